@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+// loadManifests reads and validates the manifests offline, sorted by name.
+func loadManifests(paths []string) ([]agent.CapabilityDef, error) {
+	var defs []agent.CapabilityDef
+	for _, path := range paths {
+		loaded, err := agent.LoadCapabilityManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, loaded...)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs, nil
+}
+
+func capabilitiesCmd(args []string) {
+	action, rest := subcommand("capabilities", args, "list", "export", "card", "clear-cache", "stats")
+
+	fs := flag.NewFlagSet("capabilities "+action, flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	var manifests listFlag
+	fs.Var(&manifests, "capabilities", "Capability manifest to read when the node isn't running; repeatable")
+	keyPath := fs.String("key", defaultKeyFile, "Path to the libp2p identity key (for 'card' when the node isn't running)")
+	out := fs.String("out", "", "Write the exported manifest to this file instead of stdout (for 'export')")
+	only := fs.String("capability", "", "Clear only this capability's answers (for 'clear-cache')")
+	answerDir := fs.String("answer-cache-dir", defaultAnswerCache, "Directory the reused capability answers are kept in (for 'clear-cache' when the node isn't running)")
+	days := fs.Int("days", 7, "How many days, today included, to show (for 'stats')")
+	parseFlags(fs, rest)
+
+	switch action {
+	case "clear-cache":
+		clearAnswerCache(g, *only, *answerDir)
+		return
+	case "stats":
+		capabilityStats(g, *days)
+		return
+	}
+
+	// The running node is authoritative; otherwise read the configured manifests
+	var defs []agent.CapabilityDef
+	offline := false
+	err := apiGet(g.apiAddr, "/capabilities", &defs)
+	if err == errNodeDown {
+		offline = true
+		if defs, err = loadManifests(manifests); err != nil {
+			fatalf("%v", err)
+		}
+	} else if err != nil {
+		fatalf("Failed to get capabilities: %v", err)
+	}
+	if defs == nil {
+		defs = []agent.CapabilityDef{}
+	}
+
+	switch action {
+	case "list":
+		output(defs, func() {
+			if len(defs) == 0 {
+				fmt.Println("No manifest capabilities; load some with -capabilities.")
+				return
+			}
+			fmt.Printf("%-20s %-32s %-16s %-24s %s\n", "CAPABILITY", "ID", "HANDLER", "PRICE", "DESCRIPTION")
+			for _, d := range defs {
+				id := d.ID
+				if id == "" {
+					id = "-"
+				}
+				price := "-"
+				if d.Pricing != nil {
+					price = d.Pricing.Amount + " wei"
+					if d.Pricing.Unit != "" {
+						price += "/" + d.Pricing.Unit
+					}
+				}
+				fmt.Printf("%-20s %-32s %-16s %-24s %s\n", d.Name, id, d.Handler, price, d.Description)
+			}
+		})
+
+	case "export":
+		if len(defs) == 0 {
+			preconditionf("No capabilities to export; load some with -capabilities")
+		}
+		data, err := agent.ExportCapabilityManifest(defs)
+		if err != nil {
+			fatalf("Failed to export capabilities: %v", err)
+		}
+		if *out == "" {
+			// The manifest is the result, in either output mode
+			resultOut.Write(data)
+			return
+		}
+		if err := os.WriteFile(*out, data, 0644); err != nil {
+			fatalf("Failed to write %s: %v", *out, err)
+		}
+		output(map[string]interface{}{"path": *out, "capabilities": len(defs)}, func() {
+			fmt.Printf("Exported %d capabilities to %s\n", len(defs), *out)
+		})
+
+	case "card":
+		var card agent.AgentCard
+		if offline {
+			priv, err := agent.LoadIdentity(*keyPath)
+			if err != nil {
+				preconditionf("No identity at %s; run 'agent init' first: %v", *keyPath, err)
+			}
+			pid, err := agent.PeerIDFromKey(priv)
+			if err != nil {
+				fatalf("%v", err)
+			}
+			caps := make([]agent.AgentCapability, len(defs))
+			for i, d := range defs {
+				caps[i] = d.Capability()
+			}
+			card = agent.NewAgentCard(pid.String(), caps)
+		} else if err := apiGet(g.apiAddr, "/agent-card", &card); err != nil {
+			fatalf("Failed to get agent card: %v", err)
+		}
+		// The card is a JSON document in either output mode
+		output(card, func() {
+			data, _ := json.MarshalIndent(card, "", "  ")
+			fmt.Println(string(data))
+		})
+	}
+}
+
+// clearAnswerCache drops the reused answers of one capability, or all, from
+// the running node or else straight from the database.
+func clearAnswerCache(g *globalFlags, capability, dir string) {
+	var res struct {
+		Removed int `json:"removed"`
+	}
+	err := apiDo(http.MethodDelete, g.apiAddr, "/answer-cache?capability="+url.QueryEscape(capability), &res)
+	if err == errNodeDown {
+		store := g.openStore()
+		defer store.Close()
+		res.Removed, err = agent.NewAnswerCache(store, agent.DirContentStore{Dir: dir}).Invalidate(capability)
+	}
+	if err != nil {
+		fatalf("Failed to clear the answer cache: %v", err)
+	}
+	output(res, func() {
+		fmt.Printf("Cleared %d cached answers\n", res.Removed)
+	})
+}
+
+// capabilityStats prints each capability's runs by day, from the running
+// node or else straight from the database, which knows no SLO breaches.
+func capabilityStats(g *globalFlags, days int) {
+	if days < 1 {
+		usagef("-days must be at least 1")
+	}
+	var stats agent.CapabilityStats
+	err := apiGet(g.apiAddr, fmt.Sprintf("/capabilities/stats?days=%d", days), &stats)
+	if err == errNodeDown {
+		store := g.openStore()
+		defer store.Close()
+		stats, err = agent.NewCapabilityAnalytics(store).Stats(days)
+	}
+	if err != nil {
+		fatalf("Failed to get capability stats: %v", err)
+	}
+	output(stats, func() {
+		if len(stats.Days) == 0 {
+			fmt.Printf("No capability runs in the last %d days.\n", days)
+		} else {
+			fmt.Printf("%-10s %-20s %6s %8s %9s %9s %8s %6s %s\n", "DAY", "CAPABILITY", "RUNS", "SUCCESS", "AVG", "P95", "TIMEOUTS", "PEERS", "REVENUE")
+			for _, d := range stats.Days {
+				fmt.Printf("%-10s %-20s %6d %7.1f%% %9s %9s %8d %6d %s wei\n", d.Day, d.Capability, d.Invocations, d.SuccessRate()*100,
+					time.Duration(d.AvgMillis)*time.Millisecond, time.Duration(d.P95Millis)*time.Millisecond, d.Timeouts, d.Counterparties, d.Revenue)
+			}
+		}
+		for _, b := range stats.Breaches {
+			fmt.Printf("SLO breach: %s %s is %s over the last %s, want %s\n", b.Capability, b.Objective, b.Got, b.Window, b.Want)
+		}
+	})
+}
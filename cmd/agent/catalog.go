@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"agentmesh/pkg/agent"
+)
+
+func catalogCmd(args []string) {
+	action, rest := subcommand("catalog", args, "add", "list", "remove")
+
+	fs := flag.NewFlagSet("catalog "+action, flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	var topics listFlag
+	fs.Var(&topics, "topic", "Topic tag of the listing (for 'add'; repeatable), or the tag to list (for 'list')")
+	title := fs.String("title", "", "Title of the listing (for 'add')")
+	price := fs.String("price", "", "Price of the listing in wei (for 'add')")
+	artifact := fs.String("artifact", "", "File the listing sells (for 'add')")
+	preview := fs.String("preview", "", "Text buyers see before paying (for 'add')")
+	parseFlags(fs, rest)
+
+	switch action {
+	case "add":
+		spec := agent.ListingSpec{Title: *title, Topics: topics, Price: *price, Artifact: *artifact, Preview: *preview}
+		if spec.Title == "" || spec.Price == "" || spec.Artifact == "" {
+			usagef("usage: agent catalog add -title <title> -price <wei> -artifact <file> [-topic <tag>]... [-preview <text>]")
+		}
+		var l *agent.CatalogListing
+		err := apiRequest(http.MethodPost, g.apiAddr, "/catalog", "", spec, &l, apiTimeout)
+		if err == errNodeDown {
+			// The node announces the listing from the database at its next round
+			if l, err = spec.Listing(); err == nil {
+				store := g.openStore()
+				defer store.Close()
+				err = agent.AddListing(store, l)
+			}
+		}
+		if err != nil {
+			fatalf("Failed to add the listing: %v", err)
+		}
+		output(l, func() {
+			fmt.Printf("Listed %s as %s for %s wei (artifact %s)\n", l.Title, l.ID, l.Price, l.ArtifactHash)
+		})
+
+	case "list":
+		topic := ""
+		if len(topics) > 0 {
+			topic = topics[0]
+		}
+		var listings []agent.CatalogListing
+		err := apiGet(g.apiAddr, "/catalog?topic="+url.QueryEscape(topic), &listings)
+		if err == errNodeDown {
+			store := g.openStore()
+			defer store.Close()
+			var all []agent.CatalogListing
+			all, err = store.ListListings()
+			for _, l := range all {
+				if l.HasTopic(topic) {
+					listings = append(listings, l)
+				}
+			}
+		}
+		if err != nil {
+			fatalf("Failed to list the catalog: %v", err)
+		}
+		if listings == nil {
+			listings = []agent.CatalogListing{}
+		}
+		output(listings, func() {
+			if len(listings) == 0 {
+				fmt.Println("Nothing listed; add a listing with 'agent catalog add'.")
+				return
+			}
+			fmt.Printf("%-18s %-28s %-22s %-10s %s\n", "ID", "TITLE", "PRICE (wei)", "SIZE", "TOPICS")
+			for _, l := range listings {
+				fmt.Printf("%-18s %-28s %-22s %-10d %s\n", l.ID, l.Title, l.Price, l.Size, orDash(strings.Join(l.Topics, ",")))
+			}
+		})
+
+	case "remove":
+		if fs.NArg() != 1 {
+			usagef("usage: agent catalog remove [flags] <id>")
+		}
+		id := fs.Arg(0)
+		err := apiDo(http.MethodDelete, g.apiAddr, "/catalog/"+url.PathEscape(id), nil)
+		if err == errNodeDown {
+			store := g.openStore()
+			defer store.Close()
+			l, gerr := store.GetListing(id)
+			if gerr != nil {
+				fatalf("Failed to read listing %s: %v", id, gerr)
+			}
+			if l == nil {
+				preconditionf("No listing %s", id)
+			}
+			err = store.DeleteListing(id)
+		}
+		if err != nil {
+			fatalf("Failed to remove listing %s: %v", id, err)
+		}
+		output(map[string]string{"id": id, "status": "removed"}, func() {
+			fmt.Printf("Removed listing %s\n", id)
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+// Defaults shared by every subcommand.
+const (
+	defaultDB          = "agent_metadata.db"
+	defaultRPC         = "https://sepolia.base.org"
+	defaultIdentityReg = "0x8004A169FB4a3325136EB29fA0ceB6D2e539a432"
+	defaultKeyFile     = "agent_identity.key"
+	defaultWalletFile  = "agent_wallet.key"
+	defaultAnswerCache = "answer-cache"
+	defaultEscrow      = "0x591ee5158c94d736ce9bf544bc03247d14904061"
+	defaultMarket      = "0x051509a30a62b1ea250eef5ad924d0690a4d20e6"
+	zeroAddress        = "0x0000000000000000000000000000000000000000"
+)
+
+// apiTimeout keeps CLI commands snappy when no node is running.
+const apiTimeout = 2 * time.Second
+
+// apiSecret signs API requests for a node run with -api-auth hmac, and is the
+// secret such a node checks them with.
+var apiSecret string
+
+type globalFlags struct {
+	dbDriver string
+	dbPath   string
+	apiAddr  string
+}
+
+func addGlobalFlags(fs *flag.FlagSet) *globalFlags {
+	g := &globalFlags{}
+	fs.StringVar(&g.dbDriver, "db-driver", agent.DriverSQLite, "Metadata database driver (sqlite or postgres)")
+	fs.StringVar(&g.dbPath, "db", defaultDB, "Path to metadata database, or DSN when -db-driver=postgres")
+	fs.StringVar(&g.apiAddr, "api", agent.DefaultAPIAddr, "Address of the node's local control API")
+	fs.StringVar(&apiSecret, "api-secret", "", "Shared secret API requests are signed with, for a node run with -api-auth hmac")
+	addOutputFlags(fs)
+	return g
+}
+
+type chainFlags struct {
+	rpcURL     string
+	identAddr  string
+	walletPath string
+	dryRun     bool
+	maxSpend   string
+	batchSize  int
+	strictBind bool
+	scanWorker int
+	scanRate   float64
+	scanner    *agent.LogScanner // built from -scan-workers and -scan-rate on first use
+	rpcReads   int
+	reserved   int
+	pool       *agent.RPCReadPool // built from -rpc-reads and -rpc-interactive-reserved on first use
+	readBlock  string
+	noRPCCache bool
+	rpcTTL     time.Duration
+	store      agent.MetadataStore // keeps the RPC cache across restarts, if set
+}
+
+func addChainFlags(fs *flag.FlagSet) *chainFlags {
+	c := &chainFlags{}
+	fs.StringVar(&c.rpcURL, "rpc", defaultRPC, "Ethereum RPC URL")
+	fs.StringVar(&c.identAddr, "identity", defaultIdentityReg, "ERC-8004 IdentityRegistry address")
+	fs.StringVar(&c.walletPath, "wallet", defaultWalletFile, "Path to the hex-encoded wallet private key")
+	fs.BoolVar(&c.dryRun, "dry-run", false, "Simulate transactions with eth_call/eth_estimateGas instead of sending them")
+	fs.IntVar(&c.batchSize, "summary-batch-size", agent.DefaultSummaryBatchSize, "Client addresses sent per reputation getSummary call; lower it if long lookups revert")
+	fs.BoolVar(&c.strictBind, "strict-peer-binding", false, "Ignore a published peerId unless its peerIdBinding is signed by the peer key for the agent's owner")
+	fs.IntVar(&c.scanWorker, "scan-workers", agent.DefaultScanWorkers, "eth_getLogs calls in flight at once when scanning block ranges")
+	fs.Float64Var(&c.scanRate, "scan-rate", 0, "Most eth_getLogs calls per second when scanning block ranges (0 for no limit)")
+	fs.IntVar(&c.rpcReads, "rpc-reads", agent.DefaultRPCReads, "Contract reads in flight at once across the node's chain clients; more wait their turn (0 for no limit)")
+	fs.IntVar(&c.reserved, "rpc-interactive-reserved", agent.DefaultInteractiveReserved, "Of -rpc-reads, slots kept for reads answering the readiness probe, so background reads can't hold them up")
+	fs.StringVar(&c.readBlock, "read-block", string(agent.BlockLatest), "Block contract reads see: latest, safe, finalized or a block number")
+	fs.BoolVar(&c.noRPCCache, "no-rpc-cache", false, "Send every read to the RPC instead of reusing answers that can't change and, briefly, those about the latest block")
+	fs.DurationVar(&c.rpcTTL, "rpc-cache-ttl", agent.DefaultRPCCacheTTL, "How long answers about the latest block are reused")
+	fs.StringVar(&c.maxSpend, "max-spend", "", "Most wei sent transactions may cost per 24h, gas and value included (empty for no limit; simulations are free)")
+	return c
+}
+
+// ercClient dials the identity registry. Reputation and validation registries
+// are not needed by the CLI.
+func (c *chainFlags) ercClient() (*agent.ERC8004Client, error) {
+	client := agent.NewERC8004Client(c.rpcURL, c.identAddr, zeroAddress, zeroAddress)
+	if client == nil {
+		return nil, fmt.Errorf("failed to connect to RPC %s", c.rpcURL)
+	}
+	if err := c.configure(client); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// logScanner returns the scanner for -scan-workers and -scan-rate. Every
+// caller gets the same one, so the rate limit covers all of them.
+func (c *chainFlags) logScanner() *agent.LogScanner {
+	if c.scanner == nil {
+		c.scanner = agent.NewLogScanner(c.scanWorker, c.scanRate)
+	}
+	return c.scanner
+}
+
+// readPool returns the pool every client of the command shares, or nil
+// with -rpc-reads 0.
+func (c *chainFlags) readPool() *agent.RPCReadPool {
+	if c.pool == nil && c.rpcReads > 0 {
+		c.pool = agent.NewRPCReadPool(c.rpcReads, c.reserved)
+	}
+	return c.pool
+}
+
+// configure applies -dry-run, -summary-batch-size, -strict-peer-binding,
+// -scan-workers, -scan-rate, the read pool flags, -read-block, the RPC cache
+// flags and -max-spend to a client.
+// The RPC cache only covers HTTP endpoints.
+func (c *chainFlags) configure(client *agent.ERC8004Client) error {
+	client.SetDryRun(c.dryRun)
+	client.SetSummaryBatchSize(c.batchSize)
+	client.SetStrictPeerBinding(c.strictBind)
+	client.SetLogScanner(c.logScanner())
+	client.SetReadPool(c.readPool())
+	block, err := agent.ParseBlockTag(c.readBlock)
+	if err != nil {
+		return fmt.Errorf("-read-block: %w", err)
+	}
+	client.SetBlockTag(block)
+	if !c.noRPCCache && strings.HasPrefix(strings.ToLower(client.RPCURL()), "http") {
+		cache := agent.NewRPCCache(c.store)
+		cache.TTL = c.rpcTTL
+		if err := client.UseRPCCache(cache); err != nil {
+			return fmt.Errorf("failed to set up the RPC cache: %w", err)
+		}
+	}
+	if c.maxSpend == "" {
+		return nil
+	}
+	limit, ok := new(big.Int).SetString(c.maxSpend, 10)
+	if !ok || limit.Sign() < 0 {
+		return fmt.Errorf("invalid -max-spend %q: want an amount in wei", c.maxSpend)
+	}
+	client.SetGovernor(agent.NewTxGovernor(limit, agent.DefaultSpendWindow))
+	return nil
+}
+
+// ledgerFlags shape the local reputation ledger. 'peers reputation' takes
+// them too, to decay scores the way the node does when reading the database.
+type ledgerFlags struct {
+	halfLife  time.Duration
+	weights   string
+	maxImpact float64
+	floor     float64
+	ceiling   float64
+}
+
+func addLedgerFlags(fs *flag.FlagSet) *ledgerFlags {
+	d := agent.DefaultLedgerConfig()
+	l := &ledgerFlags{}
+	fs.DurationVar(&l.halfLife, "ledger-half-life", d.HalfLife, "How long a local reputation score takes to decay halfway back to neutral")
+	fs.StringVar(&l.weights, "ledger-weights", "", "Local reputation change per interaction over the defaults, e.g. dispute=-8,timeout=-0.5")
+	fs.Float64Var(&l.maxImpact, "ledger-max-impact", d.MaxImpact, "Most a single interaction moves a local reputation score")
+	fs.Float64Var(&l.floor, "ledger-floor", d.Floor, "Lowest local reputation score")
+	fs.Float64Var(&l.ceiling, "ledger-ceiling", d.Ceiling, "Highest local reputation score")
+	return l
+}
+
+// config validates the -ledger-* flags.
+func (l *ledgerFlags) config() (agent.LedgerConfig, error) {
+	weights, err := agent.ParseLedgerWeights(l.weights)
+	if err != nil {
+		return agent.LedgerConfig{}, fmt.Errorf("-ledger-weights: %w", err)
+	}
+	c := agent.LedgerConfig{HalfLife: l.halfLife, Weights: weights, Floor: l.floor, Ceiling: l.ceiling, MaxImpact: l.maxImpact}
+	if err := c.Validate(); err != nil {
+		return agent.LedgerConfig{}, fmt.Errorf("-ledger-*: %w", err)
+	}
+	return c, nil
+}
+
+// misbehaviorFlags shape how the node scores and bans misbehaving peers.
+// 'peers show' takes them too, to decay scores the way the node does when
+// reading the database.
+type misbehaviorFlags struct {
+	points    string
+	halfLife  time.Duration
+	threshold float64
+	ban       time.Duration
+	maxBan    time.Duration
+}
+
+func addMisbehaviorFlags(fs *flag.FlagSet) *misbehaviorFlags {
+	d := agent.DefaultMisbehaviorConfig()
+	m := &misbehaviorFlags{}
+	fs.StringVar(&m.points, "misbehavior-points", "", "Misbehavior score per violation over the defaults, e.g. oversized=40,protocol_error=5")
+	fs.DurationVar(&m.halfLife, "misbehavior-half-life", d.HalfLife, "How long a peer's misbehavior score takes to decay halfway to 0")
+	fs.Float64Var(&m.threshold, "ban-threshold", d.Threshold, "Misbehavior score at which a peer is temporarily banned")
+	fs.DurationVar(&m.ban, "ban-duration", d.Ban, "Length of a peer's first ban; each later ban doubles it")
+	fs.DurationVar(&m.maxBan, "ban-max", d.MaxBan, "Longest temporary ban")
+	return m
+}
+
+// config validates the misbehavior flags.
+func (m *misbehaviorFlags) config() (agent.MisbehaviorConfig, error) {
+	points, err := agent.ParseMisbehaviorPoints(m.points)
+	if err != nil {
+		return agent.MisbehaviorConfig{}, fmt.Errorf("-misbehavior-points: %w", err)
+	}
+	c := agent.MisbehaviorConfig{Points: points, HalfLife: m.halfLife, Threshold: m.threshold, Ban: m.ban, MaxBan: m.maxBan}
+	if err := c.Validate(); err != nil {
+		return agent.MisbehaviorConfig{}, fmt.Errorf("misbehavior flags: %w", err)
+	}
+	return c, nil
+}
+
+// printSimulations describes the transactions a dry run would have sent.
+func printSimulations(sims []agent.TxSimulation) {
+	for _, s := range sims {
+		if s.Reverted {
+			fmt.Printf("Dry run: %s on %s would revert: %s\n", s.Method, s.To, s.RevertReason)
+		} else {
+			fmt.Printf("Dry run: %s on %s would use %d gas, costing up to %s wei\n", s.Method, s.To, s.Gas, s.Cost)
+		}
+	}
+}
+
+// errNodeDown is returned by the API helpers when no node answers on the API
+// address, so callers can fall back to reading the DB or chain directly.
+var errNodeDown = errors.New("node is not running")
+
+func apiGet(addr, path string, out interface{}) error {
+	return apiDo(http.MethodGet, addr, path, out)
+}
+
+func apiPost(addr, path string, out interface{}) error {
+	return apiDo(http.MethodPost, addr, path, out)
+}
+
+func apiDo(method, addr, path string, out interface{}) error {
+	return apiDoTimeout(method, addr, path, out, apiTimeout)
+}
+
+func apiDoTimeout(method, addr, path string, out interface{}, timeout time.Duration) error {
+	var in interface{}
+	if method != http.MethodGet {
+		// The API only accepts JSON for requests that change state
+		in = struct{}{}
+	}
+	return apiRequest(method, addr, path, "", in, out, timeout)
+}
+
+// apiRequest calls the node API with in, if not nil, as the JSON body, and
+// token, if set, as the bearer token the /v1 routes need. With -api-secret
+// set the request is signed too.
+func apiRequest(method, addr, path, token string, in, out interface{}, timeout time.Duration) error {
+	var reqBody io.Reader
+	var raw []byte
+	if in != nil {
+		var err error
+		if raw, err = json.Marshal(in); err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, "http://"+addr+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if apiSecret != "" {
+		agent.SignAPIRequest(req, raw, apiSecret, time.Now())
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errNodeDown
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("node returned %d: %s", resp.StatusCode, apiErr.Error)
+		}
+		return fmt.Errorf("node returned %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// openStore opens the metadata database directly, for when no node is running.
+func (g *globalFlags) openStore() agent.MetadataStore {
+	store, err := agent.OpenMetadataStore(g.dbDriver, g.dbPath)
+	if err != nil {
+		fatalf("Failed to open database: %v", err)
+	}
+	return store
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+// completionTimeout bounds how long a dynamic completion may wait on the node
+// API; after that it falls back to the database, then to nothing.
+const completionTimeout = 300 * time.Millisecond
+
+// Top-level commands and their actions, as offered by completion.
+var (
+	commands = []string{"init", "run", "register", "status", "top", "diagnostics", "doctor", "tasks", "peers", "capabilities", "catalog", "history", "wallet", "escrow", "keys", "sign", "verify", "config", "record", "simulate", "mcp", "completion", "help"}
+	actions  = map[string][]string{
+		"tasks":        {"list", "show"},
+		"peers":        {"list", "show", "block", "routes", "reputation"},
+		"capabilities": {"list", "export", "card", "clear-cache", "stats"},
+		"catalog":      {"add", "list", "remove"},
+		"history":      {"list", "verify"},
+		"wallet":       {"address", "balance", "budget"},
+		"escrow":       {"show", "bid", "submit", "claim"},
+		"keys":         {"rotate"},
+		"config":       {"list", "get", "set", "unset"},
+		"mcp":          {"serve"},
+		"completion":   {"bash", "zsh", "fish"},
+	}
+)
+
+func completionCmd(args []string) {
+	shell, _ := subcommand("completion", args, actions["completion"]...)
+	prog := filepath.Base(os.Args[0])
+	fn := "_" + regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(prog, "_") + "_complete"
+
+	switch shell {
+	case "bash":
+		fmt.Printf(`# bash completion for %[1]s. Load with: source <(%[1]s completion bash)
+%[2]s() {
+	local IFS=$'\n'
+	COMPREPLY=($(%[1]s __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F %[2]s %[1]s
+`, prog, fn)
+	case "zsh":
+		fmt.Printf(`#compdef %[1]s
+# zsh completion for %[1]s. Load with: source <(%[1]s completion zsh)
+%[2]s() {
+	local -a candidates
+	candidates=("${(@f)$(%[1]s __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	compadd -a candidates
+}
+compdef %[2]s %[1]s
+`, prog, fn)
+	case "fish":
+		fmt.Printf(`# fish completion for %[1]s. Load with: %[1]s completion fish | source
+complete -c %[1]s -f -a '(%[1]s __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+`, prog)
+	}
+}
+
+// completeCmd implements the hidden '__complete' command the shell scripts
+// call: args are the words after the program name, the last being the word
+// under the cursor. Candidates are printed one per line.
+func completeCmd(args []string) {
+	for _, c := range complete(args) {
+		fmt.Println(c)
+	}
+}
+
+// complete returns the candidates for the last word of args.
+func complete(args []string) []string {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	cur := args[len(args)-1]
+	words := args[:len(args)-1]
+
+	if strings.HasPrefix(cur, "-") {
+		return filterPrefix(completeFlags(), cur)
+	}
+	// The word after a flag taking a value is that value; leave it to the shell
+	if n := len(words); n > 0 && strings.HasPrefix(words[n-1], "-") && !strings.Contains(words[n-1], "=") && !isBoolFlag(words[n-1]) {
+		return nil
+	}
+
+	// Positional words, skipping flags and their values
+	var pos []string
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if strings.HasPrefix(w, "-") {
+			if !strings.Contains(w, "=") && !isBoolFlag(w) {
+				i++
+			}
+			continue
+		}
+		pos = append(pos, w)
+	}
+
+	switch len(pos) {
+	case 0:
+		return filterPrefix(commands, cur)
+	case 1:
+		return filterPrefix(actions[pos[0]], cur)
+	case 2:
+		switch pos[0] + " " + pos[1] {
+		case "tasks show":
+			return filterPrefix(completeTaskIDs(completionGlobals(words)), cur)
+		case "peers show", "peers block":
+			return filterPrefix(completePeerIDs(completionGlobals(words)), cur)
+		case "config get", "config set", "config unset":
+			var keys []string
+			for _, f := range configSchema() {
+				keys = append(keys, f.Name)
+			}
+			return filterPrefix(keys, cur)
+		}
+	}
+	return nil
+}
+
+// completeTaskIDs lists task IDs from the running node, or from the DB when
+// the node is down. Errors yield no candidates.
+func completeTaskIDs(g *globalFlags) []string {
+	var tasks []agent.TaskRecord
+	if err := apiDoTimeout(http.MethodGet, g.apiAddr, "/tasks", &tasks, completionTimeout); err != nil {
+		store := completionStore(g)
+		if store == nil {
+			return nil
+		}
+		defer store.Close()
+		if tasks, err = store.ListTasks(500); err != nil {
+			return nil
+		}
+	}
+	ids := make([]string, len(tasks))
+	for i, t := range tasks {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+// completePeerIDs lists known peer IDs the same way as completeTaskIDs.
+func completePeerIDs(g *globalFlags) []string {
+	var peers []agent.PeerRecord
+	if err := apiDoTimeout(http.MethodGet, g.apiAddr, "/peers", &peers, completionTimeout); err != nil {
+		store := completionStore(g)
+		if store == nil {
+			return nil
+		}
+		defer store.Close()
+		if peers, err = store.ListPeers(); err != nil {
+			return nil
+		}
+	}
+	ids := make([]string, len(peers))
+	for i, p := range peers {
+		ids[i] = p.PeerID
+	}
+	return ids
+}
+
+// completionStore opens the metadata DB read-only: it never creates a SQLite
+// file, migrates or prints, and yields nothing when the DB was written by a
+// different version of the binary.
+func completionStore(g *globalFlags) agent.MetadataStore {
+	if g.dbDriver == agent.DriverSQLite {
+		if _, err := os.Stat(g.dbPath); err != nil {
+			return nil
+		}
+	}
+	store, err := agent.OpenMetadataStoreReadOnly(g.dbDriver, g.dbPath)
+	if err != nil {
+		return nil
+	}
+	return store
+}
+
+// completionGlobals resolves -db, -db-driver and -api from the words typed so
+// far and the config file, so completion reads the same node as the command.
+func completionGlobals(words []string) *globalFlags {
+	g := &globalFlags{dbDriver: agent.DriverSQLite, dbPath: defaultDB, apiAddr: agent.DefaultAPIAddr}
+	configPath := defaultConfigFile
+	set := map[string]string{}
+	for i, w := range words {
+		name := strings.TrimLeft(w, "-")
+		if name == w {
+			continue
+		}
+		if k, v, ok := strings.Cut(name, "="); ok {
+			set[k] = v
+		} else if i+1 < len(words) {
+			set[name] = words[i+1]
+		}
+	}
+	if v, ok := set["config"]; ok {
+		configPath = v
+	}
+	if cfg, err := loadConfig(configPath); err == nil {
+		for k, v := range cfg {
+			if _, ok := set[k]; !ok {
+				set[k] = v.String()
+			}
+		}
+	}
+	if v, ok := set["db-driver"]; ok {
+		g.dbDriver = v
+	}
+	if v, ok := set["db"]; ok {
+		g.dbPath = v
+	}
+	if v, ok := set["api"]; ok {
+		g.apiAddr = v
+	}
+	return g
+}
+
+func completeFlags() []string {
+	var names []string
+	for _, f := range configSchema() {
+		names = append(names, "-"+f.Name)
+	}
+	return append(names, "-config")
+}
+
+func isBoolFlag(w string) bool {
+	name := strings.TrimLeft(w, "-")
+	if name == "config" {
+		// Added by parseFlags rather than the schema
+		return false
+	}
+	f := schemaFlags().Lookup(name)
+	if f == nil {
+		// Command-specific flags the schema doesn't know; most are boolean switches
+		return true
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func filterPrefix(candidates []string, prefix string) []string {
+	var out []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
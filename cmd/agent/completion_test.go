@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"agentmesh/pkg/agent"
+)
+
+// downAPI is an address with nothing listening, so completion falls back to
+// the database.
+const downAPI = "127.0.0.1:1"
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+// newCompletionDB creates a migrated database holding one task.
+func newCompletionDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agentmesh.db")
+	captureStdout(t, func() {
+		store, err := agent.OpenMetadataStore(agent.DriverSQLite, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		if err := store.SaveTask(agent.TaskRecord{ID: "task:42", Kind: agent.TaskKindEscrow, Status: agent.TaskStatusReceived}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.TouchPeer("12D3KooWPeer", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return path
+}
+
+func completeWith(db string, words ...string) []string {
+	args := append([]string{"-config", "/nonexistent/agentmesh.json", "-api", downAPI, "-db", db}, words...)
+	return complete(args)
+}
+
+func TestCompleteWords(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"ta"}, []string{"tasks"}},
+		{[]string{"peers", ""}, []string{"list", "show", "block", "routes", "reputation"}},
+		{[]string{"keys", "r"}, []string{"rotate"}},
+		{[]string{"config", "get", "max-ho"}, []string{"max-hops"}},
+		{[]string{"run", "-db", ""}, nil},              // a flag's value is left to the shell
+		{[]string{"-json", "wal"}, []string{"wallet"}}, // bool flags take no value
+		{[]string{"-max-"}, []string{"-max-block-lag", "-max-decompressed", "-max-head-lag", "-max-hops", "-max-spend"}},
+	}
+	for _, tt := range tests {
+		got := complete(tt.args)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("complete(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCompleteIDsFromDatabase(t *testing.T) {
+	db := newCompletionDB(t)
+	var tasks, peers []string
+	out := captureStdout(t, func() {
+		tasks = completeWith(db, "tasks", "show", "task")
+		peers = completeWith(db, "peers", "block", "")
+	})
+	if !reflect.DeepEqual(tasks, []string{"task:42"}) {
+		t.Errorf("task IDs = %q", tasks)
+	}
+	if !reflect.DeepEqual(peers, []string{"12D3KooWPeer"}) {
+		t.Errorf("peer IDs = %q", peers)
+	}
+	// Anything on stdout would become a completion candidate
+	if out != "" {
+		t.Errorf("completion printed %q", out)
+	}
+}
+
+func TestCompleteSkipsMismatchedSchema(t *testing.T) {
+	db := newCompletionDB(t)
+	raw, err := sql.Open(agent.DriverSQLite, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'from the future', 0)", agent.LatestSchemaVersion()+1)
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	out := captureStdout(t, func() { got = completeWith(db, "tasks", "show", "") })
+	if got != nil || out != "" {
+		t.Errorf("newer schema: candidates %q, output %q; want neither", got, out)
+	}
+
+	// The database is left as the newer binary wrote it
+	raw, _ = sql.Open(agent.DriverSQLite, db)
+	defer raw.Close()
+	var version int
+	raw.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if version != agent.LatestSchemaVersion()+1 {
+		t.Errorf("schema version changed to %d", version)
+	}
+}
+
+func TestCompleteDoesNotCreateDatabase(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "missing.db")
+	if got := completeWith(db, "tasks", "show", ""); got != nil {
+		t.Errorf("candidates %q from a missing database", got)
+	}
+	if _, err := os.Stat(db); !os.IsNotExist(err) {
+		t.Errorf("completion created %s", db)
+	}
+}
+
+func TestCompleteOldSchemaIsNotMigrated(t *testing.T) {
+	db := newCompletionDB(t)
+	raw, err := sql.Open(agent.DriverSQLite, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec("DELETE FROM schema_migrations WHERE version = ?", agent.LatestSchemaVersion())
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := completeWith(db, "tasks", "show", ""); got != nil {
+		t.Errorf("older schema: candidates %q, want none", got)
+	}
+	raw, _ = sql.Open(agent.DriverSQLite, db)
+	defer raw.Close()
+	var version int
+	raw.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if version != agent.LatestSchemaVersion()-1 {
+		t.Errorf("completion migrated the database to %d", version)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// defaultConfigFile is read by every command when present.
+const defaultConfigFile = "agentmesh.json"
+
+// fileConfig is the config file written by 'agent init'. Keys are flag names
+// (e.g. "rpc", "workspace"), so any flag can be set in the file; flags given
+// on the command line take precedence.
+type fileConfig map[string]configValue
+
+// configValue is a config file value: a string, or a list of strings for
+// list flags such as "capabilities". Numbers and booleans are accepted as
+// written.
+type configValue []string
+
+func (v *configValue) UnmarshalJSON(data []byte) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(data, &list); err != nil {
+		list = []json.RawMessage{data}
+	}
+	*v = configValue{}
+	for _, raw := range list {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			// Keep 12 or true as the flag would read them
+			var scalar interface{}
+			if err := json.Unmarshal(raw, &scalar); err != nil {
+				return err
+			}
+			switch scalar.(type) {
+			case float64, bool:
+				s = string(raw)
+			default:
+				return fmt.Errorf("want a string or a list of strings, got %s", raw)
+			}
+		}
+		*v = append(*v, s)
+	}
+	return nil
+}
+
+func (v configValue) MarshalJSON() ([]byte, error) {
+	if len(v) == 1 {
+		return json.Marshal(v[0])
+	}
+	return json.Marshal([]string(v))
+}
+
+func (v configValue) String() string {
+	return strings.Join(v, ",")
+}
+
+// listFlag is a flag that may be repeated or given comma-separated values;
+// in the config file it is a JSON list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func isListFlag(f *flag.Flag) bool {
+	_, ok := f.Value.(*listFlag)
+	return ok
+}
+
+func loadConfig(path string) (fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func saveConfig(path string, cfg fileConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// applyConfig sets every flag of fs named in cfg that was not given explicitly.
+// Keys for flags the command doesn't have are ignored.
+func applyConfig(fs *flag.FlagSet, cfg fileConfig) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for name, values := range cfg {
+		f := fs.Lookup(name)
+		if explicit[name] || f == nil {
+			continue
+		}
+		if len(values) != 1 && !isListFlag(f) {
+			return fmt.Errorf("config key %q: want a single value, got %d", name, len(values))
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("config key %q: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// createsConfig reports whether the command writes the config file, in which
+// case an explicit -config path need not exist yet.
+func createsConfig(fs *flag.FlagSet) bool {
+	return fs.Name() == "init" || fs.Name() == "config set"
+}
+
+// schemaFlags returns a fresh set of the flags that may appear in the config
+// file: the flags of 'agent run', which include every shared flag.
+func schemaFlags() *flag.FlagSet {
+	// Defining the flags resets the output mode globals to their defaults
+	mode, alias := outputMode, jsonAlias
+	fs, _ := newRunFlags()
+	outputMode, jsonAlias = mode, alias
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// configSchema lists the config keys sorted by name.
+func configSchema() []*flag.Flag {
+	var flags []*flag.Flag
+	schemaFlags().VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+type configEntry struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Default string `json:"default"`
+	Set     bool   `json:"set"` // present in the config file
+	Usage   string `json:"usage"`
+}
+
+func configCmd(args []string) {
+	action, rest := subcommand("config", args, "list", "get", "set", "unset")
+
+	fs := flag.NewFlagSet("config "+action, flag.ExitOnError)
+	addOutputFlags(fs)
+	parseFlags(fs, rest)
+	path := fs.Lookup("config").Value.String()
+
+	cfg, err := loadConfig(path)
+	if os.IsNotExist(err) {
+		cfg, err = fileConfig{}, nil
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	schema := map[string]*flag.Flag{}
+	for _, f := range configSchema() {
+		schema[f.Name] = f
+	}
+	key := func() string {
+		if fs.NArg() < 1 {
+			usagef("usage: agent config %s <key>", action)
+		}
+		if schema[fs.Arg(0)] == nil {
+			usagef("unknown config key %q (see 'agent config list')", fs.Arg(0))
+		}
+		return fs.Arg(0)
+	}
+
+	switch action {
+	case "list":
+		entries := []configEntry{}
+		for _, f := range configSchema() {
+			value, set := cfg[f.Name].String(), cfg[f.Name] != nil
+			if !set {
+				value = f.DefValue
+			}
+			entries = append(entries, configEntry{Key: f.Name, Value: value, Default: f.DefValue, Set: set, Usage: f.Usage})
+		}
+		output(entries, func() {
+			fmt.Printf("# %s\n", path)
+			for _, e := range entries {
+				marker := " "
+				if e.Set {
+					marker = "*"
+				}
+				fmt.Printf("%s %-16s %-40s %s\n", marker, e.Key, e.Value, e.Usage)
+			}
+			fmt.Println("\n* set in the config file; other values are defaults")
+		})
+
+	case "get":
+		k := key()
+		value, set := cfg[k].String(), cfg[k] != nil
+		if !set {
+			value = schema[k].DefValue
+		}
+		output(configEntry{Key: k, Value: value, Default: schema[k].DefValue, Set: set, Usage: schema[k].Usage}, func() {
+			fmt.Println(value)
+		})
+
+	case "set":
+		k := key()
+		values := configValue(fs.Args()[1:])
+		if len(values) == 0 || (len(values) > 1 && !isListFlag(schema[k])) {
+			usagef("usage: agent config set <key> <value> (list keys take several values)")
+		}
+		// Validate the value the same way the flag would parse it
+		check := schemaFlags()
+		for _, v := range values {
+			if err := check.Set(k, v); err != nil {
+				usagef("invalid value for %s: %v", k, err)
+			}
+		}
+		cfg[k] = values
+		if err := saveConfig(path, cfg); err != nil {
+			fatalf("Failed to write %s: %v", path, err)
+		}
+		output(configEntry{Key: k, Value: values.String(), Default: schema[k].DefValue, Set: true, Usage: schema[k].Usage}, func() {
+			fmt.Printf("%s = %s\n", k, values)
+		})
+
+	case "unset":
+		k := key()
+		delete(cfg, k)
+		if err := saveConfig(path, cfg); err != nil {
+			fatalf("Failed to write %s: %v", path, err)
+		}
+		output(configEntry{Key: k, Value: schema[k].DefValue, Default: schema[k].DefValue, Usage: schema[k].Usage}, func() {
+			fmt.Printf("%s reset to default (%s)\n", k, schema[k].DefValue)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigListValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agentmesh.json")
+	body := `{"capabilities": ["./caps/summarize.yaml", "./caps/search.yaml"], "max-hops": 5, "forward": true, "rpc": "http://rpc"}`
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, o := newRunFlags()
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"./caps/summarize.yaml", "./caps/search.yaml"}; !reflect.DeepEqual([]string(o.capabilities), want) {
+		t.Errorf("capabilities = %v, want %v", o.capabilities, want)
+	}
+	if o.maxHops != 5 || !o.forward || o.rpcURL != "http://rpc" {
+		t.Errorf("scalars not applied: max-hops=%d forward=%t rpc=%q", o.maxHops, o.forward, o.rpcURL)
+	}
+
+	// Saving keeps lists as lists and scalars as strings
+	if err := saveConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	data, _ := os.ReadFile(path)
+	json.Unmarshal(data, &raw)
+	if _, ok := raw["capabilities"].([]interface{}); !ok {
+		t.Errorf("capabilities saved as %T, want a list", raw["capabilities"])
+	}
+	if _, ok := raw["rpc"].(string); !ok {
+		t.Errorf("rpc saved as %T, want a string", raw["rpc"])
+	}
+}
+
+func TestConfigListOnlyForListFlags(t *testing.T) {
+	var cfg fileConfig
+	if err := json.Unmarshal([]byte(`{"rpc": ["a", "b"]}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	fs, _ := newRunFlags()
+	fs.SetOutput(io.Discard)
+	fs.Parse(nil)
+	if err := applyConfig(fs, cfg); err == nil || !strings.Contains(err.Error(), `"rpc"`) {
+		t.Errorf("applyConfig = %v, want an error naming rpc", err)
+	}
+}
+
+func TestCommandLineListOverridesConfig(t *testing.T) {
+	cfg := fileConfig{"capabilities": {"from-config.yaml"}}
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	var caps listFlag
+	fs.Var(&caps, "capabilities", "")
+	if err := fs.Parse([]string{"-capabilities", "a.yaml,b.yaml", "-capabilities", "c.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.yaml", "b.yaml", "c.yaml"}; !reflect.DeepEqual([]string(caps), want) {
+		t.Errorf("capabilities = %v, want %v", caps, want)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+// diagnosticsTimeout covers the RPC calls a node makes to measure its lag and
+// readiness.
+const diagnosticsTimeout = 15 * time.Second
+
+// secretFlags have their values replaced in diagnostics.
+var secretFlags = map[string]bool{"api-token": true, "api-secret": true, "eval-api-key": true}
+
+// urlFlags may carry credentials in their userinfo, path or query, as RPC
+// providers' API keys often are.
+var urlFlags = map[string]bool{"rpc": true, "otlp-endpoint": true, "eval-url": true, "metrics-push": true, "db": true}
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+const redacted = "[redacted]"
+
+// diagnosticConfig returns the effective value of every flag in fs, with
+// secrets redacted.
+func diagnosticConfig(fs *flag.FlagSet) map[string]string {
+	cfg := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch {
+		case v == "":
+		case secretFlags[f.Name]:
+			v = redacted
+		case urlFlags[f.Name]:
+			v = redactURL(v)
+		}
+		cfg[f.Name] = v
+	})
+	return cfg
+}
+
+// redactURL keeps the scheme and host of a URL, dropping the rest when it is
+// set. Of values that aren't URLs, like SQLite paths and key=value Postgres
+// DSNs, only a password setting is redacted.
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return dsnPassword.ReplaceAllString(v, "password="+redacted)
+	}
+	if u.User == nil && (u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == "" {
+		return v
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+func diagnosticsCmd(args []string) {
+	fs, o := newRunFlags()
+	fs.Init("diagnostics", flag.ExitOnError)
+	outPath := fs.String("out", "diagnostics.json", "File the diagnostics dump is written to")
+	parseFlags(fs, args)
+	g := o.globalFlags
+
+	var d agent.Diagnostics
+	err := apiDoTimeout(http.MethodGet, g.apiAddr, "/diagnostics", &d, diagnosticsTimeout)
+	switch err {
+	case nil:
+		if d.Config == nil {
+			d.Config = diagnosticConfig(fs)
+		}
+	case errNodeDown:
+		d = offlineDiagnostics(fs, o)
+	default:
+		fatalf("Diagnostics query failed: %v", err)
+	}
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		fatalf("Failed to encode diagnostics: %v", err)
+	}
+	if err := os.WriteFile(*outPath, append(data, '\n'), 0600); err != nil {
+		fatalf("Failed to write %s: %v", *outPath, err)
+	}
+
+	output(d, func() {
+		if !d.Running {
+			fmt.Printf("Node is not running (no API at %s); collected what the database, key and RPC show\n", g.apiAddr)
+		}
+		fmt.Printf("Peer ID:      %s\n", d.Status.PeerID)
+		fmt.Printf("Peers:        %d connected\n", len(d.Peers))
+		if w := d.Watcher; w != nil {
+			lag := fmt.Sprintf("%d blocks behind", w.Lag)
+			if w.LagError != "" {
+				lag = "lag unknown: " + w.LagError
+			}
+			fmt.Printf("Watcher:      checkpoint %d, %s\n", w.Checkpoint, lag)
+		}
+		if d.Readiness != nil && !d.Readiness.Ready {
+			fmt.Printf("Readiness:    not ready\n")
+		}
+		fmt.Printf("Errors:       %d recent\n", len(d.RecentErrors))
+		fmt.Printf("Written to %s\n", *outPath)
+	})
+}
+
+// offlineDiagnostics collects what can be known about a stopped node: its
+// identity and configured addresses, the database and the watcher's
+// checkpoint against the chain head. Connections, caches and recent errors
+// only exist in a running node.
+func offlineDiagnostics(fs *flag.FlagSet, o *runFlags) agent.Diagnostics {
+	d := agent.Diagnostics{
+		GeneratedAt:  time.Now().UnixMilli(),
+		Peers:        []agent.ConnectedPeer{},
+		Caches:       []agent.CacheStats{},
+		RecentErrors: []agent.NodeEvent{},
+		Config:       diagnosticConfig(fs),
+	}
+	if priv, err := agent.LoadIdentity(o.keyPath); err == nil {
+		if id, err := agent.PeerIDFromKey(priv); err == nil {
+			d.Status.PeerID = id.String()
+		}
+	}
+	d.Status.Addrs = o.listenAddrs
+
+	store := o.openStore()
+	defer store.Close()
+	d.Status.SchemaVersion, _ = store.SchemaVersion()
+	w := &agent.WatcherDiagnostics{}
+	checkpoint, ok, err := store.GetCheckpoint("watcher")
+	if err != nil {
+		w.LagError = err.Error()
+	} else if ok {
+		w.Checkpoint = checkpoint
+		w.LastBlock = checkpoint
+	}
+	d.Watcher = w
+	if !ok {
+		return d
+	}
+
+	client, err := o.ercClient()
+	if err != nil {
+		w.LagError = err.Error()
+		return d
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+	head, err := client.HeadBlock(ctx)
+	if err != nil {
+		w.LagError = err.Error()
+	} else if head > o.confirmations+checkpoint {
+		w.Lag = head - o.confirmations - checkpoint
+	}
+	return d
+}
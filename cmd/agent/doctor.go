@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"agentmesh/pkg/agent"
+)
+
+// abiReport is what 'doctor -abi' found in the watched contracts' recent logs.
+type abiReport struct {
+	Blocks    uint64           `json:"blocks"`
+	Contracts []agent.ABIAudit `json:"contracts"`
+	Drift     bool             `json:"drift"` // recent logs matched no known event
+}
+
+// doctorCmd runs health checks against the chain. With -abi it reads the
+// escrow's and market's recent logs and fails if the newer ones include
+// events the watcher wouldn't make out, as after a proxy upgrade.
+func doctorCmd(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	c := addChainFlags(fs)
+	addOutputFlags(fs)
+	checkABI := fs.Bool("abi", false, "Check the watched contracts' recent logs against their ABIs")
+	blocks := fs.Uint64("abi-blocks", 5000, "How many of the latest blocks -abi reads")
+	escrowAddr := fs.String("escrow", defaultEscrow, "TaskEscrow contract address")
+	marketAddr := fs.String("market", defaultMarket, "KnowledgeMarket contract address")
+	abisPath := fs.String("contract-abis", "", "YAML file of the ABI versions of upgraded contracts, by block")
+	parseFlags(fs, args)
+
+	if !*checkABI {
+		usagef("Nothing to check: pass -abi")
+	}
+	if *blocks == 0 {
+		usagef("-abi-blocks must be at least 1")
+	}
+	opts := []agent.WatcherOption{agent.WithLogScanner(c.logScanner())}
+	if *abisPath != "" {
+		abis, err := agent.LoadContractABIs(*abisPath)
+		if err != nil {
+			usagef("-contract-abis: %v", err)
+		}
+		opts = append(opts, agent.WithContractABIs(abis))
+	}
+	watcher, err := agent.NewEventWatcherWithHandlers(c.rpcURL, []string{*escrowAddr}, []string{*marketAddr}, nil, nil, opts...)
+	if err != nil {
+		fatalf("Failed to connect to RPC %s: %v", c.rpcURL, err)
+	}
+	audits, err := watcher.AuditABIs(context.Background(), *blocks)
+	if err != nil {
+		fatalf("ABI check failed: %v", err)
+	}
+
+	report := abiReport{Blocks: *blocks, Contracts: audits}
+	for _, a := range audits {
+		if a.UndecodedRecent > 0 {
+			report.Drift = true
+		}
+	}
+	output(report, func() {
+		fmt.Printf("Checked the last %d blocks.\n", report.Blocks)
+		for _, a := range report.Contracts {
+			verdict := "ok"
+			switch {
+			case a.UndecodedRecent > 0:
+				verdict = "POSSIBLE ABI DRIFT"
+			case a.UndecodedEarlier > 0:
+				verdict = "undecoded logs in the older half only"
+			}
+			fmt.Printf("%-6s %s: %d logs, %d undecoded earlier, %d recently: %s\n", a.Kind, a.Contract, a.Logs, a.UndecodedEarlier, a.UndecodedRecent, verdict)
+			if len(a.Topics) > 0 {
+				fmt.Printf("       unknown events: %s\n", strings.Join(a.Topics, ", "))
+			}
+		}
+		if report.Drift {
+			fmt.Println("A contract logs events its ABI doesn't have. If it was upgraded, add its new ABI with -contract-abis.")
+		}
+	})
+	if report.Drift {
+		os.Exit(exitRuntime)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type escrowTaskView struct {
+	TaskID      string `json:"taskId"`
+	State       string `json:"state"`
+	Client      string `json:"client"`
+	Worker      string `json:"worker,omitempty"`
+	Payment     string `json:"payment"`
+	WorkerStake string `json:"workerStake"`
+	SpecHash    string `json:"specHash"`
+	ResultHash  string `json:"resultHash,omitempty"`
+	CreatedAt   int64  `json:"createdAt"`
+	SubmittedAt int64  `json:"submittedAt,omitempty"`
+}
+
+type escrowResult struct {
+	Action    string               `json:"action"`
+	TaskID    string               `json:"taskId"`
+	Stake     string               `json:"stake,omitempty"` // wei, for bids
+	Sent      bool                 `json:"sent"`            // false in dry-run
+	DryRun    bool                 `json:"dryRun,omitempty"`
+	Simulated []agent.TxSimulation `json:"simulated,omitempty"`
+}
+
+func escrowCmd(args []string) {
+	action, rest := subcommand("escrow", args, "show", "bid", "submit", "claim")
+
+	fs := flag.NewFlagSet("escrow "+action, flag.ExitOnError)
+	c := addChainFlags(fs)
+	escrowAddr := fs.String("escrow", defaultEscrow, "TaskEscrow contract address")
+	addOutputFlags(fs)
+	parseFlags(fs, rest)
+
+	want := 1
+	if action == "submit" {
+		want = 2
+	}
+	if fs.NArg() != want {
+		if action == "submit" {
+			usagef("usage: agent escrow submit [flags] <taskId> <resultHash>")
+		}
+		usagef("usage: agent escrow %s [flags] <taskId>", action)
+	}
+	taskId, ok := parseEscrowTaskID(fs.Arg(0))
+	if !ok {
+		usagef("invalid task id %q", fs.Arg(0))
+	}
+
+	client, err := c.ercClient()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer client.Close()
+	escrow := agent.NewTaskEscrow(client, *escrowAddr)
+
+	if action == "show" {
+		task, err := escrow.GetTask(taskId)
+		if errors.Is(err, agent.ErrNoEscrowTask) {
+			preconditionf("%v", err)
+		} else if err != nil {
+			fatalf("Failed to read task %s: %v", taskId, err)
+		}
+		view := newEscrowTaskView(taskId, task)
+		output(view, func() {
+			fmt.Printf("Task:        %s\n", view.TaskID)
+			fmt.Printf("State:       %s\n", view.State)
+			fmt.Printf("Client:      %s\n", view.Client)
+			if view.Worker != "" {
+				fmt.Printf("Worker:      %s\n", view.Worker)
+			}
+			fmt.Printf("Payment:     %s wei\n", view.Payment)
+			fmt.Printf("Stake:       %s wei\n", view.WorkerStake)
+			fmt.Printf("Spec hash:   %s\n", view.SpecHash)
+			if view.ResultHash != "" {
+				fmt.Printf("Result hash: %s\n", view.ResultHash)
+			}
+			fmt.Printf("Created:     %s\n", time.Unix(view.CreatedAt, 0).Format(time.RFC3339))
+		})
+		return
+	}
+
+	wallet, err := agent.LoadWallet(c.walletPath)
+	if err != nil {
+		preconditionf("%v", err)
+	}
+
+	result := escrowResult{Action: action, TaskID: taskId.String()}
+	switch action {
+	case "bid":
+		var stake *big.Int
+		stake, err = escrow.Bid(wallet, taskId)
+		if stake != nil {
+			result.Stake = stake.String()
+		}
+	case "submit":
+		hash := fs.Arg(1)
+		if !isHash(hash) {
+			usagef("invalid result hash %q: want 32 bytes of hex", hash)
+		}
+		err = escrow.Submit(wallet, taskId, common.HexToHash(hash))
+	case "claim":
+		err = escrow.Claim(wallet, taskId)
+	}
+	if errors.Is(err, agent.ErrNoEscrowTask) || errors.Is(err, agent.ErrSpendLimit) {
+		preconditionf("%v", err)
+	} else if err != nil {
+		fatalf("%v", err)
+	}
+
+	result.DryRun = client.DryRun()
+	result.Sent = !result.DryRun
+	result.Simulated = client.Simulations()
+	output(result, func() {
+		if result.DryRun {
+			printSimulations(result.Simulated)
+			return
+		}
+		switch action {
+		case "bid":
+			fmt.Printf("Accepted task %s, staking %s wei\n", result.TaskID, result.Stake)
+		case "submit":
+			fmt.Printf("Submitted the result of task %s\n", result.TaskID)
+		case "claim":
+			fmt.Printf("Claimed payment for task %s\n", result.TaskID)
+		}
+	})
+}
+
+// parseEscrowTaskID accepts an on-chain task ID, bare or in the node's
+// "task:<id>" record form.
+func parseEscrowTaskID(s string) (*big.Int, bool) {
+	s = strings.TrimPrefix(s, agent.TaskKindEscrow+":")
+	id, ok := new(big.Int).SetString(s, 10)
+	return id, ok && id.Sign() > 0
+}
+
+func isHash(s string) bool {
+	s = strings.TrimPrefix(s, "0x")
+	if len(s) != 2*common.HashLength {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func newEscrowTaskView(taskId *big.Int, t *agent.EscrowTask) escrowTaskView {
+	v := escrowTaskView{
+		TaskID:      taskId.String(),
+		State:       t.StateName(),
+		Client:      t.Client.Hex(),
+		Payment:     t.Payment.String(),
+		WorkerStake: t.WorkerStake.String(),
+		SpecHash:    common.Hash(t.SpecHash).Hex(),
+		CreatedAt:   t.CreatedAt.Int64(),
+		SubmittedAt: t.SubmittedAt.Int64(),
+	}
+	if t.Worker != (common.Address{}) {
+		v.Worker = t.Worker.Hex()
+	}
+	if t.ResultHash != ([32]byte{}) {
+		v.ResultHash = common.Hash(t.ResultHash).Hex()
+	}
+	return v
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+func historyCmd(args []string) {
+	action, rest := subcommand("history", args, "list", "verify")
+
+	fs := flag.NewFlagSet("history "+action, flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	c := addChainFlags(fs)
+	file := fs.String("file", "", "Verify the record in this JSON file, such as one another agent handed over, instead of a stored one (for 'verify')")
+	offline := fs.Bool("offline", false, "Check signatures and the merkle proof only, not the root the agent published (for 'verify')")
+	parseFlags(fs, rest)
+
+	switch action {
+	case "list":
+		records := listInteractions(g)
+		output(records, func() {
+			if len(records) == 0 {
+				fmt.Println("No interactions recorded yet.")
+				return
+			}
+			fmt.Printf("%-14s %-10s %-14s %-14s %-22s %-15s %s\n", "ID", "KIND", "PROVIDER", "CLIENT", "AMOUNT (wei)", "STATE", "COMPLETED")
+			for _, r := range records {
+				fmt.Printf("%-14s %-10s %-14s %-14s %-22s %-15s %s\n", shortHash(r.ID), r.Kind, shortHash(r.Provider), shortHash(r.Client),
+					r.Amount, interactionState(r), time.UnixMilli(r.CompletedAt).Format(time.RFC3339))
+			}
+		})
+
+	case "verify":
+		var r agent.InteractionRecord
+		switch {
+		case *file != "":
+			raw, err := os.ReadFile(*file)
+			if err != nil {
+				fatalf("Failed to read %s: %v", *file, err)
+			}
+			if err := json.Unmarshal(raw, &r); err != nil {
+				usagef("%s isn't an interaction record: %v", *file, err)
+			}
+		case fs.NArg() == 1:
+			var found []agent.InteractionRecord
+			for _, rec := range listInteractions(g) {
+				if strings.HasPrefix(strings.ToLower(rec.ID), strings.ToLower(fs.Arg(0))) {
+					found = append(found, rec)
+				}
+			}
+			if len(found) == 0 {
+				preconditionf("No interaction record %s", fs.Arg(0))
+			}
+			if len(found) > 1 {
+				usagef("%d records start with %s; give more of the ID", len(found), fs.Arg(0))
+			}
+			r = found[0]
+		default:
+			usagef("usage: agent history verify [flags] <id> | -file <record.json>")
+		}
+
+		err := agent.VerifyInteraction(r)
+		if err == nil && r.Anchor != nil && !*offline {
+			client, cerr := c.ercClient()
+			if cerr != nil {
+				fatalf("Can't check the anchor: %v", cerr)
+			}
+			defer client.Close()
+			err = client.VerifyInteractionAnchor(r)
+		}
+		result := HistoryVerifyResult{ID: r.ID, Valid: err == nil, Anchored: r.Anchor != nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		output(result, func() {
+			if err != nil {
+				fmt.Printf("Record %s does NOT verify: %v\n", r.ID, err)
+				return
+			}
+			fmt.Printf("Record %s verifies: signed by provider %s and client %s\n", r.ID, r.Provider, r.Client)
+			switch {
+			case r.Anchor == nil:
+				fmt.Println("Not anchored yet.")
+			case *offline:
+				fmt.Printf("Its proof leads to root %s; the published root wasn't checked (-offline)\n", r.Anchor.Root)
+			default:
+				fmt.Printf("Anchored by agent %s under root %s in block %d\n", r.Anchor.AgentID, r.Anchor.Root, r.Anchor.Block)
+			}
+		})
+		if err != nil {
+			os.Exit(exitRuntime)
+		}
+	}
+}
+
+// HistoryVerifyResult is the -output json form of 'history verify'.
+type HistoryVerifyResult struct {
+	ID       string `json:"id"`
+	Valid    bool   `json:"valid"`
+	Anchored bool   `json:"anchored"`
+	Error    string `json:"error,omitempty"`
+}
+
+// listInteractions reads the node's interaction records, from the running
+// node or else its database.
+func listInteractions(g *globalFlags) []agent.InteractionRecord {
+	var records []agent.InteractionRecord
+	err := apiGet(g.apiAddr, "/history", &records)
+	if err == errNodeDown {
+		store := g.openStore()
+		defer store.Close()
+		records, err = store.ListInteractions()
+	}
+	if err != nil {
+		fatalf("Failed to list interactions: %v", err)
+	}
+	if records == nil {
+		records = []agent.InteractionRecord{}
+	}
+	return records
+}
+
+// interactionState says how far a record got: signed by one party, by
+// both, or anchored on-chain too.
+func interactionState(r agent.InteractionRecord) string {
+	switch {
+	case r.Anchor != nil:
+		return "anchored"
+	case r.Complete():
+		return "countersigned"
+	}
+	return "one-sided"
+}
+
+// shortHash abbreviates a hash or peer ID for a table.
+func shortHash(s string) string {
+	if len(s) <= 12 {
+		return orDash(s)
+	}
+	return s[:6] + ".." + s[len(s)-4:]
+}
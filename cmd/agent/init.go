@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Wizard steps, in order. Each can be skipped with -skip.
+var initSteps = []string{"workspace", "identity", "wallet", "config", "rpc", "register"}
+
+// initStep reports what one wizard step did.
+type initStep struct {
+	Step   string `json:"step"`
+	Status string `json:"status"` // created, exists, imported, written, ok, skipped, failed
+	Detail string `json:"detail,omitempty"`
+}
+
+type initReport struct {
+	Steps   []initStep `json:"steps"`
+	PeerID  string     `json:"peerId,omitempty"`
+	Wallet  string     `json:"wallet,omitempty"`
+	AgentID string     `json:"agentId,omitempty"`
+	Config  string     `json:"config"`
+	RunCmd  string     `json:"runCommand"`
+}
+
+func initCmd(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	c := addChainFlags(fs)
+	workspace := fs.String("workspace", "./workspace", "Path to OpenClaw workspace")
+	keyPath := fs.String("key", defaultKeyFile, "Path to the libp2p identity key")
+	importKey := fs.String("import-key", "", "Existing libp2p key file to import instead of generating one")
+	importWallet := fs.String("import-wallet", "", "Existing hex wallet key file to import instead of generating one")
+	uri := fs.String("uri", "", "Agent registration file URI, used when registering a new identity")
+	register := fs.Bool("register", false, "Register the identity and publish the peerId (non-interactive mode)")
+	nonInteractive := fs.Bool("non-interactive", false, "Never prompt; use flags and defaults (for CI)")
+	skip := fs.String("skip", "", "Comma-separated steps to skip: "+strings.Join(initSteps, ","))
+	parseFlags(fs, args)
+
+	configPath := fs.Lookup("config").Value.String()
+	skipped := map[string]bool{}
+	for _, s := range strings.Split(*skip, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			skipped[s] = true
+		}
+	}
+
+	w := &wizard{interactive: !*nonInteractive && !jsonMode(), in: bufio.NewReader(os.Stdin)}
+	report := initReport{Config: configPath}
+	add := func(step, status, detail string) {
+		report.Steps = append(report.Steps, initStep{step, status, detail})
+		fmt.Printf("[%s] %s %s\n", step, status, detail)
+	}
+
+	// 1. Workspace
+	if skipped["workspace"] {
+		add("workspace", "skipped", "")
+	} else {
+		*workspace = w.ask("Workspace directory", *workspace)
+		if _, err := os.Stat(*workspace); err == nil {
+			add("workspace", "exists", *workspace)
+		} else if err := os.MkdirAll(*workspace, 0755); err != nil {
+			add("workspace", "failed", err.Error())
+		} else {
+			add("workspace", "created", *workspace)
+		}
+	}
+
+	// 2. libp2p identity
+	var pid peer.ID
+	var priv crypto.PrivKey
+	if skipped["identity"] {
+		add("identity", "skipped", "")
+	} else {
+		status := "exists"
+		if _, err := os.Stat(*keyPath); os.IsNotExist(err) {
+			status = "created"
+			if *importKey != "" {
+				if err := copyFile(*importKey, *keyPath); err != nil {
+					fatalf("Failed to import identity key: %v", err)
+				}
+				status = "imported"
+			}
+		}
+		var err error
+		priv, err = agent.LoadOrCreateIdentity(*keyPath)
+		if err != nil {
+			fatalf("Failed to load identity: %v", err)
+		}
+		pid, _ = agent.PeerIDFromKey(priv)
+		report.PeerID = pid.String()
+		add("identity", status, fmt.Sprintf("%s (peerId %s)", *keyPath, pid))
+	}
+
+	// 3. Wallet
+	var wallet *agent.Wallet
+	if skipped["wallet"] {
+		add("wallet", "skipped", "")
+	} else {
+		status := "exists"
+		if _, err := os.Stat(c.walletPath); os.IsNotExist(err) {
+			status = "created"
+			if *importWallet != "" {
+				key, err := ethcrypto.LoadECDSA(*importWallet)
+				if err != nil {
+					fatalf("Failed to import wallet: %v", err)
+				}
+				if err := ethcrypto.SaveECDSA(c.walletPath, key); err != nil {
+					fatalf("Failed to write wallet: %v", err)
+				}
+				status = "imported"
+			}
+		}
+		var err error
+		wallet, err = agent.LoadOrCreateWallet(c.walletPath)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		report.Wallet = wallet.Address.Hex()
+		add("wallet", status, fmt.Sprintf("%s (address %s)", c.walletPath, wallet.Address.Hex()))
+	}
+
+	// 4. Config file, merged into any existing one so hand edits survive
+	if skipped["config"] {
+		add("config", "skipped", "")
+	} else {
+		c.rpcURL = w.ask("RPC URL", c.rpcURL)
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			cfg = fileConfig{}
+		}
+		cfg["workspace"] = configValue{*workspace}
+		cfg["key"] = configValue{*keyPath}
+		cfg["wallet"] = configValue{c.walletPath}
+		cfg["rpc"] = configValue{c.rpcURL}
+		cfg["identity"] = configValue{c.identAddr}
+		cfg["db"] = configValue{g.dbPath}
+		cfg["db-driver"] = configValue{g.dbDriver}
+		if err := saveConfig(configPath, cfg); err != nil {
+			add("config", "failed", err.Error())
+		} else {
+			add("config", "written", configPath)
+		}
+	}
+
+	// 5. RPC connectivity and balance
+	var client *agent.ERC8004Client
+	if skipped["rpc"] {
+		add("rpc", "skipped", "")
+	} else if cl, err := c.ercClient(); err != nil {
+		add("rpc", "failed", err.Error())
+	} else {
+		client = cl
+		defer client.Close()
+		addr := common.Address{}
+		if wallet != nil {
+			addr = wallet.Address
+		}
+		bal, err := client.Balance(addr)
+		switch {
+		case err != nil:
+			add("rpc", "failed", err.Error())
+			client = nil
+		case wallet == nil:
+			add("rpc", "ok", c.rpcURL)
+		case bal.Sign() == 0:
+			add("rpc", "ok", fmt.Sprintf("%s; wallet %s is unfunded, send it some ETH before registering", c.rpcURL, wallet.Address.Hex()))
+		default:
+			add("rpc", "ok", fmt.Sprintf("%s; wallet balance %s wei", c.rpcURL, bal))
+		}
+	}
+
+	// 6. ERC-8004 registration and peerId metadata
+	doRegister := *register
+	if w.interactive && !skipped["register"] && client != nil && wallet != nil && pid != "" {
+		doRegister = w.confirm("Register the agent identity and publish the peerId now?", false)
+		if doRegister && *uri == "" {
+			*uri = w.ask("Agent registration URI (agent.json)", "")
+		}
+	}
+	switch {
+	case skipped["register"] || !doRegister:
+		add("register", "skipped", "run 'agent register -uri <agent.json>' later")
+	case client == nil || wallet == nil || pid == "":
+		add("register", "failed", "requires the identity, wallet and rpc steps")
+	default:
+		res, err := registerIdentity(client, wallet, priv, *uri)
+		if err != nil {
+			add("register", "failed", err.Error())
+		} else if client.DryRun() {
+			add("register", "simulated", fmt.Sprintf("%d transactions simulated, none sent", len(client.Simulations())))
+		} else {
+			report.AgentID = res.AgentID
+			add("register", "ok", fmt.Sprintf("agent %s, peerId published", res.AgentID))
+		}
+	}
+
+	report.RunCmd = "agent run -config " + configPath
+	output(report, func() {
+		fmt.Println()
+		fmt.Println("Setup summary:")
+		for _, s := range report.Steps {
+			fmt.Printf("  %-10s %s\n", s.Step, s.Status)
+		}
+		if report.PeerID != "" {
+			fmt.Printf("Peer ID: %s\n", report.PeerID)
+		}
+		if report.Wallet != "" {
+			fmt.Printf("Wallet:  %s\n", report.Wallet)
+		}
+		fmt.Printf("\nStart the node with:\n  %s\n", report.RunCmd)
+	})
+	// Scripts and CI must not mistake a half-finished setup for success
+	if failed := report.failedSteps(); len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "Setup incomplete: %s failed\n", strings.Join(failed, ", "))
+		os.Exit(exitRuntime)
+	}
+}
+
+// failedSteps names the steps that reported "failed", in order.
+func (r initReport) failedSteps() []string {
+	var failed []string
+	for _, s := range r.Steps {
+		if s.Status == "failed" {
+			failed = append(failed, s.Step)
+		}
+	}
+	return failed
+}
+
+// wizard asks questions on stdin, or returns the defaults when not interactive.
+type wizard struct {
+	interactive bool
+	in          *bufio.Reader
+}
+
+func (w *wizard) ask(question, def string) string {
+	if !w.interactive {
+		return def
+	}
+	fmt.Printf("%s [%s]: ", question, def)
+	line, _ := w.in.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+func (w *wizard) confirm(question string, def bool) bool {
+	if !w.interactive {
+		return def
+	}
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	fmt.Printf("%s [%s]: ", question, hint)
+	line, _ := w.in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	}
+	return def
+}
+
+// copyFile copies src to dst, refusing to overwrite an existing dst.
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runInit runs 'agent init -non-interactive -json' with args and returns its
+// report and exit code.
+func runInit(t *testing.T, args ...string) (initReport, int) {
+	t.Helper()
+	dir := t.TempDir()
+	out, code := runCLI(t, dir, append([]string{"init",
+		"-non-interactive", "-json",
+		"-config", filepath.Join(dir, "agentmesh.json"),
+		"-workspace", filepath.Join(dir, "workspace"),
+		"-key", filepath.Join(dir, "identity.key"),
+		"-wallet", filepath.Join(dir, "wallet.key"),
+		"-db", filepath.Join(dir, "agent_metadata.db"),
+	}, args...)...)
+
+	var report initReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("init printed %q: %v", out, err)
+	}
+	return report, code
+}
+
+func TestInitSucceeds(t *testing.T) {
+	report, code := runInit(t, "-skip", "rpc,register")
+	if code != 0 {
+		t.Errorf("exit code %d, want 0; steps %+v", code, report.Steps)
+	}
+	if len(report.failedSteps()) != 0 {
+		t.Errorf("failed steps: %v", report.failedSteps())
+	}
+}
+
+func TestInitFailedStepExitsNonZero(t *testing.T) {
+	// Nothing listens on the RPC port, so the rpc step fails
+	report, code := runInit(t, "-rpc", "http://127.0.0.1:1", "-skip", "register")
+	if code != exitRuntime {
+		t.Errorf("exit code %d, want %d; steps %+v", code, exitRuntime, report.Steps)
+	}
+	if failed := report.failedSteps(); strings.Join(failed, ",") != "rpc" {
+		t.Errorf("failed steps %v, want [rpc]", failed)
+	}
+	// The steps after the failure still ran and were reported
+	if n := len(report.Steps); n != len(initSteps) {
+		t.Errorf("%d steps reported, want %d", n, len(initSteps))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// rotateTimeout covers the two metadata transactions a live rotation sends.
+const rotateTimeout = 5 * time.Minute
+
+func keysCmd(args []string) {
+	action, rest := subcommand("keys", args, "rotate")
+
+	fs := flag.NewFlagSet("keys "+action, flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	c := addChainFlags(fs)
+	keyPath := fs.String("key", defaultKeyFile, "Path to the libp2p identity key")
+	grace := fs.Duration("grace", agent.DefaultRotationGrace, "How long the old peer ID keeps answering with a moved notice")
+	parseFlags(fs, rest)
+
+	if c.dryRun {
+		simulateRotation(c)
+		return
+	}
+
+	// A running node rotates live; otherwise rotate the key file for the next start
+	var res agent.RotationResult
+	err := apiDoTimeout(http.MethodPost, g.apiAddr, "/identity/rotate?grace="+url.QueryEscape(grace.String()), &res, rotateTimeout)
+	if err == errNodeDown {
+		if _, err := os.Stat(*keyPath); err != nil {
+			preconditionf("No identity key at %s; run 'agent init' first", *keyPath)
+		}
+		store := g.openStore()
+		defer store.Close()
+		rot, newKey, err := agent.RotateIdentityFile(store, *keyPath, *grace)
+		if err != nil {
+			fatalf("Key rotation failed: %v", err)
+		}
+		res.KeyRotation = *rot
+		if agentId, err := publishRotated(c, newKey); err != nil {
+			res.PublishError = err.Error()
+		} else {
+			res.AgentID = agentId
+		}
+	} else if err != nil {
+		fatalf("Key rotation failed: %v", err)
+	}
+
+	output(res, func() {
+		fmt.Printf("Old peer ID: %s\n", res.OldPeerID)
+		fmt.Printf("New peer ID: %s\n", res.NewPeerID)
+		fmt.Printf("The old ID answers with a moved notice until %s.\n", time.Unix(res.RetireAt, 0).Format(time.RFC3339))
+		if res.PublishError != "" {
+			fmt.Printf("Warning: the new peerId was not published on-chain: %s\n", res.PublishError)
+		} else {
+			fmt.Println("New peerId and binding published to the identity registry.")
+		}
+	})
+	if res.PublishError != "" {
+		os.Exit(exitRuntime)
+	}
+}
+
+// publishRotated points the on-chain peerId at the new key when no node is
+// running to do it.
+func publishRotated(c *chainFlags, newKey crypto.PrivKey) (string, error) {
+	wallet, err := agent.LoadWallet(c.walletPath)
+	if err != nil {
+		return "", err
+	}
+	client, err := c.ercClient()
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	agentId, err := client.PublishPeerID(wallet, newKey)
+	if err != nil {
+		return "", err
+	}
+	return agentId.String(), nil
+}
+
+// simulateRotation reports what publishing a rotated key would cost, without
+// touching the key file or a running node: the metadata transactions are
+// simulated for a throwaway key.
+func simulateRotation(c *chainFlags) {
+	wallet, err := agent.LoadWallet(c.walletPath)
+	if err != nil {
+		preconditionf("%v", err)
+	}
+	newKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		fatalf("Failed to generate key: %v", err)
+	}
+	client, err := c.ercClient()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer client.Close()
+
+	_, err = client.PublishPeerID(wallet, newKey)
+	sims := client.Simulations()
+	output(sims, func() { printSimulations(sims) })
+	if err != nil {
+		fatalf("Publishing the rotated key would fail: %v", err)
+	}
+}
@@ -1,77 +1,134 @@
 package main
 
 import (
-	"context"
-	"flag"
 	"fmt"
-	"log"
 	"os"
-	"os/signal"
-	"syscall"
-
-	"agentmesh/pkg/agent"
+	"strings"
 )
 
-func main() {
-	dbPath := flag.String("db", "agent_metadata.db", "Path to metadata database")
-	workspace := flag.String("workspace", "./workspace", "Path to OpenClaw workspace")
-	listenAddr := flag.String("listen", "/ip4/0.0.0.0/tcp/0", "libp2p listen address")
-	rpcURL := flag.String("rpc", "https://sepolia.base.org", "Ethereum RPC URL")
-	escrowAddr := flag.String("escrow", "0x591ee5158c94d736ce9bf544bc03247d14904061", "TaskEscrow contract address")
-	marketAddr := flag.String("market", "0x051509a30a62b1ea250eef5ad924d0690a4d20e6", "KnowledgeMarket contract address")
-	identAddr := flag.String("identity", "0x8004A169FB4a3325136EB29fA0ceB6D2e539a432", "ERC-8004 IdentityRegistry address")
-
-	flag.Parse()
+const usage = `Usage: agent <command> [flags]
 
-	fmt.Printf("Starting AgentMesh Node...\n")
-	fmt.Printf("Database: %s\n", *dbPath)
-	fmt.Printf("Workspace: %s\n", *workspace)
+Commands:
+  init                        Interactive first-run setup (keys, wallet, config, registration)
+  run                         Start the node (default when no command is given)
+  register --uri <uri>        Register the ERC-8004 identity and publish the peerId
+  status                      Show the status of the local node
+  top                         Live dashboard of the running node
+  diagnostics -out <file>     Dump the node's state, config included, to a JSON file
+  doctor -abi                 Check the watched contracts' recent logs for ABI drift
+  tasks list|show <id>        Inspect tasks seen by the node
+  peers list|show|block|routes|reputation
+                              Inspect or block peers, show capability routes or
+                              the local reputation ledger
+  capabilities list|export|card|clear-cache|stats
+                              Show, export or describe the manifest capabilities,
+                              drop their cached answers or show how they fare
+  catalog add|list|remove     Manage the knowledge listings the node sells
+  history list|verify         Countersigned records of completed exchanges
+  wallet address|balance|budget
+                              Show the operator wallet, or what its bid budget holds
+  escrow show|bid|submit|claim <taskId>
+                              Work a TaskEscrow task (use -dry-run to simulate)
+  keys rotate                 Rotate the libp2p identity key and publish the new peerId
+  sign -data <json>           Sign a JSON document with the identity key, offline
+  verify -packet <file>       Check the signature of a signed packet
+  record -out <file>          Record live chain events to a JSONL file
+  simulate -events <file>     Replay recorded or archived events through the intake pipeline offline
+  config list|get|set|unset   Inspect or edit the config file
+  mcp serve                   Serve mesh tools to local LLM agents over MCP (stdio or sse)
+  completion bash|zsh|fish    Print a shell completion script
 
-	// Ensure workspace exists
-	os.MkdirAll(*workspace, 0755)
+Every command accepts -output text|json (or -json). In json mode the result
+is a single JSON document on stdout and logs go to stderr; 'run' emits one
+JSON event per line instead.
 
-	node, err := agent.NewAgentNode(*dbPath, *workspace)
-	if err != nil {
-		log.Fatalf("Failed to initialize node: %v", err)
-	}
+Every command reads defaults for its flags from agentmesh.json (or -config
+<file>) when present; flags on the command line take precedence.
 
-	// Setup ERC8004 Client (Mock/Placeholder addresses for Reputation/Validation)
-	node.ERCClient = agent.NewERC8004Client(*rpcURL, *identAddr, "0x0000000000000000000000000000000000000000", "0x0000000000000000000000000000000000000000")
+Exit codes:
+  0  success
+  1  runtime error
+  2  usage error
+  3  precondition failed (e.g. no wallet, not registered)
 
-	// Setup Watcher
-	watcher, err := agent.NewEventWatcher(*rpcURL, *escrowAddr, *marketAddr, func(e agent.TaskCreatedEvent) {
-		fmt.Printf("[Watcher] New Task Created on-chain: %s\n", e.TaskId)
-	}, func(q agent.KnowledgeRequestedEvent) {
-		fmt.Printf("[Watcher] New Knowledge Request on-chain: %s (Bounty: %s)\n", q.Topic, q.Bounty)
+Run 'agent <command> -h' for command flags.
+`
 
-		// Dynamic Identity Resolution: wallet -> agentId -> peerId
-		if node.ERCClient != nil {
-			agentId, err := node.ERCClient.GetAgentIdByWallet(q.Requester)
-			if err == nil {
-				peerId, err := node.ERCClient.GetMetadata(agentId, "peerId")
-				if err == nil && peerId != "" {
-					fmt.Printf("[Discovery] Resolved PeerID for %s: %s\n", q.Requester.Hex(), peerId)
-					// Trigger P2P delivery here...
-				}
-			}
-		}
-	})
-	if err == nil {
-		node.Watcher = watcher
-		go node.Watcher.Start(context.Background())
+func main() {
+	// Bare flags keep the pre-subcommand invocation (agent -workspace ...) working
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		runCmd(os.Args[1:])
+		return
 	}
 
-	if err := node.Start(*listenAddr); err != nil {
-		log.Fatalf("Failed to start node: %v", err)
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "init":
+		initCmd(args)
+	case "run":
+		runCmd(args)
+	case "register":
+		registerCmd(args)
+	case "status":
+		statusCmd(args)
+	case "top":
+		topCmd(args)
+	case "diagnostics":
+		diagnosticsCmd(args)
+	case "doctor":
+		doctorCmd(args)
+	case "tasks":
+		tasksCmd(args)
+	case "peers":
+		peersCmd(args)
+	case "capabilities":
+		capabilitiesCmd(args)
+	case "catalog":
+		catalogCmd(args)
+	case "history":
+		historyCmd(args)
+	case "wallet":
+		walletCmd(args)
+	case "keys":
+		keysCmd(args)
+	case "sign":
+		signCmd(args)
+	case "verify":
+		verifyCmd(args)
+	case "escrow":
+		escrowCmd(args)
+	case "record":
+		recordCmd(args)
+	case "simulate":
+		simulateCmd(args)
+	case "config":
+		configCmd(args)
+	case "mcp":
+		mcpCmd(args)
+	case "completion":
+		completionCmd(args)
+	case "__complete":
+		completeCmd(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(exitUsage)
 	}
+}
 
-	fmt.Printf("Node started! ID: %s\n", node.Host.ID())
-	fmt.Printf("Addresses: %v\n", node.Host.Addrs())
-
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
-
-	node.Stop()
-	fmt.Println("Node stopped.")
+// subcommand splits "tasks list ..." style arguments into the action and the rest.
+func subcommand(name string, args []string, actions ...string) (string, []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: agent %s %s\n", name, strings.Join(actions, "|"))
+		os.Exit(exitUsage)
+	}
+	for _, a := range actions {
+		if args[0] == a {
+			return a, args[1:]
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown action %q for %s (want %s)\n", args[0], name, strings.Join(actions, "|"))
+	os.Exit(exitUsage)
+	return "", nil
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"agentmesh/pkg/agent"
+	"agentmesh/pkg/mcp"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Defaults of 'agent mcp serve'.
+const (
+	defaultMCPAddr       = "127.0.0.1:7656"
+	defaultReputationReg = "0x8004BAa17C55a88189AE136b182e5fdA19dE9b63"
+)
+
+// mcpAPITimeout bounds one node API call made by a tool. Tools that start
+// work return as soon as it is queued, so this is not the task's duration.
+const mcpAPITimeout = 10 * time.Second
+
+func mcpCmd(args []string) {
+	_, rest := subcommand("mcp", args, actions["mcp"]...)
+
+	fs := flag.NewFlagSet("mcp serve", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	token := fs.String("api-token", "", "Bearer token of the node's /v1 API, which delegation and knowledge requests go through")
+	transport := fs.String("transport", "stdio", "MCP transport: stdio, or sse to serve HTTP on -sse-addr")
+	sseAddr := fs.String("sse-addr", defaultMCPAddr, "Address to serve the sse transport on")
+	rpcURL := fs.String("rpc", defaultRPC, "Ethereum RPC URL, for reputation lookups")
+	reputation := fs.String("reputation", defaultReputationReg, "ERC-8004 ReputationRegistry address")
+	parseFlags(fs, rest)
+
+	tools := &meshTools{apiAddr: g.apiAddr, token: *token, rpcURL: *rpcURL, reputationAddr: *reputation}
+	defer tools.close()
+	server := mcp.NewServer("agentmesh", buildVersion(), tools.list)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	switch *transport {
+	case "stdio":
+		// stdout carries the protocol; everything else printed goes to stderr
+		protocolOut := os.Stdout
+		os.Stdout = os.Stderr
+		if err := server.ServeStdio(ctx, os.Stdin, protocolOut); err != nil && ctx.Err() == nil {
+			fatalf("MCP session failed: %v", err)
+		}
+	case "sse":
+		ln, err := net.Listen("tcp", *sseAddr)
+		if err != nil {
+			fatalf("Failed to listen on %s: %v", *sseAddr, err)
+		}
+		srv := &http.Server{Handler: server.SSEHandler(), ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		fmt.Fprintf(os.Stderr, "MCP: http://%s/sse (node API %s)\n", ln.Addr(), g.apiAddr)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			fatalf("MCP server failed: %v", err)
+		}
+	default:
+		usagef("invalid -transport %q (want stdio or sse)", *transport)
+	}
+}
+
+// buildVersion is the module version the binary was built from.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// meshTools are the MCP tools, backed by the running node's API and, for
+// reputation, the chain.
+type meshTools struct {
+	apiAddr        string
+	token          string
+	rpcURL         string
+	reputationAddr string
+
+	mu  sync.Mutex
+	erc *agent.ERC8004Client // dialled on the first reputation lookup
+}
+
+func (m *meshTools) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.erc != nil {
+		m.erc.Close()
+	}
+}
+
+func (m *meshTools) api(method, path string, in, out interface{}) error {
+	err := apiRequest(method, m.apiAddr, path, m.token, in, out, mcpAPITimeout)
+	if err == errNodeDown {
+		return fmt.Errorf("no agentmesh node answers at %s; start one with 'agent run'", m.apiAddr)
+	}
+	return err
+}
+
+// list returns the tools. mesh_delegate_task takes its capabilities and
+// their payload schemas from the node's capability registry, so it is built
+// anew on every request.
+func (m *meshTools) list(ctx context.Context) ([]mcp.Tool, error) {
+	var defs []agent.CapabilityDef
+	if err := apiGet(m.apiAddr, "/capabilities", &defs); err != nil && err != errNodeDown {
+		return nil, err
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+
+	return []mcp.Tool{
+		{
+			Name:        "mesh_find_agents",
+			Description: "Find the mesh peers that announced a capability. Leave capability empty to list every known capability and its peers.",
+			InputSchema: objectSchema(map[string]interface{}{
+				"capability": map[string]interface{}{"type": "string", "description": "Capability name, e.g. summarize"},
+			}),
+			Call: m.findAgents,
+		},
+		{
+			Name:        "mesh_request_knowledge",
+			Description: "Post a knowledge request with a bounty to the on-chain KnowledgeMarket. Returns a task ID at once; poll it with mesh_poll.",
+			InputSchema: objectSchema(map[string]interface{}{
+				"topic":      map[string]interface{}{"type": "string", "minLength": 1, "description": "What the knowledge is about"},
+				"max_bounty": map[string]interface{}{"type": "string", "pattern": "^[0-9]+$", "description": "Most wei to pay for an answer"},
+			}, "topic"),
+			Call: m.requestKnowledge,
+		},
+		delegateTool(defs, m.delegateTask),
+		{
+			Name:        "mesh_get_reputation",
+			Description: "Read an agent's ERC-8004 reputation summary: how much feedback it has and its average score.",
+			InputSchema: objectSchema(map[string]interface{}{
+				"agentId": map[string]interface{}{"type": "string", "pattern": "^[0-9]+$", "description": "ERC-8004 agent ID"},
+				"clients": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": "Only count feedback from these wallet addresses"},
+				"tag1":    map[string]interface{}{"type": "string"},
+				"tag2":    map[string]interface{}{"type": "string"},
+			}, "agentId"),
+			Call: m.getReputation,
+		},
+		{
+			Name:        "mesh_poll",
+			Description: "Check on a task started by mesh_delegate_task or mesh_request_knowledge. A finished delegated task includes its output.",
+			InputSchema: objectSchema(map[string]interface{}{
+				"id": map[string]interface{}{"type": "string", "description": "Task ID returned when the task was started"},
+			}, "id"),
+			Call: m.poll,
+		},
+	}, nil
+}
+
+func objectSchema(properties map[string]interface{}, required ...string) map[string]interface{} {
+	s := map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// delegateTool describes mesh_delegate_task for the capabilities in defs:
+// capability is one of their names, and payload matches one of their schemas.
+func delegateTool(defs []agent.CapabilityDef, call func(context.Context, map[string]interface{}) (interface{}, error)) mcp.Tool {
+	var b strings.Builder
+	b.WriteString("Run a task on a capability the node serves. Returns a task ID at once; poll it with mesh_poll.")
+	capability := map[string]interface{}{"type": "string"}
+	payload := map[string]interface{}{"type": "object"}
+	if len(defs) > 0 {
+		b.WriteString(" Capabilities:")
+		var names []string
+		var schemas []interface{}
+		for _, d := range defs {
+			names = append(names, d.Name)
+			fmt.Fprintf(&b, "\n- %s", d.Name)
+			if d.Description != "" {
+				fmt.Fprintf(&b, ": %s", d.Description)
+			}
+			if d.Schema != nil {
+				schemas = append(schemas, d.Schema)
+			}
+		}
+		capability["enum"] = names
+		if len(schemas) == len(defs) {
+			payload = map[string]interface{}{"anyOf": schemas}
+		}
+	}
+	return mcp.Tool{
+		Name:        "mesh_delegate_task",
+		Description: b.String(),
+		InputSchema: objectSchema(map[string]interface{}{"capability": capability, "payload": payload}, "capability", "payload"),
+		Call:        call,
+	}
+}
+
+func (m *meshTools) findAgents(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	var routes []agent.Route
+	if err := m.api(http.MethodGet, "/routes", nil, &routes); err != nil {
+		return nil, err
+	}
+	capability, _ := args["capability"].(string)
+	if capability == "" {
+		return routes, nil
+	}
+	found := agent.Route{Capability: capability, Peers: []agent.RoutePeer{}}
+	for _, r := range routes {
+		if r.Capability == capability {
+			found = r
+		}
+	}
+	return found, nil
+}
+
+func (m *meshTools) requestKnowledge(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	spec := agent.KnowledgeRequestSpec{}
+	spec.Topic, _ = args["topic"].(string)
+	spec.Bounty, _ = args["max_bounty"].(string)
+	var res agent.KnowledgeRequestResult
+	if err := m.api(http.MethodPost, "/v1/knowledge/requests", spec, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (m *meshTools) delegateTask(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	spec := agent.TaskSpec{}
+	spec.Capability, _ = args["capability"].(string)
+	spec.Payload, _ = args["payload"].(map[string]interface{})
+	var st agent.LocalTaskStatus
+	if err := m.api(http.MethodPost, "/v1/tasks", spec, &st); err != nil {
+		return nil, err
+	}
+	return map[string]string{"taskId": st.ID, "status": st.Status}, nil
+}
+
+// pollResult is what mesh_poll reports about a task.
+type pollResult struct {
+	agent.LocalTaskStatus
+	Output json.RawMessage `json:"output,omitempty"` // a finished local task's result file
+}
+
+func (m *meshTools) poll(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	id, _ := args["id"].(string)
+	if id == "" {
+		return nil, fmt.Errorf("id is required")
+	}
+	var res pollResult
+	if err := m.api(http.MethodGet, "/v1/tasks/"+url.PathEscape(id), nil, &res.LocalTaskStatus); err != nil {
+		return nil, err
+	}
+	// The node writes results to its own disk, which is ours when it runs
+	// locally; elsewhere the path is all there is
+	if res.Result != "" {
+		if raw, err := os.ReadFile(res.Result); err == nil && json.Valid(raw) {
+			res.Output = raw
+		}
+	}
+	return res, nil
+}
+
+// reputationResult is what mesh_get_reputation reports.
+type reputationResult struct {
+	AgentID  string `json:"agentId"`
+	Count    uint64 `json:"count"`
+	Value    string `json:"value"` // fixed-point, Decimals places
+	Decimals uint8  `json:"decimals"`
+}
+
+func (m *meshTools) getReputation(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	s, _ := args["agentId"].(string)
+	agentID, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid agentId %q", s)
+	}
+	var clients []common.Address
+	if list, ok := args["clients"].([]interface{}); ok {
+		for _, c := range list {
+			addr, _ := c.(string)
+			if !common.IsHexAddress(addr) {
+				return nil, fmt.Errorf("invalid client address %q", addr)
+			}
+			clients = append(clients, common.HexToAddress(addr))
+		}
+	}
+	tag1, _ := args["tag1"].(string)
+	tag2, _ := args["tag2"].(string)
+
+	erc, err := m.ercClient()
+	if err != nil {
+		return nil, err
+	}
+	summary, err := erc.GetReputationSummaryForClients(agentID, clients, tag1, tag2)
+	if err != nil {
+		return nil, err
+	}
+	return reputationResult{AgentID: agentID.String(), Count: summary.Count, Value: summary.Value.String(), Decimals: summary.Decimals}, nil
+}
+
+func (m *meshTools) ercClient() (*agent.ERC8004Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.erc == nil {
+		m.erc = agent.NewERC8004Client(m.rpcURL, zeroAddress, m.reputationAddr, zeroAddress)
+		if m.erc == nil {
+			return nil, fmt.Errorf("failed to connect to RPC %s", m.rpcURL)
+		}
+	}
+	return m.erc, nil
+}
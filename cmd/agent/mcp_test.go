@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"agentmesh/pkg/mcp"
+)
+
+func TestMCPMeshTools(t *testing.T) {
+	tools := &meshTools{apiAddr: fakeNode(t)}
+	server := mcp.NewServer("agentmesh", "test", tools.list)
+
+	session := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2024-11-05","capabilities":{},"clientInfo":{"name":"script","version":"0"}}}`,
+		`{"jsonrpc":"2.0","method":"notifications/initialized"}`,
+		`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`,
+		`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"mesh_find_agents","arguments":{"capability":"summarize"}}}`,
+	}, "\n") + "\n"
+	var out bytes.Buffer
+	if err := server.ServeStdio(context.Background(), strings.NewReader(session), &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d responses, want 3 (none for the notification):\n%s", len(lines), out.String())
+	}
+
+	var list struct {
+		Result struct {
+			Tools []mcp.Tool `json:"tools"`
+		} `json:"result"`
+	}
+	json.Unmarshal([]byte(lines[1]), &list)
+	byName := map[string]mcp.Tool{}
+	for _, tool := range list.Result.Tools {
+		byName[tool.Name] = tool
+	}
+	for _, name := range []string{"mesh_find_agents", "mesh_request_knowledge", "mesh_delegate_task", "mesh_get_reputation", "mesh_poll"} {
+		if _, ok := byName[name]; !ok {
+			t.Errorf("tools/list lacks %s", name)
+		}
+	}
+	// The delegation schema comes from the node's capabilities
+	props := byName["mesh_delegate_task"].InputSchema["properties"].(map[string]interface{})
+	capability := props["capability"].(map[string]interface{})
+	if enum, _ := capability["enum"].([]interface{}); len(enum) != 1 || enum[0] != "summarize" {
+		t.Errorf("capability schema = %v, want enum [summarize]", capability)
+	}
+	payload := props["payload"].(map[string]interface{})
+	if anyOf, _ := payload["anyOf"].([]interface{}); len(anyOf) != 1 || !strings.Contains(mustJSON(t, anyOf[0]), `"required":["text"]`) {
+		t.Errorf("payload schema = %v, want the summarize schema", payload)
+	}
+
+	var call struct {
+		Result mcp.CallResult `json:"result"`
+	}
+	json.Unmarshal([]byte(lines[2]), &call)
+	if call.Result.IsError || len(call.Result.Content) != 1 || !strings.Contains(call.Result.Content[0].Text, "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN") {
+		t.Errorf("mesh_find_agents = %+v, want the summarize peer", call.Result)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
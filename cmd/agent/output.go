@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exit codes are part of the CLI contract for scripts wrapping the binary.
+const (
+	exitOK           = 0 // success
+	exitRuntime      = 1 // runtime error (RPC, database, node API failures)
+	exitUsage        = 2 // bad flags, arguments or unknown command
+	exitPrecondition = 3 // the command cannot run yet, e.g. no wallet or not registered
+)
+
+// Output modes selected with -output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var (
+	outputMode = outputText
+	jsonAlias  bool
+
+	// resultOut receives command results. In json mode os.Stdout is pointed at
+	// stderr so that log lines printed by the node never corrupt the document.
+	resultOut = os.Stdout
+	resultMu  sync.Mutex
+)
+
+func addOutputFlags(fs *flag.FlagSet) {
+	fs.StringVar(&outputMode, "output", outputText, "Output format: text or json")
+	fs.BoolVar(&jsonAlias, "json", false, "Shorthand for -output json")
+}
+
+// parseFlags parses a subcommand's flags, fills unset flags from the config
+// file and applies the output mode.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	configPath := fs.String("config", defaultConfigFile, "Config file providing defaults for these flags")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = applyConfig(fs, cfg)
+	} else if os.IsNotExist(err) && (!flagSet(fs, "config") || createsConfig(fs)) {
+		err = nil
+	}
+	if err != nil {
+		usagef("%v", err)
+	}
+
+	if jsonAlias {
+		outputMode = outputJSON
+	}
+	switch outputMode {
+	case outputText:
+	case outputJSON:
+		resultOut = os.Stdout
+		os.Stdout = os.Stderr
+	default:
+		usagef("invalid -output %q (want text or json)", outputMode)
+	}
+}
+
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func jsonMode() bool {
+	return outputMode == outputJSON
+}
+
+// output prints v as a single JSON document in json mode, otherwise calls text.
+func output(v interface{}, text func()) {
+	if jsonMode() {
+		resultMu.Lock()
+		defer resultMu.Unlock()
+		enc := json.NewEncoder(resultOut)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	text()
+}
+
+// emitEvent writes one newline-delimited JSON event in json mode. It is used
+// by long-running commands instead of output.
+func emitEvent(kind string, data interface{}) {
+	if !jsonMode() {
+		return
+	}
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	json.NewEncoder(resultOut).Encode(struct {
+		Event string      `json:"event"`
+		Time  int64       `json:"time"`
+		Data  interface{} `json:"data,omitempty"`
+	}{kind, time.Now().UnixMilli(), data})
+}
+
+// fail reports an error and exits with code. In json mode the error is also
+// written to stdout as {"error": ..., "exitCode": ...}.
+func fail(code int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintln(os.Stderr, msg)
+	if jsonMode() {
+		resultMu.Lock()
+		json.NewEncoder(resultOut).Encode(map[string]interface{}{"error": msg, "exitCode": code})
+		resultMu.Unlock()
+	}
+	os.Exit(code)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fail(exitRuntime, format, args...)
+}
+
+func usagef(format string, args ...interface{}) {
+	fail(exitUsage, format, args...)
+}
+
+func preconditionf(format string, args ...interface{}) {
+	fail(exitPrecondition, format, args...)
+}
+
+// named formats an address or peer ID with its name, if it has one:
+// "alice.eth (0x12…)".
+func named(name, id string) string {
+	if name == "" {
+		return id
+	}
+	return fmt.Sprintf("%s (%s)", name, id)
+}
+
+// orDash returns s, or "-" for an empty column.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// runCLI runs the agent binary's main with args in a child process, since
+// commands exit and swap os.Stdout, in dir. It returns stdout and the exit
+// code.
+func runCLI(t *testing.T, dir string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestCLIChild$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "AGENTMESH_CLI_CHILD=1")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// TestCLIChild is the child process of runCLI.
+func TestCLIChild(t *testing.T) {
+	if os.Getenv("AGENTMESH_CLI_CHILD") != "1" {
+		t.Skip("run by runCLI")
+	}
+	for i, a := range os.Args {
+		if a == "--" {
+			os.Args = append([]string{"agent"}, os.Args[i+1:]...)
+			break
+		}
+	}
+	main()
+	os.Exit(exitOK)
+}
+
+// fakeNode answers the control API with canned documents.
+func fakeNode(t *testing.T) string {
+	t.Helper()
+	routes := map[string]string{
+		"GET /status":       `{"peerId":"12D3KooWGoldenPeer","addrs":["/ip4/127.0.0.1/tcp/4001","/ip4/127.0.0.1/udp/4001/quic-v1"],"transports":["quic","tcp"],"connectedPeers":2,"watcherBlock":1200,"wallet":"0x00000000000000000000000000000000000000A1","schemaVersion":6,"startedAt":1700000000}`,
+		"GET /tasks":        `[{"id":"task:1","kind":"task","client":"0x00000000000000000000000000000000000000c1","specHash":"0x0000000000000000000000000000000000000000000000000000000000000001","amount":"1000","status":"received","createdAt":1700000000,"updatedAt":1700000000}]`,
+		"GET /tasks/task:1": `{"id":"task:1","kind":"task","client":"0x00000000000000000000000000000000000000c1","specHash":"0x0000000000000000000000000000000000000000000000000000000000000001","amount":"1000","status":"received","createdAt":1700000000,"updatedAt":1700000000}`,
+		"GET /peers":        `[{"peerId":"QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN","ethAddress":"0x00000000000000000000000000000000000000c2","capability":"summarize","lastSeen":1700000000,"blocked":false}]`,
+		"GET /peers/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN": `{"peerId":"QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN","lastSeen":1700000000,"blocked":false,"misbehavior":42.5,"misbehaviorAt":1700000600000,"bannedUntil":1700000600000,"banned":false,"bans":[{"peerId":"QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN","violation":"bad_signature","score":105,"startedAt":1700000000000,"until":1700000600000}]}`,
+		"GET /routes":           `[{"capability":"summarize","peers":[{"peerId":"QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN","lastSeen":1700000000000}]}]`,
+		"GET /reputation/42":    `{"agentId":"42","score":3.5,"normalized":0.675,"events":6,"updatedAt":1700000000000}`,
+		"GET /wallet":           `{"address":"0x00000000000000000000000000000000000000A1","balance":"5000"}`,
+		"GET /capabilities":     `[{"name":"summarize","description":"Summarize a document","handler":"echo","schema":{"type":"object","required":["text"]},"pricing":{"amount":"1000","unit":"task"}}]`,
+		"GET /agent-card":       `{"type":"https://eips.ethereum.org/EIPS/eip-8004#registration-v1","name":"12D3KooWGoldenPeer","description":"agentmesh node","services":[{"name":"A2A","endpoint":"p2p://12D3KooWGoldenPeer","version":"1.0.0"}],"capabilities":[{"name":"summarize","description":"Summarize a document"}],"active":true}`,
+		"POST /identity/rotate": `{"oldPeerId":"12D3KooWGoldenPeer","newPeerId":"12D3KooWGoldenNext","rotatedAt":1700000000,"retireAt":1700086400,"agentId":"42"}`,
+		"POST /peers/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN/block": `{}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			body = `{"error":"not found"}`
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// TestJSONOutputGolden checks each command's -json document against
+// testdata/golden. Run with -update to rewrite them after an intended change.
+func TestJSONOutputGolden(t *testing.T) {
+	api := fakeNode(t)
+	const down = "127.0.0.1:1"
+	const peerID = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"status", []string{"status", "-json", "-api", api}, exitOK},
+		{"status_offline", []string{"status", "-json", "-api", down}, exitOK},
+		{"tasks_list", []string{"tasks", "list", "-json", "-api", api}, exitOK},
+		{"tasks_show", []string{"tasks", "show", "-json", "-api", api, "task:1"}, exitOK},
+		{"tasks_show_missing", []string{"tasks", "show", "-json", "-api", api, "task:404"}, exitRuntime},
+		{"tasks_show_usage", []string{"tasks", "show", "-json", "-api", api}, exitUsage},
+		{"peers_list", []string{"peers", "list", "-json", "-api", api}, exitOK},
+		{"peers_show", []string{"peers", "show", "-json", "-api", api, peerID}, exitOK},
+		{"peers_show_offline", []string{"peers", "show", "-json", "-api", down, peerID}, exitPrecondition},
+		{"peers_block", []string{"peers", "block", "-json", "-api", api, peerID}, exitOK},
+		{"peers_routes", []string{"peers", "routes", "-json", "-api", api}, exitOK},
+		{"peers_routes_offline", []string{"peers", "routes", "-json", "-api", down}, exitPrecondition},
+		{"peers_reputation", []string{"peers", "reputation", "-json", "-api", api, "42"}, exitOK},
+		{"capabilities_list", []string{"capabilities", "list", "-json", "-api", api}, exitOK},
+		{"capabilities_card", []string{"capabilities", "card", "-json", "-api", api}, exitOK},
+		{"wallet_address", []string{"wallet", "address", "-json", "-api", api}, exitOK},
+		{"wallet_balance", []string{"wallet", "balance", "-json", "-api", api}, exitOK},
+		{"keys_rotate", []string{"keys", "rotate", "-json", "-api", api}, exitOK},
+		{"config_get", []string{"config", "get", "-json", "rpc"}, exitOK},
+		{"config_set", []string{"config", "set", "-json", "max-hops", "5"}, exitOK},
+		{"config_unset", []string{"config", "unset", "-json", "rpc"}, exitOK},
+		{"config_list", []string{"config", "list", "-json"}, exitOK},
+		{"simulate", []string{"simulate", "-json", "-events", "events.jsonl", "-workspace", "workspace"}, exitOK},
+		{"init", []string{"init", "-json", "-non-interactive", "-skip", "identity,wallet,rpc,register"}, exitOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "agentmesh.json"), `{"rpc": "http://rpc.test"}`)
+			writeFile(t, filepath.Join(dir, "events.jsonl"), goldenEvents)
+			writeFile(t, filepath.Join(dir, "workspace", "rust.md"), "# Rust\nOwnership and borrowing.\n")
+
+			out, code := runCLI(t, dir, tt.args...)
+			if code != tt.code {
+				t.Errorf("exit code %d, want %d", code, tt.code)
+			}
+
+			golden := filepath.Join("testdata", "golden", tt.name+".json")
+			if *update {
+				if err := os.WriteFile(golden, []byte(out), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if out != string(want) {
+				t.Errorf("-json output differs from %s:\n got: %s\nwant: %s", golden, out, want)
+			}
+		})
+	}
+}
+
+const goldenEvents = `{"kind":"task_created","block":100,"time":1700000000000,"id":"1","account":"0x00000000000000000000000000000000000000c1","hash":"0x0000000000000000000000000000000000000000000000000000000000000001","amount":"1000"}
+{"kind":"task_created","block":100,"time":1700000000000,"id":"1","account":"0x00000000000000000000000000000000000000c1","hash":"0x0000000000000000000000000000000000000000000000000000000000000001","amount":"1000"}
+{"kind":"knowledge_requested","block":101,"time":1700000002000,"id":"2","account":"0x00000000000000000000000000000000000000c2","hash":"0x0000000000000000000000000000000000000000000000000000000000000002","amount":"500","topic":"rust","peerId":"QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"}
+`
+
+func writeFile(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"time"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func peersCmd(args []string) {
+	action, rest := subcommand("peers", args, "list", "show", "block", "routes", "reputation")
+
+	fs := flag.NewFlagSet("peers "+action, flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	l := addLedgerFlags(fs)
+	m := addMisbehaviorFlags(fs)
+	out := fs.String("out", "", "Write the exported ledger to this file instead of stdout (for 'reputation' without an agentId)")
+	parseFlags(fs, rest)
+
+	switch action {
+	case "list":
+		var peers []agent.PeerRecord
+		err := apiGet(g.apiAddr, "/peers", &peers)
+		if err == errNodeDown {
+			store := g.openStore()
+			defer store.Close()
+			peers, err = store.ListPeers()
+		}
+		if err != nil {
+			fatalf("Failed to list peers: %v", err)
+		}
+		if peers == nil {
+			peers = []agent.PeerRecord{}
+		}
+		output(peers, func() {
+			if len(peers) == 0 {
+				fmt.Println("No peers seen yet.")
+				return
+			}
+			fmt.Printf("%-54s %-20s %-20s %-8s %s\n", "PEER ID", "NAME", "CAPABILITY", "BLOCKED", "LAST SEEN")
+			for _, p := range peers {
+				fmt.Printf("%-54s %-20s %-20s %-8t %s\n", p.PeerID, orDash(p.Name), p.Capability, p.Blocked, time.Unix(p.LastSeen, 0).Format(time.RFC3339))
+			}
+		})
+
+	case "show":
+		if fs.NArg() != 1 {
+			usagef("usage: agent peers show [flags] <peerId>")
+		}
+		id := fs.Arg(0)
+		if _, err := peer.Decode(id); err != nil {
+			usagef("Invalid peer id %q: %v", id, err)
+		}
+
+		var p *agent.PeerStanding
+		err := apiGet(g.apiAddr, "/peers/"+url.PathEscape(id), &p)
+		if err == errNodeDown {
+			// Offline, the stored score is decayed as the misbehavior flags say
+			config, err := m.config()
+			if err != nil {
+				usagef("%v", err)
+			}
+			store := g.openStore()
+			defer store.Close()
+			p, err = agent.NewPeerGuard(store, config).Standing(id)
+			if err != nil {
+				fatalf("Failed to read peer %s: %v", id, err)
+			}
+		} else if err != nil {
+			fatalf("Failed to read peer %s: %v", id, err)
+		}
+		if p == nil {
+			preconditionf("No record of peer %s", id)
+		}
+		output(p, func() {
+			fmt.Printf("Peer:        %s\n", p.PeerID)
+			if p.Name != "" {
+				fmt.Printf("Name:        %s\n", p.Name)
+			}
+			if p.EthAddress != "" {
+				fmt.Printf("Wallet:      %s\n", p.EthAddress)
+			}
+			if p.Capability != "" {
+				fmt.Printf("Capability:  %s\n", p.Capability)
+			}
+			if p.LastSeen > 0 {
+				fmt.Printf("Last seen:   %s\n", time.Unix(p.LastSeen, 0).Format(time.RFC3339))
+			}
+			fmt.Printf("Blocked:     %t\n", p.Blocked)
+			fmt.Printf("Misbehavior: %.1f\n", p.Misbehavior)
+			if p.Banned {
+				fmt.Printf("Banned until %s\n", time.UnixMilli(p.BannedUntil).Format(time.RFC3339))
+			}
+			if len(p.Bans) == 0 {
+				return
+			}
+			fmt.Printf("\n%-26s %-26s %-20s %s\n", "BANNED AT", "UNTIL", "VIOLATION", "SCORE")
+			for _, b := range p.Bans {
+				fmt.Printf("%-26s %-26s %-20s %.1f\n", time.UnixMilli(b.StartedAt).Format(time.RFC3339), time.UnixMilli(b.Until).Format(time.RFC3339), b.Violation, b.Score)
+			}
+		})
+
+	case "block":
+		if fs.NArg() != 1 {
+			usagef("usage: agent peers block [flags] <peerId>")
+		}
+		id := fs.Arg(0)
+		if _, err := peer.Decode(id); err != nil {
+			usagef("Invalid peer id %q: %v", id, err)
+		}
+
+		err := apiPost(g.apiAddr, "/peers/"+url.PathEscape(id)+"/block", nil)
+		if err == errNodeDown {
+			store := g.openStore()
+			defer store.Close()
+			err = store.SetPeerBlocked(id, true)
+		}
+		if err != nil {
+			fatalf("Failed to block %s: %v", id, err)
+		}
+		output(map[string]string{"peerId": id, "status": "blocked"}, func() {
+			fmt.Printf("Blocked %s\n", id)
+		})
+
+	case "routes":
+		// The routing table is built from live announcements and never stored
+		var routes []agent.Route
+		err := apiGet(g.apiAddr, "/routes", &routes)
+		if err == errNodeDown {
+			preconditionf("The routing table lives in the running node; start it with 'agent run'")
+		} else if err != nil {
+			fatalf("Failed to get routes: %v", err)
+		}
+		output(routes, func() {
+			if len(routes) == 0 {
+				fmt.Println("No capability routes yet.")
+				return
+			}
+			fmt.Printf("%-20s %-54s %s\n", "CAPABILITY", "PEER ID", "LAST SEEN")
+			for _, r := range routes {
+				for _, p := range r.Peers {
+					fmt.Printf("%-20s %-54s %s\n", r.Capability, p.PeerID, time.UnixMilli(p.LastSeen).Format(time.RFC3339))
+				}
+			}
+		})
+
+	case "reputation":
+		if fs.NArg() > 1 {
+			usagef("usage: agent peers reputation [flags] [agentId]")
+		}
+		// Offline, the stored scores are decayed as the -ledger-* flags say
+		ledgerConfig := func() agent.LedgerConfig {
+			config, err := l.config()
+			if err != nil {
+				usagef("%v", err)
+			}
+			return config
+		}
+
+		if fs.NArg() == 1 {
+			id := fs.Arg(0)
+			if _, ok := new(big.Int).SetString(id, 10); !ok {
+				usagef("Invalid agentId %q: want a decimal number", id)
+			}
+			var entry *agent.LedgerEntry
+			err := apiGet(g.apiAddr, "/reputation/"+id, &entry)
+			if err == errNodeDown {
+				store := g.openStore()
+				defer store.Close()
+				entry, err = agent.NewReputationLedger(store, ledgerConfig()).Get(id)
+			}
+			if err != nil {
+				fatalf("Failed to read the reputation of agent %s: %v", id, err)
+			}
+			if entry == nil {
+				preconditionf("No interactions with agent %s yet", id)
+			}
+			output(entry, func() {
+				fmt.Printf("Agent:      %s\n", entry.AgentID)
+				fmt.Printf("Score:      %.3f (%.2f normalized)\n", entry.Score, entry.Normalized)
+				fmt.Printf("Events:     %d\n", entry.Events)
+				fmt.Printf("Last event: %s\n", time.UnixMilli(entry.UpdatedAt).Format(time.RFC3339))
+			})
+			return
+		}
+
+		var entries []agent.LedgerEntry
+		err := apiGet(g.apiAddr, "/reputation", &entries)
+		if err == errNodeDown {
+			store := g.openStore()
+			defer store.Close()
+			entries, err = agent.NewReputationLedger(store, ledgerConfig()).Export()
+		}
+		if err != nil {
+			fatalf("Failed to export the reputation ledger: %v", err)
+		}
+		if entries == nil {
+			entries = []agent.LedgerEntry{}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if *out == "" {
+			// The export is the result, in either output mode
+			resultOut.Write(append(data, '\n'))
+			return
+		}
+		if err := os.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+			fatalf("Failed to write %s: %v", *out, err)
+		}
+		output(map[string]interface{}{"path": *out, "agents": len(entries)}, func() {
+			fmt.Printf("Exported %d agents to %s\n", len(entries), *out)
+		})
+	}
+}
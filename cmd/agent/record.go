@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func recordCmd(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	c := addChainFlags(fs)
+	addOutputFlags(fs)
+	escrowAddr := fs.String("escrow", defaultEscrow, "TaskEscrow contract address")
+	marketAddr := fs.String("market", defaultMarket, "KnowledgeMarket contract address")
+	outPath := fs.String("out", "events.jsonl", "File the recorded events are appended to")
+	pollInterval := fs.Duration("poll-interval", agent.DefaultPollInterval, "How often the watcher polls the RPC for new blocks")
+	parseFlags(fs, args)
+
+	f, err := os.OpenFile(*outPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		fatalf("Failed to open %s: %v", *outPath, err)
+	}
+	defer f.Close()
+
+	// Resolve requesters while recording so a replay can reproduce the lookup offline
+	client, _ := c.ercClient()
+	if client != nil {
+		defer client.Close()
+	}
+	resolve := func(wallet common.Address) string {
+		if client == nil {
+			return ""
+		}
+		agentId, err := client.GetAgentIdByWallet(wallet)
+		if err != nil {
+			return ""
+		}
+		peerId, _ := client.ResolvePeerID(agentId)
+		return peerId
+	}
+
+	var mu sync.Mutex
+	count := 0
+	write := func(e agent.RecordedEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := json.NewEncoder(f).Encode(e); err != nil {
+			fmt.Printf("[Record] Failed to write event: %v\n", err)
+			return
+		}
+		count++
+		fmt.Printf("[Record] %s %s (block %d)\n", e.Kind, e.ID, e.Block)
+		emitEvent("recorded", e)
+	}
+
+	watcher, err := agent.NewEventWatcher(c.rpcURL, []string{*escrowAddr}, []string{*marketAddr}, func(e agent.TaskCreatedEvent) {
+		write(agent.RecordTask(e))
+	}, func(q agent.KnowledgeRequestedEvent) {
+		rec := agent.RecordQuery(q)
+		rec.PeerID = resolve(q.Requester)
+		write(rec)
+	}, agent.WithPollInterval(*pollInterval))
+	if err != nil {
+		fatalf("Failed to connect to RPC %s: %v", c.rpcURL, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("Recording chain events to %s (Ctrl-C to stop)\n", *outPath)
+	watcher.Start(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Printf("Recorded %d events.\n", count)
+	emitEvent("stopped", map[string]int{"events": count})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+type registerResult struct {
+	AgentID    string `json:"agentId"`
+	PeerID     string `json:"peerId"`
+	Wallet     string `json:"wallet"`
+	Registered bool   `json:"registered"` // false if an existing identity was reused or nothing was sent
+	// DryRun means nothing was sent; Simulated lists what would have been
+	DryRun    bool                 `json:"dryRun,omitempty"`
+	Simulated []agent.TxSimulation `json:"simulated,omitempty"`
+}
+
+// errNeedURI means the wallet has no identity and no agentURI was given.
+var errNeedURI = errors.New("wallet has no agent identity yet; pass -uri to register one")
+
+func registerCmd(args []string) {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	c := addChainFlags(fs)
+	uri := fs.String("uri", "", "Agent registration file URI (agent.json), required for a new identity")
+	keyPath := fs.String("key", defaultKeyFile, "Path to the libp2p identity key (created if missing)")
+	addOutputFlags(fs)
+	parseFlags(fs, args)
+
+	wallet, err := agent.LoadWallet(c.walletPath)
+	if err != nil {
+		preconditionf("%v", err)
+	}
+	priv, err := agent.LoadOrCreateIdentity(*keyPath)
+	if err != nil {
+		fatalf("Failed to load identity: %v", err)
+	}
+	client, err := c.ercClient()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer client.Close()
+
+	result, err := registerIdentity(client, wallet, priv, *uri)
+	if err == errNeedURI {
+		preconditionf("Wallet %s: %v", wallet.Address.Hex(), err)
+	} else if err != nil {
+		fatalf("%v", err)
+	}
+	result.DryRun = client.DryRun()
+	result.Simulated = client.Simulations()
+
+	output(result, func() {
+		if client.DryRun() {
+			printSimulations(result.Simulated)
+			return
+		}
+		if result.Registered {
+			fmt.Printf("Registered agent %s for wallet %s\n", result.AgentID, result.Wallet)
+		} else {
+			fmt.Printf("Using existing agent %s for wallet %s\n", result.AgentID, result.Wallet)
+		}
+		fmt.Printf("Published peerId %s\n", result.PeerID)
+	})
+}
+
+// registerIdentity makes sure the wallet owns an ERC-8004 identity and that its
+// peerId metadata points at priv's peer ID, with a binding signed by priv.
+// Both steps are skipped when already done. In dry-run mode the transactions
+// are only simulated; see client.Simulations.
+func registerIdentity(client *agent.ERC8004Client, wallet *agent.Wallet, priv crypto.PrivKey, uri string) (registerResult, error) {
+	pid, err := agent.PeerIDFromKey(priv)
+	if err != nil {
+		return registerResult{}, fmt.Errorf("failed to derive peer id: %w", err)
+	}
+	result := registerResult{PeerID: pid.String(), Wallet: wallet.Address.Hex()}
+
+	// Reuse an identity already owned by this wallet instead of minting another
+	var agentId *big.Int
+	if existing, err := client.GetAgentIdByWallet(wallet.Address); err == nil {
+		agentId = existing
+	} else {
+		if uri == "" {
+			return result, errNeedURI
+		}
+		agentId, err = client.Register(wallet, uri)
+		if errors.Is(err, agent.ErrDryRun) {
+			// Nothing was registered, and setMetadata can't be simulated for
+			// an agent that doesn't exist yet
+			return result, nil
+		} else if err != nil {
+			return result, err
+		}
+		result.Registered = true
+	}
+	result.AgentID = agentId.String()
+
+	current, _ := client.GetMetadata(agentId, "peerId")
+	if current != pid.String() || client.VerifyPeerBinding(agentId, current) != nil {
+		if err := client.BindPeerID(wallet, agentId, priv); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
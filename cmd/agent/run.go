@@ -0,0 +1,1099 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/peer"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// runFlags are the flags of 'agent run'. They double as the schema of the
+// config file: the keys 'agent config' accepts are these flag names.
+type runFlags struct {
+	*globalFlags
+	*chainFlags
+	*ledgerFlags
+	*misbehaviorFlags
+	workspace      string
+	listenAddrs    listFlag
+	keyPath        string
+	escrowAddr     string
+	marketAddr     string
+	chains         string
+	preferChain    uint64
+	pollInterval   time.Duration
+	pollJitter     float64
+	confirmations  uint64
+	leaderElection bool
+	maxBlockLag    uint64
+	blockTime      time.Duration
+	maxHeadLag     uint64
+	contractABIs   string
+	onlyClients    listFlag
+	onlyTopics     listFlag
+	forward        bool
+	maxHops        int
+	taskWorkers    int
+	taskQueue      int
+	peerStreams    int
+	p2pMemory      int64
+	p2pFDs         int
+	p2pLimits      string
+	schedWeights   string
+	schedAging     time.Duration
+	batchInterval  time.Duration
+	batchSize      int
+	publishBuffer  int
+	publishTimeout time.Duration
+	compress       string
+	compressAbove  int
+	maxDecompress  int
+	ackTimeout     time.Duration
+	redeliverAfter time.Duration
+	anchorEvery    time.Duration
+	verification   string
+	publishPeerID  bool
+	courtesy       bool
+	courtesyText   string
+	courtesyPeer   int
+	courtesyEvery  time.Duration
+	minPayment     string
+	bidBudgets     listFlag
+	pricing        string
+	pricingCap     string
+	quoteTTL       time.Duration
+	clockSkew      time.Duration
+	relays         listFlag
+	bootstrap      listFlag
+	bootstrapEvery time.Duration
+	pex            bool
+	pexInterval    time.Duration
+	pexSample      int
+	pexTrusted     listFlag
+	probe          bool
+	probeInterval  time.Duration
+	capabilities   listFlag
+	answerTTL      time.Duration
+	answerEntries  int
+	answerBytes    int64
+	answerDir      string
+	invocationsTTL time.Duration
+	eventArchive   string
+	apiToken       string
+	apiAuth        string
+	resultsDir     string
+	taskDirAge     time.Duration
+	quarantine     bool
+	grpcAddr       string
+	grpcCert       string
+	grpcKey        string
+	grpcClientCA   string
+	otlpEndpoint   string
+	traceSample    float64
+	metrics        bool
+	metricsPush    string
+	pushInterval   time.Duration
+	evalURL        string
+	evalModel      string
+	evalAPIKey     string
+	evalTimeout    time.Duration
+	evalMaxCalls   int
+	weights        string
+	exploreRate    float64
+	reviewers      listFlag
+	repBlock       string
+	repViews       string
+	repViewsReload time.Duration
+	verifyGossip   bool
+	minFeedback    uint64
+	gossipTTL      time.Duration
+	validationAddr string
+	validate       listFlag
+	validationSize int64
+	validationTime time.Duration
+	validationTTL  time.Duration
+	policyPath     string
+	policyDefault  string
+	policyList     string
+	policyReload   time.Duration
+	ensRegistry    string
+	names          bool
+	nameTTL        time.Duration
+}
+
+func newRunFlags() (*flag.FlagSet, *runFlags) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	o := &runFlags{globalFlags: addGlobalFlags(fs), chainFlags: addChainFlags(fs), ledgerFlags: addLedgerFlags(fs), misbehaviorFlags: addMisbehaviorFlags(fs)}
+	fs.StringVar(&o.workspace, "workspace", "./workspace", "Path to OpenClaw workspace")
+	fs.Var(&o.listenAddrs, "listen", "libp2p listen multiaddr on TCP (/tcp/N), QUIC (/udp/N/quic-v1) or WebSocket (/tcp/N/ws); repeatable, or a list in the config file (default TCP and QUIC on ports the OS picks)")
+	fs.StringVar(&o.keyPath, "key", defaultKeyFile, "Path to the libp2p identity key (created if missing)")
+	fs.StringVar(&o.escrowAddr, "escrow", defaultEscrow, "TaskEscrow contract address")
+	fs.StringVar(&o.marketAddr, "market", defaultMarket, "KnowledgeMarket contract address")
+	fs.StringVar(&o.chains, "chains", "", "YAML file of chain profiles to work on at once, the primary first; replaces -rpc, -identity, -escrow and -market")
+	fs.Uint64Var(&o.preferChain, "prefer-chain", 0, "Chain ID whose candidates selection ranks first (0 for none)")
+	fs.DurationVar(&o.pollInterval, "poll-interval", agent.DefaultPollInterval, "How often the watcher polls the RPC for new blocks")
+	fs.Float64Var(&o.pollJitter, "poll-jitter", 0.1, "Randomise each poll delay by up to this fraction of -poll-interval")
+	fs.Uint64Var(&o.confirmations, "confirmations", 0, "Only process events this many blocks behind the head")
+	fs.Uint64Var(&o.maxBlockLag, "max-block-lag", agent.DefaultMaxBlockLag, "Blocks the watcher may trail the head and still report ready")
+	fs.DurationVar(&o.blockTime, "block-time", agent.DefaultBlockTime, "The chain's block time, for telling how far the RPC's head is behind")
+	fs.Uint64Var(&o.maxHeadLag, "max-head-lag", agent.DefaultMaxHeadLag, "Blocks the RPC's head may trail the chain before a warning is logged and the node reports not ready")
+	fs.StringVar(&o.contractABIs, "contract-abis", "", "YAML file of the ABI versions of upgraded escrow and market contracts, each from a block on; logs are decoded with the version in force at their block")
+	fs.Var(&o.onlyClients, "watch-requesters", "Only act on tasks and knowledge requests from this wallet; the watcher skips others' events without decoding them. Repeatable, or a list in the config file (none for every requester)")
+	fs.Var(&o.onlyTopics, "watch-topics", "Only answer knowledge requests on exactly this topic; the watcher skips requests on others without decoding them. Repeatable, or a list in the config file (none for every topic)")
+	fs.BoolVar(&o.forward, "forward", false, "Relay tasks for capabilities this node doesn't serve to a peer that announced them")
+	fs.IntVar(&o.maxHops, "max-hops", agent.DefaultMaxHops, "How many times a forwarded task may be relayed before it is refused")
+	fs.IntVar(&o.taskWorkers, "task-workers", agent.DefaultTaskWorkers, "How many tasks from peers run at once")
+	fs.IntVar(&o.taskQueue, "task-queue", agent.DefaultTaskQueue, "How many tasks from peers may wait for a worker before more are refused as busy")
+	fs.Int64Var(&o.p2pMemory, "p2p-memory", 0, "Bytes of memory libp2p's connection, stream and memory limits scale to (0 for an eighth of the system's memory)")
+	fs.IntVar(&o.p2pFDs, "p2p-fds", 0, "File descriptors libp2p's limits scale to (0 for half the process's limit)")
+	fs.StringVar(&o.p2pLimits, "p2p-limits", "", "JSON file of libp2p resource limits overriding the scaled ones, in libp2p's PartialLimitConfig layout")
+	fs.IntVar(&o.peerStreams, "streams-per-peer", agent.DefaultStreamsPerPeer, "How many task streams one peer may have open at once (0 means no limit)")
+	fs.StringVar(&o.schedWeights, "schedule-weights", "deadline=0.6,reward=0.25,duration=0.15", "Weights of the scores tasks submitted to the /v1 API are run in order of: time to their deadline, reward and estimated duration")
+	fs.DurationVar(&o.schedAging, "schedule-aging", agent.DefaultScheduleAging, "How long a queued /v1 task waits before it outranks any task just submitted")
+	fs.DurationVar(&o.batchInterval, "write-batch-interval", agent.DefaultWriteBatchInterval, "How long the writes of chain events and /v1 tasks are collected into one database transaction before it commits (0 commits each write on its own)")
+	fs.IntVar(&o.batchSize, "write-batch-size", agent.DefaultWriteBatchSize, "Writes that commit a batch before -write-batch-interval is up")
+	fs.IntVar(&o.publishBuffer, "publish-buffer", agent.DefaultPublishBuffer, "Capability announcements that may wait to be published over pubsub; more are dropped and counted while the network is slow")
+	fs.StringVar(&o.compress, "compress", "off", "Compress large task messages and pubsub announcements: gzip, zstd or off. Peers are sent compressed task messages once they say they read them; every node reads compressed announcements from this version on")
+	fs.IntVar(&o.compressAbove, "compress-threshold", agent.DefaultCompressionThreshold, "Bytes of JSON a payload must reach to be compressed")
+	fs.IntVar(&o.maxDecompress, "max-decompressed", agent.DefaultMaxDecompressed, "Bytes a received compressed task message or announcement may expand to; decompression stops there and the message is refused")
+	fs.DurationVar(&o.ackTimeout, "ack-timeout", agent.DefaultAckTimeout, "How long a requester has to acknowledge the answer to its knowledge request before it is sent again")
+	fs.DurationVar(&o.redeliverAfter, "redeliver-after", 0, "Send an answer again this long after its requester couldn't be reached (0 waits for the next start)")
+	fs.DurationVar(&o.anchorEvery, "anchor-interval", 0, "Publish the merkle root of new countersigned interaction records in the agent's metadata this often (0 never)")
+	fs.StringVar(&o.verification, "verification", string(agent.VerifyStrict), "What becomes of announcements, peer ID bindings and moved notices whose signatures don't verify: strict (rejected), permissive (accepted, marked unverified) or off (not checked; for development only)")
+	fs.BoolVar(&o.publishPeerID, "publish-peer-id", false, "At startup, point the wallet's agent at this node's peer ID, with a binding, if it names another (sends a transaction)")
+	fs.BoolVar(&o.courtesy, "courtesy", false, "Tell requesters whose tasks or knowledge requests the node skips why, in a signed decline message")
+	fs.StringVar(&o.courtesyText, "courtesy-templates", "", "YAML file of text templates by decline reason (unsupported-topic, price-too-low, at-capacity, not-interested) sent with -courtesy")
+	fs.IntVar(&o.courtesyPeer, "courtesy-per-peer", agent.DefaultCourtesyPerPeer, "Most declines one peer is sent per -courtesy-interval")
+	fs.DurationVar(&o.courtesyEvery, "courtesy-interval", agent.DefaultCourtesyInterval, "Window -courtesy-per-peer counts declines in")
+	fs.StringVar(&o.minPayment, "min-payment", "", "Skip tasks paying less than this many wei, telling requesters with -courtesy (empty for no minimum)")
+	fs.Var(&o.bidBudgets, "bid-budget", "Most the stakes of the node's open bids may come to, as [token=]amount in the token's smallest unit, ETH if it is left out; tasks whose stake would go over it, or over the wallet's balance, are skipped. Repeatable, or a list in the config file (none for no budget)")
+	fs.StringVar(&o.pricing, "pricing", "", "Pricing file (YAML): what each capability costs, adjusted for the requester's reputation and the node's load; tasks paying less than the quote are skipped, and capabilities it prices nothing for decline paid work")
+	fs.StringVar(&o.pricingCap, "pricing-capability", "", "Capability escrow tasks, which name none, are quoted as by -pricing")
+	fs.DurationVar(&o.quoteTTL, "quote-ttl", agent.DefaultQuoteTTL, "How long the price of each negotiation offer, and each counter amount quoted in a decline, stands")
+	fs.DurationVar(&o.clockSkew, "clock-skew", agent.DefaultClockSkew, "How far a counterparty's clock may be off this node's; offers from peers further off are refused and the peers flagged")
+	fs.Var(&o.relays, "relay", "Circuit relay multiaddr, ending in /p2p/<peer ID>, to reach requesters through when no address of theirs works; repeatable, or a list in the config file")
+	fs.Var(&o.bootstrap, "bootstrap", "Multiaddr ending in /p2p/<peer ID> of a peer dialed at startup for the node's first connections, and re-dialed whenever it is lost; repeatable, or a list in the config file, or none for no peers (default the latest agents in the registry that publish addresses)")
+	fs.DurationVar(&o.bootstrapEvery, "bootstrap-interval", agent.DefaultBootstrapInterval, "How often -bootstrap peers are pinged, and those the node lost dialed again")
+	fs.BoolVar(&o.pex, "pex", true, "Swap samples of verified peers and their addresses with connected peers, so the mesh learns of peers it isn't connected to without a DHT")
+	fs.DurationVar(&o.pexInterval, "pex-interval", agent.DefaultPEXInterval, "How often -pex swaps samples with each connected peer")
+	fs.IntVar(&o.pexSample, "pex-sample", agent.DefaultPEXSample, "Peers sent, and taken, in one -pex sample")
+	fs.Var(&o.pexTrusted, "pex-trusted", "Peer ID -pex swaps samples with, refusing every other; repeatable, or a list in the config file (empty for every connected peer)")
+	fs.BoolVar(&o.probe, "probe", true, "Ping the peers in the routing table, ranking and forwarding to the fastest first")
+	fs.DurationVar(&o.probeInterval, "probe-interval", agent.DefaultProbeInterval, "How often -probe pings each routed peer")
+	fs.DurationVar(&o.publishTimeout, "publish-timeout", agent.DefaultPublishTimeout, "How long one pubsub announcement may take to publish before it is dropped")
+	fs.Var(&o.capabilities, "capabilities", "Capability manifest (YAML) to serve and advertise; repeatable, or a list in the config file")
+	fs.DurationVar(&o.answerTTL, "answer-cache-ttl", agent.DefaultAnswerCacheTTL, "How long a capability's answer is reused for the same query (0 to always run the handler)")
+	fs.IntVar(&o.answerEntries, "answer-cache-entries", agent.DefaultAnswerCacheEntries, "Most capability answers kept for reuse")
+	fs.Int64Var(&o.answerBytes, "answer-cache-bytes", agent.DefaultAnswerCacheBytes, "Most bytes of capability answers kept for reuse")
+	fs.StringVar(&o.answerDir, "answer-cache-dir", defaultAnswerCache, "Directory the reused capability answers are kept in")
+	fs.DurationVar(&o.invocationsTTL, "invocation-retention", agent.DefaultInvocationRetention, "How long each capability run is kept once its day is summed up")
+	fs.StringVar(&o.eventArchive, "event-archive", "", "Directory to archive every chain event acted on in, by day, with a SHA-256 manifest (empty keeps none)")
+	fs.StringVar(&o.apiToken, "api-token", "", "Bearer token for the /v1 API that submits tasks to this node (empty disables it)")
+	fs.StringVar(&o.apiAuth, "api-auth", agent.APIAuthBearer, "How the HTTP API authenticates requests: bearer (-api-token on /v1 routes; loopback -api only), hmac (every route signed with -api-secret) or none")
+	fs.StringVar(&o.resultsDir, "results-dir", agent.DefaultResultsDir, "Directory results of tasks submitted to the /v1 API are written to")
+	fs.DurationVar(&o.taskDirAge, "task-dir-retention", agent.DefaultTaskDirRetention, "How long the workspace scratch directory of a task a crash left behind is kept before startup clears it")
+	fs.BoolVar(&o.quarantine, "task-dir-quarantine", false, "Move orphaned task directories to the workspace's .tasks-quarantine instead of removing them")
+	fs.StringVar(&o.grpcAddr, "grpc", "", "Address to serve the NodeControl gRPC API on (empty disables it); needs -api-token or -grpc-client-ca")
+	fs.StringVar(&o.grpcCert, "grpc-cert", "", "TLS certificate (PEM) for the gRPC API; plaintext without it")
+	fs.StringVar(&o.grpcKey, "grpc-key", "", "TLS private key (PEM) for -grpc-cert")
+	fs.StringVar(&o.grpcClientCA, "grpc-client-ca", "", "CA bundle (PEM) gRPC clients must present a certificate from; needs -grpc-cert")
+	fs.StringVar(&o.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint to export traces to, e.g. http://localhost:4318 (empty disables tracing)")
+	fs.Float64Var(&o.traceSample, "trace-sample-rate", agent.DefaultTraceSampleRate, "Share of traces started by this node that are recorded, 0 to 1")
+	fs.BoolVar(&o.metrics, "metrics", false, "Serve Prometheus metrics on GET /metrics of the API")
+	fs.StringVar(&o.metricsPush, "metrics-push", "", "Pushgateway URL to push metrics to, for nodes that can't be scraped (empty disables pushing)")
+	fs.DurationVar(&o.pushInterval, "metrics-push-interval", agent.DefaultMetricsPushInterval, "How often metrics are pushed to -metrics-push")
+	fs.StringVar(&o.evalURL, "eval-url", "", "OpenAI-compatible API base URL, e.g. https://api.openai.com/v1, of a model asked before bidding (empty disables it)")
+	fs.StringVar(&o.evalModel, "eval-model", "", "Model -eval-url is asked with")
+	fs.StringVar(&o.evalAPIKey, "eval-api-key", "", "API key for -eval-url")
+	fs.DurationVar(&o.evalTimeout, "eval-timeout", agent.DefaultEvalTimeout, "How long the -eval-url model may take to answer")
+	fs.IntVar(&o.evalMaxCalls, "eval-max-calls-per-hour", agent.DefaultEvalMaxCallsPerHour, "Most -eval-url calls made in an hour; tasks beyond it are bid on without a verdict (0 means no cap)")
+	fs.StringVar(&o.weights, "selection-weights", "reputation=0.35,successRate=0.3,latency=0.1,price=0.15,recency=0.1", "Weights of the scores counterparties are ranked by when forwarding and delegating")
+	fs.Float64Var(&o.exploreRate, "explore-rate", agent.DefaultExploreRate, "Share of rankings that try a random counterparty first, 0 to 1")
+	fs.Var(&o.reviewers, "reputation-clients", "Wallet whose ERC-8004 feedback counts towards a counterparty's reputation; repeatable, or a list in the config file (none leaves reputation out of rankings)")
+	fs.StringVar(&o.repBlock, "reputation-block", "", "Block -reputation-clients feedback is read at for rankings and gossip verification: latest, safe, finalized or a block number (empty for -read-block)")
+	fs.StringVar(&o.repViews, "reputation-views", "", "Reputation views file (YAML): named sets of wallets whose feedback rankings are scored on, the default one and the one each persona wallet uses; replaces -reputation-clients in rankings and is reloaded when it changes")
+	fs.DurationVar(&o.repViewsReload, "reputation-views-reload", agent.DefaultViewsReload, "How often -reputation-views is checked for changes")
+	fs.BoolVar(&o.verifyGossip, "verify-gossip", false, "Quarantine advertising peers whose wallet-signed advertisement doesn't map to a registered ERC-8004 agent; they are used only when no verified peer serves a capability, and never paid")
+	fs.Uint64Var(&o.minFeedback, "gossip-min-feedback", 0, "Feedback entries from -reputation-clients an advertising agent needs to be verified; needs -verify-gossip")
+	fs.DurationVar(&o.gossipTTL, "gossip-verify-ttl", agent.DefaultGossipVerifyTTL, "How long a verdict on an advertising peer is reused")
+	fs.StringVar(&o.validationAddr, "validation-registry", "", "ERC-8004 ValidationRegistry to answer validation requests addressed to the wallet from (empty disables validating); needs -validate")
+	fs.Var(&o.validate, "validate", "Validation tag this node judges and the handler judging it, as tag=handler, e.g. format=schema; repeatable, or a list in the config file")
+	fs.Int64Var(&o.validationSize, "validation-max-size", agent.DefaultValidationMaxSize, "Largest validation request document fetched, in bytes; bigger requests are skipped")
+	fs.DurationVar(&o.validationTime, "validation-timeout", agent.DefaultValidationTimeout, "How long a validation handler may take; a request it doesn't judge in time gets no response")
+	fs.DurationVar(&o.validationTTL, "validation-deadline", agent.DefaultValidationDeadline, "How long after it is first seen a validation request may still be answered")
+	fs.StringVar(&o.policyPath, "policy", "", "Identity policy file (YAML) of counterparties to allow and deny by agentId, wallet, peerId or ENS name; reloaded when it changes")
+	fs.StringVar(&o.policyDefault, "policy-default", agent.PolicyAllow, "Whether counterparties no policy rule matches are allowed or denied, unless the policy file sets a default (allow or deny)")
+	fs.StringVar(&o.policyList, "policy-list", "", "Identity list contract whose allowed() and denied() wallets are policy rules too (empty for none)")
+	fs.DurationVar(&o.policyReload, "policy-reload", agent.DefaultPolicyReload, "How often -policy and -policy-list are checked for changes")
+	fs.StringVar(&o.ensRegistry, "ens-registry", agent.DefaultENSRegistry, "ENS registry that ens policy rules and counterparty names are resolved through")
+	fs.BoolVar(&o.names, "names", true, "Show counterparties by their ENS or agent card name next to their address or peer ID in the status, peer list, events and logs")
+	fs.DurationVar(&o.nameTTL, "name-ttl", agent.DefaultNameTTL, "How long a counterparty's name, or its lack of one, is cached")
+	fs.BoolVar(&o.leaderElection, "leader-election", false, "Only run the chain watcher while holding the shared watcher lease (for clusters sharing a Postgres store)")
+	return fs, o
+}
+
+func runCmd(args []string) {
+	fs, o := newRunFlags()
+	parseFlags(fs, args)
+	g, c := o.globalFlags, o.chainFlags
+
+	if _, err := agent.ParseListenAddrs(o.listenAddrs); err != nil {
+		usagef("-listen: %v", err)
+	}
+
+	fmt.Printf("Starting AgentMesh Node...\n")
+	fmt.Printf("Database: %s\n", g.dbPath)
+	fmt.Printf("Workspace: %s\n", o.workspace)
+
+	// Ensure workspace exists
+	os.MkdirAll(o.workspace, 0755)
+
+	store, err := agent.OpenMetadataStore(g.dbDriver, g.dbPath)
+	if err != nil {
+		fatalf("Failed to initialize node: %v", err)
+	}
+	node := agent.NewAgentNodeWithStore(store, o.workspace)
+	node.MaxBlockLag = o.maxBlockLag
+	node.Forwarding = o.forward
+	node.MaxHops = o.maxHops
+	if o.taskWorkers < 1 || o.taskQueue < 0 {
+		usagef("-task-workers must be at least 1 and -task-queue at least 0")
+	}
+	node.Workers = agent.NewTaskPool(o.taskWorkers, o.taskQueue)
+	switch {
+	case o.peerStreams < 0:
+		usagef("-streams-per-peer must be at least 0")
+	case o.peerStreams == 0:
+		node.StreamLimit = nil
+	default:
+		node.StreamLimit = agent.NewStreamLimiter(o.peerStreams)
+	}
+	node.Resources = agent.ResourceLimits{Memory: o.p2pMemory, FDs: o.p2pFDs, File: o.p2pLimits}
+	limits, err := node.Resources.Describe()
+	if err != nil {
+		usagef("-p2p-memory, -p2p-fds, -p2p-limits: %v", err)
+	}
+	fmt.Printf("[P2P] Resource limits: %s\n", limits)
+	schedWeights, err := agent.ParseScheduleWeights(o.schedWeights)
+	if err != nil {
+		usagef("-schedule-weights: %v", err)
+	}
+	if o.schedAging <= 0 {
+		usagef("-schedule-aging must be positive")
+	}
+	node.Scheduler.Weights, node.Scheduler.Aging = schedWeights, o.schedAging
+	if o.batchInterval < 0 || o.batchSize <= 0 {
+		usagef("-write-batch-interval can't be negative and -write-batch-size must be positive")
+	}
+	node.Writes = agent.NewWriteBatcher(node.Store)
+	node.Writes.Interval, node.Writes.Size = o.batchInterval, o.batchSize
+	if o.publishBuffer < 0 || o.publishTimeout <= 0 {
+		usagef("-publish-buffer can't be negative and -publish-timeout must be positive")
+	}
+	node.Publisher = agent.NewPublisher(o.publishBuffer)
+	node.Publisher.Timeout = o.publishTimeout
+	if o.compressAbove <= 0 {
+		usagef("-compress-threshold must be positive")
+	}
+	if node.Compression, err = agent.ParseCompression(o.compress, o.compressAbove); err != nil {
+		usagef("-compress: %v", err)
+	}
+	if o.maxDecompress <= 0 {
+		usagef("-max-decompressed must be positive")
+	}
+	node.MaxDecompressed = o.maxDecompress
+	if o.ackTimeout <= 0 {
+		usagef("-ack-timeout must be positive")
+	}
+	node.AckTimeout = o.ackTimeout
+	if o.redeliverAfter < 0 {
+		usagef("-redeliver-after can't be negative")
+	}
+	node.RedeliverAfter = o.redeliverAfter
+	if o.courtesyPeer < 1 || o.courtesyEvery <= 0 {
+		usagef("-courtesy-per-peer and -courtesy-interval must be positive")
+	}
+	if o.courtesy {
+		var templates map[string]string
+		if o.courtesyText != "" {
+			if templates, err = agent.LoadCourtesyTemplates(o.courtesyText); err != nil {
+				usagef("-courtesy-templates: %v", err)
+			}
+		}
+		if node.Courtesy, err = agent.NewCourtesyReplies(templates); err != nil {
+			usagef("-courtesy-templates: %v", err)
+		}
+		node.Courtesy.PerPeer, node.Courtesy.Interval = o.courtesyPeer, o.courtesyEvery
+	} else if o.courtesyText != "" {
+		usagef("-courtesy-templates needs -courtesy")
+	}
+	var minPayment *big.Int
+	if o.minPayment != "" {
+		var ok bool
+		if minPayment, ok = new(big.Int).SetString(o.minPayment, 10); !ok || minPayment.Sign() < 0 {
+			usagef("-min-payment must be a whole number of wei")
+		}
+	}
+	for _, r := range o.relays {
+		relay, err := peer.AddrInfoFromString(r)
+		if err != nil {
+			usagef("-relay: %q is not a multiaddr ending in /p2p/<peer ID>: %v", r, err)
+		}
+		node.Relays = append(node.Relays, *relay)
+	}
+	bootstraps, err := agent.ParseBootstrapPeers(o.bootstrap)
+	if err != nil {
+		usagef("-bootstrap: %v", err)
+	}
+	if o.bootstrapEvery <= 0 {
+		usagef("-bootstrap-interval must be positive")
+	}
+	node.Bootstrap = agent.NewBootstrapPeers(bootstraps)
+	node.Bootstrap.Interval = o.bootstrapEvery
+	if len(o.bootstrap) == 0 {
+		node.Bootstrap.FromRegistry = agent.DefaultRegistryBootstraps
+	}
+	if o.pex {
+		if o.pexInterval <= 0 || o.pexSample <= 0 {
+			usagef("-pex-interval and -pex-sample must be positive")
+		}
+		node.PEX = &agent.PeerExchange{Interval: o.pexInterval, Sample: o.pexSample}
+		for _, id := range o.pexTrusted {
+			pid, err := peer.Decode(id)
+			if err != nil {
+				usagef("-pex-trusted: %q is not a peer ID: %v", id, err)
+			}
+			node.PEX.Trusted = append(node.PEX.Trusted, pid)
+		}
+	} else if len(o.pexTrusted) > 0 {
+		usagef("-pex-trusted needs -pex")
+	}
+	if o.quoteTTL <= 0 || o.clockSkew <= 0 {
+		usagef("-quote-ttl and -clock-skew must be positive")
+	}
+	node.Offers = agent.OfferTiming{TTL: o.quoteTTL, ClockSkew: o.clockSkew}
+	if o.probe {
+		if o.probeInterval <= 0 {
+			usagef("-probe-interval must be positive")
+		}
+		node.Probe = &agent.LatencyProbe{Interval: o.probeInterval}
+	}
+	node.APIToken = o.apiToken
+	switch o.apiAuth {
+	case agent.APIAuthBearer:
+	case agent.APIAuthHMAC:
+		if apiSecret == "" {
+			usagef("-api-auth hmac needs -api-secret")
+		}
+	case agent.APIAuthNone:
+		fmt.Printf("Warning: the API on %s takes every request without authentication, management routes included\n", g.apiAddr)
+	default:
+		usagef("-api-auth must be bearer, hmac or none")
+	}
+	node.APIAuth, node.APISecret = o.apiAuth, apiSecret
+	if node.Verification, err = agent.ParseVerificationMode(o.verification); err != nil {
+		usagef("-verification: %v", err)
+	}
+	fmt.Printf("[Security] Signature verification: %s\n", node.Verification)
+	if node.Verification == agent.VerifyOff {
+		fmt.Println("Warning: signatures on announcements, peer ID bindings and moved notices are not checked")
+	}
+	node.ResultsDir = o.resultsDir
+	if o.taskDirAge <= 0 {
+		usagef("-task-dir-retention must be positive")
+	}
+	node.TaskDirRetention = agent.TaskDirRetention{MaxAge: o.taskDirAge, Quarantine: o.quarantine}
+	node.DiagnosticConfig = diagnosticConfig(fs)
+	var tracing *sdktrace.TracerProvider
+	if o.otlpEndpoint != "" {
+		tracing, err = agent.NewOTLPTracerProvider(context.Background(), o.otlpEndpoint, o.traceSample, "agentmesh")
+		if err != nil {
+			usagef("%v", err)
+		}
+		node.TracerProvider = tracing
+	}
+	if o.metrics || o.metricsPush != "" {
+		node.Metrics = agent.NewMetrics()
+	}
+	node.Analytics = agent.NewCapabilityAnalytics(store)
+	node.Analytics.Retention = o.invocationsTTL
+	if o.eventArchive != "" {
+		if node.Archive, err = agent.NewEventArchive(o.eventArchive); err != nil {
+			fatalf("Failed to open event archive: %v", err)
+		}
+	}
+	if err := node.LoadCapabilities(o.capabilities); err != nil {
+		fatalf("Failed to load capabilities: %v", err)
+	}
+	if o.answerTTL > 0 {
+		node.Answers = agent.NewAnswerCache(store, agent.DirContentStore{Dir: o.answerDir})
+		node.Answers.TTL, node.Answers.MaxEntries, node.Answers.MaxBytes = o.answerTTL, o.answerEntries, o.answerBytes
+	}
+
+	priv, err := agent.LoadOrCreateIdentity(o.keyPath)
+	if err != nil {
+		fatalf("Failed to load identity: %v", err)
+	}
+	node.SetIdentity(priv)
+	node.IdentityPath = o.keyPath
+
+	// The wallet is optional for running; it is only needed to send transactions
+	if _, err := os.Stat(c.walletPath); err == nil {
+		wallet, err := agent.LoadWallet(c.walletPath)
+		if err != nil {
+			fatalf("Failed to load wallet: %v", err)
+		}
+		node.Wallet = wallet
+	}
+
+	// Setup ERC8004 Client (Mock/Placeholder address for Reputation)
+	validationAddr := zeroAddress
+	if o.validationAddr != "" {
+		if !common.IsHexAddress(o.validationAddr) {
+			usagef("-validation-registry: %q is not an address", o.validationAddr)
+		}
+		validationAddr = o.validationAddr
+	}
+	c.store = node.Store
+	setupClient := func(client *agent.ERC8004Client) {
+		client.SetJournal(node.Store)
+		client.SetTracerProvider(node.TracerProvider)
+		client.SetVerification(node.Verification)
+		if err := c.configure(client); err != nil {
+			usagef("%v", err)
+		}
+	}
+	marketAddr, escrowAddr := o.marketAddr, o.escrowAddr
+	if o.chains != "" {
+		profiles, err := agent.LoadChainProfiles(o.chains)
+		if err != nil {
+			usagef("-chains: %v", err)
+		}
+		// -validation-registry is the primary chain's
+		if o.validationAddr != "" {
+			profiles[0].Validation = o.validationAddr
+		}
+		for _, p := range profiles {
+			client, err := p.NewClient(context.Background())
+			if err != nil {
+				preconditionf("Can't work on chain %s: %v", p.Name, err)
+			}
+			setupClient(client)
+			node.Chains = append(node.Chains, &agent.Chain{Profile: p, Client: client})
+			fmt.Printf("[Chain] Working on %s (chain %d) through %s\n", p.Name, p.ChainID, client.RPCURL())
+		}
+		node.ERCClient = node.Chains[0].Client
+		marketAddr, escrowAddr = firstOf(profiles[0].Markets), firstOf(profiles[0].Escrows)
+	} else if node.ERCClient = agent.NewERC8004Client(c.rpcURL, c.identAddr, zeroAddress, validationAddr); node.ERCClient != nil {
+		setupClient(node.ERCClient)
+	}
+	if node.ERCClient != nil {
+		if c.dryRun {
+			fmt.Println("[Tx] Dry run: transactions are simulated and journaled, never sent")
+		}
+		if marketAddr != "" {
+			node.Market = agent.NewKnowledgeMarket(node.ERCClient, marketAddr)
+		}
+	}
+
+	weights, err := agent.ParseSelectionWeights(o.weights)
+	if err != nil {
+		usagef("-selection-weights: %v", err)
+	}
+	if o.exploreRate < 0 || o.exploreRate > 1 {
+		usagef("-explore-rate must be between 0 and 1")
+	}
+	ledger, err := o.ledgerFlags.config()
+	if err != nil {
+		usagef("%v", err)
+	}
+	node.Ledger = agent.NewReputationLedger(node.Store, ledger)
+	misbehavior, err := o.misbehaviorFlags.config()
+	if err != nil {
+		usagef("%v", err)
+	}
+	node.Guard = agent.NewPeerGuard(node.Store, misbehavior)
+	if o.policyPath != "" || o.policyList != "" || o.policyDefault != agent.PolicyAllow {
+		node.Policy = identityPolicy(node, o)
+	}
+	if o.names && node.ERCClient != nil {
+		if !common.IsHexAddress(o.ensRegistry) {
+			usagef("-ens-registry: %q is not an address", o.ensRegistry)
+		}
+		if o.nameTTL <= 0 {
+			usagef("-name-ttl must be positive")
+		}
+		node.Names = agent.NewNameResolver(node.ERCClient, common.HexToAddress(o.ensRegistry), node.Store)
+		node.Names.TTL = o.nameTTL
+	}
+	clients := make([]common.Address, len(o.reviewers))
+	for i, r := range o.reviewers {
+		if !common.IsHexAddress(r) {
+			usagef("-reputation-clients: %q is not an address", r)
+		}
+		clients[i] = common.HexToAddress(r)
+	}
+	var repBlock agent.BlockTag
+	if o.repBlock != "" {
+		if repBlock, err = agent.ParseBlockTag(o.repBlock); err != nil {
+			usagef("-reputation-block: %v", err)
+		}
+	}
+	var reputation agent.ReputationFunc
+	if node.ERCClient != nil && len(clients) > 0 {
+		reputation = agent.RegistryReputation(node.ERCClient, clients, repBlock)
+	}
+	if o.minFeedback > 0 && !o.verifyGossip {
+		usagef("-gossip-min-feedback needs -verify-gossip")
+	}
+	if o.anchorEvery < 0 {
+		usagef("-anchor-interval can't be negative")
+	}
+	if o.anchorEvery > 0 && (node.ERCClient == nil || node.Wallet == nil) {
+		preconditionf("Can't anchor interaction records: they need a chain client and a wallet")
+	}
+	node.AnchorInterval = o.anchorEvery
+	if o.publishPeerID && (node.ERCClient == nil || node.Wallet == nil) {
+		preconditionf("Can't publish the peer ID: it needs a chain client and a wallet")
+	}
+	node.PublishPeerID = o.publishPeerID
+	if len(o.bidBudgets) > 0 {
+		node.Capital = capitalTracker(node, o.bidBudgets, escrowAddr)
+	}
+	if o.verifyGossip {
+		if node.ERCClient == nil {
+			preconditionf("Can't verify gossip: no chain client for %s", c.rpcURL)
+		}
+		node.Gossip = agent.NewGossipVerifier(node.ERCClient, node.Store, clients)
+		node.Gossip.MinFeedback, node.Gossip.TTL, node.Gossip.Block = o.minFeedback, o.gossipTTL, repBlock
+	}
+	node.Selection = agent.NewSelectionPolicy(reputation, node.History)
+	node.Selection.Weights, node.Selection.ExploreRate = weights, o.exploreRate
+	node.Selection.PreferChain = o.preferChain
+	node.Selection.Ledger = node.Ledger
+	node.Selection.Latencies = node.Latencies
+	if o.repViews != "" {
+		if o.repViewsReload <= 0 {
+			usagef("-reputation-views-reload must be positive")
+		}
+		if node.ERCClient == nil {
+			preconditionf("Can't read -reputation-views: no chain client for %s", c.rpcURL)
+		}
+		var self []common.Address
+		if node.Wallet != nil {
+			self = append(self, node.Wallet.Address)
+		}
+		if node.Selection.Views, err = agent.NewReputationViews(o.repViews, node.ERCClient, self, repBlock); err != nil {
+			usagef("-reputation-views: %v", err)
+		}
+	}
+	node.Selection.Record = func(d agent.SelectionDecision) { node.Events.Add("selection", d) }
+
+	// Events go to stdout in json mode and to the node's log for 'agent top'
+	publish := func(kind string, data interface{}) {
+		emitEvent(kind, data)
+		node.Events.Add(kind, data)
+	}
+
+	// Every chain event goes through an intake pipeline, one per chain
+	var eval agent.Evaluator
+	if o.evalURL != "" {
+		if o.evalModel == "" {
+			usagef("-eval-url needs -eval-model")
+		}
+		llm := agent.NewLLMEvaluator(o.evalURL, o.evalModel, o.evalAPIKey, node.Capabilities)
+		llm.Timeout, llm.MaxCallsPerHour = o.evalTimeout, o.evalMaxCalls
+		eval = llm
+		fmt.Printf("[Eval] Asking %s at %s before bidding\n", o.evalModel, o.evalURL)
+	}
+	onDecision := func(record agent.TaskRecord, d agent.Decision) {
+		if record.Kind == agent.TaskKindEscrow {
+			fmt.Printf("[Watcher] New Task Created on-chain: %s\n", record.ID)
+			publish("task_created", record)
+		} else {
+			fmt.Printf("[Watcher] New Knowledge Request on-chain: %s (Bounty: %s)\n", record.Topic, record.Amount)
+			publish("knowledge_requested", record)
+		}
+		if d.PeerID != "" || d.Endpoint != "" {
+			if d.PeerID != "" {
+				fmt.Printf("[Discovery] Resolved PeerID for %s: %s\n", node.Names.Display(record.Client), d.PeerID)
+			} else {
+				fmt.Printf("[Discovery] Resolved A2A endpoint for %s: %s\n", node.Names.Display(record.Client), d.Endpoint)
+			}
+			resolved := map[string]string{"taskId": record.ID, "wallet": record.Client, "peerId": d.PeerID}
+			if d.Endpoint != "" {
+				resolved["endpoint"] = d.Endpoint
+			}
+			publish("requester_resolved", resolved)
+		}
+		if d.Action == agent.ActionAnswer && d.PeerID != "" {
+			go deliverAnswer(node, record, d, requestMarket(node, record, marketAddr))
+		}
+		fmt.Printf("[Intake] %s: %s\n", record.ID, describeDecision(d))
+		node.Events.Add("decision", d)
+		node.EmitLifecycle(agent.LifecycleEvent{TaskID: record.ID, Stage: agent.StageReceived})
+		if d.Action == agent.ActionSkip {
+			node.EmitLifecycle(agent.LifecycleEvent{TaskID: record.ID, Stage: agent.StageSkipped, Reason: d.Reason})
+		} else {
+			node.EmitLifecycle(agent.LifecycleEvent{TaskID: record.ID, Stage: agent.StageValidated, Peer: d.PeerID})
+		}
+	}
+	var pricing *agent.PricingEngine
+	if o.pricing != "" {
+		if pricing, err = agent.LoadPricing(o.pricing, node.ERCClient); err != nil {
+			usagef("-pricing: %v", err)
+		}
+		pricing.Load = node.Workers.Load
+		pricing.Estimate = node.Store.EstimateTaskRun
+		pricing.Record = func(q agent.PriceQuote) { node.Events.Add("quote", q) }
+		if reputation != nil {
+			pricing.Reputation = counterpartyReputation(node.ERCClient, reputation)
+		}
+	} else if o.pricingCap != "" {
+		usagef("-pricing-capability needs -pricing")
+	}
+	newIntake := func(client *agent.ERC8004Client, escrow string) *agent.TaskIntake {
+		intake := agent.NewTaskIntake(node.Writes, node.Memory, func(wallet common.Address) agent.Recipient {
+			return resolveRecipient(node, client, wallet)
+		})
+		if client != nil && escrow != "" {
+			intake.VerifyFunding(agent.NewTaskEscrow(client, escrow).EscrowBalance)
+		}
+		if eval != nil {
+			intake.UseEvaluator(eval)
+		}
+		intake.UsePolicy(node.Policy)
+		intake.UseArchive(node.Archive)
+		intake.UseCapacity(node.Workers.RetryAfter)
+		intake.RequirePayment(minPayment)
+		if pricing != nil {
+			intake.UsePricing(pricing, o.pricingCap)
+		}
+		intake.OnDecision(func(record agent.TaskRecord, d agent.Decision) {
+			onDecision(record, d)
+			sendDecline(node, client, record, d)
+		})
+		return intake
+	}
+
+	watcherOpts := []agent.WatcherOption{
+		agent.WithPollInterval(o.pollInterval), agent.WithJitter(o.pollJitter), agent.WithConfirmations(o.confirmations),
+		agent.WithBlockTime(o.blockTime), agent.WithMaxHeadLag(o.maxHeadLag),
+		agent.WithTracerProvider(node.TracerProvider), agent.WithLogScanner(c.logScanner()),
+		// The watcher reads its start block once the RPC answers, not before the node is up
+		agent.WithDeferredHead(),
+	}
+	if o.contractABIs != "" {
+		abis, err := agent.LoadContractABIs(o.contractABIs)
+		if err != nil {
+			usagef("-contract-abis: %v", err)
+		}
+		watcherOpts = append(watcherOpts, agent.WithContractABIs(abis))
+	}
+	prefilter := func() []agent.WatcherOption { return nil }
+	if len(o.onlyClients) > 0 || len(o.onlyTopics) > 0 {
+		requesters := make([]common.Address, len(o.onlyClients))
+		for i, r := range o.onlyClients {
+			if !common.IsHexAddress(r) {
+				usagef("-watch-requesters: %q is not an address", r)
+			}
+			requesters[i] = common.HexToAddress(r)
+		}
+		// Each watcher gets its own filter, counting its own events
+		prefilter = func() []agent.WatcherOption {
+			return []agent.WatcherOption{agent.WithPrefilter(agent.NewEventPrefilter(requesters, o.onlyTopics))}
+		}
+	}
+	// The address book caches the primary chain's registry, so its reorgs
+	// rewind the book's scans
+	primaryOpts := append(append([]agent.WatcherOption(nil), watcherOpts...), prefilter()...)
+	primaryOpts = append(primaryOpts, agent.WithReorgHandler(node.RewindAddressBook))
+	if o.validationAddr != "" {
+		topics, err := agent.ParseValidationTopics(o.validate)
+		if err != nil {
+			usagef("-validate: %v", err)
+		}
+		if o.validationSize <= 0 || o.validationTime <= 0 || o.validationTTL <= 0 {
+			usagef("-validation-max-size, -validation-timeout and -validation-deadline must be positive")
+		}
+		validator, err := agent.NewValidator(node.ERCClient, node.Wallet, node.Store, topics)
+		if err != nil {
+			preconditionf("Can't validate: %v", err)
+		}
+		validator.MaxDataSize, validator.Timeout, validator.Deadline = o.validationSize, o.validationTime, o.validationTTL
+		validator.OnRecord(func(r agent.ValidationRecord) { publish("validation", r) })
+		primaryOpts = append(primaryOpts, agent.WithValidationRequests(o.validationAddr, validator.OnRequest))
+		fmt.Printf("[Validator] Answering validation requests to %s from %s\n", node.Wallet.Address.Hex(), o.validationAddr)
+	}
+
+	// Setup Watchers; checkpoints commit with the intake's writes
+	if len(node.Chains) == 0 {
+		intake := newIntake(node.ERCClient, o.escrowAddr)
+		intake.UseCapital(node.Capital)
+		opts := append(primaryOpts, agent.WithErrorHandler(func(err error) { node.Events.AddError("watcher_error", err, nil) }))
+		watcher, err := agent.NewEventWatcherWithHandlers(c.rpcURL, []string{o.escrowAddr}, []string{o.marketAddr}, intake.OnTask, intake.OnQuery, opts...)
+		if err == nil {
+			if err := watcher.UseCheckpoints(node.Writes, "watcher"); err != nil {
+				fatalf("%v", err)
+			}
+			node.Watcher = watcher
+		}
+	}
+	for i, chain := range node.Chains {
+		primary, p := i == 0, chain.Profile
+		opts := primaryOpts
+		if !primary {
+			opts = append(append([]agent.WatcherOption(nil), watcherOpts...), prefilter()...)
+		}
+		detail := map[string]uint64{"chainId": p.ChainID}
+		opts = append(opts[:len(opts):len(opts)], agent.WithErrorHandler(func(err error) { node.Events.AddError("watcher_error", err, detail) }))
+		intake := newIntake(chain.Client, firstOf(p.Escrows))
+		if primary {
+			// Reservations are reconciled with the primary chain's escrow
+			intake.UseCapital(node.Capital)
+		}
+		watcher, err := p.NewWatcher(context.Background(), primary, intake.OnTask, intake.OnQuery, opts...)
+		if err != nil {
+			fmt.Printf("[Chain] Not watching %s: %v\n", p.Name, err)
+			continue
+		}
+		if err := watcher.UseCheckpoints(node.Writes, p.Checkpoint(primary)); err != nil {
+			fatalf("%v", err)
+		}
+		chain.Watcher = watcher
+		if primary {
+			node.Watcher = watcher
+		}
+	}
+
+	if err := node.Start(o.listenAddrs...); err != nil {
+		fatalf("Failed to start node: %v", err)
+	}
+	fmt.Printf("[P2P] Listening on %s\n", strings.Join(node.Transports(), ", "))
+	fmt.Printf("[Boot] %s\n", describeStartup(node.Status().Startup))
+
+	if o.leaderElection {
+		node.Elector = agent.NewLeaderElector(node.Store, agent.WatcherLease, node.Host.ID().String(), agent.DefaultLeaseTTL)
+	}
+	node.StartWatcher()
+
+	var ethAddress string
+	if node.Wallet != nil {
+		ethAddress = node.Wallet.Address.Hex()
+	}
+	for _, def := range node.Capabilities() {
+		fmt.Printf("Serving capability %s (handler %s)\n", def.Name, def.Handler)
+		node.AdvertiseCapabilityWithEth(def.Capability(), ethAddress)
+	}
+
+	if err := node.ServeAPI(g.apiAddr); err != nil {
+		fatalf("Failed to start API: %v", err)
+	}
+
+	if o.grpcAddr != "" {
+		tlsConfig, err := grpcTLSConfig(o.grpcCert, o.grpcKey, o.grpcClientCA)
+		if err != nil {
+			usagef("%v", err)
+		}
+		if err := node.ServeGRPC(o.grpcAddr, tlsConfig); err != nil {
+			fatalf("Failed to start gRPC API: %v", err)
+		}
+		fmt.Printf("gRPC: %s\n", node.GRPCAddr())
+	}
+
+	if o.metricsPush != "" {
+		if err := node.PushMetrics(o.metricsPush, o.pushInterval); err != nil {
+			fatalf("Failed to push metrics: %v", err)
+		}
+	}
+
+	h := node.CurrentHost()
+	fmt.Printf("Node started, waiting for readiness. ID: %s\n", h.ID())
+	fmt.Printf("Addresses: %v\n", h.Addrs())
+	fmt.Printf("API: http://%s\n", g.apiAddr)
+	publish("started", node.Status())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node.Policy.Watch(ctx, o.policyReload)
+	node.Selection.Views.Watch(ctx, o.repViewsReload)
+	go func() {
+		if node.WaitReady(ctx) == nil {
+			fmt.Println("Node ready!")
+			publish("ready", node.Readyz())
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	node.Stop()
+	if tracing != nil {
+		// Flush the spans still buffered
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		tracing.Shutdown(flushCtx)
+		cancel()
+	}
+	fmt.Println("Node stopped.")
+	emitEvent("stopped", nil)
+}
+
+// deliverAnswer sends the workspace file answering a knowledge request on
+// market to its requester and waits for the requester's acknowledgement. A
+// delivery that isn't acknowledged is sent again when the node restarts, or
+// after -redeliver-after if the requester couldn't be reached.
+func deliverAnswer(node *agent.AgentNode, record agent.TaskRecord, d agent.Decision, market string) {
+	chunk, err := node.Memory.GetMemory(d.Answer)
+	if err != nil {
+		fmt.Printf("[Knowledge] Can't read the answer to %s: %v\n", record.ID, err)
+		return
+	}
+	answer := agent.KnowledgeAnswer{RequestID: record.ID[strings.LastIndex(record.ID, ":")+1:], ChainID: record.ChainID, Topic: record.Topic, Content: chunk, Market: market}
+	if node.Wallet != nil {
+		// The requester's receipt credits our wallet
+		answer.Provider = node.Wallet.Address.Hex()
+	}
+	if _, err := node.DeliverKnowledge(context.Background(), record.ID, d.PeerID, answer); err != nil {
+		var unreachable *agent.UnreachableError
+		if errors.As(err, &unreachable) {
+			fmt.Printf("[Knowledge] Can't reach the requester of %s, %s:\n", record.ID, node.Names.Display(d.PeerID))
+			for _, a := range unreachable.Tried {
+				fmt.Printf("[Knowledge]   %s: %s\n", a.Method, a.Err)
+			}
+			node.Events.Add("knowledge_unreachable", map[string]string{"taskId": record.ID, "peerId": d.PeerID})
+			return
+		}
+		fmt.Printf("[Knowledge] Answer to %s not acknowledged yet: %v\n", record.ID, err)
+		return
+	}
+	node.Events.Add("knowledge_delivered", map[string]string{"taskId": record.ID, "peerId": d.PeerID})
+}
+
+// sendDecline tells the requester of a skipped task or knowledge request
+// why, in the background, if the node sends courtesy replies, the skip has
+// a reason code and the requester has a peer ID.
+func sendDecline(node *agent.AgentNode, client *agent.ERC8004Client, record agent.TaskRecord, d agent.Decision) {
+	if node.Courtesy == nil || d.Action != agent.ActionSkip || d.Code == "" {
+		return
+	}
+	go func() {
+		// Knowledge requesters were resolved by the intake; task clients aren't
+		pid := d.PeerID
+		if pid == "" && common.IsHexAddress(record.Client) {
+			pid = resolveRecipient(node, client, common.HexToAddress(record.Client)).PeerID
+		}
+		if pid == "" {
+			return
+		}
+		err := node.SendDecline(context.Background(), pid, record, d)
+		switch {
+		case errors.Is(err, agent.ErrCourtesyLimited):
+			fmt.Printf("[Courtesy] Not telling %s about %s: %v\n", node.Names.Display(pid), record.ID, err)
+		case err != nil:
+			fmt.Printf("[Courtesy] Can't tell %s about %s: %v\n", node.Names.Display(pid), record.ID, err)
+		default:
+			node.Events.Add("decline_sent", map[string]string{"taskId": record.ID, "peerId": pid, "reason": d.Code})
+		}
+	}()
+}
+
+// requestMarket returns the market a knowledge request was posted on: the
+// one its ID names, if the node watches several, or else the one of its
+// chain, or fallback.
+func requestMarket(node *agent.AgentNode, record agent.TaskRecord, fallback string) string {
+	for _, part := range strings.Split(record.ID, ":") {
+		if common.IsHexAddress(part) {
+			return part
+		}
+	}
+	if c := node.Chain(record.ChainID); c != nil {
+		return firstOf(c.Profile.Markets)
+	}
+	return fallback
+}
+
+// identityPolicy loads the identity policy from the -policy* flags.
+// capitalTracker limits the node's bids to budgets, reconciling what they
+// hold with escrow, the primary chain's TaskEscrow.
+func capitalTracker(node *agent.AgentNode, budgets []string, escrow string) *agent.CapitalTracker {
+	limits := map[string]*big.Int{}
+	for _, b := range budgets {
+		token, amount, err := agent.ParseBudget(b)
+		if err != nil {
+			usagef("-bid-budget: %v", err)
+		}
+		limits[token] = amount
+	}
+	capital := agent.NewCapitalTracker(node.Store, limits)
+	client := node.ERCClient
+	if client == nil {
+		return capital
+	}
+	if escrow != "" {
+		capital.Tasks = agent.NewTaskEscrow(client, escrow).GetTask
+	}
+	if node.Wallet != nil {
+		wallet := node.Wallet.Address
+		capital.Worker = wallet
+		capital.Balance = func(token string) (*big.Int, error) {
+			if token != agent.NativeToken {
+				return nil, nil
+			}
+			return client.Balance(wallet)
+		}
+	}
+	return capital
+}
+
+func identityPolicy(node *agent.AgentNode, o *runFlags) *agent.IdentityPolicy {
+	if o.policyDefault != agent.PolicyAllow && o.policyDefault != agent.PolicyDeny {
+		usagef("-policy-default must be allow or deny")
+	}
+	if o.policyList != "" && !common.IsHexAddress(o.policyList) {
+		usagef("-policy-list: %q is not an address", o.policyList)
+	}
+	if !common.IsHexAddress(o.ensRegistry) {
+		usagef("-ens-registry: %q is not an address", o.ensRegistry)
+	}
+	if o.policyReload <= 0 {
+		usagef("-policy-reload must be positive")
+	}
+	policy, err := agent.NewIdentityPolicy(o.policyPath, node.Store)
+	if err != nil {
+		usagef("-policy: %v", err)
+	}
+	policy.DefaultDeny = o.policyDefault == agent.PolicyDeny
+	if node.ERCClient != nil {
+		if err := policy.UseChain(node.ERCClient, o.ensRegistry, o.policyList); err != nil {
+			preconditionf("Can't load the identity policy: %v", err)
+		}
+	} else if o.policyList != "" {
+		preconditionf("Can't read -policy-list: no chain client for the RPC")
+	}
+	return policy
+}
+
+// grpcTLSConfig builds the gRPC server's TLS settings from the -grpc-* flags:
+// nil for plaintext, and client certificates required with a client CA.
+func grpcTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("-grpc-client-ca needs -grpc-cert and -grpc-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load -grpc-cert/-grpc-key: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s holds no PEM certificates", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// counterpartyReputation reads a -pricing counterparty's reputation, finding
+// the agent of a wallet in client's registry. Counterparties known by peer
+// ID only have none.
+func counterpartyReputation(client *agent.ERC8004Client, reputation agent.ReputationFunc) agent.CounterpartyReputation {
+	return func(ctx context.Context, c agent.Counterparty, capability string) (float64, bool, error) {
+		agentID, ok := new(big.Int).SetString(c.AgentID, 10)
+		if !ok && c.Wallet != "" && client != nil {
+			var err error
+			if agentID, err = client.GetAgentIdByWalletContext(ctx, common.HexToAddress(c.Wallet)); err != nil {
+				return 0, false, err
+			}
+			ok = agentID != nil
+		}
+		if !ok {
+			return 0, false, nil
+		}
+		return reputation(ctx, agentID, capability)
+	}
+}
+
+// resolveTimeout bounds one requester lookup. A registry scan cut short is
+// resumed by the next lookup of the same wallet.
+const resolveTimeout = 30 * time.Second
+
+// resolveRecipient maps a wallet to its published peerId and A2A endpoint
+// in client's registry. The address book holds the agents of the primary
+// chain's registry, node.ERCClient's: it is consulted before querying that
+// registry, and only for it.
+func resolveRecipient(node *agent.AgentNode, client *agent.ERC8004Client, wallet common.Address) agent.Recipient {
+	if client == nil {
+		return agent.Recipient{}
+	}
+	booked := client == node.ERCClient
+	var entry *agent.AddressBookEntry
+	if booked {
+		entry, _ = node.Store.LookupAddress(wallet.Hex())
+	}
+	if entry != nil && (entry.PeerID != "" || entry.Endpoint != "") {
+		return agent.Recipient{PeerID: entry.PeerID, Endpoint: entry.Endpoint}
+	}
+
+	var scan agent.WalletScan
+	if entry != nil {
+		scan.ScannedBlock = entry.ScannedBlock
+		scan.AgentID, _ = new(big.Int).SetString(entry.AgentID, 10)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	scan, _ = client.ScanAgentIdByWallet(ctx, wallet, scan)
+	book := agent.AddressBookEntry{Wallet: wallet.Hex(), ScannedBlock: scan.ScannedBlock}
+	if scan.AgentID == nil {
+		// Not registered, or not found yet: the next lookup scans newer blocks
+		if booked && scan.ScannedBlock > 0 {
+			node.Store.SaveAddress(book)
+		}
+		return agent.Recipient{}
+	}
+	book.AgentID = scan.AgentID.String()
+
+	// The endpoint is the fallback for agents whose peer can't be reached
+	to, err := client.ResolveRecipient(ctx, scan.AgentID)
+	if errors.Is(err, agent.ErrUnboundPeerID) {
+		fmt.Printf("[Discovery] Ignoring the peerId of %s: %v\n", wallet.Hex(), err)
+	}
+	if booked {
+		book.PeerID, book.Endpoint = to.PeerID, to.Endpoint
+		node.Store.SaveAddress(book)
+	}
+	// First contact needn't wait for discovery
+	node.LearnAddrs(to)
+	return to
+}
+
+// firstOf returns the first of addrs, or "" if there is none.
+func firstOf(addrs []string) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
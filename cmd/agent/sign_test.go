@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"agentmesh/pkg/agent"
+)
+
+func TestSignedPacketVerifiesOffline(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := agent.LoadOrCreateIdentity(filepath.Join(dir, defaultKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := runCLI(t, dir, "sign", "-data", `{"b": 2, "a": 1}`)
+	if code != exitOK {
+		t.Fatalf("sign exited %d: %s", code, out)
+	}
+	var packet agent.SignedPacket
+	if err := json.Unmarshal([]byte(out), &packet); err != nil || packet.Data != `{"a":1,"b":2}` {
+		t.Fatalf("sign printed %s (%v), want a packet of the canonical document", out, err)
+	}
+	writeFile(t, filepath.Join(dir, "packet.json"), out)
+	out, code = runCLI(t, dir, "verify", "-json", "-packet", "packet.json")
+	var res VerifyResult
+	if json.Unmarshal([]byte(out), &res); code != exitOK || !res.Valid || res.PeerID != packet.PeerID {
+		t.Errorf("verify = %s, exit %d, want valid", out, code)
+	}
+
+	// A changed document no longer verifies
+	packet.Data = `{"a":2,"b":2}`
+	tampered, _ := json.Marshal(packet)
+	writeFile(t, filepath.Join(dir, "packet.json"), string(tampered))
+	if out, code := runCLI(t, dir, "verify", "-packet", "packet.json"); code != exitRuntime || !strings.Contains(out, "INVALID") {
+		t.Errorf("tampered packet: %s, exit %d, want it rejected", out, code)
+	}
+
+	if _, code := runCLI(t, dir, "sign", "-data", "not json"); code != exitUsage {
+		t.Errorf("signing a non-JSON document exited %d, want a usage error", code)
+	}
+}
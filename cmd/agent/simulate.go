@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type simulateResult struct {
+	Events    int              `json:"events"`
+	Bids      int              `json:"bids"`
+	Answers   int              `json:"answers"`
+	Skips     int              `json:"skips"`
+	Changed   int              `json:"changed,omitempty"` // decisions unlike those in the archive replayed
+	Decisions []agent.Decision `json:"decisions"`
+}
+
+func simulateCmd(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	addOutputFlags(fs)
+	eventsPath := fs.String("events", "events.jsonl", "Recorded events (JSONL, as written by 'agent record'), or an event archive (the -event-archive directory, or one of its files)")
+	workspace := fs.String("workspace", "./workspace", "Path to OpenClaw workspace")
+	speed := fs.Float64("speed", 0, "Replay speed: 1 is real time, 10 ten times faster, 0 without delays")
+	step := fs.Bool("step", false, "Wait for Enter before each event")
+	parseFlags(fs, args)
+
+	events, archived := readSimulateEvents(*eventsPath)
+
+	// A throwaway database keeps the simulation away from the node's real state
+	tmp, err := os.MkdirTemp("", "agentmesh-simulate-")
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmp)
+	store, err := agent.OpenMetadataStore(agent.DriverSQLite, filepath.Join(tmp, "simulate.db"))
+	if err != nil {
+		fatalf("Failed to open scratch database: %v", err)
+	}
+	defer store.Close()
+
+	// The chain is stubbed out: requesters resolve to the peerIds captured
+	// at recording time
+	peers := map[common.Address]agent.Recipient{}
+	for _, e := range events {
+		if e.PeerID != "" || e.Endpoint != "" {
+			peers[common.HexToAddress(e.Account)] = agent.Recipient{PeerID: e.PeerID, Endpoint: e.Endpoint}
+		}
+	}
+	intake := agent.NewTaskIntake(store, agent.NewMemoryStoreWithMetadata(store, *workspace), func(wallet common.Address) agent.Recipient {
+		return peers[wallet]
+	})
+
+	result := simulateResult{Events: len(events), Decisions: []agent.Decision{}}
+	intake.OnDecision(func(record agent.TaskRecord, d agent.Decision) {
+		switch d.Action {
+		case agent.ActionBid:
+			result.Bids++
+		case agent.ActionAnswer:
+			result.Answers++
+		case agent.ActionSkip:
+			result.Skips++
+		}
+		result.Decisions = append(result.Decisions, d)
+		fmt.Printf("[Simulate] %s: %s\n", record.ID, describeDecision(d))
+		if was, ok := archived[record.ID]; ok && !sameDecision(was, d) {
+			result.Changed++
+			fmt.Printf("[Simulate] %s: was %s\n", record.ID, describeDecision(was))
+		}
+	})
+
+	replay := agent.NewReplaySource(events, intake.OnTask, intake.OnQuery)
+	replay.Speed = *speed
+	if *step {
+		in := bufio.NewReader(os.Stdin)
+		replay.Step = func(e agent.RecordedEvent) {
+			fmt.Fprintf(os.Stderr, "Next: %s %s (block %d). Press Enter...", e.Kind, e.ID, e.Block)
+			in.ReadString('\n')
+		}
+	}
+	replay.Start(context.Background())
+
+	output(result, func() {
+		fmt.Printf("\n%d events: %d bids, %d answers, %d skips\n", result.Events, result.Bids, result.Answers, result.Skips)
+		if archived != nil {
+			fmt.Printf("%d decisions unlike those archived\n", result.Changed)
+		}
+	})
+}
+
+// readSimulateEvents reads a recording, or an event archive along with the
+// decisions archived, by task ID.
+func readSimulateEvents(path string) ([]agent.RecordedEvent, map[string]agent.Decision) {
+	info, err := os.Stat(path)
+	if err != nil {
+		usagef("Failed to open recording: %v", err)
+	}
+	if !info.IsDir() && !strings.HasSuffix(path, ".ndjson") && !strings.HasSuffix(path, ".ndjson.gz") {
+		f, err := os.Open(path)
+		if err != nil {
+			usagef("Failed to open recording: %v", err)
+		}
+		defer f.Close()
+		events, err := agent.ReadRecordedEvents(f)
+		if err != nil {
+			usagef("Invalid recording %s: %v", path, err)
+		}
+		return events, nil
+	}
+
+	archive, err := agent.ReadEventArchive(path)
+	if errors.Is(err, agent.ErrArchiveTampered) {
+		fatalf("%v", err)
+	} else if err != nil {
+		usagef("Invalid event archive %s: %v", path, err)
+	}
+	events := make([]agent.RecordedEvent, len(archive))
+	decisions := map[string]agent.Decision{}
+	for i, e := range archive {
+		events[i] = e.RecordedEvent
+		if e.Decision != nil {
+			decisions[e.Decision.TaskID] = *e.Decision
+		}
+	}
+	return events, decisions
+}
+
+// sameDecision reports whether a replay decided as the node did.
+func sameDecision(a, b agent.Decision) bool {
+	return a.Action == b.Action && a.Amount == b.Amount && a.Answer == b.Answer && a.Code == b.Code
+}
+
+// describeDecision renders an intake decision as one line.
+func describeDecision(d agent.Decision) string {
+	var b strings.Builder
+	b.WriteString(d.Action)
+	switch d.Action {
+	case agent.ActionBid:
+		fmt.Fprintf(&b, " %s wei", d.Amount)
+	case agent.ActionAnswer:
+		fmt.Fprintf(&b, " with %s", d.Answer)
+	}
+	if d.PeerID != "" {
+		fmt.Fprintf(&b, " (requester %s)", d.PeerID)
+	} else if d.Endpoint != "" {
+		fmt.Fprintf(&b, " (requester %s)", d.Endpoint)
+	}
+	if d.Reason != "" {
+		fmt.Fprintf(&b, ": %s", d.Reason)
+	}
+	return b.String()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+// statusReport is the status of a running node, or just the database state
+// when the node is stopped.
+type statusReport struct {
+	Running bool `json:"running"`
+	agent.NodeStatus
+}
+
+func statusCmd(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	parseFlags(fs, args)
+
+	var report statusReport
+	err := apiGet(g.apiAddr, "/status", &report.NodeStatus)
+	switch err {
+	case nil:
+		report.Running = true
+	case errNodeDown:
+		store := g.openStore()
+		defer store.Close()
+		report.SchemaVersion, _ = store.SchemaVersion()
+	default:
+		fatalf("Status query failed: %v", err)
+	}
+
+	output(report, func() {
+		if !report.Running {
+			fmt.Printf("Node is not running (no API at %s)\n", g.apiAddr)
+			fmt.Printf("Database: %s (schema v%d)\n", g.dbPath, report.SchemaVersion)
+			return
+		}
+		fmt.Printf("Peer ID:      %s\n", report.PeerID)
+		fmt.Printf("Addresses:    %v\n", report.Addrs)
+		if len(report.Transports) > 0 {
+			fmt.Printf("Transports:   %s\n", strings.Join(report.Transports, ", "))
+		}
+		if len(report.Degraded) > 0 {
+			fmt.Printf("Status:       degraded: %s\n", strings.Join(report.Degraded, ", "))
+		}
+		fmt.Printf("Peers:        %d connected\n", report.ConnectedPeers)
+		if len(report.Bootstraps) > 0 {
+			var connected []string
+			for _, b := range report.Bootstraps {
+				if b.Connected {
+					connected = append(connected, b.PeerID)
+				}
+			}
+			fmt.Printf("Bootstrap:    %d of %d connected", len(connected), len(report.Bootstraps))
+			if len(connected) > 0 {
+				fmt.Printf(" (%s)", strings.Join(connected, ", "))
+			}
+			fmt.Println()
+		}
+		fmt.Printf("Watcher:      block %d\n", report.WatcherBlock)
+		for _, w := range report.Watchers {
+			if !w.CatchingUp {
+				continue
+			}
+			if w.ChainID != 0 {
+				fmt.Printf("Catching up:  chain %d at %s\n", w.ChainID, w)
+			} else {
+				fmt.Printf("Catching up:  %s\n", w)
+			}
+		}
+		for _, u := range report.UndecodedLogs {
+			fmt.Printf("ABI drift:    %d logs from %s matched no known event (last in block %d)\n", u.Count, u.Contract, u.LastBlock)
+		}
+		for _, b := range report.SLOBreaches {
+			fmt.Printf("SLO breach:   %s %s is %s over the last %s, want %s\n", b.Capability, b.Objective, b.Got, b.Window, b.Want)
+		}
+		if report.Leader != nil {
+			role := "follower"
+			if report.Leader.IsLeader {
+				role = "leader"
+			}
+			fmt.Printf("Cluster:      %s (lease held by %s)\n", role, report.Leader.Holder)
+		}
+		if report.Wallet != "" {
+			fmt.Printf("Wallet:       %s\n", named(report.WalletName, report.Wallet))
+		}
+		if report.AgentID != "" {
+			fmt.Printf("Agent:        %s\n", report.AgentID)
+		}
+		fmt.Printf("Schema:       v%d\n", report.SchemaVersion)
+		fmt.Printf("Up since:     %s\n", time.Unix(report.StartedAt, 0).Format(time.RFC3339))
+		if len(report.Startup) > 0 {
+			fmt.Printf("Startup:      %s\n", describeStartup(report.Startup))
+		}
+	})
+}
+
+// describeStartup lists how long each component took to start, e.g.
+// "store 2ms, host 48ms, chain starting (12.345s, 3 attempts)".
+func describeStartup(timings []agent.ComponentTiming) string {
+	parts := make([]string, len(timings))
+	for i, t := range timings {
+		took := (time.Duration(t.Millis) * time.Millisecond).String()
+		switch {
+		case t.State == agent.ComponentUp:
+			parts[i] = fmt.Sprintf("%s %s", t.Name, took)
+		case t.Attempts > 1:
+			parts[i] = fmt.Sprintf("%s %s (%s, %d attempts)", t.Name, t.State, took, t.Attempts)
+		case t.State == agent.ComponentPending:
+			parts[i] = fmt.Sprintf("%s %s", t.Name, t.State)
+		default:
+			parts[i] = fmt.Sprintf("%s %s (%s)", t.Name, t.State, took)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
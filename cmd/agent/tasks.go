@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+func tasksCmd(args []string) {
+	action, rest := subcommand("tasks", args, "list", "show")
+
+	fs := flag.NewFlagSet("tasks "+action, flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	limit := 100
+	if action == "list" {
+		fs.IntVar(&limit, "limit", 100, "Maximum number of tasks to show (offline only; the node API returns its latest 100)")
+	}
+	parseFlags(fs, rest)
+
+	switch action {
+	case "list":
+		var tasks []agent.TaskRecord
+		err := apiGet(g.apiAddr, "/tasks", &tasks)
+		if err == errNodeDown {
+			store := g.openStore()
+			defer store.Close()
+			tasks, err = store.ListTasks(limit)
+		}
+		if err != nil {
+			fatalf("Failed to list tasks: %v", err)
+		}
+		if tasks == nil {
+			tasks = []agent.TaskRecord{}
+		}
+		output(tasks, func() {
+			if len(tasks) == 0 {
+				fmt.Println("No tasks recorded.")
+				return
+			}
+			fmt.Printf("%-28s %-10s %-10s %-22s %-8s %s\n", "ID", "KIND", "STATUS", "AMOUNT (wei)", "PRIORITY", "CREATED")
+			for _, t := range tasks {
+				priority := "-"
+				if t.Priority != nil {
+					priority = fmt.Sprintf("%.3f", *t.Priority)
+				}
+				fmt.Printf("%-28s %-10s %-10s %-22s %-8s %s\n", t.ID, t.Kind, t.Status, t.Amount, priority, time.Unix(t.CreatedAt, 0).Format(time.RFC3339))
+			}
+		})
+
+	case "show":
+		if fs.NArg() != 1 {
+			usagef("usage: agent tasks show [flags] <id>")
+		}
+		id := fs.Arg(0)
+
+		var task *agent.TaskRecord
+		err := apiGet(g.apiAddr, "/tasks/"+url.PathEscape(id), &task)
+		if err == errNodeDown {
+			store := g.openStore()
+			defer store.Close()
+			task, err = store.GetTask(id)
+			if err == nil && task == nil {
+				err = fmt.Errorf("task not found")
+			}
+		}
+		if err != nil {
+			fatalf("Failed to show task %s: %v", id, err)
+		}
+		output(task, func() {
+			fmt.Printf("ID:        %s\n", task.ID)
+			fmt.Printf("Kind:      %s\n", task.Kind)
+			fmt.Printf("Status:    %s\n", task.Status)
+			fmt.Printf("Client:    %s\n", task.Client)
+			if task.Topic != "" {
+				fmt.Printf("Topic:     %s\n", task.Topic)
+			}
+			fmt.Printf("Spec hash: %s\n", task.SpecHash)
+			fmt.Printf("Amount:    %s wei\n", task.Amount)
+			if task.Deadline > 0 {
+				fmt.Printf("Deadline:  %s\n", time.Unix(task.Deadline, 0).Format(time.RFC3339))
+			}
+			if task.Priority != nil {
+				fmt.Printf("Priority:  %.3f\n", *task.Priority)
+			}
+			fmt.Printf("Created:   %s\n", time.Unix(task.CreatedAt, 0).Format(time.RFC3339))
+			fmt.Printf("Updated:   %s\n", time.Unix(task.UpdatedAt, 0).Format(time.RFC3339))
+			if v := task.Verdict; v != nil {
+				fmt.Printf("Verdict:   bid=%t confidence=%.2f", v.Bid, v.Confidence)
+				if v.SuggestedPrice != "" {
+					fmt.Printf(" price=%s wei", v.SuggestedPrice)
+				}
+				fmt.Println()
+				if v.Reason != "" {
+					fmt.Printf("Reason:    %s\n", v.Reason)
+				}
+				if v.Raw != "" {
+					fmt.Printf("Raw:       %s\n", v.Raw)
+				}
+			}
+			if v := task.Verification; v != nil {
+				fmt.Printf("Verified:  %s by %s at %s\n", v.Outcome, v.Worker, time.UnixMilli(v.VerifiedAt).Format(time.RFC3339))
+				fmt.Printf("Committed: %s\n", v.Commitment)
+				if v.ResultHash != "" {
+					fmt.Printf("Delivered: %s\n", v.ResultHash)
+				}
+				if v.Reason != "" {
+					fmt.Printf("Reason:    %s\n", v.Reason)
+				}
+				if v.Verifier != nil && v.Verifier.Output != "" {
+					fmt.Printf("Verifier:  %s\n", v.Verifier.Output)
+				}
+			}
+		})
+	}
+}
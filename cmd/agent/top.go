@@ -0,0 +1,589 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+const (
+	// topSlowRefresh spaces out the panes that cost RPC calls on the node
+	// (readiness and wallet balance), whatever the refresh interval.
+	topSlowRefresh = 5 * time.Second
+	// topKeepEvents is how many recent events and errors the dashboard keeps.
+	topKeepEvents = 100
+)
+
+// Panes that can be focused and drilled into.
+const (
+	paneTasks = iota
+	panePeers
+)
+
+// topSnapshot is everything the dashboard shows, as fetched from the API.
+type topSnapshot struct {
+	At     time.Time          `json:"at"`
+	Status agent.NodeStatus   `json:"status"`
+	Ready  *agent.Readiness   `json:"ready,omitempty"`
+	Tasks  []agent.TaskRecord `json:"tasks"`
+	Peers  []agent.PeerRecord `json:"peers"`
+	Wallet *agent.WalletInfo  `json:"wallet,omitempty"`
+	Events []agent.NodeEvent  `json:"events"` // new since the previous snapshot
+	Err    string             `json:"error,omitempty"`
+}
+
+// topState is the dashboard: the latest snapshot, the events seen so far and
+// the keyboard selection.
+type topState struct {
+	addr      string
+	snap      topSnapshot
+	events    []agent.NodeEvent
+	errors    []agent.NodeEvent
+	lastSeq   uint64
+	startedAt int64
+	slowAt    time.Time
+
+	focus    int
+	selected [2]int
+	detail   string // ID of the task or peer being inspected, if any
+}
+
+func topCmd(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	interval := fs.Duration("interval", time.Second, "Refresh interval")
+	plain := fs.Bool("plain", false, "Print a refreshing text summary instead of the full-screen dashboard")
+	parseFlags(fs, args)
+	if *interval <= 0 {
+		usagef("-interval must be positive")
+	}
+
+	st := &topState{addr: g.apiAddr}
+	st.refresh()
+	if st.snap.Err != "" && st.snap.Status.PeerID == "" {
+		preconditionf("No node answers at %s; start it with 'agent run'", g.apiAddr)
+	}
+
+	switch {
+	case jsonMode():
+		// One snapshot event per refresh, for scripts
+		for {
+			emitEvent("snapshot", st.snap)
+			time.Sleep(*interval)
+			st.refresh()
+		}
+	case *plain || !fullScreenCapable():
+		st.runPlain(*interval)
+	default:
+		if err := st.runFullScreen(*interval); err != nil {
+			// Raw mode failed after all; fall back rather than give up
+			st.runPlain(*interval)
+		}
+	}
+}
+
+// fullScreenCapable reports whether stdin and stdout are a terminal that
+// understands cursor movement.
+func fullScreenCapable() bool {
+	term := os.Getenv("TERM")
+	if term == "" || term == "dumb" {
+		return false
+	}
+	return isTerminal(int(os.Stdin.Fd())) && isTerminal(int(os.Stdout.Fd()))
+}
+
+// runPlain prints the dashboard as text every interval, for dumb terminals
+// and logs.
+func (st *topState) runPlain(interval time.Duration) {
+	for {
+		for _, line := range st.render(0, 0, false) {
+			fmt.Println(line)
+		}
+		fmt.Println()
+		time.Sleep(interval)
+		st.refresh()
+	}
+}
+
+// runFullScreen draws the dashboard on the alternate screen and handles keys
+// until the user quits.
+//
+// The dashboard is drawn with plain ANSI sequences rather than a TUI library
+// such as bubbletea or tview: it is a list of text panes redrawn whole on
+// every tick, which needs only raw mode and the window size (golang.org/x/sys,
+// already a dependency), while those libraries would bring a screen model and
+// several modules into a binary that otherwise has no interactive UI. The
+// layout lives in render and the key handling in handleKey, so both are
+// tested without a terminal.
+func (st *topState) runFullScreen(interval time.Duration) error {
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	st.loop(os.Stdout, keys, ticker.C, func() (int, int) {
+		width, height, err := termSize(int(os.Stdout.Fd()))
+		if err != nil {
+			return 80, 24
+		}
+		return width, height
+	})
+	return nil
+}
+
+// loop writes a frame to out, then refreshes on each tick and applies each
+// key, redrawing after either, until the user quits or keys is closed.
+func (st *topState) loop(out io.Writer, keys <-chan string, ticks <-chan time.Time, size func() (int, int)) {
+	for {
+		width, height := size()
+		fmt.Fprint(out, "\x1b[H\x1b[2J"+strings.Join(st.render(width, height, true), "\r\n"))
+
+		select {
+		case <-ticks:
+			st.refresh()
+		case key, ok := <-keys:
+			if !ok || !st.handleKey(key) {
+				return
+			}
+		}
+	}
+}
+
+// refresh fetches a new snapshot. A node that went away is shown as an
+// error; one that restarted resets the event history.
+func (st *topState) refresh() {
+	snap := topSnapshot{At: time.Now(), Ready: st.snap.Ready, Wallet: st.snap.Wallet}
+	if err := apiGet(st.addr, "/status", &snap.Status); err != nil {
+		snap.Err = err.Error()
+		snap.Status = st.snap.Status
+		snap.Tasks, snap.Peers = st.snap.Tasks, st.snap.Peers
+		st.snap = snap
+		return
+	}
+	if snap.Status.StartedAt != st.startedAt {
+		st.startedAt, st.lastSeq = snap.Status.StartedAt, 0
+		st.events, st.errors = nil, nil
+	}
+
+	if err := apiGet(st.addr, "/tasks", &snap.Tasks); err != nil {
+		snap.Err = err.Error()
+	}
+	if err := apiGet(st.addr, "/peers", &snap.Peers); err != nil {
+		snap.Err = err.Error()
+	}
+	if err := apiGet(st.addr, fmt.Sprintf("/events?after=%d", st.lastSeq), &snap.Events); err != nil {
+		snap.Err = err.Error()
+	}
+	for _, e := range snap.Events {
+		st.lastSeq = e.Seq
+		if e.Error != "" {
+			st.errors = appendEvent(st.errors, e)
+		} else {
+			st.events = appendEvent(st.events, e)
+		}
+	}
+
+	if snap.At.Sub(st.slowAt) >= topSlowRefresh {
+		st.slowAt = snap.At
+		if ready, err := fetchReadiness(st.addr); err == nil {
+			snap.Ready = &ready
+		}
+		snap.Wallet = nil
+		if snap.Status.Wallet != "" {
+			var info agent.WalletInfo
+			if apiGet(st.addr, "/wallet", &info) == nil {
+				snap.Wallet = &info
+			}
+		}
+	}
+	st.snap = snap
+}
+
+func appendEvent(events []agent.NodeEvent, e agent.NodeEvent) []agent.NodeEvent {
+	events = append(events, e)
+	if len(events) > topKeepEvents {
+		events = events[len(events)-topKeepEvents:]
+	}
+	return events
+}
+
+// fetchReadiness reads GET /readyz, whose body lists the checks even when it
+// answers 503.
+func fetchReadiness(addr string) (agent.Readiness, error) {
+	var r agent.Readiness
+	client := &http.Client{Timeout: apiTimeout}
+	resp, err := client.Get("http://" + addr + "/readyz")
+	if err != nil {
+		return r, errNodeDown
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	return r, err
+}
+
+// runningTasks are the tasks still being worked on, oldest first.
+func (st *topState) runningTasks() []agent.TaskRecord {
+	var tasks []agent.TaskRecord
+	for i := len(st.snap.Tasks) - 1; i >= 0; i-- {
+		if t := st.snap.Tasks[i]; t.Status == agent.TaskStatusReceived {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks
+}
+
+// pendingDeliveries are running tasks whose requester has been resolved to a
+// peer, as "task -> peer" lines.
+func (st *topState) pendingDeliveries() []string {
+	running := map[string]bool{}
+	for _, t := range st.runningTasks() {
+		running[t.ID] = true
+	}
+	var out []string
+	for _, e := range st.events {
+		if e.Kind != "requester_resolved" {
+			continue
+		}
+		data, _ := e.Data.(map[string]interface{})
+		taskID, _ := data["taskId"].(string)
+		peerID, _ := data["peerId"].(string)
+		if running[taskID] {
+			out = append(out, fmt.Sprintf("%-24s -> %s", taskID, peerID))
+		}
+	}
+	return out
+}
+
+// selection returns the IDs listed in the focused pane.
+func (st *topState) selection() []string {
+	var ids []string
+	if st.focus == paneTasks {
+		for _, t := range st.runningTasks() {
+			ids = append(ids, t.ID)
+		}
+	} else {
+		for _, p := range st.snap.Peers {
+			ids = append(ids, p.PeerID)
+		}
+	}
+	return ids
+}
+
+// handleKey applies a key press and reports whether to keep running.
+func (st *topState) handleKey(key string) bool {
+	switch key {
+	case "q", "ctrl-c":
+		return false
+	}
+	if st.detail != "" {
+		switch key {
+		case "esc", "backspace", "left", "h", "enter":
+			st.detail = ""
+		}
+		return true
+	}
+
+	ids := st.selection()
+	sel := &st.selected[st.focus]
+	switch key {
+	case "tab", "backtab":
+		st.focus = 1 - st.focus
+	case "up", "k":
+		if *sel > 0 {
+			*sel--
+		}
+	case "down", "j":
+		if *sel < len(ids)-1 {
+			*sel++
+		}
+	case "enter", "right", "l":
+		if *sel < len(ids) {
+			st.detail = ids[*sel]
+		}
+	}
+	return true
+}
+
+// readKeys turns terminal input into key names until stdin closes.
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		if key := keyName(buf[:n]); key != "" {
+			keys <- key
+		}
+	}
+}
+
+func keyName(b []byte) string {
+	if len(b) >= 3 && b[0] == 27 && b[1] == '[' {
+		switch b[2] {
+		case 'A':
+			return "up"
+		case 'B':
+			return "down"
+		case 'C':
+			return "right"
+		case 'D':
+			return "left"
+		case 'Z':
+			return "backtab"
+		}
+		return ""
+	}
+	if len(b) != 1 {
+		return ""
+	}
+	switch b[0] {
+	case 27:
+		return "esc"
+	case 3:
+		return "ctrl-c"
+	case 9:
+		return "tab"
+	case 10, 13:
+		return "enter"
+	case 8, 127:
+		return "backspace"
+	}
+	return string(b)
+}
+
+// render lays the dashboard out in at most height lines of width columns; a
+// zero height means no limit. Selection is only shown when interactive.
+func (st *topState) render(width, height int, interactive bool) []string {
+	now := time.Now()
+	s := st.snap
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, clip(fmt.Sprintf(format, args...), width))
+	}
+
+	state := "NOT READY"
+	if s.Ready != nil && s.Ready.Ready {
+		state = "ready"
+	}
+	if s.Err != "" {
+		state = "ERROR: " + s.Err
+	}
+	add("agentmesh top  %s  up %s  %s  %s", s.Status.PeerID, since(now, s.Status.StartedAt*1000), state, s.At.Format("15:04:05"))
+	wallet := "none"
+	if s.Wallet != nil {
+		wallet = named(s.Status.WalletName, s.Wallet.Address)
+		if s.Wallet.Balance != "" {
+			wallet += " " + s.Wallet.Balance + " wei"
+		}
+	}
+	add("Peers: %d connected  Watcher: block %d  Wallet: %s", s.Status.ConnectedPeers, s.Status.WatcherBlock, wallet)
+	if s.Ready != nil {
+		var checks []string
+		for _, c := range s.Ready.Checks {
+			status := "ok"
+			if !c.OK {
+				status = "FAIL"
+			}
+			checks = append(checks, fmt.Sprintf("%s %s (%s)", c.Name, status, c.Detail))
+		}
+		add("Checks: %s", strings.Join(checks, "  "))
+	}
+
+	var footer string
+	if interactive {
+		footer = "tab switch pane  ↑/↓ select  enter inspect  esc back  q quit"
+	}
+
+	if st.detail != "" {
+		lines = append(lines, "")
+		lines = append(lines, st.renderDetail(now, width)...)
+	} else {
+		running := st.runningTasks()
+		taskRows := make([]string, len(running))
+		for i, t := range running {
+			taskRows[i] = fmt.Sprintf("%-24s %-10s %-9s %-42s %s wei", t.ID, t.Kind, since(now, t.CreatedAt*1000), t.Client, t.Amount)
+		}
+		peerRows := make([]string, len(s.Peers))
+		for i, p := range s.Peers {
+			peerRows[i] = fmt.Sprintf("%-54s %-20s %-20s seen %s ago", p.PeerID, orDash(p.Name), p.Capability, since(now, p.LastSeen*1000))
+		}
+		deliveries := st.pendingDeliveries()
+
+		// Share the remaining rows out by weight
+		weights := []int{4, 2, 3, 3, 2}
+		budget := []int{0, 0, 0, 0, 0}
+		avail := height - len(lines) - 2*len(weights) - 1
+		for i, w := range weights {
+			if height == 0 {
+				budget[i] = 10
+			} else if budget[i] = avail * w / 14; budget[i] < 1 {
+				budget[i] = 1
+			}
+		}
+
+		selected := func(pane int) int {
+			if !interactive || st.focus != pane {
+				return -1
+			}
+			return st.selected[pane]
+		}
+		lines = append(lines, section(fmt.Sprintf("RUNNING TASKS (%d)", len(running)), taskRows, budget[0], selected(paneTasks), width)...)
+		lines = append(lines, section(fmt.Sprintf("PENDING DELIVERIES (%d)", len(deliveries)), deliveries, budget[1], -1, width)...)
+		lines = append(lines, section(fmt.Sprintf("PEERS (%d)", len(s.Peers)), peerRows, budget[2], selected(panePeers), width)...)
+		lines = append(lines, section("RECENT EVENTS", eventRows(st.events), budget[3], -1, width)...)
+		lines = append(lines, section(fmt.Sprintf("RECENT ERRORS (%d)", len(st.errors)), eventRows(st.errors), budget[4], -1, width)...)
+	}
+
+	if height > 0 && len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	if footer != "" {
+		if height > 0 {
+			for len(lines) < height-1 {
+				lines = append(lines, "")
+			}
+		}
+		lines = append(lines, clip(footer, width))
+	}
+	return lines
+}
+
+// renderDetail shows the inspected task or peer with the events that
+// mention it.
+func (st *topState) renderDetail(now time.Time, width int) []string {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, clip(fmt.Sprintf(format, args...), width))
+	}
+
+	found := false
+	for _, t := range st.snap.Tasks {
+		if t.ID == st.detail {
+			found = true
+			add("TASK %s", t.ID)
+			add("  Kind:     %s", t.Kind)
+			add("  Status:   %s", t.Status)
+			add("  Client:   %s", t.Client)
+			if t.Topic != "" {
+				add("  Topic:    %s", t.Topic)
+			}
+			if t.SpecHash != "" {
+				add("  Spec:     %s", t.SpecHash)
+			}
+			add("  Amount:   %s wei", t.Amount)
+			add("  Created:  %s (%s ago)", time.Unix(t.CreatedAt, 0).Format(time.RFC3339), since(now, t.CreatedAt*1000))
+			add("  Updated:  %s", time.Unix(t.UpdatedAt, 0).Format(time.RFC3339))
+		}
+	}
+	for _, p := range st.snap.Peers {
+		if p.PeerID == st.detail {
+			found = true
+			add("PEER %s", p.PeerID)
+			if p.Name != "" {
+				add("  Name:       %s", p.Name)
+			}
+			if p.EthAddress != "" {
+				add("  Wallet:     %s", p.EthAddress)
+			}
+			add("  Capability: %s", p.Capability)
+			add("  Last seen:  %s (%s ago)", time.Unix(p.LastSeen, 0).Format(time.RFC3339), since(now, p.LastSeen*1000))
+			add("  Blocked:    %t", p.Blocked)
+		}
+	}
+	if !found {
+		add("%s is no longer listed by the node", st.detail)
+	}
+
+	var related []agent.NodeEvent
+	for _, e := range append(append([]agent.NodeEvent(nil), st.events...), st.errors...) {
+		if raw, _ := json.Marshal(e.Data); strings.Contains(string(raw), st.detail) {
+			related = append(related, e)
+		}
+	}
+	lines = append(lines, "")
+	return append(lines, section("EVENTS", eventRows(related), 0, -1, width)...)
+}
+
+// section renders a titled list showing at most limit rows (0 means all),
+// scrolled so the selected row, if any, stays visible.
+func section(title string, rows []string, limit, selected, width int) []string {
+	lines := []string{"", clip(title, width)}
+	if len(rows) == 0 {
+		return append(lines, "  -")
+	}
+	if selected >= len(rows) {
+		selected = len(rows) - 1
+	}
+	start := 0
+	if limit > 0 && selected >= limit {
+		start = selected - limit + 1
+	}
+	end := len(rows)
+	if limit > 0 && end > start+limit {
+		end = start + limit
+	}
+	for i := start; i < end; i++ {
+		if i == selected {
+			lines = append(lines, "\x1b[7m"+clip("> "+rows[i], width)+"\x1b[0m")
+		} else {
+			lines = append(lines, clip("  "+rows[i], width))
+		}
+	}
+	return lines
+}
+
+// eventRows describes events newest first.
+func eventRows(events []agent.NodeEvent) []string {
+	rows := make([]string, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		detail := e.Error
+		if detail == "" && e.Data != nil {
+			raw, _ := json.Marshal(e.Data)
+			detail = string(raw)
+		}
+		// Name the wallets and peers in it, as far as the node knew them
+		for id, name := range e.Names {
+			detail = strings.ReplaceAll(detail, id, named(name, id))
+		}
+		rows = append(rows, fmt.Sprintf("%s %-20s %s", time.UnixMilli(e.Time).Format("15:04:05"), e.Kind, detail))
+	}
+	return rows
+}
+
+// since formats the time elapsed from a unix millisecond timestamp.
+func since(now time.Time, ms int64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return now.Sub(time.UnixMilli(ms)).Round(time.Second).String()
+}
+
+// clip cuts s to width runes; a non-positive width leaves it whole.
+func clip(s string, width int) string {
+	if width <= 0 {
+		return s
+	}
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	return string(r[:width])
+}
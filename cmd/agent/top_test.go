@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/agent"
+)
+
+// fakeEventNode serves the API 'agent top' polls, with an event log the test
+// appends to.
+type fakeEventNode struct {
+	mu     sync.Mutex
+	events []agent.NodeEvent
+}
+
+func (f *fakeEventNode) emit(kind, errMsg string, data interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, agent.NodeEvent{
+		Seq: uint64(len(f.events) + 1), Kind: kind, Time: time.Now().UnixMilli(), Error: errMsg, Data: data,
+	})
+}
+
+func (f *fakeEventNode) start(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, agent.NodeStatus{PeerID: "12D3KooWTopPeer", ConnectedPeers: 1, StartedAt: 1700000000})
+	})
+	mux.HandleFunc("GET /tasks", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, []agent.TaskRecord{{ID: "task:7", Kind: agent.TaskKindEscrow, Status: agent.TaskStatusReceived, Amount: "1000", CreatedAt: 1700000000}})
+	})
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, []agent.PeerRecord{})
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		events := []agent.NodeEvent{}
+		for _, e := range f.events {
+			if e.Seq > after {
+				events = append(events, e)
+			}
+		}
+		reply(w, events)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// frameWriter hands each frame the dashboard draws to the test.
+type frameWriter chan string
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestTopShowsNewEventsLive(t *testing.T) {
+	node := &fakeEventNode{}
+	st := &topState{addr: node.start(t)}
+	st.refresh()
+
+	frames := make(frameWriter)
+	keys := make(chan string)
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		st.loop(frames, keys, ticks, func() (int, int) { return 120, 40 })
+	}()
+
+	next := func() string {
+		t.Helper()
+		select {
+		case f := <-frames:
+			return f
+		case <-time.After(5 * time.Second):
+			t.Fatal("no frame drawn")
+			return ""
+		}
+	}
+
+	first := next()
+	if !strings.Contains(first, "task:7") {
+		t.Errorf("first frame doesn't list the running task:\n%s", first)
+	}
+	if strings.Contains(first, "bid_sent") {
+		t.Errorf("first frame shows an event before it happened:\n%s", first)
+	}
+
+	// The node reports a bid and a failure; the next tick draws both
+	node.emit("bid_sent", "", map[string]interface{}{"taskId": "task:7"})
+	node.emit("rpc_failed", "dial tcp: connection refused", nil)
+	ticks <- time.Now()
+	second := next()
+	if !strings.Contains(second, "bid_sent") || !strings.Contains(second, `"taskId":"task:7"`) {
+		t.Errorf("frame after the tick doesn't show the new event:\n%s", second)
+	}
+	if !strings.Contains(second, "RECENT ERRORS (1)") || !strings.Contains(second, "connection refused") {
+		t.Errorf("frame after the tick doesn't show the new error:\n%s", second)
+	}
+
+	// Events already shown aren't fetched twice
+	ticks <- time.Now()
+	third := next()
+	if n := strings.Count(third, "bid_sent"); n != 1 {
+		t.Errorf("bid_sent shown %d times after a quiet tick, want 1:\n%s", n, third)
+	}
+
+	// Drilling into the task lists the events that mention it
+	keys <- "enter"
+	detail := next()
+	if !strings.Contains(detail, "TASK task:7") || !strings.Contains(detail, "bid_sent") {
+		t.Errorf("task detail doesn't show its event:\n%s", detail)
+	}
+
+	keys <- "q"
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dashboard didn't quit on q")
+	}
+}
+
+func TestTopKeyNames(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"\x1b[A", "up"},
+		{"\x1b[B", "down"},
+		{"\x1b[Z", "backtab"},
+		{"\x1b", "esc"},
+		{"\t", "tab"},
+		{"\r", "enter"},
+		{"\x03", "ctrl-c"},
+		{"q", "q"},
+		{"\x1b[1;5A", ""},
+	}
+	for _, tt := range tests {
+		if got := keyName([]byte(tt.in)); got != tt.want {
+			t.Errorf("keyName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+var errNoTTY = errors.New("terminal control is not supported on this platform")
+
+// On other platforms 'agent top' always uses its plain text mode.
+
+func isTerminal(fd int) bool { return false }
+
+func termSize(fd int) (int, int, error) { return 0, 0, errNoTTY }
+
+func makeRaw(fd int) (func(), error) { return nil, errNoTTY }
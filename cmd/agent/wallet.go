@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"agentmesh/pkg/agent"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func walletCmd(args []string) {
+	action, rest := subcommand("wallet", args, "address", "balance", "budget")
+
+	fs := flag.NewFlagSet("wallet "+action, flag.ExitOnError)
+	g := addGlobalFlags(fs)
+	c := addChainFlags(fs)
+	parseFlags(fs, rest)
+
+	if action == "budget" {
+		walletBudget(g)
+		return
+	}
+
+	// Prefer the running node's view; fall back to the key file and RPC
+	var info agent.WalletInfo
+	err := apiGet(g.apiAddr, "/wallet", &info)
+	if err == errNodeDown {
+		wallet, err := agent.LoadWallet(c.walletPath)
+		if err != nil {
+			preconditionf("%v", err)
+		}
+		info.Address = wallet.Address.Hex()
+	} else if err != nil {
+		fatalf("Wallet query failed: %v", err)
+	}
+
+	switch action {
+	case "address":
+		output(agent.WalletInfo{Address: info.Address}, func() {
+			fmt.Println(info.Address)
+		})
+
+	case "balance":
+		if info.Balance == "" {
+			client, err := c.ercClient()
+			if err != nil {
+				fatalf("%v", err)
+			}
+			defer client.Close()
+			bal, err := client.Balance(common.HexToAddress(info.Address))
+			if err != nil {
+				fatalf("Failed to fetch balance: %v", err)
+			}
+			info.Balance = bal.String()
+		}
+		output(info, func() {
+			fmt.Printf("%s: %s wei\n", info.Address, info.Balance)
+		})
+	}
+}
+
+// walletBudget shows what the node's bid budget has reserved and locked.
+// Without a running node it shows the reservations in the database; their
+// budgets are the node's flags.
+func walletBudget(g *globalFlags) {
+	var st agent.CapitalStatus
+	err := apiGet(g.apiAddr, "/wallet/budget", &st)
+	if err == errNodeDown {
+		store := g.openStore()
+		defer store.Close()
+		capital := agent.NewCapitalTracker(store, nil)
+		if err = capital.Load(); err == nil {
+			st = capital.Snapshot()
+		}
+	}
+	if err != nil {
+		fatalf("Budget query failed: %v", err)
+	}
+	output(st, func() {
+		if len(st.Tokens) == 0 {
+			fmt.Println("Nothing reserved")
+			return
+		}
+		for _, t := range st.Tokens {
+			fmt.Printf("%s: %s reserved, %s locked", t.Token, t.Reserved, t.Locked)
+			if t.Budget != "" {
+				fmt.Printf(" of %s", t.Budget)
+			}
+			if t.Available != "" {
+				fmt.Printf(", %s available", t.Available)
+			}
+			fmt.Println()
+		}
+		for _, r := range st.Reservations {
+			fmt.Printf("  %-30s %-8s %s %s\n", r.TaskID, r.State, r.Amount, r.Token)
+		}
+	})
+}
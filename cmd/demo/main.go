@@ -55,8 +55,8 @@ func main() {
 	// Agent A will "watch" for tasks and knowledge queries on-chain and react.
 	watcher, err := agent.NewEventWatcher(
 		"https://sepolia.base.org",
-		"0x0000000000000000000000000000000000000000", // TaskEscrow placeholder
-		"0x0000000000000000000000000000000000000000", // KnowledgeMarket placeholder
+		[]string{"0x0000000000000000000000000000000000000000"}, // TaskEscrow placeholder
+		[]string{"0x0000000000000000000000000000000000000000"}, // KnowledgeMarket placeholder
 		func(e agent.TaskCreatedEvent) {
 			fmt.Printf("[Watcher] >>> ON-CHAIN TASK DETECTED: ID=%s, Payment=%s\n", e.TaskId, e.Payment)
 			fmt.Println("[Agent A] Task found on-chain! Advertising capability to handle it...")
@@ -69,7 +69,7 @@ func main() {
 			if reputationClient != nil {
 				agentId, err := reputationClient.GetAgentIdByWallet(q.Requester)
 				if err == nil {
-					peerId, _ := reputationClient.GetMetadata(agentId, "peerId")
+					peerId, _ := reputationClient.ResolvePeerID(agentId)
 					if peerId != "" {
 						fmt.Printf("[Agent A] Successfully resolved PeerID: %s\n", peerId)
 						fmt.Println("[Agent A] Reacting to on-chain knowledge demand via P2P...")
@@ -0,0 +1,274 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Agents that don't run libp2p can be reached over HTTP, at the endpoint
+// they publish in ERC-8004. The node POSTs a SignedPacket whose Data is the
+// AgentMessage, signed with the node's libp2p key as discovery packets are.
+// The agent answers with:
+//
+//   - 200 and the response AgentMessage, or
+//   - 202 and an A2AAck, after which GET on its StatusURL answers 202 until
+//     the result is ready and then 200 and the response AgentMessage, or
+//   - another status, optionally with an error AgentMessage; 429 and 5xx
+//     are retried.
+//
+// Responses carry the request's ID. Retries resend the same ID, so the agent
+// can recognise a request it already accepted.
+
+// MetadataA2AEndpoint is the ERC-8004 metadata key of an agent's HTTP endpoint.
+const MetadataA2AEndpoint = "a2aEndpoint"
+
+// a2aRequestTimeout bounds one HTTP request; polling for an acknowledged
+// request goes on until the caller's context ends.
+const a2aRequestTimeout = 30 * time.Second
+
+// a2aPollInterval is the wait between polls of a StatusURL. It is a variable
+// so tests can shorten it.
+var a2aPollInterval = 2 * time.Second
+
+// A2AAck acknowledges a request that is answered at StatusURL, which may be
+// relative to the endpoint.
+type A2AAck struct {
+	ID        string `json:"id"`
+	StatusURL string `json:"statusUrl"`
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// httpTransport reaches an agent at its HTTP endpoint.
+type httpTransport struct {
+	n        *AgentNode
+	endpoint string
+	client   *http.Client
+}
+
+func (t httpTransport) String() string {
+	return "http " + t.endpoint
+}
+
+func (t httpTransport) Exchange(ctx context.Context, msg AgentMessage) (resp *AgentMessage, err error) {
+	ctx, span := t.n.tracer().Start(ctx, "http.task", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("agentmesh.endpoint", t.endpoint), capabilityAttr(taskCapability(msg.Payload))))
+	defer func() { endSpan(span, err) }()
+	injectTrace(ctx, &msg)
+
+	packet, err := t.n.signMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(packet)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return t.decode(res)
+	case http.StatusAccepted:
+		var ack A2AAck
+		if err := json.NewDecoder(io.LimitReader(res.Body, maxMessageSize)).Decode(&ack); err != nil || ack.StatusURL == "" {
+			return nil, fmt.Errorf("%s sent an invalid acknowledgement", t.endpoint)
+		}
+		if ack.ID != msg.ID {
+			return nil, fmt.Errorf("%s acknowledged message %s, not %s", t.endpoint, ack.ID, msg.ID)
+		}
+		return t.poll(ctx, ack)
+	}
+	return nil, t.statusError(res)
+}
+
+// poll waits for the result of an acknowledged request.
+func (t httpTransport) poll(ctx context.Context, ack A2AAck) (*AgentMessage, error) {
+	base, _ := url.Parse(t.endpoint)
+	ref, err := url.Parse(ack.StatusURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s sent an invalid status URL: %w", t.endpoint, err)
+	}
+	statusURL := base.ResolveReference(ref).String()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(a2aPollInterval):
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, statusURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := t.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch res.StatusCode {
+		case http.StatusOK:
+			resp, err := t.decode(res)
+			res.Body.Close()
+			return resp, err
+		case http.StatusAccepted:
+			res.Body.Close()
+			continue
+		}
+		err = t.statusError(res)
+		res.Body.Close()
+		return nil, err
+	}
+}
+
+// decode reads the response AgentMessage, turning an error message into a
+// *PeerError.
+func (t httpTransport) decode(res *http.Response) (*AgentMessage, error) {
+	var msg AgentMessage
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxMessageSize)).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("%s sent an invalid response: %w", t.endpoint, err)
+	}
+	if msg.Type == MessageError {
+		return nil, peerError(t.endpoint, msg)
+	}
+	return &msg, nil
+}
+
+// statusError describes a failed HTTP exchange as a *PeerError, using the
+// agent's error message when it sent one.
+func (t httpTransport) statusError(res *http.Response) *PeerError {
+	var msg AgentMessage
+	var e *PeerError
+	if json.NewDecoder(io.LimitReader(res.Body, maxMessageSize)).Decode(&msg) == nil && msg.Type == MessageError {
+		e = peerError(t.endpoint, msg)
+	} else {
+		code := ErrCodeInternal
+		switch res.StatusCode {
+		case http.StatusBadRequest:
+			code = ErrCodeBadRequest
+		case http.StatusUnauthorized, http.StatusForbidden:
+			code = ErrCodeForbidden
+		case http.StatusNotFound:
+			code = ErrCodeNotFound
+		case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+			code = ErrCodeTimeout
+		}
+		e = &PeerError{PeerID: t.endpoint, ErrorPayload: ErrorPayload{Code: code, Message: res.Status}}
+	}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		e.Retryable = true
+	}
+	return e
+}
+
+// signMessage wraps msg in a packet signed by the node's identity.
+func (n *AgentNode) signMessage(msg AgentMessage) (SignedPacket, error) {
+	n.mu.RLock()
+	h, priv := n.Host, n.privKey
+	n.mu.RUnlock()
+	data, err := canonical.Marshal(msg)
+	if err != nil {
+		return SignedPacket{}, err
+	}
+	sig, err := signData(priv, data)
+	if err != nil {
+		return SignedPacket{}, err
+	}
+	return SignedPacket{Data: string(data), Signature: sig, PeerID: h.ID().String()}, nil
+}
+
+// A2AEndpoint returns the agent card's HTTP A2A service endpoint, or "".
+func (c AgentCard) A2AEndpoint() string {
+	for _, s := range c.Services {
+		if strings.EqualFold(s.Name, "A2A") && isHTTPURL(s.Endpoint) {
+			return s.Endpoint
+		}
+	}
+	return ""
+}
+
+// FetchAgentCard downloads an agent card from an http(s) agentURI.
+func FetchAgentCard(ctx context.Context, uri string) (*AgentCard, error) {
+	if !isHTTPURL(uri) {
+		return nil, fmt.Errorf("unsupported agent URI %q", uri)
+	}
+	ctx, cancel := context.WithTimeout(ctx, a2aRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", uri, res.Status)
+	}
+	var card AgentCard
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxMessageSize)).Decode(&card); err != nil {
+		return nil, fmt.Errorf("invalid agent card at %s: %w", uri, err)
+	}
+	return &card, nil
+}
+
+// GetAgentURI returns the agentURI an agent registered, where its agent card
+// is published.
+func (c *ERC8004Client) GetAgentURI(agentId *big.Int, at ...BlockTag) (string, error) {
+	data, _ := c.identityABI.Pack("tokenURI", agentId)
+	res, err := c.call(c.identityAddr, data, c.readBlock(at))
+	if err != nil {
+		return "", err
+	}
+	var uri string
+	err = c.identityABI.UnpackIntoInterface(&uri, "tokenURI", res)
+	return uri, err
+}
+
+// A2AEndpoint returns the HTTP endpoint an agent publishes: its a2aEndpoint
+// metadata or, failing that, the A2A service of its agent card. It is ""
+// for agents reachable over libp2p only.
+func (c *ERC8004Client) A2AEndpoint(ctx context.Context, agentId *big.Int) (string, error) {
+	endpoint, _ := c.GetMetadata(agentId, MetadataA2AEndpoint)
+	return c.a2aEndpoint(ctx, agentId, endpoint)
+}
+
+// a2aEndpoint is A2AEndpoint for the a2aEndpoint metadata already read.
+func (c *ERC8004Client) a2aEndpoint(ctx context.Context, agentId *big.Int, endpoint string) (string, error) {
+	if isHTTPURL(endpoint) {
+		return endpoint, nil
+	}
+	uri, err := c.GetAgentURI(agentId)
+	if err != nil {
+		return "", err
+	}
+	if !isHTTPURL(uri) {
+		return "", nil
+	}
+	card, err := FetchAgentCard(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	return card.A2AEndpoint(), nil
+}
@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// a2aAgent is the minimal HTTP counterpart: it checks the sender's signature
+// and echoes each task back under its correlation ID. With async set it
+// acknowledges first and makes the first poll wait. fail holds statuses to
+// answer the first requests with.
+type a2aAgent struct {
+	async bool
+
+	mu     sync.Mutex
+	fail   []int
+	ids    []string // IDs of the requests received, retries included
+	polled map[string]bool
+	done   map[string]AgentMessage
+}
+
+func (a *a2aAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r.Method == http.MethodGet {
+		id := strings.TrimPrefix(r.URL.Path, "/status/")
+		resp, ok := a.done[id]
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case !a.polled[id]:
+			a.polled[id] = true
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			json.NewEncoder(w).Encode(resp)
+		}
+		return
+	}
+
+	var packet SignedPacket
+	var msg AgentMessage
+	if json.NewDecoder(r.Body).Decode(&packet) != nil || !packet.Verify() ||
+		json.Unmarshal([]byte(packet.Data), &msg) != nil || msg.Sender != packet.PeerID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(AgentMessage{ID: msg.ID, Type: MessageError, Payload: ErrorPayload{Code: ErrCodeBadRequest, Message: "bad signature"}})
+		return
+	}
+	a.ids = append(a.ids, msg.ID)
+	if len(a.fail) > 0 {
+		w.WriteHeader(a.fail[0])
+		a.fail = a.fail[1:]
+		return
+	}
+	resp := AgentMessage{ID: msg.ID, Type: "response", Payload: map[string]interface{}{"echo": msg.Payload}}
+	if !a.async {
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if a.done == nil {
+		a.done, a.polled = map[string]AgentMessage{}, map[string]bool{}
+	}
+	a.done[msg.ID] = resp
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(A2AAck{ID: msg.ID, StatusURL: "/status/" + msg.ID})
+}
+
+func (a *a2aAgent) received() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.ids...)
+}
+
+// fastDelivery shortens retry and poll waits for the test.
+func fastDelivery(t *testing.T) {
+	backoff, poll := deliveryBackoff, a2aPollInterval
+	deliveryBackoff, a2aPollInterval = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { deliveryBackoff, a2aPollInterval = backoff, poll })
+}
+
+func TestDelegateOverHTTP(t *testing.T) {
+	fastDelivery(t)
+	n := startTestNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, async := range []bool{false, true} {
+		counterpart := &a2aAgent{async: async}
+		srv := httptest.NewServer(counterpart)
+		defer srv.Close()
+
+		payload, receipt, err := n.Delegate(ctx, Recipient{Endpoint: srv.URL + "/a2a"}, map[string]interface{}{"capability": "summarize"})
+		if err != nil {
+			t.Fatalf("async %v: %v", async, err)
+		}
+		echo, _ := payload.(map[string]interface{})["echo"].(map[string]interface{})
+		if echo["capability"] != "summarize" {
+			t.Errorf("async %v: payload %v, want the task echoed", async, payload)
+		}
+		if ids := counterpart.received(); len(ids) != 1 || ids[0] != receipt.ID || !receipt.Delivered || receipt.Attempts != 1 ||
+			receipt.Transport != "http "+srv.URL+"/a2a" {
+			t.Errorf("async %v: receipt %+v, agent received %v", async, receipt, ids)
+		}
+	}
+}
+
+func TestDeliverFallsBackToHTTP(t *testing.T) {
+	fastDelivery(t)
+	n := startTestNode(t)
+	counterpart := &a2aAgent{}
+	srv := httptest.NewServer(counterpart)
+	defer srv.Close()
+
+	// A peer ID with no known addresses can't be dialled
+	_, pub, _ := crypto.GenerateEd25519Key(nil)
+	gone, _ := peer.IDFromPublicKey(pub)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, receipt, err := n.Delegate(ctx, Recipient{PeerID: gone.String(), Endpoint: srv.URL}, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Transport != "http "+srv.URL || receipt.Attempts != deliveryAttempts+1 {
+		t.Errorf("receipt %+v, want %d p2p attempts and then one over http", receipt, deliveryAttempts)
+	}
+}
+
+func TestDeliverRetriesWithTheSameID(t *testing.T) {
+	fastDelivery(t)
+	n := startTestNode(t)
+	ctx := context.Background()
+
+	counterpart := &a2aAgent{fail: []int{http.StatusServiceUnavailable}}
+	srv := httptest.NewServer(counterpart)
+	defer srv.Close()
+	_, receipt, err := n.Delegate(ctx, Recipient{Endpoint: srv.URL}, "hello")
+	if ids := counterpart.received(); err != nil || len(ids) != 2 || ids[0] != ids[1] || receipt.Attempts != 2 {
+		t.Errorf("after a 503: err %v, receipt %+v, agent received %v; want one retry of the same ID", err, receipt, ids)
+	}
+
+	// A definite refusal isn't retried
+	counterpart = &a2aAgent{fail: []int{http.StatusForbidden}}
+	srv = httptest.NewServer(counterpart)
+	defer srv.Close()
+	_, receipt, err = n.Delegate(ctx, Recipient{Endpoint: srv.URL}, "hello")
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Code != ErrCodeForbidden || pe.PeerID != srv.URL || receipt.Attempts != 1 || !receipt.Delivered {
+		t.Errorf("after a 403: err %v, receipt %+v; want a forbidden PeerError after one attempt", err, receipt)
+	}
+}
+
+func TestDeliverOverP2PEchoesID(t *testing.T) {
+	a, b := startTestNode(t), startTestNode(t)
+	a.CurrentHost().Peerstore().AddAddrs(b.CurrentHost().ID(), b.CurrentHost().Addrs(), time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, receipt, err := a.Deliver(ctx, Recipient{PeerID: b.CurrentHost().ID().String(), Endpoint: "https://unused.example"}, AgentMessage{Type: "task", Payload: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != receipt.ID || receipt.Transport != "p2p "+b.CurrentHost().ID().String() || receipt.Attempts != 1 {
+		t.Errorf("response %s, receipt %+v; want the correlation ID echoed over p2p", resp.ID, receipt)
+	}
+}
+
+func TestDeliverDialsThePublishedAddrs(t *testing.T) {
+	a, b := startTestNode(t), startTestNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a has never heard of b but for its published addresses
+	to := Recipient{PeerID: b.CurrentHost().ID().String(), Addrs: b.CurrentHost().Addrs()}
+	if _, receipt, err := a.Deliver(ctx, to, AgentMessage{Type: "task", Payload: "hello"}); err != nil || receipt.Attempts != 1 {
+		t.Errorf("delivery: %v, receipt %+v, want a first dial to reach the peer", err, receipt)
+	}
+}
+
+func TestAgentCardA2AEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		card := NewAgentCard("12D3KooW", nil)
+		card.Services = append(card.Services, AgentCardService{Name: "a2a", Endpoint: "https://agent.example/a2a"})
+		json.NewEncoder(w).Encode(card)
+	}))
+	defer srv.Close()
+
+	card, err := FetchAgentCard(context.Background(), srv.URL+"/agent.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The p2p:// service is skipped
+	if got := card.A2AEndpoint(); got != "https://agent.example/a2a" {
+		t.Errorf("A2AEndpoint = %q", got)
+	}
+	if _, err := FetchAgentCard(context.Background(), "ipfs://bafy"); err == nil {
+		t.Error("fetched an ipfs:// card, want an unsupported URI error")
+	}
+}
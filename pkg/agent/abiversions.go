@@ -0,0 +1,318 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrABIDrift is reported for logs of a watched contract that match no
+// event of the ABI in force at their block: the contract was likely
+// upgraded behind its proxy to events the watcher doesn't know.
+var ErrABIDrift = errors.New("possible ABI drift")
+
+// ABIVersion is a contract's ABI from a block on, as deployed behind an
+// upgradeable proxy. It needs the contract's events; functions are ignored.
+type ABIVersion struct {
+	FromBlock uint64
+	ABI       abi.ABI
+}
+
+// ContractABIs lists the ABI versions of upgraded contracts, oldest first.
+// Blocks before a contract's first version, and contracts not listed, are
+// decoded with the built-in ABI.
+type ContractABIs map[common.Address][]ABIVersion
+
+// contractABIsFile is the layout of a -contract-abis file: ABI files, each
+// a JSON ABI or a build artifact holding one under "abi", by contract and
+// the block they take effect at. Paths are relative to the file.
+//
+//	contracts:
+//	  "0x0515...":
+//	    - fromBlock: 0
+//	      abi: market-v1.json
+//	    - fromBlock: 31000000
+//	      abi: market-v2.json
+type contractABIsFile struct {
+	Contracts map[string][]struct {
+		FromBlock uint64 `yaml:"fromBlock"`
+		ABI       string `yaml:"abi"`
+	} `yaml:"contracts"`
+}
+
+// LoadContractABIs reads the ABI versions in path.
+func LoadContractABIs(path string) (ContractABIs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f contractABIsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	abis := ContractABIs{}
+	for addr, versions := range f.Contracts {
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("%s: %q is not an address", path, addr)
+		}
+		contract := common.HexToAddress(addr)
+		for _, v := range versions {
+			file := v.ABI
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			parsed, err := readABI(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s from block %d: %w", path, addr, v.FromBlock, err)
+			}
+			abis[contract] = append(abis[contract], ABIVersion{FromBlock: v.FromBlock, ABI: parsed})
+		}
+		if err := abis.check(contract); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return abis, nil
+}
+
+// readABI parses the ABI in file, bare or in a Foundry or Hardhat artifact.
+func readABI(file string) (abi.ABI, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return abi.ABI{}, err
+	}
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		var artifact struct {
+			ABI json.RawMessage `json:"abi"`
+		}
+		if err := json.Unmarshal(data, &artifact); err != nil || artifact.ABI == nil {
+			return abi.ABI{}, fmt.Errorf("%s holds no abi", file)
+		}
+		data = artifact.ABI
+	}
+	parsed, err := abi.JSON(bytes.NewReader(data))
+	if err != nil {
+		return abi.ABI{}, err
+	}
+	if len(parsed.Events) == 0 {
+		return abi.ABI{}, fmt.Errorf("%s has no events", file)
+	}
+	return parsed, nil
+}
+
+// check sorts contract's versions and makes sure no two start at one block.
+func (c ContractABIs) check(contract common.Address) error {
+	versions := c[contract]
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].FromBlock < versions[j].FromBlock })
+	for i := 1; i < len(versions); i++ {
+		if versions[i].FromBlock == versions[i-1].FromBlock {
+			return fmt.Errorf("%s has two ABIs from block %d", contract.Hex(), versions[i].FromBlock)
+		}
+	}
+	return nil
+}
+
+// WithContractABIs makes the watcher decode the logs of the contracts in c
+// with the ABI in force at each log's block.
+func WithContractABIs(c ContractABIs) WatcherOption {
+	return func(w *EventWatcher) {
+		for contract := range c {
+			c.check(contract)
+		}
+		w.abis = c
+	}
+}
+
+// abiAt returns the ABI of contract at block: the newest of its versions
+// from that block or before, or base.
+func (w *EventWatcher) abiAt(contract common.Address, block uint64, base abi.ABI) abi.ABI {
+	versions := w.abis[contract]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].FromBlock <= block {
+			return versions[i].ABI
+		}
+	}
+	return base
+}
+
+// escrowABIAt and marketABIAt return the ABI vLog is decoded with, as an
+// escrow's or a market's log.
+func (w *EventWatcher) escrowABIAt(vLog types.Log) abi.ABI {
+	return w.abiAt(vLog.Address, vLog.BlockNumber, w.escrowABI)
+}
+
+func (w *EventWatcher) marketABIAt(vLog types.Log) abi.ABI {
+	return w.abiAt(vLog.Address, vLog.BlockNumber, w.marketABI)
+}
+
+// recognized reports whether vLog is an event of the ABI in force at its
+// block, if it comes from a watched escrow or market.
+func (w *EventWatcher) recognized(vLog types.Log) bool {
+	escrow, market := contractIndex(w.escrowAddrs, vLog.Address) >= 0, contractIndex(w.marketAddrs, vLog.Address) >= 0
+	if !escrow && !market {
+		return true
+	}
+	if len(vLog.Topics) == 0 {
+		return false
+	}
+	return escrow && hasEvent(w.escrowABIAt(vLog), vLog.Topics[0]) || market && hasEvent(w.marketABIAt(vLog), vLog.Topics[0])
+}
+
+func hasEvent(parsed abi.ABI, id common.Hash) bool {
+	_, err := parsed.EventByID(id)
+	return err == nil
+}
+
+// UndecodedLogs counts the logs of one watched contract the watcher
+// couldn't make out, which it would otherwise have dropped.
+type UndecodedLogs struct {
+	Contract  string   `json:"contract"`
+	Count     uint64   `json:"count"`
+	LastBlock uint64   `json:"lastBlock"`
+	Topics    []string `json:"topics"` // the unknown event signatures, as topic 0
+}
+
+// noteUndecoded counts vLog as undecoded, warning the first time a contract
+// sends a log with its signature.
+func (w *EventWatcher) noteUndecoded(vLog types.Log, why string) {
+	topic := "(anonymous)"
+	if len(vLog.Topics) > 0 {
+		topic = vLog.Topics[0].Hex()
+	}
+	w.driftMu.Lock()
+	if w.undecoded == nil {
+		w.undecoded = map[common.Address]*UndecodedLogs{}
+	}
+	u, ok := w.undecoded[vLog.Address]
+	if !ok {
+		u = &UndecodedLogs{Contract: vLog.Address.Hex()}
+		w.undecoded[vLog.Address] = u
+	}
+	u.Count++
+	if vLog.BlockNumber > u.LastBlock {
+		u.LastBlock = vLog.BlockNumber
+	}
+	first := !strings.Contains(strings.Join(u.Topics, ","), topic)
+	if first {
+		u.Topics = append(u.Topics, topic)
+	}
+	w.driftMu.Unlock()
+
+	if first {
+		err := fmt.Errorf("%w%s: log %s from %s in block %d %s", ErrABIDrift, w.chainLabel(), topic, vLog.Address.Hex(), vLog.BlockNumber, why)
+		fmt.Printf("[Watcher] %v\n", err)
+		w.reportError(err)
+	}
+}
+
+// UndecodedLogs returns, by contract, the logs of watched contracts the
+// watcher couldn't make out since it started.
+func (w *EventWatcher) UndecodedLogs() []UndecodedLogs {
+	w.driftMu.Lock()
+	defer w.driftMu.Unlock()
+	out := make([]UndecodedLogs, 0, len(w.undecoded))
+	for _, u := range w.undecoded {
+		c := *u
+		c.Topics = append([]string(nil), u.Topics...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Contract < out[j].Contract })
+	return out
+}
+
+// ABIAudit is what AuditABIs found in one watched contract's logs: how many
+// it had, and how many of the older and the newer half of the range matched
+// no event of the ABI in force.
+type ABIAudit struct {
+	Contract         string   `json:"contract"`
+	Kind             string   `json:"kind"` // escrow or market
+	Logs             uint64   `json:"logs"`
+	UndecodedEarlier uint64   `json:"undecodedEarlier"`
+	UndecodedRecent  uint64   `json:"undecodedRecent"`
+	Topics           []string `json:"topics,omitempty"` // the unknown event signatures
+}
+
+// AuditABIs reads the watched escrows' and markets' logs of the last blocks
+// blocks and counts those the watcher wouldn't make out, comparing the older
+// half of the range with the newer. Nothing is delivered.
+func (w *EventWatcher) AuditABIs(ctx context.Context, blocks uint64) ([]ABIAudit, error) {
+	header, err := w.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the head: %w", err)
+	}
+	to, from := header.Number.Uint64(), uint64(0)
+	if blocks > 0 && to >= blocks {
+		from = to - blocks + 1
+	}
+	audits := map[common.Address]*ABIAudit{}
+	var order []common.Address
+	for kind, addrs := range map[string][]common.Address{"escrow": w.escrowAddrs, "market": w.marketAddrs} {
+		for _, addr := range addrs {
+			if _, ok := audits[addr]; !ok {
+				audits[addr] = &ABIAudit{Contract: addr.Hex(), Kind: kind, Topics: []string{}}
+				order = append(order, addr)
+			}
+		}
+	}
+	middle := from + (to-from)/2
+	err = w.scanner.Scan(ctx, from, to, w.logRange, w.fetchLogs, func(_, _ uint64, logs []types.Log) error {
+		for _, vLog := range logs {
+			a, ok := audits[vLog.Address]
+			if !ok {
+				continue
+			}
+			a.Logs++
+			if w.recognized(vLog) && w.decodes(vLog) {
+				continue
+			}
+			if vLog.BlockNumber > middle {
+				a.UndecodedRecent++
+			} else {
+				a.UndecodedEarlier++
+			}
+			topic := "(anonymous)"
+			if len(vLog.Topics) > 0 {
+				topic = vLog.Topics[0].Hex()
+			}
+			if !strings.Contains(strings.Join(a.Topics, ","), topic) {
+				a.Topics = append(a.Topics, topic)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].Hex() < order[j].Hex() })
+	out := make([]ABIAudit, len(order))
+	for i, addr := range order {
+		out[i] = *audits[addr]
+	}
+	return out, nil
+}
+
+// decodes reports whether vLog, if it is an event the watcher acts on,
+// unpacks into its event.
+func (w *EventWatcher) decodes(vLog types.Log) bool {
+	if contractIndex(w.escrowAddrs, vLog.Address) >= 0 {
+		if parsed := w.escrowABIAt(vLog); vLog.Topics[0] == parsed.Events["TaskCreated"].ID {
+			return unpackLog(parsed, "TaskCreated", new(TaskCreatedEvent), vLog) == nil
+		}
+	}
+	if contractIndex(w.marketAddrs, vLog.Address) >= 0 {
+		if parsed := w.marketABIAt(vLog); vLog.Topics[0] == parsed.Events["KnowledgeRequested"].ID {
+			return unpackLog(parsed, "KnowledgeRequested", new(KnowledgeRequestedEvent), vLog) == nil
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const testMarketHex = "0x00000000000000000000000000000000000000e8"
+
+// marketV2ABI is the market after its upgrade at block 100: requests name a
+// deadline, which changes the event's signature.
+const marketV2ABI = `{"abi":[{"anonymous":false,"inputs":[{"indexed":true,"name":"requestId","type":"uint256"},{"indexed":true,"name":"requester","type":"address"},{"indexed":false,"name":"topic","type":"string"},{"indexed":true,"name":"topicHash","type":"bytes32"},{"indexed":false,"name":"bounty","type":"uint256"},{"indexed":false,"name":"deadline","type":"uint64"}],"name":"KnowledgeRequested","type":"event"}]}`
+
+// upgradedMarket writes a -contract-abis file for the upgrade and loads it.
+func upgradedMarket(t *testing.T) ContractABIs {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "market-v2.json"), []byte(marketV2ABI), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "abis.yaml")
+	config := "contracts:\n  \"" + testMarketHex + "\":\n    - fromBlock: 100\n      abi: market-v2.json\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	abis, err := LoadContractABIs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abis
+}
+
+// queryLog is a KnowledgeRequested log of parsed in block, with the
+// fields the event has of a request for topic.
+func queryLog(t *testing.T, parsed abi.ABI, id int64, topic string, block uint64) types.Log {
+	t.Helper()
+	event := parsed.Events["KnowledgeRequested"]
+	args := []interface{}{topic, big.NewInt(1000)}
+	if len(event.Inputs.NonIndexed()) == 3 {
+		args = append(args, uint64(1700000000))
+	}
+	data, err := event.Inputs.NonIndexed().Pack(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.Log{
+		Address:     common.HexToAddress(testMarketHex),
+		Topics:      []common.Hash{event.ID, common.BigToHash(big.NewInt(id)), common.HexToHash("0xc1"), crypto.Keccak256Hash([]byte(topic))},
+		Data:        data,
+		BlockNumber: block,
+	}
+}
+
+func TestWatcherDecodesEachABIEra(t *testing.T) {
+	abis := upgradedMarket(t)
+	var delivered []KnowledgeRequestedEvent
+	var reported []error
+	w, err := NewEventWatcher(newFakeRPC(t, (&fakeChain{head: 1}).handle), nil, []string{testMarketHex}, nil,
+		func(e KnowledgeRequestedEvent) { delivered = append(delivered, e) },
+		WithContractABIs(abis), WithErrorHandler(func(err error) { reported = append(reported, err) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, v2 := w.marketABI, abis[common.HexToAddress(testMarketHex)][0].ABI
+
+	// Each era's requests, on either side of the switch
+	logs := []types.Log{queryLog(t, v1, 1, "before", 99), queryLog(t, v2, 2, "after", 100)}
+	if err := w.processLogs(90, 110, logs); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("delivered %d requests, want both eras'", len(delivered))
+	}
+	for i, want := range []string{"before", "after"} {
+		if e := delivered[i]; e.RequestId.Int64() != int64(i+1) || e.Topic != want || e.Bounty.Int64() != 1000 || e.TopicHash != crypto.Keccak256Hash([]byte(want)) {
+			t.Errorf("request %d = %+v", i+1, e)
+		}
+	}
+	if got := w.UndecodedLogs(); len(got) != 0 {
+		t.Errorf("undecoded logs = %+v, want none", got)
+	}
+
+	// An era's event out of its era isn't known to the ABI in force
+	logs = []types.Log{queryLog(t, v2, 3, "early", 98), queryLog(t, v1, 4, "late", 101), queryLog(t, v1, 5, "late", 102)}
+	if err := w.processLogs(90, 110, logs); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 2 {
+		t.Errorf("delivered %d requests, want the out-of-era ones dropped", len(delivered))
+	}
+	got := w.UndecodedLogs()
+	if len(got) != 1 || got[0].Count != 3 || got[0].LastBlock != 102 || len(got[0].Topics) != 2 {
+		t.Fatalf("undecoded logs = %+v, want 3 with 2 signatures", got)
+	}
+	// Warned about once per signature
+	if len(reported) != 2 || !errors.Is(reported[0], ErrABIDrift) {
+		t.Errorf("reported %v, want ABI drift for each signature", reported)
+	}
+}
+
+func TestAuditABIsComparesRecentLogs(t *testing.T) {
+	abis := upgradedMarket(t)
+	chain := &fakeChain{head: 110}
+	w, err := NewEventWatcherWithHandlers(newFakeRPC(t, chain.handle), nil, []string{testMarketHex}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, v2 := w.marketABI, abis[common.HexToAddress(testMarketHex)][0].ABI
+	chain.logs = []types.Log{queryLog(t, v1, 1, "before", 95), queryLog(t, v2, 2, "after", 105)}
+
+	// Without the upgrade's ABI the newer half holds an unknown event
+	audits, err := w.AuditABIs(context.Background(), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 1 || audits[0].Logs != 2 || audits[0].UndecodedEarlier != 0 || audits[0].UndecodedRecent != 1 || audits[0].Kind != "market" {
+		t.Fatalf("audits = %+v, want one recent undecoded log", audits)
+	}
+	if topics := strings.Join(audits[0].Topics, ","); topics != v2.Events["KnowledgeRequested"].ID.Hex() {
+		t.Errorf("unknown events %s, want the v2 request", topics)
+	}
+
+	WithContractABIs(abis)(w)
+	if audits, err = w.AuditABIs(context.Background(), 20); err != nil || audits[0].UndecodedRecent != 0 {
+		t.Errorf("audits with both ABIs = %+v, %v", audits, err)
+	}
+}
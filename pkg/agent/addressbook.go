@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AddressBookEntry caches the identity resolution wallet -> agentId -> peerId,
+// and the HTTP endpoint of agents that publish one.
+// ScannedBlock is the last registry block searched for the wallet, so a
+// later lookup only needs to scan newer blocks. It never stands above a
+// block a reorg replaced: once the watcher sees one, RewindAddressScans
+// lowers it to the last block before the fork, so a registration mined
+// again in the new blocks is found by the next lookup.
+type AddressBookEntry struct {
+	Wallet       string `json:"wallet"`
+	AgentID      string `json:"agentId,omitempty"`
+	PeerID       string `json:"peerId,omitempty"`
+	Endpoint     string `json:"endpoint,omitempty"`
+	ScannedBlock uint64 `json:"scannedBlock"`
+	UpdatedAt    int64  `json:"updatedAt"`
+}
+
+func (s *sqlStore) SaveAddress(e AddressBookEntry) error {
+	if e.UpdatedAt == 0 {
+		e.UpdatedAt = time.Now().Unix()
+	}
+	_, err := s.exec(`
+		INSERT INTO address_book (wallet, agent_id, peer_id, endpoint, scanned_block, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(wallet) DO UPDATE SET agent_id = excluded.agent_id, peer_id = excluded.peer_id,
+			endpoint = excluded.endpoint, scanned_block = excluded.scanned_block, updated_at = excluded.updated_at`,
+		e.Wallet, e.AgentID, e.PeerID, e.Endpoint, int64(e.ScannedBlock), e.UpdatedAt)
+	return err
+}
+
+// LookupAddress returns the cached entry for a wallet, or nil if none exists.
+func (s *sqlStore) LookupAddress(wallet string) (*AddressBookEntry, error) {
+	var e AddressBookEntry
+	var scanned int64
+	err := s.queryRow("SELECT wallet, agent_id, peer_id, COALESCE(endpoint, ''), scanned_block, updated_at FROM address_book WHERE wallet = ?", wallet).
+		Scan(&e.Wallet, &e.AgentID, &e.PeerID, &e.Endpoint, &scanned, &e.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.ScannedBlock = uint64(scanned)
+	return &e, nil
+}
+
+// LookupPeerAddress returns the most recent entry that resolved to peerID, or
+// nil if none did.
+func (s *sqlStore) LookupPeerAddress(peerID string) (*AddressBookEntry, error) {
+	var e AddressBookEntry
+	var scanned int64
+	err := s.queryRow("SELECT wallet, agent_id, peer_id, COALESCE(endpoint, ''), scanned_block, updated_at FROM address_book WHERE peer_id = ? ORDER BY updated_at DESC LIMIT 1", peerID).
+		Scan(&e.Wallet, &e.AgentID, &e.PeerID, &e.Endpoint, &scanned, &e.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.ScannedBlock = uint64(scanned)
+	return &e, nil
+}
+
+// RewindAddressScans lowers every ScannedBlock above block to block, after a
+// reorg replaced the blocks after it, returning how many entries it moved.
+func (s *sqlStore) RewindAddressScans(block uint64) (int64, error) {
+	res, err := s.exec("UPDATE address_book SET scanned_block = ? WHERE scanned_block > ?", int64(block), int64(block))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) ListAddresses() ([]AddressBookEntry, error) {
+	rows, err := s.query("SELECT wallet, agent_id, peer_id, COALESCE(endpoint, ''), scanned_block, updated_at FROM address_book ORDER BY updated_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []AddressBookEntry
+	for rows.Next() {
+		var e AddressBookEntry
+		var scanned int64
+		if err := rows.Scan(&e.Wallet, &e.AgentID, &e.PeerID, &e.Endpoint, &scanned, &e.UpdatedAt); err == nil {
+			e.ScannedBlock = uint64(scanned)
+			results = append(results, e)
+		}
+	}
+	return results, rows.Err()
+}
+
+// RewindAddressBook is the ReorgHandler of the watcher of the chain whose
+// registry the address book caches: wallets scanned past ancestor are
+// scanned again from the block after it.
+func (n *AgentNode) RewindAddressBook(ancestor uint64) error {
+	moved, err := n.Store.RewindAddressScans(ancestor)
+	if err != nil {
+		return fmt.Errorf("failed to rewind the address book: %w", err)
+	}
+	if moved > 0 {
+		fmt.Printf("[Discovery] %d wallets will be scanned for again from block %d\n", moved, ancestor+1)
+	}
+	return nil
+}
@@ -0,0 +1,566 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Invocation outcomes.
+const (
+	InvocationOK      = "ok"
+	InvocationFailed  = "failed"
+	InvocationTimeout = "timeout"
+)
+
+const (
+	// DefaultSLOWindow is how far back a capability's SLO is measured.
+	DefaultSLOWindow = time.Hour
+	// DefaultSLOMinRuns is how many runs a window needs before its SLO is
+	// judged, so one slow run of a quiet capability isn't a breach.
+	DefaultSLOMinRuns = 10
+	// DefaultInvocationRetention is how long single invocations are kept
+	// once their day is rolled up.
+	DefaultInvocationRetention = 14 * 24 * time.Hour
+)
+
+// analyticsRollupInterval is how often finished days are rolled up.
+const analyticsRollupInterval = time.Hour
+
+// invocationSample is how many of a capability's latest successful runs
+// its estimate averages, within invocationSampleWindow.
+const (
+	invocationSample       = 20
+	invocationSampleWindow = 24 * time.Hour
+)
+
+// dayLayout names a UTC day in the analytics.
+const dayLayout = "2006-01-02"
+
+// CapabilityInvocation is one run of a capability's handler.
+type CapabilityInvocation struct {
+	TaskID       string `json:"taskId,omitempty"` // the task it served; empty for a re-execution
+	Capability   string `json:"capability"`
+	StartedAt    int64  `json:"startedAt"` // unix ms
+	DurationMs   int64  `json:"durationMs"`
+	InputBytes   int64  `json:"inputBytes"`
+	Outcome      string `json:"outcome"`                // InvocationOK, InvocationFailed or InvocationTimeout
+	Counterparty string `json:"counterparty,omitempty"` // the sender's peer ID
+	Revenue      string `json:"revenue,omitempty"`      // wei, once the task is settled
+}
+
+// CapabilityDay sums up one capability's invocations over a UTC day.
+type CapabilityDay struct {
+	Day            string `json:"day"` // YYYY-MM-DD
+	Capability     string `json:"capability"`
+	Invocations    int64  `json:"invocations"`
+	Failures       int64  `json:"failures"` // timeouts included
+	Timeouts       int64  `json:"timeouts"`
+	AvgMillis      int64  `json:"avgMillis"`
+	P95Millis      int64  `json:"p95Millis"`
+	InputBytes     int64  `json:"inputBytes"`
+	Revenue        string `json:"revenue"` // wei
+	Counterparties int64  `json:"counterparties"`
+}
+
+// SuccessRate is the share of the day's invocations that succeeded.
+func (d CapabilityDay) SuccessRate() float64 {
+	if d.Invocations == 0 {
+		return 0
+	}
+	return float64(d.Invocations-d.Failures) / float64(d.Invocations)
+}
+
+// CapabilitySLO is what a capability's runs should meet over a rolling
+// window, declared under slo: in its manifest entry:
+//
+//	slo: {p95: 2s, successRate: 0.99, window: 1h}
+type CapabilitySLO struct {
+	P95         time.Duration `yaml:"p95,omitempty" json:"p95,omitempty"`                 // most the 95th percentile run may take; 0 for no bound
+	SuccessRate float64       `yaml:"successRate,omitempty" json:"successRate,omitempty"` // least share of runs that succeed, from 0 to 1; 0 for no bound
+	Window      time.Duration `yaml:"window,omitempty" json:"window,omitempty"`           // 0 means DefaultSLOWindow
+	MinRuns     int           `yaml:"minRuns,omitempty" json:"minRuns,omitempty"`         // 0 means DefaultSLOMinRuns
+}
+
+func (s CapabilitySLO) validate() error {
+	switch {
+	case s.P95 < 0 || s.Window < 0 || s.MinRuns < 0:
+		return errors.New("p95, window and minRuns can't be negative")
+	case s.SuccessRate < 0 || s.SuccessRate > 1:
+		return fmt.Errorf("successRate %v is not between 0 and 1", s.SuccessRate)
+	case s.P95 == 0 && s.SuccessRate == 0:
+		return errors.New("sets neither p95 nor successRate")
+	}
+	return nil
+}
+
+func (s CapabilitySLO) window() time.Duration {
+	if s.Window <= 0 {
+		return DefaultSLOWindow
+	}
+	return s.Window
+}
+
+func (s CapabilitySLO) minRuns() int {
+	if s.MinRuns <= 0 {
+		return DefaultSLOMinRuns
+	}
+	return s.MinRuns
+}
+
+// SLO objectives a breach names.
+const (
+	ObjectiveP95         = "p95"
+	ObjectiveSuccessRate = "successRate"
+)
+
+// SLOBreach is a capability missing an objective of its SLO over its
+// window.
+type SLOBreach struct {
+	Capability string `json:"capability"`
+	Objective  string `json:"objective"` // ObjectiveP95 or ObjectiveSuccessRate
+	Want       string `json:"want"`      // e.g. "2s" or "99%"
+	Got        string `json:"got"`
+	Runs       int    `json:"runs"` // in the window
+	Window     string `json:"window"`
+	Since      int64  `json:"since"` // unix ms the breach was first seen
+}
+
+// CapabilityAnalytics records each run of the node's capability handlers
+// in the store, rolls them up by day, and watches each capability's SLO
+// over its rolling window, calling OnBreach as one starts or stops being
+// missed.
+type CapabilityAnalytics struct {
+	Retention time.Duration // how long invocations are kept; 0 means DefaultInvocationRetention
+	Clock     Clock         // nil means the SystemClock
+	// OnBreach is told of a breach when it starts, and again with
+	// recovered set once the objective is met
+	OnBreach func(b SLOBreach, recovered bool)
+
+	store    MetadataStore
+	mu       sync.Mutex
+	slos     map[string]CapabilitySLO
+	breaches map[string]SLOBreach // by capability and objective
+}
+
+// NewCapabilityAnalytics keeps analytics in store.
+func NewCapabilityAnalytics(store MetadataStore) *CapabilityAnalytics {
+	return &CapabilityAnalytics{store: store, slos: map[string]CapabilitySLO{}, breaches: map[string]SLOBreach{}}
+}
+
+func (a *CapabilityAnalytics) now() time.Time {
+	if a.Clock == nil {
+		return SystemClock.Now()
+	}
+	return a.Clock.Now()
+}
+
+func (a *CapabilityAnalytics) retention() time.Duration {
+	if a.Retention <= 0 {
+		return DefaultInvocationRetention
+	}
+	return a.Retention
+}
+
+// SetSLO holds capability to slo; nil drops its SLO, and any breach of it.
+func (a *CapabilityAnalytics) SetSLO(capability string, slo *CapabilitySLO) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if slo == nil {
+		delete(a.slos, capability)
+		for key, b := range a.breaches {
+			if b.Capability == capability {
+				delete(a.breaches, key)
+			}
+		}
+		return
+	}
+	a.slos[capability] = *slo
+}
+
+// Record saves inv and checks its capability's SLO. A nil analytics
+// records nothing.
+func (a *CapabilityAnalytics) Record(inv CapabilityInvocation) error {
+	if a == nil {
+		return nil
+	}
+	if err := a.store.RecordInvocation(inv); err != nil {
+		return err
+	}
+	return a.Check(inv.Capability)
+}
+
+// Check measures capability against its SLO over the window that ends now.
+func (a *CapabilityAnalytics) Check(capability string) error {
+	a.mu.Lock()
+	slo, ok := a.slos[capability]
+	a.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	now := a.now()
+	runs, err := a.store.ListInvocations(capability, now.Add(-slo.window()).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	var missed []SLOBreach
+	if len(runs) >= slo.minRuns() {
+		day := aggregateDay("", capability, runs)
+		if p95 := time.Duration(day.P95Millis) * time.Millisecond; slo.P95 > 0 && p95 > slo.P95 {
+			missed = append(missed, SLOBreach{Objective: ObjectiveP95, Want: slo.P95.String(), Got: p95.String()})
+		}
+		if rate := day.SuccessRate(); slo.SuccessRate > 0 && rate < slo.SuccessRate {
+			missed = append(missed, SLOBreach{Objective: ObjectiveSuccessRate, Want: percent(slo.SuccessRate), Got: percent(rate)})
+		}
+	}
+
+	var started, recovered []SLOBreach
+	a.mu.Lock()
+	seen := map[string]bool{}
+	for _, b := range missed {
+		key := capability + "/" + b.Objective
+		seen[key] = true
+		b.Capability, b.Runs, b.Window = capability, len(runs), slo.window().String()
+		if prev, ok := a.breaches[key]; ok {
+			b.Since = prev.Since
+		} else {
+			b.Since = now.UnixMilli()
+			started = append(started, b)
+		}
+		a.breaches[key] = b
+	}
+	for key, b := range a.breaches {
+		if b.Capability == capability && !seen[key] {
+			delete(a.breaches, key)
+			recovered = append(recovered, b)
+		}
+	}
+	a.mu.Unlock()
+
+	if a.OnBreach != nil {
+		for _, b := range started {
+			a.OnBreach(b, false)
+		}
+		for _, b := range recovered {
+			a.OnBreach(b, true)
+		}
+	}
+	return nil
+}
+
+func percent(rate float64) string {
+	return fmt.Sprintf("%.1f%%", rate*100)
+}
+
+// Breaches lists the SLOs being missed, by capability.
+func (a *CapabilityAnalytics) Breaches() []SLOBreach {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]SLOBreach, 0, len(a.breaches))
+	for _, b := range a.breaches {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Capability != out[j].Capability {
+			return out[i].Capability < out[j].Capability
+		}
+		return out[i].Objective < out[j].Objective
+	})
+	return out
+}
+
+// Settle credits revenue, in wei, to the invocations of taskID.
+func (a *CapabilityAnalytics) Settle(taskID string, revenue *big.Int) error {
+	if a == nil || revenue == nil {
+		return nil
+	}
+	return a.store.SettleInvocations(taskID, revenue.String())
+}
+
+// Estimate averages the latest successful runs of capability, and reports
+// false if it had none lately.
+func (a *CapabilityAnalytics) Estimate(capability string) (time.Duration, bool, error) {
+	now := a.now()
+	runs, err := a.store.ListInvocations(capability, now.Add(-invocationSampleWindow).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return 0, false, err
+	}
+	var total time.Duration
+	count := 0
+	// Newest first; failed runs may end early, and would make it look fast
+	for i := len(runs) - 1; i >= 0 && count < invocationSample; i-- {
+		if runs[i].Outcome == InvocationOK {
+			total += time.Duration(runs[i].DurationMs) * time.Millisecond
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false, nil
+	}
+	return total / time.Duration(count), true, nil
+}
+
+// Daily sums up each capability's invocations by UTC day, for the days
+// from and to fall on and those between, oldest first. Days rolled up are
+// read as saved; the rest are summed from their invocations.
+func (a *CapabilityAnalytics) Daily(from, to time.Time) ([]CapabilityDay, error) {
+	from, to = startOfDay(from), startOfDay(to).Add(24*time.Hour)
+	rolled, err := a.store.ListCapabilityDays(from.Format(dayLayout), to.Add(-time.Millisecond).Format(dayLayout))
+	if err != nil {
+		return nil, err
+	}
+	runs, err := a.store.ListInvocations("", from.UnixMilli(), to.UnixMilli()-1)
+	if err != nil {
+		return nil, err
+	}
+	days := map[[2]string]CapabilityDay{}
+	for _, d := range rolled {
+		days[[2]string{d.Day, d.Capability}] = d
+	}
+	for key, d := range aggregateDays(runs) {
+		if _, ok := days[key]; !ok {
+			days[key] = d
+		}
+	}
+	out := make([]CapabilityDay, 0, len(days))
+	for _, d := range days {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Day != out[j].Day {
+			return out[i].Day < out[j].Day
+		}
+		return out[i].Capability < out[j].Capability
+	})
+	return out, nil
+}
+
+// CapabilityStats is served by GET /capabilities/stats.
+type CapabilityStats struct {
+	Days     []CapabilityDay `json:"days"`
+	Breaches []SLOBreach     `json:"breaches,omitempty"`
+}
+
+// Stats sums up the last days UTC days, today included, with the SLOs
+// being missed.
+func (a *CapabilityAnalytics) Stats(days int) (CapabilityStats, error) {
+	now := a.now()
+	daily, err := a.Daily(now.AddDate(0, 0, 1-days), now)
+	if err != nil {
+		return CapabilityStats{}, err
+	}
+	return CapabilityStats{Days: daily, Breaches: a.Breaches()}, nil
+}
+
+// Rollup saves the sums of every finished day whose invocations are kept,
+// then drops the invocations past the retention period. Days are summed
+// again until their invocations are dropped, so revenue settled late is
+// counted.
+func (a *CapabilityAnalytics) Rollup() error {
+	now := a.now()
+	today := startOfDay(now)
+	cutoff := startOfDay(now.Add(-a.retention()))
+	runs, err := a.store.ListInvocations("", 0, today.UnixMilli()-1)
+	if err != nil {
+		return err
+	}
+	for _, d := range aggregateDays(runs) {
+		if err := a.store.SaveCapabilityDay(d); err != nil {
+			return err
+		}
+	}
+	return a.store.DeleteInvocationsBefore(cutoff.UnixMilli())
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// aggregateDays sums runs by day and capability.
+func aggregateDays(runs []CapabilityInvocation) map[[2]string]CapabilityDay {
+	grouped := map[[2]string][]CapabilityInvocation{}
+	for _, r := range runs {
+		key := [2]string{time.UnixMilli(r.StartedAt).UTC().Format(dayLayout), r.Capability}
+		grouped[key] = append(grouped[key], r)
+	}
+	days := make(map[[2]string]CapabilityDay, len(grouped))
+	for key, runs := range grouped {
+		days[key] = aggregateDay(key[0], key[1], runs)
+	}
+	return days
+}
+
+// aggregateDay sums runs, all of capability, as the day named.
+func aggregateDay(day, capability string, runs []CapabilityInvocation) CapabilityDay {
+	d := CapabilityDay{Day: day, Capability: capability, Invocations: int64(len(runs))}
+	revenue := new(big.Int)
+	durations := make([]int64, 0, len(runs))
+	counterparties := map[string]bool{}
+	var total int64
+	for _, r := range runs {
+		switch r.Outcome {
+		case InvocationTimeout:
+			d.Timeouts++
+			d.Failures++
+		case InvocationFailed:
+			d.Failures++
+		}
+		d.InputBytes += r.InputBytes
+		total += r.DurationMs
+		durations = append(durations, r.DurationMs)
+		if r.Counterparty != "" {
+			counterparties[r.Counterparty] = true
+		}
+		if amount, ok := new(big.Int).SetString(r.Revenue, 10); ok {
+			revenue.Add(revenue, amount)
+		}
+	}
+	d.Counterparties = int64(len(counterparties))
+	d.Revenue = revenue.String()
+	if len(runs) > 0 {
+		d.AvgMillis = total / int64(len(runs))
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		// Nearest rank: the smallest run at least 95% of runs don't exceed
+		d.P95Millis = durations[int(math.Ceil(0.95*float64(len(durations))))-1]
+	}
+	return d
+}
+
+// invocationOutcome classifies a handler's error.
+func invocationOutcome(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return InvocationOK
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return InvocationTimeout
+	}
+	return InvocationFailed
+}
+
+func (n *AgentNode) analyticsStep() BootStep {
+	return BootStep{Name: "analytics", After: []string{"store"}, Run: func(context.Context) error {
+		if n.Analytics == nil {
+			return nil
+		}
+		for _, def := range n.Capabilities() {
+			n.Analytics.SetSLO(def.Name, def.SLO)
+		}
+		if n.Analytics.OnBreach == nil {
+			n.Analytics.OnBreach = n.reportSLO
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			for {
+				if err := n.Analytics.Rollup(); err != nil {
+					fmt.Printf("[Analytics] Failed to roll up capability analytics: %v\n", err)
+				}
+				select {
+				case <-n.ctx.Done():
+					return
+				case <-time.After(analyticsRollupInterval):
+				}
+			}
+		}()
+		return nil
+	}}
+}
+
+// reportSLO logs an SLO breach, or its end, and adds it to the node's
+// events.
+func (n *AgentNode) reportSLO(b SLOBreach, recovered bool) {
+	data := map[string]string{"capability": b.Capability, "objective": b.Objective, "want": b.Want, "got": b.Got, "window": b.Window}
+	if recovered {
+		fmt.Printf("[Analytics] %s meets its %s SLO again\n", b.Capability, b.Objective)
+		n.Events.Add("slo_recovered", data)
+		return
+	}
+	fmt.Printf("[Analytics] %s misses its SLO: %s %s over the last %s, want %s\n", b.Capability, b.Objective, b.Got, b.Window, b.Want)
+	n.Events.Add("slo_breached", data)
+}
+
+// Store methods
+
+func (s *sqlStore) RecordInvocation(inv CapabilityInvocation) error {
+	_, err := s.exec(`
+		INSERT INTO capability_invocations (task_id, capability, started_at, duration_ms, input_bytes, outcome, counterparty, revenue)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		inv.TaskID, inv.Capability, inv.StartedAt, inv.DurationMs, inv.InputBytes, inv.Outcome, inv.Counterparty, inv.Revenue)
+	return err
+}
+
+// ListInvocations returns the invocations of capability, or of every
+// capability if it is empty, started from from to to (unix ms), oldest first.
+func (s *sqlStore) ListInvocations(capability string, from, to int64) ([]CapabilityInvocation, error) {
+	rows, err := s.query(`
+		SELECT task_id, capability, started_at, duration_ms, input_bytes, outcome, counterparty, revenue
+		FROM capability_invocations
+		WHERE (capability = ? OR ? = '') AND started_at >= ? AND started_at <= ?
+		ORDER BY started_at`, capability, capability, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []CapabilityInvocation
+	for rows.Next() {
+		var inv CapabilityInvocation
+		if err := rows.Scan(&inv.TaskID, &inv.Capability, &inv.StartedAt, &inv.DurationMs, &inv.InputBytes, &inv.Outcome, &inv.Counterparty, &inv.Revenue); err != nil {
+			return nil, err
+		}
+		out = append(out, inv)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) SettleInvocations(taskID, revenue string) error {
+	_, err := s.exec("UPDATE capability_invocations SET revenue = ? WHERE task_id = ? AND outcome = ?", revenue, taskID, InvocationOK)
+	return err
+}
+
+func (s *sqlStore) DeleteInvocationsBefore(before int64) error {
+	_, err := s.exec("DELETE FROM capability_invocations WHERE started_at < ?", before)
+	return err
+}
+
+func (s *sqlStore) SaveCapabilityDay(d CapabilityDay) error {
+	_, err := s.exec(`
+		INSERT INTO capability_days (day, capability, invocations, failures, timeouts, avg_ms, p95_ms, input_bytes, revenue, counterparties)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (day, capability) DO UPDATE SET
+			invocations = excluded.invocations, failures = excluded.failures, timeouts = excluded.timeouts,
+			avg_ms = excluded.avg_ms, p95_ms = excluded.p95_ms, input_bytes = excluded.input_bytes,
+			revenue = excluded.revenue, counterparties = excluded.counterparties`,
+		d.Day, d.Capability, d.Invocations, d.Failures, d.Timeouts, d.AvgMillis, d.P95Millis, d.InputBytes, d.Revenue, d.Counterparties)
+	return err
+}
+
+// ListCapabilityDays returns the days rolled up from from to to, both
+// YYYY-MM-DD and included.
+func (s *sqlStore) ListCapabilityDays(from, to string) ([]CapabilityDay, error) {
+	rows, err := s.query(`
+		SELECT day, capability, invocations, failures, timeouts, avg_ms, p95_ms, input_bytes, revenue, counterparties
+		FROM capability_days WHERE day >= ? AND day <= ? ORDER BY day, capability`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []CapabilityDay
+	for rows.Next() {
+		var d CapabilityDay
+		if err := rows.Scan(&d.Day, &d.Capability, &d.Invocations, &d.Failures, &d.Timeouts, &d.AvgMillis, &d.P95Millis, &d.InputBytes, &d.Revenue, &d.Counterparties); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
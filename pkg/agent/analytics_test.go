@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+)
+
+// invocationAt is a run of capability started at the time given.
+func invocationAt(capability, at string, took time.Duration, outcome, sender string) CapabilityInvocation {
+	started, _ := time.Parse(time.RFC3339Nano, at)
+	return CapabilityInvocation{Capability: capability, StartedAt: started.UnixMilli(), DurationMs: took.Milliseconds(), InputBytes: 100, Outcome: outcome, Counterparty: sender}
+}
+
+func TestCapabilityAnalyticsAggregatesByDay(t *testing.T) {
+	store := newTestStore(t)
+	clock := testutil.NewFakeClock(time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC))
+	a := NewCapabilityAnalytics(store)
+	a.Clock = clock
+
+	runs := []CapabilityInvocation{
+		invocationAt("summarize", "2023-11-12T23:59:59.999Z", time.Second, InvocationOK, "p1"), // before the window
+		invocationAt("summarize", "2023-11-13T00:00:00Z", 100*time.Millisecond, InvocationOK, "p1"),
+		invocationAt("summarize", "2023-11-13T12:00:00Z", 300*time.Millisecond, InvocationFailed, "p2"),
+		invocationAt("summarize", "2023-11-14T09:00:00Z", 200*time.Millisecond, InvocationOK, "p1"),
+		invocationAt("summarize", "2023-11-14T23:59:59.999Z", 30*time.Second, InvocationTimeout, "p3"),
+		invocationAt("translate", "2023-11-14T10:00:00Z", 50*time.Millisecond, InvocationOK, "p2"),
+	}
+	runs[3].TaskID = "task:42"
+	for _, r := range runs {
+		if err := store.RecordInvocation(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Settle("task:42", big.NewInt(5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		days, err := a.Daily(clock.Now().AddDate(0, 0, -1), clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []CapabilityDay{
+			{Day: "2023-11-13", Capability: "summarize", Invocations: 2, Failures: 1, AvgMillis: 200, P95Millis: 300, InputBytes: 200, Revenue: "0", Counterparties: 2},
+			{Day: "2023-11-14", Capability: "summarize", Invocations: 2, Failures: 1, Timeouts: 1, AvgMillis: 15100, P95Millis: 30000, InputBytes: 200, Revenue: "5000", Counterparties: 2},
+			{Day: "2023-11-14", Capability: "translate", Invocations: 1, AvgMillis: 50, P95Millis: 50, InputBytes: 100, Revenue: "0", Counterparties: 1},
+		}
+		if len(days) != len(want) {
+			t.Fatalf("%s: days = %+v", stage, days)
+		}
+		for i := range want {
+			if days[i] != want[i] {
+				t.Errorf("%s: day %d = %+v, want %+v", stage, i, days[i], want[i])
+			}
+		}
+	}
+	check("from invocations")
+
+	// Two days on, the days are rolled up and their invocations dropped
+	clock.Advance(48 * time.Hour)
+	a.Retention = time.Hour
+	if err := a.Rollup(); err != nil {
+		t.Fatal(err)
+	}
+	if left, err := store.ListInvocations("", 0, clock.Now().UnixMilli()); err != nil || len(left) != 0 {
+		t.Fatalf("invocations left after the rollup: %+v, %v", left, err)
+	}
+	clock.Advance(-48 * time.Hour)
+	check("rolled up")
+}
+
+func TestCapabilityAnalyticsDetectsSLOBreaches(t *testing.T) {
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	a := NewCapabilityAnalytics(newTestStore(t))
+	a.Clock = clock
+	a.SetSLO("summarize", &CapabilitySLO{P95: 100 * time.Millisecond, SuccessRate: 0.9, Window: time.Hour, MinRuns: 5})
+	var started, recovered []string
+	a.OnBreach = func(b SLOBreach, ok bool) {
+		if ok {
+			recovered = append(recovered, b.Objective)
+		} else {
+			started = append(started, b.Objective)
+		}
+	}
+	record := func(took time.Duration, outcome string) {
+		t.Helper()
+		clock.Advance(time.Minute)
+		inv := CapabilityInvocation{Capability: "summarize", StartedAt: clock.Now().UnixMilli(), DurationMs: took.Milliseconds(), Outcome: outcome}
+		if err := a.Record(inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Too few runs to judge
+	for range 4 {
+		record(500*time.Millisecond, InvocationOK)
+	}
+	if len(a.Breaches()) != 0 || len(started) != 0 {
+		t.Fatalf("breach with fewer runs than minRuns: %+v", a.Breaches())
+	}
+	record(500*time.Millisecond, InvocationOK)
+	if b := a.Breaches(); len(b) != 1 || b[0].Objective != ObjectiveP95 || b[0].Got != "500ms" || b[0].Want != "100ms" || b[0].Runs != 5 {
+		t.Fatalf("breaches = %+v, want p95", b)
+	}
+	since := a.Breaches()[0].Since
+
+	// Failures breach the success rate too; p95 is still the same breach
+	record(10*time.Millisecond, InvocationFailed)
+	b := a.Breaches()
+	if len(b) != 2 || b[1].Objective != ObjectiveSuccessRate || b[1].Got != "83.3%" || b[0].Since != since {
+		t.Fatalf("breaches = %+v, want p95 since %d and successRate", b, since)
+	}
+	if len(started) != 2 {
+		t.Errorf("breaches started = %v, want each once", started)
+	}
+
+	// Once the bad runs leave the window, fast runs meet both again
+	clock.Advance(time.Hour)
+	for range 5 {
+		record(20*time.Millisecond, InvocationOK)
+	}
+	if len(a.Breaches()) != 0 || len(recovered) != 2 {
+		t.Errorf("breaches = %+v, recovered %v; want both recovered", a.Breaches(), recovered)
+	}
+	// The estimate averages the successful runs of the day
+	if d, ok, err := a.Estimate("summarize"); err != nil || !ok || d != 260*time.Millisecond {
+		t.Errorf("estimate = %v, %v, %v; want 260ms", d, ok, err)
+	}
+}
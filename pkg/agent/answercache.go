@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+)
+
+// Defaults for an AnswerCache.
+const (
+	DefaultAnswerCacheTTL     = 15 * time.Minute
+	DefaultAnswerCacheEntries = 1000
+	DefaultAnswerCacheBytes   = 64 << 20
+)
+
+// CachedAnswer is a capability's answer to a query, kept so the same query
+// is answered again without running the handler.
+type CachedAnswer struct {
+	Capability string `json:"capability"`
+	QueryHash  string `json:"queryHash"`         // of the normalized payload; see QueryHash
+	Version    string `json:"version,omitempty"` // the capability's manifest version when cached
+	AnswerHash string `json:"answerHash"`        // SHA-256 of the answer's JSON, hex
+	URI        string `json:"uri"`               // where the content store keeps the answer
+	Size       int64  `json:"size"`              // bytes of the answer's JSON
+	CreatedAt  int64  `json:"createdAt"`         // unix ms
+	ExpiresAt  int64  `json:"expiresAt"`         // unix ms
+}
+
+// AnswerCache keeps capability answers, keyed by capability and the hash of
+// the normalized query, so repeated questions skip the handler. The answers
+// themselves live in a ContentStore under their hash, so identical answers
+// to different queries are stored once; the metadata store indexes them.
+//
+// Capabilities with noCache set in their manifest are never cached, and a
+// handler can keep one answer out with NoCache. An entry cached under
+// another manifest version of its capability is a miss, and is dropped.
+type AnswerCache struct {
+	TTL        time.Duration // how long an answer is served; DefaultAnswerCacheTTL if 0
+	MaxEntries int           // most answers kept; DefaultAnswerCacheEntries if 0
+	MaxBytes   int64         // most answer bytes kept; DefaultAnswerCacheBytes if 0
+	Clock      Clock         // nil means the SystemClock
+
+	store    MetadataStore
+	content  ContentStore
+	mu       sync.Mutex // serializes writes, so an answer isn't deleted as it is cached again
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	bypassed atomic.Uint64
+}
+
+// AnswerCacheStats counts the queries an AnswerCache was asked: those it
+// answered, those it had no answer to, and those whose requester asked for
+// a fresh answer. Capabilities with noCache aren't counted.
+type AnswerCacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Bypassed uint64 `json:"bypassed"`
+}
+
+// Stats returns the counts of the queries the cache was asked.
+func (c *AnswerCache) Stats() AnswerCacheStats {
+	if c == nil {
+		return AnswerCacheStats{}
+	}
+	return AnswerCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Bypassed: c.bypassed.Load()}
+}
+
+// NewAnswerCache indexes answers in store and keeps them in content.
+func NewAnswerCache(store MetadataStore, content ContentStore) *AnswerCache {
+	return &AnswerCache{store: store, content: content}
+}
+
+// QueryHash returns the cache key of a task payload: the SHA-256 of its
+// canonical JSON with every string trimmed, lowercased and its runs of
+// whitespace collapsed, so queries differing only in case or spacing share
+// an answer. Capabilities for which those differences matter should set
+// noCache.
+func QueryHash(payload map[string]interface{}) (string, error) {
+	data, err := canonical.Marshal(normalizeQuery(payload))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func normalizeQuery(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return strings.ToLower(strings.Join(strings.Fields(v), " "))
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = normalizeQuery(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = normalizeQuery(e)
+		}
+		return out
+	}
+	return v
+}
+
+type noCacheKey struct{}
+
+// NoCache keeps the answer of the task ctx belongs to out of the answer
+// cache. Handlers call it for answers that only hold right now, such as
+// ones from a partial result or a failed upstream.
+func NoCache(ctx context.Context) {
+	if flag, ok := ctx.Value(noCacheKey{}).(*atomic.Bool); ok {
+		flag.Store(true)
+	}
+}
+
+// AnswerSigner signs a capability's answer for the requester of req, such
+// as with a signature over the answer, req.ID and req.Sender. Handlers of
+// capabilities whose answers carry signatures bound to the request return
+// them unsigned: the answer is cached as the handler returned it, and each
+// one sent, from the cache or not, is signed for the requester it goes to.
+type AnswerSigner func(ctx context.Context, req TaskRequest, answer interface{}) (interface{}, error)
+
+type freshKey struct{}
+
+// WithoutAnswerCache returns a context whose tasks ask the peer for a fresh
+// answer, worked out by its handler rather than served from its
+// AnswerCache. The fresh answer replaces any the peer had cached.
+func WithoutAnswerCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshKey{}, true)
+}
+
+func wantsFreshAnswer(ctx context.Context) bool {
+	fresh, _ := ctx.Value(freshKey{}).(bool)
+	return fresh
+}
+
+// withNoCache returns a context NoCache can mark, and the mark.
+func withNoCache(ctx context.Context) (context.Context, *atomic.Bool) {
+	flag := new(atomic.Bool)
+	return context.WithValue(ctx, noCacheKey{}, flag), flag
+}
+
+func (c *AnswerCache) now() time.Time {
+	if c.Clock == nil {
+		return SystemClock.Now()
+	}
+	return c.Clock.Now()
+}
+
+// Lookup returns the cached answer of the capability def to the query hashed
+// to queryHash. A nil cache, or a capability with noCache, has none.
+func (c *AnswerCache) Lookup(ctx context.Context, def CapabilityDef, queryHash string) (interface{}, bool) {
+	if c == nil || def.NoCache {
+		return nil, false
+	}
+	answer, ok := c.lookup(ctx, def, queryHash)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return answer, ok
+}
+
+func (c *AnswerCache) lookup(ctx context.Context, def CapabilityDef, queryHash string) (interface{}, bool) {
+	e, err := c.store.GetCachedAnswer(def.Name, queryHash)
+	if err != nil || e == nil {
+		return nil, false
+	}
+	if e.Version != def.Version || c.now().UnixMilli() >= e.ExpiresAt {
+		c.drop(*e)
+		return nil, false
+	}
+	data, err := c.content.Get(ctx, e.URI)
+	if err != nil {
+		fmt.Printf("[Cache] Answer %s of %s is gone, recomputing: %v\n", e.AnswerHash, def.Name, err)
+		c.drop(*e)
+		return nil, false
+	}
+	var answer interface{}
+	if err := json.Unmarshal(data, &answer); err != nil {
+		c.drop(*e)
+		return nil, false
+	}
+	return answer, true
+}
+
+// bypass counts a query whose requester asked for a fresh answer.
+func (c *AnswerCache) bypass(def CapabilityDef) {
+	if c != nil && !def.NoCache {
+		c.bypassed.Add(1)
+	}
+}
+
+func (c *AnswerCache) drop(e CachedAnswer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove([]CachedAnswer{e})
+}
+
+// Store caches answer as the capability's answer to the query hashed to
+// queryHash, then drops expired answers and the oldest ones over the limits.
+func (c *AnswerCache) Store(ctx context.Context, def CapabilityDef, queryHash string, answer interface{}) error {
+	if c == nil || def.NoCache {
+		return nil
+	}
+	data, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > c.maxBytes() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uri, err := c.content.Put(ctx, data)
+	if err != nil {
+		return fmt.Errorf("failed to store answer: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	now := c.now()
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultAnswerCacheTTL
+	}
+	err = c.store.SaveCachedAnswer(CachedAnswer{
+		Capability: def.Name,
+		QueryHash:  queryHash,
+		Version:    def.Version,
+		AnswerHash: hex.EncodeToString(sum[:]),
+		URI:        uri,
+		Size:       int64(len(data)),
+		CreatedAt:  now.UnixMilli(),
+		ExpiresAt:  now.Add(ttl).UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.prune()
+}
+
+func (c *AnswerCache) maxBytes() int64 {
+	if c.MaxBytes <= 0 {
+		return DefaultAnswerCacheBytes
+	}
+	return c.MaxBytes
+}
+
+// prune drops expired answers, then the oldest until the rest fit the
+// limits. c.mu is held.
+func (c *AnswerCache) prune() error {
+	entries, err := c.store.ListCachedAnswers()
+	if err != nil {
+		return err
+	}
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultAnswerCacheEntries
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	// entries are oldest first
+	now := c.now().UnixMilli()
+	var drop []CachedAnswer
+	for _, e := range entries {
+		over := len(entries)-len(drop) > maxEntries || total > c.maxBytes()
+		if !over && now < e.ExpiresAt {
+			continue
+		}
+		drop = append(drop, e)
+		total -= e.Size
+	}
+	c.remove(drop)
+	return nil
+}
+
+// Invalidate drops every cached answer of capability, or of every
+// capability if it is empty, and reports how many there were.
+func (c *AnswerCache) Invalidate(capability string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.store.ListCachedAnswers()
+	if err != nil {
+		return 0, err
+	}
+	var drop []CachedAnswer
+	for _, e := range entries {
+		if capability == "" || e.Capability == capability {
+			drop = append(drop, e)
+		}
+	}
+	c.remove(drop)
+	return len(drop), nil
+}
+
+// contentDeleter is a ContentStore that can delete, like DirContentStore.
+type contentDeleter interface {
+	Delete(ctx context.Context, uri string) error
+}
+
+// remove deletes entries, and their answers once no entry left refers to
+// them. c.mu is held.
+func (c *AnswerCache) remove(entries []CachedAnswer) {
+	if len(entries) == 0 {
+		return
+	}
+	for _, e := range entries {
+		if err := c.store.DeleteCachedAnswer(e.Capability, e.QueryHash); err != nil {
+			fmt.Printf("[Cache] Failed to drop answer %s of %s: %v\n", e.AnswerHash, e.Capability, err)
+		}
+	}
+	deleter, ok := c.content.(contentDeleter)
+	if !ok {
+		return
+	}
+	left, err := c.store.ListCachedAnswers()
+	if err != nil {
+		return
+	}
+	kept := map[string]bool{}
+	for _, e := range left {
+		kept[e.URI] = true
+	}
+	for _, e := range entries {
+		if !kept[e.URI] {
+			kept[e.URI] = true
+			deleter.Delete(context.Background(), e.URI)
+		}
+	}
+}
+
+// SaveCachedAnswer stores a cached answer, replacing any for the same query.
+func (s *sqlStore) SaveCachedAnswer(a CachedAnswer) error {
+	_, err := s.exec(`
+		INSERT INTO answer_cache (capability, query_hash, version, answer_hash, uri, size, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(capability, query_hash) DO UPDATE SET
+			version = excluded.version, answer_hash = excluded.answer_hash, uri = excluded.uri,
+			size = excluded.size, created_at = excluded.created_at, expires_at = excluded.expires_at`,
+		a.Capability, a.QueryHash, a.Version, a.AnswerHash, a.URI, a.Size, a.CreatedAt, a.ExpiresAt)
+	return err
+}
+
+// GetCachedAnswer returns the cached answer of capability to a query, or nil
+// if there is none.
+func (s *sqlStore) GetCachedAnswer(capability, queryHash string) (*CachedAnswer, error) {
+	rows, err := s.query(`
+		SELECT capability, query_hash, version, answer_hash, uri, size, created_at, expires_at
+		FROM answer_cache WHERE capability = ? AND query_hash = ?`, capability, queryHash)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanCachedAnswers(rows)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[0], nil
+}
+
+// ListCachedAnswers returns every cached answer, oldest first.
+func (s *sqlStore) ListCachedAnswers() ([]CachedAnswer, error) {
+	rows, err := s.query(`
+		SELECT capability, query_hash, version, answer_hash, uri, size, created_at, expires_at
+		FROM answer_cache ORDER BY created_at, capability, query_hash`)
+	if err != nil {
+		return nil, err
+	}
+	return scanCachedAnswers(rows)
+}
+
+func (s *sqlStore) DeleteCachedAnswer(capability, queryHash string) error {
+	_, err := s.exec("DELETE FROM answer_cache WHERE capability = ? AND query_hash = ?", capability, queryHash)
+	return err
+}
+
+func scanCachedAnswers(rows *sql.Rows) ([]CachedAnswer, error) {
+	defer rows.Close()
+	var results []CachedAnswer
+	for rows.Next() {
+		var a CachedAnswer
+		if err := rows.Scan(&a.Capability, &a.QueryHash, &a.Version, &a.AnswerHash, &a.URI, &a.Size, &a.CreatedAt, &a.ExpiresAt); err != nil {
+			return nil, err
+		}
+		results = append(results, a)
+	}
+	return results, rows.Err()
+}
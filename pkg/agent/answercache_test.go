@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+)
+
+// lookupCalls counts how often test.lookup ran.
+var lookupCalls atomic.Int32
+
+func init() {
+	// test.lookup answers with the topic it was asked about, or, for a
+	// "volatile" topic, an answer it keeps out of the cache
+	RegisterHandler("test.lookup", func(ctx context.Context, req TaskRequest) (interface{}, error) {
+		lookupCalls.Add(1)
+		if req.Payload["topic"] == "volatile" {
+			NoCache(ctx)
+		}
+		return map[string]interface{}{"answer": "all about " + req.Payload["topic"].(string)}, nil
+	})
+}
+
+const lookupManifest = `
+version: 1
+capabilities:
+  - name: lookup
+    handler: test.lookup
+    version: "1"
+  - name: live
+    handler: test.lookup
+    noCache: true
+`
+
+// cachingNode returns a node serving lookupManifest with an answer cache on
+// clock, and the directory the answers are kept in.
+func cachingNode(t *testing.T, clock Clock) (*AgentNode, string) {
+	t.Helper()
+	n := startTestNode(t)
+	if err := n.LoadCapabilities([]string{writeManifest(t, lookupManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	n.Answers = NewAnswerCache(n.Store, DirContentStore{Dir: dir})
+	n.Answers.Clock = clock
+	return n, dir
+}
+
+// ask serves a lookup task and returns how many times the handler ran for it.
+func ask(t *testing.T, n *AgentNode, capability, topic string) int32 {
+	t.Helper()
+	b, ok := n.binding(capability)
+	if !ok {
+		t.Fatalf("no capability %s", capability)
+	}
+	before := lookupCalls.Load()
+	msg := AgentMessage{Type: "request", Sender: "requester", Payload: map[string]interface{}{"capability": capability, "topic": topic}}
+	resp := n.serveCapability(context.Background(), "task", b, msg)
+	if resp.Type != "response" {
+		t.Fatalf("%s %q: %+v", capability, topic, resp)
+	}
+	return lookupCalls.Load() - before
+}
+
+func TestAnswerCacheSkipsHandlerForTheSameQuery(t *testing.T) {
+	n, dir := cachingNode(t, nil)
+	if ask(t, n, "lookup", "Go generics") != 1 {
+		t.Fatal("the first request didn't run the handler")
+	}
+	if ask(t, n, "lookup", "  go   GENERICS ") != 0 {
+		t.Error("the same query, spaced and cased differently, ran the handler again")
+	}
+	if ask(t, n, "lookup", "Rust traits") != 1 {
+		t.Error("a different query was answered from the cache")
+	}
+
+	for _, topic := range []string{"volatile", "volatile"} {
+		if ask(t, n, "lookup", topic) != 1 {
+			t.Errorf("an answer the handler marked NoCache was reused")
+		}
+	}
+	for _, topic := range []string{"Go generics", "Go generics"} {
+		if ask(t, n, "live", topic) != 1 {
+			t.Errorf("a noCache capability's answer was reused")
+		}
+	}
+
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("%d answers stored, want the 2 cacheable ones", len(files))
+	}
+}
+
+func TestAnswerCacheRecomputesAfterTTL(t *testing.T) {
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	n, _ := cachingNode(t, clock)
+	n.Answers.TTL = time.Minute
+
+	ask(t, n, "lookup", "Go generics")
+	clock.Advance(time.Minute - time.Millisecond)
+	if ask(t, n, "lookup", "Go generics") != 0 {
+		t.Error("answer recomputed before its TTL")
+	}
+	clock.Advance(time.Millisecond)
+	if ask(t, n, "lookup", "Go generics") != 1 {
+		t.Error("answer reused after its TTL")
+	}
+}
+
+func TestAnswerCacheDropsAnswersOfAnotherManifestVersion(t *testing.T) {
+	n, _ := cachingNode(t, nil)
+	ask(t, n, "lookup", "Go generics")
+
+	b, _ := n.binding("lookup")
+	b.def.Version = "2"
+	n.bindings["lookup"] = b
+	if ask(t, n, "lookup", "Go generics") != 1 {
+		t.Error("an answer cached under version 1 was served for version 2")
+	}
+}
+
+func TestAnswerCacheSharesIdenticalAnswersAndHonoursLimits(t *testing.T) {
+	n, dir := cachingNode(t, nil)
+	n.Answers.MaxEntries = 2
+	def := CapabilityDef{Name: "lookup", Version: "1"}
+	ctx := context.Background()
+	for _, q := range []string{"a", "b", "c"} {
+		if err := n.Answers.Store(ctx, def, q, "same answer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, _ := n.Store.ListCachedAnswers()
+	if len(entries) != 2 || entries[0].QueryHash != "b" {
+		t.Errorf("entries = %+v, want the newest 2", entries)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files for one answer, want 1", len(files))
+	}
+
+	if removed, err := n.Answers.Invalidate("lookup"); err != nil || removed != 2 {
+		t.Errorf("Invalidate = %d, %v, want 2", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, entries[0].AnswerHash)); !os.IsNotExist(err) {
+		t.Errorf("answer file left after its entries were invalidated: %v", err)
+	}
+}
+
+func TestCachedAnswersAreSignedForEachRequester(t *testing.T) {
+	n, _ := cachingNode(t, nil)
+	n.SignAnswer = func(ctx context.Context, req TaskRequest, answer interface{}) (interface{}, error) {
+		return map[string]interface{}{"answer": answer, "for": req.Sender, "task": req.ID}, nil
+	}
+	a, c := startTestNode(t), startTestNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	before := lookupCalls.Load()
+	task := map[string]interface{}{"capability": "lookup", "topic": "Go generics"}
+	for i, requester := range []*AgentNode{a, c, a} {
+		askCtx := ctx
+		if i == 2 {
+			askCtx = WithoutAnswerCache(ctx)
+		}
+		resp, err := requester.SendTask(askCtx, dialAddr(n), task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, _ := resp.(map[string]interface{})
+		if id, _ := signed["task"].(string); signed["for"] != requester.CurrentHost().ID().String() || id == "" || signed["answer"] == nil {
+			t.Errorf("answer %d = %v, want it signed for its requester", i, resp)
+		}
+	}
+	if calls := lookupCalls.Load() - before; calls != 2 {
+		t.Errorf("handler ran %d times, want once, then for the fresh answer", calls)
+	}
+	if s := n.Answers.Stats(); s != (AnswerCacheStats{Hits: 1, Misses: 1, Bypassed: 1}) {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// Answers are cached unsigned
+	entries, _ := n.Store.ListCachedAnswers()
+	if len(entries) != 1 {
+		t.Fatalf("%d answers cached, want 1", len(entries))
+	}
+	b, _ := n.binding("lookup")
+	cached, _ := n.Answers.lookup(ctx, b.def, entries[0].QueryHash)
+	if _, signed := cached.(map[string]interface{})["for"]; signed {
+		t.Errorf("cached answer %v carries a requester's signature", cached)
+	}
+}
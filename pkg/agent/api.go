@@ -0,0 +1,495 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// DefaultAPIAddr is where the local control API listens unless configured otherwise.
+const DefaultAPIAddr = "127.0.0.1:7654"
+
+// NodeStatus is the snapshot served by GET /status.
+type NodeStatus struct {
+	PeerID         string        `json:"peerId"`
+	Addrs          []string      `json:"addrs"`
+	Transports     []string      `json:"transports,omitempty"` // tcp, quic, ws
+	ConnectedPeers int           `json:"connectedPeers"`
+	WatcherBlock   uint64        `json:"watcherBlock,omitempty"`
+	Leader         *LeaderStatus `json:"leader,omitempty"`
+	Wallet         string        `json:"wallet,omitempty"`
+	WalletName     string        `json:"walletName,omitempty"` // ENS or agent card name, if known
+	AgentID        string        `json:"agentId,omitempty"`    // the wallet's, once found
+	SchemaVersion  int           `json:"schemaVersion"`
+	StartedAt      int64         `json:"startedAt"`
+	// Degraded lists what the node is running without, such as "chain
+	// unavailable" while the RPC doesn't answer; empty when fully up
+	Degraded []string          `json:"degraded,omitempty"`
+	Startup  []ComponentTiming `json:"startup,omitempty"`
+	// Capital is what the bid budget has reserved and locked, with a
+	// CapitalTracker
+	Capital *CapitalStatus `json:"capital,omitempty"`
+	// UndecodedLogs counts the logs of watched contracts that matched no
+	// event of their ABI: a sign of an upgrade the watcher doesn't know
+	UndecodedLogs []UndecodedLogs `json:"undecodedLogs,omitempty"`
+	// Bootstraps is how each bootstrap peer fared at its last check
+	Bootstraps []BootstrapStatus `json:"bootstraps,omitempty"`
+	// SLOBreaches lists the capability SLOs being missed
+	SLOBreaches []SLOBreach `json:"sloBreaches,omitempty"`
+	// Watchers is how far each chain's watcher has come, and how its
+	// catch-up goes if it is behind
+	Watchers []WatcherProgress `json:"watchers,omitempty"`
+}
+
+// WalletInfo is served by GET /wallet.
+type WalletInfo struct {
+	Address string `json:"address"`
+	Balance string `json:"balance,omitempty"` // wei
+}
+
+// SelfReputation is served by GET /reputation/self: the on-chain feedback
+// summary of the node's own agent.
+type SelfReputation struct {
+	AgentID  string `json:"agentId"`
+	Tag1     string `json:"tag1,omitempty"`
+	Tag2     string `json:"tag2,omitempty"`
+	Count    uint64 `json:"count"`
+	Value    string `json:"value"` // fixed-point, with Decimals places
+	Decimals uint8  `json:"decimals"`
+}
+
+// Status returns a point-in-time view of the running node.
+func (n *AgentNode) Status() NodeStatus {
+	st := NodeStatus{StartedAt: n.startedAt.Unix()}
+	if h := n.CurrentHost(); h != nil {
+		st.PeerID = h.ID().String()
+		for _, a := range h.Addrs() {
+			st.Addrs = append(st.Addrs, a.String())
+		}
+		st.Transports = n.Transports()
+		st.ConnectedPeers = len(h.Network().Peers())
+	}
+	if n.Watcher != nil {
+		st.WatcherBlock = n.Watcher.LastBlock()
+	}
+	if n.Elector != nil {
+		ls := n.Elector.Status()
+		st.Leader = &ls
+	}
+	if n.Wallet != nil {
+		st.Wallet = n.Wallet.Address.Hex()
+		st.WalletName = n.Names.Names(context.Background(), st.Wallet)[st.Wallet]
+	}
+	if id, ok := n.AgentID(); ok {
+		st.AgentID = id.String()
+	}
+	st.SchemaVersion, _ = n.Store.SchemaVersion()
+	st.Degraded = n.boot.degraded()
+	st.Startup = n.boot.timings()
+	if n.Capital != nil {
+		cs := n.Capital.Snapshot()
+		st.Capital = &cs
+	}
+	st.Bootstraps = n.Bootstrap.Status()
+	st.SLOBreaches = n.Analytics.Breaches()
+	for _, w := range n.watchers() {
+		st.UndecodedLogs = append(st.UndecodedLogs, w.UndecodedLogs()...)
+		st.Watchers = append(st.Watchers, w.Progress())
+	}
+	return st
+}
+
+// ServeAPI starts the local HTTP control API on addr. It returns once the
+// listener is bound; requests are served in the background until Stop.
+func (n *AgentNode) ServeAPI(addr string) error {
+	if err := n.validateAPIAuth(addr); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to bind API listener: %w", err)
+	}
+	n.api = &http.Server{Handler: n.apiHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go n.api.Serve(ln)
+	return nil
+}
+
+// apiHandler routes the control API.
+func (n *AgentNode) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.Status())
+	})
+
+	// Liveness and readiness probes, e.g. for Kubernetes
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := n.Healthz(); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready := n.Readyz()
+		status := http.StatusOK
+		if !ready.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, ready)
+	})
+
+	mux.HandleFunc("GET /diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.Diagnostics(r.Context()))
+	})
+
+	mux.HandleFunc("GET /tasks", func(w http.ResponseWriter, r *http.Request) {
+		tasks, err := n.Tasks(0)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tasks)
+	})
+
+	mux.HandleFunc("GET /tasks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		n.serveTask(w, r.PathValue("id"))
+	})
+
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		peers, err := n.Peers()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, peers)
+	})
+
+	mux.HandleFunc("GET /peers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		p, err := n.Peer(r.PathValue("id"))
+		switch {
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		case p == nil:
+			writeError(w, http.StatusNotFound, fmt.Errorf("no record of peer %s", r.PathValue("id")))
+		default:
+			writeJSON(w, http.StatusOK, p)
+		}
+	})
+
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		var after uint64
+		if v := r.URL.Query().Get("after"); v != "" {
+			var err error
+			if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid after: %w", err))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, n.Events.Since(after))
+	})
+
+	mux.HandleFunc("GET /routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.Routes.Snapshot())
+	})
+
+	mux.HandleFunc("GET /state", func(w http.ResponseWriter, r *http.Request) {
+		snap, err := n.DumpState()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, snap)
+	})
+
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		records, err := n.Store.ListInteractions()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if records == nil {
+			records = []InteractionRecord{}
+		}
+		writeJSON(w, http.StatusOK, records)
+	})
+
+	mux.HandleFunc("GET /history/{id}", func(w http.ResponseWriter, r *http.Request) {
+		record, err := n.Store.GetInteraction(r.PathValue("id"))
+		switch {
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		case record == nil:
+			writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrNoInteraction, r.PathValue("id")))
+		default:
+			writeJSON(w, http.StatusOK, record)
+		}
+	})
+
+	// The local reputation ledger, decayed to the time of the request
+	mux.HandleFunc("GET /reputation", func(w http.ResponseWriter, r *http.Request) {
+		if n.Ledger == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("the reputation ledger is disabled"))
+			return
+		}
+		entries, err := n.Ledger.Export()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	})
+
+	mux.HandleFunc("GET /reputation/{agentId}", func(w http.ResponseWriter, r *http.Request) {
+		if n.Ledger == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("the reputation ledger is disabled"))
+			return
+		}
+		e, err := n.Ledger.Get(r.PathValue("agentId"))
+		switch {
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		case e == nil:
+			writeError(w, http.StatusNotFound, fmt.Errorf("no interactions with agent %s", r.PathValue("agentId")))
+		default:
+			writeJSON(w, http.StatusOK, e)
+		}
+	})
+
+	// The on-chain feedback summary of the node's own agent
+	mux.HandleFunc("GET /reputation/self", func(w http.ResponseWriter, r *http.Request) {
+		tag1, tag2 := r.URL.Query().Get("tag1"), r.URL.Query().Get("tag2")
+		summary, err := n.OwnReputation(tag1, tag2)
+		if errors.Is(err, ErrAgentUnknown) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		id, _ := n.AgentID()
+		rep := SelfReputation{AgentID: id.String(), Tag1: tag1, Tag2: tag2, Count: summary.Count, Value: "0", Decimals: summary.Decimals}
+		if summary.Value != nil {
+			rep.Value = summary.Value.String()
+		}
+		writeJSON(w, http.StatusOK, rep)
+	})
+
+	mux.HandleFunc("GET /capabilities", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.Capabilities())
+	})
+
+	// Each capability's runs by day, for the last ?days (7 by default)
+	mux.HandleFunc("GET /capabilities/stats", func(w http.ResponseWriter, r *http.Request) {
+		if n.Analytics == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("capability analytics are disabled"))
+			return
+		}
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			d, err := strconv.Atoi(v)
+			if err != nil || d < 1 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("days %q is not a positive number", v))
+				return
+			}
+			days = d
+		}
+		stats, err := n.Analytics.Stats(days)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	mux.HandleFunc("DELETE /answer-cache", func(w http.ResponseWriter, r *http.Request) {
+		if n.Answers == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("the answer cache is disabled"))
+			return
+		}
+		removed, err := n.Answers.Invalidate(r.URL.Query().Get("capability"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+	})
+
+	mux.HandleFunc("GET /agent-card", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.AgentCard())
+	})
+
+	mux.HandleFunc("GET /catalog", func(w http.ResponseWriter, r *http.Request) {
+		listings, err := n.Listings(r.URL.Query().Get("topic"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if listings == nil {
+			listings = []CatalogListing{}
+		}
+		writeJSON(w, http.StatusOK, listings)
+	})
+
+	mux.HandleFunc("POST /catalog", func(w http.ResponseWriter, r *http.Request) {
+		var spec ListingSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid listing: %w", err))
+			return
+		}
+		l, err := spec.Listing()
+		if err == nil {
+			err = n.AddListing(l)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+	})
+
+	mux.HandleFunc("DELETE /catalog/{id}", func(w http.ResponseWriter, r *http.Request) {
+		err := n.RemoveListing(r.PathValue("id"))
+		switch {
+		case errors.Is(err, ErrNoListing):
+			writeError(w, http.StatusNotFound, err)
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"id": r.PathValue("id"), "status": "removed"})
+		}
+	})
+
+	mux.HandleFunc("POST /peers/{id}/block", func(w http.ResponseWriter, r *http.Request) {
+		if err := n.BlockPeer(r.PathValue("id")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"peerId": r.PathValue("id"), "status": "blocked"})
+	})
+
+	mux.HandleFunc("POST /identity/rotate", func(w http.ResponseWriter, r *http.Request) {
+		// A dry run would rotate the key for real but only simulate publishing
+		// it, leaving the registry pointing at an ID that retires
+		if n.ERCClient != nil && n.ERCClient.DryRun() {
+			writeError(w, http.StatusConflict, fmt.Errorf("the node runs with -dry-run; rotate with 'agent keys rotate -dry-run' to simulate, or restart without it"))
+			return
+		}
+		grace := DefaultRotationGrace
+		if v := r.URL.Query().Get("grace"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid grace: %w", err))
+				return
+			}
+			grace = d
+		}
+		newKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		rot, err := n.RotateIdentity(newKey, grace)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		res := RotationResult{KeyRotation: *rot}
+		if n.ERCClient == nil || n.Wallet == nil {
+			res.PublishError = "no wallet or RPC configured; publish the new peerId with 'agent register'"
+		} else if agentId, err := n.ownAgentID(r.Context()); err != nil {
+			res.PublishError = err.Error()
+		} else if err := n.ERCClient.BindPeerID(n.Wallet, agentId, newKey); err != nil {
+			res.PublishError = err.Error()
+		} else {
+			res.AgentID = agentId.String()
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+
+	mux.HandleFunc("GET /wallet", func(w http.ResponseWriter, r *http.Request) {
+		if n.Wallet == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no wallet configured"))
+			return
+		}
+		info := WalletInfo{Address: n.Wallet.Address.Hex()}
+		if n.ERCClient != nil {
+			if bal, err := n.ERCClient.Balance(n.Wallet.Address); err == nil {
+				info.Balance = bal.String()
+			}
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	mux.HandleFunc("GET /wallet/budget", func(w http.ResponseWriter, r *http.Request) {
+		if n.Capital == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no bid budget configured"))
+			return
+		}
+		writeJSON(w, http.StatusOK, n.Capital.Snapshot())
+	})
+
+	if n.Metrics != nil {
+		mux.Handle("GET /metrics", n.Metrics.Handler())
+	}
+
+	n.handleV1(mux)
+	if n.APIAuth == APIAuthHMAC {
+		return n.requireSignature(guardWrites(mux))
+	}
+	return guardWrites(mux)
+}
+
+// serveTask answers with task id, or 404.
+func (n *AgentNode) serveTask(w http.ResponseWriter, id string) {
+	st, err := n.Task(id)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, fmt.Errorf("task not found"))
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// guardWrites refuses state-changing requests a web page could forge against
+// the local API: they must be JSON, which a cross-site form cannot send
+// without a CORS preflight we never answer, and must not come from another
+// origin.
+func guardWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+				writeError(w, http.StatusForbidden, fmt.Errorf("cross-origin request refused"))
+				return
+			}
+			if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("requests that change state must have Content-Type: application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
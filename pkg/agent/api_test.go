@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIRefusesForgeableWrites(t *testing.T) {
+	n := newTestNode(t)
+	handler := n.apiHandler()
+
+	tests := []struct {
+		name        string
+		contentType string
+		origin      string
+		want        int
+	}{
+		{"form post", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"no content type", "", "", http.StatusUnsupportedMediaType},
+		{"foreign origin", "application/json", "http://evil.example", http.StatusForbidden},
+		// Reaches the handler, which rejects the peer ID
+		{"json", "application/json", "", http.StatusBadRequest},
+		{"same origin", "application/json; charset=utf-8", "http://example.com", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/peers/not-a-peer/block", strings.NewReader("{}"))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	// Reads are not affected
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/healthz", nil))
+	if rec.Code == http.StatusUnsupportedMediaType || rec.Code == http.StatusForbidden {
+		t.Errorf("GET refused with %d", rec.Code)
+	}
+}
+
+func TestAPIRefusesRotationInDryRun(t *testing.T) {
+	n := newTestNode(t)
+	n.ERCClient = NewERC8004Client("http://127.0.0.1:1", zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	n.ERCClient.SetDryRun(true)
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	before := n.CurrentHost().ID()
+
+	req := httptest.NewRequest(http.MethodPost, "/identity/rotate", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	n.apiHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	if n.CurrentHost().ID() != before {
+		t.Error("identity rotated although the node runs in dry-run mode")
+	}
+}
+
+func TestAPIServesDiagnostics(t *testing.T) {
+	peer, n := connectedPair(t)
+	n.DiagnosticConfig = map[string]string{"api-token": "[redacted]"}
+	n.Events.Add("task.received", nil)
+	n.Events.AddError("task.failed", errors.New("handler crashed"), nil)
+
+	rec := httptest.NewRecorder()
+	n.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/diagnostics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var d Diagnostics
+	if err := json.Unmarshal(rec.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Running || d.Status.PeerID != n.CurrentHost().ID().String() || d.Config["api-token"] != "[redacted]" {
+		t.Errorf("diagnostics = %+v, want the running node's status and config", d)
+	}
+	if len(d.Peers) != 1 || d.Peers[0].PeerID != peer.CurrentHost().ID().String() || d.Peers[0].Direction != "Inbound" {
+		t.Errorf("peers = %+v, want the inbound connection from %s", d.Peers, peer.CurrentHost().ID())
+	}
+	if len(d.RecentErrors) != 1 || d.RecentErrors[0].Error != "handler crashed" {
+		t.Errorf("recent errors = %+v, want only the failure", d.RecentErrors)
+	}
+	if len(d.Caches) == 0 || d.Readiness == nil {
+		t.Errorf("diagnostics lack cache stats or readiness: %+v", d)
+	}
+}
+
+func TestAPIServesState(t *testing.T) {
+	peer, n := connectedPair(t)
+	pid := peer.CurrentHost().ID()
+	n.Routes.Add("summarize", pid)
+	if err := n.Store.SaveAddress(AddressBookEntry{Wallet: "0xabc", AgentID: "7", PeerID: pid.String(), ScannedBlock: 40}); err != nil {
+		t.Fatal(err)
+	}
+	url := newFakeRPC(t, (&fakeChain{head: 100, headTime: uint64(time.Now().Unix())}).handle)
+	w, err := NewEventWatcher(url, []string{zeroAddressHex}, nil, nil, nil, WithDeferredHead())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Store.SetCheckpoint("watcher", 42)
+	if err := w.UseCheckpoints(n.Store, "watcher"); err != nil {
+		t.Fatal(err)
+	}
+	n.Watcher = w
+
+	rec := httptest.NewRecorder()
+	n.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var s StateSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Routes) != 1 || s.Routes[0].Capability != "summarize" || s.Routes[0].Peers[0].PeerID != pid.String() {
+		t.Errorf("routes = %+v, want summarize served by %s", s.Routes, pid)
+	}
+	if len(s.AddressBook) != 1 || s.AddressBook[0].AgentID != "7" {
+		t.Errorf("address book = %+v, want agent 7", s.AddressBook)
+	}
+	if len(s.Reachability) != 1 || s.Reachability[0].PeerID != pid.String() || s.Reachability[0].Connectedness != "Connected" {
+		t.Errorf("reachability = %+v, want the connected peer", s.Reachability)
+	}
+	if len(s.Checkpoints) != 1 || s.Checkpoints[0].Name != "watcher" || s.Checkpoints[0].LastBlock != 42 || s.Checkpoints[0].Persisted != 42 {
+		t.Errorf("checkpoints = %+v, want the watcher at block 42", s.Checkpoints)
+	}
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Modes of HTTP API authentication.
+const (
+	APIAuthBearer = "bearer" // /v1 routes need APIToken as a bearer token; the rest are open, so it is served on loopback only
+	APIAuthHMAC   = "hmac"   // every route needs a request signed with APISecret
+	APIAuthNone   = "none"   // nothing is checked, /v1 routes included
+)
+
+// Headers of a signed API request.
+const (
+	HeaderAPITimestamp = "X-Agentmesh-Timestamp" // unix seconds the request was signed at
+	HeaderAPISignature = "X-Agentmesh-Signature" // hex HMAC-SHA256, see SignAPIRequest
+)
+
+// MaxAPIClockSkew is how far a signed request's timestamp may be from the
+// node's clock. Older requests are refused as stale.
+const MaxAPIClockSkew = 5 * time.Minute
+
+// unsignedRoutes stay open under APIAuthHMAC, for probes and scrapers that
+// can't sign.
+var unsignedRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// SignAPIRequest signs req, whose body is body, with secret at time at. The
+// signature covers the timestamp, method, path with query and a SHA-256 of
+// the body, so none can be changed without the node noticing.
+func SignAPIRequest(req *http.Request, body []byte, secret string, at time.Time) {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set(HeaderAPITimestamp, ts)
+	req.Header.Set(HeaderAPISignature, apiSignature(secret, ts, req.Method, req.URL.RequestURI(), body))
+}
+
+func apiSignature(secret, ts, method, uri string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x", ts, method, uri, sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateAPIAuth reports an auth configuration the API can't be served on
+// addr with. Bearer auth leaves the management routes, identity rotation
+// among them, open to whoever can connect, so it is refused beyond loopback.
+func (n *AgentNode) validateAPIAuth(addr string) error {
+	switch n.APIAuth {
+	case "", APIAuthBearer:
+		if !isLoopbackAddr(addr) {
+			return fmt.Errorf("bearer API auth leaves the management routes open, so it is served on loopback only; use hmac API auth to serve %s", addr)
+		}
+		return nil
+	case APIAuthNone:
+		return nil
+	case APIAuthHMAC:
+		if n.APISecret == "" {
+			return fmt.Errorf("hmac API auth needs a secret")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown API auth mode %q: want %s, %s or %s", n.APIAuth, APIAuthNone, APIAuthBearer, APIAuthHMAC)
+}
+
+// isLoopbackAddr reports whether addr, a host:port, only accepts connections
+// from this machine. An empty host listens on every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireSignature lets a request through only if it is signed with the
+// node's APISecret, recently, and wasn't seen before.
+func (n *AgentNode) requireSignature(next http.Handler) http.Handler {
+	seen := newSignatureCache()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unsignedRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ts, sig := r.Header.Get(HeaderAPITimestamp), r.Header.Get(HeaderAPISignature)
+		if ts == "" || sig == "" {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("request is not signed"))
+			return
+		}
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid %s", HeaderAPITimestamp))
+			return
+		}
+		now := time.Now()
+		signedAt := time.Unix(unix, 0)
+		if skew := now.Sub(signedAt); skew > MaxAPIClockSkew || skew < -MaxAPIClockSkew {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("stale request: signed at %s", signedAt.UTC().Format(time.RFC3339)))
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxContentSize+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(body) > maxContentSize {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body over %d bytes", maxContentSize))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		want := apiSignature(n.APISecret, ts, r.Method, r.URL.RequestURI(), body)
+		if !hmac.Equal([]byte(sig), []byte(want)) {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("wrong signature"))
+			return
+		}
+		// A signature is good for one request; it needn't be remembered past
+		// the point its timestamp goes stale
+		if !seen.add(sig, signedAt.Add(MaxAPIClockSkew), now) {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("replayed request"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signatureCache remembers the signatures of accepted requests until they
+// go stale.
+type signatureCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newSignatureCache() *signatureCache {
+	return &signatureCache{expires: map[string]time.Time{}}
+}
+
+// add records sig until expiry, and reports false if it was already there.
+func (c *signatureCache) add(sig string, expiry, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for s, e := range c.expires {
+		if now.After(e) {
+			delete(c.expires, s)
+		}
+	}
+	if _, ok := c.expires[sig]; ok {
+		return false
+	}
+	c.expires[sig] = expiry
+	return true
+}
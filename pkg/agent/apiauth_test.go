@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthRejectsUnsignedStaleReplayedAndTamperedRequests(t *testing.T) {
+	const secret = "shared-secret"
+	_, srv := newV1Node(t, func(n *AgentNode) {
+		n.APIAuth, n.APISecret = APIAuthHMAC, secret
+	})
+	send := func(req *http.Request) int {
+		t.Helper()
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	signed := func(method, path, body string, at time.Time) *http.Request {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		SignAPIRequest(req, []byte(body), secret, at)
+		return req
+	}
+
+	// Management routes need a signature too; health probes don't
+	unsigned, _ := http.NewRequest(http.MethodGet, srv.URL+"/status", nil)
+	if got := send(unsigned); got != http.StatusUnauthorized {
+		t.Errorf("unsigned GET /status: %d, want 401", got)
+	}
+	probe, _ := http.NewRequest(http.MethodGet, srv.URL+"/healthz", nil)
+	if got := send(probe); got == http.StatusUnauthorized {
+		t.Error("GET /healthz needs a signature")
+	}
+	if got := send(signed(http.MethodGet, "/status", "", time.Now())); got != http.StatusOK {
+		t.Errorf("signed GET /status: %d, want 200", got)
+	}
+
+	// A signed /v1 request needs no bearer token
+	body := `{"capability":"summarize","payload":{"text":"hello"}}`
+	req := signed(http.MethodPost, "/v1/tasks", body, time.Now())
+	replay := req.Clone(req.Context())
+	replay.Body, _ = req.GetBody()
+	if got := send(req); got != http.StatusAccepted {
+		t.Fatalf("signed POST /v1/tasks: %d, want 202", got)
+	}
+	if got := send(replay); got != http.StatusUnauthorized {
+		t.Errorf("replayed request: %d, want 401", got)
+	}
+
+	tampered := signed(http.MethodPost, "/v1/tasks", body, time.Now())
+	tampered.Body = io.NopCloser(strings.NewReader(strings.Replace(body, "hello", "h3llo", 1)))
+	if got := send(tampered); got != http.StatusUnauthorized {
+		t.Errorf("tampered body: %d, want 401", got)
+	}
+	if got := send(signed(http.MethodGet, "/status", "", time.Now().Add(-MaxAPIClockSkew-time.Minute))); got != http.StatusUnauthorized {
+		t.Errorf("stale request: %d, want 401", got)
+	}
+	wrong := signed(http.MethodGet, "/status", "", time.Now())
+	SignAPIRequest(wrong, nil, "guess", time.Now())
+	if got := send(wrong); got != http.StatusUnauthorized {
+		t.Errorf("request signed with the wrong secret: %d, want 401", got)
+	}
+}
+
+func TestBearerAuthIsServedOnLoopbackOnly(t *testing.T) {
+	for _, tc := range []struct {
+		auth, addr string
+		ok         bool
+	}{
+		{APIAuthBearer, DefaultAPIAddr, true},
+		{APIAuthBearer, "localhost:7654", true},
+		{APIAuthBearer, "[::1]:7654", true},
+		{"", "127.0.0.1:0", true},
+		// The management routes would be open to the network
+		{APIAuthBearer, "0.0.0.0:7654", false},
+		{APIAuthBearer, ":7654", false},
+		{"", "192.168.1.10:7654", false},
+		// Signed or explicitly unauthenticated APIs may be served anywhere
+		{APIAuthHMAC, "0.0.0.0:7654", true},
+		{APIAuthNone, "0.0.0.0:7654", true},
+	} {
+		n := &AgentNode{APIAuth: tc.auth, APISecret: "shared-secret"}
+		if err := n.validateAPIAuth(tc.addr); (err == nil) != tc.ok {
+			t.Errorf("%q auth on %s: %v, want ok %v", tc.auth, tc.addr, err, tc.ok)
+		}
+	}
+}
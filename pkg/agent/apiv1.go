@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sseKeepAlive is how often an idle /v1/events stream sends a comment, so
+// proxies don't time it out.
+const sseKeepAlive = 15 * time.Second
+
+// KnowledgeRequestSpec is the body of POST /v1/knowledge/requests.
+type KnowledgeRequestSpec struct {
+	Topic  string `json:"topic"`
+	Bounty string `json:"bounty,omitempty"` // wei
+}
+
+// KnowledgeRequestResult answers POST /v1/knowledge/requests. In dry-run
+// mode the request is only simulated and has no ID.
+type KnowledgeRequestResult struct {
+	RequestID string `json:"requestId,omitempty"`
+	TaskID    string `json:"taskId,omitempty"`
+	Topic     string `json:"topic"`
+	Bounty    string `json:"bounty"`
+	DryRun    bool   `json:"dryRun,omitempty"`
+}
+
+// knowledgeRequestSchema is the contract for KnowledgeRequestSpec bodies,
+// checked like a capability payload.
+var knowledgeRequestSchema = mustCompileSchema(`
+type: object
+required: [topic]
+additionalProperties: false
+properties:
+  topic: {type: string, minLength: 1, maxLength: 256}
+  bounty: {type: string, pattern: "^[0-9]+$"}
+`)
+
+func mustCompileSchema(src string) *taskSchema {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(src), &doc); err != nil {
+		panic(err)
+	}
+	s, err := compileSchema(doc.Content[0])
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// handleV1 adds the /v1 API, which lets local tools submit work to the node.
+// Every route needs the bearer token set in APIToken, unless APIAuth says
+// otherwise.
+func (n *AgentNode) handleV1(mux *http.ServeMux) {
+	mux.Handle("POST /v1/tasks", n.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		var spec TaskSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid task: %w", err))
+			return
+		}
+		record, err := n.SubmitTask(spec)
+		switch {
+		case errors.Is(err, ErrQueueFull):
+			writeError(w, http.StatusServiceUnavailable, err)
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err)
+		default:
+			writeJSON(w, http.StatusAccepted, LocalTaskStatus{TaskRecord: record})
+		}
+	}))
+
+	mux.Handle("GET /v1/tasks/{id}", n.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		n.serveTask(w, r.PathValue("id"))
+	}))
+
+	mux.Handle("DELETE /v1/tasks/{id}", n.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		err := n.DeleteTask(r.PathValue("id"))
+		switch {
+		case errors.Is(err, ErrNotFound):
+			writeError(w, http.StatusNotFound, fmt.Errorf("task not found"))
+		case errors.Is(err, ErrTaskRunning):
+			writeError(w, http.StatusConflict, err)
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	// The body is a capability manifest; JSON is valid YAML, so the manifest
+	// format applies unchanged
+	mux.Handle("POST /v1/capabilities", n.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxContentSize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		defs, err := n.AddCapabilities(data)
+		switch {
+		case errors.Is(err, ErrCapabilityExists):
+			writeError(w, http.StatusConflict, err)
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err)
+		default:
+			writeJSON(w, http.StatusCreated, defs)
+		}
+	}))
+
+	mux.Handle("POST /v1/knowledge/requests", n.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid knowledge request: %w", err))
+			return
+		}
+		if err := knowledgeRequestSchema.validate(body, "body"); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		spec := KnowledgeRequestSpec{Topic: body["topic"].(string), Bounty: "0"}
+		if b, ok := body["bounty"].(string); ok {
+			spec.Bounty = b
+		}
+		bounty, _ := new(big.Int).SetString(spec.Bounty, 10)
+
+		if n.Market == nil || n.Wallet == nil {
+			writeError(w, http.StatusConflict, fmt.Errorf("no wallet or RPC configured; knowledge requests need both"))
+			return
+		}
+		res := KnowledgeRequestResult{Topic: spec.Topic, Bounty: bounty.String()}
+		id, err := n.Market.RequestKnowledge(n.Wallet, spec.Topic, bounty)
+		switch {
+		case errors.Is(err, ErrDryRun):
+			res.DryRun = true
+			writeJSON(w, http.StatusOK, res)
+		case err != nil:
+			writeError(w, http.StatusBadGateway, err)
+		default:
+			res.RequestID = id.String()
+			res.TaskID = fmt.Sprintf("%s:%s", TaskKindKnowledge, id)
+			n.Events.Add("knowledge_request_sent", res)
+			writeJSON(w, http.StatusCreated, res)
+		}
+	}))
+
+	mux.Handle("GET /v1/events", n.requireToken(n.streamEvents))
+}
+
+// requireToken lets a request through only with the node's bearer token. An
+// empty APIToken disables the routes rather than leaving them open. Under
+// APIAuthHMAC the request was already checked for a signature, and under
+// APIAuthNone nothing is checked.
+func (n *AgentNode) requireToken(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.APIAuth == APIAuthHMAC || n.APIAuth == APIAuthNone {
+			next(w, r)
+			return
+		}
+		if n.APIToken == "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("the /v1 API is disabled; start the node with -api-token"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(n.APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="agentmesh"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or wrong bearer token"))
+			return
+		}
+		next(w, r)
+	})
+}
+
+// streamEvents serves the event log as server-sent events. A client resumes
+// where it left off with the Last-Event-ID header, or ?after=seq.
+func (n *AgentNode) streamEvents(w http.ResponseWriter, r *http.Request) {
+	after := r.Header.Get("Last-Event-ID")
+	if v := r.URL.Query().Get("after"); v != "" {
+		after = v
+	}
+	var last uint64
+	if after != "" {
+		var err error
+		if last, err = strconv.ParseUint(after, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid after: %w", err))
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+		return
+	}
+
+	// Subscribe before reading the backlog, so no event falls in between
+	events, unsubscribe := n.Events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e NodeEvent) error {
+		if e.Seq <= last {
+			return nil
+		}
+		last = e.Seq
+		raw, _ := json.Marshal(e)
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Kind, raw)
+		return err
+	}
+	for _, e := range n.Events.Since(last) {
+		if send(e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-n.ctx.Done():
+			return
+		case e := <-events:
+			if send(e) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIToken = "s3cret"
+
+// v1Request sends a /v1 request with token, if set, and decodes the JSON
+// answer into out, if given. It returns the status code.
+func v1Request(t *testing.T, srv *httptest.Server, method, path, token, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding answer: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// newV1Node serves the API of a node with the summarize manifest loaded.
+// setup, if given, configures the node before the server starts.
+func newV1Node(t *testing.T, setup func(n *AgentNode)) (*AgentNode, *httptest.Server) {
+	t.Helper()
+	n := newTestNode(t)
+	n.APIToken = testAPIToken
+	n.ResultsDir = t.TempDir()
+	if err := n.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(n)
+	}
+	srv := httptest.NewServer(n.apiHandler())
+	t.Cleanup(srv.Close)
+	return n, srv
+}
+
+func TestV1RequiresToken(t *testing.T) {
+	_, srv := newV1Node(t, nil)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "guess", http.StatusUnauthorized},
+		{"right token", testAPIToken, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := v1Request(t, srv, http.MethodGet, "/v1/tasks/local:0", tt.token, "", nil); got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Without a configured token the routes are off, not open
+	_, off := newV1Node(t, func(n *AgentNode) { n.APIToken = "" })
+	if got := v1Request(t, off, http.MethodGet, "/v1/tasks/local:0", "", "", nil); got != http.StatusForbidden {
+		t.Errorf("status %d with no token configured, want %d", got, http.StatusForbidden)
+	}
+}
+
+// sseEvents reads a server-sent event stream into a channel of events.
+func sseEvents(t *testing.T, srv *httptest.Server, path string) <-chan NodeEvent {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIToken)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the stream ends the handler, which the server waits for
+	t.Cleanup(func() { resp.Body.Close() })
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("events answered %d %s", resp.StatusCode, ct)
+	}
+
+	events := make(chan NodeEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var e NodeEvent
+				if json.Unmarshal([]byte(data), &e) == nil {
+					events <- e
+				}
+			}
+		}
+	}()
+	return events
+}
+
+func TestV1RunsLocalTask(t *testing.T) {
+	_, srv := newV1Node(t, nil)
+	events := sseEvents(t, srv, "/v1/events")
+
+	// Payloads are checked against the capability schema before queueing
+	if got := v1Request(t, srv, http.MethodPost, "/v1/tasks", testAPIToken, `{"capability":"summarize","payload":{"text":""}}`, nil); got != http.StatusBadRequest {
+		t.Errorf("invalid payload answered %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := v1Request(t, srv, http.MethodPost, "/v1/tasks", testAPIToken, `{"capability":"translate","payload":{}}`, nil); got != http.StatusBadRequest {
+		t.Errorf("unknown capability answered %d, want %d", got, http.StatusBadRequest)
+	}
+
+	var submitted LocalTaskStatus
+	if got := v1Request(t, srv, http.MethodPost, "/v1/tasks", testAPIToken, `{"capability":"summarize","payload":{"text":"hello","style":"short"}}`, &submitted); got != http.StatusAccepted {
+		t.Fatalf("submit answered %d, want %d", got, http.StatusAccepted)
+	}
+	if !strings.HasPrefix(submitted.ID, TaskKindLocal+":") || submitted.Status != TaskStatusReceived {
+		t.Fatalf("submitted task = %+v", submitted)
+	}
+
+	var st LocalTaskStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got := v1Request(t, srv, http.MethodGet, "/v1/tasks/"+submitted.ID, testAPIToken, "", &st); got != http.StatusOK {
+			t.Fatalf("status answered %d", got)
+		}
+		if st.Status != TaskStatusReceived || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if st.Status != TaskStatusResolved || st.Result == "" {
+		t.Fatalf("task = %+v, want resolved with a result", st)
+	}
+	raw, err := os.ReadFile(st.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]string
+	if err := json.Unmarshal(raw, &result); err != nil || result["text"] != "hello" || result["style"] != "short" {
+		t.Errorf("result file = %s (%v), want the echoed payload", raw, err)
+	}
+
+	// The event stream saw the task go through
+	var kinds, stages []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("event stream ended after %v", kinds)
+			}
+			if e.Kind == "lifecycle" {
+				stages = append(stages, e.Data.(map[string]interface{})["stage"].(string))
+				continue
+			}
+			kinds = append(kinds, e.Kind)
+			if e.Kind != "local_task_resolved" {
+				continue
+			}
+			if data, _ := e.Data.(map[string]interface{}); data["taskId"] != submitted.ID {
+				t.Errorf("local_task_resolved for %v, want %s", e.Data, submitted.ID)
+			}
+			if kinds[0] != "local_task_submitted" {
+				t.Errorf("events %v, want local_task_submitted first", kinds)
+			}
+			if got := strings.Join(stages, ","); got != "received,validated,dispatched,completed" {
+				t.Errorf("lifecycle stages %s, want received to completed", got)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("no local_task_resolved event, got %v", kinds)
+		}
+	}
+}
+
+func TestV1EventsResumeAfter(t *testing.T) {
+	n, srv := newV1Node(t, nil)
+	n.Events.Add("first", nil)
+	second := n.Events.Add("second", nil)
+	n.Events.Add("third", nil)
+
+	events := sseEvents(t, srv, "/v1/events?after="+strconv.FormatUint(second.Seq, 10))
+	select {
+	case e := <-events:
+		if e.Kind != "third" {
+			t.Errorf("first streamed event %q, want third", e.Kind)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backlog not streamed")
+	}
+}
+
+func TestV1KnowledgeRequest(t *testing.T) {
+	_, unconfigured := newV1Node(t, nil)
+	var answer map[string]string
+	if got := v1Request(t, unconfigured, http.MethodPost, "/v1/knowledge/requests", testAPIToken, `{"topic":"rust"}`, &answer); got != http.StatusConflict {
+		t.Errorf("without a wallet answered %d, want %d: %v", got, http.StatusConflict, answer)
+	}
+
+	c, backend := newEscrowChain(t, "")
+	c.SetDryRun(true)
+	wallet := newTestWallet(t)
+	_, srv := newV1Node(t, func(n *AgentNode) {
+		n.Market = NewKnowledgeMarket(c, "0x00000000000000000000000000000000000000e6")
+		n.Wallet = wallet
+	})
+
+	for _, body := range []string{`{"topic":""}`, `{"topic":"rust","bounty":"-1"}`, `{"topic":"rust","reward":"1"}`, `null`} {
+		if got := v1Request(t, srv, http.MethodPost, "/v1/knowledge/requests", testAPIToken, body, nil); got != http.StatusBadRequest {
+			t.Errorf("%s answered %d, want %d", body, got, http.StatusBadRequest)
+		}
+	}
+
+	var res KnowledgeRequestResult
+	if got := v1Request(t, srv, http.MethodPost, "/v1/knowledge/requests", testAPIToken, `{"topic":"rust","bounty":"500"}`, &res); got != http.StatusOK {
+		t.Fatalf("dry-run request answered %d", got)
+	}
+	if !res.DryRun || res.RequestID != "" || res.Bounty != "500" {
+		t.Errorf("answer = %+v, want a dry run for 500 wei", res)
+	}
+	sims := c.Simulations()
+	if len(sims) != 1 || sims[0].Method != "requestKnowledge" {
+		t.Errorf("simulations = %+v, want one requestKnowledge", sims)
+	}
+	if backend.sent.Load() != 0 {
+		t.Error("a dry run sent a transaction")
+	}
+}
+
+func TestV1DeleteTaskAndAddCapabilities(t *testing.T) {
+	n, srv := newV1Node(t, nil)
+
+	manifest := `{"version":1,"capabilities":[{"name":"translate","handler":"echo"}]}`
+	var added []CapabilityDef
+	if got := v1Request(t, srv, http.MethodPost, "/v1/capabilities", testAPIToken, manifest, &added); got != http.StatusCreated {
+		t.Fatalf("adding translate answered %d", got)
+	}
+	if len(added) != 1 || added[0].Name != "translate" {
+		t.Errorf("added %+v, want translate", added)
+	}
+	if got := v1Request(t, srv, http.MethodPost, "/v1/capabilities", testAPIToken, manifest, nil); got != http.StatusConflict {
+		t.Errorf("adding translate twice answered %d, want %d", got, http.StatusConflict)
+	}
+	if got := v1Request(t, srv, http.MethodPost, "/v1/capabilities", testAPIToken, `{"capabilities":[{"name":"x","handler":"nope"}]}`, nil); got != http.StatusBadRequest {
+		t.Errorf("unknown handler answered %d, want %d", got, http.StatusBadRequest)
+	}
+
+	record, err := n.SubmitTask(TaskSpec{Capability: "translate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := v1Request(t, srv, http.MethodDelete, "/v1/tasks/"+record.ID, testAPIToken, "{}", nil)
+		if got == http.StatusNoContent {
+			break
+		}
+		if got != http.StatusConflict || time.Now().After(deadline) {
+			t.Fatalf("delete answered %d", got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := os.Stat(n.resultPath(record.ID)); !os.IsNotExist(err) {
+		t.Errorf("result file left behind: %v", err)
+	}
+	if got := v1Request(t, srv, http.MethodDelete, "/v1/tasks/"+record.ID, testAPIToken, "{}", nil); got != http.StatusNotFound {
+		t.Errorf("deleting again answered %d, want %d", got, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,500 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ArchiveManifestName is the file in an event archive listing the SHA-256
+// of each closed day.
+const ArchiveManifestName = "manifest.json"
+
+// archiveRotateInterval is how often a node checks whether its archive's
+// day is over, so a quiet day is closed without waiting for an event.
+const archiveRotateInterval = time.Minute
+
+// ErrArchiveTampered is returned for an archive whose files don't match
+// its manifest.
+var ErrArchiveTampered = errors.New("event archive doesn't match its manifest")
+
+// ArchivedEvent is one line of an event archive: the event as 'agent record'
+// writes it, the intake's decision, and the log it was decoded from. A
+// ReplaySource replays it like a recorded event.
+type ArchivedEvent struct {
+	RecordedEvent
+	Decision  *Decision  `json:"decision,omitempty"`
+	BlockHash string     `json:"blockHash,omitempty"`
+	Log       *types.Log `json:"log,omitempty"` // nil for events that didn't come from a watcher
+}
+
+// ArchiveTask converts a TaskCreated event and the decision on it for an
+// EventArchive.
+func ArchiveTask(e TaskCreatedEvent, d Decision) ArchivedEvent {
+	return archived(RecordTask(e), d, e.raw)
+}
+
+// ArchiveQuery converts a KnowledgeRequested event and the decision on it
+// for an EventArchive.
+func ArchiveQuery(q KnowledgeRequestedEvent, d Decision) ArchivedEvent {
+	return archived(RecordQuery(q), d, q.raw)
+}
+
+func archived(r RecordedEvent, d Decision, raw *types.Log) ArchivedEvent {
+	// Replays resolve the requester as it was resolved live
+	r.PeerID, r.Endpoint = d.PeerID, d.Endpoint
+	a := ArchivedEvent{RecordedEvent: r, Decision: &d}
+	if raw != nil {
+		// A log's JSON must have its topics to be read back
+		l := *raw
+		if l.Topics == nil {
+			l.Topics = []common.Hash{}
+		}
+		a.Log, a.BlockHash = &l, raw.BlockHash.Hex()
+	}
+	return a
+}
+
+// key tells events apart across contracts and chains.
+func (e ArchivedEvent) key() string {
+	return fmt.Sprintf("%s/%d/%s/%s", e.Kind, e.ChainID, e.Contract, e.ID)
+}
+
+// ArchiveFile is a closed day of an archive, as its manifest lists it.
+type ArchiveFile struct {
+	Name       string `json:"name"`
+	SHA256     string `json:"sha256"` // of the compressed file
+	Bytes      int64  `json:"bytes"`
+	Events     int    `json:"events"`
+	FirstBlock uint64 `json:"firstBlock,omitempty"`
+	LastBlock  uint64 `json:"lastBlock,omitempty"`
+	ClosedAt   int64  `json:"closedAt"` // unix seconds
+}
+
+// ArchiveManifest lists the closed days of an archive, oldest first.
+type ArchiveManifest struct {
+	Files []ArchiveFile `json:"files"`
+}
+
+// EventArchive keeps a record of the chain events the node acted on,
+// apart from its database: each is appended, with the intake's decision and
+// the raw log, to the NDJSON file of the UTC day it was seen,
+// events-YYYY-MM-DD.ndjson in Dir. Once the day is over its file is
+// compressed to .ndjson.gz and its SHA-256 added to the manifest, so a file
+// changed later is found by VerifyEventArchive. Appends aren't synced one by
+// one; a file is synced when it is closed.
+type EventArchive struct {
+	Dir   string
+	Clock Clock // nil means the SystemClock
+
+	mu   sync.Mutex
+	day  string   // of the open file
+	file *os.File // nil until the first event
+	seen map[string]bool
+}
+
+// NewEventArchive keeps an archive in dir, creating it if need be, and
+// closes the days before today left open.
+func NewEventArchive(dir string) (*EventArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	a := &EventArchive{Dir: dir}
+	return a, a.Rotate()
+}
+
+func (a *EventArchive) now() time.Time {
+	if a.Clock == nil {
+		return SystemClock.Now()
+	}
+	return a.Clock.Now()
+}
+
+func archiveDayFile(day string) string {
+	return "events-" + day + ".ndjson"
+}
+
+// Append adds e to today's file, unless today's file has it already. A nil
+// archive keeps nothing.
+func (a *EventArchive) Append(e ArchivedEvent) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if day := now.UTC().Format(dayLayout); a.file == nil || day != a.day {
+		// Today's events are kept even if the days before can't be closed
+		if err := a.rotate(day); err != nil {
+			fmt.Printf("[Archive] %v\n", err)
+		}
+		if err := a.open(day); err != nil {
+			return err
+		}
+	}
+	if a.seen[e.key()] {
+		return nil
+	}
+	e.Time = now.UnixMilli()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to archive event %s: %w", e.ID, err)
+	}
+	a.seen[e.key()] = true
+	return nil
+}
+
+// open opens day's file for appending. A line cut short by a crash is
+// dropped, and the events already in the file are remembered.
+func (a *EventArchive) open(day string) error {
+	path := filepath.Join(a.Dir, archiveDayFile(day))
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return err
+		}
+		data = data[:end]
+	}
+	seen := map[string]bool{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var e ArchivedEvent
+		if json.Unmarshal(line, &e) == nil {
+			seen[e.key()] = true
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	a.file, a.day, a.seen = f, day, seen
+	return nil
+}
+
+// Rotate closes the files of the days before today.
+func (a *EventArchive) Rotate() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rotate(a.now().UTC().Format(dayLayout))
+}
+
+// rotate closes the open file unless it is today's, then compresses every
+// day before today into the manifest.
+func (a *EventArchive) rotate(today string) error {
+	if a.file != nil && a.day != today {
+		if err := a.closeFile(); err != nil {
+			return err
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(a.Dir, "events-*.ndjson"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, path := range names {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "events-"), ".ndjson")
+		if day >= today {
+			continue
+		}
+		if err := a.closeDay(path); err != nil {
+			return fmt.Errorf("failed to close the archive of %s: %w", day, err)
+		}
+		fmt.Printf("[Archive] Closed the events of %s\n", day)
+	}
+	return nil
+}
+
+func (a *EventArchive) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Sync()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.file, a.seen = nil, nil
+	return err
+}
+
+// closeDay compresses the day file at path, adds it to the manifest and
+// removes it. Each step can be redone, so a crash partway leaves the day to
+// be closed again.
+func (a *EventArchive) closeDay(path string) error {
+	gzPath := path + ".gz"
+	manifest, err := readArchiveManifest(a.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range manifest.Files {
+		if f.Name == filepath.Base(gzPath) {
+			return os.Remove(path)
+		}
+	}
+
+	events, err := readArchiveFile(path)
+	if err != nil {
+		return err
+	}
+	entry := ArchiveFile{Name: filepath.Base(gzPath), Events: len(events), ClosedAt: a.now().Unix()}
+	for _, e := range events {
+		if entry.FirstBlock == 0 || e.Block < entry.FirstBlock {
+			entry.FirstBlock = e.Block
+		}
+		entry.LastBlock = max(entry.LastBlock, e.Block)
+	}
+	if entry.SHA256, entry.Bytes, err = compressFile(path, gzPath); err != nil {
+		return err
+	}
+	manifest.Files = append(manifest.Files, entry)
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name })
+	if err := writeArchiveManifest(a.Dir, manifest); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// compressFile gzips src into dst, returning the SHA-256 and size of dst.
+func compressFile(src, dst string) (string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp)
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, hash)}
+	zw := gzip.NewWriter(counter)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), counter.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Close syncs and closes today's file. It is appended to again by the
+// next archive opened on Dir.
+func (a *EventArchive) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeFile()
+}
+
+func readArchiveManifest(dir string) (ArchiveManifest, error) {
+	var m ArchiveManifest
+	data, err := os.ReadFile(filepath.Join(dir, ArchiveManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", ArchiveManifestName, err)
+	}
+	return m, nil
+}
+
+// writeArchiveManifest replaces the manifest whole, so a crash leaves the
+// old one or the new.
+func writeArchiveManifest(dir string, m ArchiveManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, ArchiveManifestName+".tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ArchiveManifestName))
+}
+
+// VerifyEventArchive checks each closed day of the archive in dir against
+// the SHA-256 in its manifest. The error wraps ErrArchiveTampered when a
+// file was changed or removed, or a closed day isn't in the manifest.
+func VerifyEventArchive(dir string) (ArchiveManifest, error) {
+	m, err := readArchiveManifest(dir)
+	if err != nil {
+		return m, err
+	}
+	var problems []string
+	listed := map[string]bool{}
+	for _, f := range m.Files {
+		listed[f.Name] = true
+		data, err := os.ReadFile(filepath.Join(dir, f.Name))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f.Name, err))
+			continue
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != f.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s: SHA-256 %x, manifest has %s", f.Name, sum, f.SHA256))
+		}
+	}
+	closed, err := filepath.Glob(filepath.Join(dir, "events-*.ndjson.gz"))
+	if err != nil {
+		return m, err
+	}
+	for _, path := range closed {
+		if name := filepath.Base(path); !listed[name] {
+			problems = append(problems, name+": not in the manifest")
+		}
+	}
+	if len(problems) > 0 {
+		return m, fmt.Errorf("%w: %s", ErrArchiveTampered, strings.Join(problems, "; "))
+	}
+	return m, nil
+}
+
+// ReadEventArchive reads an archive's events, oldest first. path is the
+// archive's directory, which is verified with VerifyEventArchive first, or
+// one of its files, compressed or not.
+func ReadEventArchive(path string) ([]ArchivedEvent, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return readArchiveFile(path)
+	}
+	m, err := VerifyEventArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(m.Files)+1)
+	for _, f := range m.Files {
+		files = append(files, f.Name)
+	}
+	// Days still open, unless a crash left them closed as well
+	open, err := filepath.Glob(filepath.Join(path, "events-*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range open {
+		if name := filepath.Base(p); !slices.Contains(files, name+".gz") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	var events []ArchivedEvent
+	for _, name := range files {
+		read, err := readArchiveFile(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, read...)
+	}
+	return events, nil
+}
+
+// readArchiveFile reads the events of one archive file, gunzipping a .gz.
+func readArchiveFile(path string) ([]ArchivedEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var events []ArchivedEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e ArchivedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return events, nil
+}
+
+func (n *AgentNode) archiveStep() BootStep {
+	return BootStep{Name: "archive", Run: func(context.Context) error {
+		if n.Archive == nil {
+			return nil
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			ticker := time.NewTicker(archiveRotateInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-n.ctx.Done():
+					return
+				case <-ticker.C:
+					if err := n.Archive.Rotate(); err != nil {
+						fmt.Printf("[Archive] %v\n", err)
+					}
+				}
+			}
+		}()
+		return nil
+	}}
+}
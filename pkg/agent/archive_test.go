@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestEventArchiveManifestDetectsModifiedFile(t *testing.T) {
+	dir := t.TempDir()
+	clock := testutil.NewFakeClock(time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC))
+	a, err := NewEventArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Clock = clock
+	for i := int64(1); i <= 3; i++ {
+		e := TaskCreatedEvent{TaskId: big.NewInt(i), Payment: big.NewInt(1000), Block: uint64(100 + i)}
+		if err := a.Append(ArchiveTask(e, Decision{TaskID: TaskRecordFromEvent(e).ID, Action: ActionBid})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The next day closes the day before
+	clock.Advance(3 * time.Hour)
+	if err := a.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := VerifyEventArchive(dir)
+	if err != nil {
+		t.Fatalf("untouched archive: %v", err)
+	}
+	if len(m.Files) != 1 || m.Files[0].Name != "events-2023-11-14.ndjson.gz" || m.Files[0].Events != 3 ||
+		m.Files[0].FirstBlock != 101 || m.Files[0].LastBlock != 103 {
+		t.Fatalf("manifest = %+v", m)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "events-2023-11-14.ndjson")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("closed day left uncompressed: %v", err)
+	}
+
+	path := filepath.Join(dir, m.Files[0].Name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyEventArchive(dir); !errors.Is(err, ErrArchiveTampered) {
+		t.Errorf("modified file: %v, want ErrArchiveTampered", err)
+	}
+	if _, err := ReadEventArchive(dir); !errors.Is(err, ErrArchiveTampered) {
+		t.Errorf("reading a modified archive: %v, want ErrArchiveTampered", err)
+	}
+}
+
+func TestSimulatedArchiveReproducesDecisions(t *testing.T) {
+	workspace := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workspace, "rust.md"), []byte("Rust borrow checker notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	requester := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	resolve := func(wallet common.Address) Recipient {
+		if wallet == requester {
+			return Recipient{PeerID: "12D3KooWRequester"}
+		}
+		return Recipient{}
+	}
+
+	dir := t.TempDir()
+	clock := testutil.NewFakeClock(time.Date(2023, 11, 14, 23, 0, 0, 0, time.UTC))
+	archive, err := NewEventArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.Clock = clock
+	store := newTestStore(t)
+	live := NewTaskIntake(store, NewMemoryStoreWithMetadata(store, workspace), resolve)
+	live.UseArchive(archive)
+	live.RequirePayment(big.NewInt(500))
+	var want []Decision
+	live.OnDecision(func(_ TaskRecord, d Decision) { want = append(want, d) })
+
+	log := &types.Log{BlockNumber: 101, BlockHash: common.HexToHash("0xb1")}
+	bid := TaskCreatedEvent{TaskId: big.NewInt(1), Client: requester, Payment: big.NewInt(1000), Block: 101, raw: log}
+	live.OnTask(bid)
+	live.OnTask(TaskCreatedEvent{TaskId: big.NewInt(2), Payment: big.NewInt(100), Block: 102})
+	// A redelivery is dropped before it reaches the archive
+	live.OnTask(bid)
+	// The rest land in the next day's file, left open
+	clock.Advance(2 * time.Hour)
+	live.OnQuery(KnowledgeRequestedEvent{RequestId: big.NewInt(3), Requester: requester, Topic: "rust", Bounty: big.NewInt(10), Block: 103})
+	live.OnQuery(KnowledgeRequestedEvent{RequestId: big.NewInt(4), Requester: requester, Topic: "haskell", Bounty: big.NewInt(10), Block: 104})
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 4 {
+		t.Fatalf("live decisions = %+v", want)
+	}
+
+	archived, err := ReadEventArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 4 {
+		t.Fatalf("archived %d events, want each of the 4 once: %+v", len(archived), archived)
+	}
+	if first := archived[0]; first.BlockHash != log.BlockHash.Hex() || first.Log == nil || first.Decision == nil || first.Decision.Action != ActionBid {
+		t.Errorf("first archived event = %+v", first)
+	}
+
+	// Replay as 'agent simulate' does, resolving requesters as archived
+	peers := map[common.Address]Recipient{}
+	events := make([]RecordedEvent, len(archived))
+	for i, e := range archived {
+		events[i] = e.RecordedEvent
+		if e.PeerID != "" {
+			peers[common.HexToAddress(e.Account)] = Recipient{PeerID: e.PeerID}
+		}
+	}
+	scratch := newTestStore(t)
+	replayed := NewTaskIntake(scratch, NewMemoryStoreWithMetadata(scratch, workspace), func(wallet common.Address) Recipient {
+		return peers[wallet]
+	})
+	replayed.RequirePayment(big.NewInt(500))
+	var got []Decision
+	replayed.OnDecision(func(_ TaskRecord, d Decision) { got = append(got, d) })
+	NewReplaySource(events, replayed.OnTask, replayed.OnQuery).Start(context.Background())
+
+	if len(got) != len(archived) {
+		t.Fatalf("replayed %d decisions, want %d", len(got), len(archived))
+	}
+	for i, e := range archived {
+		if got[i] != want[i] || *e.Decision != want[i] {
+			t.Errorf("event %s: replayed %+v, archived %+v, live %+v", e.ID, got[i], *e.Decision, want[i])
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package agent
+
+import "time"
+
+// Audit log kinds.
+const (
+	AuditKeyRotated  = "identity.rotated"
+	AuditKeyRetired  = "identity.retired"
+	AuditTxSent      = "tx.sent"
+	AuditTxSimulated = "tx.simulated"
+	AuditPolicy      = "policy.decision"
+)
+
+func (s *sqlStore) AppendAudit(kind, subject, detail string) error {
+	_, err := s.exec("INSERT INTO audit_log (at, kind, subject, detail) VALUES (?, ?, ?, ?)",
+		time.Now().Unix(), kind, subject, detail)
+	return err
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// BlockTag picks the block a contract read sees: the latest block, the
+// latest safe or finalized one, or a block number. Left to the provider, a
+// read may see the pending block instead, so every read names one.
+type BlockTag string
+
+const (
+	BlockLatest    BlockTag = "latest"    // the chain head; may still be reorganized away
+	BlockSafe      BlockTag = "safe"      // the latest block safe from reorgs in practice
+	BlockFinalized BlockTag = "finalized" // the latest block that can no longer change
+)
+
+// BlockAt is the tag of block number n.
+func BlockAt(n uint64) BlockTag {
+	return BlockTag(strconv.FormatUint(n, 10))
+}
+
+// ParseBlockTag reads latest, safe, finalized, or a block number in decimal
+// or 0x-prefixed hex. Empty is latest.
+func ParseBlockTag(s string) (BlockTag, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch t := BlockTag(s); t {
+	case "":
+		return BlockLatest, nil
+	case BlockLatest, BlockSafe, BlockFinalized:
+		return t, nil
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid block %q: want latest, safe, finalized or a block number", s)
+	}
+	return BlockAt(n), nil
+}
+
+// number is the tag as go-ethereum takes it: a block number, or one of the
+// negative numbers standing for the named blocks.
+func (t BlockTag) number() *big.Int {
+	switch t {
+	case "", BlockLatest:
+		return big.NewInt(int64(rpc.LatestBlockNumber))
+	case BlockSafe:
+		return big.NewInt(int64(rpc.SafeBlockNumber))
+	case BlockFinalized:
+		return big.NewInt(int64(rpc.FinalizedBlockNumber))
+	}
+	n, _ := new(big.Int).SetString(string(t), 10)
+	return n
+}
+
+// SetBlockTag sets the block reads see unless a call names its own; empty
+// restores BlockLatest.
+func (c *ERC8004Client) SetBlockTag(t BlockTag) {
+	c.blockTag = t
+}
+
+// readBlock returns the block a read is made against: the first of tags
+// the caller passed, or the client's default.
+func (c *ERC8004Client) readBlock(tags []BlockTag) BlockTag {
+	if len(tags) > 0 && tags[0] != "" {
+		return tags[0]
+	}
+	if c.blockTag == "" {
+		return BlockLatest
+	}
+	return c.blockTag
+}
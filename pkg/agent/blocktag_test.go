@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"encoding/json"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestParseBlockTag(t *testing.T) {
+	cases := map[string]BlockTag{
+		"":          BlockLatest,
+		"latest":    BlockLatest,
+		"Finalized": BlockFinalized,
+		"safe":      BlockSafe,
+		"12345":     "12345",
+		"0x10":      "16",
+	}
+	for in, want := range cases {
+		if got, err := ParseBlockTag(in); err != nil || got != want {
+			t.Errorf("ParseBlockTag(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"pending", "earliest", "-1", "next"} {
+		if _, err := ParseBlockTag(in); err == nil {
+			t.Errorf("ParseBlockTag(%q) took a block reads can't name", in)
+		}
+	}
+}
+
+func TestReadsNameTheirBlock(t *testing.T) {
+	var mu sync.Mutex
+	var blocks []string
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		if method != "eth_call" {
+			return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+		}
+		var block string
+		json.Unmarshal(params[1], &block)
+		mu.Lock()
+		blocks = append(blocks, block)
+		mu.Unlock()
+		return common.BytesToHash([]byte{0xaa}).Hex(), nil
+	})
+	client := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	t.Cleanup(client.Close)
+	id := big.NewInt(1)
+
+	client.GetAgentWallet(id)
+	client.GetAgentWallet(id, BlockAt(100))
+	client.SetBlockTag(BlockFinalized)
+	client.GetAgentWallet(id)
+	client.GetReputationSummaryForClients(id, nil, "", "", BlockSafe)
+	RegistryReputation(client, nil, "")(t.Context(), id, "")
+
+	want := []string{"latest", "0x64", "finalized", "safe", "finalized"}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(blocks) != len(want) {
+		t.Fatalf("calls were made at %v, want %v", blocks, want)
+	}
+	for i := range want {
+		if blocks[i] != want[i] {
+			t.Errorf("call %d was made at %q, want %q", i, blocks[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Background boot steps are retried after a failure, backing off from
+// bootRetryMin to bootRetryMax.
+const (
+	bootRetryMin = time.Second
+	bootRetryMax = 30 * time.Second
+)
+
+// chainProbeTimeout bounds one attempt of the chain boot step to reach the
+// RPC.
+const chainProbeTimeout = 10 * time.Second
+
+// BootStep is a component Start brings up. A step runs as soon as the steps
+// it comes After are up, alongside any others that are ready.
+type BootStep struct {
+	Name  string
+	After []string
+	Run   func(ctx context.Context) error
+	// Background steps don't hold up Start. Until one is up the node reports
+	// itself degraded with Degraded, or "<name> unavailable", and a failed
+	// run is retried until it succeeds or the node stops. A step can only
+	// come after a background step if it is one too.
+	Background bool
+	Degraded   string
+}
+
+// Component states in a ComponentTiming.
+const (
+	ComponentPending  = "pending"
+	ComponentStarting = "starting"
+	ComponentUp       = "up"
+	ComponentFailed   = "failed"
+)
+
+// ComponentTiming is how a component fared at startup: how long it took to
+// come up, or has been starting for so far.
+type ComponentTiming struct {
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Millis     int64  `json:"ms"`
+	Attempts   int    `json:"attempts,omitempty"`
+	Error      string `json:"error,omitempty"` // of the last failed attempt
+	Background bool   `json:"background,omitempty"`
+}
+
+// bootGraph runs a set of boot steps in dependency order and keeps their
+// timings for the status output.
+type bootGraph struct {
+	mu    sync.Mutex
+	steps map[string]*bootState
+	order []string
+	wg    sync.WaitGroup // background steps
+}
+
+type bootState struct {
+	step     BootStep
+	state    string
+	start    time.Time
+	took     time.Duration
+	attempts int
+	err      error
+	done     chan struct{} // closed once the step is up or has given up
+}
+
+// AddBootStep adds a component for Start to bring up, after the node's own
+// store and host steps, named "store" and "host". Call it before Start.
+func (n *AgentNode) AddBootStep(step BootStep) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.bootSteps = append(n.bootSteps, step)
+}
+
+// chainStep waits in the background for the RPC to answer. Steps that need
+// the chain at startup come after it, so the node serves P2P traffic while
+// the RPC is slow or down.
+func (n *AgentNode) chainStep() BootStep {
+	return BootStep{Name: "chain", Background: true, Degraded: "chain unavailable", Run: func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, chainProbeTimeout)
+		defer cancel()
+		head, err := n.ERCClient.HeadBlock(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[Boot] Chain reachable at block %d\n", head)
+		return nil
+	}}
+}
+
+// run starts steps and returns once every foreground step is up, or
+// with the first one to fail. Background steps keep running on ctx.
+func (g *bootGraph) run(ctx context.Context, steps []BootStep) error {
+	g.mu.Lock()
+	g.steps = map[string]*bootState{}
+	for _, s := range steps {
+		if _, dup := g.steps[s.Name]; dup {
+			g.mu.Unlock()
+			return fmt.Errorf("boot step %q added twice", s.Name)
+		}
+		g.steps[s.Name] = &bootState{step: s, state: ComponentPending, done: make(chan struct{})}
+		g.order = append(g.order, s.Name)
+	}
+	for _, s := range steps {
+		for _, dep := range s.After {
+			d, ok := g.steps[dep]
+			if !ok {
+				g.mu.Unlock()
+				return fmt.Errorf("boot step %q comes after unknown step %q", s.Name, dep)
+			}
+			if d.step.Background && !s.Background {
+				g.mu.Unlock()
+				return fmt.Errorf("boot step %q can't wait for background step %q", s.Name, dep)
+			}
+		}
+	}
+	if err := g.checkAcyclic(); err != nil {
+		g.mu.Unlock()
+		return err
+	}
+	g.mu.Unlock()
+
+	errs := make(chan error, len(steps))
+	foreground := 0
+	for _, s := range steps {
+		st := g.steps[s.Name]
+		if s.Background {
+			g.wg.Add(1)
+			go func() {
+				defer g.wg.Done()
+				g.runBackground(ctx, st)
+			}()
+			continue
+		}
+		foreground++
+		go func() { errs <- g.runForeground(ctx, st) }()
+	}
+	var first error
+	for i := 0; i < foreground; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// checkAcyclic fails if steps wait on each other in a loop. Called with g.mu
+// held.
+func (g *bootGraph) checkAcyclic() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	mark := map[string]int{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch mark[name] {
+		case visiting:
+			return fmt.Errorf("boot step %q depends on itself", name)
+		case visited:
+			return nil
+		}
+		mark[name] = visiting
+		for _, dep := range g.steps[name].step.After {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		mark[name] = visited
+		return nil
+	}
+	for _, name := range g.order {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// await waits for st's dependencies. It fails if one of them failed.
+func (g *bootGraph) await(ctx context.Context, st *bootState) error {
+	for _, dep := range st.step.After {
+		d := g.steps[dep]
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		g.mu.Lock()
+		state := d.state
+		g.mu.Unlock()
+		if state != ComponentUp {
+			return fmt.Errorf("%s did not come up", dep)
+		}
+	}
+	return nil
+}
+
+func (g *bootGraph) runForeground(ctx context.Context, st *bootState) error {
+	defer close(st.done)
+	if err := g.await(ctx, st); err != nil {
+		g.finish(st, err)
+		return fmt.Errorf("%s: %w", st.step.Name, err)
+	}
+	g.begin(st)
+	if err := st.step.Run(ctx); err != nil {
+		g.finish(st, err)
+		return err
+	}
+	g.finish(st, nil)
+	return nil
+}
+
+func (g *bootGraph) runBackground(ctx context.Context, st *bootState) {
+	defer close(st.done)
+	if err := g.await(ctx, st); err != nil {
+		g.finish(st, err)
+		return
+	}
+	g.begin(st)
+	backoff := bootRetryMin
+	for {
+		err := st.step.Run(ctx)
+		if err == nil {
+			g.finish(st, nil)
+			return
+		}
+		g.mu.Lock()
+		st.err = err
+		g.mu.Unlock()
+		if ctx.Err() != nil {
+			g.finish(st, err)
+			return
+		}
+		fmt.Printf("[Boot] %s not up yet, retrying in %s: %v\n", st.step.Name, backoff, err)
+		select {
+		case <-ctx.Done():
+			g.finish(st, err)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, bootRetryMax)
+		g.mu.Lock()
+		st.attempts++
+		g.mu.Unlock()
+	}
+}
+
+func (g *bootGraph) begin(st *bootState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st.state, st.start, st.attempts = ComponentStarting, time.Now(), 1
+}
+
+func (g *bootGraph) finish(st *bootState, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !st.start.IsZero() {
+		st.took = time.Since(st.start)
+	}
+	st.err = err
+	if err == nil {
+		st.state = ComponentUp
+	} else {
+		st.state = ComponentFailed
+	}
+}
+
+// timings returns each step's timing, in the order the steps were given.
+func (g *bootGraph) timings() []ComponentTiming {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	timings := make([]ComponentTiming, 0, len(g.order))
+	for _, name := range g.order {
+		st := g.steps[name]
+		t := ComponentTiming{Name: name, State: st.state, Attempts: st.attempts, Background: st.step.Background}
+		took := st.took
+		if st.state == ComponentStarting {
+			took = time.Since(st.start)
+		}
+		t.Millis = took.Milliseconds()
+		if st.err != nil && st.state != ComponentUp {
+			t.Error = st.err.Error()
+		}
+		timings = append(timings, t)
+	}
+	return timings
+}
+
+// degraded returns what the node is running without: the background steps
+// not up, sorted, each reason once.
+func (g *bootGraph) degraded() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var reasons []string
+	seen := map[string]bool{}
+	for _, name := range g.order {
+		st := g.steps[name]
+		if !st.step.Background || st.state == ComponentUp {
+			continue
+		}
+		reason := st.step.Degraded
+		if reason == "" {
+			reason = name + " unavailable"
+		}
+		if !seen[reason] {
+			seen[reason] = true
+			reasons = append(reasons, reason)
+		}
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// wait blocks until the background steps have returned.
+func (g *bootGraph) wait() {
+	g.wg.Wait()
+}
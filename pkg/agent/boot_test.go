@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowChain answers after latency, or as soon as it is healed.
+type slowChain struct {
+	fakeChain
+	latency time.Duration
+	healed  chan struct{}
+	heal    sync.Once
+}
+
+func (c *slowChain) handle(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	select {
+	case <-time.After(c.latency):
+	case <-c.healed:
+	}
+	if method == "eth_blockNumber" {
+		return "0x64", nil
+	}
+	return c.fakeChain.handle(method, params)
+}
+
+func TestNodeServesP2PBeforeTheChainAnswers(t *testing.T) {
+	chain := &slowChain{fakeChain: fakeChain{head: 100, headTime: uint64(time.Now().Unix())}, latency: 10 * time.Second, healed: make(chan struct{})}
+	url := newFakeRPC(t, chain.handle)
+	// Let pending calls go before the server closes
+	t.Cleanup(func() { chain.heal.Do(func() { close(chain.healed) }) })
+
+	n := newTestNode(t)
+	n.ERCClient = NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	w, err := NewEventWatcher(url, []string{zeroAddressHex}, nil, nil, nil, WithDeferredHead())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Watcher = w
+	var reconciled sync.WaitGroup
+	reconciled.Add(1)
+	n.AddBootStep(BootStep{Name: "reconcile", After: []string{"chain"}, Background: true, Degraded: "chain unavailable", Run: func(ctx context.Context) error {
+		defer reconciled.Done()
+		return nil
+	}})
+
+	start := time.Now()
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second || n.Host.ID() == "" {
+		t.Fatalf("host up after %s, want within 1s", took)
+	}
+
+	// A peer can reach the node while the chain is down
+	peer := startTestNode(t)
+	if _, err := peer.addTarget(dialAddr(n)); err != nil {
+		t.Fatalf("dialling the node: %v", err)
+	}
+	st := n.Status()
+	if len(st.Degraded) != 1 || st.Degraded[0] != "chain unavailable" {
+		t.Errorf("degraded = %v, want chain unavailable", st.Degraded)
+	}
+	states := map[string]string{}
+	for _, c := range st.Startup {
+		states[c.Name] = c.State
+	}
+	want := map[string]string{"store": ComponentUp, "host": ComponentUp, "rotations": ComponentUp, "chain": ComponentStarting, "reconcile": ComponentPending}
+	for name, state := range want {
+		if states[name] != state {
+			t.Errorf("%s is %q, want %q (startup %+v)", name, states[name], state, st.Startup)
+		}
+	}
+
+	// The RPC comes back: the steps waiting on it run and the watcher picks
+	// its start block
+	chain.heal.Do(func() { close(chain.healed) })
+	reconciled.Wait()
+	for deadline := time.Now().Add(5 * time.Second); len(n.Status().Degraded) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("still degraded: %v", n.Status().Degraded)
+		}
+	}
+	if _, err := w.Lag(context.Background()); err == nil {
+		t.Error("the watcher reported its lag before it picked a start block")
+	}
+	w.pollLogs(context.Background())
+	if lag, err := w.Lag(context.Background()); err != nil || lag != 0 || w.LastBlock() != 100 {
+		t.Errorf("after the first poll: lag %d, %v, last block %d, want 0 at block 100", lag, err, w.LastBlock())
+	}
+}
+
+func TestBootStepsRunAfterTheirDependencies(t *testing.T) {
+	var g bootGraph
+	var mu sync.Mutex
+	var ran []string
+	step := func(name string, after ...string) BootStep {
+		return BootStep{Name: name, After: after, Run: func(context.Context) error {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			ran = append(ran, name)
+			mu.Unlock()
+			return nil
+		}}
+	}
+	failing := BootStep{Name: "broken", Run: func(context.Context) error { return errors.New("no disk") }}
+	err := g.run(context.Background(), []BootStep{step("c", "a", "b"), step("a"), step("b", "a"), failing, step("d", "broken")})
+	if err == nil {
+		t.Fatal("Start succeeded with a step down")
+	}
+	if len(ran) != 3 || ran[0] != "a" || ran[1] != "b" || ran[2] != "c" {
+		t.Errorf("ran %v, want a, b, c in order and not d", ran)
+	}
+
+	// Loops and foreground steps waiting on background ones are refused
+	for _, steps := range [][]BootStep{
+		{step("x", "y"), step("y", "x")},
+		{{Name: "bg", Background: true, Run: func(context.Context) error { return nil }}, step("fg", "bg")},
+	} {
+		if err := new(bootGraph).run(context.Background(), steps); err == nil {
+			t.Errorf("ran %+v", steps)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// DefaultBootstrapInterval is how often bootstrap peers are checked and
+	// those the node lost re-dialed.
+	DefaultBootstrapInterval = time.Minute
+	bootstrapTimeout         = 15 * time.Second
+	// Until every bootstrap answers, the first checks come sooner: 1s after
+	// starting, then twice as long each time, up to the interval
+	bootstrapRetryDelay = time.Second
+)
+
+// DefaultRegistryBootstraps is how many agents from the IdentityRegistry a
+// node given no bootstrap peers dials instead; see BootstrapPeers.FromRegistry.
+const DefaultRegistryBootstraps = 3
+
+// registryBootstrapCandidates is the most registrations RegistryBootstrapPeers
+// looks at, so a registry of agents that publish no addresses costs a bounded
+// number of metadata reads.
+const registryBootstrapCandidates = 64
+
+// ParseBootstrapPeers groups multiaddrs ending in /p2p/<peer ID> by peer.
+// "none" alone parses to no peers; a node is given it to dial no default
+// peers from the registry either.
+func ParseBootstrapPeers(addrs []string) ([]peer.AddrInfo, error) {
+	if len(addrs) == 0 || len(addrs) == 1 && addrs[0] == "none" {
+		return nil, nil
+	}
+	mas := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		a, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap address %q: %w", s, err)
+		}
+		mas = append(mas, a)
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(mas...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap address: %w", err)
+	}
+	return infos, nil
+}
+
+// BootstrapPeers are the peers a node dials as it starts, for its first
+// connections, and keeps connected: each is checked every Interval, pinged
+// if connected and re-dialed if not.
+type BootstrapPeers struct {
+	Peers    []peer.AddrInfo
+	Interval time.Duration // between checks; 0 means DefaultBootstrapInterval
+	// FromRegistry is how many agents RegistryBootstrapPeers adds to Peers
+	// once the node starts, if it has a chain client; 0 adds none. These
+	// are the defaults of a node given no bootstrap peers.
+	FromRegistry int
+
+	mu     sync.Mutex
+	health map[peer.ID]*BootstrapStatus
+}
+
+// BootstrapStatus is how one bootstrap peer fared at its last check.
+type BootstrapStatus struct {
+	PeerID        string   `json:"peerId"`
+	Addrs         []string `json:"addrs"`
+	Connected     bool     `json:"connected"`
+	RTTMillis     int64    `json:"rttMillis,omitempty"`     // of the last ping
+	LastConnected int64    `json:"lastConnected,omitempty"` // unix ms of the last successful check
+	Failures      int      `json:"failures,omitempty"`      // checks failed in a row
+	LastError     string   `json:"lastError,omitempty"`
+}
+
+// NewBootstrapPeers returns bootstrap peers to give an AgentNode.
+func NewBootstrapPeers(peers []peer.AddrInfo) *BootstrapPeers {
+	return &BootstrapPeers{Peers: peers, health: map[peer.ID]*BootstrapStatus{}}
+}
+
+func (b *BootstrapPeers) interval() time.Duration {
+	if b.Interval <= 0 {
+		return DefaultBootstrapInterval
+	}
+	return b.Interval
+}
+
+// record notes the outcome of checking info.
+func (b *BootstrapPeers) record(info peer.AddrInfo, rtt time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.health[info.ID]
+	if !ok {
+		st = &BootstrapStatus{PeerID: info.ID.String()}
+		for _, a := range info.Addrs {
+			st.Addrs = append(st.Addrs, a.String())
+		}
+		b.health[info.ID] = st
+	}
+	// Log the first failure in a row, and the recovery
+	switch {
+	case err != nil && st.Failures == 0:
+		fmt.Printf("[P2P] Bootstrap peer %s unreachable: %v\n", info.ID, err)
+	case err == nil && st.Failures > 0:
+		fmt.Printf("[P2P] Bootstrap peer %s reconnected after %d failed checks\n", info.ID, st.Failures)
+	}
+	st.Connected = err == nil
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+		st.RTTMillis = 0
+		return
+	}
+	st.Failures, st.LastError = 0, ""
+	st.RTTMillis = rtt.Milliseconds()
+	st.LastConnected = time.Now().UnixMilli()
+}
+
+// Status returns each bootstrap peer's last check, ordered by peer ID.
+// Peers not checked yet are listed as not connected.
+func (b *BootstrapPeers) Status() []BootstrapStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]BootstrapStatus, 0, len(b.Peers))
+	for _, info := range b.Peers {
+		if st, ok := b.health[info.ID]; ok {
+			c := *st
+			c.Addrs = slices.Clone(st.Addrs)
+			out = append(out, c)
+			continue
+		}
+		st := BootstrapStatus{PeerID: info.ID.String()}
+		for _, a := range info.Addrs {
+			st.Addrs = append(st.Addrs, a.String())
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PeerID < out[j].PeerID })
+	return out
+}
+
+// peers returns Peers, which the registry lookup adds to, or none for a nil
+// b.
+func (b *BootstrapPeers) peers() []peer.AddrInfo {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.Peers)
+}
+
+// add adds infos to Peers, skipping peers already there.
+func (b *BootstrapPeers) add(infos []peer.AddrInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, info := range infos {
+		if !slices.ContainsFunc(b.Peers, func(p peer.AddrInfo) bool { return p.ID == info.ID }) {
+			b.Peers = append(b.Peers, info)
+		}
+	}
+}
+
+// Connected counts the bootstrap peers connected at their last check.
+func (b *BootstrapPeers) Connected() int {
+	connected := 0
+	for _, st := range b.Status() {
+		if st.Connected {
+			connected++
+		}
+	}
+	return connected
+}
+
+func (n *AgentNode) bootstrapStep() BootStep {
+	return BootStep{Name: "bootstrap", After: []string{"host"}, Run: func(context.Context) error {
+		if n.Bootstrap == nil {
+			return nil
+		}
+		lookup := n.Bootstrap.FromRegistry > 0 && n.ERCClient != nil
+		if !lookup && len(n.Bootstrap.peers()) == 0 {
+			return nil
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			retry := bootstrapRetryDelay
+			for {
+				// A lookup the RPC failed is tried again at the next check
+				if lookup {
+					lookup = !n.bootstrapFromRegistry(n.ctx)
+				}
+				wait := n.Bootstrap.interval()
+				if !n.checkBootstraps(n.ctx) && retry < wait {
+					wait, retry = retry, retry*2
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case <-n.ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+		}()
+		return nil
+	}}
+}
+
+// checkBootstraps checks every bootstrap peer at once, pinging those the
+// node is connected to and dialing the rest, and reports whether all of
+// them answered. A peer that doesn't answer its ping is disconnected and
+// dialed again.
+func (n *AgentNode) checkBootstraps(ctx context.Context) bool {
+	h := n.CurrentHost()
+	var wg sync.WaitGroup
+	want := 0
+	for _, info := range n.Bootstrap.peers() {
+		if info.ID == h.ID() {
+			continue
+		}
+		want++
+		wg.Add(1)
+		go func(info peer.AddrInfo) {
+			defer wg.Done()
+			dctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+			defer cancel()
+			rtt, err := checkBootstrap(dctx, h, info)
+			if ctx.Err() != nil {
+				return
+			}
+			n.Bootstrap.record(info, rtt, err)
+		}(info)
+	}
+	wg.Wait()
+	return n.Bootstrap.Connected() >= want
+}
+
+func checkBootstrap(ctx context.Context, h host.Host, info peer.AddrInfo) (time.Duration, error) {
+	if h.Network().Connectedness(info.ID) == network.Connected {
+		// Peers known to speak other protocols but not ping can't be
+		// checked beyond their connection
+		if protos, _ := h.Peerstore().GetProtocols(info.ID); len(protos) > 0 && !slices.Contains(protos, ping.ID) {
+			return 0, nil
+		}
+		res := <-ping.Ping(ctx, h, info.ID)
+		if res.Error == nil {
+			return res.RTT, nil
+		}
+		// A connection that can't carry a ping is dead; start afresh
+		h.Network().ClosePeer(info.ID)
+	}
+	start := time.Now()
+	if err := h.Connect(ctx, info); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// bootstrapFromRegistry adds the agents RegistryBootstrapPeers finds to the
+// bootstrap peers, and reports whether the lookup is done.
+func (n *AgentNode) bootstrapFromRegistry(ctx context.Context) bool {
+	found, err := n.ERCClient.RegistryBootstrapPeers(ctx, n.Bootstrap.FromRegistry)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("[P2P] Failed to find bootstrap peers in the registry: %v\n", err)
+		}
+		return false
+	}
+	if len(found) == 0 {
+		fmt.Println("[P2P] No registered agent publishes addresses to bootstrap from")
+		return true
+	}
+	fmt.Printf("[P2P] Bootstrapping from %d agents in the registry\n", len(found))
+	n.Bootstrap.add(found)
+	return true
+}
+
+// RegistryBootstrapPeers returns up to max of the agents registered last in
+// the IdentityRegistry that publish a peerId and addresses to reach it at,
+// newest first; on the default deployment, agents on Base Sepolia. Peer IDs
+// are checked as ResolveRecipient checks them, and agents that fail the
+// check are skipped. Only the last registryBootstrapCandidates registrations
+// are looked at.
+func (c *ERC8004Client) RegistryBootstrapPeers(ctx context.Context, max int) ([]peer.AddrInfo, error) {
+	head, err := c.HeadBlock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the head block: %w", err)
+	}
+	start := uint64(registryDeployBlock)
+	if c.registryBlock > 0 {
+		start = c.registryBlock
+	}
+
+	var found []peer.AddrInfo
+	var lastErr error
+	candidates := 0
+	// Newest registrations first, a window at a time, until enough are found
+	for to := head; to >= start && len(found) < max && candidates < registryBootstrapCandidates; {
+		from := start
+		if to-start >= registryLogRange {
+			from = to - registryLogRange + 1
+		}
+		var logs []types.Log
+		err := c.scanner.Scan(ctx, from, to, registryLogRange, c.registeredLogs(nil), func(_, _ uint64, l []types.Log) error {
+			logs = append(logs, l...)
+			return nil
+		})
+		if err != nil {
+			return found, fmt.Errorf("failed to filter registry logs: %w", err)
+		}
+		sort.Slice(logs, func(i, j int) bool {
+			if logs[i].BlockNumber != logs[j].BlockNumber {
+				return logs[i].BlockNumber > logs[j].BlockNumber
+			}
+			return logs[i].Index > logs[j].Index
+		})
+		for _, l := range logs {
+			if len(found) == max || candidates == registryBootstrapCandidates {
+				break
+			}
+			candidates++
+			// agentId is indexed, so it's in Topics[1]
+			agentId := new(big.Int).SetBytes(l.Topics[1].Bytes())
+			r, err := c.ResolveRecipient(ctx, agentId)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			id, err := peer.Decode(r.PeerID)
+			if err != nil || len(r.Addrs) == 0 || slices.ContainsFunc(found, func(p peer.AddrInfo) bool { return p.ID == id }) {
+				continue
+			}
+			found = append(found, peer.AddrInfo{ID: id, Addrs: r.Addrs})
+		}
+		if from == start {
+			break
+		}
+		to = from - 1
+	}
+	// An RPC that failed every read isn't a registry without addresses
+	if len(found) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return found, nil
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestParseBootstrapPeers(t *testing.T) {
+	// The defaults come from the registry, not from parsing
+	defaults, err := ParseBootstrapPeers(nil)
+	if err != nil || len(defaults) != 0 {
+		t.Errorf("no bootstrap peers parsed as %v, %v", defaults, err)
+	}
+	if none, err := ParseBootstrapPeers([]string{"none"}); err != nil || len(none) != 0 {
+		t.Errorf("none = %v, %v", none, err)
+	}
+
+	const id = "12D3KooWLKs4hTbXrjJaQQ1Vg9oDwhhbtRn4NUeRt7wLTtBj1dkh"
+	infos, err := ParseBootstrapPeers([]string{"/ip4/10.0.0.1/tcp/4001/p2p/" + id, "/ip4/10.0.0.1/udp/4001/quic-v1/p2p/" + id})
+	if err != nil || len(infos) != 1 || len(infos[0].Addrs) != 2 {
+		t.Errorf("one peer's two addresses parsed as %v, %v", infos, err)
+	}
+	for _, bad := range []string{"/ip4/10.0.0.1/tcp/4001", "bootstrap.example.com:4001"} {
+		if _, err := ParseBootstrapPeers([]string{bad}); err == nil {
+			t.Errorf("parsed %q, which names no peer", bad)
+		}
+	}
+}
+
+func TestBootstrapPeersAreKeptConnected(t *testing.T) {
+	bootstrap := startTestNode(t)
+	info, err := peer.AddrInfoFromString(dialAddr(bootstrap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A peer nothing listens for
+	priv, _, _ := crypto.GenerateEd25519Key(nil)
+	gone, _ := peer.IDFromPrivateKey(priv)
+	unreachable, _ := peer.AddrInfoFromString("/ip4/127.0.0.1/tcp/1/p2p/" + gone.String())
+
+	n := newTestNode(t)
+	n.Bootstrap = NewBootstrapPeers([]peer.AddrInfo{*info, *unreachable})
+	n.Bootstrap.Interval = 100 * time.Millisecond
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	connected := func() bool {
+		return n.CurrentHost().Network().Connectedness(info.ID) == network.Connected && n.Bootstrap.Connected() == 1
+	}
+	for deadline := time.Now().Add(10 * time.Second); !connected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bootstrap peer not dialed: %+v", n.Bootstrap.Status())
+		}
+	}
+
+	// The bootstrap peer drops the node, which dials it again
+	bootstrap.CurrentHost().Network().ClosePeer(n.CurrentHost().ID())
+	time.Sleep(50 * time.Millisecond)
+	for deadline := time.Now().Add(10 * time.Second); !connected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bootstrap peer not re-dialed: %+v", n.Bootstrap.Status())
+		}
+	}
+
+	st := n.Status().Bootstraps
+	if len(st) != 2 {
+		t.Fatalf("bootstraps = %+v", st)
+	}
+	for _, b := range st {
+		switch b.PeerID {
+		case info.ID.String():
+			if !b.Connected || b.LastConnected == 0 || b.LastError != "" {
+				t.Errorf("reachable bootstrap peer: %+v", b)
+			}
+		case gone.String():
+			if b.Connected || b.Failures == 0 || b.LastError == "" {
+				t.Errorf("unreachable bootstrap peer: %+v", b)
+			}
+		}
+	}
+}
+
+func TestRegistryBootstrapPeersAreTheLatestWithAddresses(t *testing.T) {
+	identity, _ := abi.JSON(strings.NewReader(identityABI))
+	peers := map[int64]peer.ID{}
+	for _, agentId := range []int64{1, 2, 3, 4} {
+		priv, _, _ := crypto.GenerateEd25519Key(nil)
+		peers[agentId], _ = peer.IDFromPrivateKey(priv)
+	}
+	// Agent 3 publishes no addresses; the others each publish one
+	metadata := func(agentId int64, key string) string {
+		switch key {
+		case "peerId":
+			return peers[agentId].String()
+		case MetadataAddrs:
+			if agentId != 3 {
+				return `["/ip4/10.0.0.` + big.NewInt(agentId).String() + `/tcp/4001"]`
+			}
+		}
+		return ""
+	}
+	registered := func(block uint64, index uint, agentId int64) types.Log {
+		return types.Log{BlockNumber: block, Index: index, Topics: []common.Hash{registeredEventSig, common.BigToHash(big.NewInt(agentId))}}
+	}
+	// Agent 1 is a window further back than the rest
+	chain := &fakeChain{head: 1 + 2*registryLogRange, logs: []types.Log{
+		registered(100, 0, 1),
+		registered(2*registryLogRange-10, 0, 2),
+		registered(2*registryLogRange, 0, 3),
+		registered(2*registryLogRange, 1, 4),
+	}}
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		if method != "eth_call" {
+			return chain.handle(method, params)
+		}
+		var call struct {
+			Input hexutil.Bytes `json:"input"`
+		}
+		json.Unmarshal(params[0], &call)
+		m, err := identity.MethodById(call.Input)
+		if err != nil || m.Name != "getMetadata" {
+			return nil, &rpcError{Code: 3, Message: "execution reverted"}
+		}
+		args, _ := m.Inputs.Unpack(call.Input[4:])
+		out, _ := m.Outputs.Pack([]byte(metadata(args[0].(*big.Int).Int64(), args[1].(string))))
+		return hexutil.Encode(out), nil
+	})
+	c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	if c == nil {
+		t.Fatal("client not created")
+	}
+	defer c.Close()
+	c.SetRegistryDeployBlock(1)
+
+	for _, tt := range []struct {
+		max  int
+		want []int64
+	}{
+		{2, []int64{4, 2}},
+		{5, []int64{4, 2, 1}},
+	} {
+		found, err := c.RegistryBootstrapPeers(context.Background(), tt.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, info := range found {
+			for agentId, id := range peers {
+				if info.ID == id && len(info.Addrs) == 1 && strings.HasPrefix(info.Addrs[0].String(), "/ip4/10.0.0.") {
+					got = append(got, agentId)
+				}
+			}
+		}
+		if len(got) != len(found) || !slices.Equal(got, tt.want) {
+			t.Errorf("%d bootstrap peers from the registry = %v, want those of agents %v", tt.max, found, tt.want)
+		}
+	}
+}
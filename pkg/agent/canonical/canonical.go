@@ -0,0 +1,256 @@
+// Package canonical implements the JSON Canonicalization Scheme of RFC 8785
+// (JCS): object members sorted by the UTF-16 code units of their names,
+// numbers written the way ECMAScript writes IEEE 754 doubles, and strings
+// with only the escapes JSON requires. Signed documents are serialized with
+// it, so signatures made in Go verify byte-for-byte in other languages and
+// across Go versions.
+package canonical
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ErrInvalid is returned for JSON that has no canonical form: invalid UTF-8,
+// duplicate object members, or numbers an IEEE 754 double can't hold.
+var ErrInvalid = errors.New("no canonical form")
+
+// maxExactInteger is 2^53, above which doubles skip integers.
+var maxExactInteger = new(big.Int).Lsh(big.NewInt(1), 53)
+
+// Marshal returns the canonical JSON encoding of v, encoded first with
+// encoding/json. Integers beyond 2^53 that a double would round, such as
+// large *big.Int amounts, are an error rather than silently changed; encode
+// them as strings.
+func Marshal(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Transform(raw)
+}
+
+// Transform returns the canonical form of the JSON document raw.
+func Transform(raw []byte) ([]byte, error) {
+	if !utf8.Valid(raw) {
+		return nil, fmt.Errorf("%w: invalid UTF-8", ErrInvalid)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := encodeValue(&out, dec); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: data after the top-level value", ErrInvalid)
+	}
+	return out.Bytes(), nil
+}
+
+// Verify reports whether verify accepts the canonical form of data, or, for
+// documents signed before canonicalization, data exactly as it is.
+func Verify(data []byte, verify func(signed []byte) bool) bool {
+	if c, err := Transform(data); err == nil && verify(c) {
+		return true
+	}
+	return verify(data)
+}
+
+func encodeValue(out *bytes.Buffer, dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			return encodeArray(out, dec)
+		}
+		return encodeObject(out, dec)
+	case string:
+		writeString(out, t)
+	case json.Number:
+		s, err := formatNumber(string(t))
+		if err != nil {
+			return err
+		}
+		out.WriteString(s)
+	case bool:
+		out.WriteString(strconv.FormatBool(t))
+	case nil:
+		out.WriteString("null")
+	}
+	return nil
+}
+
+func encodeArray(out *bytes.Buffer, dec *json.Decoder) error {
+	out.WriteByte('[')
+	for i := 0; dec.More(); i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if err := encodeValue(out, dec); err != nil {
+			return err
+		}
+	}
+	out.WriteByte(']')
+	_, err := dec.Token()
+	return err
+}
+
+type member struct {
+	name  string
+	key   []uint16
+	value []byte
+}
+
+func encodeObject(out *bytes.Buffer, dec *json.Decoder) error {
+	var members []member
+	seen := map[string]bool{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name := tok.(string)
+		if seen[name] {
+			return fmt.Errorf("%w: duplicate member %q", ErrInvalid, name)
+		}
+		seen[name] = true
+		var value bytes.Buffer
+		if err := encodeValue(&value, dec); err != nil {
+			return err
+		}
+		members = append(members, member{name: name, key: utf16.Encode([]rune(name)), value: value.Bytes()})
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	sort.Slice(members, func(i, j int) bool { return lessUTF16(members[i].key, members[j].key) })
+	out.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		writeString(out, m.name)
+		out.WriteByte(':')
+		out.Write(m.value)
+	}
+	out.WriteByte('}')
+	return nil
+}
+
+func lessUTF16(a, b []uint16) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// writeString quotes s with the escapes of ECMAScript's JSON.stringify:
+// the two-character forms where JSON has them, \u00XX for other control
+// characters, and everything else as UTF-8.
+func writeString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\b':
+			out.WriteString(`\b`)
+		case '\f':
+			out.WriteString(`\f`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(out, `\u%04x`, r)
+			} else {
+				out.WriteRune(r)
+			}
+		}
+	}
+	out.WriteByte('"')
+}
+
+// formatNumber writes the JSON number literal lit as ECMAScript's
+// Number.prototype.toString writes the double nearest to it. An integer
+// literal the double doesn't hold, and so would come out as another
+// integer, is an error.
+func formatNumber(lit string) (string, error) {
+	f, err := strconv.ParseFloat(lit, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("%w: number %s is out of range", ErrInvalid, lit)
+	}
+	s := formatFloat(f)
+	if n, ok := new(big.Int).SetString(lit, 10); ok && new(big.Int).Abs(n).Cmp(maxExactInteger) > 0 {
+		written, _, _ := big.ParseFloat(s, 10, 1100, big.ToNearestEven)
+		if v, _ := written.Int(nil); v.Cmp(n) != 0 {
+			return "", fmt.Errorf("%w: integer %s would change to %s; encode it as a string", ErrInvalid, lit, s)
+		}
+	}
+	return s, nil
+}
+
+// formatFloat is ECMA-262's Number::toString of a finite f.
+func formatFloat(f float64) string {
+	if f == 0 {
+		return "0"
+	}
+
+	sign := ""
+	if f < 0 {
+		sign, f = "-", -f
+	}
+	// Shortest digits that round-trip, and the decimal point's position n
+	// relative to them, as in ECMA-262's Number::toString
+	e := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exp, _ := strings.Cut(e, "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	x, _ := strconv.Atoi(exp)
+	k, n := len(digits), x+1
+
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k)
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits
+	}
+	expSign := "+"
+	if n-1 < 0 {
+		expSign = "-"
+	}
+	exponent := strconv.Itoa(abs(n - 1))
+	if k == 1 {
+		return sign + digits + "e" + expSign + exponent
+	}
+	return sign + digits[:1] + "." + digits[1:] + "e" + expSign + exponent
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,125 @@
+package canonical
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type vector struct {
+	Name      string `json:"name"`
+	Input     string `json:"input"`
+	Canonical string `json:"canonical"`
+}
+
+// vectors reads testdata/vectors.json, whose canonical forms come from the
+// reference implementation (see testdata/generate.js).
+func vectors(t testing.TB) []vector {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", "vectors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vs []vector
+	if err := json.Unmarshal(raw, &vs); err != nil {
+		t.Fatal(err)
+	}
+	return vs
+}
+
+func TestTransformMatchesReferenceVectors(t *testing.T) {
+	for _, v := range vectors(t) {
+		t.Run(v.Name, func(t *testing.T) {
+			got, err := Transform([]byte(v.Input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != v.Canonical {
+				t.Errorf("got  %s\nwant %s", got, v.Canonical)
+			}
+		})
+	}
+}
+
+func TestMarshalIgnoresGoEncodingChoices(t *testing.T) {
+	// encoding/json escapes HTML and writes struct fields in declaration
+	// order; the canonical form does neither
+	v := struct {
+		Zeta  string            `json:"zeta"`
+		Alpha map[string]string `json:"alpha"`
+	}{Zeta: "<b>&</b>", Alpha: map[string]string{"b": "2", "a": "1"}}
+	got, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"alpha":{"a":"1","b":"2"},"zeta":"<b>&</b>"}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestTransformRejectsDocumentsWithoutACanonicalForm(t *testing.T) {
+	price, _ := new(big.Int).SetString("123456789012345678901", 10)
+	tests := map[string][]byte{
+		"duplicate member": []byte(`{"a":1,"a":2}`),
+		"invalid utf-8":    []byte("\"\xff\""),
+		"rounded integer":  []byte(`12345678901234567`),
+		"trailing data":    []byte(`{} {}`),
+		"out of range":     []byte(`1e400`),
+	}
+	if raw, err := json.Marshal(map[string]*big.Int{"price": price}); err == nil {
+		tests["big.Int"] = raw
+	}
+	for name, raw := range tests {
+		if _, err := Transform(raw); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: err = %v, want ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestVerifyAcceptsLegacyEncodings(t *testing.T) {
+	legacy := []byte(`{"timestamp":1,"capability":{"name":"x"}}`)
+	canonical, _ := Transform(legacy)
+	signedOver := func(want []byte) func([]byte) bool {
+		return func(b []byte) bool { return string(b) == string(want) }
+	}
+	if !Verify(legacy, signedOver(canonical)) || !Verify(legacy, signedOver(legacy)) {
+		t.Error("a document signed in either form didn't verify")
+	}
+	if Verify(legacy, signedOver([]byte(`{}`))) {
+		t.Error("a document signed over other bytes verified")
+	}
+}
+
+// FuzzTransform checks that canonical output is valid, stable and means the
+// same as its input, and matches the reference vectors it is seeded with.
+func FuzzTransform(f *testing.F) {
+	want := map[string]string{}
+	for _, v := range vectors(f) {
+		want[v.Input] = v.Canonical
+		f.Add(v.Input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		got, err := Transform([]byte(input))
+		if err != nil {
+			return
+		}
+		if c, ok := want[input]; ok && string(got) != c {
+			t.Fatalf("Transform(%q) = %s, reference has %s", input, got, c)
+		}
+		again, err := Transform(got)
+		if err != nil || string(again) != string(got) {
+			t.Fatalf("canonical form %s isn't stable: %s, %v", got, again, err)
+		}
+		var in, out interface{}
+		if json.Unmarshal([]byte(input), &in) != nil || json.Unmarshal(got, &out) != nil {
+			t.Fatalf("%q or its canonical form %s doesn't decode", input, got)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("canonical form %s of %q decodes to %v, want %v", got, input, out, in)
+		}
+	})
+}
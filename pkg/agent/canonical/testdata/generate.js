@@ -0,0 +1,22 @@
+// Fills in the "canonical" field of every vector in vectors.json with the
+// output of the reference JCS implementation (RFC 8785, appendix: the
+// ECMAScript canonicalize function). Run with: node generate.js
+const fs = require('fs');
+const path = require('path');
+
+function canonicalize(o) {
+  if (o === null || typeof o !== 'object') {
+    return JSON.stringify(o);
+  }
+  if (Array.isArray(o)) {
+    return '[' + o.map(canonicalize).join(',') + ']';
+  }
+  return '{' + Object.keys(o).sort().map(k => JSON.stringify(k) + ':' + canonicalize(o[k])).join(',') + '}';
+}
+
+const file = path.join(__dirname, 'vectors.json');
+const vectors = JSON.parse(fs.readFileSync(file, 'utf8'));
+for (const v of vectors) {
+  v.canonical = canonicalize(JSON.parse(v.input));
+}
+fs.writeFileSync(file, JSON.stringify(vectors, null, 2) + '\n');
@@ -0,0 +1,440 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// NativeToken names the chain's own currency in budgets and reservations.
+// The stake a bid puts in escrow is paid in it.
+const NativeToken = "ETH"
+
+// Reservation states. Budget is reserved for a bid before it is placed,
+// and locked once the bid has staked it in escrow.
+const (
+	CapitalReserved = "reserved"
+	CapitalLocked   = "locked"
+)
+
+// DefaultReservationTTL is how long budget reserved for a bid is held
+// without the bid being placed.
+const DefaultReservationTTL = 10 * time.Minute
+
+// capitalReconcileInterval is how often reservations are checked against
+// their tasks' escrow state.
+const capitalReconcileInterval = time.Minute
+
+// ErrBudgetExceeded is returned for a bid that would reserve more than is
+// left of its token's budget, or of the wallet's balance.
+var ErrBudgetExceeded = errors.New("bid budget exceeded")
+
+// CapitalReservation is budget held for one task's bid: reserved until the
+// bid is placed, then locked in escrow until the task settles or the bid
+// loses.
+type CapitalReservation struct {
+	TaskID    string `json:"taskId"`
+	Token     string `json:"token"`
+	Amount    string `json:"amount"` // in the token's smallest unit, wei for NativeToken
+	State     string `json:"state"`
+	CreatedAt int64  `json:"createdAt"` // unix ms
+	UpdatedAt int64  `json:"updatedAt"` // unix ms
+}
+
+// TokenCapital is where one token's budget stands.
+type TokenCapital struct {
+	Token     string `json:"token"`
+	Budget    string `json:"budget,omitempty"`  // none if empty
+	Balance   string `json:"balance,omitempty"` // the wallet's, as last read
+	Reserved  string `json:"reserved"`
+	Locked    string `json:"locked"`
+	Available string `json:"available,omitempty"` // what the next bid may reserve; unlimited if empty
+}
+
+// CapitalStatus is served by GET /wallet/budget and in the node status.
+type CapitalStatus struct {
+	Tokens       []TokenCapital       `json:"tokens"`
+	Reservations []CapitalReservation `json:"reservations"`
+}
+
+// CapitalTracker keeps the node from bidding on more than it can stake.
+// Each bid reserves its stake first, and a bid whose stake doesn't fit the
+// token's budget, less what is reserved and locked, is refused. Nor may it
+// exceed the wallet's balance less what is reserved; stakes already locked
+// have left the wallet. Reservations are kept in the store, so they survive
+// a restart.
+type CapitalTracker struct {
+	Budgets    map[string]*big.Int                        // most each token may have reserved and locked at once; tokens without one are bounded by the balance alone
+	Balance    func(token string) (*big.Int, error)       // the wallet's balance of token, or nil if it isn't known; a nil func leaves balances out
+	Tasks      func(taskId *big.Int) (*EscrowTask, error) // reads a task from the escrow, like TaskEscrow.GetTask, for Reconcile; nil never reconciles
+	Worker     common.Address                             // the wallet bids are placed from, to tell a won task from a lost one
+	ReserveTTL time.Duration                              // how long a reservation waits for its bid; 0 means DefaultReservationTTL
+	Clock      Clock                                      // nil means the SystemClock
+	// OnSettled is told of each task this worker was paid for, as Reconcile
+	// releases its stake
+	OnSettled func(taskID string, payment *big.Int)
+
+	store    MetadataStore
+	mu       sync.Mutex
+	held     map[string]CapitalReservation // by task ID
+	balances map[string]*big.Int
+}
+
+// NewCapitalTracker keeps reservations in store, limited to budgets.
+func NewCapitalTracker(store MetadataStore, budgets map[string]*big.Int) *CapitalTracker {
+	return &CapitalTracker{Budgets: budgets, store: store, held: map[string]CapitalReservation{}, balances: map[string]*big.Int{}}
+}
+
+func (c *CapitalTracker) now() time.Time {
+	if c.Clock == nil {
+		return SystemClock.Now()
+	}
+	return c.Clock.Now()
+}
+
+// Load reads the reservations kept in the store.
+func (c *CapitalTracker) Load() error {
+	reservations, err := c.store.ListReservations()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range reservations {
+		c.held[r.TaskID] = r
+	}
+	return nil
+}
+
+// escrowReservation is what a bid on the escrow's taskId is reserved as:
+// the ID the intake records the task under on the primary chain.
+func escrowReservation(taskId *big.Int) string {
+	return eventID(TaskKindEscrow, 0, false, common.Address{}, false, taskId)
+}
+
+// EscrowStake is the stake a bid on a task paying payment puts in escrow.
+func EscrowStake(payment *big.Int) *big.Int {
+	stake := new(big.Int).Mul(payment, big.NewInt(EscrowWorkerStakePercent))
+	return stake.Div(stake, big.NewInt(100))
+}
+
+// Reserve holds amount of token for the bid on taskID, or fails with
+// ErrBudgetExceeded and holds nothing. A task already holding budget keeps
+// what it holds.
+func (c *CapitalTracker) Reserve(taskID, token string, amount *big.Int) error {
+	if c == nil {
+		return nil
+	}
+	var balance *big.Int
+	if c.Balance != nil {
+		var err error
+		if balance, err = c.Balance(token); err != nil {
+			return fmt.Errorf("reading the %s balance: %w", token, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if balance != nil {
+		c.balances[token] = balance
+	}
+	c.expire()
+	if _, ok := c.held[taskID]; ok {
+		return nil
+	}
+	reserved, locked := c.totals(token)
+	if budget, ok := c.Budgets[token]; ok {
+		if total := new(big.Int).Add(reserved, locked); total.Add(total, amount).Cmp(budget) > 0 {
+			return fmt.Errorf("%w: %s %s for %s would bring the %s reserved and %s locked to %s of the %s budget", ErrBudgetExceeded, amount, token, taskID, reserved, locked, total, budget)
+		}
+	}
+	if balance != nil {
+		if total := new(big.Int).Add(reserved, amount); total.Cmp(balance) > 0 {
+			return fmt.Errorf("%w: %s %s for %s would bring the %s reserved to %s, over the wallet's %s", ErrBudgetExceeded, amount, token, taskID, reserved, total, balance)
+		}
+	}
+	now := c.now().UnixMilli()
+	r := CapitalReservation{TaskID: taskID, Token: token, Amount: amount.String(), State: CapitalReserved, CreatedAt: now, UpdatedAt: now}
+	if err := c.store.SaveReservation(r); err != nil {
+		return fmt.Errorf("recording the reservation: %w", err)
+	}
+	c.held[taskID] = r
+	return nil
+}
+
+// Lock notes that the bid on taskID was placed, its reservation staked in
+// escrow.
+func (c *CapitalTracker) Lock(taskID string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.held[taskID]
+	if !ok {
+		return fmt.Errorf("no budget reserved for %s", taskID)
+	}
+	r.State, r.UpdatedAt = CapitalLocked, c.now().UnixMilli()
+	if err := c.store.SaveReservation(r); err != nil {
+		return err
+	}
+	c.held[taskID] = r
+	return nil
+}
+
+// Release frees the budget taskID holds, because its bid lost or wasn't
+// placed, or its task settled.
+func (c *CapitalTracker) Release(taskID, reason string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.release(taskID, reason)
+}
+
+// release frees taskID's budget with c.mu held.
+func (c *CapitalTracker) release(taskID, reason string) {
+	r, ok := c.held[taskID]
+	if !ok {
+		return
+	}
+	if err := c.store.DeleteReservation(taskID); err != nil {
+		fmt.Printf("[Capital] Failed to release %s %s held for %s: %v\n", r.Amount, r.Token, taskID, err)
+		return
+	}
+	delete(c.held, taskID)
+	fmt.Printf("[Capital] Released %s %s %s for %s: %s\n", r.Amount, r.Token, r.State, taskID, reason)
+}
+
+// expire releases reservations whose bid wasn't placed within the TTL.
+// c.mu is held.
+func (c *CapitalTracker) expire() {
+	ttl := c.ReserveTTL
+	if ttl <= 0 {
+		ttl = DefaultReservationTTL
+	}
+	cutoff := c.now().Add(-ttl).UnixMilli()
+	for id, r := range c.held {
+		if r.State == CapitalReserved && r.UpdatedAt <= cutoff {
+			c.release(id, "bid not placed in time")
+		}
+	}
+}
+
+// totals sums what token has reserved and locked. c.mu is held.
+func (c *CapitalTracker) totals(token string) (reserved, locked *big.Int) {
+	reserved, locked = new(big.Int), new(big.Int)
+	for _, r := range c.held {
+		if r.Token != token {
+			continue
+		}
+		amount, _ := new(big.Int).SetString(r.Amount, 10)
+		if amount == nil {
+			continue
+		}
+		if r.State == CapitalLocked {
+			locked.Add(locked, amount)
+		} else {
+			reserved.Add(reserved, amount)
+		}
+	}
+	return reserved, locked
+}
+
+// Reconcile brings reservations up to date with their tasks' escrow: the
+// stake of a task the wallet took is locked, and budget is released for
+// tasks that settled and tasks another worker took. Tasks are looked up by
+// the on-chain ID their record's ID ends in. Reservations whose bid still
+// wasn't placed after the TTL are released last.
+func (c *CapitalTracker) Reconcile() {
+	if c == nil || c.Tasks == nil {
+		return
+	}
+	c.mu.Lock()
+	held := make([]CapitalReservation, 0, len(c.held))
+	for _, r := range c.held {
+		held = append(held, r)
+	}
+	c.mu.Unlock()
+
+	for _, r := range held {
+		taskId, ok := new(big.Int).SetString(r.TaskID[strings.LastIndex(r.TaskID, ":")+1:], 10)
+		if !ok {
+			continue
+		}
+		task, err := c.Tasks(taskId)
+		if errors.Is(err, ErrNoEscrowTask) {
+			c.Release(r.TaskID, "no such task in the escrow")
+			continue
+		} else if err != nil {
+			fmt.Printf("[Capital] Failed to read the escrow of %s: %v\n", r.TaskID, err)
+			continue
+		}
+		switch state := task.StateName(); {
+		case task.Worker != (common.Address{}) && task.Worker != c.Worker:
+			c.Release(r.TaskID, "another worker took the task")
+		case state == "verified" || state == "completed" || state == "refunded":
+			if state != "refunded" && task.Worker == c.Worker && c.OnSettled != nil {
+				c.OnSettled(r.TaskID, task.Payment)
+			}
+			c.Release(r.TaskID, "task "+state)
+		case task.Worker != (common.Address{}) && r.State == CapitalReserved:
+			// Bid from outside the tracker, e.g. with agent escrow bid
+			if err := c.Lock(r.TaskID); err != nil {
+				fmt.Printf("[Capital] Failed to lock the stake of %s: %v\n", r.TaskID, err)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.expire()
+	c.mu.Unlock()
+}
+
+// Snapshot returns each token's budget, balance and holds, and every
+// reservation, oldest first.
+func (c *CapitalTracker) Snapshot() CapitalStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := CapitalStatus{Tokens: []TokenCapital{}, Reservations: []CapitalReservation{}}
+	tokens := map[string]bool{}
+	for token := range c.Budgets {
+		tokens[token] = true
+	}
+	for _, r := range c.held {
+		tokens[r.Token] = true
+		st.Reservations = append(st.Reservations, r)
+	}
+	sort.Slice(st.Reservations, func(i, j int) bool {
+		a, b := st.Reservations[i], st.Reservations[j]
+		return a.CreatedAt < b.CreatedAt || (a.CreatedAt == b.CreatedAt && a.TaskID < b.TaskID)
+	})
+	for token := range tokens {
+		reserved, locked := c.totals(token)
+		tc := TokenCapital{Token: token, Reserved: reserved.String(), Locked: locked.String()}
+		var available *big.Int
+		if budget, ok := c.Budgets[token]; ok {
+			tc.Budget = budget.String()
+			available = new(big.Int).Sub(budget, reserved)
+			available.Sub(available, locked)
+		}
+		if balance, ok := c.balances[token]; ok {
+			tc.Balance = balance.String()
+			if free := new(big.Int).Sub(balance, reserved); available == nil || free.Cmp(available) < 0 {
+				available = free
+			}
+		}
+		if available != nil {
+			if available.Sign() < 0 {
+				available.SetInt64(0)
+			}
+			tc.Available = available.String()
+		}
+		st.Tokens = append(st.Tokens, tc)
+	}
+	sort.Slice(st.Tokens, func(i, j int) bool { return st.Tokens[i].Token < st.Tokens[j].Token })
+	return st
+}
+
+// ParseBudget reads a budget given as [token=]amount, the token being
+// NativeToken if it is left out.
+func ParseBudget(s string) (token string, amount *big.Int, err error) {
+	token, value := NativeToken, s
+	if i := strings.LastIndex(s, "="); i >= 0 {
+		token, value = strings.TrimSpace(s[:i]), s[i+1:]
+	}
+	amount, ok := new(big.Int).SetString(strings.TrimSpace(value), 10)
+	if !ok || amount.Sign() < 0 || token == "" {
+		return "", nil, fmt.Errorf("invalid budget %q: want [token=]amount", s)
+	}
+	if common.IsHexAddress(token) {
+		token = common.HexToAddress(token).Hex()
+	}
+	return token, amount, nil
+}
+
+// capitalStep loads the reservations kept across restarts, then checks
+// them against their tasks' escrow until the node stops.
+func (n *AgentNode) capitalStep() BootStep {
+	return BootStep{Name: "capital", After: []string{"store"}, Run: func(context.Context) error {
+		if n.Capital == nil {
+			return nil
+		}
+		if err := n.Capital.Load(); err != nil {
+			return err
+		}
+		if n.Capital.OnSettled == nil && n.Analytics != nil {
+			n.Capital.OnSettled = func(taskID string, payment *big.Int) {
+				if err := n.Analytics.Settle(taskID, payment); err != nil {
+					fmt.Printf("[Analytics] Failed to credit the payment of %s: %v\n", taskID, err)
+				}
+			}
+		}
+		if n.Capital.Tasks == nil {
+			return nil
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			if err := n.WaitReady(n.ctx); err != nil {
+				return
+			}
+			ticker := time.NewTicker(capitalReconcileInterval)
+			defer ticker.Stop()
+			for {
+				n.Capital.Reconcile()
+				select {
+				case <-n.ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+		return nil
+	}}
+}
+
+// SaveReservation records budget held for a task's bid.
+func (s *sqlStore) SaveReservation(r CapitalReservation) error {
+	_, err := s.exec(`
+		INSERT INTO capital_reservations (task_id, token, amount, state, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(task_id) DO UPDATE SET token = excluded.token, amount = excluded.amount,
+			state = excluded.state, updated_at = excluded.updated_at`,
+		r.TaskID, r.Token, r.Amount, r.State, r.CreatedAt, r.UpdatedAt)
+	return err
+}
+
+func (s *sqlStore) DeleteReservation(taskID string) error {
+	_, err := s.exec("DELETE FROM capital_reservations WHERE task_id = ?", taskID)
+	return err
+}
+
+// ListReservations returns the budget held for bids, oldest first.
+func (s *sqlStore) ListReservations() ([]CapitalReservation, error) {
+	rows, err := s.query(`
+		SELECT task_id, token, amount, state, created_at, updated_at
+		FROM capital_reservations ORDER BY created_at, task_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []CapitalReservation
+	for rows.Next() {
+		var r CapitalReservation
+		if err := rows.Scan(&r.TaskID, &r.Token, &r.Amount, &r.State, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
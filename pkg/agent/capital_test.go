@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestConcurrentBidsDontOverReserve(t *testing.T) {
+	store := newTestStore(t)
+	capital := NewCapitalTracker(store, map[string]*big.Int{NativeToken: big.NewInt(1000)})
+	capital.Balance = func(string) (*big.Int, error) { return big.NewInt(10000), nil }
+	// 900 is held already; 20 bids of 30 race for the last 100
+	for i := 0; i < 3; i++ {
+		if err := capital.Reserve(fmt.Sprintf("task:held-%d", i), NativeToken, big.NewInt(300)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := capital.Lock("task:held-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won, refused := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := capital.Reserve(fmt.Sprintf("task:%d", i), NativeToken, big.NewInt(30))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				won++
+			case errors.Is(err, ErrBudgetExceeded):
+				refused++
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if won != 3 || refused != 17 {
+		t.Errorf("%d bids reserved and %d were refused, want 3 and 17", won, refused)
+	}
+
+	st := capital.Snapshot()
+	if len(st.Tokens) != 1 {
+		t.Fatalf("tokens = %+v", st.Tokens)
+	}
+	if tc := st.Tokens[0]; tc.Reserved != "690" || tc.Locked != "300" || tc.Available != "10" {
+		t.Errorf("%s: %s reserved, %s locked, %s available, want 690, 300 and 10", tc.Token, tc.Reserved, tc.Locked, tc.Available)
+	}
+	kept, err := store.ListReservations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 6 {
+		t.Errorf("%d reservations kept, want 6", len(kept))
+	}
+
+	// Reserving again for a task that holds budget takes no more
+	if err := capital.Reserve("task:held-1", NativeToken, big.NewInt(300)); err != nil {
+		t.Errorf("reserving again: %v", err)
+	}
+	capital.Release("task:held-1", "bid lost")
+	if err := capital.Reserve("task:late", NativeToken, big.NewInt(300)); err != nil {
+		t.Errorf("reserving released budget: %v", err)
+	}
+}
+
+func TestBidsAreBoundedByTheWalletBalance(t *testing.T) {
+	capital := NewCapitalTracker(newTestStore(t), nil)
+	capital.Balance = func(string) (*big.Int, error) { return big.NewInt(100), nil }
+	if err := capital.Reserve("task:1", NativeToken, big.NewInt(60)); err != nil {
+		t.Fatal(err)
+	}
+	if err := capital.Reserve("task:2", NativeToken, big.NewInt(60)); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("overdrawing the wallet: %v", err)
+	}
+}
+
+func TestReconcileFollowsTheEscrow(t *testing.T) {
+	store := newTestStore(t)
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	self, other := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	tasks := map[int64]*EscrowTask{
+		1: {Worker: self, State: 1},  // accepted by us
+		2: {Worker: other, State: 1}, // accepted by someone else
+		3: {Worker: self, State: 5},  // completed
+		4: {State: 0},                // still open
+	}
+	newTracker := func() *CapitalTracker {
+		c := NewCapitalTracker(store, map[string]*big.Int{NativeToken: big.NewInt(1000)})
+		c.Worker, c.Clock = self, clock
+		c.Tasks = func(taskId *big.Int) (*EscrowTask, error) {
+			if task, ok := tasks[taskId.Int64()]; ok {
+				return task, nil
+			}
+			return nil, ErrNoEscrowTask
+		}
+		return c
+	}
+	capital := newTracker()
+	for _, id := range []string{"task:1", "task:2", "task:3", "task:4", "task:5"} {
+		if err := capital.Reserve(id, NativeToken, big.NewInt(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A restarted node picks up where the last left off
+	capital = newTracker()
+	if err := capital.Load(); err != nil {
+		t.Fatal(err)
+	}
+	capital.Reconcile()
+	st := capital.Snapshot()
+	if len(st.Reservations) != 2 {
+		t.Fatalf("reservations = %+v, want task:1 and task:4", st.Reservations)
+	}
+	if r := st.Reservations[0]; r.TaskID != "task:1" || r.State != CapitalLocked {
+		t.Errorf("won bid: %+v, want it locked", r)
+	}
+	if r := st.Reservations[1]; r.TaskID != "task:4" || r.State != CapitalReserved {
+		t.Errorf("open task: %+v, want it still reserved", r)
+	}
+
+	// The open task's bid was never placed
+	clock.Advance(DefaultReservationTTL)
+	capital.Reconcile()
+	if st := capital.Snapshot(); len(st.Reservations) != 1 || st.Reservations[0].TaskID != "task:1" {
+		t.Errorf("reservations = %+v, want task:1 alone", st.Reservations)
+	}
+}
+
+func TestIntakeSkipsBidsOverBudget(t *testing.T) {
+	in := NewTaskIntake(newTestStore(t), nil, nil)
+	// Stakes are 10% of the payment: room for one bid on a 1000 wei task
+	in.UseCapital(NewCapitalTracker(newTestStore(t), map[string]*big.Int{NativeToken: big.NewInt(150)}))
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(1), Payment: big.NewInt(1000)}); d.Action != ActionBid {
+		t.Errorf("first bid: %+v", d)
+	}
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(2), Payment: big.NewInt(1000)}); d.Action != ActionSkip || d.Code != "" {
+		t.Errorf("bid over budget: %+v, want an uncoded skip", d)
+	}
+}
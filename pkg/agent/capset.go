@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+)
+
+// CapabilitySet holds the capabilities a node advertises. It is safe for
+// concurrent use: each change happens under its lock, and readers take a
+// Snapshot, a copy later changes don't touch, so an announcement or query
+// never sees a set partway through a change.
+type CapabilitySet struct {
+	mu      sync.RWMutex
+	entries map[string]advertisedCapability
+	changed chan struct{} // signalled after a change, for the announcer
+}
+
+// advertisedCapability is a capability with the wallet it is advertised
+// under, for reputation lookups; "" for none.
+type advertisedCapability struct {
+	AgentCapability
+	ethAddress string
+}
+
+func NewCapabilitySet() *CapabilitySet {
+	return &CapabilitySet{entries: map[string]advertisedCapability{}, changed: make(chan struct{}, 1)}
+}
+
+// Add advertises caps under ethAddress as one change, replacing any of the
+// same names.
+func (s *CapabilitySet) Add(ethAddress string, caps ...AgentCapability) {
+	s.mu.Lock()
+	for _, c := range caps {
+		s.entries[c.Name] = advertisedCapability{AgentCapability: c, ethAddress: ethAddress}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Remove withdraws the named capabilities as one change and reports how
+// many were advertised.
+func (s *CapabilitySet) Remove(names ...string) int {
+	s.mu.Lock()
+	removed := 0
+	for _, name := range names {
+		if _, ok := s.entries[name]; ok {
+			delete(s.entries, name)
+			removed++
+		}
+	}
+	s.mu.Unlock()
+	if removed > 0 {
+		s.notify()
+	}
+	return removed
+}
+
+func (s *CapabilitySet) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns the advertised capability named name.
+func (s *CapabilitySet) Get(name string) (AgentCapability, bool) {
+	if s == nil {
+		return AgentCapability{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[name]
+	return e.AgentCapability, ok
+}
+
+// Snapshot returns the advertised capabilities, sorted by name. A nil
+// *CapabilitySet has none.
+func (s *CapabilitySet) Snapshot() []AgentCapability {
+	entries := s.snapshot()
+	caps := make([]AgentCapability, len(entries))
+	for i, e := range entries {
+		caps[i] = e.AgentCapability
+	}
+	return caps
+}
+
+// snapshot is Snapshot with the wallet each capability is advertised under.
+func (s *CapabilitySet) snapshot() []advertisedCapability {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	entries := make([]advertisedCapability, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	s.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
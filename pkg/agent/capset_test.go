@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCapabilitySetSnapshotsAreConsistent(t *testing.T) {
+	s := NewCapabilitySet()
+	s.Add("", AgentCapability{Name: "stable"})
+
+	// Writers add and withdraw capabilities in pairs; a snapshot must never
+	// hold half a pair
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				a, b := fmt.Sprintf("w%d-%d-a", w, i), fmt.Sprintf("w%d-%d-b", w, i)
+				s.Add("", AgentCapability{Name: a}, AgentCapability{Name: b})
+				s.Remove(a, b)
+			}
+		}(w)
+	}
+	var readers sync.WaitGroup
+	var bad []string
+	var mu sync.Mutex
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				snap := s.Snapshot()
+				names := map[string]bool{}
+				for _, c := range snap {
+					names[c.Name] = true
+				}
+				for name := range names {
+					pair := strings.TrimSuffix(name, "-a") + "-b"
+					if strings.HasSuffix(name, "-a") && !names[pair] {
+						mu.Lock()
+						bad = append(bad, name)
+						mu.Unlock()
+					}
+				}
+				if !names["stable"] {
+					mu.Lock()
+					bad = append(bad, "stable missing")
+					mu.Unlock()
+				}
+				// A snapshot is the reader's own
+				if len(snap) > 0 {
+					snap[0].Name = "scribbled"
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	if len(bad) > 0 {
+		t.Errorf("snapshots held half a change: %v", bad[:min(len(bad), 5)])
+	}
+	if snap := s.Snapshot(); len(snap) != 1 || snap[0].Name != "stable" {
+		t.Errorf("set = %+v, want only stable", snap)
+	}
+}
+
+func TestAnnouncementsFollowRegistrations(t *testing.T) {
+	n := startTestNode(t)
+	sub, err := n.DiscoveryTopic.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+
+	// Register and withdraw while the announcer runs
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				name := fmt.Sprintf("churn-%d-%d", w, i)
+				n.AdvertiseCapability(AgentCapability{Name: name})
+				n.CanHandle(name)
+				n.WithdrawCapability(name)
+			}
+		}(w)
+	}
+	n.AdvertiseCapability(AgentCapability{Name: "keep"})
+	wg.Wait()
+	if caps := n.AdvertisedCapabilities(); len(caps) != 1 || caps[0].Name != "keep" {
+		t.Fatalf("advertised %+v, want only keep", caps)
+	}
+
+	// Once the churn's announcements are through, a change announces
+	// exactly the set
+	next := func(wait time.Duration) (AgentCapability, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		defer cancel()
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return AgentCapability{}, err
+		}
+		var packet SignedPacket
+		var data struct {
+			Capability AgentCapability `json:"capability"`
+		}
+		json.Unmarshal(msg.Data, &packet)
+		json.Unmarshal([]byte(packet.Data), &data)
+		return data.Capability, nil
+	}
+	for {
+		if _, err := next(300 * time.Millisecond); err != nil {
+			break
+		}
+	}
+	n.AdvertiseCapability(AgentCapability{Name: "keep", Description: "updated"})
+	c, err := next(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "keep" || c.Description != "updated" {
+		t.Errorf("announced %+v after the update, want keep as updated", c)
+	}
+}
@@ -0,0 +1,930 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Limits of the knowledge catalog. An artifact travels whole in one
+// knowledge message, so it has to fit in one with room to spare.
+const (
+	DefaultCatalogPageSize = 50
+	MaxCatalogPageSize     = 100
+	MaxListingPreview      = 16 << 10
+	MaxListingArtifact     = 2 << 20
+)
+
+// Request and reply types of the catalog protocol. A query is answered with
+// a catalog message carrying a CatalogPage; a purchase, once the artifact
+// was delivered, with a purchased message naming the delivery.
+const (
+	catalogQuery      = "query"
+	catalogPurchase   = "purchase"
+	MessageCatalog    = "catalog"
+	MessagePurchased  = "purchased"
+	catalogTaskPrefix = "catalog:"
+)
+
+// catalogAnnounceMax caps the listings one gossip announcement carries; the
+// rest are a catalog query away.
+const catalogAnnounceMax = 32
+
+// purchaseTimeout bounds how long a buyer waits for the artifact once it
+// paid for it.
+const purchaseTimeout = 2 * time.Minute
+
+// catalogAnnounceInterval is how often the node announces its catalog, and
+// a third of how long peers keep an announcement. It is a variable so tests
+// can shorten it.
+var catalogAnnounceInterval = 30 * time.Second
+
+// ErrNoListing is returned for a listing ID the catalog doesn't have.
+var ErrNoListing = errors.New("no such listing")
+
+// CatalogListing is a piece of knowledge the node sells: an artifact file,
+// described by a title and topic tags, at a fixed price. Buyers see the
+// preview before paying and check what they get against ArtifactHash.
+type CatalogListing struct {
+	ID           string   `json:"id"`
+	Title        string   `json:"title"`
+	Topics       []string `json:"topics,omitempty"`
+	Price        string   `json:"price"`        // wei, decimal
+	ArtifactHash string   `json:"artifactHash"` // keccak256 of the artifact; the AssetHash its purchase negotiates
+	Size         int64    `json:"size"`         // artifact bytes
+	Preview      string   `json:"preview,omitempty"`
+	Seller       string   `json:"seller,omitempty"` // peer ID, set by whoever served the listing
+	CreatedAt    int64    `json:"createdAt"`
+	UpdatedAt    int64    `json:"updatedAt"`
+	ArtifactPath string   `json:"-"` // where the seller keeps the artifact; never sent
+	// Unverified marks a listing learned from a catalog announcement whose
+	// signature didn't verify, taken under VerifyPermissive
+	Unverified bool `json:"unverified,omitempty"`
+}
+
+// PriceWei is the listing's price, or nil if it isn't a decimal number.
+func (l CatalogListing) PriceWei() *big.Int {
+	p, ok := new(big.Int).SetString(l.Price, 10)
+	if !ok || p.Sign() < 0 {
+		return nil
+	}
+	return p
+}
+
+// HasTopic reports whether the listing is tagged topic; every listing has
+// the empty topic.
+func (l CatalogListing) HasTopic(topic string) bool {
+	if topic == "" {
+		return true
+	}
+	topic = strings.ToLower(strings.TrimSpace(topic))
+	for _, t := range l.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// summary is the listing without its preview, as announced and carried in
+// the agent card.
+func (l CatalogListing) summary() CatalogListing {
+	l.Preview, l.ArtifactPath = "", ""
+	return l
+}
+
+// CatalogTopic is the market topic a purchase of listing id is paid under.
+func CatalogTopic(id string) string {
+	return catalogTaskPrefix + id
+}
+
+// NewListing describes the artifact file at artifactPath for sale at price
+// wei. Topics are lowercased and deduplicated; the preview is cut to
+// MaxListingPreview bytes.
+func NewListing(title string, topics []string, price *big.Int, artifactPath, preview string) (*CatalogListing, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return nil, errors.New("a listing needs a title")
+	}
+	if price == nil || price.Sign() < 0 {
+		return nil, errors.New("a listing needs a non-negative price")
+	}
+	path, err := filepath.Abs(artifactPath)
+	if err != nil {
+		return nil, err
+	}
+	artifact, err := readArtifact(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(preview) > MaxListingPreview {
+		preview = preview[:MaxListingPreview]
+	}
+	seen := map[string]bool{}
+	var tags []string
+	for _, t := range topics {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	return &CatalogListing{
+		Title:        title,
+		Topics:       tags,
+		Price:        price.String(),
+		ArtifactHash: HashAsset(artifact),
+		Size:         int64(len(artifact)),
+		Preview:      preview,
+		ArtifactPath: path,
+	}, nil
+}
+
+// ListingSpec is a listing to add, as the control API and CLI take it.
+type ListingSpec struct {
+	Title    string   `json:"title"`
+	Topics   []string `json:"topics,omitempty"`
+	Price    string   `json:"price"`    // wei, decimal
+	Artifact string   `json:"artifact"` // path of the artifact file
+	Preview  string   `json:"preview,omitempty"`
+}
+
+// Listing builds the listing spec describes, as NewListing does.
+func (spec ListingSpec) Listing() (*CatalogListing, error) {
+	price, ok := new(big.Int).SetString(spec.Price, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid price %q: want wei, in decimal", spec.Price)
+	}
+	return NewListing(spec.Title, spec.Topics, price, spec.Artifact, spec.Preview)
+}
+
+// readArtifact reads an artifact file, refusing one too large to deliver.
+func readArtifact(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MaxListingArtifact {
+		return nil, fmt.Errorf("artifact %s is %d bytes, more than the %d a listing may sell", path, info.Size(), MaxListingArtifact)
+	}
+	return os.ReadFile(path)
+}
+
+// AddListing puts l in the catalog kept in store, giving it an ID if it has
+// none. An artifact is listed once, so a negotiation over its hash has one
+// price.
+func AddListing(store MetadataStore, l *CatalogListing) error {
+	if l.ArtifactPath == "" || l.PriceWei() == nil {
+		return errors.New("listing has no artifact or no valid price; build it with NewListing")
+	}
+	if prev, err := store.GetListingByAsset(l.ArtifactHash); err != nil {
+		return err
+	} else if prev != nil && prev.ID != l.ID {
+		return fmt.Errorf("artifact %s is already listed as %s", l.ArtifactHash, prev.ID)
+	}
+	now := time.Now().Unix()
+	if l.ID == "" {
+		l.ID = newMessageID()[:16]
+		l.CreatedAt = now
+	}
+	l.UpdatedAt = now
+	return store.SaveListing(*l)
+}
+
+// AddListing puts l in the node's catalog and announces it.
+func (n *AgentNode) AddListing(l *CatalogListing) error {
+	if err := AddListing(n.Store, l); err != nil {
+		return err
+	}
+	c := n.catalogs()
+	c.nudge()
+	c.mu.Lock()
+	booted := c.booted
+	c.mu.Unlock()
+	if booted {
+		n.startCatalogAnnouncer(c)
+	}
+	return nil
+}
+
+// RemoveListing takes a listing out of the node's catalog.
+func (n *AgentNode) RemoveListing(id string) error {
+	l, err := n.Store.GetListing(id)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return fmt.Errorf("%w: %s", ErrNoListing, id)
+	}
+	if err := n.Store.DeleteListing(id); err != nil {
+		return err
+	}
+	n.catalogs().nudge()
+	return nil
+}
+
+// Listings returns the node's own listings tagged topic, or all for "", by
+// ID.
+func (n *AgentNode) Listings(topic string) ([]CatalogListing, error) {
+	all, err := n.Store.ListListings()
+	if err != nil {
+		return nil, err
+	}
+	var out []CatalogListing
+	for _, l := range all {
+		if l.HasTopic(topic) {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+// CatalogPage is one page of a catalog query. Next is the cursor of the
+// following page, empty on the last.
+type CatalogPage struct {
+	Listings []CatalogListing `json:"listings"`
+	Next     string           `json:"next,omitempty"`
+}
+
+// pageListings returns up to limit of listings, which are sorted by ID,
+// after cursor.
+func pageListings(listings []CatalogListing, cursor string, limit int) CatalogPage {
+	if limit <= 0 {
+		limit = DefaultCatalogPageSize
+	}
+	if limit > MaxCatalogPageSize {
+		limit = MaxCatalogPageSize
+	}
+	i := sort.Search(len(listings), func(i int) bool { return listings[i].ID > cursor })
+	page := CatalogPage{Listings: []CatalogListing{}}
+	for ; i < len(listings) && len(page.Listings) < limit; i++ {
+		page.Listings = append(page.Listings, listings[i])
+	}
+	if i < len(listings) {
+		page.Next = page.Listings[len(page.Listings)-1].ID
+	}
+	return page
+}
+
+// catalogState holds the catalogs peers announced or were synced from, and
+// wakes the announcer when the node's own catalog changes.
+type catalogState struct {
+	mu      sync.Mutex
+	remote  map[string]remoteCatalog // by seller peer ID
+	changed chan struct{}
+	booted  bool // the catalog boot step has run
+	once    sync.Once
+}
+
+type remoteCatalog struct {
+	listings []CatalogListing
+	seen     time.Time
+}
+
+// catalogs returns the node's catalog state, creating it on first use.
+func (n *AgentNode) catalogs() *catalogState {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.catalog == nil {
+		n.catalog = &catalogState{remote: map[string]remoteCatalog{}, changed: make(chan struct{}, 1)}
+	}
+	return n.catalog
+}
+
+func (c *catalogState) nudge() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// learn replaces what is known of seller's catalog, marking its listings
+// unverified unless verified.
+func (c *catalogState) learn(seller string, listings []CatalogListing, verified bool) {
+	for i := range listings {
+		listings[i].Seller, listings[i].ArtifactPath, listings[i].Unverified = seller, "", !verified
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remote[seller] = remoteCatalog{listings: listings, seen: time.Now()}
+}
+
+// KnownListings returns the listings peers announced or were synced from
+// recently, tagged topic or all for "", by seller and ID.
+func (n *AgentNode) KnownListings(topic string) []CatalogListing {
+	c := n.catalogs()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []CatalogListing
+	for seller, rc := range c.remote {
+		if time.Since(rc.seen) > 3*catalogAnnounceInterval {
+			delete(c.remote, seller)
+			continue
+		}
+		for _, l := range rc.listings {
+			if l.HasTopic(topic) && !n.Store.IsPeerBlocked(seller) {
+				out = append(out, l)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Seller != out[j].Seller {
+			return out[i].Seller < out[j].Seller
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// catalogStep starts the catalog announcer once the store and host are up,
+// if the node has anything listed; otherwise the first AddListing does.
+func (n *AgentNode) catalogStep() BootStep {
+	return BootStep{Name: "catalog", After: []string{"store", "host"}, Run: func(context.Context) error {
+		c := n.catalogs()
+		c.mu.Lock()
+		c.booted = true
+		c.mu.Unlock()
+		listings, err := n.Store.ListListings()
+		if err != nil {
+			return err
+		}
+		if len(listings) > 0 {
+			n.startCatalogAnnouncer(c)
+		}
+		return nil
+	}}
+}
+
+// startCatalogAnnouncer starts announceCatalog on first use.
+func (n *AgentNode) startCatalogAnnouncer(c *catalogState) {
+	c.once.Do(func() {
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			n.announceCatalog(c)
+		}()
+	})
+}
+
+// announceCatalog publishes the node's catalog on the knowledge discovery
+// topic every catalogAnnounceInterval and whenever it changes, until the
+// node stops. A node with nothing listed announces nothing.
+func (n *AgentNode) announceCatalog(c *catalogState) {
+	if err := n.WaitReady(n.ctx); err != nil {
+		return
+	}
+	ticker := time.NewTicker(catalogAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		if err := n.broadcastCatalog(); err != nil {
+			fmt.Printf("[Catalog] Announcement failed: %v\n", err)
+		}
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.changed:
+		}
+	}
+}
+
+// catalogAnnouncement is the data of a signed catalog announcement.
+type catalogAnnouncement struct {
+	Catalog *struct {
+		Listings []CatalogListing `json:"listings"`
+		Total    int              `json:"total"`
+	} `json:"catalog"`
+}
+
+func (n *AgentNode) broadcastCatalog() error {
+	listings, err := n.Store.ListListings()
+	if err != nil || len(listings) == 0 {
+		return err
+	}
+	summaries := make([]CatalogListing, 0, catalogAnnounceMax)
+	for i := 0; i < len(listings) && i < catalogAnnounceMax; i++ {
+		summaries = append(summaries, listings[i].summary())
+	}
+	dataBytes, err := canonical.Marshal(map[string]interface{}{
+		"catalog":   map[string]interface{}{"listings": summaries, "total": len(listings)},
+		"timestamp": time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	// Announce under the current identity, which rotation may have changed
+	n.mu.RLock()
+	h, topic, priv := n.Host, n.KnowledgeTopic, n.privKey
+	n.mu.RUnlock()
+	sig, err := signData(priv, dataBytes)
+	if err != nil {
+		return err
+	}
+	bytes, _ := json.Marshal(SignedPacket{Data: string(dataBytes), PeerID: h.ID().String(), Signature: sig})
+	bytes = n.pubsubData(bytes)
+	if n.Publisher != nil {
+		n.Publisher.Publish(topic, bytes)
+		return nil
+	}
+	if err := topic.Publish(n.ctx, bytes); err != nil && n.ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// handleCatalogAnnouncement records a peer's announced catalog. It reports
+// false when the signature doesn't verify and the catalog was rejected for
+// it.
+func (n *AgentNode) handleCatalogAnnouncement(packet SignedPacket) bool {
+	if n.Store.IsPeerBlocked(packet.PeerID) {
+		return true
+	}
+	accept, verified := n.Verification.admit("catalog", packet.PeerID, packet.Verify)
+	if !accept {
+		return false
+	}
+	var data catalogAnnouncement
+	if err := json.Unmarshal([]byte(packet.Data), &data); err != nil || data.Catalog == nil {
+		return true
+	}
+	n.catalogs().learn(packet.PeerID, data.Catalog.Listings, verified)
+	return true
+}
+
+// catalogRequest is a request of the catalog protocol.
+type catalogRequest struct {
+	Type     string         `json:"type"`
+	Topic    string         `json:"topic,omitempty"`  // query: only listings tagged this
+	ID       string         `json:"id,omitempty"`     // query: only this listing
+	Cursor   string         `json:"cursor,omitempty"` // query: the Next of the previous page
+	Limit    int            `json:"limit,omitempty"`  // query: 0 means DefaultCatalogPageSize
+	Purchase *purchaseOrder `json:"purchase,omitempty"`
+}
+
+// purchaseOrder asks the seller to deliver a listing the buyer agreed a
+// price for and paid into the market as request RequestID. The agreement
+// is the one both signed, which the seller may not have saved yet.
+type purchaseOrder struct {
+	ListingID string    `json:"listingId"`
+	Agreement Agreement `json:"agreement"`
+	ChainID   uint64    `json:"chainId,omitempty"`
+	Market    string    `json:"market"`
+	RequestID string    `json:"requestId"`
+}
+
+// purchaseReply names the delivery a purchased artifact came in.
+type purchaseReply struct {
+	DeliveryID string `json:"deliveryId"`
+}
+
+// handleCatalog serves the node's catalog to a peer and sells it listings.
+func (n *AgentNode) handleCatalog(s network.Stream) {
+	if n.checkBlocked(s) {
+		return
+	}
+	data, ok := n.readRequest(s)
+	if !ok {
+		return
+	}
+	var req catalogRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		n.misbehaved(s, ViolationProtocolError)
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "invalid JSON: " + err.Error()})
+		return
+	}
+	self := s.Conn().LocalPeer().String()
+	switch req.Type {
+	case catalogQuery:
+		var listings []CatalogListing
+		if req.ID != "" {
+			l, err := n.Store.GetListing(req.ID)
+			if err != nil {
+				n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "catalog unavailable", Retryable: true})
+				return
+			}
+			if l == nil || !l.HasTopic(req.Topic) {
+				n.replyError(s, ErrorPayload{Code: ErrCodeNotFound, Message: fmt.Sprintf("no listing %q", req.ID)})
+				return
+			}
+			listings = []CatalogListing{*l}
+		} else {
+			var err error
+			if listings, err = n.Listings(req.Topic); err != nil {
+				n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "catalog unavailable", Retryable: true})
+				return
+			}
+		}
+		page := pageListings(listings, req.Cursor, req.Limit)
+		for i := range page.Listings {
+			page.Listings[i].Seller = self
+		}
+		writeMessage(s, AgentMessage{Type: MessageCatalog, Payload: page, Sender: self, Timestamp: time.Now().UnixMilli()})
+
+	case catalogPurchase:
+		if req.Purchase == nil {
+			n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "a purchase needs an order"})
+			return
+		}
+		deliveryID, perr := n.sell(n.ctx, self, s.Conn().RemotePeer().String(), *req.Purchase)
+		if perr != nil {
+			n.replyError(s, *perr)
+			return
+		}
+		writeMessage(s, AgentMessage{Type: MessagePurchased, Payload: purchaseReply{DeliveryID: deliveryID}, Sender: self, Timestamp: time.Now().UnixMilli()})
+
+	default:
+		n.replyError(s, ErrorPayload{Code: ErrCodeUnsupported, Message: fmt.Sprintf("unsupported request type %q", req.Type)})
+	}
+}
+
+// sell checks a purchase order from buyer against the listing, the
+// agreement they negotiated and the request the buyer paid into the market,
+// then delivers the artifact. The bounty is collected when the delivery
+// settles.
+func (n *AgentNode) sell(ctx context.Context, self, buyer string, o purchaseOrder) (string, *ErrorPayload) {
+	l, err := n.Store.GetListing(o.ListingID)
+	if err != nil {
+		return "", &ErrorPayload{Code: ErrCodeInternal, Message: "catalog unavailable", Retryable: true}
+	}
+	if l == nil {
+		return "", &ErrorPayload{Code: ErrCodeNotFound, Message: fmt.Sprintf("no listing %q", o.ListingID)}
+	}
+	a := &o.Agreement
+	switch {
+	case a.Responder != self || !a.Verify():
+		return "", &ErrorPayload{Code: ErrCodeForbidden, Message: "the agreement isn't one this node signed"}
+	case a.Requester != buyer:
+		return "", &ErrorPayload{Code: ErrCodeForbidden, Message: "the agreement is another peer's"}
+	case a.AssetHash != l.ArtifactHash || a.Price == nil || a.Price.Cmp(l.PriceWei()) < 0:
+		return "", &ErrorPayload{Code: ErrCodeBadRequest, Message: "the agreement isn't for this listing at its price"}
+	case a.Expiry < time.Now().UnixMilli():
+		return "", &ErrorPayload{Code: ErrCodeBadRequest, Message: "the agreement expired"}
+	}
+
+	market := n.marketAt(o.ChainID, o.Market)
+	if market == nil {
+		return "", &ErrorPayload{Code: ErrCodeBadRequest, Message: fmt.Sprintf("unknown market %s on chain %d", o.Market, o.ChainID)}
+	}
+	requestId, ok := new(big.Int).SetString(o.RequestID, 10)
+	if !ok {
+		return "", &ErrorPayload{Code: ErrCodeBadRequest, Message: fmt.Sprintf("invalid request ID %q", o.RequestID)}
+	}
+	req, err := market.GetRequest(requestId)
+	switch {
+	case errors.Is(err, ErrNoMarketRequest):
+		return "", &ErrorPayload{Code: ErrCodeNotFound, Message: err.Error()}
+	case err != nil:
+		return "", &ErrorPayload{Code: ErrCodeInternal, Message: "reading the market failed", Retryable: true}
+	case req.Topic != CatalogTopic(l.ID):
+		return "", &ErrorPayload{Code: ErrCodeBadRequest, Message: fmt.Sprintf("request %s is for %q, not this listing", requestId, req.Topic)}
+	case req.Bounty.Cmp(a.Price) < 0:
+		return "", &ErrorPayload{Code: ErrCodeBadRequest, Message: fmt.Sprintf("request %s pays %s, less than the agreed %s", requestId, req.Bounty, a.Price)}
+	case req.Fulfilled:
+		return "", &ErrorPayload{Code: ErrCodeForbidden, Message: fmt.Sprintf("request %s was already fulfilled", requestId)}
+	case a.RequesterWallet != "" && !sameAddress(a.RequesterWallet, req.Requester.Hex()):
+		return "", &ErrorPayload{Code: ErrCodeForbidden, Message: fmt.Sprintf("request %s was paid by %s, not the buyer's wallet", requestId, req.Requester.Hex())}
+	}
+
+	artifact, err := readArtifact(l.ArtifactPath)
+	if err != nil || HashAsset(artifact) != l.ArtifactHash {
+		fmt.Printf("[Catalog] Artifact of listing %s is missing or changed: %v\n", l.ID, err)
+		return "", &ErrorPayload{Code: ErrCodeInternal, Message: "the artifact is unavailable"}
+	}
+	answer := KnowledgeAnswer{RequestID: requestId.String(), ChainID: o.ChainID, Topic: req.Topic,
+		Content: base64.StdEncoding.EncodeToString(artifact), Market: market.Address().Hex()}
+	if n.Wallet != nil {
+		answer.Provider = n.Wallet.Address.Hex()
+	}
+	d, err := n.DeliverKnowledge(ctx, CatalogTopic(l.ID)+":"+requestId.String(), buyer, answer)
+	if d == nil || (d.Status != DeliveryAcked && d.Status != DeliverySettled) {
+		return "", &ErrorPayload{Code: ErrCodeInternal, Message: fmt.Sprintf("delivering the artifact failed: %v", err), Retryable: true}
+	}
+	if err != nil {
+		// Delivered all the same; ResumeDeliveries collects the bounty later
+		fmt.Printf("[Catalog] Sold listing %s to %s, but %v\n", l.ID, n.Names.Display(buyer), err)
+	}
+	n.Events.Add("catalog_sold", map[string]string{"listing": l.ID, "peerId": buyer, "requestId": requestId.String(), "price": a.Price.String()})
+	return d.ID, nil
+}
+
+// marketAt returns the knowledge market at addr on chainID that the node
+// knows, as its Market or one of its Chains' markets, or nil.
+func (n *AgentNode) marketAt(chainID uint64, addr string) *KnowledgeMarket {
+	if !common.IsHexAddress(addr) {
+		return nil
+	}
+	want := common.HexToAddress(addr)
+	if m := n.Market; m != nil && m.addr == want && (chainID == 0 || m.client.ChainID() == 0 || m.client.ChainID() == chainID) {
+		return m
+	}
+	if c := n.Chain(chainID); c != nil && c.Client != nil {
+		for _, m := range c.Profile.Markets {
+			if common.HexToAddress(m) == want {
+				return NewKnowledgeMarket(c.Client, m)
+			}
+		}
+	}
+	return nil
+}
+
+// settlePurchase collects the bounty of a delivered purchase by fulfilling
+// its market request, with the buyer's acknowledged answer hash as the
+// response path. It returns the bounty and the transaction, for the sale's
+// interaction record.
+func (n *AgentNode) settlePurchase(ctx context.Context, d KnowledgeDelivery) (settlement, error) {
+	market := n.marketAt(d.Answer.ChainID, d.Answer.Market)
+	if market == nil {
+		return settlement{}, fmt.Errorf("unknown market %s on chain %d", d.Answer.Market, d.Answer.ChainID)
+	}
+	if n.Wallet == nil {
+		return settlement{}, errors.New("no wallet to collect the bounty with")
+	}
+	requestId, ok := new(big.Int).SetString(d.Answer.RequestID, 10)
+	if !ok {
+		return settlement{}, fmt.Errorf("invalid request ID %q", d.Answer.RequestID)
+	}
+	req, err := market.GetRequest(requestId)
+	if err != nil {
+		return settlement{}, err
+	}
+	tx, err := market.Fulfill(n.Wallet, requestId, d.Ack.AnswerHash)
+	if err != nil {
+		return settlement{}, err
+	}
+	fmt.Printf("[Catalog] Collected the bounty of request %s from %s\n", requestId, market.Address().Hex())
+	paid := settlement{Amount: req.Bounty}
+	if tx != (common.Hash{}) {
+		paid.TxHash = tx.Hex()
+	}
+	return paid, nil
+}
+
+// listingStrategy is how the node negotiates an artifact it lists: at the
+// listed price, take it or leave it. It is nil for an asset it doesn't list.
+func (n *AgentNode) listingStrategy(assetHash string) NegotiationStrategy {
+	l, err := n.Store.GetListingByAsset(assetHash)
+	if err != nil || l == nil || l.PriceWei() == nil {
+		return nil
+	}
+	return TakeItOrLeaveIt{Price: l.PriceWei()}
+}
+
+// QueryCatalog reads a page of the catalog of the peer at targetAddr: the
+// listings tagged topic, or all for "", after cursor.
+func (n *AgentNode) QueryCatalog(ctx context.Context, targetAddr, topic, cursor string, limit int) (*CatalogPage, error) {
+	pid, err := n.addTarget(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	var page CatalogPage
+	if err := n.catalogExchange(ctx, pid, catalogRequest{Type: catalogQuery, Topic: topic, Cursor: cursor, Limit: limit}, MessageCatalog, &page); err != nil {
+		return nil, err
+	}
+	for i := range page.Listings {
+		page.Listings[i].Seller = pid.String()
+	}
+	return &page, nil
+}
+
+// GetListing reads one listing, preview included, from the catalog of the
+// peer at targetAddr.
+func (n *AgentNode) GetListing(ctx context.Context, targetAddr, id string) (*CatalogListing, error) {
+	pid, err := n.addTarget(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	var page CatalogPage
+	if err := n.catalogExchange(ctx, pid, catalogRequest{Type: catalogQuery, ID: id}, MessageCatalog, &page); err != nil {
+		var pe *PeerError
+		if errors.As(err, &pe) && pe.Code == ErrCodeNotFound {
+			return nil, fmt.Errorf("%w: %s at %s", ErrNoListing, id, pid)
+		}
+		return nil, err
+	}
+	if len(page.Listings) != 1 || page.Listings[0].ID != id {
+		return nil, fmt.Errorf("peer %s answered for another listing", pid)
+	}
+	l := page.Listings[0]
+	l.Seller = pid.String()
+	return &l, nil
+}
+
+// SyncCatalog reads the whole catalog of the peer at targetAddr, page by
+// page, and remembers it as KnownListings do an announcement.
+func (n *AgentNode) SyncCatalog(ctx context.Context, targetAddr string) ([]CatalogListing, error) {
+	pid, err := n.addTarget(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	var all []CatalogListing
+	cursor := ""
+	for {
+		page, err := n.QueryCatalog(ctx, pid.String(), "", cursor, MaxCatalogPageSize)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page.Listings...)
+		if page.Next == "" || page.Next <= cursor {
+			break
+		}
+		cursor = page.Next
+	}
+	n.catalogs().learn(pid.String(), append([]CatalogListing(nil), all...), true)
+	return all, nil
+}
+
+// catalogExchange sends req to pid on the catalog protocol and decodes the
+// payload of its want reply into out.
+func (n *AgentNode) catalogExchange(ctx context.Context, pid peer.ID, req catalogRequest, want string, out interface{}) error {
+	if err := n.permit(pid, PolicyActionDeliver); err != nil {
+		return err
+	}
+	s, err := n.CurrentHost().NewStream(ctx, pid, protocol.ID(CatalogProtocol))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	data, _ := json.Marshal(req)
+	if err := writeLP(s, data); err != nil {
+		return err
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		return err
+	}
+	switch resp.Type {
+	case MessageError:
+		return peerError(pid.String(), *resp)
+	case want:
+	default:
+		return fmt.Errorf("peer %s answered a catalog %s with %q", pid, req.Type, resp.Type)
+	}
+	if err := UnmarshalPayload(*resp, out); err != nil {
+		return fmt.Errorf("peer %s sent an unreadable %s: %w", pid, want, err)
+	}
+	return nil
+}
+
+// Purchase is a listing bought from a peer: the agreed terms, the market
+// request that paid for it, and the artifact delivered.
+type Purchase struct {
+	Listing    CatalogListing `json:"listing"`
+	Agreement  Agreement      `json:"agreement"`
+	RequestID  string         `json:"requestId"`
+	DeliveryID string         `json:"deliveryId"`
+	Artifact   []byte         `json:"artifact"`
+}
+
+// BuyListing buys listing id from the peer at targetAddr: it negotiates the
+// price, at most maxPrice or the listed price if maxPrice is nil, pays it
+// into the node's Market as a request for the listing's CatalogTopic, and
+// waits for the seller to deliver the artifact, which must match the
+// listing's hash. The seller collects the payment by fulfilling the
+// request. A purchase that fails after paying returns an error naming the
+// request, whose bounty stays in the market.
+func (n *AgentNode) BuyListing(ctx context.Context, targetAddr, id string, maxPrice *big.Int) (*Purchase, error) {
+	if n.Market == nil || n.Wallet == nil {
+		return nil, errors.New("buying needs a market and a wallet")
+	}
+	l, err := n.GetListing(ctx, targetAddr, id)
+	if err != nil {
+		return nil, err
+	}
+	price := l.PriceWei()
+	if price == nil {
+		return nil, fmt.Errorf("listing %s has an invalid price %q", id, l.Price)
+	}
+	if maxPrice == nil {
+		maxPrice = price
+	}
+	if price.Cmp(maxPrice) > 0 {
+		return nil, fmt.Errorf("listing %s costs %s wei, more than %s", id, price, maxPrice)
+	}
+	agreement, err := n.Negotiate(ctx, l.Seller, Offer{AssetHash: l.ArtifactHash, Price: price}, TakeItOrLeaveIt{Price: maxPrice})
+	if err != nil {
+		return nil, err
+	}
+
+	requestId, err := n.Market.RequestKnowledge(n.Wallet, CatalogTopic(l.ID), agreement.Price)
+	if err != nil {
+		return nil, fmt.Errorf("paying for listing %s: %w", id, err)
+	}
+	pid, _ := peer.Decode(l.Seller)
+	ctx, cancel := context.WithTimeout(ctx, purchaseTimeout)
+	defer cancel()
+	order := purchaseOrder{ListingID: l.ID, Agreement: *agreement, ChainID: n.Market.client.ChainID(),
+		Market: n.Market.Address().Hex(), RequestID: requestId.String()}
+	var reply purchaseReply
+	if err := n.catalogExchange(ctx, pid, catalogRequest{Type: catalogPurchase, Purchase: &order}, MessagePurchased, &reply); err != nil {
+		return nil, fmt.Errorf("paid request %s, but listing %s wasn't delivered: %w", requestId, id, err)
+	}
+
+	d, err := n.Store.GetDelivery(reply.DeliveryID)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil || d.Status != DeliveryReceived || d.PeerID != l.Seller || d.Answer.RequestID != requestId.String() {
+		return nil, fmt.Errorf("paid request %s, but %s named a delivery it didn't make", requestId, pid)
+	}
+	encoded, _ := d.Answer.Content.(string)
+	artifact, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || ethcrypto.Keccak256Hash(artifact).Hex() != l.ArtifactHash {
+		return nil, fmt.Errorf("paid request %s, but the artifact %s delivered doesn't match listing %s", requestId, pid, id)
+	}
+	n.Events.Add("catalog_bought", map[string]string{"listing": l.ID, "peerId": l.Seller, "requestId": requestId.String(), "price": agreement.Price.String()})
+	return &Purchase{Listing: *l, Agreement: *agreement, RequestID: requestId.String(), DeliveryID: d.ID, Artifact: artifact}, nil
+}
+
+// SaveListing inserts or replaces a catalog listing.
+func (s *sqlStore) SaveListing(l CatalogListing) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`
+		INSERT INTO catalog_listings (id, asset_hash, artifact_path, listing, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET asset_hash = excluded.asset_hash, artifact_path = excluded.artifact_path,
+			listing = excluded.listing, updated_at = excluded.updated_at`,
+		l.ID, l.ArtifactHash, l.ArtifactPath, string(data), l.CreatedAt, l.UpdatedAt)
+	return err
+}
+
+// GetListing returns a catalog listing, or nil if there is none for id.
+func (s *sqlStore) GetListing(id string) (*CatalogListing, error) {
+	return scanListing(s.queryRow("SELECT listing, artifact_path FROM catalog_listings WHERE id = ?", id))
+}
+
+// GetListingByAsset returns the listing of the artifact with assetHash, or
+// nil if it isn't listed.
+func (s *sqlStore) GetListingByAsset(assetHash string) (*CatalogListing, error) {
+	return scanListing(s.queryRow("SELECT listing, artifact_path FROM catalog_listings WHERE asset_hash = ?", assetHash))
+}
+
+func scanListing(row *sql.Row) (*CatalogListing, error) {
+	var data, path string
+	err := row.Scan(&data, &path)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var l CatalogListing
+	if err := json.Unmarshal([]byte(data), &l); err != nil {
+		return nil, err
+	}
+	l.ArtifactPath = path
+	return &l, nil
+}
+
+// ListListings returns every catalog listing, by ID.
+func (s *sqlStore) ListListings() ([]CatalogListing, error) {
+	rows, err := s.query("SELECT listing, artifact_path FROM catalog_listings ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []CatalogListing
+	for rows.Next() {
+		var data, path string
+		if err := rows.Scan(&data, &path); err != nil {
+			return nil, err
+		}
+		var l CatalogListing
+		if err := json.Unmarshal([]byte(data), &l); err != nil {
+			return nil, err
+		}
+		l.ArtifactPath = path
+		results = append(results, l)
+	}
+	return results, rows.Err()
+}
+
+// DeleteListing removes a catalog listing.
+func (s *sqlStore) DeleteListing(id string) error {
+	_, err := s.exec("DELETE FROM catalog_listings WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const marketAddrHex = "0x00000000000000000000000000000000000000ee"
+
+// marketChain runs a KnowledgeMarket in memory: transactions sent to it are
+// executed and mined at once, and calls read its state.
+type marketChain struct {
+	*ethclient.Client
+	client *ERC8004Client
+
+	mu       sync.Mutex
+	requests []MarketRequest
+	paid     map[common.Address]*big.Int // bounties collected, by provider
+	receipts map[common.Hash]*types.Receipt
+}
+
+func newMarketChain(t *testing.T) *marketChain {
+	t.Helper()
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		switch method {
+		case "eth_chainId":
+			return hexutil.Uint64(84532), nil
+		case "eth_getBlockByNumber":
+			return &types.Header{Number: big.NewInt(100), Difficulty: big.NewInt(0), BaseFee: big.NewInt(1e9)}, nil
+		case "eth_maxPriorityFeePerGas":
+			return "0x3b9aca00", nil
+		case "eth_getTransactionCount":
+			return hexutil.Uint64(0), nil
+		case "eth_estimateGas":
+			return hexutil.Uint64(80000), nil
+		}
+		return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+	})
+	eth, err := ethclient.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(eth.Close)
+	c := &marketChain{Client: eth, paid: map[common.Address]*big.Int{}, receipts: map[common.Hash]*types.Receipt{}}
+	c.client = NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	if c.client == nil {
+		t.Fatal("client not created")
+	}
+	t.Cleanup(c.client.Close)
+	c.client.SetTxBackend(c)
+	return c
+}
+
+func (c *marketChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return err
+	}
+	market := c.client.marketABI
+	method, err := market.MethodById(tx.Data())
+	if err != nil {
+		return err
+	}
+	args, err := method.Inputs.Unpack(tx.Data()[4:])
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx.Hash(), BlockNumber: big.NewInt(int64(101 + len(c.receipts)))}
+	switch method.Name {
+	case "requestKnowledge":
+		id := big.NewInt(int64(len(c.requests)))
+		topic, topicHash := args[0].(string), args[1].([32]byte)
+		c.requests = append(c.requests, MarketRequest{Requester: from, Topic: topic, TopicHash: topicHash, Bounty: tx.Value(), Timestamp: big.NewInt(1700000000)})
+		event := market.Events["KnowledgeRequested"]
+		data, _ := event.Inputs.NonIndexed().Pack(topic, tx.Value())
+		receipt.Logs = []*types.Log{{Address: common.HexToAddress(marketAddrHex), Data: data,
+			Topics: []common.Hash{event.ID, common.BigToHash(id), common.BytesToHash(from.Bytes()), topicHash}}}
+	case "fulfillRequest":
+		id := args[0].(*big.Int)
+		if !id.IsInt64() || id.Int64() >= int64(len(c.requests)) || c.requests[id.Int64()].Fulfilled {
+			receipt.Status = types.ReceiptStatusFailed
+			break
+		}
+		req := &c.requests[id.Int64()]
+		req.Fulfilled = true
+		if c.paid[from] == nil {
+			c.paid[from] = new(big.Int)
+		}
+		c.paid[from].Add(c.paid[from], req.Bounty)
+		event := market.Events["KnowledgeProvided"]
+		data, _ := event.Inputs.NonIndexed().Pack(args[1].(string))
+		receipt.Logs = []*types.Log{{Address: common.HexToAddress(marketAddrHex), Data: data,
+			Topics: []common.Hash{event.ID, common.BigToHash(id), common.BytesToHash(from.Bytes())}}}
+	default:
+		return fmt.Errorf("the market has no %s", method.Name)
+	}
+	c.receipts[tx.Hash()] = receipt
+	return nil
+}
+
+func (c *marketChain) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.receipts[hash]; ok {
+		return r, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (c *marketChain) CallContract(ctx context.Context, msg ethereum.CallMsg, block *big.Int) ([]byte, error) {
+	market := c.client.marketABI
+	args, err := market.Methods["requests"].Inputs.Unpack(msg.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := MarketRequest{Bounty: new(big.Int), Timestamp: new(big.Int)}
+	if id := args[0].(*big.Int); id.IsInt64() && id.Int64() < int64(len(c.requests)) {
+		req = c.requests[id.Int64()]
+	}
+	return market.Methods["requests"].Outputs.Pack(req.Requester, req.Topic, req.TopicHash, req.Bounty, req.Timestamp, req.Fulfilled)
+}
+
+// listArtifact lists a file holding content on n.
+func listArtifact(t *testing.T, n *AgentNode, title string, topics []string, price int64, content string) *CatalogListing {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "artifact")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewListing(title, topics, big.NewInt(price), path, "a taste of "+title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AddListing(l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestCatalogsAreAnnouncedAndSyncedBetweenNodes(t *testing.T) {
+	defer func(d time.Duration) { catalogAnnounceInterval = d }(catalogAnnounceInterval)
+	catalogAnnounceInterval = 200 * time.Millisecond
+
+	seller, buyer := startTestNode(t), startTestNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	info, _ := peer.AddrInfoFromString(dialAddr(seller))
+	if err := buyer.CurrentHost().Connect(ctx, *info); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		topics := []string{"go"}
+		if i%2 == 0 {
+			topics = append(topics, "Crypto")
+		}
+		listArtifact(t, seller, fmt.Sprintf("notes %d", i), topics, int64(100+i), fmt.Sprintf("artifact %d", i))
+	}
+	if err := seller.AddListing(&CatalogListing{}); err == nil {
+		t.Error("a listing without an artifact was added")
+	}
+
+	// The announcement reaches the buyer, without previews
+	var known []CatalogListing
+	for deadline := time.Now().Add(10 * time.Second); len(known) < 5; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("buyer knows %d listings, want the 5 announced", len(known))
+		}
+		known = buyer.KnownListings("")
+	}
+	if l := known[0]; l.Seller != seller.CurrentHost().ID().String() || l.Preview != "" || l.ArtifactHash == "" || l.PriceWei() == nil || l.PriceWei().Int64() < 100 {
+		t.Errorf("announced listing %+v", l)
+	}
+	if crypto := buyer.KnownListings("crypto"); len(crypto) != 3 {
+		t.Errorf("%d announced listings tagged crypto, want 3", len(crypto))
+	}
+
+	// Queries page through the catalog, filtered by topic
+	first, err := buyer.QueryCatalog(ctx, dialAddr(seller), "crypto", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Listings) != 2 || first.Next == "" || first.Listings[0].Preview == "" {
+		t.Fatalf("first page %+v, want 2 listings with previews and a cursor", first)
+	}
+	second, err := buyer.QueryCatalog(ctx, dialAddr(seller), "crypto", first.Next, 2)
+	if err != nil || len(second.Listings) != 1 || second.Next != "" || second.Listings[0].ID <= first.Next {
+		t.Fatalf("second page %+v (%v), want the last crypto listing", second, err)
+	}
+	all, err := buyer.SyncCatalog(ctx, dialAddr(seller))
+	if err != nil || len(all) != 5 {
+		t.Fatalf("synced %d listings (%v), want 5", len(all), err)
+	}
+	if _, err := buyer.GetListing(ctx, dialAddr(seller), "missing"); !errors.Is(err, ErrNoListing) {
+		t.Errorf("getting a missing listing failed with %v, want ErrNoListing", err)
+	}
+
+	// The agent card carries the catalog; removals are announced
+	if card := seller.AgentCard(); len(card.Catalog) != 5 || card.Catalog[0].Preview != "" {
+		t.Errorf("agent card catalog %+v, want the 5 listings without previews", card.Catalog)
+	}
+	if err := seller.RemoveListing(all[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); len(buyer.KnownListings("")) != 4; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the removal was never announced")
+		}
+	}
+}
+
+func TestListingsAreBoughtThroughNegotiationDeliveryAndTheMarket(t *testing.T) {
+	chain := newMarketChain(t)
+	seller, buyer := startTestNode(t), startTestNode(t)
+	seller.Wallet, buyer.Wallet = newTestWallet(t), newTestWallet(t)
+	seller.Market = NewKnowledgeMarket(chain.client, marketAddrHex)
+	buyer.Market = NewKnowledgeMarket(chain.client, marketAddrHex)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := buyer.addTarget(dialAddr(seller)); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "how the agent mesh settles knowledge sales"
+	l := listArtifact(t, seller, "settlement notes", []string{"mesh"}, 5000, content)
+
+	// A limit under the price buys nothing
+	if _, err := buyer.BuyListing(ctx, dialAddr(seller), l.ID, big.NewInt(4000)); err == nil {
+		t.Fatal("bought a listing above the buyer's limit")
+	}
+
+	p, err := buyer.BuyListing(ctx, dialAddr(seller), l.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Artifact, []byte(content)) || p.Agreement.Price.Int64() != 5000 || p.Agreement.AssetHash != l.ArtifactHash {
+		t.Fatalf("purchase %+v, want the artifact at the listed price", p)
+	}
+	if p.Agreement.RequesterWallet != buyer.Wallet.Address.Hex() || !p.Agreement.Verify() {
+		t.Errorf("agreement %+v, want one signed by the buyer's wallet", p.Agreement)
+	}
+
+	// The seller fulfilled the buyer's request and was paid its bounty
+	chain.mu.Lock()
+	req := chain.requests[0]
+	paid := chain.paid[seller.Wallet.Address]
+	chain.mu.Unlock()
+	if req.Requester != buyer.Wallet.Address || req.Topic != CatalogTopic(l.ID) || req.Bounty.Int64() != 5000 || !req.Fulfilled {
+		t.Errorf("market request %+v, want the buyer's, for the listing, fulfilled", req)
+	}
+	if paid == nil || paid.Int64() != 5000 {
+		t.Errorf("seller was paid %v, want 5000", paid)
+	}
+	deliveries, _ := seller.Store.ListDeliveries()
+	if len(deliveries) != 1 || deliveries[0].Status != DeliverySettled || deliveries[0].ID != p.DeliveryID {
+		t.Errorf("seller's deliveries %+v, want the purchase settled", deliveries)
+	}
+
+	// A paid request can't buy the listing twice
+	agreement, err := buyer.Negotiate(ctx, seller.CurrentHost().ID().String(), Offer{AssetHash: l.ArtifactHash, Price: big.NewInt(5000)}, TakeItOrLeaveIt{Price: big.NewInt(5000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := purchaseOrder{ListingID: l.ID, Agreement: *agreement, Market: marketAddrHex, RequestID: p.RequestID}
+	err = buyer.catalogExchange(ctx, seller.CurrentHost().ID(), catalogRequest{Type: catalogPurchase, Purchase: &order}, MessagePurchased, &purchaseReply{})
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Code != ErrCodeForbidden {
+		t.Errorf("buying again with a fulfilled request failed with %v, want forbidden", err)
+	}
+	// Nor can terms the seller didn't sign
+	order.Agreement.Price = big.NewInt(1)
+	err = buyer.catalogExchange(ctx, seller.CurrentHost().ID(), catalogRequest{Type: catalogPurchase, Purchase: &order}, MessagePurchased, &purchaseReply{})
+	if !errors.As(err, &pe) || pe.Code != ErrCodeForbidden {
+		t.Errorf("buying with altered terms failed with %v, want forbidden", err)
+	}
+}
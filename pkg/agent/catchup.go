@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// catchUpLogInterval is how often a watcher catching up logs its progress.
+const catchUpLogInterval = 15 * time.Second
+
+// WatcherProgress is how far a watcher has come through the chain, served
+// in the node status. A watcher more than its log range behind the
+// confirmed head is catching up, as after a restart from an old checkpoint
+// or from a deploy block: it then reports its progress since it fell
+// behind, how fast it goes through blocks and when it should be done.
+type WatcherProgress struct {
+	ChainID         uint64  `json:"chainId,omitempty"`
+	Block           uint64  `json:"block"` // the last block processed
+	Head            uint64  `json:"head"`  // the confirmed head at the last poll; 0 before the first
+	Behind          uint64  `json:"behind"`
+	CatchingUp      bool    `json:"catchingUp"`
+	Percent         float64 `json:"percent"` // of the blocks to catch up on, done; 100 when not catching up
+	BlocksPerSecond float64 `json:"blocksPerSecond,omitempty"`
+	ETASeconds      int64   `json:"etaSeconds,omitempty"`
+}
+
+// ETA is how long the catch-up should still take, or 0 if it isn't known.
+func (p WatcherProgress) ETA() time.Duration {
+	return time.Duration(p.ETASeconds) * time.Second
+}
+
+// String describes p, e.g. "block 1200 of 5000 (24.0%, 95 blocks/s, ETA 40s)".
+func (p WatcherProgress) String() string {
+	if !p.CatchingUp {
+		return fmt.Sprintf("block %d, %d behind", p.Block, p.Behind)
+	}
+	s := fmt.Sprintf("block %d of %d (%.1f%%", p.Block, p.Head, p.Percent)
+	if p.BlocksPerSecond > 0 {
+		s += fmt.Sprintf(", %.0f blocks/s, ETA %s", p.BlocksPerSecond, p.ETA())
+	}
+	return s + ")"
+}
+
+// catchUp tracks a watcher's way through a gap of blocks.
+type catchUp struct {
+	head atomic.Uint64 // the confirmed head at the last poll
+
+	mu         sync.Mutex
+	active     bool
+	startBlock uint64    // the last block processed when it fell behind
+	started    time.Time // when it fell behind
+	logged     time.Time // when progress was last logged
+}
+
+// noteTarget records the confirmed head a poll is about to catch up to, and
+// starts tracking a catch-up when it is more than a log range away.
+func (w *EventWatcher) noteTarget(head uint64) {
+	w.progress.head.Store(head)
+	last := w.LastBlock()
+	if head <= last || head-last <= w.logRange {
+		return
+	}
+	c := &w.progress
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active {
+		return
+	}
+	now := w.clock.Now()
+	c.active, c.startBlock, c.started, c.logged = true, last, now, now
+	fmt.Printf("[Watcher] Catching up on %d blocks%s, from block %d to %d\n", head-last, w.chainLabel(), last+1, head)
+}
+
+// noteProgress logs a catch-up's progress every catchUpLogInterval, and
+// ends it once the watcher has reached the head it was catching up to.
+func (w *EventWatcher) noteProgress() {
+	c := &w.progress
+	c.mu.Lock()
+	if !c.active {
+		c.mu.Unlock()
+		return
+	}
+	now := w.clock.Now()
+	last, head := w.LastBlock(), c.head.Load()
+	if last >= head {
+		c.active = false
+		blocks, took := last-c.startBlock, now.Sub(c.started)
+		c.mu.Unlock()
+		fmt.Printf("[Watcher] Caught up%s at block %d: %d blocks in %s\n", w.chainLabel(), last, blocks, took.Round(time.Second))
+		return
+	}
+	if now.Sub(c.logged) < catchUpLogInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.logged = now
+	c.mu.Unlock()
+	fmt.Printf("[Watcher] Catching up%s: %s\n", w.chainLabel(), w.Progress())
+}
+
+// Progress returns how far the watcher has come, and if it is catching up,
+// how fast and how long until it is done.
+func (w *EventWatcher) Progress() WatcherProgress {
+	c := &w.progress
+	c.mu.Lock()
+	active, start, started := c.active, c.startBlock, c.started
+	c.mu.Unlock()
+
+	p := WatcherProgress{ChainID: w.chainID, Block: w.LastBlock(), Head: c.head.Load(), Percent: 100}
+	if p.Head > p.Block {
+		p.Behind = p.Head - p.Block
+	}
+	if !active || p.Behind == 0 || p.Head <= start {
+		return p
+	}
+	p.CatchingUp = true
+	var done uint64
+	if p.Block > start {
+		// A reorg may rewind it before where it started
+		done = p.Block - start
+	}
+	p.Percent = float64(done) / float64(p.Head-start) * 100
+	if elapsed := w.clock.Now().Sub(started).Seconds(); elapsed > 0 && done > 0 {
+		p.BlocksPerSecond = float64(done) / elapsed
+		p.ETASeconds = int64(float64(p.Behind)/p.BlocksPerSecond + 0.5)
+	}
+	return p
+}
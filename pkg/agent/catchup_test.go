@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+)
+
+func TestWatcherReportsCatchUpProgress(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := testutil.NewFakeClock(now)
+	chain := &fakeChain{head: 3500, headTime: uint64(now.Unix()), failFrom: 2500}
+	rpcURL := newFakeRPC(t, chain.handle)
+	w, err := NewEventWatcher(rpcURL, []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil,
+		WithLogRange(1000), WithClock(clock), WithErrorHandler(func(error) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+	store.SetCheckpoint("watcher", 100)
+	if err := w.UseCheckpoints(store, "watcher"); err != nil {
+		t.Fatal(err)
+	}
+	n := newTestNode(t)
+	n.ERCClient = NewERC8004Client(rpcURL, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	n.Watcher = w
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	watcherCheck := func(r Readiness) Check {
+		t.Helper()
+		for _, c := range r.Checks {
+			if c.Name == "watcher" {
+				return c
+			}
+		}
+		t.Fatalf("no watcher check in %+v", r)
+		return Check{}
+	}
+
+	// A chunk fails partway, leaving the watcher 1400 of 3400 blocks short
+	w.pollLogs(context.Background())
+	clock.Advance(10 * time.Second)
+	p := w.Progress()
+	if !p.CatchingUp || p.Block != 2100 || p.Head != 3500 || p.Behind != 1400 {
+		t.Fatalf("progress = %+v, want catching up at 2100 of 3500", p)
+	}
+	if p.Percent < 58.8 || p.Percent > 58.9 || p.BlocksPerSecond != 200 || p.ETA() != 7*time.Second {
+		t.Errorf("progress = %+v, want 58.8%% at 200 blocks/s, 7s to go", p)
+	}
+	r := n.Readyz()
+	if c := watcherCheck(r); r.Ready || c.OK || !strings.Contains(c.Detail, "catching up: block 2100 of 3500") {
+		t.Errorf("readiness = %+v while catching up, want not ready", r)
+	}
+	if st := n.Status().Watchers; len(st) != 1 || st[0] != p {
+		t.Errorf("status watchers = %+v, want %+v", st, p)
+	}
+
+	chain.mu.Lock()
+	chain.failFrom = 0
+	chain.mu.Unlock()
+	w.pollLogs(context.Background())
+	if p := w.Progress(); p.CatchingUp || p.Block != 3500 || p.Behind != 0 || p.Percent != 100 {
+		t.Errorf("progress = %+v once caught up", p)
+	}
+	if r := n.Readyz(); !r.Ready || !watcherCheck(r).OK {
+		t.Errorf("readiness = %+v once caught up, want ready", r)
+	}
+
+	// A gap within one log range is polled through, not caught up on
+	chain.mu.Lock()
+	chain.head = 3900
+	chain.mu.Unlock()
+	w.noteTarget(3900)
+	if p := w.Progress(); p.CatchingUp || p.Behind != 400 {
+		t.Errorf("progress = %+v 400 blocks behind, want no catch-up", p)
+	}
+}
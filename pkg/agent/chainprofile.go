@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"gopkg.in/yaml.v3"
+)
+
+// endpointProbeTimeout bounds the chain ID query to each RPC endpoint of a
+// profile.
+const endpointProbeTimeout = 5 * time.Second
+
+// ChainProfile is one deployment the node works against: a chain, the RPC
+// endpoints serving it and the contracts on it. Empty registry addresses
+// leave that registry out.
+type ChainProfile struct {
+	Name       string            `json:"name" yaml:"name"`
+	ChainID    uint64            `json:"chainId" yaml:"chainId"`
+	RPC        []string          `json:"rpc" yaml:"rpc"` // endpoints, in order of preference
+	Identity   string            `json:"identity,omitempty" yaml:"identity"`
+	Reputation string            `json:"reputation,omitempty" yaml:"reputation"`
+	Validation string            `json:"validation,omitempty" yaml:"validation"`
+	Escrows    []string          `json:"escrows,omitempty" yaml:"escrows"`
+	Markets    []string          `json:"markets,omitempty" yaml:"markets"`
+	Blocks     DeployBlocks      `json:"deployBlocks" yaml:"deployBlocks"`
+	Tokens     map[string]string `json:"tokens,omitempty" yaml:"tokens"` // payment tokens' addresses, by symbol
+}
+
+// DeployBlocks are where scans of a profile's contracts' logs start.
+type DeployBlocks struct {
+	Identity uint64 `json:"identity,omitempty" yaml:"identity"` // the IdentityRegistry's; 0 for Base Sepolia's
+	Watched  uint64 `json:"watched,omitempty" yaml:"watched"`   // the earliest escrow's or market's; 0 to start at the head
+}
+
+// chainsFile is the layout of a chain profiles file:
+//
+//	chains:
+//	  - name: base
+//	    chainId: 8453
+//	    rpc: ["https://mainnet.base.org"]
+//	    identity: "0x..."
+//	    markets: ["0x..."]
+//	    deployBlocks: {identity: 25000000, watched: 26000000}
+//	    tokens: {USDC: "0x..."}
+//	  - name: op-sepolia
+//	    chainId: 11155420
+//	    ...
+//
+// The first chain is the node's primary one.
+type chainsFile struct {
+	Chains []ChainProfile `yaml:"chains"`
+}
+
+// LoadChainProfiles reads the profiles in path, the primary chain's first.
+func LoadChainProfiles(path string) ([]ChainProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("chain profiles: %w", err)
+	}
+	var f chainsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("chain profiles %s: %w", path, err)
+	}
+	if len(f.Chains) == 0 {
+		return nil, fmt.Errorf("chain profiles %s: no chains", path)
+	}
+	seen := map[uint64]bool{}
+	for i := range f.Chains {
+		p := &f.Chains[i]
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("chain-%d", p.ChainID)
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("chain profiles %s: %w", path, err)
+		}
+		if seen[p.ChainID] {
+			return nil, fmt.Errorf("chain profiles %s: chain %d is listed twice", path, p.ChainID)
+		}
+		seen[p.ChainID] = true
+	}
+	return f.Chains, nil
+}
+
+func (p ChainProfile) validate() error {
+	if p.ChainID == 0 {
+		return fmt.Errorf("chain %s: no chainId", p.Name)
+	}
+	if len(p.RPC) == 0 {
+		return fmt.Errorf("chain %s: no rpc endpoint", p.Name)
+	}
+	for field, addr := range map[string]string{"identity": p.Identity, "reputation": p.Reputation, "validation": p.Validation} {
+		if addr != "" && !common.IsHexAddress(addr) {
+			return fmt.Errorf("chain %s: %s %q is not an address", p.Name, field, addr)
+		}
+	}
+	if _, err := parseContracts("escrow", p.Escrows); err != nil {
+		return fmt.Errorf("chain %s: %w", p.Name, err)
+	}
+	if _, err := parseContracts("market", p.Markets); err != nil {
+		return fmt.Errorf("chain %s: %w", p.Name, err)
+	}
+	for symbol, addr := range p.Tokens {
+		if !common.IsHexAddress(addr) {
+			return fmt.Errorf("chain %s: token %s %q is not an address", p.Name, symbol, addr)
+		}
+	}
+	return nil
+}
+
+// Endpoint returns the first of the profile's RPC endpoints that serves its
+// chain. Endpoints that don't answer are passed over, but if none serves the
+// chain the first of them is returned, for the client or watcher to retry and
+// check once it is up. It fails only when every endpoint answered for another
+// chain.
+func (p ChainProfile) Endpoint(ctx context.Context) (string, error) {
+	var down string
+	var wrong []string
+	for _, url := range p.RPC {
+		id, err := probeChainID(ctx, url)
+		switch {
+		case err != nil:
+			fmt.Printf("[Chain] %s: RPC %s unreachable: %v\n", p.Name, url, err)
+			if down == "" {
+				down = url
+			}
+		case id != p.ChainID:
+			fmt.Printf("[Chain] %s: RPC %s serves chain %d, not %d; skipping it\n", p.Name, url, id, p.ChainID)
+			wrong = append(wrong, fmt.Sprintf("%s serves chain %d", url, id))
+		default:
+			return url, nil
+		}
+	}
+	if down != "" {
+		return down, nil
+	}
+	return "", fmt.Errorf("chain %s: %w: %s", p.Name, ErrWrongChain, strings.Join(wrong, "; "))
+}
+
+func probeChainID(ctx context.Context, url string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, endpointProbeTimeout)
+	defer cancel()
+	client, err := ethclient.DialContext(ctx, url)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	id, err := client.ChainID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return id.Uint64(), nil
+}
+
+// Checkpoint names the checkpoint of the profile's watcher: "watcher" on the
+// primary chain, the name a node on one chain uses, so naming its chains
+// keeps its progress; "watcher:<chainId>" on the others.
+func (p ChainProfile) Checkpoint(primary bool) string {
+	if primary {
+		return "watcher"
+	}
+	return fmt.Sprintf("watcher:%d", p.ChainID)
+}
+
+// NewClient connects to the profile's registries through its Endpoint,
+// with the client bound to its chain.
+func (p ChainProfile) NewClient(ctx context.Context) (*ERC8004Client, error) {
+	url, err := p.Endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := NewERC8004Client(url, addressOrZero(p.Identity), addressOrZero(p.Reputation), addressOrZero(p.Validation))
+	if client == nil {
+		return nil, fmt.Errorf("chain %s: failed to connect to RPC %s", p.Name, url)
+	}
+	client.BindChain(p.ChainID)
+	client.SetRegistryDeployBlock(p.Blocks.Identity)
+	return client, nil
+}
+
+// NewWatcher watches the profile's escrows and markets through its
+// Endpoint, like NewEventWatcherWithHandlers, with the watcher bound to its
+// chain and starting at its Watched deployment block. primary is whether
+// this is the node's primary chain; see WithChain.
+func (p ChainProfile) NewWatcher(ctx context.Context, primary bool, onTask TaskCreatedHandler, onQuery KnowledgeRequestedHandler, opts ...WatcherOption) (*EventWatcher, error) {
+	url, err := p.Endpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, WithChain(p.ChainID, primary), WithStartBlock(p.Blocks.Watched))
+	return NewEventWatcherWithHandlers(url, p.Escrows, p.Markets, onTask, onQuery, opts...)
+}
+
+func addressOrZero(addr string) string {
+	if addr == "" {
+		return common.Address{}.Hex()
+	}
+	return addr
+}
+
+// Chain is a deployment the node works on: its profile, and the client and
+// watcher bound to its chain. Either may be nil.
+type Chain struct {
+	Profile ChainProfile
+	Client  *ERC8004Client
+	Watcher *EventWatcher
+}
+
+// Chain returns the chain of the node's Chains with chainID, or nil.
+func (n *AgentNode) Chain(chainID uint64) *Chain {
+	for _, c := range n.Chains {
+		if c.Profile.ChainID == chainID {
+			return c
+		}
+	}
+	return nil
+}
+
+// watchers returns the node's Watcher and those of its other Chains.
+func (n *AgentNode) watchers() []*EventWatcher {
+	var ws []*EventWatcher
+	if n.Watcher != nil {
+		ws = append(ws, n.Watcher)
+	}
+	for _, c := range n.Chains {
+		if c.Watcher != nil && c.Watcher != n.Watcher {
+			ws = append(ws, c.Watcher)
+		}
+	}
+	return ws
+}
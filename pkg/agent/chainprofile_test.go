@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestChainsNeverMixTheirEvents(t *testing.T) {
+	const base, opSepolia = 8453, 11155420
+	now := uint64(time.Now().Unix())
+	chainA := &fakeChain{chainID: base, head: 100, headTime: now}
+	chainB := &fakeChain{chainID: opSepolia, head: 100, headTime: now}
+	urlA, urlB := newFakeRPC(t, chainA.handle), newFakeRPC(t, chainB.handle)
+
+	store := newTestStore(t)
+	in := NewTaskIntake(store, nil, nil)
+	seen := map[uint64][]uint64{} // chains of the events each watcher delivered, by its chain
+	failing := true
+	handler := func(chain uint64) TaskCreatedHandler {
+		return func(e TaskCreatedEvent) error {
+			seen[chain] = append(seen[chain], e.ChainID)
+			if chain == opSepolia && e.TaskId.Int64() == 8 && failing {
+				return errors.New("handler broke")
+			}
+			return in.OnTask(e)
+		}
+	}
+
+	// Both chains have the escrow at the same address, and a task 7. The
+	// second profile lists the first chain's RPC first, by mistake
+	primary := ChainProfile{Name: "base", ChainID: base, RPC: []string{urlA}, Escrows: []string{testEscrowHex}, Blocks: DeployBlocks{Watched: 40}}
+	other := ChainProfile{Name: "op-sepolia", ChainID: opSepolia, RPC: []string{urlA, urlB}, Escrows: []string{testEscrowHex}, Blocks: DeployBlocks{Watched: 40}}
+	wa, err := primary.NewWatcher(context.Background(), true, handler(base), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb, err := other.NewWatcher(context.Background(), false, handler(opSepolia), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.logs = []types.Log{taskCreatedLog(t, wa, 7)}
+	chainB.logs = []types.Log{taskCreatedLog(t, wb, 7), taskCreatedLog(t, wb, 8)}
+	for _, w := range []struct {
+		*EventWatcher
+		checkpoint string
+	}{{wa, primary.Checkpoint(true)}, {wb, other.Checkpoint(false)}} {
+		if err := w.UseCheckpoints(store, w.checkpoint); err != nil {
+			t.Fatal(err)
+		}
+		w.pollLogs(context.Background())
+	}
+
+	for id, chain := range map[string]uint64{"task:7": base, "task:11155420:7": opSepolia} {
+		if r, _ := store.GetTask(id); r == nil || r.ChainID != chain {
+			t.Errorf("%s recorded as %+v, want it on chain %d", id, r, chain)
+		}
+	}
+	for name, want := range map[string]uint64{"watcher": 100, "watcher:11155420": 100} {
+		if block, ok, _ := store.GetCheckpoint(name); !ok || block != want {
+			t.Errorf("checkpoint %s at %d (%v), want %d", name, block, ok, want)
+		}
+	}
+	letters, _ := store.ListDeadLetters()
+	if len(letters) != 1 || letters[0].ID != "task:11155420:8" || letters[0].ChainID != opSepolia {
+		t.Fatalf("dead letters %+v, want the second chain's task 8", letters)
+	}
+
+	// Only the chain that kept a dead letter retries it
+	later := time.Now().Add(time.Hour)
+	wa.retryDeadLetters(later)
+	if letters, _ := store.ListDeadLetters(); len(letters) != 1 || letters[0].Attempts != 1 {
+		t.Fatalf("after the first chain's retry the dead letters are %+v", letters)
+	}
+	if err := wa.RetryDeadLetter("task:11155420:8"); err == nil {
+		t.Error("the first chain's watcher retried the second chain's dead letter")
+	}
+	failing = false
+	wb.retryDeadLetters(later)
+	if r, _ := store.GetTask("task:11155420:8"); r == nil || r.ChainID != opSepolia {
+		t.Errorf("retried task recorded as %+v, want it on chain %d", r, opSepolia)
+	}
+	for chain, ids := range seen {
+		for _, id := range ids {
+			if id != chain {
+				t.Errorf("the watcher of chain %d delivered an event of chain %d", chain, id)
+			}
+		}
+	}
+	if len(seen[base]) != 1 || len(seen[opSepolia]) != 3 {
+		t.Errorf("delivered %d and %d events, want 1 and 3", len(seen[base]), len(seen[opSepolia]))
+	}
+
+	// A watcher bound to a chain its RPC doesn't serve processes nothing
+	var errs []error
+	wrong, err := NewEventWatcherWithHandlers(urlA, []string{testEscrowHex}, nil, handler(opSepolia), nil,
+		WithChain(opSepolia, false), WithStartBlock(40), WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong.pollLogs(context.Background())
+	if len(errs) != 1 || !errors.Is(errs[0], ErrWrongChain) || wrong.LastBlock() != 39 {
+		t.Errorf("misbound watcher reported %v and reached block %d", errs, wrong.LastBlock())
+	}
+	if _, err := (ChainProfile{Name: "lost", ChainID: opSepolia, RPC: []string{urlA}}).Endpoint(context.Background()); !errors.Is(err, ErrWrongChain) {
+		t.Errorf("a profile with only another chain's RPC: %v, want ErrWrongChain", err)
+	}
+}
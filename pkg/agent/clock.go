@@ -0,0 +1,34 @@
+package agent
+
+import "time"
+
+// Clock tells the time to code with caches, TTLs and backoff, so tests can
+// move time forward instead of sleeping. testutil.FakeClock is one.
+type Clock interface {
+	Now() time.Time
+	// After is time.After: the returned channel receives the time once d
+	// has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the wall clock, the default everywhere a Clock is taken.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock replaces the clock the client backs off on, and that caches built
+// on the client, such as RegistryReputation, expire entries by.
+func (c *ERC8004Client) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// Clock returns the client's clock; a nil client has the SystemClock.
+func (c *ERC8004Client) Clock() Clock {
+	if c == nil || c.clock == nil {
+		return SystemClock
+	}
+	return c.clock
+}
@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Encodings a message payload may be compressed with.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// DefaultCompressionThreshold is the smallest payload, in bytes of JSON,
+// worth compressing unless configured otherwise.
+const DefaultCompressionThreshold = 8 << 10
+
+// DefaultMaxDecompressed is the most bytes a compressed message or
+// announcement may decompress to unless configured otherwise: the size limit
+// of an uncompressed message.
+const DefaultMaxDecompressed = maxMessageSize
+
+// acceptedEncodings are the encodings the node reads, as it tells peers in
+// its messages' AcceptEncoding.
+var acceptedEncodings = []string{EncodingZstd, EncodingGzip}
+
+// encodingsKey is the peerstore key of the encodings a peer said it reads.
+const encodingsKey = "agentmesh/accept-encoding"
+
+// Compression makes the node compress the payloads of large messages: task
+// requests and responses on the task protocol, and its announcements over
+// pubsub. Peers are only sent compressed task messages once they have said
+// they read the encoding; every node reads both, so received messages are
+// decompressed whatever this is set to.
+type Compression struct {
+	Encoding  string // EncodingGzip or EncodingZstd
+	Threshold int    // payloads below this many bytes are sent as they are; 0 means DefaultCompressionThreshold
+}
+
+// ParseCompression returns compression with encoding, or nil for "" or
+// "off".
+func ParseCompression(encoding string, threshold int) (*Compression, error) {
+	switch encoding {
+	case "", "off":
+		return nil, nil
+	case EncodingGzip, EncodingZstd:
+		return &Compression{Encoding: encoding, Threshold: threshold}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q: want %s, %s or off", encoding, EncodingGzip, EncodingZstd)
+}
+
+func (c *Compression) threshold() int {
+	if c.Threshold <= 0 {
+		return DefaultCompressionThreshold
+	}
+	return c.Threshold
+}
+
+// zstdEncoder is safe for concurrent use, so one serves every message.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case EncodingGzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// decompress undoes compress, giving up as soon as the output passes limit
+// bytes, so a small payload can't expand into gigabytes: no more than limit
+// bytes are ever held.
+func decompress(encoding string, data []byte, limit int) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case EncodingZstd:
+		d, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	case EncodingGzip:
+		g, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = g
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, fmt.Errorf("%w: %v", errMessageTooLarge, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("%w: decompresses to over %d bytes", errMessageTooLarge, limit)
+	}
+	return out, nil
+}
+
+// payloadViolation is the protocol violation a payload that failed to
+// decode with err was.
+func payloadViolation(err error) string {
+	if errors.Is(err, errMessageTooLarge) {
+		return ViolationOversized
+	}
+	return ViolationProtocolError
+}
+
+// maxDecompressed is the most bytes a received payload may decompress to.
+func (n *AgentNode) maxDecompressed() int {
+	if n.MaxDecompressed <= 0 {
+		return DefaultMaxDecompressed
+	}
+	return n.MaxDecompressed
+}
+
+// decodePayload decompresses msg's payload if it came compressed, and
+// checks it is what msg's type declares. Its error matches
+// errMessageTooLarge for a payload past MaxDecompressed, and
+// ErrInvalidPayload for one of the wrong type.
+func (n *AgentNode) decodePayload(msg *AgentMessage) error {
+	if msg.Encoding == "" {
+		return checkPayload(msg)
+	}
+	packed, ok := msg.Payload.(string)
+	if !ok {
+		return fmt.Errorf("%s payload is not a string", msg.Encoding)
+	}
+	raw, err := base64.StdEncoding.DecodeString(packed)
+	if err != nil {
+		return fmt.Errorf("%s payload: %w", msg.Encoding, err)
+	}
+	if raw, err = decompress(msg.Encoding, raw, n.maxDecompressed()); err != nil {
+		return fmt.Errorf("%s payload: %w", msg.Encoding, err)
+	}
+	msg.Payload, msg.Encoding = nil, ""
+	if err := json.Unmarshal(raw, &msg.Payload); err != nil {
+		return err
+	}
+	return checkPayload(msg)
+}
+
+// compressMessage compresses msg's payload for a peer that reads accepted,
+// if the node compresses and the payload is large enough to be worth it.
+func (n *AgentNode) compressMessage(msg *AgentMessage, accepted []string) {
+	c := n.Compression
+	if c == nil || msg.Encoding != "" || msg.Payload == nil || !slices.Contains(accepted, c.Encoding) {
+		return
+	}
+	raw, err := json.Marshal(msg.Payload)
+	if err != nil || len(raw) < c.threshold() {
+		return
+	}
+	packed, err := compress(c.Encoding, raw)
+	if err != nil {
+		fmt.Printf("[P2P] Failed to compress a %s message: %v\n", msg.Type, err)
+		return
+	}
+	n.Metrics.observeCompression("stream", c.Encoding, len(raw), len(packed))
+	msg.Payload, msg.Encoding = base64.StdEncoding.EncodeToString(packed), c.Encoding
+}
+
+// compressFor compresses msg for pid, as far as pid has said which
+// encodings it reads.
+func (n *AgentNode) compressFor(pid peer.ID, msg *AgentMessage) {
+	if n.Compression == nil {
+		return
+	}
+	accepted, _ := n.CurrentHost().Peerstore().Get(pid, encodingsKey)
+	encodings, _ := accepted.([]string)
+	n.compressMessage(msg, encodings)
+}
+
+// noteEncodings remembers the encodings pid said it reads in msg.
+func (n *AgentNode) noteEncodings(pid peer.ID, msg *AgentMessage) {
+	if len(msg.AcceptEncoding) > 0 {
+		n.CurrentHost().Peerstore().Put(pid, encodingsKey, msg.AcceptEncoding)
+	}
+}
+
+// compressedPacket is how a compressed pubsub message travels: the message's
+// JSON, compressed with Encoding.
+type compressedPacket struct {
+	Encoding   string `json:"encoding"`
+	Compressed []byte `json:"compressed"`
+}
+
+// pubsubData compresses data, a pubsub message, if the node compresses and
+// it is large enough to be worth it.
+func (n *AgentNode) pubsubData(data []byte) []byte {
+	c := n.Compression
+	if c == nil || len(data) < c.threshold() {
+		return data
+	}
+	packed, err := compress(c.Encoding, data)
+	if err != nil {
+		fmt.Printf("[PubSub] Failed to compress a message: %v\n", err)
+		return data
+	}
+	n.Metrics.observeCompression("pubsub", c.Encoding, len(data), len(packed))
+	out, _ := json.Marshal(compressedPacket{Encoding: c.Encoding, Compressed: packed})
+	return out
+}
+
+// receivedPubsubData undoes pubsubData for a received message. A message
+// that wasn't compressed is returned as it is.
+func (n *AgentNode) receivedPubsubData(data []byte) ([]byte, error) {
+	var packet compressedPacket
+	if json.Unmarshal(data, &packet) != nil || packet.Encoding == "" {
+		return data, nil
+	}
+	return decompress(packet.Encoding, packet.Compressed, n.maxDecompressed())
+}
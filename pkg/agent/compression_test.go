@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLargeTaskMessagesAreCompressed(t *testing.T) {
+	delegator, worker := connectedPair(t)
+	for _, n := range []*AgentNode{delegator, worker} {
+		n.Compression = &Compression{Encoding: EncodingZstd, Threshold: 1 << 10}
+		n.Metrics = NewMetrics()
+	}
+	if err := worker.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	text := strings.Repeat("a long and repetitive document ", 1000)
+	payload := map[string]interface{}{"capability": "summarize", "text": text}
+
+	// The first request goes as it is, since the worker hasn't said what it
+	// reads; its response comes compressed, and the second request goes so
+	for i := 1; i <= 2; i++ {
+		result, err := delegator.SendTask(ctx, dialAddr(worker), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := result.(map[string]interface{})["text"]; got != text {
+			t.Fatalf("result %d came back changed", i)
+		}
+	}
+	if got := testutil.CollectAndCount(delegator.Metrics.compression); got != 1 {
+		t.Fatalf("delegator compression ratio series = %d, want 1", got)
+	}
+	sent := testutil.ToFloat64(delegator.Metrics.compressed.WithLabelValues("stream", EncodingZstd, "original"))
+	packed := testutil.ToFloat64(delegator.Metrics.compressed.WithLabelValues("stream", EncodingZstd, "compressed"))
+	if sent < float64(len(text)) || packed <= 0 || packed > sent/10 {
+		t.Errorf("delegator compressed %v bytes to %v, want one request compressed well", sent, packed)
+	}
+	if got := testutil.ToFloat64(worker.Metrics.compressed.WithLabelValues("stream", EncodingZstd, "original")); got < 2*float64(len(text)) {
+		t.Errorf("worker compressed %v bytes, want both responses", got)
+	}
+
+	// Small messages aren't worth it
+	if _, err := delegator.SendTask(ctx, dialAddr(worker), map[string]interface{}{"capability": "summarize", "text": "short"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(delegator.Metrics.compressed.WithLabelValues("stream", EncodingZstd, "original")); got != sent {
+		t.Errorf("a small request was compressed: %v bytes, was %v", got, sent)
+	}
+}
+
+func TestDecompressedSizeIsLimited(t *testing.T) {
+	// A few kilobytes that expand past the default limit
+	n := &AgentNode{}
+	bomb, _ := json.Marshal(strings.Repeat("0", DefaultMaxDecompressed))
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		packed, err := compress(encoding, bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed) > maxMessageSize/100 {
+			t.Fatalf("%s: bomb is %d bytes compressed", encoding, len(packed))
+		}
+		msg := AgentMessage{Type: "task", Encoding: encoding, Payload: base64.StdEncoding.EncodeToString(packed)}
+		if err := n.decodePayload(&msg); !errors.Is(err, errMessageTooLarge) {
+			t.Errorf("%s: err = %v, want errMessageTooLarge", encoding, err)
+		}
+		if _, err := n.receivedPubsubData(mustMarshal(t, compressedPacket{Encoding: encoding, Compressed: packed})); !errors.Is(err, errMessageTooLarge) {
+			t.Errorf("%s pubsub: err = %v, want errMessageTooLarge", encoding, err)
+		}
+	}
+
+	// A node may allow more
+	n.MaxDecompressed = 2 * DefaultMaxDecompressed
+	packed, _ := compress(EncodingZstd, bomb)
+	msg := AgentMessage{Type: "task", Encoding: EncodingZstd, Payload: base64.StdEncoding.EncodeToString(packed)}
+	if err := n.decodePayload(&msg); err != nil || msg.Encoding != "" || len(msg.Payload.(string)) != DefaultMaxDecompressed {
+		t.Errorf("under a larger limit: err = %v", err)
+	}
+}
+
+// bomb compresses size zero bytes with encoding without holding them.
+func bomb(t *testing.T, encoding string, size int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case EncodingZstd:
+		w, _ = zstd.NewWriter(&b, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	case EncodingGzip:
+		w, _ = gzip.NewWriterLevel(&b, gzip.BestCompression)
+	}
+	zeros := make([]byte, 1<<20)
+	for written := 0; written < size; written += len(zeros) {
+		if _, err := w.Write(zeros); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestDecompressionBombDoesNotExhaustMemory(t *testing.T) {
+	n := &AgentNode{MaxDecompressed: 1 << 20}
+	for encoding, size := range map[string]int{EncodingZstd: 1 << 30, EncodingGzip: 256 << 20} {
+		packed := bomb(t, encoding, size)
+		if len(packed) > maxMessageSize {
+			t.Fatalf("%s: bomb is %d bytes compressed", encoding, len(packed))
+		}
+		msg := AgentMessage{Type: "task", Encoding: encoding, Payload: base64.StdEncoding.EncodeToString(packed)}
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		err := n.decodePayload(&msg)
+		runtime.ReadMemStats(&after)
+		if !errors.Is(err, errMessageTooLarge) {
+			t.Errorf("%s: err = %v, want errMessageTooLarge", encoding, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 32<<20 {
+			t.Errorf("%s: decoding a %d MiB bomb allocated %d MiB", encoding, size>>20, allocated>>20)
+		}
+	}
+}
+
+func TestCompressedRequestOverTheLimitIsRefused(t *testing.T) {
+	sender, worker := connectedPair(t)
+	worker.MaxDecompressed = 64 << 10
+	packed := bomb(t, EncodingZstd, 64<<20)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := sender.CurrentHost().NewStream(ctx, worker.CurrentHost().ID(), protocol.ID(TaskProtocol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := writeMessage(s, AgentMessage{Type: "task", Encoding: EncodingZstd, Payload: base64.StdEncoding.EncodeToString(packed)}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pe := peerError(worker.CurrentHost().ID().String(), *resp); resp.Type != MessageError || pe.Code != ErrCodeBadRequest {
+		t.Fatalf("response = %+v, want a bad_request error", resp)
+	}
+	rec, err := worker.Store.GetPeer(sender.CurrentHost().ID().String())
+	if err != nil || rec == nil || rec.Misbehavior != DefaultMisbehaviorConfig().Points[ViolationOversized] {
+		t.Errorf("sender's record = %+v, %v; want scored for an oversized message", rec, err)
+	}
+}
+
+func TestPubsubDataRoundTrip(t *testing.T) {
+	n := &AgentNode{Compression: &Compression{Encoding: EncodingGzip, Threshold: 64}}
+	packet := mustMarshal(t, SignedPacket{Data: strings.Repeat(`{"capability":"summarize"}`, 20), PeerID: "peer", Signature: "sig"})
+	sent := n.pubsubData(packet)
+	if len(sent) >= len(packet) {
+		t.Fatalf("sent %d bytes for a %d byte packet", len(sent), len(packet))
+	}
+	got, err := n.receivedPubsubData(sent)
+	if err != nil || string(got) != string(packet) {
+		t.Errorf("received %q, %v; want the packet back", got, err)
+	}
+
+	// Packets from nodes that don't compress pass through
+	if got, err := n.receivedPubsubData(packet); err != nil || string(got) != string(packet) {
+		t.Errorf("uncompressed packet came through as %q, %v", got, err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
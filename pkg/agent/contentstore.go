@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxContentSize caps a document read from a content store.
+const maxContentSize = 4 << 20
+
+// ContentStore keeps documents under URIs derived from their content, so a
+// URI published on-chain can't later point at something else.
+type ContentStore interface {
+	// Put stores data and returns its URI.
+	Put(ctx context.Context, data []byte) (string, error)
+	// Get returns the data stored under uri.
+	Get(ctx context.Context, uri string) ([]byte, error)
+}
+
+// StreamingContentStore is a ContentStore that can store a document as it
+// is read, so documents of any size go in without being held in memory.
+type StreamingContentStore interface {
+	ContentStore
+	// PutStream stores what r holds and returns its URI.
+	PutStream(ctx context.Context, r io.Reader) (string, error)
+}
+
+// PutContent stores what r holds in store: streamed into a
+// StreamingContentStore, read whole, up to maxContentSize, into others.
+func PutContent(ctx context.Context, store ContentStore, r io.Reader) (string, error) {
+	if s, ok := store.(StreamingContentStore); ok {
+		return s.PutStream(ctx, r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxContentSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxContentSize {
+		return "", fmt.Errorf("document is over %d bytes", maxContentSize)
+	}
+	return store.Put(ctx, data)
+}
+
+// DirContentStore keeps documents in a directory, named by their SHA-256, and
+// hands out file:// URIs. It suits nodes sharing a filesystem, and tests.
+type DirContentStore struct {
+	Dir string
+}
+
+func (s DirContentStore) Put(ctx context.Context, data []byte) (string, error) {
+	return s.PutStream(ctx, bytes.NewReader(data))
+}
+
+// PutStream writes r to a temporary file, hashing it on the way, and renames
+// the file to the hash once r is done.
+func (s DirContentStore) PutStream(ctx context.Context, r io.Reader) (string, error) {
+	dir, err := filepath.Abs(s.Dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, ".put-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, sum), r); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, hex.EncodeToString(sum.Sum(nil)))
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+// Get reads a file:// URI and checks the file still hashes to its name.
+func (s DirContentStore) Get(ctx context.Context, uri string) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return nil, fmt.Errorf("not a file:// URI: %s", uri)
+	}
+	path := filepath.FromSlash(u.Path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != filepath.Base(path) {
+		return nil, fmt.Errorf("%s does not match its content hash", uri)
+	}
+	return data, nil
+}
+
+// Delete removes the file behind a file:// URI; one already gone is not an
+// error.
+func (s DirContentStore) Delete(ctx context.Context, uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return fmt.Errorf("not a file:// URI: %s", uri)
+	}
+	if err := os.Remove(filepath.FromSlash(u.Path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DefaultIPFSAPI is the RPC address of a local Kubo (go-ipfs) daemon.
+const DefaultIPFSAPI = "http://127.0.0.1:5001"
+
+// IPFSContentStore adds documents through a Kubo daemon's RPC API and hands
+// out ipfs:// URIs. The daemon checks blocks against their CIDs on read.
+type IPFSContentStore struct {
+	API    string       // Kubo RPC address; empty means DefaultIPFSAPI
+	Client *http.Client // nil means http.DefaultClient
+}
+
+func (s IPFSContentStore) Put(ctx context.Context, data []byte) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "manifest.json")
+	if err != nil {
+		return "", err
+	}
+	part.Write(data)
+	form.Close()
+
+	var added struct {
+		Hash string
+	}
+	if err := s.call(ctx, "add?cid-version=1&pin=true", form.FormDataContentType(), &body, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&added)
+	}); err != nil {
+		return "", err
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("ipfs add returned no CID")
+	}
+	return "ipfs://" + added.Hash, nil
+}
+
+func (s IPFSContentStore) Get(ctx context.Context, uri string) ([]byte, error) {
+	cid, ok := strings.CutPrefix(uri, "ipfs://")
+	if !ok || cid == "" {
+		return nil, fmt.Errorf("not an ipfs:// URI: %s", uri)
+	}
+	var data []byte
+	err := s.call(ctx, "cat?arg="+url.QueryEscape(cid), "", nil, func(r io.Reader) (err error) {
+		data, err = io.ReadAll(io.LimitReader(r, maxContentSize+1))
+		if err == nil && len(data) > maxContentSize {
+			err = fmt.Errorf("%s is over %d bytes", uri, maxContentSize)
+		}
+		return err
+	})
+	return data, err
+}
+
+// call POSTs to a Kubo RPC endpoint, which only accepts POST, and hands the
+// body of a successful answer to read.
+func (s IPFSContentStore) call(ctx context.Context, endpoint, contentType string, body io.Reader, read func(io.Reader) error) error {
+	api := s.API
+	if api == "" {
+		api = DefaultIPFSAPI
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(api, "/")+"/api/v0/"+endpoint, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("ipfs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string
+		}
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(raw, &e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(raw))
+		}
+		return fmt.Errorf("ipfs returned %d: %s", resp.StatusCode, e.Message)
+	}
+	return read(resp.Body)
+}
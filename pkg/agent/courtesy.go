@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// Decline reason codes: why the node won't take up a task or knowledge
+// request, as its requester is told in a DeclineNotice.
+const (
+	DeclineUnsupportedTopic = "unsupported-topic" // the node knows nothing on the topic
+	DeclinePriceTooLow      = "price-too-low"     // CounterAmount is what it would take
+	DeclineAtCapacity       = "at-capacity"       // RetryAfter is when it may have room
+	DeclineNotInterested    = "not-interested"    // the node's evaluator passed on the task
+)
+
+// MessageDecline is the AgentMessage type a DeclineNotice is sent in, on
+// the task protocol. It isn't answered.
+const MessageDecline = "decline"
+
+// Courtesy reply defaults: each peer is sent at most DefaultCourtesyPerPeer
+// declines per DefaultCourtesyInterval.
+const (
+	DefaultCourtesyPerPeer  = 3
+	DefaultCourtesyInterval = 10 * time.Minute
+)
+
+// declineTimeout bounds reaching a requester and sending it a decline.
+const declineTimeout = 15 * time.Second
+
+// ErrCourtesyLimited is returned by SendDecline when the peer was sent as
+// many declines as it may be for now.
+var ErrCourtesyLimited = errors.New("courtesy replies to this peer are rate-limited")
+
+// DeclineNotice tells a requester the node won't take up its task or
+// knowledge request, and why, so it can tell "not interested" from
+// "offline". It is signed with the node's peer key.
+type DeclineNotice struct {
+	TaskID        string `json:"taskId"` // the event's task record, e.g. "query:7"
+	Kind          string `json:"kind"`
+	ChainID       uint64 `json:"chainId,omitempty"`
+	Topic         string `json:"topic,omitempty"`
+	Reason        string `json:"reason"`                  // a Decline* code
+	CounterAmount string `json:"counterAmount,omitempty"` // wei, for DeclinePriceTooLow
+	RetryAfter    int64  `json:"retryAfter,omitempty"`    // seconds, for DeclineAtCapacity
+	Text          string `json:"text,omitempty"`          // for people, from the node's templates
+	Responder     string `json:"responder"`               // peer ID that signed
+	IssuedAt      int64  `json:"issuedAt"`                // unix ms
+	ExpiresAt     int64  `json:"expiresAt,omitempty"`     // unix ms after which CounterAmount no longer stands
+	Signature     string `json:"signature"`
+}
+
+// Validate requires the task declined; the signature is checked by the
+// receiver, which knows who sent the notice.
+func (d DeclineNotice) Validate() error {
+	if d.TaskID == "" {
+		return errors.New("decline without a task")
+	}
+	return nil
+}
+
+func (d DeclineNotice) signedBytes() []byte {
+	d.Signature = ""
+	return signedDocument("agentmesh-decline:", d)
+}
+
+// Verify checks that Responder signed the notice.
+func (d DeclineNotice) Verify() bool {
+	return verifyPeerSignature(d.Responder, d.signedBytes(), d.Signature)
+}
+
+// DeclineHandler gets the declines other nodes send this one.
+type DeclineHandler func(from string, notice DeclineNotice)
+
+// CourtesyReplies makes the node tell requesters it skips why, instead of
+// going silent. Each peer is sent at most PerPeer declines per Interval, so
+// a flood of requests doesn't become a flood of replies.
+type CourtesyReplies struct {
+	PerPeer  int           // 0 means DefaultCourtesyPerPeer
+	Interval time.Duration // 0 means DefaultCourtesyInterval
+
+	templates map[string]*template.Template
+	clock     Clock
+	mu        sync.Mutex
+	sent      map[string][]time.Time // by peer ID, within the last Interval
+}
+
+// NewCourtesyReplies returns courtesy replies whose text comes from
+// templates, text/template sources by Decline* code executed with the
+// DeclineNotice. Codes without a template are sent without text.
+func NewCourtesyReplies(templates map[string]string) (*CourtesyReplies, error) {
+	c := &CourtesyReplies{templates: map[string]*template.Template{}, clock: SystemClock, sent: map[string][]time.Time{}}
+	for code, src := range templates {
+		switch code {
+		case DeclineUnsupportedTopic, DeclinePriceTooLow, DeclineAtCapacity, DeclineNotInterested:
+		default:
+			return nil, fmt.Errorf("template for unknown reason %q: want %s, %s, %s or %s", code,
+				DeclineUnsupportedTopic, DeclinePriceTooLow, DeclineAtCapacity, DeclineNotInterested)
+		}
+		t, err := template.New(code).Option("missingkey=error").Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("template for %s: %w", code, err)
+		}
+		c.templates[code] = t
+	}
+	return c, nil
+}
+
+// LoadCourtesyTemplates reads a YAML map of Decline* codes to the text
+// templates NewCourtesyReplies takes.
+func LoadCourtesyTemplates(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var templates map[string]string
+	if err := yaml.Unmarshal(raw, &templates); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return templates, nil
+}
+
+// SetClock replaces the clock the rate limit is kept by.
+func (c *CourtesyReplies) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// allow reports whether peerID may be sent another decline now, counting
+// it if so.
+func (c *CourtesyReplies) allow(peerID string) bool {
+	limit, interval := c.PerPeer, c.Interval
+	if limit <= 0 {
+		limit = DefaultCourtesyPerPeer
+	}
+	if interval <= 0 {
+		interval = DefaultCourtesyInterval
+	}
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recent := c.sent[peerID][:0]
+	for _, at := range c.sent[peerID] {
+		if now.Sub(at) < interval {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= limit {
+		c.sent[peerID] = recent
+		return false
+	}
+	c.sent[peerID] = append(recent, now)
+	return true
+}
+
+// text is the human text of notice, or "" without a template for its
+// reason or if the template fails.
+func (c *CourtesyReplies) text(notice DeclineNotice) string {
+	t := c.templates[notice.Reason]
+	if t == nil {
+		return ""
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, notice); err != nil {
+		fmt.Printf("[Courtesy] Template for %s failed: %v\n", notice.Reason, err)
+		return ""
+	}
+	return b.String()
+}
+
+// SendDecline tells peerID, the requester of record, that the node skipped
+// it and why, as d's Code says. It does nothing without Courtesy, for
+// decisions other than skips, and for skips without a code, such as of
+// denied requesters. It fails with ErrCourtesyLimited when peerID was sent
+// its share of declines for now.
+func (n *AgentNode) SendDecline(ctx context.Context, peerID string, record TaskRecord, d Decision) error {
+	c := n.Courtesy
+	if c == nil || d.Action != ActionSkip || d.Code == "" {
+		return nil
+	}
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid requester peer ID %q: %w", peerID, err)
+	}
+	if !c.allow(peerID) {
+		return ErrCourtesyLimited
+	}
+
+	n.mu.RLock()
+	priv := n.privKey
+	n.mu.RUnlock()
+	h := n.CurrentHost()
+	notice := DeclineNotice{TaskID: record.ID, Kind: record.Kind, ChainID: record.ChainID, Topic: record.Topic, Reason: d.Code,
+		CounterAmount: d.CounterAmount, RetryAfter: d.RetryAfter, Responder: h.ID().String(), IssuedAt: c.clock.Now().UnixMilli()}
+	if notice.CounterAmount != "" {
+		notice.ExpiresAt = notice.IssuedAt + n.Offers.ttl().Milliseconds()
+	}
+	notice.Text = c.text(notice)
+	if notice.Signature, err = signData(priv, notice.signedBytes()); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, declineTimeout)
+	defer cancel()
+	if err := n.reachPeer(ctx, pid); err != nil {
+		return err
+	}
+	s, err := h.NewStream(network.WithAllowLimitedConn(ctx, "decline"), pid, protocol.ID(TaskProtocol))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	s.SetDeadline(deadline)
+	return writeMessage(s, AgentMessage{ID: record.ID, Type: MessageDecline, Payload: notice, Sender: notice.Responder, Timestamp: notice.IssuedAt})
+}
+
+// receiveDecline records a decline sent to this node and hands it to
+// OnDecline.
+func (n *AgentNode) receiveDecline(s network.Stream, msg AgentMessage) {
+	from := s.Conn().RemotePeer().String()
+	var notice DeclineNotice
+	if err := UnmarshalPayload(msg, &notice); err != nil {
+		n.misbehaved(s, ViolationProtocolError)
+		return
+	}
+	if notice.Responder != from || !notice.Verify() {
+		n.misbehaved(s, ViolationBadSignature)
+		return
+	}
+	// A skewed clock is flagged; the notice stands
+	n.checkClock(s.Conn().RemotePeer(), notice.IssuedAt)
+	fmt.Printf("[Courtesy] %s declined %s: %s\n", n.Names.Display(from), notice.TaskID, notice.Reason)
+	n.Events.Add("decline_received", notice)
+	if n.OnDecline != nil {
+		n.OnDecline(from, notice)
+	}
+}
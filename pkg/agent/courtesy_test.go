@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+)
+
+func TestSkipsCarryTheirDeclineCodes(t *testing.T) {
+	in := NewTaskIntake(newTestStore(t), nil, nil)
+	in.RequirePayment(big.NewInt(100))
+	full := false
+	in.UseCapacity(func() time.Duration {
+		if full {
+			return time.Minute
+		}
+		return 0
+	})
+	in.VerifyFunding(func(taskId *big.Int) (*big.Int, error) {
+		if taskId.Int64() == 4 {
+			return big.NewInt(150), nil
+		}
+		return big.NewInt(1000), nil
+	})
+	declined := [32]byte{5}
+	in.UseEvaluator(StubEvaluator{Verdicts: map[string]Verdict{
+		TaskRecordFromEvent(TaskCreatedEvent{SpecHash: declined}).SpecHash: {Confidence: 0.8, Reason: "not my field"},
+	}})
+
+	check := func(name string, d Decision, code, counter string, retryAfter int64) {
+		t.Helper()
+		if d.Action != ActionSkip || d.Code != code || d.CounterAmount != counter || d.RetryAfter != retryAfter {
+			t.Errorf("%s: %+v, want a skip coded %q, counter %q, retry after %d", name, d, code, counter, retryAfter)
+		}
+	}
+	check("unpaid", in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(1)}), DeclinePriceTooLow, "100", 0)
+	check("underpaid", in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(2), Payment: big.NewInt(50)}), DeclinePriceTooLow, "100", 0)
+	full = true
+	check("at capacity", in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(3), Payment: big.NewInt(200)}), DeclineAtCapacity, "", 60)
+	full = false
+	check("underfunded", in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(4), Payment: big.NewInt(200)}), DeclinePriceTooLow, "200", 0)
+	check("declined", in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(5), SpecHash: declined, Payment: big.NewInt(200)}), DeclineNotInterested, "", 0)
+	check("unknown topic", in.HandleQuery(KnowledgeRequestedEvent{RequestId: big.NewInt(6), Topic: "astronomy"}), DeclineUnsupportedTopic, "", 0)
+
+	// Skips no requester is told of
+	check("duplicate", in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(5), SpecHash: declined, Payment: big.NewInt(200)}), "", "", 0)
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(7), Payment: big.NewInt(200)}); d.Action != ActionBid || d.Code != "" {
+		t.Errorf("paying task: %+v, want an uncoded bid", d)
+	}
+}
+
+func TestDeclinesReachRequestersAndAreRateLimited(t *testing.T) {
+	delegator, worker := connectedPair(t)
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	courtesy, err := NewCourtesyReplies(map[string]string{DeclinePriceTooLow: "I'd do it for {{.CounterAmount}} wei"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	courtesy.SetClock(clock)
+	courtesy.PerPeer, courtesy.Interval = 2, time.Minute
+	worker.Courtesy = courtesy
+	received := make(chan DeclineNotice, 10)
+	delegator.OnDecline = func(from string, notice DeclineNotice) { received <- notice }
+
+	ctx := context.Background()
+	dID := delegator.CurrentHost().ID().String()
+	record := TaskRecord{ID: "task:9", Kind: TaskKindEscrow}
+	d := Decision{Action: ActionSkip, Code: DeclinePriceTooLow, CounterAmount: "500"}
+
+	// A flood of skips is answered twice per interval
+	var sent, limited int
+	for i := 0; i < 5; i++ {
+		switch err := worker.SendDecline(ctx, dID, record, d); {
+		case err == nil:
+			sent++
+		case errors.Is(err, ErrCourtesyLimited):
+			limited++
+		default:
+			t.Fatalf("SendDecline: %v", err)
+		}
+	}
+	if sent != 2 || limited != 3 {
+		t.Errorf("sent %d and suppressed %d declines, want 2 and 3", sent, limited)
+	}
+	for i := 0; i < sent; i++ {
+		select {
+		case n := <-received:
+			if n.TaskID != "task:9" || n.Reason != DeclinePriceTooLow || n.CounterAmount != "500" || n.Text != "I'd do it for 500 wei" ||
+				n.Responder != worker.CurrentHost().ID().String() || !n.Verify() {
+				t.Errorf("received %+v, want the worker's signed decline", n)
+			}
+			if n.ExpiresAt != n.IssuedAt+DefaultQuoteTTL.Milliseconds() {
+				t.Errorf("counter amount stands until %d, want %s after it was issued", n.ExpiresAt, DefaultQuoteTTL)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("decline never arrived")
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if err := worker.SendDecline(ctx, dID, record, d); err != nil {
+		t.Errorf("after the interval: %v, want it sent", err)
+	}
+
+	// Nothing is sent for bids, uncoded skips or without courtesy
+	if err := worker.SendDecline(ctx, dID, record, Decision{Action: ActionSkip, Reason: "denied"}); err != nil {
+		t.Errorf("uncoded skip: %v", err)
+	}
+	worker.Courtesy = nil
+	if err := worker.SendDecline(ctx, dID, record, d); err != nil {
+		t.Errorf("without courtesy: %v", err)
+	}
+	select {
+	case n := <-received:
+		if n.IssuedAt != clock.Now().UnixMilli() {
+			t.Errorf("received %+v, want only the one sent after the interval", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decline after the interval never arrived")
+	}
+	select {
+	case n := <-received:
+		t.Errorf("received %+v, want nothing more", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err := NewCourtesyReplies(map[string]string{"busy": "later"}); err == nil {
+		t.Error("NewCourtesyReplies took a template for an unknown reason")
+	}
+}
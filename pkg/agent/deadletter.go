@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Dead letter statuses. A pending letter is retried on a backoff schedule;
+// one that used up its attempts is parked until retried by hand.
+const (
+	DeadLetterPending = "pending"
+	DeadLetterParked  = "parked"
+)
+
+// DefaultMaxAttempts is how many deliveries an event gets, the first
+// included, before its dead letter is parked.
+const DefaultMaxAttempts = 5
+
+// DefaultRetryBackoff is the wait before the first retry; it doubles with
+// every failed attempt, up to maxRetryBackoff.
+const DefaultRetryBackoff = 30 * time.Second
+
+const maxRetryBackoff = time.Hour
+
+// DeadLetter is a watcher event whose callback failed, kept so it can be
+// delivered again instead of being lost.
+type DeadLetter struct {
+	ID          string    `json:"id"`                // the event's task ID, e.g. "task:7"
+	ChainID     uint64    `json:"chainId,omitempty"` // of the watcher that kept it; 0 if unbound
+	Log         types.Log `json:"log"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	Status      string    `json:"status"`
+	NextAttempt int64     `json:"nextAttempt"` // unix seconds; unused once parked
+	CreatedAt   int64     `json:"createdAt"`
+	UpdatedAt   int64     `json:"updatedAt"`
+}
+
+// SaveDeadLetter inserts or replaces a dead letter.
+func (s *sqlStore) SaveDeadLetter(d DeadLetter) error {
+	raw, err := json.Marshal(d.Log)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`
+		INSERT INTO dead_letters (id, chain_id, log, attempts, last_error, status, next_attempt, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET log = excluded.log, attempts = excluded.attempts, last_error = excluded.last_error,
+			status = excluded.status, next_attempt = excluded.next_attempt, updated_at = excluded.updated_at`,
+		d.ID, int64(d.ChainID), string(raw), d.Attempts, d.LastError, d.Status, d.NextAttempt, d.CreatedAt, d.UpdatedAt)
+	return err
+}
+
+// GetDeadLetter returns a dead letter, or nil if there is none for id.
+func (s *sqlStore) GetDeadLetter(id string) (*DeadLetter, error) {
+	rows, err := s.query(`
+		SELECT id, chain_id, log, attempts, last_error, status, next_attempt, created_at, updated_at
+		FROM dead_letters WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	letters, err := scanDeadLetters(rows)
+	if err != nil || len(letters) == 0 {
+		return nil, err
+	}
+	return &letters[0], nil
+}
+
+// ListDeadLetters returns every dead letter, oldest first.
+func (s *sqlStore) ListDeadLetters() ([]DeadLetter, error) {
+	rows, err := s.query(`
+		SELECT id, chain_id, log, attempts, last_error, status, next_attempt, created_at, updated_at
+		FROM dead_letters ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeadLetters(rows)
+}
+
+// DeleteDeadLetter removes a dead letter once its event was delivered.
+func (s *sqlStore) DeleteDeadLetter(id string) error {
+	_, err := s.exec("DELETE FROM dead_letters WHERE id = ?", id)
+	return err
+}
+
+func scanDeadLetters(rows *sql.Rows) ([]DeadLetter, error) {
+	defer rows.Close()
+	var results []DeadLetter
+	for rows.Next() {
+		var d DeadLetter
+		var raw string
+		var chainID int64
+		var lastError sql.NullString
+		if err := rows.Scan(&d.ID, &chainID, &raw, &d.Attempts, &lastError, &d.Status, &d.NextAttempt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(raw), &d.Log); err != nil {
+			return nil, fmt.Errorf("dead letter %s: %w", d.ID, err)
+		}
+		d.ChainID, d.LastError = uint64(chainID), lastError.String
+		results = append(results, d)
+	}
+	return results, rows.Err()
+}
+
+// WithRetryPolicy sets how many deliveries a failing event gets before its
+// dead letter is parked, and the backoff before the first retry. Non-positive
+// values keep DefaultMaxAttempts and DefaultRetryBackoff.
+func WithRetryPolicy(maxAttempts int, backoff time.Duration) WatcherOption {
+	return func(w *EventWatcher) {
+		if maxAttempts > 0 {
+			w.maxAttempts = maxAttempts
+		}
+		if backoff > 0 {
+			w.retryBackoff = backoff
+		}
+	}
+}
+
+// deliver hands the event id to its callback, turning a panic into an
+// error. A failure is written to the dead letter queue when the watcher has a
+// store; the error returned means it couldn't be, and the event is lost
+// unless delivered again.
+func (w *EventWatcher) deliver(id string, vLog types.Log) error {
+	_, span := tracerFrom(w.tracing).Start(context.Background(), "watcher.event", trace.WithAttributes(
+		attribute.String("agentmesh.event", id),
+		attribute.Int64("eth.block", int64(vLog.BlockNumber)),
+		attribute.String("eth.tx", vLog.TxHash.Hex()),
+	))
+	err := callSafely(func() error { return w.dispatch(vLog) })
+	endSpan(span, err)
+	if err == nil {
+		return nil
+	}
+	if w.store == nil {
+		return fmt.Errorf("event %s failed: %w", id, err)
+	}
+	now := w.clock.Now()
+	d := DeadLetter{ID: id, ChainID: w.chainID, Log: vLog, CreatedAt: now.Unix()}
+	if prev, gerr := w.store.GetDeadLetter(id); gerr == nil && prev != nil {
+		d = *prev
+	}
+	return w.recordFailure(&d, err, now)
+}
+
+// recordFailure counts a failed delivery of d and schedules the next one, or
+// parks d once it is out of attempts. It fails only if d can't be saved.
+func (w *EventWatcher) recordFailure(d *DeadLetter, err error, now time.Time) error {
+	d.Attempts++
+	d.LastError = err.Error()
+	d.UpdatedAt = now.Unix()
+	d.Status = DeadLetterPending
+	if d.Attempts >= w.maxAttempts {
+		d.Status = DeadLetterParked
+	} else {
+		backoff := min(w.retryBackoff<<(d.Attempts-1), maxRetryBackoff)
+		d.NextAttempt = now.Add(backoff).Unix()
+	}
+	fmt.Printf("[Watcher] Event %s failed (attempt %d, %s): %v\n", d.ID, d.Attempts, d.Status, err)
+	if serr := w.store.SaveDeadLetter(*d); serr != nil {
+		return fmt.Errorf("event %s failed and its dead letter wasn't saved: %w (callback: %v)", d.ID, serr, err)
+	}
+	w.reportError(fmt.Errorf("event %s failed, %s as a dead letter: %w", d.ID, d.Status, err))
+	return nil
+}
+
+// callSafely runs callback, returning its error, or its panic as one.
+func callSafely(callback func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("callback panicked: %v", r)
+		}
+	}()
+	return callback()
+}
+
+// retryDeadLetters redelivers the watcher's pending dead letters that are
+// due. Those of a watcher on another chain are left to it.
+func (w *EventWatcher) retryDeadLetters(now time.Time) {
+	if w.store == nil {
+		return
+	}
+	letters, err := w.store.ListDeadLetters()
+	if err != nil {
+		w.reportError(fmt.Errorf("failed to list dead letters: %w", err))
+		return
+	}
+	for _, d := range letters {
+		if w.owns(d) && d.Status == DeadLetterPending && d.NextAttempt <= now.Unix() {
+			w.redeliver(d, now)
+		}
+	}
+}
+
+// owns reports whether d was kept by a watcher on the same chain. The
+// primary chain's watcher also takes the letters kept before it was bound to
+// a chain.
+func (w *EventWatcher) owns(d DeadLetter) bool {
+	return d.ChainID == w.chainID || (d.ChainID == 0 && !w.otherChain)
+}
+
+// redeliver hands d's event to the callbacks again, dropping the letter if
+// they succeed.
+func (w *EventWatcher) redeliver(d DeadLetter, now time.Time) error {
+	if err := callSafely(func() error { return w.dispatch(d.Log) }); err != nil {
+		if serr := w.recordFailure(&d, err, now); serr != nil {
+			w.reportError(serr)
+		}
+		return err
+	}
+	fmt.Printf("[Watcher] Event %s delivered after %d failed attempts\n", d.ID, d.Attempts)
+	return w.store.DeleteDeadLetter(d.ID)
+}
+
+// ListDeadLetters returns the events whose callbacks failed, pending and
+// parked, oldest first.
+func (w *EventWatcher) ListDeadLetters() ([]DeadLetter, error) {
+	if w.store == nil {
+		return nil, fmt.Errorf("dead letters need a store; call UseCheckpoints")
+	}
+	letters, err := w.store.ListDeadLetters()
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	return letters, err
+}
+
+// RetryDeadLetter delivers a dead letter's event now, parked or not. On
+// success the letter is removed; on failure it counts as another attempt and
+// the error is returned.
+func (w *EventWatcher) RetryDeadLetter(id string) error {
+	if w.store == nil {
+		return fmt.Errorf("dead letters need a store; call UseCheckpoints")
+	}
+	d, err := w.store.GetDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return fmt.Errorf("dead letter %s: %w", id, ErrNotFound)
+	}
+	if !w.owns(*d) {
+		return fmt.Errorf("dead letter %s is of chain %d; retry it with that chain's watcher", id, d.ChainID)
+	}
+	return w.redeliver(*d, w.clock.Now())
+}
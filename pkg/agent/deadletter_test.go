@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const testEscrowHex = "0x00000000000000000000000000000000000000e5"
+
+// taskCreatedLog is the TaskCreated log the escrow emits for task id.
+func taskCreatedLog(t *testing.T, w *EventWatcher, id int64) types.Log {
+	t.Helper()
+	data, err := w.escrowABI.Events["TaskCreated"].Inputs.NonIndexed().Pack([32]byte{1}, big.NewInt(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.Log{
+		Address:     w.escrowAddrs[0],
+		Topics:      []common.Hash{w.escrowABI.Events["TaskCreated"].ID, common.BigToHash(big.NewInt(id)), common.HexToHash("0xc1")},
+		Data:        data,
+		BlockNumber: 42,
+	}
+}
+
+func TestWatcherDeadLettersFailingCallback(t *testing.T) {
+	chain := &fakeChain{head: 100}
+	failing := true
+	var delivered []TaskCreatedEvent
+	onTask := func(e TaskCreatedEvent) {
+		if failing {
+			panic("handler broke")
+		}
+		delivered = append(delivered, e)
+	}
+	var errs []error
+	w, err := NewEventWatcher(newFakeRPC(t, chain.handle), []string{testEscrowHex}, []string{zeroAddressHex}, onTask, nil,
+		WithRetryPolicy(3, time.Minute), WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+	w.UseCheckpoints(store, "watcher")
+
+	w.handleLog(taskCreatedLog(t, w, 7))
+	letters, err := w.ListDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "task:7" || letters[0].Attempts != 1 || letters[0].Status != DeadLetterPending {
+		t.Fatalf("dead letters = %+v, want task:7 pending after 1 attempt", letters)
+	}
+	if len(errs) != 1 {
+		t.Errorf("reported %d errors, want 1", len(errs))
+	}
+
+	// Not due yet, then retried on the backoff schedule until parked
+	start := time.Now()
+	w.retryDeadLetters(start)
+	if letters, _ := w.ListDeadLetters(); letters[0].Attempts != 1 {
+		t.Fatalf("retried before the backoff: %+v", letters[0])
+	}
+	w.retryDeadLetters(start.Add(time.Minute))
+	w.retryDeadLetters(start.Add(time.Minute + 2*time.Minute))
+	letters, _ = w.ListDeadLetters()
+	if letters[0].Attempts != 3 || letters[0].Status != DeadLetterParked || letters[0].LastError != "callback panicked: handler broke" {
+		t.Fatalf("after 3 attempts: %+v, want parked", letters[0])
+	}
+	w.retryDeadLetters(start.Add(24 * time.Hour))
+	if letters, _ := w.ListDeadLetters(); letters[0].Attempts != 3 {
+		t.Errorf("parked letter was retried: %+v", letters[0])
+	}
+
+	// A manual retry delivers the parked event once the handler is fixed
+	failing = false
+	if err := w.RetryDeadLetter("task:7"); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 || delivered[0].TaskId.Int64() != 7 || delivered[0].Payment.Int64() != 1000 || delivered[0].Block != 42 {
+		t.Errorf("delivered %+v, want task 7 from the stored log", delivered)
+	}
+	if letters, _ := w.ListDeadLetters(); len(letters) != 0 {
+		t.Errorf("dead letters after delivery = %+v, want none", letters)
+	}
+	if err := w.RetryDeadLetter("task:7"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("retrying a delivered event: %v, want ErrNotFound", err)
+	}
+}
+
+// failingDeadLetterStore fails to save dead letters until healed.
+type failingDeadLetterStore struct {
+	MetadataStore
+	failing bool
+}
+
+func (s *failingDeadLetterStore) SaveDeadLetter(d DeadLetter) error {
+	if s.failing {
+		return errors.New("disk full")
+	}
+	return s.MetadataStore.SaveDeadLetter(d)
+}
+
+func TestWatcherHoldsCheckpointUntilEventIsKept(t *testing.T) {
+	chain := &fakeChain{head: 100}
+	onTask := func(e TaskCreatedEvent) error {
+		return errors.New("intake down")
+	}
+	var errs []error
+	w, err := NewEventWatcherWithHandlers(newFakeRPC(t, chain.handle), []string{testEscrowHex}, []string{zeroAddressHex}, onTask, nil,
+		WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.logs = []types.Log{taskCreatedLog(t, w, 7)}
+	store := &failingDeadLetterStore{MetadataStore: newTestStore(t), failing: true}
+	store.SetCheckpoint("watcher", 10)
+	if err := w.UseCheckpoints(store, "watcher"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The event at block 42 is neither processed nor kept: the blocks before
+	// it are checkpointed, it and the ones after aren't
+	w.pollLogs(context.Background())
+	if block, _, _ := store.GetCheckpoint("watcher"); block != 41 || w.LastBlock() != 41 {
+		t.Errorf("checkpoint = %d, last block = %d, want both 41", block, w.LastBlock())
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "disk full") {
+		t.Errorf("errors = %v, want the failed dead letter", errs)
+	}
+
+	// Once the dead letter is saved the watcher moves past the event
+	store.failing = false
+	w.pollLogs(context.Background())
+	if block, _, _ := store.GetCheckpoint("watcher"); block != 100 {
+		t.Errorf("checkpoint = %d after the event was kept, want 100", block)
+	}
+	letters, _ := w.ListDeadLetters()
+	if len(letters) != 1 || letters[0].ID != "task:7" || letters[0].LastError != "intake down" {
+		t.Errorf("dead letters = %+v, want task:7 failed with the handler's error", letters)
+	}
+}
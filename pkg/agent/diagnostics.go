@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+// diagnosticsErrors is how many recent failure events a diagnostics dump
+// carries.
+const diagnosticsErrors = 50
+
+// Diagnostics is a snapshot of the node's state for triaging problems,
+// served by GET /diagnostics and written by 'agent diagnostics'.
+type Diagnostics struct {
+	GeneratedAt  int64               `json:"generatedAt"` // unix ms
+	Running      bool                `json:"running"`     // taken from a running node, not the database alone
+	Status       NodeStatus          `json:"status"`
+	Peers        []ConnectedPeer     `json:"peers"`
+	Watcher      *WatcherDiagnostics `json:"watcher,omitempty"`
+	Caches       []CacheStats        `json:"caches"`
+	Readiness    *Readiness          `json:"readiness,omitempty"`
+	RecentErrors []NodeEvent         `json:"recentErrors"`
+	Config       map[string]string   `json:"config,omitempty"` // effective settings, secrets redacted
+}
+
+// ConnectedPeer is one peer the node has a connection to.
+type ConnectedPeer struct {
+	PeerID    string   `json:"peerId"`
+	Addrs     []string `json:"addrs"`
+	Direction string   `json:"direction"` // inbound or outbound, of its first connection
+}
+
+// WatcherDiagnostics is the chain watcher's progress.
+type WatcherDiagnostics struct {
+	LastBlock  uint64 `json:"lastBlock,omitempty"`  // last block processed in memory
+	Checkpoint uint64 `json:"checkpoint,omitempty"` // last block persisted
+	Lag        uint64 `json:"lag"`                  // confirmed blocks behind the head
+	LagError   string `json:"lagError,omitempty"`   // why the lag couldn't be measured
+	HeadLag    uint64 `json:"headLag"`              // blocks the RPC's head trails the chain
+}
+
+// CacheStats sizes one of the node's in-memory caches.
+type CacheStats struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// Diagnostics collects the node's state. Measuring the watcher's lag and
+// readiness takes RPC calls, bounded by ctx.
+func (n *AgentNode) Diagnostics(ctx context.Context) Diagnostics {
+	d := Diagnostics{GeneratedAt: time.Now().UnixMilli(), Running: true, Status: n.Status(), Peers: []ConnectedPeer{}, Config: n.DiagnosticConfig}
+
+	if h := n.CurrentHost(); h != nil {
+		for _, pid := range h.Network().Peers() {
+			p := ConnectedPeer{PeerID: pid.String(), Addrs: []string{}}
+			for i, c := range h.Network().ConnsToPeer(pid) {
+				p.Addrs = append(p.Addrs, c.RemoteMultiaddr().String())
+				if i == 0 {
+					p.Direction = c.Stat().Direction.String()
+				}
+			}
+			d.Peers = append(d.Peers, p)
+		}
+	}
+
+	if n.Watcher != nil {
+		w := &WatcherDiagnostics{LastBlock: n.Watcher.LastBlock()}
+		if n.Watcher.store != nil {
+			w.Checkpoint, _, _ = n.Watcher.store.GetCheckpoint(n.Watcher.checkpoint)
+		}
+		lctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+		lag, err := n.Watcher.Lag(lctx)
+		cancel()
+		if err != nil {
+			w.LagError = err.Error()
+		}
+		w.Lag = lag
+		w.HeadLag = n.Watcher.HeadLag()
+		d.Watcher = w
+	}
+
+	d.Caches = []CacheStats{
+		{Name: "routes", Entries: n.Routes.Len(), TTL: n.Routes.ttl.String()},
+		{Name: "peer_history", Entries: n.History.Len()},
+		{Name: "events", Entries: n.Events.Len()},
+	}
+	if n.Gossip != nil {
+		d.Caches = append(d.Caches, CacheStats{Name: "gossip_verdicts", Entries: n.Gossip.Len(), TTL: n.Gossip.ttl().String()})
+	}
+
+	r := n.Readyz()
+	d.Readiness = &r
+
+	d.RecentErrors = []NodeEvent{}
+	for _, e := range n.Events.Since(0) {
+		if e.Error != "" {
+			d.RecentErrors = append(d.RecentErrors, e)
+		}
+	}
+	if len(d.RecentErrors) > diagnosticsErrors {
+		d.RecentErrors = d.RecentErrors[len(d.RecentErrors)-diagnosticsErrors:]
+	}
+	return d
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// DefaultENSRegistry is the ENS registry on Ethereum mainnet, and on the
+// testnets ENS is deployed to.
+const DefaultENSRegistry = "0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e"
+
+// ENS registry resolver(bytes32), and resolver addr(bytes32) and
+// name(bytes32).
+const ensABI = `[
+	{"inputs":[{"internalType":"bytes32","name":"node","type":"bytes32"}],"name":"resolver","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},
+	{"inputs":[{"internalType":"bytes32","name":"node","type":"bytes32"}],"name":"addr","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},
+	{"inputs":[{"internalType":"bytes32","name":"node","type":"bytes32"}],"name":"name","outputs":[{"internalType":"string","name":"","type":"string"}],"stateMutability":"view","type":"function"}
+]`
+
+var ens = func() abi.ABI {
+	parsed, _ := abi.JSON(strings.NewReader(ensABI))
+	return parsed
+}()
+
+// namehash is the ENS node of name, per EIP-137. Names are lowercased but
+// not otherwise normalized.
+func namehash(name string) common.Hash {
+	var node common.Hash
+	if name == "" {
+		return node
+	}
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = ethcrypto.Keccak256Hash(node.Bytes(), ethcrypto.Keccak256([]byte(labels[i])))
+	}
+	return node
+}
+
+// ResolveENS returns the address name resolves to through the ENS registry
+// at registry. A name without a resolver or address is an error.
+func (c *ERC8004Client) ResolveENS(registry common.Address, name string) (common.Address, error) {
+	node := namehash(name)
+	resolver, err := c.ensAddress(registry, "resolver", node)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("ENS resolver of %s: %w", name, err)
+	}
+	if resolver == (common.Address{}) {
+		return common.Address{}, fmt.Errorf("ENS name %s has no resolver", name)
+	}
+	addr, err := c.ensAddress(resolver, "addr", node)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("ENS address of %s: %w", name, err)
+	}
+	if addr == (common.Address{}) {
+		return common.Address{}, fmt.Errorf("ENS name %s has no address", name)
+	}
+	return addr, nil
+}
+
+// reverseNode is the ENS node of addr's reverse record,
+// <addr>.addr.reverse.
+func reverseNode(addr common.Address) common.Hash {
+	return namehash(strings.ToLower(addr.Hex()[2:]) + ".addr.reverse")
+}
+
+// ReverseENS returns the primary ENS name of addr, from its reverse record.
+// The name must resolve back to addr: anyone can claim any name in their own
+// reverse record.
+func (c *ERC8004Client) ReverseENS(registry common.Address, addr common.Address) (string, error) {
+	node := reverseNode(addr)
+	resolver, err := c.ensAddress(registry, "resolver", node)
+	if err != nil {
+		return "", fmt.Errorf("ENS reverse resolver of %s: %w", addr.Hex(), err)
+	}
+	if resolver == (common.Address{}) {
+		return "", fmt.Errorf("%s has no ENS reverse record", addr.Hex())
+	}
+	data, err := ens.Pack("name", node)
+	if err != nil {
+		return "", err
+	}
+	res, err := c.call(resolver, data, c.readBlock(nil))
+	if err != nil {
+		return "", fmt.Errorf("ENS name of %s: %w", addr.Hex(), err)
+	}
+	out, err := ens.Unpack("name", res)
+	if err != nil {
+		return "", fmt.Errorf("ENS name of %s: %w", addr.Hex(), err)
+	}
+	name := out[0].(string)
+	if name == "" {
+		return "", fmt.Errorf("%s has no ENS name", addr.Hex())
+	}
+	if forward, err := c.ResolveENS(registry, name); err != nil || forward != addr {
+		return "", fmt.Errorf("ENS name %s of %s doesn't resolve back to it", name, addr.Hex())
+	}
+	return name, nil
+}
+
+func (c *ERC8004Client) ensAddress(to common.Address, method string, node common.Hash) (common.Address, error) {
+	data, err := ens.Pack(method, node)
+	if err != nil {
+		return common.Address{}, err
+	}
+	res, err := c.call(to, data, c.readBlock(nil))
+	if err != nil {
+		return common.Address{}, err
+	}
+	out, err := ens.Unpack(method, res)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return out[0].(common.Address), nil
+}
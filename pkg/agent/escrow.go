@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TaskEscrow functions a worker calls, those a client settles a submitted
+// result with, and the getTask view.
+const taskEscrowABI = `[
+	{"inputs":[{"internalType":"uint256","name":"taskId","type":"uint256"}],"name":"acceptTask","outputs":[],"stateMutability":"payable","type":"function"},
+	{"inputs":[{"internalType":"uint256","name":"taskId","type":"uint256"},{"internalType":"bytes32","name":"resultHash","type":"bytes32"}],"name":"submitResult","outputs":[],"stateMutability":"nonpayable","type":"function"},
+	{"inputs":[{"internalType":"uint256","name":"taskId","type":"uint256"}],"name":"claimAfterTimeout","outputs":[],"stateMutability":"nonpayable","type":"function"},
+	{"inputs":[{"internalType":"uint256","name":"taskId","type":"uint256"}],"name":"approveResult","outputs":[],"stateMutability":"nonpayable","type":"function"},
+	{"inputs":[{"internalType":"uint256","name":"taskId","type":"uint256"}],"name":"disputeResult","outputs":[],"stateMutability":"nonpayable","type":"function"},
+	{"inputs":[{"internalType":"uint256","name":"taskId","type":"uint256"}],"name":"getTask","outputs":[{"components":[
+		{"internalType":"address","name":"client","type":"address"},
+		{"internalType":"address","name":"worker","type":"address"},
+		{"internalType":"uint256","name":"payment","type":"uint256"},
+		{"internalType":"uint256","name":"workerStake","type":"uint256"},
+		{"internalType":"bytes32","name":"specHash","type":"bytes32"},
+		{"internalType":"bytes32","name":"resultHash","type":"bytes32"},
+		{"internalType":"enum TaskEscrow.TaskState","name":"state","type":"uint8"},
+		{"internalType":"uint256","name":"createdAt","type":"uint256"},
+		{"internalType":"uint256","name":"submittedAt","type":"uint256"}
+	],"internalType":"struct TaskEscrow.Task","name":"","type":"tuple"}],"stateMutability":"view","type":"function"}
+]`
+
+// EscrowWorkerStakePercent mirrors TaskEscrow.WORKER_STAKE_PERCENT: accepting
+// a task stakes this share of its payment.
+const EscrowWorkerStakePercent = 10
+
+// EscrowStates names TaskEscrow.TaskState values.
+var EscrowStates = []string{"created", "accepted", "submitted", "verified", "disputed", "completed", "refunded"}
+
+// ErrNoEscrowTask is returned for a task ID the escrow doesn't know.
+var ErrNoEscrowTask = errors.New("no such escrow task")
+
+// EscrowTask is a task as stored by the TaskEscrow contract.
+type EscrowTask struct {
+	Client      common.Address
+	Worker      common.Address
+	Payment     *big.Int
+	WorkerStake *big.Int
+	SpecHash    [32]byte
+	ResultHash  [32]byte
+	State       uint8
+	CreatedAt   *big.Int
+	SubmittedAt *big.Int
+}
+
+// StateName describes the task's escrow state.
+func (t *EscrowTask) StateName() string {
+	if int(t.State) < len(EscrowStates) {
+		return EscrowStates[t.State]
+	}
+	return fmt.Sprintf("state %d", t.State)
+}
+
+// TaskEscrow sends the worker side of the TaskEscrow contract through an
+// ERC8004Client, so dry-run, the journal and the governor apply to it.
+type TaskEscrow struct {
+	client  *ERC8004Client
+	addr    common.Address
+	capital *CapitalTracker
+}
+
+func NewTaskEscrow(client *ERC8004Client, escrowAddr string) *TaskEscrow {
+	return &TaskEscrow{client: client, addr: common.HexToAddress(escrowAddr)}
+}
+
+// UseCapital makes Bid reserve its stake with c first, refusing bids the
+// budget has no room for, and lock it once the bid is placed.
+func (e *TaskEscrow) UseCapital(c *CapitalTracker) {
+	e.capital = c
+}
+
+// GetTask reads a task from the escrow.
+func (e *TaskEscrow) GetTask(taskId *big.Int) (*EscrowTask, error) {
+	data, _ := e.client.escrowABI.Pack("getTask", taskId)
+	res, err := e.client.call(e.addr, data, e.client.readBlock(nil))
+	if err != nil {
+		return nil, err
+	}
+	out, err := e.client.escrowABI.Unpack("getTask", res)
+	if err != nil {
+		return nil, err
+	}
+	task := abi.ConvertType(out[0], new(EscrowTask)).(*EscrowTask)
+	if task.Client == (common.Address{}) {
+		return nil, fmt.Errorf("%w: %s", ErrNoEscrowTask, taskId)
+	}
+	return task, nil
+}
+
+// EscrowBalance returns the funds the escrow holds for a task: its payment,
+// plus the worker's stake once accepted, until the task is settled. It is
+// capped by the contract's own balance, so a drained escrow shows as such.
+func (e *TaskEscrow) EscrowBalance(taskId *big.Int) (*big.Int, error) {
+	task, err := e.GetTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	held := new(big.Int)
+	switch task.StateName() {
+	case "created":
+		held.Set(task.Payment)
+	case "accepted", "submitted", "disputed":
+		held.Add(task.Payment, task.WorkerStake)
+	}
+	if held.Sign() == 0 {
+		return held, nil
+	}
+	bal, err := e.client.Balance(e.addr)
+	if err != nil {
+		return nil, err
+	}
+	if bal.Cmp(held) < 0 {
+		held.Set(bal)
+	}
+	return held, nil
+}
+
+// Bid accepts a task as its worker, staking EscrowWorkerStakePercent of the
+// payment. It returns the stake.
+func (e *TaskEscrow) Bid(w *Wallet, taskId *big.Int) (*big.Int, error) {
+	task, err := e.GetTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	stake := EscrowStake(task.Payment)
+
+	data, err := e.client.escrowABI.Pack("acceptTask", taskId)
+	if err != nil {
+		return nil, err
+	}
+	reservation := escrowReservation(taskId)
+	if err := e.capital.Reserve(reservation, NativeToken, stake); err != nil {
+		fmt.Printf("[Capital] Not bidding on %s: %v\n", reservation, err)
+		return stake, err
+	}
+	if _, err := e.client.transact(w, e.addr, data, stake); err != nil {
+		e.capital.Release(reservation, "bid failed")
+		return stake, fmt.Errorf("acceptTask(%s) failed: %w", taskId, err)
+	}
+	if e.client.DryRun() {
+		e.capital.Release(reservation, "dry run")
+	} else if err := e.capital.Lock(reservation); err != nil {
+		fmt.Printf("[Capital] Failed to lock the stake of %s: %v\n", reservation, err)
+	}
+	return stake, nil
+}
+
+// Submit records the hash of the worker's result.
+func (e *TaskEscrow) Submit(w *Wallet, taskId *big.Int, resultHash common.Hash) error {
+	data, err := e.client.escrowABI.Pack("submitResult", taskId, resultHash)
+	if err != nil {
+		return err
+	}
+	if _, err := e.client.transact(w, e.addr, data, nil); err != nil {
+		return fmt.Errorf("submitResult(%s) failed: %w", taskId, err)
+	}
+	return nil
+}
+
+// Claim releases payment and stake to the worker once the client has let
+// the verification timeout pass.
+func (e *TaskEscrow) Claim(w *Wallet, taskId *big.Int) error {
+	data, err := e.client.escrowABI.Pack("claimAfterTimeout", taskId)
+	if err != nil {
+		return err
+	}
+	if _, err := e.client.transact(w, e.addr, data, nil); err != nil {
+		return fmt.Errorf("claimAfterTimeout(%s) failed: %w", taskId, err)
+	}
+	return nil
+}
+
+// ApprovePayment accepts the submitted result of a task w created, releasing
+// payment and stake to the worker.
+func (e *TaskEscrow) ApprovePayment(w *Wallet, taskId *big.Int) error {
+	data, err := e.client.escrowABI.Pack("approveResult", taskId)
+	if err != nil {
+		return err
+	}
+	if _, err := e.client.transact(w, e.addr, data, nil); err != nil {
+		return fmt.Errorf("approveResult(%s) failed: %w", taskId, err)
+	}
+	return nil
+}
+
+// Dispute rejects the submitted result of a task w created, holding payment
+// and stake until the dispute is resolved.
+func (e *TaskEscrow) Dispute(w *Wallet, taskId *big.Int) error {
+	data, err := e.client.escrowABI.Pack("disputeResult", taskId)
+	if err != nil {
+		return err
+	}
+	if _, err := e.client.transact(w, e.addr, data, nil); err != nil {
+		return fmt.Errorf("disputeResult(%s) failed: %w", taskId, err)
+	}
+	return nil
+}
+
+// Settlement pays for, or disputes, the result of a delegated task.
+type Settlement interface {
+	ApprovePayment(taskId *big.Int) error
+	Dispute(taskId *big.Int) error
+}
+
+// Client returns the escrow as a Settlement for the tasks w created.
+func (e *TaskEscrow) Client(w *Wallet) Settlement {
+	return escrowClient{e, w}
+}
+
+type escrowClient struct {
+	escrow *TaskEscrow
+	wallet *Wallet
+}
+
+func (c escrowClient) ApprovePayment(taskId *big.Int) error {
+	return c.escrow.ApprovePayment(c.wallet, taskId)
+}
+
+func (c escrowClient) Dispute(taskId *big.Int) error {
+	return c.escrow.Dispute(c.wallet, taskId)
+}
@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Evaluator defaults.
+const (
+	DefaultEvalTimeout         = 20 * time.Second
+	DefaultEvalMaxCallsPerHour = 60
+)
+
+// ErrEvalBudget is returned by an Evaluator that has used up its calls for
+// the hour.
+var ErrEvalBudget = errors.New("evaluation budget exhausted")
+
+// Evaluator decides whether the node should bid on a task. When the intake
+// has one, it is asked after the funding check; a task it declines is
+// skipped.
+type Evaluator interface {
+	Evaluate(ctx context.Context, task EvalRequest) (*Verdict, error)
+}
+
+// EvalRequest is what an Evaluator is told about a task: what TaskCreated
+// carries. The spec itself is only published as its hash.
+type EvalRequest struct {
+	TaskID   string `json:"taskId"`
+	SpecHash string `json:"specHash"`
+	Client   string `json:"client"`
+	Payment  string `json:"payment"` // wei
+}
+
+// Verdict is an Evaluator's answer.
+type Verdict struct {
+	Bid            bool    `json:"bid"`
+	Confidence     float64 `json:"confidence"`               // 0 to 1
+	SuggestedPrice string  `json:"suggestedPrice,omitempty"` // wei
+	Reason         string  `json:"reason,omitempty"`
+	Raw            string  `json:"raw,omitempty"` // model output the verdict was parsed from
+}
+
+// evalRequest builds the request for a TaskCreated event.
+func evalRequest(record TaskRecord) EvalRequest {
+	return EvalRequest{TaskID: record.ID, SpecHash: record.SpecHash, Client: record.Client, Payment: record.Amount}
+}
+
+// StubEvaluator is a deterministic Evaluator for tests and dry runs. It
+// returns the verdict Verdicts holds for a spec hash and otherwise bids, at
+// the advertised payment, on tasks paying at least MinPayment wei.
+type StubEvaluator struct {
+	MinPayment *big.Int
+	Verdicts   map[string]Verdict
+}
+
+func (s StubEvaluator) Evaluate(ctx context.Context, task EvalRequest) (*Verdict, error) {
+	if v, ok := s.Verdicts[task.SpecHash]; ok {
+		return &v, nil
+	}
+	payment, ok := new(big.Int).SetString(task.Payment, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid payment %q", task.Payment)
+	}
+	if s.MinPayment != nil && payment.Cmp(s.MinPayment) < 0 {
+		return &Verdict{Confidence: 1, Reason: fmt.Sprintf("pays less than %s wei", s.MinPayment)}, nil
+	}
+	return &Verdict{Bid: true, Confidence: 1, SuggestedPrice: task.Payment}, nil
+}
+
+// LLMEvaluator asks a model behind an OpenAI-compatible chat completions
+// endpoint for a verdict, sending it the task and the node's capability
+// manifests. Verdicts are cached by spec hash, so a task posted again isn't
+// paid for twice, and calls are capped per hour.
+type LLMEvaluator struct {
+	BaseURL         string // e.g. https://api.openai.com/v1
+	Model           string
+	APIKey          string
+	Timeout         time.Duration // per call
+	MaxCallsPerHour int           // 0 means no cap
+	// Capabilities lists what the node serves when the model is asked, like
+	// AgentNode.Capabilities.
+	Capabilities func() []CapabilityDef
+	Client       *http.Client
+
+	mu    sync.Mutex
+	cache map[string]Verdict
+	calls []time.Time // model calls within the last hour
+}
+
+func NewLLMEvaluator(baseURL, model, apiKey string, capabilities func() []CapabilityDef) *LLMEvaluator {
+	return &LLMEvaluator{
+		BaseURL:         strings.TrimSuffix(baseURL, "/"),
+		Model:           model,
+		APIKey:          apiKey,
+		Timeout:         DefaultEvalTimeout,
+		MaxCallsPerHour: DefaultEvalMaxCallsPerHour,
+		Capabilities:    capabilities,
+		Client:          http.DefaultClient,
+	}
+}
+
+const evalSystemPrompt = `You decide whether an autonomous agent should bid on a paid task.
+You are given the task and the capabilities the agent serves. Answer with a
+single JSON object and nothing else:
+{"bid": true|false, "confidence": 0..1, "suggested_price": "<wei>", "reason": "<one sentence>"}`
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model          string            `json:"model"`
+	Messages       []chatMessage     `json:"messages"`
+	Temperature    float64           `json:"temperature"`
+	ResponseFormat map[string]string `json:"response_format,omitempty"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (e *LLMEvaluator) Evaluate(ctx context.Context, task EvalRequest) (*Verdict, error) {
+	if v, ok := e.cached(task.SpecHash); ok {
+		return &v, nil
+	}
+	if !e.reserve() {
+		return nil, ErrEvalBudget
+	}
+
+	var caps []CapabilityDef
+	if e.Capabilities != nil {
+		caps = e.Capabilities()
+	}
+	prompt, _ := json.MarshalIndent(struct {
+		Task         EvalRequest     `json:"task"`
+		Capabilities []CapabilityDef `json:"capabilities"`
+	}{task, caps}, "", "  ")
+	raw, err := e.complete(ctx, evalSystemPrompt, string(prompt))
+	if err != nil {
+		return nil, err
+	}
+	v, err := parseVerdict(raw)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	if e.cache == nil {
+		e.cache = map[string]Verdict{}
+	}
+	e.cache[task.SpecHash] = *v
+	e.mu.Unlock()
+	return v, nil
+}
+
+func (e *LLMEvaluator) cached(specHash string) (Verdict, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	v, ok := e.cache[specHash]
+	return v, ok
+}
+
+// reserve counts a model call against the hourly cap, reporting whether the
+// call may be made.
+func (e *LLMEvaluator) reserve() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.MaxCallsPerHour <= 0 {
+		return true
+	}
+	cutoff := time.Now().Add(-time.Hour)
+	recent := e.calls[:0]
+	for _, t := range e.calls {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	e.calls = recent
+	if len(e.calls) >= e.MaxCallsPerHour {
+		return false
+	}
+	e.calls = append(e.calls, time.Now())
+	return true
+}
+
+// complete sends one chat completion and returns the model's message.
+func (e *LLMEvaluator) complete(ctx context.Context, system, prompt string) (string, error) {
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = DefaultEvalTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, _ := json.Marshal(chatRequest{
+		Model: e.Model,
+		Messages: []chatMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: prompt},
+		},
+		ResponseFormat: map[string]string{"type": "json_object"},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.BaseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.APIKey)
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var out chatResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxMessageSize)).Decode(&out); err != nil {
+		return "", fmt.Errorf("invalid chat completion (%s): %w", res.Status, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		if out.Error != nil {
+			return "", fmt.Errorf("chat completion failed: %s: %s", res.Status, out.Error.Message)
+		}
+		return "", fmt.Errorf("chat completion failed: %s", res.Status)
+	}
+	if len(out.Choices) == 0 {
+		return "", fmt.Errorf("chat completion has no choices")
+	}
+	return out.Choices[0].Message.Content, nil
+}
+
+// parseVerdict reads the JSON object in a model's answer, tolerating prose
+// or a code fence around it.
+func parseVerdict(raw string) (*Verdict, error) {
+	start, end := strings.Index(raw, "{"), strings.LastIndex(raw, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("model answered without a verdict: %q", raw)
+	}
+	var out struct {
+		Bid            *bool           `json:"bid"`
+		Confidence     float64         `json:"confidence"`
+		SuggestedPrice json.RawMessage `json:"suggested_price"`
+		Reason         string          `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(raw[start:end+1]), &out); err != nil {
+		return nil, fmt.Errorf("invalid verdict: %w", err)
+	}
+	if out.Bid == nil {
+		return nil, fmt.Errorf("verdict has no bid field: %q", raw)
+	}
+	v := &Verdict{Bid: *out.Bid, Confidence: out.Confidence, Reason: out.Reason, Raw: raw}
+	// Models write prices as strings or numbers
+	if price := strings.Trim(string(out.SuggestedPrice), `"`); price != "" && price != "null" {
+		if p, ok := new(big.Int).SetString(price, 10); ok && p.Sign() >= 0 {
+			v.SuggestedPrice = p.String()
+		}
+	}
+	if v.Confidence < 0 {
+		v.Confidence = 0
+	} else if v.Confidence > 1 {
+		v.Confidence = 1
+	}
+	return v, nil
+}
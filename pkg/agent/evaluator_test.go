@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIntakeStoresVerdicts(t *testing.T) {
+	store := newTestStore(t)
+	in := NewTaskIntake(store, nil, nil)
+	declined := [32]byte{2}
+	in.UseEvaluator(StubEvaluator{
+		MinPayment: big.NewInt(100),
+		Verdicts:   map[string]Verdict{TaskRecordFromEvent(TaskCreatedEvent{SpecHash: declined}).SpecHash: {Confidence: 0.9, Reason: "needs GPUs", Raw: `{"bid":false}`}},
+	})
+
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(1), Payment: big.NewInt(1000)}); d.Action != ActionBid {
+		t.Errorf("task the stub bids on: %+v, want a bid", d)
+	}
+	d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(2), SpecHash: declined, Payment: big.NewInt(1000)})
+	if d.Action != ActionSkip || d.Reason != "evaluator declined (confidence 0.90): needs GPUs" {
+		t.Errorf("declined task: %+v, want skipped with the evaluator's reason", d)
+	}
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(3), Payment: big.NewInt(10)}); d.Action != ActionSkip {
+		t.Errorf("underpaid task: %+v, want a skip", d)
+	}
+
+	task, err := store.GetTask("task:2")
+	if err != nil || task == nil || task.Verdict == nil || task.Verdict.Bid || task.Verdict.Raw != `{"bid":false}` {
+		t.Fatalf("task:2 = %+v, %v; want the verdict and raw output stored", task, err)
+	}
+	tasks, _ := store.ListTasks(10)
+	for _, task := range tasks {
+		if task.Verdict == nil {
+			t.Errorf("%s listed without its verdict", task.ID)
+		}
+	}
+}
+
+func TestIntakeBidsWhenEvaluationFails(t *testing.T) {
+	in := NewTaskIntake(newTestStore(t), nil, nil)
+	in.UseEvaluator(failingEvaluator{})
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(1), Payment: big.NewInt(1000)}); d.Action != ActionBid {
+		t.Errorf("%+v, want a bid without a verdict", d)
+	}
+}
+
+type failingEvaluator struct{}
+
+func (failingEvaluator) Evaluate(context.Context, EvalRequest) (*Verdict, error) {
+	return nil, ErrEvalBudget
+}
+
+// fakeCompletions answers chat completions with content, counting calls.
+func fakeCompletions(t *testing.T, content string, calls *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		var req chatRequest
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer sk-test" ||
+			json.NewDecoder(r.Body).Decode(&req) != nil || req.Model != "judge" || len(req.Messages) != 2 ||
+			!strings.Contains(req.Messages[1].Content, `"summarize"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"message": "bad request"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": content}}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLLMEvaluator(t *testing.T) {
+	var calls int32
+	content := "```json\n{\"bid\": true, \"confidence\": 0.8, \"suggested_price\": 900, \"reason\": \"fits summarize\"}\n```"
+	srv := fakeCompletions(t, content, &calls)
+	e := NewLLMEvaluator(srv.URL+"/v1/", "judge", "sk-test", func() []CapabilityDef {
+		return []CapabilityDef{{Name: "summarize", Handler: "echo"}}
+	})
+	e.MaxCallsPerHour = 2
+	ctx := context.Background()
+
+	v, err := e.Evaluate(ctx, EvalRequest{TaskID: "task:1", SpecHash: "0x01", Payment: "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Bid || v.Confidence != 0.8 || v.SuggestedPrice != "900" || v.Reason != "fits summarize" || v.Raw != content {
+		t.Errorf("verdict %+v", v)
+	}
+
+	// The same spec is answered from the cache
+	if _, err := e.Evaluate(ctx, EvalRequest{TaskID: "task:2", SpecHash: "0x01", Payment: "1000"}); err != nil || calls != 1 {
+		t.Errorf("cached spec: err %v after %d calls, want one call", err, calls)
+	}
+	if _, err := e.Evaluate(ctx, EvalRequest{TaskID: "task:3", SpecHash: "0x03", Payment: "1000"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Evaluate(ctx, EvalRequest{TaskID: "task:4", SpecHash: "0x04", Payment: "1000"}); !errors.Is(err, ErrEvalBudget) || calls != 2 {
+		t.Errorf("third spec: err %v after %d calls, want the hourly cap of 2 hit", err, calls)
+	}
+}
+
+func TestParseVerdict(t *testing.T) {
+	for _, raw := range []string{"", "I would bid.", `{"confidence": 1}`, `{"bid": "maybe"}`} {
+		if v, err := parseVerdict(raw); err == nil {
+			t.Errorf("parseVerdict(%q) = %+v, want an error", raw, v)
+		}
+	}
+	v, err := parseVerdict(`Verdict: {"bid": false, "confidence": 3, "suggested_price": "-5"}`)
+	if err != nil || v.Bid || v.Confidence != 1 || v.SuggestedPrice != "" {
+		t.Errorf("verdict %+v, %v; want the confidence clamped and the negative price dropped", v, err)
+	}
+}
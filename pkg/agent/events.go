@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DefaultEventBuffer is how many recent events a node keeps for GET /events.
+const DefaultEventBuffer = 200
+
+// NodeEvent is one entry of the node's recent activity. Error is set for
+// failures, which dashboards list separately.
+type NodeEvent struct {
+	Seq   uint64      `json:"seq"`
+	Kind  string      `json:"kind"`
+	Time  int64       `json:"time"` // unix ms
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	// Names are those of the wallets and peers in Data and Error the node
+	// already knew when the event happened, by raw identifier
+	Names map[string]string `json:"names,omitempty"`
+}
+
+// EventLog is a fixed-size ring of recent node events. Sequence numbers keep
+// increasing, so readers poll with the last one they saw.
+type EventLog struct {
+	mu     sync.Mutex
+	size   int
+	next   uint64
+	events []NodeEvent
+	subs   map[chan NodeEvent]struct{}
+	names  *NameResolver
+}
+
+// eventSubBuffer is how many events a subscriber may fall behind before
+// events are dropped for it.
+const eventSubBuffer = 64
+
+// NewEventLog keeps the last size events; non-positive values mean
+// DefaultEventBuffer.
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+	return &EventLog{size: size, next: 1}
+}
+
+// Add appends an event and returns it.
+func (l *EventLog) Add(kind string, data interface{}) NodeEvent {
+	return l.add(NodeEvent{Kind: kind, Data: data})
+}
+
+// AddError appends a failure event.
+func (l *EventLog) AddError(kind string, err error, data interface{}) NodeEvent {
+	return l.add(NodeEvent{Kind: kind, Error: err.Error(), Data: data})
+}
+
+// useNames has events name the wallets and peers they mention.
+func (l *EventLog) useNames(r *NameResolver) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.names = r
+}
+
+func (l *EventLog) add(e NodeEvent) NodeEvent {
+	l.mu.Lock()
+	names := l.names
+	l.mu.Unlock()
+	e.Names = eventNames(names, e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq = l.next
+	e.Time = time.Now().UnixMilli()
+	l.next++
+	l.events = append(l.events, e)
+	if len(l.events) > l.size {
+		l.events = append([]NodeEvent(nil), l.events[len(l.events)-l.size:]...)
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+			// A slow reader skips ahead; the gap shows in the sequence numbers
+		}
+	}
+	return e
+}
+
+// Subscribe returns a channel receiving every event added from now on, and a
+// func that ends the subscription. A reader that falls more than
+// eventSubBuffer events behind misses events; it can fill the gap with Since.
+func (l *EventLog) Subscribe() (<-chan NodeEvent, func()) {
+	ch := make(chan NodeEvent, eventSubBuffer)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.subs == nil {
+		l.subs = map[chan NodeEvent]struct{}{}
+	}
+	l.subs[ch] = struct{}{}
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subs, ch)
+	}
+}
+
+// Len returns how many events are buffered.
+func (l *EventLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.events)
+}
+
+// Since returns the buffered events with a sequence number above seq, oldest
+// first.
+func (l *EventLog) Since(seq uint64) []NodeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []NodeEvent{}
+	for _, e := range l.events {
+		if e.Seq > seq {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// eventNames returns the known names of the identifiers in e. It never
+// waits: the unknown ones are looked up for later events.
+func eventNames(r *NameResolver, e NodeEvent) map[string]string {
+	if r == nil {
+		return nil
+	}
+	text := e.Error
+	if e.Data != nil {
+		raw, _ := json.Marshal(e.Data)
+		text += string(raw)
+	}
+	var names map[string]string
+	for _, id := range identifiersIn(text) {
+		if name := r.Name(id); name != "" {
+			if names == nil {
+				names = map[string]string{}
+			}
+			names[id] = name
+		}
+	}
+	return names
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package agent
+
+// processFDs returns the process's file descriptor limit, or 0 if unknown.
+func processFDs() int {
+	return 0
+}
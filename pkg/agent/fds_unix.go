@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// processFDs returns the process's file descriptor limit, or 0 if unknown.
+func processFDs() int {
+	var l unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &l); err != nil {
+		return 0
+	}
+	return int(l.Cur)
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// The buffers frames and envelopes are read and written through are pooled,
+// so a node relaying large results doesn't allocate per frame or per stream.
+var (
+	frameBuffers = sync.Pool{New: func() interface{} { return &frameBuffer{data: make([]byte, streamChunkSize)} }}
+	frameWriters = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, streamChunkSize+binary.MaxVarintLen64) }}
+	frameReaders = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, streamChunkSize) }}
+	envelopes    = sync.Pool{New: func() interface{} { return newEnvelope() }}
+)
+
+// maxPooledEnvelope is the largest envelope buffer put back in the pool; a
+// rare large message shouldn't pin its buffer for good.
+const maxPooledEnvelope = 4 * streamChunkSize
+
+// frameBuffer holds one frame's bytes, taken from the pool by
+// getFrameBuffer. Its holder releases it exactly once, when nothing refers
+// to data any more; releasing it twice panics rather than hand the same
+// memory to two streams.
+type frameBuffer struct {
+	data     []byte
+	released atomic.Bool
+}
+
+func getFrameBuffer() *frameBuffer {
+	b := frameBuffers.Get().(*frameBuffer)
+	b.released.Store(false)
+	return b
+}
+
+func (b *frameBuffer) release() {
+	if b.released.Swap(true) {
+		panic("agent: frame buffer released twice")
+	}
+	frameBuffers.Put(b)
+}
+
+// getFrameWriter returns a pooled writer buffering frames to w; put it back
+// with putFrameWriter once flushed.
+func getFrameWriter(w io.Writer) *bufio.Writer {
+	bw := frameWriters.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putFrameWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	frameWriters.Put(bw)
+}
+
+// getFrameReader returns a pooled reader buffering the frames of r; put it
+// back with putFrameReader once nothing reads from it, or from slices it
+// returned.
+func getFrameReader(r io.Reader) *bufio.Reader {
+	br := frameReaders.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putFrameReader(br *bufio.Reader) {
+	br.Reset(nil)
+	frameReaders.Put(br)
+}
+
+// writeFrame writes data with its length prefix to bw. The prefix goes
+// straight into bw's buffer, so a frame costs no allocation.
+func writeFrame(bw *bufio.Writer, data []byte) error {
+	if bw.Available() < binary.MaxVarintLen64 {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	if _, err := bw.Write(binary.AppendUvarint(bw.AvailableBuffer(), uint64(len(data)))); err != nil {
+		return err
+	}
+	_, err := bw.Write(data)
+	return err
+}
+
+// envelope encodes a message for writeMessage, reusing its buffer and
+// encoder from one message to the next.
+type envelope struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+func newEnvelope() *envelope {
+	e := new(envelope)
+	e.enc = json.NewEncoder(&e.buf)
+	return e
+}
+
+// writeMessage writes v as one length-prefixed JSON message, as
+// json.Marshal and writeLP would, encoded in a pooled envelope. The prefix
+// goes in room left ahead of the JSON, so the message is a single write.
+func writeMessage(w io.Writer, v interface{}) error {
+	e := envelopes.Get().(*envelope)
+	defer func() {
+		if e.buf.Cap() <= maxPooledEnvelope {
+			e.buf.Reset()
+			envelopes.Put(e)
+		}
+	}()
+	var room [binary.MaxVarintLen64]byte
+	e.buf.Write(room[:])
+	if err := e.enc.Encode(v); err != nil {
+		return err
+	}
+	// Encode ends the document with a newline Marshal doesn't write
+	b := e.buf.Bytes()
+	b = b[:len(b)-1]
+	var prefix [binary.MaxVarintLen64]byte
+	k := binary.PutUvarint(prefix[:], uint64(len(b)-len(room)))
+	start := len(room) - k
+	copy(b[start:], prefix[:k])
+	_, err := w.Write(b[start:])
+	return err
+}
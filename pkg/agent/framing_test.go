@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seededReader yields size bytes that differ with seed, so a frame of one
+// stream turning up in another is caught.
+type seededReader struct {
+	seed      byte
+	size, off int64
+}
+
+func (r *seededReader) Read(b []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if left := r.size - r.off; int64(len(b)) > left {
+		b = b[:left]
+	}
+	for i := range b {
+		b[i] = r.seed ^ byte((r.off+int64(i))%251)
+	}
+	r.off += int64(len(b))
+	return len(b), nil
+}
+
+// transfer sends body through the frames of a streamed result over a pipe
+// and returns the reading side.
+func transfer(body io.Reader, size int64) *StreamResult {
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(writeFrames(pw, body, size)) }()
+	return readFrames(pr, pr, StreamHeader{Size: size})
+}
+
+// Run with -race: the pooled frames, readers and writers of many streams at
+// once must never be shared, and one closed mid-read must not give its
+// reader back while the read is still using it.
+func TestPooledFramesAreNotReusedWhileReferenced(t *testing.T) {
+	const size = 1<<20 + 123
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(seed byte) {
+			defer wg.Done()
+			result := transfer(&seededReader{seed: seed, size: size}, size)
+			defer result.Close()
+			got := sha256.New()
+			var err error
+			if seed%2 == 0 {
+				_, err = io.Copy(got, result) // frames handed over in place
+			} else {
+				_, err = io.Copy(got, struct{ io.Reader }{result}) // frames copied out
+			}
+			want := sha256.New()
+			io.Copy(want, &seededReader{seed: seed, size: size})
+			if err != nil || string(got.Sum(nil)) != string(want.Sum(nil)) {
+				t.Errorf("stream %d read %v, or not what was sent", seed, err)
+			}
+		}(byte(i))
+
+		wg.Add(1)
+		go func(seed byte) {
+			defer wg.Done()
+			result := transfer(&seededReader{seed: seed, size: 1 << 30}, 1<<30)
+			go func() {
+				time.Sleep(time.Millisecond)
+				result.Close()
+			}()
+			if _, err := io.Copy(io.Discard, result); err == nil {
+				t.Errorf("stream %d closed mid-read ended without an error", seed)
+			}
+		}(byte(100 + i))
+	}
+	wg.Wait()
+}
+
+func TestStreamFramesDontAllocatePerChunk(t *testing.T) {
+	const size = 16 << 20
+	const chunks = size / streamChunkSize
+	allocs := testing.AllocsPerRun(3, func() {
+		result := transfer(&seededReader{size: size}, size)
+		if _, err := io.Copy(io.Discard, result); err != nil {
+			t.Fatal(err)
+		}
+		result.Close()
+	})
+	// Allocating each frame's length prefix alone was one a chunk
+	if perChunk := allocs / chunks; perChunk > 0.5 {
+		t.Errorf("%.2f allocations a chunk, want under 0.5", perChunk)
+	}
+}
+
+func TestFrameBufferReleasedTwicePanics(t *testing.T) {
+	b := getFrameBuffer()
+	b.release()
+	defer func() {
+		if recover() == nil {
+			t.Error("releasing a frame buffer twice didn't panic")
+		}
+	}()
+	b.release()
+}
+
+func TestWriteMessageMatchesMarshal(t *testing.T) {
+	pr, pw := io.Pipe()
+	msg := AgentMessage{ID: "1", Type: "response", Payload: map[string]interface{}{"html": "<b>&</b>"}, Sender: "peer"}
+	go func() { pw.CloseWithError(writeMessage(pw, msg)) }()
+	got, err := readLP(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(msg)
+	if string(got) != string(want) {
+		t.Errorf("writeMessage sent %s, want %s", got, want)
+	}
+	if err := writeMessage(io.Discard, make(chan int)); err == nil {
+		t.Errorf("writeMessage of a channel = %v, want an encoding error", err)
+	}
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// DefaultSpendWindow is the rolling window a TxGovernor limit applies to.
+const DefaultSpendWindow = 24 * time.Hour
+
+// ErrSpendLimit is returned when a transaction would take the node past its
+// spending limit.
+var ErrSpendLimit = errors.New("transaction spend limit reached")
+
+// TxGovernor caps what the node spends on transactions within a rolling
+// window. A transaction is charged its worst case, gas * fee cap + value,
+// before it is signed. Simulated transactions are never charged. A nil
+// governor allows everything.
+type TxGovernor struct {
+	mu     sync.Mutex
+	limit  *big.Int
+	window time.Duration
+	spends []txSpend
+	now    func() time.Time
+}
+
+type txSpend struct {
+	at     time.Time
+	amount *big.Int
+}
+
+// NewTxGovernor allows up to limit wei of transaction costs per window.
+func NewTxGovernor(limit *big.Int, window time.Duration) *TxGovernor {
+	if window <= 0 {
+		window = DefaultSpendWindow
+	}
+	return &TxGovernor{limit: new(big.Int).Set(limit), window: window, now: time.Now}
+}
+
+// Reserve charges cost to the window, or fails with ErrSpendLimit and
+// charges nothing.
+func (g *TxGovernor) Reserve(cost *big.Int) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	spent := g.spentLocked(now)
+	if total := new(big.Int).Add(spent, cost); total.Cmp(g.limit) > 0 {
+		return fmt.Errorf("%w: %s wei would bring the last %s to %s of %s wei", ErrSpendLimit, cost, g.window, total, g.limit)
+	}
+	g.spends = append(g.spends, txSpend{at: now, amount: new(big.Int).Set(cost)})
+	return nil
+}
+
+// Spent returns what has been charged within the current window.
+func (g *TxGovernor) Spent() *big.Int {
+	if g == nil {
+		return big.NewInt(0)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.spentLocked(g.now())
+}
+
+// spentLocked drops spends older than the window and sums the rest.
+func (g *TxGovernor) spentLocked(now time.Time) *big.Int {
+	cutoff := now.Add(-g.window)
+	kept := g.spends[:0]
+	total := new(big.Int)
+	for _, s := range g.spends {
+		if s.at.After(cutoff) {
+			kept = append(kept, s)
+			total.Add(total, s.amount)
+		}
+	}
+	g.spends = kept
+	return total
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestTxGovernorRollingWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewTxGovernor(big.NewInt(100), time.Hour)
+	g.now = func() time.Time { return now }
+
+	if err := g.Reserve(big.NewInt(60)); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Minute)
+	if err := g.Reserve(big.NewInt(40)); err != nil {
+		t.Fatalf("reserving up to the limit: %v", err)
+	}
+	if err := g.Reserve(big.NewInt(1)); !errors.Is(err, ErrSpendLimit) {
+		t.Errorf("over the limit: err = %v, want ErrSpendLimit", err)
+	}
+	if spent := g.Spent(); spent.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("spent %s, want 100", spent)
+	}
+
+	// The first spend leaves the window
+	now = now.Add(31 * time.Minute)
+	if spent := g.Spent(); spent.Cmp(big.NewInt(40)) != 0 {
+		t.Errorf("spent %s after the window moved, want 40", spent)
+	}
+	if err := g.Reserve(big.NewInt(60)); err != nil {
+		t.Errorf("after the window moved: %v", err)
+	}
+}
+
+func TestNilTxGovernorAllowsEverything(t *testing.T) {
+	var g *TxGovernor
+	if err := g.Reserve(big.NewInt(1e18)); err != nil {
+		t.Error(err)
+	}
+	if g.Spent().Sign() != 0 {
+		t.Error("nil governor reports spending")
+	}
+}
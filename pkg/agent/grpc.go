@@ -0,0 +1,309 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"agentmesh/pkg/controlpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ServeGRPC starts the NodeControl gRPC service on addr. Callers must
+// authenticate: with the APIToken as a bearer token, or with a client
+// certificate when tlsConfig requires one. It refuses to start with neither.
+// It returns once the listener is bound; requests are served in the
+// background until Stop.
+func (n *AgentNode) ServeGRPC(addr string, tlsConfig *tls.Config) error {
+	mtls := tlsConfig != nil && tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert
+	if n.APIToken == "" && !mtls {
+		return fmt.Errorf("the gRPC API needs -api-token or client certificates")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to bind gRPC listener: %w", err)
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := n.checkToken(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := n.checkToken(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	controlpb.RegisterNodeControlServer(s, &controlServer{n: n})
+	n.grpc, n.grpcAddr = s, ln.Addr().String()
+	go s.Serve(ln)
+	return nil
+}
+
+// GRPCAddr is the address ServeGRPC bound, e.g. to learn a random port.
+func (n *AgentNode) GRPCAddr() string {
+	return n.grpcAddr
+}
+
+// checkToken requires "authorization: Bearer <APIToken>" when a token is set;
+// without one, the client certificate was checked during the handshake.
+func (n *AgentNode) checkToken(ctx context.Context) error {
+	if n.APIToken == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(v, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(n.APIToken)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong bearer token")
+}
+
+// controlServer serves NodeControl through the same node methods as the HTTP
+// API.
+type controlServer struct {
+	controlpb.UnimplementedNodeControlServer
+	n *AgentNode
+}
+
+func (s *controlServer) GetStatus(ctx context.Context, _ *controlpb.GetStatusRequest) (*controlpb.NodeStatus, error) {
+	st := s.n.Status()
+	return &controlpb.NodeStatus{
+		PeerId:         st.PeerID,
+		Addrs:          st.Addrs,
+		ConnectedPeers: int32(st.ConnectedPeers),
+		WatcherBlock:   st.WatcherBlock,
+		Wallet:         st.Wallet,
+		SchemaVersion:  int32(st.SchemaVersion),
+		StartedAt:      st.StartedAt,
+	}, nil
+}
+
+func (s *controlServer) ListTasks(ctx context.Context, req *controlpb.ListTasksRequest) (*controlpb.ListTasksResponse, error) {
+	tasks, err := s.n.Tasks(int(req.GetLimit()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &controlpb.ListTasksResponse{Tasks: make([]*controlpb.Task, len(tasks))}
+	for i, t := range tasks {
+		res.Tasks[i] = taskProto(LocalTaskStatus{TaskRecord: t})
+	}
+	return res, nil
+}
+
+func (s *controlServer) GetTask(ctx context.Context, req *controlpb.GetTaskRequest) (*controlpb.Task, error) {
+	st, err := s.n.Task(req.GetId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return taskProto(*st), nil
+}
+
+func (s *controlServer) SubmitTask(ctx context.Context, req *controlpb.SubmitTaskRequest) (*controlpb.Task, error) {
+	record, err := s.n.SubmitTask(TaskSpec{Capability: req.GetCapability(), Payload: req.GetPayload().AsMap()})
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	case err != nil:
+		// Anything else is a bad capability or payload
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return taskProto(LocalTaskStatus{TaskRecord: record}), nil
+}
+
+func (s *controlServer) DeleteTask(ctx context.Context, req *controlpb.DeleteTaskRequest) (*controlpb.DeleteTaskResponse, error) {
+	if err := s.n.DeleteTask(req.GetId()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &controlpb.DeleteTaskResponse{}, nil
+}
+
+func (s *controlServer) ListPeers(ctx context.Context, _ *controlpb.ListPeersRequest) (*controlpb.ListPeersResponse, error) {
+	peers, err := s.n.Peers()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &controlpb.ListPeersResponse{Peers: make([]*controlpb.Peer, len(peers))}
+	for i, p := range peers {
+		res.Peers[i] = peerProto(p)
+	}
+	return res, nil
+}
+
+func (s *controlServer) BlockPeer(ctx context.Context, req *controlpb.BlockPeerRequest) (*controlpb.Peer, error) {
+	if err := s.n.BlockPeer(req.GetPeerId()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	peers, err := s.n.Peers()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	for _, p := range peers {
+		if p.PeerID == req.GetPeerId() {
+			return peerProto(p), nil
+		}
+	}
+	return &controlpb.Peer{PeerId: req.GetPeerId(), Blocked: true}, nil
+}
+
+func (s *controlServer) ListRoutes(ctx context.Context, _ *controlpb.ListRoutesRequest) (*controlpb.ListRoutesResponse, error) {
+	routes := s.n.Routes.Snapshot()
+	res := &controlpb.ListRoutesResponse{Routes: make([]*controlpb.Route, len(routes))}
+	for i, r := range routes {
+		route := &controlpb.Route{Capability: r.Capability, Peers: make([]*controlpb.RoutePeer, len(r.Peers))}
+		for j, p := range r.Peers {
+			route.Peers[j] = &controlpb.RoutePeer{PeerId: p.PeerID, LastSeen: p.LastSeen}
+		}
+		res.Routes[i] = route
+	}
+	return res, nil
+}
+
+func (s *controlServer) ListCapabilities(ctx context.Context, _ *controlpb.ListCapabilitiesRequest) (*controlpb.ListCapabilitiesResponse, error) {
+	return capabilitiesProto(s.n.Capabilities())
+}
+
+func (s *controlServer) AddCapabilities(ctx context.Context, req *controlpb.AddCapabilitiesRequest) (*controlpb.ListCapabilitiesResponse, error) {
+	defs, err := s.n.AddCapabilities(req.GetManifest())
+	switch {
+	case errors.Is(err, ErrCapabilityExists):
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return capabilitiesProto(defs)
+}
+
+// Events streams like GET /v1/events: the buffered events after after_seq,
+// then new ones until the client goes away or the node stops.
+func (s *controlServer) Events(req *controlpb.EventsRequest, stream controlpb.NodeControl_EventsServer) error {
+	// Subscribe before reading the backlog, so no event falls in between
+	events, unsubscribe := s.n.Events.Subscribe()
+	defer unsubscribe()
+
+	last := req.GetAfterSeq()
+	send := func(e NodeEvent) error {
+		if e.Seq <= last {
+			return nil
+		}
+		last = e.Seq
+		pe, err := eventProto(e)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return stream.Send(pe)
+	}
+	for _, e := range s.n.Events.Since(last) {
+		if err := send(e); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.n.ctx.Done():
+			return status.Error(codes.Unavailable, "node stopped")
+		case e := <-events:
+			if err := send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcError maps the node's errors to status codes.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrTaskRunning):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func taskProto(t LocalTaskStatus) *controlpb.Task {
+	return &controlpb.Task{
+		Id:        t.ID,
+		Kind:      t.Kind,
+		Client:    t.Client,
+		Topic:     t.Topic,
+		SpecHash:  t.SpecHash,
+		Amount:    t.Amount,
+		Status:    t.Status,
+		CreatedAt: t.CreatedAt,
+		UpdatedAt: t.UpdatedAt,
+		Result:    t.Result,
+	}
+}
+
+func peerProto(p PeerRecord) *controlpb.Peer {
+	return &controlpb.Peer{PeerId: p.PeerID, EthAddress: p.EthAddress, Capability: p.Capability, LastSeen: p.LastSeen, Blocked: p.Blocked}
+}
+
+func capabilitiesProto(defs []CapabilityDef) (*controlpb.ListCapabilitiesResponse, error) {
+	res := &controlpb.ListCapabilitiesResponse{Capabilities: make([]*controlpb.Capability, len(defs))}
+	for i, d := range defs {
+		c := &controlpb.Capability{Name: d.Name, Description: d.Description, Handler: d.Handler}
+		if d.Schema != nil {
+			v, err := jsonValue(d.Schema)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			c.Schema = v.GetStructValue()
+		}
+		if d.Pricing != nil {
+			c.Pricing = &controlpb.Pricing{Amount: d.Pricing.Amount, Unit: d.Pricing.Unit}
+		}
+		res.Capabilities[i] = c
+	}
+	return res, nil
+}
+
+func eventProto(e NodeEvent) (*controlpb.Event, error) {
+	pe := &controlpb.Event{Seq: e.Seq, Kind: e.Kind, Time: e.Time, Error: e.Error}
+	if e.Data != nil {
+		v, err := jsonValue(e.Data)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", e.Seq, err)
+		}
+		pe.Data = v
+	}
+	return pe, nil
+}
+
+// jsonValue converts v as it would be served in JSON, so structs keep their
+// JSON field names.
+func jsonValue(v interface{}) (*structpb.Value, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return nil, err
+	}
+	return structpb.NewValue(generic)
+}
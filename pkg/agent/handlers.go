@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// TaskRequest is a task addressed to one of the node's manifest capabilities.
+type TaskRequest struct {
+	ID         string // correlation ID of the task message, if it came from a peer
+	Capability string
+	Payload    map[string]interface{} // validated against the capability's schema
+	Sender     string
+	Node       *AgentNode
+	// Dir is a scratch directory of the run's own in the workspace, removed
+	// once the result is sent; empty if the node has no workspace
+	Dir string
+}
+
+// TaskHandler serves tasks for a capability and returns the response payload.
+// ctx carries the task's trace, so spans started from it join the sender's.
+// A result too large to hold in memory is returned as a *StreamResult, made
+// with NewStreamResult or WriteStream, and sent as it is read.
+type TaskHandler func(ctx context.Context, req TaskRequest) (interface{}, error)
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]TaskHandler{}
+)
+
+// RegisterHandler makes a handler available to capability manifests under
+// name, typically from an init function. Registering a name twice panics,
+// like database/sql drivers.
+func RegisterHandler(name string, h TaskHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if _, dup := handlers[name]; dup {
+		panic("agent: handler " + name + " registered twice")
+	}
+	handlers[name] = h
+}
+
+// HandlerNames lists the registered handler names, sorted.
+func HandlerNames() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupHandler(name string) (TaskHandler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	h, ok := handlers[name]
+	return h, ok
+}
+
+func init() {
+	// echo returns the payload, for wiring up and testing manifests
+	RegisterHandler("echo", func(ctx context.Context, req TaskRequest) (interface{}, error) {
+		return req.Payload, nil
+	})
+
+	// memory.search searches the workspace for the payload's "query"
+	RegisterHandler("memory.search", func(ctx context.Context, req TaskRequest) (interface{}, error) {
+		query, _ := req.Payload["query"].(string)
+		if query == "" {
+			return nil, fmt.Errorf("payload has no query")
+		}
+		return req.Node.Memory.Search(query)
+	})
+}
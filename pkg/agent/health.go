@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultMaxBlockLag is how many blocks the watcher may trail the confirmed
+// head and still count as caught up.
+const DefaultMaxBlockLag = 5
+
+// readyCheckTimeout bounds the RPC calls made by a readiness check.
+const readyCheckTimeout = 5 * time.Second
+
+// Check is the outcome of one readiness check.
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Readiness is served by GET /readyz.
+type Readiness struct {
+	Ready  bool    `json:"ready"`
+	Checks []Check `json:"checks"`
+}
+
+// Healthz reports whether the node process is alive and not shutting down.
+// Unlike Readyz it never touches the network, so a slow RPC endpoint cannot
+// get a healthy node restarted.
+func (n *AgentNode) Healthz() error {
+	if n.ctx.Err() != nil {
+		return fmt.Errorf("node is stopping")
+	}
+	if n.CurrentHost() == nil {
+		return fmt.Errorf("node is not started")
+	}
+	return nil
+}
+
+// Readyz reports whether the node should receive work: P2P is up, the RPC
+// endpoint answers, the watcher isn't catching up on a backlog and is within
+// MaxBlockLag blocks of the head, and that head is within the watcher's
+// MaxHeadLag of where the chain should be. Without the last check, a
+// watcher caught up with a stalled RPC would look ready while events go
+// unseen. The node's other Chains are checked the same way, under names
+// ending in their chain ID, e.g. "watcher:84532".
+func (n *AgentNode) Readyz() Readiness {
+	// Probes shouldn't queue behind the node's background chain reads
+	ctx, cancel := context.WithTimeout(WithReadLane(n.ctx, ReadInteractive), readyCheckTimeout)
+	defer cancel()
+
+	var checks []Check
+	if err := n.Healthz(); err != nil {
+		checks = append(checks, Check{Name: "p2p", Detail: err.Error()})
+	} else {
+		// The DHT is disabled for now; once it is back this check also
+		// waits for its bootstrap
+		detail := fmt.Sprintf("%d peers", len(n.CurrentHost().Network().Peers()))
+		if peers := n.Bootstrap.peers(); len(peers) > 0 {
+			detail += fmt.Sprintf(", %d of %d bootstrap peers", n.Bootstrap.Connected(), len(peers))
+		}
+		checks = append(checks, Check{Name: "p2p", OK: true, Detail: detail})
+	}
+
+	if n.ERCClient != nil {
+		checks = append(checks, rpcCheck(ctx, "rpc", n.ERCClient))
+	}
+	for _, c := range n.Chains {
+		if c.Client != nil && c.Client != n.ERCClient {
+			checks = append(checks, rpcCheck(ctx, fmt.Sprintf("rpc:%d", c.Profile.ChainID), c.Client))
+		}
+	}
+
+	for _, w := range n.watchers() {
+		suffix := ""
+		if w != n.Watcher {
+			suffix = fmt.Sprintf(":%d", w.ChainID())
+		}
+		checks = append(checks, n.watcherChecks(ctx, suffix, w)...)
+	}
+
+	r := Readiness{Ready: true, Checks: checks}
+	for _, c := range checks {
+		r.Ready = r.Ready && c.OK
+	}
+	return r
+}
+
+// rpcCheck checks that client's RPC endpoint answers.
+func rpcCheck(ctx context.Context, name string, client *ERC8004Client) Check {
+	head, err := client.HeadBlock(ctx)
+	if err != nil {
+		return Check{Name: name, Detail: err.Error()}
+	}
+	return Check{Name: name, OK: true, Detail: fmt.Sprintf("head %d", head)}
+}
+
+// watcherChecks checks w's lag and its RPC's head lag, naming the checks
+// "watcher" and "rpc_head" with suffix appended.
+func (n *AgentNode) watcherChecks(ctx context.Context, suffix string, w *EventWatcher) []Check {
+	if n.Elector != nil && !n.Elector.IsLeader() {
+		// Followers don't run the watcher, so there is nothing to catch up
+		return []Check{{Name: "watcher" + suffix, OK: true, Detail: "follower"}}
+	}
+	maxLag := n.MaxBlockLag
+	if maxLag == 0 {
+		maxLag = DefaultMaxBlockLag
+	}
+	var checks []Check
+	lag, err := w.Lag(ctx)
+	switch {
+	case err != nil:
+		checks = append(checks, Check{Name: "watcher" + suffix, Detail: err.Error()})
+	case w.Progress().CatchingUp:
+		// Not ready until the catch-up is through, however close it is
+		checks = append(checks, Check{Name: "watcher" + suffix, Detail: "catching up: " + w.Progress().String()})
+	case lag > maxLag:
+		checks = append(checks, Check{Name: "watcher" + suffix, Detail: fmt.Sprintf("%d blocks behind (max %d)", lag, maxLag)})
+	default:
+		checks = append(checks, Check{Name: "watcher" + suffix, OK: true, Detail: fmt.Sprintf("%d blocks behind", lag)})
+	}
+	// Lag just read the head, so HeadLag is current
+	if err == nil {
+		headLag, maxHeadLag := w.HeadLag(), w.MaxHeadLag()
+		if headLag > maxHeadLag {
+			checks = append(checks, Check{Name: "rpc_head" + suffix, Detail: fmt.Sprintf("RPC head %d blocks behind the chain (max %d)", headLag, maxHeadLag)})
+		} else {
+			checks = append(checks, Check{Name: "rpc_head" + suffix, OK: true, Detail: fmt.Sprintf("%d blocks behind the chain", headLag)})
+		}
+	}
+	return checks
+}
+
+// WaitReady polls Readyz until the node is ready or ctx is done.
+func (n *AgentNode) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		if n.Readyz().Ready {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// newTestNode creates an unstarted node on a fresh SQLite database.
+func newTestNode(t *testing.T) *AgentNode {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := OpenMetadataStore(DriverSQLite, filepath.Join(dir, "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewAgentNodeWithStore(store, dir)
+	t.Cleanup(func() { n.Stop() })
+	return n
+}
+
+// startTestNode starts a node listening on loopback.
+func startTestNode(t *testing.T) *AgentNode {
+	t.Helper()
+	n := newTestNode(t)
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// dialAddr is a full multiaddr for reaching n's current identity.
+func dialAddr(n *AgentNode) string {
+	h := n.CurrentHost()
+	return fmt.Sprintf("%s/p2p/%s", h.Addrs()[0], h.ID())
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// LoadOrCreateIdentity loads the libp2p private key stored at path, generating
+// and persisting a new Ed25519 key if the file does not exist yet. Keeping the
+// key on disk gives the node a stable peerId across restarts, which is what
+// gets published to the ERC-8004 registry.
+func LoadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	priv, err := LoadIdentity(path)
+	if err == nil || !os.IsNotExist(err) {
+		return priv, err
+	}
+
+	priv, _, err = crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	if err := SaveIdentity(path, priv); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// LoadIdentity reads a libp2p private key. A missing file is reported with
+// an error satisfying os.IsNotExist.
+func LoadIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+	priv, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode identity key %s: %w", path, err)
+	}
+	return priv, nil
+}
+
+// SaveIdentity writes a libp2p private key to path, readable only by the owner.
+func SaveIdentity(path string, priv crypto.PrivKey) error {
+	raw, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		return fmt.Errorf("failed to write identity key: %w", err)
+	}
+	return nil
+}
+
+// PeerIDFromKey derives the peer ID for a libp2p private key.
+func PeerIDFromKey(priv crypto.PrivKey) (peer.ID, error) {
+	return peer.IDFromPrivateKey(priv)
+}
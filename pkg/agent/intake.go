@@ -0,0 +1,356 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Intake actions: what the node decided to do about an on-chain event.
+const (
+	ActionBid    = "bid"
+	ActionAnswer = "answer"
+	ActionSkip   = "skip"
+)
+
+// Decision is the outcome of running one event through the intake pipeline.
+type Decision struct {
+	TaskID   string `json:"taskId"`
+	Kind     string `json:"kind"`
+	Block    uint64 `json:"block,omitempty"`
+	Action   string `json:"action"`
+	Amount   string `json:"amount,omitempty"`   // wei, for bids
+	Answer   string `json:"answer,omitempty"`   // workspace file answering a knowledge request
+	PeerID   string `json:"peerId,omitempty"`   // resolved requester
+	Endpoint string `json:"endpoint,omitempty"` // requester's HTTP endpoint, for agents without libp2p
+	Reason   string `json:"reason,omitempty"`
+	// Code is the reason for a skip the requester may be told of, a
+	// Decline* code; "" for skips it isn't, such as of denied requesters
+	Code          string `json:"code,omitempty"`
+	CounterAmount string `json:"counterAmount,omitempty"` // wei the node would take, for DeclinePriceTooLow
+	RetryAfter    int64  `json:"retryAfter,omitempty"`    // seconds until the node has room, for DeclineAtCapacity
+}
+
+// PeerResolver maps a wallet to how its agent is reached: the peerId and
+// HTTP endpoint it published, either of which may be "".
+type PeerResolver func(wallet common.Address) Recipient
+
+// CapacityFunc reports how long until the node has room for another task,
+// or 0 if it has room now, like TaskPool.RetryAfter.
+type CapacityFunc func() time.Duration
+
+// EscrowBalanceFunc reports the funds an escrow holds for a task, like
+// TaskEscrow.EscrowBalance.
+type EscrowBalanceFunc func(taskId *big.Int) (*big.Int, error)
+
+// TaskIntake is the pipeline every chain event goes through: dedup, record,
+// evaluate, decide. It doesn't care where events come from; the live
+// EventWatcher and a ReplaySource both deliver into OnTask and OnQuery.
+type TaskIntake struct {
+	store      MetadataStore
+	memory     *MemoryStore
+	resolve    PeerResolver
+	balance    EscrowBalanceFunc
+	capacity   CapacityFunc
+	minPayment *big.Int
+	pricing    *PricingEngine
+	priceAs    string
+	evaluator  Evaluator
+	policy     *IdentityPolicy
+	capital    *CapitalTracker
+	archive    *EventArchive
+	onDecision func(TaskRecord, Decision)
+}
+
+func NewTaskIntake(store MetadataStore, memory *MemoryStore, resolve PeerResolver) *TaskIntake {
+	return &TaskIntake{store: store, memory: memory, resolve: resolve}
+}
+
+// OnDecision registers a callback invoked after each event is decided.
+func (in *TaskIntake) OnDecision(cb func(TaskRecord, Decision)) {
+	in.onDecision = cb
+}
+
+// VerifyFunding makes the intake check a paid task's escrow before bidding
+// on it, skipping tasks whose escrow holds less than the advertised payment.
+func (in *TaskIntake) VerifyFunding(balance EscrowBalanceFunc) {
+	in.balance = balance
+}
+
+// UseCapacity makes the intake skip paid tasks while capacity reports the
+// node has no room, before funding and the evaluator are checked.
+func (in *TaskIntake) UseCapacity(capacity CapacityFunc) {
+	in.capacity = capacity
+}
+
+// RequirePayment makes the intake skip tasks paying less than min wei.
+func (in *TaskIntake) RequirePayment(min *big.Int) {
+	in.minPayment = min
+}
+
+// UsePricing makes the intake skip tasks paying less than p quotes for
+// them, asking for the quote instead. Escrow tasks name no capability, so
+// they are quoted as capability; one p has no price for declines paid work.
+func (in *TaskIntake) UsePricing(p *PricingEngine, capability string) {
+	in.pricing, in.priceAs = p, capability
+}
+
+// UseEvaluator makes the intake ask e before bidding on a paid task. Its
+// verdict is stored on the task record, and a task it declines is skipped.
+func (in *TaskIntake) UseEvaluator(e Evaluator) {
+	in.evaluator = e
+}
+
+// UsePolicy makes the intake check a task's client, or a knowledge request's
+// requester, against p before acting on it. Denied requesters are skipped
+// before their identity is resolved.
+func (in *TaskIntake) UsePolicy(p *IdentityPolicy) {
+	in.policy = p
+}
+
+// UseCapital makes the intake reserve the stake of each task it would bid
+// on with c, skipping tasks the bid budget has no room for. It is the last
+// check, so a reservation is only taken for a bid.
+func (in *TaskIntake) UseCapital(c *CapitalTracker) {
+	in.capital = c
+}
+
+// UseArchive makes the intake append every event it hasn't seen before,
+// with its decision, to a. Duplicates are dropped by the dedup first, so
+// each event is archived once.
+func (in *TaskIntake) UseArchive(a *EventArchive) {
+	in.archive = a
+}
+
+// OnTask handles a TaskCreated event. It is a TaskCreatedHandler, failing
+// when the event couldn't be checked against the ones already processed.
+func (in *TaskIntake) OnTask(e TaskCreatedEvent) error {
+	_, err := in.handleTask(e)
+	return err
+}
+
+// OnQuery handles a KnowledgeRequested event. It is a
+// KnowledgeRequestedHandler, failing like OnTask.
+func (in *TaskIntake) OnQuery(q KnowledgeRequestedEvent) error {
+	_, err := in.handleQuery(q)
+	return err
+}
+
+// HandleTask runs a TaskCreated event through the pipeline.
+func (in *TaskIntake) HandleTask(e TaskCreatedEvent) Decision {
+	d, _ := in.handleTask(e)
+	return d
+}
+
+func (in *TaskIntake) handleTask(e TaskCreatedEvent) (Decision, error) {
+	record := TaskRecordFromEvent(e)
+	d := Decision{TaskID: record.ID, Kind: record.Kind, Block: e.Block}
+	if ok, err := in.admit(record, &d); !ok {
+		return d, err
+	}
+	d = in.decideTask(record, e, d)
+	if err := in.archive.Append(ArchiveTask(e, d)); err != nil {
+		fmt.Printf("[Archive] %v\n", err)
+	}
+	return d, nil
+}
+
+func (in *TaskIntake) decideTask(record TaskRecord, e TaskCreatedEvent, d Decision) Decision {
+	if err := in.policy.Check(Counterparty{Wallet: e.Client.Hex()}, PolicyActionBid); err != nil {
+		d.Action, d.Reason = ActionSkip, err.Error()
+	} else if e.Payment == nil || e.Payment.Sign() <= 0 {
+		d.Action, d.Reason, d.Code = ActionSkip, "task carries no payment", DeclinePriceTooLow
+		if in.minPayment != nil {
+			d.CounterAmount = in.minPayment.String()
+		}
+	} else if in.minPayment != nil && e.Payment.Cmp(in.minPayment) < 0 {
+		d.Action, d.Reason, d.Code = ActionSkip, fmt.Sprintf("pays %s of the %s wei minimum", e.Payment, in.minPayment), DeclinePriceTooLow
+		d.CounterAmount = in.minPayment.String()
+	} else if reason, code, counter := in.checkPrice(record, e); reason != "" {
+		d.Action, d.Reason, d.Code = ActionSkip, reason, code
+		d.CounterAmount = counter
+	} else if wait := in.checkCapacity(); wait > 0 {
+		d.Action, d.Reason, d.Code = ActionSkip, "no room for another task", DeclineAtCapacity
+		d.RetryAfter = int64(wait.Round(time.Second) / time.Second)
+	} else if reason, code := in.checkFunding(e); reason != "" {
+		d.Action, d.Reason, d.Code = ActionSkip, reason, code
+		if code == DeclinePriceTooLow {
+			// The escrow should be topped up to the payment advertised
+			d.CounterAmount = e.Payment.String()
+		}
+	} else if reason := in.evaluate(&record); reason != "" {
+		d.Action, d.Reason, d.Code = ActionSkip, reason, DeclineNotInterested
+	} else if err := in.capital.Reserve(record.ID, NativeToken, EscrowStake(e.Payment)); err != nil {
+		fmt.Printf("[Capital] Not bidding on %s: %v\n", record.ID, err)
+		d.Action, d.Reason = ActionSkip, err.Error()
+	} else {
+		d.Action, d.Amount = ActionBid, e.Payment.String()
+	}
+	return in.finish(record, d)
+}
+
+// checkPrice quotes the task, returning why it should be skipped, the
+// Decline* code and the quoted price, or "" when it pays enough.
+func (in *TaskIntake) checkPrice(record TaskRecord, e TaskCreatedEvent) (reason, code, counter string) {
+	if in.pricing == nil {
+		return "", "", ""
+	}
+	q, err := in.pricing.Quote(context.Background(), in.priceAs, TaskContext{TaskID: record.ID, Capability: in.priceAs, Counterparty: &Counterparty{Wallet: e.Client.Hex()}})
+	switch {
+	case err != nil:
+		return fmt.Sprintf("no quote: %v", err), "", ""
+	case q.Declined != "":
+		return fmt.Sprintf("paid work on %s is declined: %s", in.priceAs, q.Declined), DeclineNotInterested, ""
+	case e.Payment.Cmp(q.Price) < 0:
+		return fmt.Sprintf("pays %s of the %s wei quoted", e.Payment, q.Price), DeclinePriceTooLow, q.Price.String()
+	}
+	return "", "", ""
+}
+
+// checkCapacity returns how long until the node has room for the task, or
+// 0 if it has room.
+func (in *TaskIntake) checkCapacity() time.Duration {
+	if in.capacity == nil {
+		return 0
+	}
+	return in.capacity()
+}
+
+// checkFunding compares the task's escrow with its advertised payment,
+// returning why the task should be skipped and the Decline* code of an
+// underfunded one, or "" when it can pay out.
+func (in *TaskIntake) checkFunding(e TaskCreatedEvent) (reason, code string) {
+	if in.balance == nil {
+		return "", ""
+	}
+	held, err := in.balance(e.TaskId)
+	if err != nil {
+		fmt.Printf("[Escrow] Failed to read the escrow of task %s: %v\n", e.TaskId, err)
+		return fmt.Sprintf("escrow balance unknown: %v", err), ""
+	}
+	if held.Cmp(e.Payment) < 0 {
+		fmt.Printf("[Escrow] Task %s is underfunded: escrow holds %s wei, event advertised %s\n", e.TaskId, held, e.Payment)
+		return fmt.Sprintf("escrow underfunded: holds %s of %s wei", held, e.Payment), DeclinePriceTooLow
+	}
+	return "", ""
+}
+
+// evaluate asks the evaluator about a task and records its verdict,
+// returning why the task should be skipped, or "" to bid. A task the
+// evaluator can't judge, because its budget is spent or the model is down,
+// is bid on as it would be without one.
+func (in *TaskIntake) evaluate(record *TaskRecord) string {
+	if in.evaluator == nil {
+		return ""
+	}
+	v, err := in.evaluator.Evaluate(context.Background(), evalRequest(*record))
+	if err != nil {
+		fmt.Printf("[Eval] Failed to evaluate task %s, bidding without a verdict: %v\n", record.ID, err)
+		return ""
+	}
+	record.Verdict = v
+	if err := in.store.SetTaskVerdict(record.ID, *v); err != nil {
+		fmt.Printf("[DB] Failed to record the verdict on task %s: %v\n", record.ID, err)
+	}
+	if v.Bid {
+		return ""
+	}
+	if v.Reason != "" {
+		return fmt.Sprintf("evaluator declined (confidence %.2f): %s", v.Confidence, v.Reason)
+	}
+	return fmt.Sprintf("evaluator declined (confidence %.2f)", v.Confidence)
+}
+
+// HandleQuery runs a KnowledgeRequested event through the pipeline.
+func (in *TaskIntake) HandleQuery(q KnowledgeRequestedEvent) Decision {
+	d, _ := in.handleQuery(q)
+	return d
+}
+
+func (in *TaskIntake) handleQuery(q KnowledgeRequestedEvent) (Decision, error) {
+	record := TaskRecordFromQuery(q)
+	d := Decision{TaskID: record.ID, Kind: record.Kind, Block: q.Block}
+	if ok, err := in.admit(record, &d); !ok {
+		return d, err
+	}
+	d = in.decideQuery(record, q, d)
+	if err := in.archive.Append(ArchiveQuery(q, d)); err != nil {
+		fmt.Printf("[Archive] %v\n", err)
+	}
+	return d, nil
+}
+
+func (in *TaskIntake) decideQuery(record TaskRecord, q KnowledgeRequestedEvent, d Decision) Decision {
+	// A denied requester isn't worth resolving
+	if err := in.policy.Check(Counterparty{Wallet: q.Requester.Hex()}, PolicyActionAnswer); err != nil {
+		d.Action, d.Reason = ActionSkip, err.Error()
+		return in.finish(record, d)
+	}
+
+	// Dynamic Identity Resolution: wallet -> agentId -> peerId
+	if in.resolve != nil {
+		to := in.resolve(q.Requester)
+		d.PeerID, d.Endpoint = to.PeerID, to.Endpoint
+		// Rules on the agentId or peerId only match once they are known
+		if err := in.policy.Check(Counterparty{Wallet: q.Requester.Hex(), PeerID: to.PeerID}, PolicyActionAnswer); err != nil {
+			d.Action, d.Reason = ActionSkip, err.Error()
+			return in.finish(record, d)
+		}
+	}
+
+	var matches []MemoryChunk
+	if in.memory != nil {
+		matches = in.memory.SearchLocalWorkspace(q.Topic)
+	}
+	switch {
+	case len(matches) == 0:
+		d.Action, d.Reason, d.Code = ActionSkip, fmt.Sprintf("no local knowledge on %q", q.Topic), DeclineUnsupportedTopic
+	case d.PeerID == "" && d.Endpoint == "":
+		d.Action, d.Reason = ActionSkip, "requester has no published peerId or endpoint"
+	default:
+		d.Action, d.Answer = ActionAnswer, matches[0].Topic
+	}
+	return in.finish(record, d)
+}
+
+// admit dedups and records the event, reporting whether it should be
+// evaluated. The error is set when the dedup check itself failed.
+func (in *TaskIntake) admit(record TaskRecord, d *Decision) (bool, error) {
+	isNew, err := in.store.MarkProcessed(record.ID)
+	if err != nil {
+		// Not a duplicate: leave the event unmarked so a later delivery of it
+		// is evaluated once the store is back
+		fmt.Printf("[DB] Failed to mark event %s processed: %v\n", record.ID, err)
+		d.Action, d.Reason = ActionSkip, fmt.Sprintf("dedup check failed: %v", err)
+		return false, fmt.Errorf("dedup check for %s failed: %w", record.ID, err)
+	}
+	if !isNew {
+		d.Action, d.Reason = ActionSkip, "already processed"
+		return false, nil
+	}
+	if err := in.store.SaveTask(record); err != nil {
+		fmt.Printf("[DB] Failed to record task %s: %v\n", record.ID, err)
+	}
+	return true, nil
+}
+
+func (in *TaskIntake) finish(record TaskRecord, d Decision) Decision {
+	// A bid leaves the task open; answers and skips settle it locally
+	switch d.Action {
+	case ActionAnswer:
+		record.Status = TaskStatusResolved
+	case ActionSkip:
+		record.Status = TaskStatusSkipped
+	}
+	if record.Status != TaskStatusReceived {
+		in.store.UpdateTaskStatus(record.ID, record.Status)
+	}
+
+	if in.onDecision != nil {
+		in.onDecision(record, d)
+	}
+	return d
+}
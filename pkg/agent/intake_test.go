@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// failingMarkStore fails MarkProcessed until healed.
+type failingMarkStore struct {
+	MetadataStore
+	failing bool
+}
+
+func (s *failingMarkStore) MarkProcessed(id string) (bool, error) {
+	if s.failing {
+		return false, errors.New("database is locked")
+	}
+	return s.MetadataStore.MarkProcessed(id)
+}
+
+func TestIntakeDedupsEvents(t *testing.T) {
+	in := NewTaskIntake(newTestStore(t), nil, nil)
+	e := TaskCreatedEvent{TaskId: big.NewInt(7), Payment: big.NewInt(1000)}
+
+	if d := in.HandleTask(e); d.Action != ActionBid {
+		t.Fatalf("first delivery: %+v, want a bid", d)
+	}
+	if d := in.HandleTask(e); d.Action != ActionSkip || d.Reason != "already processed" {
+		t.Errorf("second delivery: %+v, want skipped as already processed", d)
+	}
+}
+
+func TestIntakeStoreErrorIsNotADuplicate(t *testing.T) {
+	store := &failingMarkStore{MetadataStore: newTestStore(t), failing: true}
+	in := NewTaskIntake(store, nil, nil)
+	e := TaskCreatedEvent{TaskId: big.NewInt(7), Payment: big.NewInt(1000)}
+
+	d := in.HandleTask(e)
+	if d.Action != ActionSkip || !strings.Contains(d.Reason, "database is locked") {
+		t.Errorf("with a failing store: %+v, want a skip naming the error", d)
+	}
+	if d.Reason == "already processed" {
+		t.Error("store error reported as a duplicate")
+	}
+
+	if err := in.OnTask(e); err == nil {
+		t.Error("OnTask with a failing store succeeded, want an error so the event is delivered again")
+	}
+
+	// The event wasn't marked, so it is evaluated once the store recovers
+	store.failing = false
+	if d := in.HandleTask(e); d.Action != ActionBid {
+		t.Errorf("after recovery: %+v, want a bid", d)
+	}
+}
+
+func TestIntakeSkipsUnderfundedTasks(t *testing.T) {
+	in := NewTaskIntake(newTestStore(t), nil, nil)
+	balances := map[int64]*big.Int{1: big.NewInt(1000), 2: big.NewInt(999)}
+	in.VerifyFunding(func(taskId *big.Int) (*big.Int, error) {
+		if bal, ok := balances[taskId.Int64()]; ok {
+			return bal, nil
+		}
+		return nil, errors.New("rpc unavailable")
+	})
+
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(1), Payment: big.NewInt(1000)}); d.Action != ActionBid {
+		t.Errorf("funded task: %+v, want a bid", d)
+	}
+	d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(2), Payment: big.NewInt(1000)})
+	if d.Action != ActionSkip || d.Reason != "escrow underfunded: holds 999 of 1000 wei" {
+		t.Errorf("underfunded task: %+v, want skipped as underfunded", d)
+	}
+	d = in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(3), Payment: big.NewInt(1000)})
+	if d.Action != ActionSkip || !strings.Contains(d.Reason, "rpc unavailable") {
+		t.Errorf("unreadable escrow: %+v, want a skip naming the error", d)
+	}
+}
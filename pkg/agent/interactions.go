@@ -0,0 +1,640 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Kinds of completed exchange an InteractionRecord attests.
+const (
+	RecordKindKnowledge = "knowledge" // an answer delivered, acknowledged and settled
+	RecordKindTask      = "task"      // a delegated result verified and paid for
+)
+
+// MessageInteraction is the message type of the history protocol, both ways:
+// a record signed by the party that completed the exchange, and the same
+// record countersigned.
+const MessageInteraction = "interaction"
+
+// MetadataInteractionRoot is the ERC-8004 metadata key an agent anchors its
+// interaction records under: the canonical JSON of an InteractionRoot.
+const MetadataInteractionRoot = "interactionRoot"
+
+// interactionTimeout bounds the countersigning exchange.
+const interactionTimeout = 30 * time.Second
+
+// commitmentTTL is how long the node remembers a result it committed to,
+// and so will countersign a record of.
+const commitmentTTL = time.Hour
+
+var (
+	// ErrInteractionSignature is returned by VerifyInteraction when a
+	// party's signature is missing or doesn't verify.
+	ErrInteractionSignature = errors.New("interaction signature invalid")
+	// ErrInteractionAnchor is returned when a record's merkle proof doesn't
+	// lead to its anchored root, or the root isn't the one published.
+	ErrInteractionAnchor = errors.New("interaction anchor doesn't match")
+	// ErrNoInteraction is returned for a record ID the node doesn't hold.
+	ErrNoInteraction = errors.New("no such interaction record")
+)
+
+// InteractionRecord attests one completed exchange. Both parties sign it
+// with their peer keys and keep a copy, so either can show it as proof of
+// the work to anyone. Its ID is the keccak256 hash of the signed fields,
+// which is also its leaf when anchored.
+type InteractionRecord struct {
+	ID                string             `json:"id"`
+	Kind              string             `json:"kind"`
+	Reference         string             `json:"reference"`    // the delivery's correlation ID, or the task's record ID
+	Provider          string             `json:"provider"`     // peer ID that did the work
+	Client            string             `json:"client"`       // peer ID it was done for
+	ArtifactHash      string             `json:"artifactHash"` // the answer or result delivered
+	Amount            string             `json:"amount"`       // wei paid, in decimal
+	TxHash            string             `json:"txHash,omitempty"`
+	StartedAt         int64              `json:"startedAt"`   // unix ms
+	CompletedAt       int64              `json:"completedAt"` // unix ms
+	ProviderSignature string             `json:"providerSignature,omitempty"`
+	ClientSignature   string             `json:"clientSignature,omitempty"`
+	Anchor            *InteractionAnchor `json:"anchor,omitempty"` // not signed; set once the record is anchored
+}
+
+// InteractionAnchor places a record under a merkle root its anchoring agent
+// published as MetadataInteractionRoot.
+type InteractionAnchor struct {
+	Root       string   `json:"root"`
+	Proof      []string `json:"proof"` // sibling hashes from the leaf up
+	AgentID    string   `json:"agentId"`
+	ChainID    uint64   `json:"chainId,omitempty"`
+	Block      uint64   `json:"block"` // where the root was set; read the metadata there
+	TxHash     string   `json:"txHash"`
+	AnchoredAt int64    `json:"anchoredAt"` // unix ms
+}
+
+// InteractionRoot is the value published under MetadataInteractionRoot.
+// Prev is the root anchored before, so the anchors form a chain.
+type InteractionRoot struct {
+	Root  string `json:"root"`
+	Count int    `json:"count"`
+	Prev  string `json:"prev,omitempty"`
+}
+
+func (r InteractionRecord) signedBytes() []byte {
+	return signedDocument("agentmesh-interaction:", struct {
+		Kind         string `json:"kind"`
+		Reference    string `json:"reference"`
+		Provider     string `json:"provider"`
+		Client       string `json:"client"`
+		ArtifactHash string `json:"artifactHash"`
+		Amount       string `json:"amount"`
+		TxHash       string `json:"txHash"`
+		StartedAt    int64  `json:"startedAt"`
+		CompletedAt  int64  `json:"completedAt"`
+	}{r.Kind, r.Reference, r.Provider, r.Client, r.ArtifactHash, r.Amount, r.TxHash, r.StartedAt, r.CompletedAt})
+}
+
+// Hash is the keccak256 hash of the fields both parties sign.
+func (r InteractionRecord) Hash() common.Hash {
+	return ethcrypto.Keccak256Hash(r.signedBytes())
+}
+
+// Complete reports whether both parties signed the record.
+func (r InteractionRecord) Complete() bool {
+	return r.ProviderSignature != "" && r.ClientSignature != ""
+}
+
+// VerifyInteraction checks a record anyone handed over: that its ID is its
+// hash, that both parties signed it, and, if it is anchored, that its proof
+// leads to the anchor's root. Whether that root was really published is
+// for ERC8004Client.VerifyInteractionAnchor.
+func VerifyInteraction(r InteractionRecord) error {
+	signed := r.signedBytes()
+	if len(signed) == 0 {
+		return fmt.Errorf("%w: the record has no canonical form", ErrInteractionSignature)
+	}
+	if !strings.EqualFold(r.ID, r.Hash().Hex()) {
+		return fmt.Errorf("%w: ID %s isn't the record's hash", ErrInteractionSignature, r.ID)
+	}
+	if !verifyPeerSignature(r.Provider, signed, r.ProviderSignature) {
+		return fmt.Errorf("%w: provider %s", ErrInteractionSignature, r.Provider)
+	}
+	if !verifyPeerSignature(r.Client, signed, r.ClientSignature) {
+		return fmt.Errorf("%w: client %s", ErrInteractionSignature, r.Client)
+	}
+	if a := r.Anchor; a != nil && !verifyMerkleProof(r.Hash(), a.Proof, a.Root) {
+		return fmt.Errorf("%w: the proof doesn't lead to root %s", ErrInteractionAnchor, a.Root)
+	}
+	return nil
+}
+
+// VerifyInteractionAnchor checks that the agent named by r's anchor
+// published the anchor's root, reading its metadata at the anchoring block.
+func (c *ERC8004Client) VerifyInteractionAnchor(r InteractionRecord) error {
+	a := r.Anchor
+	if a == nil {
+		return fmt.Errorf("record %s isn't anchored", r.ID)
+	}
+	agentId, ok := new(big.Int).SetString(a.AgentID, 10)
+	if !ok {
+		return fmt.Errorf("%w: invalid agent ID %q", ErrInteractionAnchor, a.AgentID)
+	}
+	raw, err := c.GetMetadata(agentId, MetadataInteractionRoot, BlockAt(a.Block))
+	if err != nil {
+		return err
+	}
+	var published InteractionRoot
+	if err := json.Unmarshal([]byte(raw), &published); err != nil || !strings.EqualFold(published.Root, a.Root) {
+		return fmt.Errorf("%w: agent %s published %q at block %d, not %s", ErrInteractionAnchor, a.AgentID, published.Root, a.Block, a.Root)
+	}
+	return nil
+}
+
+// settlement is what settling a delivery paid, for its interaction record.
+type settlement struct {
+	TxHash string
+	Amount *big.Int
+}
+
+// recordDelivery records a settled delivery of this node's as an
+// interaction it provided, and has the requester countersign it, in the
+// background.
+func (n *AgentNode) recordDelivery(d KnowledgeDelivery, paid settlement) {
+	amount := paid.Amount
+	if amount == nil {
+		amount = n.taskAmount(d.TaskID)
+	}
+	r := InteractionRecord{Kind: RecordKindKnowledge, Reference: d.ID, Client: d.PeerID, Amount: amount.String(), TxHash: paid.TxHash,
+		StartedAt: d.CreatedAt * 1000, CompletedAt: time.Now().UnixMilli()}
+	if d.Ack != nil {
+		r.ArtifactHash = d.Ack.AnswerHash
+	}
+	n.recordInteraction(r, d.PeerID)
+}
+
+// recordTask records a delegated result the node paid for as an interaction
+// worker provided, and has the worker countersign it, in the background.
+func (n *AgentNode) recordTask(worker, recordID, resultHash string, started time.Time) {
+	r := InteractionRecord{Kind: RecordKindTask, Reference: recordID, Provider: worker, ArtifactHash: resultHash,
+		Amount: n.taskAmount(recordID).String(), StartedAt: started.UnixMilli(), CompletedAt: time.Now().UnixMilli()}
+	n.recordInteraction(r, worker)
+}
+
+// taskAmount is the amount of the task record id, or zero.
+func (n *AgentNode) taskAmount(id string) *big.Int {
+	amount := new(big.Int)
+	if t, err := n.Store.GetTask(id); err == nil && t != nil {
+		amount.SetString(t.Amount, 10)
+	}
+	return amount
+}
+
+// recordInteraction signs r as this node's side, keeps it, and sends it to
+// the counterparty to countersign. A record the counterparty doesn't sign
+// stays one-sided: it is kept, but neither verifies nor gets anchored.
+func (n *AgentNode) recordInteraction(r InteractionRecord, counterparty string) {
+	n.mu.RLock()
+	priv := n.privKey
+	n.mu.RUnlock()
+	self, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return
+	}
+	if r.Provider == "" {
+		r.Provider = self.String()
+	} else {
+		r.Client = self.String()
+	}
+	if err := signInteraction(&r, priv, self.String()); err != nil {
+		fmt.Printf("[History] Failed to sign the record of %s: %v\n", r.Reference, err)
+		return
+	}
+	n.saveInteraction(r)
+
+	n.localWG.Add(1)
+	go func() {
+		defer n.localWG.Done()
+		ctx, cancel := context.WithTimeout(n.ctx, interactionTimeout)
+		defer cancel()
+		signed, err := n.countersign(ctx, counterparty, r)
+		if err != nil {
+			fmt.Printf("[History] %s didn't countersign the record of %s: %v\n", n.Names.Display(counterparty), r.Reference, err)
+			return
+		}
+		n.saveInteraction(*signed)
+		n.Events.Add("interaction_recorded", map[string]string{"id": signed.ID, "kind": signed.Kind, "reference": signed.Reference, "peerId": counterparty})
+	}()
+}
+
+// signInteraction sets r's ID and the signature of self, its provider or
+// its client.
+func signInteraction(r *InteractionRecord, priv crypto.PrivKey, self string) error {
+	sig, err := signData(priv, r.signedBytes())
+	if err != nil {
+		return err
+	}
+	r.ID = r.Hash().Hex()
+	switch self {
+	case r.Provider:
+		r.ProviderSignature = sig
+	case r.Client:
+		r.ClientSignature = sig
+	default:
+		return fmt.Errorf("%s isn't a party to the record", self)
+	}
+	return nil
+}
+
+func (n *AgentNode) saveInteraction(r InteractionRecord) {
+	if err := n.Store.SaveInteraction(r); err != nil {
+		fmt.Printf("[DB] Failed to record interaction %s: %v\n", r.ID, err)
+	}
+}
+
+// countersign sends r, signed by this node, to the counterparty at peerID
+// and returns it signed by both.
+func (n *AgentNode) countersign(ctx context.Context, peerID string, r InteractionRecord) (*InteractionRecord, error) {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID %q: %w", peerID, err)
+	}
+	if err := n.reachPeer(ctx, pid); err != nil {
+		return nil, err
+	}
+	h := n.CurrentHost()
+	s, err := h.NewStream(network.WithAllowLimitedConn(ctx, "history"), pid, protocol.ID(HistoryProtocol))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	if err := writeMessage(s, AgentMessage{ID: r.ID, Type: MessageInteraction, Payload: r, Sender: h.ID().String(), Timestamp: time.Now().UnixMilli()}); err != nil {
+		return nil, err
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Type {
+	case MessageError:
+		return nil, peerError(peerID, *resp)
+	case MessageInteraction:
+	default:
+		return nil, fmt.Errorf("peer %s answered a record with %q", pid, resp.Type)
+	}
+	var signed InteractionRecord
+	if err := UnmarshalPayload(*resp, &signed); err != nil {
+		return nil, fmt.Errorf("peer %s sent an unreadable record: %w", pid, err)
+	}
+	// Only the counterparty's signature may be new
+	signed.Anchor = nil
+	if signed.ID != r.ID || (r.ProviderSignature != "" && signed.ProviderSignature != r.ProviderSignature) ||
+		(r.ClientSignature != "" && signed.ClientSignature != r.ClientSignature) {
+		return nil, fmt.Errorf("peer %s returned a different record", pid)
+	}
+	if err := VerifyInteraction(signed); err != nil {
+		return nil, fmt.Errorf("peer %s: %w", pid, err)
+	}
+	return &signed, nil
+}
+
+// handleInteraction countersigns a record of an exchange the node took part
+// in: an answer it received from the provider, or a task it committed a
+// result to for the client.
+func (n *AgentNode) handleInteraction(s network.Stream) {
+	if n.checkBlocked(s) {
+		return
+	}
+	msg, err := readMessage(s)
+	if err != nil || msg.Type != MessageInteraction {
+		n.misbehaved(s, ViolationProtocolError)
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "expected an interaction record"})
+		return
+	}
+	var r InteractionRecord
+	if err := UnmarshalPayload(*msg, &r); err != nil || r.ID != r.Hash().Hex() {
+		n.misbehaved(s, ViolationProtocolError)
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "invalid interaction record"})
+		return
+	}
+	from, self := s.Conn().RemotePeer().String(), s.Conn().LocalPeer().String()
+	r.Anchor = nil
+
+	var theirs string
+	switch {
+	case r.Kind == RecordKindKnowledge && r.Provider == from && r.Client == self:
+		theirs = r.ProviderSignature
+		d, err := n.Store.GetDelivery(r.Reference)
+		if err != nil {
+			n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "delivery log unavailable", Retryable: true})
+			return
+		}
+		if d == nil || d.Status != DeliveryReceived || d.PeerID != from || !answerHashIs(d.Answer, r.ArtifactHash) {
+			n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "no such answer was received from you"})
+			return
+		}
+	case r.Kind == RecordKindTask && r.Client == from && r.Provider == self:
+		theirs = r.ClientSignature
+		if !n.commitments().committed(r.ArtifactHash, from) {
+			n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "no such result was committed to you"})
+			return
+		}
+	default:
+		n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "not a record between you and this node"})
+		return
+	}
+	if !verifyPeerSignature(from, r.signedBytes(), theirs) {
+		n.misbehaved(s, ViolationBadSignature)
+		n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "your signature doesn't verify"})
+		return
+	}
+
+	n.mu.RLock()
+	priv := n.privKey
+	n.mu.RUnlock()
+	if err := signInteraction(&r, priv, self); err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "signing the record failed"})
+		return
+	}
+	n.saveInteraction(r)
+	n.Events.Add("interaction_recorded", map[string]string{"id": r.ID, "kind": r.Kind, "reference": r.Reference, "peerId": from})
+	writeMessage(s, AgentMessage{ID: msg.ID, Type: MessageInteraction, Payload: r, Sender: self, Timestamp: time.Now().UnixMilli()})
+}
+
+// answerHashIs reports whether answer hashes to hash.
+func answerHashIs(answer KnowledgeAnswer, hash string) bool {
+	h, err := answer.Hash()
+	return err == nil && strings.EqualFold(h.Hex(), hash)
+}
+
+// commitLog remembers the results the node committed to, and for whom, so
+// it countersigns records only of tasks it did.
+type commitLog struct {
+	mu      sync.Mutex
+	results map[string]commitEntry // by result hash, lowercase
+}
+
+type commitEntry struct {
+	peerID string
+	at     time.Time
+}
+
+// commitments returns the node's commit log, creating it on first use.
+func (n *AgentNode) commitments() *commitLog {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.commits == nil {
+		n.commits = &commitLog{results: map[string]commitEntry{}}
+	}
+	return n.commits
+}
+
+// add notes that the node delivered the result hashing to hash to peerID,
+// forgetting those older than commitmentTTL.
+func (c *commitLog) add(hash, peerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for h, e := range c.results {
+		if now.Sub(e.at) > commitmentTTL {
+			delete(c.results, h)
+		}
+	}
+	c.results[strings.ToLower(hash)] = commitEntry{peerID: peerID, at: now}
+}
+
+func (c *commitLog) committed(hash, peerID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.results[strings.ToLower(hash)]
+	return ok && e.peerID == peerID && time.Since(e.at) <= commitmentTTL
+}
+
+// AnchorInteractions publishes the merkle root of the node's countersigned
+// records not yet anchored as its MetadataInteractionRoot, naming the root
+// anchored before, and gives each record its proof. It returns nil when
+// there is nothing to anchor. On a dry run the root is simulated but no
+// record is marked anchored.
+func (n *AgentNode) AnchorInteractions(ctx context.Context) (*InteractionRoot, error) {
+	if n.ERCClient == nil || n.Wallet == nil {
+		return nil, errors.New("anchoring needs a chain client and a wallet")
+	}
+	records, err := n.Store.ListInteractions()
+	if err != nil {
+		return nil, err
+	}
+	var batch []InteractionRecord
+	var prev *InteractionAnchor
+	for _, r := range records {
+		switch {
+		case r.Anchor != nil:
+			if prev == nil || r.Anchor.AnchoredAt > prev.AnchoredAt {
+				prev = r.Anchor
+			}
+		case r.Complete():
+			batch = append(batch, r)
+		}
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].ID < batch[j].ID })
+	leaves := make([]common.Hash, len(batch))
+	for i, r := range batch {
+		leaves[i] = r.Hash()
+	}
+	root := InteractionRoot{Root: merkleRoot(leaves).Hex(), Count: len(batch)}
+	if prev != nil {
+		root.Prev = prev.Root
+	}
+	value, err := canonical.Marshal(root)
+	if err != nil {
+		return nil, err
+	}
+
+	agentId, err := n.ownAgentID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := n.ERCClient.setMetadata(n.Wallet, agentId, MetadataInteractionRoot, value)
+	if err != nil || receipt == nil {
+		return &root, err
+	}
+	now := time.Now().UnixMilli()
+	for i, r := range batch {
+		proof := merkleProof(leaves, i)
+		a := &InteractionAnchor{Root: root.Root, Proof: make([]string, len(proof)), AgentID: agentId.String(), ChainID: n.ERCClient.ChainID(),
+			Block: receipt.BlockNumber.Uint64(), TxHash: receipt.TxHash.Hex(), AnchoredAt: now}
+		for j, h := range proof {
+			a.Proof[j] = h.Hex()
+		}
+		r.Anchor = a
+		n.saveInteraction(r)
+	}
+	fmt.Printf("[History] Anchored %d records under %s in block %d\n", len(batch), root.Root, receipt.BlockNumber)
+	n.Events.Add("interactions_anchored", map[string]interface{}{"root": root.Root, "count": root.Count, "txHash": receipt.TxHash.Hex()})
+	return &root, nil
+}
+
+// historyStep anchors the node's records every AnchorInterval, once the
+// node is ready, if it is set.
+func (n *AgentNode) historyStep() BootStep {
+	return BootStep{Name: "history", After: []string{"store", "host"}, Run: func(context.Context) error {
+		if n.AnchorInterval <= 0 {
+			return nil
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			if err := n.WaitReady(n.ctx); err != nil {
+				return
+			}
+			ticker := time.NewTicker(n.AnchorInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-n.ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if _, err := n.AnchorInteractions(n.ctx); err != nil {
+					fmt.Printf("[History] Anchoring failed: %v\n", err)
+				}
+			}
+		}()
+		return nil
+	}}
+}
+
+// merkleRoot is the root of the tree over leaves, in order, whose nodes
+// hash their children sorted, so a proof needs no left or right. A node
+// without a sibling moves up as it is.
+func merkleRoot(leaves []common.Hash) common.Hash {
+	if len(leaves) == 0 {
+		return common.Hash{}
+	}
+	level := leaves
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+func merkleLevel(level []common.Hash) []common.Hash {
+	next := make([]common.Hash, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, hashPair(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+// merkleProof lists the siblings on the way from leaves[i] to the root.
+func merkleProof(leaves []common.Hash, i int) []common.Hash {
+	var proof []common.Hash
+	level := leaves
+	for len(level) > 1 {
+		if sibling := i ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		level, i = merkleLevel(level), i/2
+	}
+	return proof
+}
+
+func verifyMerkleProof(leaf common.Hash, proof []string, root string) bool {
+	h := leaf
+	for _, p := range proof {
+		if len(common.FromHex(p)) != common.HashLength {
+			return false
+		}
+		h = hashPair(h, common.HexToHash(p))
+	}
+	return strings.EqualFold(h.Hex(), root)
+}
+
+func hashPair(a, b common.Hash) common.Hash {
+	if strings.Compare(a.Hex(), b.Hex()) > 0 {
+		a, b = b, a
+	}
+	return ethcrypto.Keccak256Hash(a.Bytes(), b.Bytes())
+}
+
+// SaveInteraction inserts or replaces an interaction record.
+func (s *sqlStore) SaveInteraction(r InteractionRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var root interface{}
+	if r.Anchor != nil {
+		root = r.Anchor.Root
+	}
+	_, err = s.exec(`
+		INSERT INTO interactions (id, kind, reference, record, anchor_root, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET record = excluded.record, anchor_root = excluded.anchor_root`,
+		r.ID, r.Kind, r.Reference, string(data), root, r.CompletedAt)
+	return err
+}
+
+// GetInteraction returns an interaction record, or nil if there is none
+// with id.
+func (s *sqlStore) GetInteraction(id string) (*InteractionRecord, error) {
+	var data string
+	err := s.queryRow("SELECT record FROM interactions WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r InteractionRecord
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListInteractions returns every interaction record, newest first.
+func (s *sqlStore) ListInteractions() ([]InteractionRecord, error) {
+	rows, err := s.query("SELECT record FROM interactions ORDER BY completed_at DESC, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []InteractionRecord
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var r InteractionRecord
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
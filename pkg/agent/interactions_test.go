@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// countersigned waits until both nodes hold the complete record of
+// reference and returns each one's copy.
+func countersigned(t *testing.T, a, b *AgentNode, reference string) (InteractionRecord, InteractionRecord) {
+	t.Helper()
+	find := func(n *AgentNode) *InteractionRecord {
+		records, _ := n.Store.ListInteractions()
+		for _, r := range records {
+			if r.Reference == reference && r.Complete() {
+				return &r
+			}
+		}
+		return nil
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		ra, rb := find(a), find(b)
+		if ra != nil && rb != nil {
+			return *ra, *rb
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("record of %s on both sides: %v, %v", reference, ra, rb)
+		}
+	}
+}
+
+func TestExchangesAreRecordedAndCountersignedByBothParties(t *testing.T) {
+	delegator, worker := connectedPair(t)
+	if err := worker.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dID, wID := delegator.CurrentHost().ID().String(), worker.CurrentHost().ID().String()
+
+	// The delegator answers a knowledge request of the worker's
+	answer := KnowledgeAnswer{RequestID: "7", Topic: "go", Content: "channels"}
+	d, err := delegator.DeliverKnowledge(ctx, "query:7", wID, answer)
+	if err != nil || d.Status != DeliverySettled {
+		t.Fatalf("delivery = %+v, %v", d, err)
+	}
+	provided, received := countersigned(t, delegator, worker, d.ID)
+	hash, _ := answer.Hash()
+	if provided.ID != received.ID || provided.Kind != RecordKindKnowledge || provided.Provider != dID || provided.Client != wID ||
+		provided.ArtifactHash != hash.Hex() || provided.Amount != "0" {
+		t.Errorf("records = %+v and %+v, want the same record of the answer", provided, received)
+	}
+	for _, r := range []InteractionRecord{provided, received} {
+		if err := VerifyInteraction(r); err != nil {
+			t.Errorf("VerifyInteraction: %v", err)
+		}
+	}
+
+	// The worker does a paid task for the delegator
+	settle := &fakeSettlement{}
+	payload := map[string]interface{}{"capability": "summarize", "text": "a long document"}
+	if _, _, err := delegator.DelegateVerified(ctx, worker.CurrentHost().ID(), big.NewInt(8), payload, nil, settle); err != nil {
+		t.Fatal(err)
+	}
+	paid, worked := countersigned(t, delegator, worker, "task:8")
+	if paid.ID != worked.ID || paid.Kind != RecordKindTask || paid.Provider != wID || paid.Client != dID {
+		t.Errorf("records = %+v and %+v, want the same record of the task", paid, worked)
+	}
+	if err := VerifyInteraction(worked); err != nil {
+		t.Errorf("VerifyInteraction: %v", err)
+	}
+
+	// Records of exchanges that didn't happen aren't countersigned
+	forged := InteractionRecord{Kind: RecordKindKnowledge, Reference: "never-sent", Client: wID, ArtifactHash: hash.Hex(), Amount: "1000"}
+	delegator.recordInteraction(forged, wID)
+	time.Sleep(200 * time.Millisecond)
+	records, _ := worker.Store.ListInteractions()
+	if len(records) != 2 {
+		t.Errorf("worker holds %d records, want the 2 real ones", len(records))
+	}
+}
+
+// signedRecord is a record of reference between two fresh identities,
+// signed by both.
+func signedRecord(t *testing.T, reference string) InteractionRecord {
+	t.Helper()
+	pPriv, _, _ := crypto.GenerateEd25519Key(nil)
+	cPriv, _, _ := crypto.GenerateEd25519Key(nil)
+	provider, _ := peer.IDFromPrivateKey(pPriv)
+	client, _ := peer.IDFromPrivateKey(cPriv)
+	r := InteractionRecord{Kind: RecordKindTask, Reference: reference, Provider: provider.String(), Client: client.String(),
+		ArtifactHash: common.Hash{1}.Hex(), Amount: "1000", StartedAt: 1, CompletedAt: 2}
+	if err := signInteraction(&r, pPriv, r.Provider); err != nil {
+		t.Fatal(err)
+	}
+	if err := signInteraction(&r, cPriv, r.Client); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestInteractionVerificationFailsOnBadSignaturesOrAnchors(t *testing.T) {
+	r := signedRecord(t, "task:1")
+	if err := VerifyInteraction(r); err != nil {
+		t.Fatalf("VerifyInteraction: %v", err)
+	}
+
+	// Either signature swapped for the other, or the terms changed
+	swapped := r
+	swapped.ClientSignature = r.ProviderSignature
+	other := signedRecord(t, "task:1")
+	foreign := r
+	foreign.ProviderSignature = other.ProviderSignature
+	raised := r
+	raised.Amount = "2000"
+	for name, bad := range map[string]InteractionRecord{"client": swapped, "provider": foreign, "terms": raised} {
+		if err := VerifyInteraction(bad); !errors.Is(err, ErrInteractionSignature) {
+			t.Errorf("%s: err = %v, want ErrInteractionSignature", name, err)
+		}
+	}
+
+	// Three records under one root: each proof leads there, none elsewhere
+	batch := []InteractionRecord{r, signedRecord(t, "task:2"), signedRecord(t, "task:3")}
+	leaves := make([]common.Hash, len(batch))
+	for i, b := range batch {
+		leaves[i] = b.Hash()
+	}
+	root := merkleRoot(leaves).Hex()
+	for i := range batch {
+		a := &InteractionAnchor{Root: root, AgentID: "1", Block: 10}
+		for _, h := range merkleProof(leaves, i) {
+			a.Proof = append(a.Proof, h.Hex())
+		}
+		batch[i].Anchor = a
+		if err := VerifyInteraction(batch[i]); err != nil {
+			t.Errorf("record %d: %v", i, err)
+		}
+	}
+	moved := batch[0]
+	moved.Anchor = &InteractionAnchor{Root: common.Hash{2}.Hex(), Proof: batch[0].Anchor.Proof, AgentID: "1", Block: 10}
+	borrowed := batch[1]
+	borrowed.Anchor = &InteractionAnchor{Root: root, Proof: batch[2].Anchor.Proof, AgentID: "1", Block: 10}
+	for name, bad := range map[string]InteractionRecord{"root": moved, "proof": borrowed} {
+		if err := VerifyInteraction(bad); !errors.Is(err, ErrInteractionAnchor) {
+			t.Errorf("%s: err = %v, want ErrInteractionAnchor", name, err)
+		}
+	}
+
+	// The root must be the one the agent published
+	published, _ := canonical.Marshal(InteractionRoot{Root: root, Count: 3})
+	c, _ := metadataRegistry(t, map[string]string{MetadataInteractionRoot: string(published)}, false, false)
+	if err := c.VerifyInteractionAnchor(batch[0]); err != nil {
+		t.Errorf("VerifyInteractionAnchor: %v", err)
+	}
+	stale, _ := canonical.Marshal(InteractionRoot{Root: common.Hash{3}.Hex(), Count: 1})
+	c, _ = metadataRegistry(t, map[string]string{MetadataInteractionRoot: string(stale)}, false, false)
+	if err := c.VerifyInteractionAnchor(batch[0]); !errors.Is(err, ErrInteractionAnchor) {
+		t.Errorf("err = %v, want ErrInteractionAnchor for another published root", err)
+	}
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// KnowledgeMarket functions a requester and a provider call, plus the
+// events they emit.
+const knowledgeMarketABI = `[
+	{"inputs":[{"internalType":"uint256","name":"","type":"uint256"}],"name":"requests","outputs":[{"internalType":"address","name":"requester","type":"address"},{"internalType":"string","name":"topic","type":"string"},{"internalType":"bytes32","name":"topicHash","type":"bytes32"},{"internalType":"uint256","name":"bounty","type":"uint256"},{"internalType":"uint256","name":"timestamp","type":"uint256"},{"internalType":"bool","name":"fulfilled","type":"bool"}],"stateMutability":"view","type":"function"},
+	{"inputs":[{"internalType":"uint256","name":"requestId","type":"uint256"},{"internalType":"string","name":"responsePath","type":"string"}],"name":"fulfillRequest","outputs":[],"stateMutability":"nonpayable","type":"function"},
+	{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"requestId","type":"uint256"},{"indexed":true,"internalType":"address","name":"provider","type":"address"},{"indexed":false,"internalType":"string","name":"responsePath","type":"string"}],"name":"KnowledgeProvided","type":"event"},
+	{"inputs":[{"internalType":"string","name":"topic","type":"string"},{"internalType":"bytes32","name":"topicHash","type":"bytes32"}],"name":"requestKnowledge","outputs":[],"stateMutability":"payable","type":"function"},
+	{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"requestId","type":"uint256"},{"indexed":true,"internalType":"address","name":"requester","type":"address"},{"indexed":false,"internalType":"string","name":"topic","type":"string"},{"indexed":true,"internalType":"bytes32","name":"topicHash","type":"bytes32"},{"indexed":false,"internalType":"uint256","name":"bounty","type":"uint256"}],"name":"KnowledgeRequested","type":"event"}
+]`
+
+// ErrNoMarketRequest is returned by GetRequest for a requestId the market
+// never issued.
+var ErrNoMarketRequest = errors.New("no such knowledge request")
+
+// MarketRequest is a knowledge request as the market stores it. Bounty is in
+// wei, Timestamp in unix seconds.
+type MarketRequest struct {
+	Requester common.Address
+	Topic     string
+	TopicHash [32]byte
+	Bounty    *big.Int
+	Timestamp *big.Int
+	Fulfilled bool
+}
+
+// KnowledgeMarket sends the KnowledgeMarket contract's transactions
+// through an ERC8004Client, so dry-run, the journal and the governor apply
+// to it.
+type KnowledgeMarket struct {
+	client *ERC8004Client
+	addr   common.Address
+}
+
+func NewKnowledgeMarket(client *ERC8004Client, marketAddr string) *KnowledgeMarket {
+	return &KnowledgeMarket{client: client, addr: common.HexToAddress(marketAddr)}
+}
+
+// RequestKnowledge posts a request for topic with bounty wei attached and
+// returns its requestId. Nodes watching the market pick it up as a
+// KnowledgeRequested event.
+func (m *KnowledgeMarket) RequestKnowledge(w *Wallet, topic string, bounty *big.Int) (*big.Int, error) {
+	data, err := m.client.marketABI.Pack("requestKnowledge", topic, crypto.Keccak256Hash([]byte(topic)))
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := m.client.transact(w, m.addr, data, bounty)
+	if err != nil {
+		return nil, fmt.Errorf("requestKnowledge(%q) failed: %w", topic, err)
+	}
+	if receipt == nil {
+		// The requestId only exists once the request is mined
+		return nil, ErrDryRun
+	}
+
+	requested := m.client.marketABI.Events["KnowledgeRequested"].ID
+	for _, l := range receipt.Logs {
+		if l.Address == m.addr && len(l.Topics) > 1 && l.Topics[0] == requested {
+			return new(big.Int).SetBytes(l.Topics[1].Bytes()), nil
+		}
+	}
+	return nil, fmt.Errorf("request mined in %s but no KnowledgeRequested event was found", receipt.TxHash.Hex())
+}
+
+// Address is the market contract's address.
+func (m *KnowledgeMarket) Address() common.Address {
+	return m.addr
+}
+
+// GetRequest reads a knowledge request from the market.
+func (m *KnowledgeMarket) GetRequest(requestId *big.Int) (*MarketRequest, error) {
+	data, _ := m.client.marketABI.Pack("requests", requestId)
+	res, err := m.client.call(m.addr, data, m.client.readBlock(nil))
+	if err != nil {
+		return nil, err
+	}
+	out, err := m.client.marketABI.Unpack("requests", res)
+	if err != nil {
+		return nil, err
+	}
+	req := &MarketRequest{
+		Requester: *abi.ConvertType(out[0], new(common.Address)).(*common.Address),
+		Topic:     *abi.ConvertType(out[1], new(string)).(*string),
+		TopicHash: *abi.ConvertType(out[2], new([32]byte)).(*[32]byte),
+		Bounty:    abi.ConvertType(out[3], new(big.Int)).(*big.Int),
+		Timestamp: abi.ConvertType(out[4], new(big.Int)).(*big.Int),
+		Fulfilled: *abi.ConvertType(out[5], new(bool)).(*bool),
+	}
+	if req.Requester == (common.Address{}) {
+		return nil, fmt.Errorf("%w: %s", ErrNoMarketRequest, requestId)
+	}
+	return req, nil
+}
+
+// Fulfill marks a request answered, with responsePath saying where the
+// answer went, and collects its bounty for w. It returns the transaction's
+// hash, or the zero hash on a dry run.
+func (m *KnowledgeMarket) Fulfill(w *Wallet, requestId *big.Int, responsePath string) (common.Hash, error) {
+	data, err := m.client.marketABI.Pack("fulfillRequest", requestId, responsePath)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	receipt, err := m.client.transact(w, m.addr, data, nil)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("fulfillRequest(%s) failed: %w", requestId, err)
+	}
+	if receipt == nil {
+		return common.Hash{}, nil
+	}
+	return receipt.TxHash, nil
+}
@@ -0,0 +1,477 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Message types of the knowledge delivery exchange. The node answering a
+// knowledge request sends its answer in a knowledge message; the requester
+// returns a delivery_ack, signed with its peer key, that names the message's
+// correlation ID, the answer's hash and the node that sent it. A requester
+// with a wallet adds an EIP-712 KnowledgeReceipt for the answer's market.
+const (
+	MessageKnowledge   = "knowledge"
+	MessageDeliveryAck = "delivery_ack"
+)
+
+// Knowledge delivery statuses. A pending delivery is sent again until it is
+// acknowledged or out of attempts; an acknowledged one is settled, e.g. its
+// bounty claimed, before it is done.
+const (
+	DeliveryPending  = "pending"
+	DeliveryAcked    = "acked"
+	DeliverySettled  = "settled"
+	DeliveryFailed   = "failed"
+	DeliveryReceived = "received" // an answer sent to this node, and acknowledged
+)
+
+// DefaultAckTimeout is how long a requester has to acknowledge an answer.
+const DefaultAckTimeout = 30 * time.Second
+
+// DefaultDeliveryAttempts is how many times an answer is sent, the first
+// included, before its delivery is given up.
+const DefaultDeliveryAttempts = 5
+
+// ErrAckTimeout is returned when a requester didn't acknowledge an answer
+// within the node's AckTimeout.
+var ErrAckTimeout = errors.New("requester didn't acknowledge the answer in time")
+
+// SettleFunc finishes an acknowledged delivery, such as by claiming the
+// request's bounty on-chain. d.Ack.Receipt, if set, is the requester's
+// EIP-712 receipt, for a market whose claim takes one. A delivery it fails
+// on stays acknowledged and is settled again by ResumeDeliveries.
+type SettleFunc func(ctx context.Context, d KnowledgeDelivery) error
+
+// KnowledgeHandler gets an answer delivered to this node by the peer from.
+// An error withholds the ack, so the sender tries again.
+type KnowledgeHandler func(from string, answer KnowledgeAnswer) error
+
+// KnowledgeAnswer is the answer to a knowledge request.
+type KnowledgeAnswer struct {
+	RequestID string      `json:"requestId"`         // the market's
+	ChainID   uint64      `json:"chainId,omitempty"` // the market's chain, if the node knows it
+	Topic     string      `json:"topic"`
+	Content   interface{} `json:"content"`
+	Market    string      `json:"market,omitempty"`   // the market holding the bounty, for the receipt
+	Provider  string      `json:"provider,omitempty"` // wallet the receipt credits
+}
+
+// Hash is the keccak256 hash of the answer's canonical JSON, which its
+// acknowledgement names.
+func (a KnowledgeAnswer) Hash() (common.Hash, error) {
+	raw, err := canonical.Marshal(a)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return ethcrypto.Keccak256Hash(raw), nil
+}
+
+// DeliveryAck is a requester's receipt for an answer. It names the delivery
+// and the node it came from, so it can't be replayed to confirm another
+// delivery, or one from another node.
+type DeliveryAck struct {
+	ID         string `json:"id"` // correlation ID of the knowledge message
+	RequestID  string `json:"requestId"`
+	AnswerHash string `json:"answerHash"`
+	Responder  string `json:"responder"` // peer ID the answer came from
+	Requester  string `json:"requester"` // peer ID that signed the ack
+	Signature  string `json:"signature"`
+	// Receipt is the requester's wallet's receipt for the answer, if the
+	// answer named its market and provider and the requester has a wallet.
+	// It has a signature of its own, so the ack's doesn't cover it.
+	Receipt *KnowledgeReceipt `json:"receipt,omitempty"`
+}
+
+func (a DeliveryAck) signedBytes() []byte {
+	return signedDocument("agentmesh-delivery-ack:", struct {
+		ID         string `json:"id"`
+		RequestID  string `json:"requestId"`
+		AnswerHash string `json:"answerHash"`
+		Responder  string `json:"responder"`
+		Requester  string `json:"requester"`
+	}{a.ID, a.RequestID, a.AnswerHash, a.Responder, a.Requester})
+}
+
+// Verify checks that Requester signed the ack.
+func (a DeliveryAck) Verify() bool {
+	return verifyPeerSignature(a.Requester, a.signedBytes(), a.Signature)
+}
+
+// KnowledgeDelivery is an answer on its way to a requester, kept so a
+// delivery interrupted by a restart resumes where it stopped. Answers the
+// node received are kept too, so one sent again is acknowledged without
+// being handled twice.
+type KnowledgeDelivery struct {
+	ID        string          `json:"id"`               // correlation ID, the same for every attempt
+	TaskID    string          `json:"taskId,omitempty"` // the request's task record, e.g. "query:7"
+	PeerID    string          `json:"peerId"`           // the requester, or the sender of an answer received
+	Answer    KnowledgeAnswer `json:"answer"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	Ack       *DeliveryAck    `json:"ack,omitempty"`
+	CreatedAt int64           `json:"createdAt"`
+	UpdatedAt int64           `json:"updatedAt"`
+}
+
+// DeliverKnowledge sends answer to the requester at peerID on the task
+// protocol and waits for its signed acknowledgement. Only then is the
+// delivery settled through SettleKnowledge. The delivery is recorded before
+// it is sent; one that fails is resumed by ResumeDeliveries.
+func (n *AgentNode) DeliverKnowledge(ctx context.Context, taskID, peerID string, answer KnowledgeAnswer) (*KnowledgeDelivery, error) {
+	if _, err := answer.Hash(); err != nil {
+		return nil, fmt.Errorf("answer has no canonical form: %w", err)
+	}
+	now := time.Now().Unix()
+	d := &KnowledgeDelivery{ID: newMessageID(), TaskID: taskID, PeerID: peerID, Answer: answer, Status: DeliveryPending, CreatedAt: now, UpdatedAt: now}
+	if err := n.Store.SaveDelivery(*d); err != nil {
+		return nil, fmt.Errorf("recording the delivery: %w", err)
+	}
+	return d, n.advanceDelivery(ctx, d)
+}
+
+// ResumeDeliveries takes every delivery still in progress a step further:
+// pending ones are sent again, under their correlation ID, and acknowledged
+// ones settled. It fails only if the deliveries can't be listed.
+func (n *AgentNode) ResumeDeliveries(ctx context.Context) error {
+	deliveries, err := n.Store.ListDeliveries()
+	if err != nil {
+		return err
+	}
+	return n.resumeDeliveries(ctx, deliveries)
+}
+
+// deliveriesStep lists the deliveries a restart interrupted once the store
+// and host are up, and resumes them in the background.
+func (n *AgentNode) deliveriesStep() BootStep {
+	return BootStep{Name: "deliveries", After: []string{"store", "host"}, Run: func(ctx context.Context) error {
+		deliveries, err := n.Store.ListDeliveries()
+		if err != nil {
+			return err
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			n.resumeDeliveries(ctx, deliveries)
+		}()
+		return nil
+	}}
+}
+
+func (n *AgentNode) resumeDeliveries(ctx context.Context, deliveries []KnowledgeDelivery) error {
+	for i := range deliveries {
+		d := &deliveries[i]
+		if d.Status != DeliveryPending && d.Status != DeliveryAcked {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := n.advanceDelivery(ctx, d); err != nil {
+			fmt.Printf("[Knowledge] Delivery %s of %s still %s: %v\n", d.ID, d.TaskID, d.Status, err)
+		}
+	}
+	return nil
+}
+
+// advanceDelivery sends a pending delivery and waits for its ack, then
+// settles it, saving it after each step.
+func (n *AgentNode) advanceDelivery(ctx context.Context, d *KnowledgeDelivery) error {
+	if d.Status == DeliveryPending {
+		ack, err := n.sendKnowledge(ctx, d)
+		d.Attempts++
+		d.UpdatedAt = time.Now().Unix()
+		if err != nil {
+			d.LastError = err.Error()
+			if d.Attempts >= DefaultDeliveryAttempts {
+				d.Status = DeliveryFailed
+			}
+			n.saveDelivery(*d)
+			if errors.Is(err, ErrUnreachable) && d.Status == DeliveryPending {
+				n.redeliverLater(*d)
+			}
+			return err
+		}
+		d.Status, d.Ack, d.LastError = DeliveryAcked, ack, ""
+		n.saveDelivery(*d)
+		fmt.Printf("[Knowledge] %s acknowledged the answer to %s\n", n.Names.Display(d.PeerID), d.TaskID)
+	}
+	if d.Status != DeliveryAcked {
+		return nil
+	}
+	var paid settlement
+	var err error
+	switch {
+	case strings.HasPrefix(d.TaskID, catalogTaskPrefix):
+		// A catalog sale is paid by fulfilling the buyer's market request
+		paid, err = n.settlePurchase(ctx, *d)
+	case n.SettleKnowledge != nil:
+		err = n.SettleKnowledge(ctx, *d)
+	}
+	if err != nil {
+		d.LastError, d.UpdatedAt = err.Error(), time.Now().Unix()
+		n.saveDelivery(*d)
+		return fmt.Errorf("settling %s: %w", d.TaskID, err)
+	}
+	d.Status, d.LastError, d.UpdatedAt = DeliverySettled, "", time.Now().Unix()
+	n.saveDelivery(*d)
+	n.recordDelivery(*d, paid)
+	return nil
+}
+
+// redeliverLater sends d again after RedeliverAfter, if it is set, unless
+// the node stops first. Without it, d waits for the next start.
+func (n *AgentNode) redeliverLater(d KnowledgeDelivery) {
+	if n.RedeliverAfter <= 0 || n.ctx.Err() != nil {
+		return
+	}
+	fmt.Printf("[Knowledge] Sending the answer to %s again in %s\n", d.TaskID, n.RedeliverAfter)
+	n.localWG.Add(1)
+	go func() {
+		defer n.localWG.Done()
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-time.After(n.RedeliverAfter):
+		}
+		if err := n.advanceDelivery(n.ctx, &d); err != nil {
+			fmt.Printf("[Knowledge] Delivery %s of %s still %s: %v\n", d.ID, d.TaskID, d.Status, err)
+		}
+	}()
+}
+
+func (n *AgentNode) saveDelivery(d KnowledgeDelivery) {
+	if err := n.Store.SaveDelivery(d); err != nil {
+		fmt.Printf("[DB] Failed to record delivery %s: %v\n", d.ID, err)
+	}
+}
+
+func (n *AgentNode) ackTimeout() time.Duration {
+	if n.AckTimeout > 0 {
+		return n.AckTimeout
+	}
+	return DefaultAckTimeout
+}
+
+// sendKnowledge sends d's answer and returns the requester's ack once it
+// checks out.
+func (n *AgentNode) sendKnowledge(ctx context.Context, d *KnowledgeDelivery) (*DeliveryAck, error) {
+	pid, err := peer.Decode(d.PeerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid requester peer ID %q: %w", d.PeerID, err)
+	}
+	if err := n.permit(pid, PolicyActionDeliver); err != nil {
+		return nil, err
+	}
+	hash, err := d.Answer.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if err := n.reachPeer(ctx, pid); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.ackTimeout())
+	defer cancel()
+	h := n.CurrentHost()
+	s, err := h.NewStream(network.WithAllowLimitedConn(ctx, "deliver"), pid, protocol.ID(TaskProtocol))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	s.SetDeadline(deadline)
+
+	msg := AgentMessage{ID: d.ID, Type: MessageKnowledge, Payload: d.Answer, Sender: h.ID().String(), Timestamp: time.Now().UnixMilli()}
+	if err := writeMessage(s, msg); err != nil {
+		return nil, err
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		var ne net.Error
+		if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+			return nil, fmt.Errorf("%w (%s)", ErrAckTimeout, n.ackTimeout())
+		}
+		return nil, err
+	}
+	switch resp.Type {
+	case MessageError:
+		return nil, peerError(pid.String(), *resp)
+	case MessageDeliveryAck:
+	default:
+		return nil, fmt.Errorf("peer %s answered with %q instead of an ack", pid, resp.Type)
+	}
+	var ack DeliveryAck
+	if err := UnmarshalPayload(*resp, &ack); err != nil {
+		return nil, fmt.Errorf("peer %s sent an unreadable ack: %w", pid, err)
+	}
+	if ack.ID != d.ID || ack.RequestID != d.Answer.RequestID || ack.AnswerHash != hash.Hex() ||
+		ack.Responder != msg.Sender || ack.Requester != pid.String() || !ack.Verify() {
+		return nil, fmt.Errorf("peer %s sent an ack that doesn't match the delivery", pid)
+	}
+	if r := ack.Receipt; r != nil && (r.RequestID != d.Answer.RequestID || r.AnswerHash != hash.Hex() || r.ChainID != d.Answer.ChainID ||
+		!sameAddress(r.Market, d.Answer.Market) || !sameAddress(r.Provider, d.Answer.Provider) || !r.Verify()) {
+		return nil, fmt.Errorf("peer %s sent a receipt that doesn't match the delivery", pid)
+	}
+	return &ack, nil
+}
+
+// receipt is this node's wallet's receipt for answer, or nil if the answer
+// doesn't name a market and provider, or the node has no wallet.
+func (n *AgentNode) receipt(answer KnowledgeAnswer, hash common.Hash) (*KnowledgeReceipt, error) {
+	signer := n.signer()
+	if signer == nil || !common.IsHexAddress(answer.Market) || !common.IsHexAddress(answer.Provider) {
+		return nil, nil
+	}
+	if _, ok := new(big.Int).SetString(answer.RequestID, 10); !ok {
+		return nil, nil
+	}
+	r := KnowledgeReceipt{
+		ChainID:    answer.ChainID,
+		Market:     common.HexToAddress(answer.Market).Hex(),
+		RequestID:  answer.RequestID,
+		AnswerHash: hash.Hex(),
+		Provider:   common.HexToAddress(answer.Provider).Hex(),
+		Requester:  signer.Account().Hex(),
+	}
+	sig, err := signer.SignTypedData(r.TypedData())
+	if err != nil {
+		return nil, err
+	}
+	r.Signature = hexutil.Encode(sig)
+	return &r, nil
+}
+
+// sameAddress reports whether a and b are the same address, in any case.
+func sameAddress(a, b string) bool {
+	return common.IsHexAddress(a) && common.IsHexAddress(b) && common.HexToAddress(a) == common.HexToAddress(b)
+}
+
+// receiveKnowledge handles an answer sent to this node: it is handed to
+// OnKnowledge once, recorded, and acknowledged every time it is sent.
+func (n *AgentNode) receiveKnowledge(s network.Stream, msg AgentMessage) {
+	from := s.Conn().RemotePeer().String()
+	var answer KnowledgeAnswer
+	if err := UnmarshalPayload(msg, &answer); err != nil || msg.ID == "" {
+		n.misbehaved(s, ViolationProtocolError)
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "invalid knowledge message"})
+		return
+	}
+	hash, err := answer.Hash()
+	if err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "answer has no canonical form"})
+		return
+	}
+
+	prev, err := n.Store.GetDelivery(msg.ID)
+	if err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "delivery log unavailable", Retryable: true})
+		return
+	}
+	if prev != nil && (prev.PeerID != from || prev.Status != DeliveryReceived) {
+		// Another node's delivery, or one of ours: not this sender's to confirm
+		n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "delivery ID already in use"})
+		return
+	}
+	if prev == nil {
+		if n.OnKnowledge != nil {
+			if err := n.OnKnowledge(from, answer); err != nil {
+				n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: err.Error(), Retryable: true})
+				return
+			}
+		}
+		now := time.Now().Unix()
+		n.saveDelivery(KnowledgeDelivery{ID: msg.ID, PeerID: from, Answer: answer, Status: DeliveryReceived, Attempts: 1, CreatedAt: now, UpdatedAt: now})
+		n.Events.Add("knowledge_received", map[string]string{"requestId": answer.RequestID, "topic": answer.Topic, "peerId": from})
+	}
+
+	n.mu.RLock()
+	priv := n.privKey
+	n.mu.RUnlock()
+	self, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "no identity to sign with"})
+		return
+	}
+	ack := DeliveryAck{ID: msg.ID, RequestID: answer.RequestID, AnswerHash: hash.Hex(), Responder: from, Requester: self.String()}
+	if ack.Signature, err = signData(priv, ack.signedBytes()); err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "signing the ack failed"})
+		return
+	}
+	if ack.Receipt, err = n.receipt(answer, hash); err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "signing the receipt failed", Retryable: true})
+		return
+	}
+	writeMessage(s, AgentMessage{ID: msg.ID, Type: MessageDeliveryAck, Payload: ack, Sender: self.String(), Timestamp: time.Now().UnixMilli()})
+}
+
+// SaveDelivery inserts or replaces a knowledge delivery.
+func (s *sqlStore) SaveDelivery(d KnowledgeDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`
+		INSERT INTO knowledge_deliveries (id, task_id, peer_id, status, delivery, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET status = excluded.status, delivery = excluded.delivery, updated_at = excluded.updated_at`,
+		d.ID, d.TaskID, d.PeerID, d.Status, string(data), d.CreatedAt, d.UpdatedAt)
+	return err
+}
+
+// GetDelivery returns a knowledge delivery, or nil if there is none for id.
+func (s *sqlStore) GetDelivery(id string) (*KnowledgeDelivery, error) {
+	var data string
+	err := s.queryRow("SELECT delivery FROM knowledge_deliveries WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d KnowledgeDelivery
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListDeliveries returns every knowledge delivery, oldest first.
+func (s *sqlStore) ListDeliveries() ([]KnowledgeDelivery, error) {
+	rows, err := s.query("SELECT delivery FROM knowledge_deliveries ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []KnowledgeDelivery
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var d KnowledgeDelivery
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			return nil, err
+		}
+		results = append(results, d)
+	}
+	return results, rows.Err()
+}
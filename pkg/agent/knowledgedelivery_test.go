@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKnowledgeDeliverySettlesOnlyOnceAcknowledged(t *testing.T) {
+	requester, responder := startTestNode(t), startTestNode(t)
+	if _, err := responder.addTarget(dialAddr(requester)); err != nil {
+		t.Fatal(err)
+	}
+	// The requester is slow to take the first answer, then keeps up
+	release := make(chan struct{})
+	var handled atomic.Int32
+	requester.OnKnowledge = func(from string, a KnowledgeAnswer) error {
+		if handled.Add(1) == 1 {
+			<-release
+		}
+		return nil
+	}
+	var settled atomic.Int32
+	responder.SettleKnowledge = func(ctx context.Context, d KnowledgeDelivery) error {
+		if d.Ack == nil || !d.Ack.Verify() {
+			t.Errorf("settling %s without a verified ack", d.ID)
+		}
+		settled.Add(1)
+		return nil
+	}
+	responder.AckTimeout = 200 * time.Millisecond
+	answer := KnowledgeAnswer{RequestID: "7", Topic: "go", Content: map[string]interface{}{"summary": "goroutines"}}
+
+	d, err := responder.DeliverKnowledge(context.Background(), "query:7", requester.CurrentHost().ID().String(), answer)
+	if !errors.Is(err, ErrAckTimeout) {
+		t.Fatalf("delivery to a stalled requester: %v, want ErrAckTimeout", err)
+	}
+	if settled.Load() != 0 {
+		t.Fatal("settled before the requester acknowledged")
+	}
+	if got, _ := responder.Store.GetDelivery(d.ID); got == nil || got.Status != DeliveryPending || got.Attempts != 1 {
+		t.Fatalf("after the timeout the delivery is %+v, want pending after 1 attempt", got)
+	}
+
+	// Resumed, as after a restart: the same delivery is acknowledged without
+	// the requester handling the answer twice
+	close(release)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if got, _ := requester.Store.GetDelivery(d.ID); got != nil && got.Status == DeliveryReceived {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the requester never recorded the answer")
+		}
+	}
+	if err := responder.ResumeDeliveries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := responder.Store.GetDelivery(d.ID)
+	if got == nil || got.Status != DeliverySettled || got.Attempts != 2 || got.Ack == nil {
+		t.Fatalf("after resuming the delivery is %+v, want settled on the second attempt", got)
+	}
+	if settled.Load() != 1 || handled.Load() != 1 {
+		t.Errorf("settled %d times and handled %d times, want once each", settled.Load(), handled.Load())
+	}
+	if got.Ack.Responder != responder.CurrentHost().ID().String() || got.Ack.Requester != requester.CurrentHost().ID().String() {
+		t.Errorf("ack %+v doesn't name both sides", got.Ack)
+	}
+
+	// The ack can't confirm a different answer
+	forged := *got.Ack
+	forged.AnswerHash = "0x00"
+	if forged.Verify() {
+		t.Error("an ack verified for an answer it didn't name")
+	}
+}
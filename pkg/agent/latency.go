@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// DefaultProbeInterval is how often the peers in the routing table are
+// pinged.
+const DefaultProbeInterval = 30 * time.Second
+
+// DefaultLatencyAlpha is how much each round trip moves a peer's average:
+// its weight in the EWMA.
+const DefaultLatencyAlpha = 0.3
+
+// probeTimeout bounds one ping; probeParallel is how many run at once.
+const (
+	probeTimeout  = 10 * time.Second
+	probeParallel = 8
+)
+
+// rttReference is the round trip scored 0.5, as good as an unknown peer.
+const rttReference = 200 * time.Millisecond
+
+// LatencyProbe configures how the node measures the round trip to the peers
+// it routes to, with the libp2p ping protocol.
+type LatencyProbe struct {
+	Interval time.Duration // 0 means DefaultProbeInterval
+}
+
+func (p *LatencyProbe) interval() time.Duration {
+	if p.Interval <= 0 {
+		return DefaultProbeInterval
+	}
+	return p.Interval
+}
+
+// PeerLatency is what the probe measured of one peer.
+type PeerLatency struct {
+	PeerID      string        `json:"peerId"`
+	Latency     time.Duration `json:"latency"` // EWMA of the round trips
+	Last        time.Duration `json:"last"`    // latest round trip
+	Samples     int           `json:"samples"`
+	Unreachable bool          `json:"unreachable,omitempty"` // the latest ping failed
+	MeasuredAt  int64         `json:"measuredAt"`            // unix ms of the latest ping
+}
+
+// PeerLatencies keeps an EWMA of the round trip to each peer. A peer whose
+// latest ping failed is unreachable until one succeeds; its average is kept.
+type PeerLatencies struct {
+	Alpha float64 // weight of each new round trip; 0 means DefaultLatencyAlpha
+
+	mu    sync.RWMutex
+	clock Clock
+	peers map[peer.ID]*PeerLatency
+}
+
+func NewPeerLatencies() *PeerLatencies {
+	return &PeerLatencies{clock: SystemClock, peers: make(map[peer.ID]*PeerLatency)}
+}
+
+// SetClock replaces the clock pings are timed by.
+func (l *PeerLatencies) SetClock(clock Clock) {
+	l.clock = clock
+}
+
+// Observe records a round trip of rtt to pid.
+func (l *PeerLatencies) Observe(pid peer.ID, rtt time.Duration) {
+	alpha := l.Alpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = DefaultLatencyAlpha
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.entry(pid)
+	if p.Samples == 0 {
+		p.Latency = rtt
+	} else {
+		p.Latency = time.Duration(alpha*float64(rtt) + (1-alpha)*float64(p.Latency))
+	}
+	p.Last, p.Unreachable = rtt, false
+	p.Samples++
+}
+
+// fail records that pid didn't answer a ping.
+func (l *PeerLatencies) fail(pid peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entry(pid).Unreachable = true
+}
+
+// entry returns pid's entry, stamped now, with l.mu held.
+func (l *PeerLatencies) entry(pid peer.ID) *PeerLatency {
+	p, ok := l.peers[pid]
+	if !ok {
+		p = &PeerLatency{PeerID: pid.String()}
+		l.peers[pid] = p
+	}
+	p.MeasuredAt = l.clock.Now().UnixMilli()
+	return p
+}
+
+// Get returns what was measured of pid, if anything.
+func (l *PeerLatencies) Get(pid peer.ID) (PeerLatency, bool) {
+	if l == nil {
+		return PeerLatency{}, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	p, ok := l.peers[pid]
+	if !ok {
+		return PeerLatency{}, false
+	}
+	return *p, true
+}
+
+// Remove forgets pid, e.g. once it is blocked.
+func (l *PeerLatencies) Remove(pid peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.peers, pid)
+}
+
+// Snapshot returns every peer measured, sorted by peer ID.
+func (l *PeerLatencies) Snapshot() []PeerLatency {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]PeerLatency, 0, len(l.peers))
+	for _, p := range l.peers {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PeerID < out[j].PeerID })
+	return out
+}
+
+// score is the selection input for pid's latency: 1 for an instant round
+// trip, 0.5 at rttReference, 0 for an unreachable peer. ok is false for
+// peers never pinged.
+func (l *PeerLatencies) score(peerID string) (score float64, ok bool) {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return 0, false
+	}
+	p, ok := l.Get(pid)
+	switch {
+	case !ok:
+		return 0, false
+	case p.Unreachable:
+		return 0, true
+	case p.Samples == 0:
+		return 0, false
+	}
+	return float64(rttReference) / float64(rttReference+p.Latency), true
+}
+
+// Sort orders ids fastest first: reachable peers by their average round
+// trip, then peers never pinged, then unreachable ones. Ties keep their
+// order.
+func (l *PeerLatencies) Sort(ids []peer.ID) {
+	rank := func(pid peer.ID) (int, time.Duration) {
+		p, ok := l.Get(pid)
+		switch {
+		case !ok || (p.Samples == 0 && !p.Unreachable):
+			return 1, 0
+		case p.Unreachable:
+			return 2, 0
+		}
+		return 0, p.Latency
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		ri, li := rank(ids[i])
+		rj, lj := rank(ids[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return li < lj
+	})
+}
+
+// probeStep pings the routed peers every probe interval, until the node
+// stops.
+func (n *AgentNode) probeStep() BootStep {
+	return BootStep{Name: "probe", After: []string{"host"}, Run: func(context.Context) error {
+		if n.Probe == nil {
+			return nil
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			if err := n.WaitReady(n.ctx); err != nil {
+				return
+			}
+			ticker := time.NewTicker(n.Probe.interval())
+			defer ticker.Stop()
+			for {
+				n.probePeers(n.ctx)
+				select {
+				case <-n.ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+		return nil
+	}}
+}
+
+// probePeers pings every peer in the routing table once.
+func (n *AgentNode) probePeers(ctx context.Context) {
+	h := n.CurrentHost()
+	seen := map[string]bool{h.ID().String(): true}
+	var ids []peer.ID
+	for _, r := range n.Routes.Snapshot() {
+		for _, p := range r.Peers {
+			if seen[p.PeerID] {
+				continue
+			}
+			seen[p.PeerID] = true
+			if pid, err := peer.Decode(p.PeerID); err == nil {
+				ids = append(ids, pid)
+			}
+		}
+	}
+
+	sem := make(chan struct{}, probeParallel)
+	var wg sync.WaitGroup
+	for _, pid := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			pctx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			res := <-ping.Ping(pctx, h, pid)
+			if res.Error != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("[Probe] Ping to %s failed: %v\n", n.Names.Display(pid.String()), res.Error)
+					n.Latencies.fail(pid)
+				}
+				return
+			}
+			n.Latencies.Observe(pid, res.RTT)
+		}()
+	}
+	wg.Wait()
+}
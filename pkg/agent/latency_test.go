@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestLatencyIsAnEWMA(t *testing.T) {
+	l := NewPeerLatencies()
+	pid := randomPeer(t)
+	l.Observe(pid, 100*time.Millisecond)
+	l.Observe(pid, 200*time.Millisecond)
+	p, ok := l.Get(pid)
+	if !ok || p.Latency != 130*time.Millisecond || p.Last != 200*time.Millisecond || p.Samples != 2 {
+		t.Fatalf("latency = %+v, want an average of 130ms over 2 samples", p)
+	}
+
+	// A failed ping makes the peer unreachable until one succeeds
+	l.fail(pid)
+	if p, _ := l.Get(pid); !p.Unreachable || p.Latency != 130*time.Millisecond {
+		t.Errorf("after a failure: %+v", p)
+	}
+	l.Observe(pid, 130*time.Millisecond)
+	if p, _ := l.Get(pid); p.Unreachable {
+		t.Error("an answered ping left the peer unreachable")
+	}
+}
+
+// simulatedPeers routes capability to four peers, three of them pinged with
+// the latencies given and one unreachable.
+func simulatedPeers(t *testing.T, n *AgentNode, capability string, latencies ...time.Duration) (fast, mid, slow, down peer.ID) {
+	t.Helper()
+	ids := []peer.ID{randomPeer(t), randomPeer(t), randomPeer(t), randomPeer(t)}
+	// Announced slowest first, so the newest route is the unreachable one
+	for i := len(ids) - 1; i >= 0; i-- {
+		n.Routes.Add(capability, ids[i])
+		time.Sleep(2 * time.Millisecond)
+	}
+	for i, d := range latencies {
+		n.Latencies.Observe(ids[i], d)
+	}
+	n.Latencies.fail(ids[3])
+	return ids[0], ids[1], ids[2], ids[3]
+}
+
+func TestForwardingPrefersTheFastestPeer(t *testing.T) {
+	n := newTestNode(t)
+	fast, mid, slow, down := simulatedPeers(t, n, "summarize", 20*time.Millisecond, 80*time.Millisecond, 400*time.Millisecond)
+	unprobed := randomPeer(t)
+	n.Routes.Add("summarize", unprobed)
+
+	got := n.forwardCandidates(context.Background(), "task:1", "summarize")
+	want := []peer.ID{fast, mid, slow, unprobed, down}
+	if len(got) != len(want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("candidates = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSelectionWeighsLatencyAndReputation(t *testing.T) {
+	n := newTestNode(t)
+	fast, mid, slow, down := simulatedPeers(t, n, "summarize", 20*time.Millisecond, 80*time.Millisecond, 400*time.Millisecond)
+
+	reputation := map[string]float64{"1": 0.5, "2": 0.5, "3": 0.5, "4": 0.5}
+	policy := NewSelectionPolicy(func(ctx context.Context, agentId *big.Int, tag string) (float64, bool, error) {
+		return reputation[agentId.String()], true, nil
+	}, nil)
+	policy.Weights = SelectionWeights{Reputation: 1, Latency: 1}
+	policy.ExploreRate = 0
+	policy.Latencies = n.Latencies
+	candidates := []AgentRef{
+		{Recipient: Recipient{PeerID: down.String()}, AgentID: big.NewInt(4)},
+		{Recipient: Recipient{PeerID: slow.String()}, AgentID: big.NewInt(3)},
+		{Recipient: Recipient{PeerID: mid.String()}, AgentID: big.NewInt(2)},
+		{Recipient: Recipient{PeerID: fast.String()}, AgentID: big.NewInt(1)},
+	}
+	order := func() []string {
+		ranked, err := policy.RankCandidates(context.Background(), candidates, TaskContext{Capability: "summarize"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, r := range ranked {
+			ids = append(ids, r.PeerID)
+		}
+		return ids
+	}
+
+	// Equal reputation: fastest first, the unreachable peer last
+	if got, want := order(), []string{fast.String(), mid.String(), slow.String(), down.String()}; !equalStrings(got, want) {
+		t.Errorf("by latency: %v, want %v", got, want)
+	}
+
+	// Reputation outweighs a few tens of milliseconds, not an unreachable peer
+	reputation["2"], reputation["4"] = 0.9, 1
+	if got, want := order(), []string{mid.String(), fast.String(), slow.String(), down.String()}; !equalStrings(got, want) {
+		t.Errorf("by latency and reputation: %v, want %v", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProbePingsRoutedPeers(t *testing.T) {
+	a, b := startTestNode(t), startTestNode(t)
+	connect(t, a, b)
+	gone := randomPeer(t)
+	a.Routes.Add("summarize", b.CurrentHost().ID())
+	a.Routes.Add("summarize", gone)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	a.probePeers(ctx)
+	if p, ok := a.Latencies.Get(b.CurrentHost().ID()); !ok || p.Samples != 1 || p.Unreachable || p.Latency <= 0 {
+		t.Errorf("b = %+v, want one round trip", p)
+	}
+	if p, ok := a.Latencies.Get(gone); !ok || !p.Unreachable {
+		t.Errorf("a peer that can't be dialled = %+v, want unreachable", p)
+	}
+
+	snap, err := a.DumpState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Latency) != 2 {
+		t.Errorf("state dump latency = %+v", snap.Latency)
+	}
+}
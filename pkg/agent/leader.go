@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WatcherLease is the lease name contended for by clustered watchers.
+const WatcherLease = "watcher"
+
+// DefaultLeaseTTL is how long a leader holds the lease without renewing it.
+// A crashed leader is replaced at most one TTL after its last renewal.
+const DefaultLeaseTTL = 15 * time.Second
+
+// LeaderElector elects a single leader among node processes sharing a
+// MetadataStore, using a lease row that the leader renews every TTL/3.
+type LeaderElector struct {
+	store  MetadataStore
+	name   string
+	holder string
+	ttl    time.Duration
+
+	mu       sync.RWMutex
+	isLeader bool
+}
+
+// LeaderStatus is the election state reported by the status API.
+type LeaderStatus struct {
+	Enabled  bool   `json:"enabled"`
+	IsLeader bool   `json:"isLeader"`
+	Holder   string `json:"holder,omitempty"`
+	Self     string `json:"self,omitempty"`
+}
+
+func NewLeaderElector(store MetadataStore, name, holder string, ttl time.Duration) *LeaderElector {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &LeaderElector{store: store, name: name, holder: holder, ttl: ttl}
+}
+
+// IsLeader reports whether this process currently holds the lease.
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.isLeader
+}
+
+// Status returns the current election state.
+func (e *LeaderElector) Status() LeaderStatus {
+	holder, _ := e.store.LeaseHolder(e.name)
+	return LeaderStatus{Enabled: true, IsLeader: e.IsLeader(), Holder: holder, Self: e.holder}
+}
+
+// Run contends for the lease until ctx is done, calling onElected when this
+// process becomes leader and onDemoted when it loses the lease (including a
+// failed renewal). The lease is released on exit so a follower takes over
+// without waiting for expiry.
+func (e *LeaderElector) Run(ctx context.Context, onElected, onDemoted func()) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := e.store.AcquireLease(e.name, e.holder, e.ttl)
+		if err != nil {
+			fmt.Printf("[Leader] Lease %s renewal failed: %v\n", e.name, err)
+			acquired = false
+		}
+		e.transition(acquired, onElected, onDemoted)
+
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				e.store.ReleaseLease(e.name, e.holder)
+				e.transition(false, onElected, onDemoted)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *LeaderElector) transition(leader bool, onElected, onDemoted func()) {
+	e.mu.Lock()
+	changed := e.isLeader != leader
+	e.isLeader = leader
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if leader {
+		fmt.Printf("[Leader] %s acquired lease %s\n", e.holder, e.name)
+		if onElected != nil {
+			onElected()
+		}
+	} else {
+		fmt.Printf("[Leader] %s lost lease %s\n", e.holder, e.name)
+		if onDemoted != nil {
+			onDemoted()
+		}
+	}
+}
+
+// StartWatcher runs n.Watcher, and the watchers of the node's other Chains,
+// in the background. With an Elector configured, the watchers only run while
+// this node is leader; followers keep serving P2P requests but leave
+// on-chain event processing to the leader.
+func (n *AgentNode) StartWatcher() {
+	watchers := n.watchers()
+	if len(watchers) == 0 {
+		return
+	}
+	if n.Elector == nil {
+		for _, w := range watchers {
+			go w.Start(n.ctx)
+		}
+		return
+	}
+
+	// The callbacks run on the elector's goroutine, so waiting for the
+	// watchers on demotion holds off the next election until they are out:
+	// a watcher restarted while still polling would race with itself
+	var cancel context.CancelFunc
+	var running sync.WaitGroup
+	go n.Elector.Run(n.ctx, func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(n.ctx)
+		for _, w := range watchers {
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				w.Start(ctx)
+			}()
+		}
+	}, func() {
+		if cancel != nil {
+			cancel()
+			cancel = nil
+			running.Wait()
+		}
+	})
+}
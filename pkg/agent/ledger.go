@@ -0,0 +1,354 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Interaction kinds the reputation ledger scores.
+const (
+	InteractionTaskSucceeded    = "task_succeeded"    // a task it took came back with a result
+	InteractionTaskFailed       = "task_failed"       // it answered a task with an error
+	InteractionDeliveryAccepted = "delivery_accepted" // it took a message delivered to it
+	InteractionDispute          = "dispute"           // a task with it went to the jury
+	InteractionTimeout          = "timeout"           // it didn't answer in time
+	InteractionMisbehavior      = "misbehavior"       // malformed or forged traffic, scaled by severity
+)
+
+// DefaultLedgerHalfLife is how long a ledger score takes to decay halfway
+// back to neutral.
+const DefaultLedgerHalfLife = 7 * 24 * time.Hour
+
+// LedgerConfig shapes the local reputation ledger. Scores start at 0, move by
+// the weight of each interaction and decay back towards 0 over time.
+type LedgerConfig struct {
+	HalfLife  time.Duration      `json:"halfLife"`
+	Weights   map[string]float64 `json:"weights"`   // score change per interaction kind
+	Floor     float64            `json:"floor"`     // lowest score, at most 0
+	Ceiling   float64            `json:"ceiling"`   // highest score, at least 0
+	MaxImpact float64            `json:"maxImpact"` // most one interaction moves the score
+}
+
+// DefaultLedgerConfig punishes failures harder than it rewards successes,
+// but caps any single interaction at a fifth of the range above neutral.
+func DefaultLedgerConfig() LedgerConfig {
+	return LedgerConfig{
+		HalfLife: DefaultLedgerHalfLife,
+		Weights: map[string]float64{
+			InteractionTaskSucceeded:    1,
+			InteractionTaskFailed:       -2,
+			InteractionDeliveryAccepted: 0.5,
+			InteractionDispute:          -5,
+			InteractionTimeout:          -1,
+			InteractionMisbehavior:      -3,
+		},
+		Floor:     -10,
+		Ceiling:   10,
+		MaxImpact: 2,
+	}
+}
+
+// Validate reports a configuration the ledger can't score with.
+func (c LedgerConfig) Validate() error {
+	switch {
+	case c.HalfLife <= 0:
+		return fmt.Errorf("half-life must be positive")
+	case c.Floor > 0 || c.Ceiling < 0 || c.Floor == c.Ceiling:
+		return fmt.Errorf("floor %g and ceiling %g must lie either side of 0", c.Floor, c.Ceiling)
+	case c.MaxImpact <= 0:
+		return fmt.Errorf("max impact must be positive")
+	}
+	return nil
+}
+
+// ParseLedgerWeights reads weights written as "dispute=-8,timeout=-0.5" over
+// the defaults; kinds left out keep their default weight.
+func ParseLedgerWeights(s string) (map[string]float64, error) {
+	weights := DefaultLedgerConfig().Weights
+	if strings.TrimSpace(s) == "" {
+		return weights, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kind, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if _, known := weights[kind]; !ok || !known {
+			return nil, fmt.Errorf("invalid weight %q: want kind=value with kind one of %s", part, strings.Join(interactionKinds(), ", "))
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q: want a number", part)
+		}
+		weights[kind] = v
+	}
+	return weights, nil
+}
+
+func interactionKinds() []string {
+	var kinds []string
+	for kind := range DefaultLedgerConfig().Weights {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// decay returns score after elapsed time has passed.
+func (c LedgerConfig) decay(score float64, elapsed time.Duration) float64 {
+	return halfLifeDecay(score, elapsed, c.HalfLife)
+}
+
+// halfLifeDecay returns score after elapsed time has taken it towards 0,
+// halfway every halfLife.
+func halfLifeDecay(score float64, elapsed, halfLife time.Duration) float64 {
+	if elapsed <= 0 {
+		return score
+	}
+	return score * math.Pow(0.5, float64(elapsed)/float64(halfLife))
+}
+
+// normalize maps a score to 0 to 1 for ranking: the floor is 0, neutral 0.5
+// and the ceiling 1.
+func (c LedgerConfig) normalize(score float64) float64 {
+	if score >= 0 {
+		return clamp01(0.5 + 0.5*score/c.Ceiling)
+	}
+	return clamp01(0.5 - 0.5*score/c.Floor)
+}
+
+// LedgerEntry is one agent's standing in the local reputation ledger.
+type LedgerEntry struct {
+	AgentID    string  `json:"agentId"`
+	Score      float64 `json:"score"`      // decayed to when it was read; stored as of UpdatedAt
+	Normalized float64 `json:"normalized"` // Score on the 0 to 1 scale rankings use
+	Events     int     `json:"events"`     // interactions recorded
+	UpdatedAt  int64   `json:"updatedAt"`  // unix ms of the last interaction
+}
+
+// ReputationLedger keeps the node's own reputation score for every agent it
+// has dealt with, in the metadata store. It reacts to each interaction where
+// the registry only sees the feedback clients choose to post. A nil
+// *ReputationLedger records nothing.
+type ReputationLedger struct {
+	Config LedgerConfig
+
+	store MetadataStore
+	mu    sync.Mutex
+	now   func() time.Time
+}
+
+func NewReputationLedger(store MetadataStore, config LedgerConfig) *ReputationLedger {
+	return &ReputationLedger{Config: config, store: store, now: time.Now}
+}
+
+// Record scores one interaction of kind with agentId. magnitude scales the
+// kind's weight; pass 1 unless the interaction has a severity, such as a
+// misbehavior score. Whatever the weight and magnitude, the score moves by at
+// most MaxImpact, so one bad exchange can't wipe out a long good history.
+func (l *ReputationLedger) Record(agentId, kind string, magnitude float64) (LedgerEntry, error) {
+	if l == nil {
+		return LedgerEntry{}, nil
+	}
+	weight, ok := l.Config.Weights[kind]
+	if !ok {
+		return LedgerEntry{}, fmt.Errorf("unknown interaction kind %q", kind)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	e, err := l.store.GetLedgerEntry(agentId)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	if e == nil {
+		e = &LedgerEntry{AgentID: agentId}
+	} else {
+		e.Score = l.Config.decay(e.Score, now.Sub(time.UnixMilli(e.UpdatedAt)))
+	}
+	delta := math.Max(-l.Config.MaxImpact, math.Min(l.Config.MaxImpact, weight*magnitude))
+	e.Score = math.Max(l.Config.Floor, math.Min(l.Config.Ceiling, e.Score+delta))
+	e.Events++
+	e.UpdatedAt = now.UnixMilli()
+	if err := l.store.SaveLedgerEntry(*e); err != nil {
+		return LedgerEntry{}, err
+	}
+	e.Normalized = l.Config.normalize(e.Score)
+	return *e, nil
+}
+
+// Get returns agentId's entry decayed to now, or nil if the ledger has
+// none.
+func (l *ReputationLedger) Get(agentId string) (*LedgerEntry, error) {
+	if l == nil {
+		return nil, nil
+	}
+	e, err := l.store.GetLedgerEntry(agentId)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	*e = l.Config.current(*e, l.now())
+	return e, nil
+}
+
+// Export returns every entry decayed to now, best first, for offline
+// analysis.
+func (l *ReputationLedger) Export() ([]LedgerEntry, error) {
+	if l == nil {
+		return nil, nil
+	}
+	entries, err := l.store.ListLedgerEntries()
+	if err != nil {
+		return nil, err
+	}
+	now := l.now()
+	for i := range entries {
+		entries[i] = l.Config.current(entries[i], now)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].AgentID < entries[j].AgentID
+	})
+	return entries, nil
+}
+
+func (c LedgerConfig) current(e LedgerEntry, now time.Time) LedgerEntry {
+	e.Score = c.decay(e.Score, now.Sub(time.UnixMilli(e.UpdatedAt)))
+	e.Normalized = c.normalize(e.Score)
+	return e
+}
+
+// reputation returns agentId's normalised score and whether the ledger has
+// one; a score that can't be read counts as unknown.
+func (l *ReputationLedger) reputation(agentId string) (float64, bool) {
+	e, err := l.Get(agentId)
+	if err != nil || e == nil {
+		return 0, false
+	}
+	return e.Normalized, true
+}
+
+// SaveLedgerEntry inserts or replaces an agent's ledger entry.
+func (s *sqlStore) SaveLedgerEntry(e LedgerEntry) error {
+	_, err := s.exec(`
+		INSERT INTO reputation_ledger (agent_id, score, events, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(agent_id) DO UPDATE SET score = excluded.score, events = excluded.events, updated_at = excluded.updated_at`,
+		e.AgentID, e.Score, e.Events, e.UpdatedAt)
+	return err
+}
+
+// GetLedgerEntry returns an agent's stored entry, or nil if there is none.
+func (s *sqlStore) GetLedgerEntry(agentId string) (*LedgerEntry, error) {
+	var e LedgerEntry
+	err := s.queryRow("SELECT agent_id, score, events, updated_at FROM reputation_ledger WHERE agent_id = ?", agentId).
+		Scan(&e.AgentID, &e.Score, &e.Events, &e.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ListLedgerEntries returns every stored entry, as last updated.
+func (s *sqlStore) ListLedgerEntries() ([]LedgerEntry, error) {
+	rows, err := s.query("SELECT agent_id, score, events, updated_at FROM reputation_ledger ORDER BY agent_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.AgentID, &e.Score, &e.Events, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, e)
+	}
+	return results, rows.Err()
+}
+
+// misbehaviorBadRequest is the ledger severity of traffic that broke the
+// protocol: likely a broken client rather than an attack, so it counts once.
+// The PeerGuard weighs each kind of violation itself.
+const misbehaviorBadRequest = 1
+
+// agentIDs maps the peer IDs and A2A endpoints in the address book to the
+// agentId they resolved from.
+func (n *AgentNode) agentIDs() map[string]*big.Int {
+	agents := map[string]*big.Int{}
+	entries, err := n.Store.ListAddresses()
+	if err != nil {
+		return agents
+	}
+	for _, e := range entries {
+		id, ok := new(big.Int).SetString(e.AgentID, 10)
+		if !ok {
+			continue
+		}
+		if e.PeerID != "" {
+			agents[e.PeerID] = id
+		}
+		if e.Endpoint != "" {
+			agents[e.Endpoint] = id
+		}
+	}
+	return agents
+}
+
+// noteInteraction scores an interaction with the counterparty key, its peer
+// ID or endpoint, in the ledger. Counterparties the address book can't tie to
+// an agentId aren't scored.
+func (n *AgentNode) noteInteraction(key, kind string, magnitude float64) {
+	if n.Ledger == nil || key == "" {
+		return
+	}
+	id, ok := n.agentIDs()[key]
+	if !ok {
+		return
+	}
+	if _, err := n.Ledger.Record(id.String(), kind, magnitude); err != nil {
+		fmt.Printf("[Ledger] Failed to record %s for agent %s: %v\n", kind, id, err)
+	}
+}
+
+// noteOutcome scores an exchange with key that ended with err: success when
+// it answered, a failure when it answered with an error and a timeout when it
+// didn't answer in time. A counterparty that couldn't be reached isn't
+// scored; the network may be at fault.
+func (n *AgentNode) noteOutcome(key, success string, err error) {
+	var pe *PeerError
+	var ne net.Error
+	switch {
+	case err == nil:
+		n.noteInteraction(key, success, 1)
+	case errors.As(err, &pe) && pe.Code == ErrCodeTimeout:
+		n.noteInteraction(key, InteractionTimeout, 1)
+	case errors.As(err, &pe):
+		n.noteInteraction(key, InteractionTaskFailed, 1)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		n.noteInteraction(key, InteractionTimeout, 1)
+	}
+}
+
+// misbehaved scores traffic from the peer on s that broke the protocol, in
+// the ledger and as a violation against the peer.
+func (n *AgentNode) misbehaved(s network.Stream, violation string) {
+	peerID := s.Conn().RemotePeer().String()
+	n.noteInteraction(peerID, InteractionMisbehavior, misbehaviorBadRequest)
+	n.ReportMisbehavior(peerID, violation)
+}
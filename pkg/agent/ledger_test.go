@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestLedger returns a ledger on a fresh database whose clock the test
+// moves with the returned function.
+func newTestLedger(t *testing.T, config LedgerConfig) (*ReputationLedger, func(time.Duration)) {
+	t.Helper()
+	store, err := OpenMetadataStore(DriverSQLite, filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	l := NewReputationLedger(store, config)
+	now := time.UnixMilli(1700000000000)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLedgerScoresDecayWithHalfLife(t *testing.T) {
+	config := DefaultLedgerConfig()
+	config.HalfLife = 24 * time.Hour
+	l, advance := newTestLedger(t, config)
+
+	for i := 0; i < 4; i++ {
+		if _, err := l.Record("7", InteractionTaskSucceeded, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []struct {
+		after time.Duration
+		want  float64
+	}{
+		{0, 4},
+		{24 * time.Hour, 2},
+		{24 * time.Hour, 1},
+		{12 * time.Hour, 1 / math.Sqrt2},
+	}
+	for _, step := range steps {
+		advance(step.after)
+		e, err := l.Get("7")
+		if err != nil || e == nil {
+			t.Fatalf("Get: %v, %v", e, err)
+		}
+		if math.Abs(e.Score-step.want) > 1e-9 {
+			t.Fatalf("score %g, want %g", e.Score, step.want)
+		}
+		if want := 0.5 + 0.5*step.want/config.Ceiling; math.Abs(e.Normalized-want) > 1e-9 {
+			t.Errorf("normalized %g, want %g", e.Normalized, want)
+		}
+	}
+
+	// A new interaction lands on the decayed score: 1/√2 - 2
+	e, err := l.Record("7", InteractionTaskFailed, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1/math.Sqrt2 - 2; math.Abs(e.Score-want) > 1e-9 || e.Events != 5 {
+		t.Errorf("after a failure: %+v, want score %g over 5 events", e, want)
+	}
+
+	// Years later the agent is back to neutral
+	advance(3 * 365 * 24 * time.Hour)
+	if e, _ := l.Get("7"); math.Abs(e.Score) > 1e-9 || math.Abs(e.Normalized-0.5) > 1e-9 {
+		t.Errorf("long after: %+v", e)
+	}
+}
+
+func TestLedgerCapsTheImpactOfOneEvent(t *testing.T) {
+	config := DefaultLedgerConfig()
+	config.MaxImpact = 1.5
+	l, advance := newTestLedger(t, config)
+
+	// A long good history reaches the ceiling and stays there
+	for i := 0; i < 50; i++ {
+		if _, err := l.Record("1", InteractionTaskSucceeded, 1); err != nil {
+			t.Fatal(err)
+		}
+		advance(time.Minute)
+	}
+	good, _ := l.Get("1")
+	if good.Score > config.Ceiling || good.Score < config.Ceiling-0.1 {
+		t.Fatalf("good history scored %g, want just under the ceiling %g", good.Score, config.Ceiling)
+	}
+
+	// A dispute weighs -5, and a severe misbehavior far more, but neither
+	// moves the score by more than the max impact
+	for _, bad := range []struct {
+		kind      string
+		magnitude float64
+	}{{InteractionDispute, 1}, {InteractionMisbehavior, 100}} {
+		before, _ := l.Get("1")
+		after, err := l.Record("1", bad.kind, bad.magnitude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drop := before.Score - after.Score; math.Abs(drop-config.MaxImpact) > 1e-9 {
+			t.Errorf("%s dropped the score by %g, want %g", bad.kind, drop, config.MaxImpact)
+		}
+	}
+
+	// Nor can a newcomer be pushed below the floor
+	for i := 0; i < 20; i++ {
+		l.Record("2", InteractionMisbehavior, 10)
+	}
+	if e, _ := l.Get("2"); e.Score != config.Floor || e.Normalized != 0 {
+		t.Errorf("bad agent scored %+v, want the floor %g", e, config.Floor)
+	}
+
+	entries, err := l.Export()
+	if err != nil || len(entries) != 2 || entries[0].AgentID != "1" || entries[1].AgentID != "2" {
+		t.Errorf("Export = %+v, %v", entries, err)
+	}
+	if _, err := l.Record("1", "gossip", 1); err == nil {
+		t.Error("an unknown interaction kind was recorded")
+	}
+}
+
+func TestSelectionAveragesLedgerWithRegistry(t *testing.T) {
+	l, _ := newTestLedger(t, DefaultLedgerConfig())
+	for i := 0; i < 4; i++ {
+		l.Record("1", InteractionTaskSucceeded, 1) // 4 of 10: 0.7 normalized
+		l.Record("2", InteractionTimeout, 1)       // -4 of -10: 0.3 normalized
+	}
+	registry := func(ctx context.Context, agentId *big.Int, tag string) (float64, bool, error) {
+		if agentId.Int64() == 1 {
+			return 0.9, true, nil
+		}
+		return 0, false, nil
+	}
+	p := NewSelectionPolicy(registry, nil)
+	p.Ledger = l
+	p.Weights = SelectionWeights{Reputation: 1}
+	p.ExploreRate = 0
+
+	ranked, err := p.RankCandidates(context.Background(), []AgentRef{
+		{Recipient: Recipient{PeerID: "unknown"}, AgentID: big.NewInt(3)},
+		{Recipient: Recipient{PeerID: "late"}, AgentID: big.NewInt(2)},
+		{Recipient: Recipient{PeerID: "good"}, AgentID: big.NewInt(1)},
+	}, TaskContext{Capability: "summarize"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		key        string
+		reputation float64
+	}{{"good", 0.8}, {"unknown", 0.5}, {"late", 0.3}}
+	for i, w := range want {
+		if ranked[i].key() != w.key || math.Abs(ranked[i].Inputs.Reputation-w.reputation) > 1e-9 {
+			t.Errorf("rank %d: %s with reputation %g, want %s with %g", i, ranked[i].key(), ranked[i].Inputs.Reputation, w.key, w.reputation)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// Task lifecycle stages, in the order a task passes them. A task the node
+// serves ends completed or failed; a chain task it decides not to take ends
+// skipped. Paid follows completed once the task's payment is released; the
+// node doesn't release payments itself ('agentmesh escrow claim' does), so
+// it is emitted by whoever does, through EmitLifecycle.
+const (
+	StageReceived   = "received"
+	StageValidated  = "validated"
+	StageDispatched = "dispatched"
+	StageCompleted  = "completed"
+	StageFailed     = "failed"
+	StageSkipped    = "skipped"
+	StagePaid       = "paid"
+)
+
+// LifecycleEvent marks a task reaching a stage.
+type LifecycleEvent struct {
+	TaskID     string `json:"taskId"`
+	Stage      string `json:"stage"`
+	Time       int64  `json:"time"` // unix ms
+	Capability string `json:"capability,omitempty"`
+	Peer       string `json:"peer,omitempty"`   // the peer a task was dispatched to or received from
+	Reason     string `json:"reason,omitempty"` // why the task failed or was skipped
+}
+
+// lifecycleSubBuffer is how many events a subscriber may fall behind before
+// events are dropped for it.
+const lifecycleSubBuffer = 64
+
+// lifecycleBus fans lifecycle events out to subscribers.
+type lifecycleBus struct {
+	mu   sync.Mutex
+	subs map[chan LifecycleEvent]struct{}
+}
+
+// Lifecycle returns a channel receiving the lifecycle event of every task
+// stage from now on, and a func that ends the subscription. A reader that
+// falls more than lifecycleSubBuffer events behind misses events; every
+// event is also in the node's EventLog, as kind "lifecycle".
+func (n *AgentNode) Lifecycle() (<-chan LifecycleEvent, func()) {
+	b := &n.lifecycle
+	ch := make(chan LifecycleEvent, lifecycleSubBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = map[chan LifecycleEvent]struct{}{}
+	}
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, ch)
+	}
+}
+
+// EmitLifecycle records a task reaching a stage: it is sent to Lifecycle
+// subscribers, added to the EventLog and counted in the node's metrics.
+func (n *AgentNode) EmitLifecycle(e LifecycleEvent) {
+	if e.Time == 0 {
+		e.Time = time.Now().UnixMilli()
+	}
+	b := &n.lifecycle
+	b.mu.Lock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	b.mu.Unlock()
+
+	n.Events.Add("lifecycle", e)
+	n.Metrics.observeStage(e.Stage)
+}
+
+// peerTaskID names a task received from a peer in lifecycle events, by its
+// correlation ID. Tasks from peers predating correlation IDs get a fresh one.
+func peerTaskID(msg AgentMessage) string {
+	if msg.ID == "" {
+		return "peer:" + newMessageID()
+	}
+	return "peer:" + msg.ID
+}
+
+// taskStage emits a stage of a task the node serves; err, when set, is the
+// reason it failed.
+func (n *AgentNode) taskStage(taskID, stage, capability string, err error) {
+	e := LifecycleEvent{TaskID: taskID, Stage: stage, Capability: capability}
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	n.EmitLifecycle(e)
+}
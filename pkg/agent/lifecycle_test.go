@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stagesOf reads lifecycle events until one ends taskID, returning the
+// task's stages.
+func stagesOf(t *testing.T, events <-chan LifecycleEvent, taskID string) []string {
+	t.Helper()
+	var stages []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.TaskID != taskID {
+				continue
+			}
+			stages = append(stages, e.Stage)
+			if e.Stage == StageCompleted || e.Stage == StageFailed {
+				return stages
+			}
+		case <-timeout:
+			t.Fatalf("task %s didn't finish, stages %v", taskID, stages)
+		}
+	}
+}
+
+func TestLifecycleOfPeerTasks(t *testing.T) {
+	a, b := startTestNode(t), startTestNode(t)
+	if err := b.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	b.Metrics = NewMetrics()
+	a.CurrentHost().Peerstore().AddAddrs(b.CurrentHost().ID(), b.CurrentHost().Addrs(), time.Hour)
+	to := Recipient{PeerID: b.CurrentHost().ID().String()}
+	events, stop := b.Lifecycle()
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, receipt, err := a.Delegate(ctx, to, map[string]interface{}{"capability": "summarize", "text": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(stagesOf(t, events, "peer:"+receipt.ID), ","); got != "received,validated,dispatched,completed" {
+		t.Errorf("served task went through %s, want received to completed", got)
+	}
+
+	// A payload the schema rejects fails before it is dispatched
+	_, receipt, _ = a.Delegate(ctx, to, map[string]interface{}{"capability": "summarize"})
+	if got := strings.Join(stagesOf(t, events, "peer:"+receipt.ID), ","); got != "received,failed" {
+		t.Errorf("invalid task went through %s, want received,failed", got)
+	}
+
+	families, _ := b.Metrics.registry.Gather()
+	for _, f := range families {
+		if f.GetName() != "agentmesh_task_stages_total" {
+			continue
+		}
+		for _, m := range f.Metric {
+			if m.GetLabel()[0].GetValue() == StageReceived && m.GetCounter().GetValue() != 2 {
+				t.Errorf("received counted %v times, want 2", m.GetCounter().GetValue())
+			}
+		}
+		return
+	}
+	t.Error("no agentmesh_task_stages_total metric")
+}
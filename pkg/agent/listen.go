@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// DefaultListenAddrs are listened on when no address is given: TCP and QUIC
+// on every interface, on ports the OS picks.
+var DefaultListenAddrs = []string{"/ip4/0.0.0.0/tcp/0", "/ip4/0.0.0.0/udp/0/quic-v1"}
+
+// Transports a node listens and dials on, as AgentNode.Transports names them.
+const (
+	TransportTCP       = "tcp"
+	TransportQUIC      = "quic"
+	TransportWebSocket = "ws"
+)
+
+// transportOptions configures the host with the transports the node supports.
+var transportOptions = libp2p.ChainOptions(
+	libp2p.Transport(tcp.NewTCPTransport),
+	libp2p.Transport(libp2pquic.NewTransport),
+	libp2p.Transport(websocket.New),
+)
+
+// transportOf names the transport a listen address uses, or returns why the
+// node can't listen on it.
+func transportOf(a multiaddr.Multiaddr) (string, error) {
+	var names []string
+	for _, p := range a.Protocols() {
+		names = append(names, p.Name)
+	}
+	if len(names) < 2 {
+		return "", fmt.Errorf("want an IP or DNS address followed by a transport, e.g. /ip4/0.0.0.0/tcp/4001")
+	}
+	switch last := names[len(names)-1]; {
+	case last == "tcp":
+		return TransportTCP, nil
+	case last == "quic-v1" && names[len(names)-2] == "udp":
+		return TransportQUIC, nil
+	case last == "quic":
+		return "", fmt.Errorf("QUIC draft-29 is no longer supported; use /quic-v1")
+	case last == "ws" && names[len(names)-2] == "tcp":
+		return TransportWebSocket, nil
+	case last == "wss" || last == "tls":
+		return "", fmt.Errorf("secure WebSocket needs a TLS certificate; listen on /ws behind a TLS-terminating proxy")
+	case last == "udp":
+		return "", fmt.Errorf("UDP alone isn't a transport; add /quic-v1")
+	}
+	return "", fmt.Errorf("no transport for %s; the node supports tcp, udp/.../quic-v1 and tcp/.../ws", names[len(names)-1])
+}
+
+// ParseListenAddrs checks that each address is a multiaddr on a transport
+// the node supports. No addresses means DefaultListenAddrs.
+func ParseListenAddrs(addrs []string) ([]multiaddr.Multiaddr, error) {
+	if len(addrs) == 0 {
+		addrs = DefaultListenAddrs
+	}
+	out := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		a, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", s, err)
+		}
+		if _, err := transportOf(a); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", s, err)
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// ephemeralAddrs returns addrs with their ports set to 0, so the OS picks
+// free ones.
+func ephemeralAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	out := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		var parts []multiaddr.Component
+		for _, c := range a {
+			if code := c.Protocol().Code; code == multiaddr.P_TCP || code == multiaddr.P_UDP {
+				zero, _ := multiaddr.NewComponent(c.Protocol().Name, "0")
+				c = *zero
+			}
+			parts = append(parts, c)
+		}
+		out = append(out, multiaddr.Multiaddr(parts))
+	}
+	return out
+}
+
+// Transports lists the transports the node is listening on, sorted.
+func (n *AgentNode) Transports() []string {
+	h := n.CurrentHost()
+	if h == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, a := range h.Network().ListenAddresses() {
+		if t, err := transportOf(a); err == nil && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
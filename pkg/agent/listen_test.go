@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddrs(t *testing.T) {
+	addrs, err := ParseListenAddrs(nil)
+	if err != nil || len(addrs) != len(DefaultListenAddrs) {
+		t.Fatalf("defaults: %v, %v", addrs, err)
+	}
+
+	bad := map[string]string{
+		"0.0.0.0:4001":                 "invalid listen address",
+		"/ip4/0.0.0.0":                 "followed by a transport",
+		"/ip4/0.0.0.0/udp/4001":        "add /quic-v1",
+		"/ip4/0.0.0.0/udp/4001/quic":   "use /quic-v1",
+		"/ip4/0.0.0.0/tcp/4001/wss":    "TLS",
+		"/ip4/0.0.0.0/tcp/4001/http":   "no transport for http",
+		"/ip4/0.0.0.0/tcp/notaport/ws": "invalid listen address",
+		"/ip4/999.0.0.1/udp/1/quic-v1": "invalid listen address",
+	}
+	for addr, want := range bad {
+		_, err := ParseListenAddrs([]string{"/ip4/0.0.0.0/tcp/0", addr})
+		if err == nil || !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), addr) {
+			t.Errorf("ParseListenAddrs(%q) = %v, want an error naming it and %q", addr, err, want)
+		}
+	}
+}
+
+func TestEphemeralAddrs(t *testing.T) {
+	addrs, _ := ParseListenAddrs([]string{"/ip4/0.0.0.0/tcp/4001/ws", "/ip6/::/udp/4001/quic-v1"})
+	got := ephemeralAddrs(addrs)
+	if got[0].String() != "/ip4/0.0.0.0/tcp/0/ws" || got[1].String() != "/ip6/::/udp/0/quic-v1" {
+		t.Errorf("ephemeralAddrs = %v", got)
+	}
+}
+
+func TestListenOnSeveralTransports(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.Start("/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1", "/ip4/127.0.0.1/tcp/0/ws"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(n.Transports(), ","); got != "quic,tcp,ws" {
+		t.Errorf("Transports() = %s, want quic,tcp,ws", got)
+	}
+	if got := n.Status().Transports; len(got) != 3 {
+		t.Errorf("status transports %v", got)
+	}
+
+	// A peer that only knows the QUIC address reaches the node
+	client := startTestNode(t)
+	var quicAddr string
+	for _, a := range n.CurrentHost().Addrs() {
+		if tr, _ := transportOf(a); tr == TransportQUIC {
+			quicAddr = fmt.Sprintf("%s/p2p/%s", a, n.CurrentHost().ID())
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := client.SendTask(ctx, quicAddr, "hello"); err != nil {
+		t.Errorf("task over QUIC to %s: %v", quicAddr, err)
+	}
+	if conns := client.CurrentHost().Network().ConnsToPeer(n.CurrentHost().ID()); len(conns) == 0 || !strings.Contains(conns[0].RemoteMultiaddr().String(), "quic-v1") {
+		t.Errorf("connections %v, want one over QUIC", conns)
+	}
+}
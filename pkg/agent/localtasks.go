@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TaskKindLocal marks tasks submitted to the node's own API.
+const TaskKindLocal = "local"
+
+// DefaultResultsDir is where local task results are written unless
+// configured otherwise.
+const DefaultResultsDir = "results"
+
+// DefaultLocalQueueSize is how many submitted tasks may wait for the worker
+// before submissions are refused.
+const DefaultLocalQueueSize = 64
+
+// ErrUnknownCapability is returned for a task naming a capability the node
+// doesn't serve.
+var ErrUnknownCapability = errors.New("unknown capability")
+
+// ErrQueueFull is returned when the local task queue can't take another task.
+var ErrQueueFull = errors.New("local task queue is full")
+
+// TaskSpec is a task submitted to the node's own API: a manifest capability
+// and the payload for it, and optionally when it is due and what it pays,
+// which the node's TaskScheduler orders queued tasks by.
+type TaskSpec struct {
+	Capability string                 `json:"capability"`
+	Payload    map[string]interface{} `json:"payload"`
+	Deadline   int64                  `json:"deadline,omitempty"` // unix seconds, e.g. of the on-chain task it serves
+	Reward     string                 `json:"reward,omitempty"`   // wei
+	// EscrowTask is the record ID of the escrow task this serves, e.g.
+	// task:42; its run is credited with the task's payment once it settles
+	EscrowTask string `json:"escrowTask,omitempty"`
+}
+
+// LocalTaskStatus is a task as served by GET /v1/tasks/{id}. For a local task,
+// Result is the file the handler's response, or its error, is written to once
+// the task finishes.
+type LocalTaskStatus struct {
+	TaskRecord
+	Result string `json:"result,omitempty"`
+}
+
+// localTask is a queued submission.
+type localTask struct {
+	record   TaskRecord
+	binding  capabilityBinding
+	payload  map[string]interface{}
+	deadline time.Time     // zero for none
+	reward   *big.Int      // nil for none
+	estimate time.Duration // of the run, from the capability's history; 0 if unknown
+	queued   time.Time
+	serves   string // the escrow task it runs for, if any
+}
+
+// SubmitTask validates spec against its capability's schema, records it and
+// queues it for the node's worker. It returns the record, whose ID the task
+// is tracked by.
+func (n *AgentNode) SubmitTask(spec TaskSpec) (TaskRecord, error) {
+	b, ok := n.binding(spec.Capability)
+	if !ok {
+		return TaskRecord{}, fmt.Errorf("%w %q", ErrUnknownCapability, spec.Capability)
+	}
+	if spec.Payload == nil {
+		spec.Payload = map[string]interface{}{}
+	}
+	if b.schema != nil {
+		if err := b.schema.validate(spec.Payload, "payload"); err != nil {
+			return TaskRecord{}, err
+		}
+	}
+
+	task := localTask{binding: b, payload: spec.Payload, serves: spec.EscrowTask}
+	if spec.Reward != "" {
+		reward, ok := new(big.Int).SetString(spec.Reward, 10)
+		if !ok || reward.Sign() < 0 {
+			return TaskRecord{}, fmt.Errorf("reward %q is not an amount of wei", spec.Reward)
+		}
+		task.reward = reward
+	}
+	if spec.Deadline < 0 {
+		return TaskRecord{}, fmt.Errorf("deadline %d is not a unix time", spec.Deadline)
+	}
+	if spec.Deadline > 0 {
+		task.deadline = time.Unix(spec.Deadline, 0)
+	}
+	if d, ok, err := n.estimateRun(b.def.Name); err != nil {
+		fmt.Printf("[API] No run time estimate for %s: %v\n", b.def.Name, err)
+	} else if ok {
+		task.estimate = d
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := time.Now().Unix()
+	task.record = TaskRecord{
+		ID:        fmt.Sprintf("%s:%s", TaskKindLocal, hex.EncodeToString(id)),
+		Kind:      TaskKindLocal,
+		Client:    TaskKindLocal,
+		Topic:     spec.Capability,
+		Amount:    "0",
+		Status:    TaskStatusReceived,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Deadline:  spec.Deadline,
+	}
+	if task.reward != nil {
+		task.record.Amount = task.reward.String()
+	}
+	record := task.record
+
+	queue := n.localQueue()
+	select {
+	case <-n.ctx.Done():
+		return TaskRecord{}, fmt.Errorf("node stopped")
+	default:
+	}
+	if err := n.Store.SaveTask(record); err != nil {
+		return TaskRecord{}, err
+	}
+	n.taskStage(record.ID, StageReceived, spec.Capability, nil)
+	n.taskStage(record.ID, StageValidated, spec.Capability, nil)
+	if err := queue.push(task); err != nil {
+		n.Store.UpdateTaskStatus(record.ID, TaskStatusFailed)
+		n.taskStage(record.ID, StageFailed, spec.Capability, err)
+		return TaskRecord{}, err
+	}
+	n.Events.Add("local_task_submitted", record)
+	return record, nil
+}
+
+// localQueue returns the queue of submitted tasks, starting its worker on
+// first use.
+func (n *AgentNode) localQueue() *TaskScheduler {
+	n.localOnce.Do(func() {
+		if n.Scheduler == nil {
+			n.Scheduler = NewTaskScheduler(DefaultLocalQueueSize)
+		}
+		n.localWG.Add(1)
+		go n.runLocalTasks()
+	})
+	return n.Scheduler
+}
+
+// runLocalTasks serves queued tasks one at a time, highest priority first,
+// until the node stops.
+func (n *AgentNode) runLocalTasks() {
+	defer n.localWG.Done()
+	for {
+		task, ok := n.Scheduler.pop(n.ctx)
+		if !ok {
+			return
+		}
+		n.runLocalTask(task)
+	}
+}
+
+func (n *AgentNode) runLocalTask(task localTask) {
+	var sender string
+	if h := n.CurrentHost(); h != nil {
+		sender = h.ID().String()
+	}
+	var result interface{}
+	var err error
+	if !task.deadline.IsZero() && !n.Scheduler.now().Before(task.deadline) {
+		err = fmt.Errorf("%w: it was due at %s", ErrDeadlinePassed, task.deadline.Format(time.RFC3339))
+	} else {
+		ctx, cancel := context.WithTimeout(n.ctx, capabilityTimeout)
+		defer cancel()
+		n.taskStage(task.record.ID, StageDispatched, task.binding.def.Name, nil)
+		started := time.Now()
+		taskID := task.record.ID
+		if task.serves != "" {
+			taskID = task.serves
+		}
+		result, err = n.runHandler(ctx, taskID, task.binding, TaskRequest{Capability: task.binding.def.Name, Payload: task.payload, Sender: sender, Node: n})
+		// Failed runs may end early, and would make the capability look fast
+		if err == nil {
+			if rerr := n.writes().RecordTaskRun(task.binding.def.Name, time.Since(started)); rerr != nil {
+				fmt.Printf("[API] Failed to record the run of %s: %v\n", task.record.ID, rerr)
+			}
+		}
+	}
+
+	status := TaskStatusResolved
+	if err != nil {
+		status = TaskStatusFailed
+		result = map[string]string{"error": err.Error()}
+	}
+	if werr := n.writeResult(task.record.ID, result); werr != nil && err == nil {
+		status, err = TaskStatusFailed, werr
+	}
+	if uerr := n.writes().UpdateTaskStatus(task.record.ID, status); uerr != nil {
+		fmt.Printf("[API] Failed to record %s as %s: %v\n", task.record.ID, status, uerr)
+	}
+	// Whoever hears the task is done may read its status back
+	if n.Writes != nil {
+		if ferr := n.Writes.Flush(); ferr != nil {
+			fmt.Printf("[API] Failed to record %s as %s: %v\n", task.record.ID, status, ferr)
+		}
+	}
+
+	data := map[string]string{"taskId": task.record.ID, "capability": task.binding.def.Name, "result": n.resultPath(task.record.ID)}
+	if err != nil {
+		n.taskStage(task.record.ID, StageFailed, task.binding.def.Name, err)
+		n.Events.AddError("local_task_failed", err, data)
+		return
+	}
+	n.taskStage(task.record.ID, StageCompleted, task.binding.def.Name, nil)
+	n.Events.Add("local_task_resolved", data)
+}
+
+// writes is where the task runner writes: the node's WriteBatcher if it has
+// one, or its store.
+// estimateRun is how long a run of capability is expected to take: the
+// average of its latest runs in the analytics, else of the runs recorded
+// with RecordTaskRun.
+func (n *AgentNode) estimateRun(capability string) (time.Duration, bool, error) {
+	if n.Analytics != nil {
+		if d, ok, err := n.Analytics.Estimate(capability); err != nil || ok {
+			return d, ok, err
+		}
+	}
+	return n.Store.EstimateTaskRun(capability)
+}
+
+func (n *AgentNode) writes() MetadataStore {
+	if n.Writes != nil {
+		return n.Writes
+	}
+	return n.Store
+}
+
+// resultPath is the file a local task's result is written to.
+func (n *AgentNode) resultPath(id string) string {
+	dir := n.ResultsDir
+	if dir == "" {
+		dir = DefaultResultsDir
+	}
+	// Task IDs contain a colon, which Windows doesn't allow in file names
+	return filepath.Join(dir, strings.Replace(id, ":", "-", 1)+".json")
+}
+
+// writeResult writes a task's result as indented JSON or, for a
+// StreamResult, as it is read.
+func (n *AgentNode) writeResult(id string, result interface{}) error {
+	path := n.resultPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if stream, ok := result.(*StreamResult); ok {
+		defer stream.Close()
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, stream.Body); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	raw, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("result is not JSON: %w", err)
+	}
+	return os.WriteFile(path, raw, 0644)
+}
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"golang.org/x/time/rate"
+)
+
+// DefaultScanWorkers is how many eth_getLogs calls a LogScanner has in flight
+// at once. Months of blocks take minutes to walk one window at a time, while
+// public endpoints start refusing well above a handful of concurrent calls.
+const DefaultScanWorkers = 4
+
+// LogFetcher returns the logs of blocks from..to, in block order.
+type LogFetcher func(ctx context.Context, from, to uint64) ([]types.Log, error)
+
+// LogScanner fetches the logs of a block range as windows queried
+// concurrently, and hands them back in block order. Clients and watchers
+// that share an RPC endpoint can share one scanner, so its rate limit covers
+// all their scans. A nil *LogScanner scans with DefaultScanWorkers and no
+// rate limit.
+type LogScanner struct {
+	workers int
+	limiter *rate.Limiter // nil for no limit
+}
+
+// NewLogScanner returns a scanner with up to workers eth_getLogs calls in
+// flight, starting at most perSecond of them each second. Non-positive
+// workers means DefaultScanWorkers, and a non-positive perSecond no limit.
+func NewLogScanner(workers int, perSecond float64) *LogScanner {
+	if workers <= 0 {
+		workers = DefaultScanWorkers
+	}
+	s := &LogScanner{workers: workers}
+	if perSecond > 0 {
+		s.limiter = rate.NewLimiter(rate.Limit(perSecond), 1)
+	}
+	return s
+}
+
+// Scan fetches the logs of blocks from..to in windows of up to window blocks
+// (DefaultLogRange if 0), and calls emit for each window in block order from
+// the calling goroutine. A window the RPC refuses as too large is split in
+// half until it is accepted, and later windows start at the size that
+// worked, growing back toward window as calls succeed.
+//
+// Scan stops at the first window that can't be fetched, once every window
+// before it has been emitted, and returns that window's error; an error from
+// emit stops it too. Windows after the failure are not emitted, so a caller
+// that records progress in emit can resume after the last one.
+func (s *LogScanner) Scan(ctx context.Context, from, to, window uint64, fetch LogFetcher, emit func(from, to uint64, logs []types.Log) error) error {
+	if from > to {
+		return nil
+	}
+	if window == 0 {
+		window = DefaultLogRange
+	}
+	workers := DefaultScanWorkers
+	if s != nil {
+		workers = s.workers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	windows := &scanWindows{next: from, end: to, size: window, max: window}
+	type result struct {
+		from, to uint64
+		logs     []types.Log
+		err      error
+	}
+	results := make(chan result)
+	// Each window fetched but not yet emitted holds a slot, so a slow window
+	// holds back at most this many behind it
+	slots := make(chan struct{}, 2*workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				wFrom, wTo, ok := windows.take()
+				if !ok {
+					<-slots
+					return
+				}
+				logs, err := s.fetch(ctx, windows, wFrom, wTo, fetch)
+				if err != nil {
+					windows.stopBefore(wFrom)
+				}
+				select {
+				case results <- result{wFrom, wTo, logs, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := map[uint64]result{}
+	next := from
+	for r := range results {
+		done[r.from] = r
+		for r, ok := done[next]; ok; r, ok = done[next] {
+			delete(done, next)
+			if r.err != nil {
+				return r.err
+			}
+			if err := emit(r.from, r.to, r.logs); err != nil {
+				return err
+			}
+			<-slots
+			next = r.to + 1
+		}
+	}
+	if next <= to {
+		// Only cancellation stops the workers early
+		return ctx.Err()
+	}
+	return nil
+}
+
+// fetch returns the logs of blocks from..to, halving the range while the RPC
+// says it holds too many.
+func (s *LogScanner) fetch(ctx context.Context, windows *scanWindows, from, to uint64, fetch LogFetcher) ([]types.Log, error) {
+	if s != nil && s.limiter != nil {
+		if err := s.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	logs, err := fetch(ctx, from, to)
+	if err == nil {
+		windows.grow()
+		return logs, nil
+	}
+	if from == to || !tooManyLogs(err) {
+		return nil, err
+	}
+	mid := from + (to-from)/2
+	windows.shrink(mid - from + 1)
+	first, err := s.fetch(ctx, windows, from, mid, fetch)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := s.fetch(ctx, windows, mid+1, to, fetch)
+	if err != nil {
+		return nil, err
+	}
+	return append(first, rest...), nil
+}
+
+// scanWindows hands out the windows of a scan in block order.
+type scanWindows struct {
+	mu   sync.Mutex
+	next uint64 // first block not yet handed out
+	end  uint64 // last block to hand out
+	size uint64 // blocks in the next window
+	max  uint64 // most blocks in a window
+}
+
+func (w *scanWindows) take() (from, to uint64, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.next > w.end {
+		return 0, 0, false
+	}
+	from, to = w.next, min(w.next+w.size-1, w.end)
+	w.next = to + 1
+	return from, to, true
+}
+
+// stopBefore hands out no windows from block on.
+func (w *scanWindows) stopBefore(block uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if block > 0 && block-1 < w.end {
+		w.end = block - 1
+	}
+}
+
+func (w *scanWindows) shrink(size uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size = min(w.size, size)
+}
+
+func (w *scanWindows) grow() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size = min(2*w.size, w.max)
+}
+
+// tooManyLogsErrors are how RPC providers refuse an eth_getLogs range that
+// a narrower one would satisfy.
+var tooManyLogsErrors = []string{
+	"query returned more than", // geth, Infura
+	"log response size exceeded",
+	"too many results",
+	"block range",
+	"range too large",
+}
+
+// tooManyLogs reports whether err is the RPC refusing a range as too large.
+func tooManyLogs(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range tooManyLogsErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// blockLogs returns a fetcher with one log per block, answering after up to
+// latency.
+func blockLogs(latency time.Duration) LogFetcher {
+	return func(ctx context.Context, from, to uint64) ([]types.Log, error) {
+		if latency > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(latency))))
+		}
+		var logs []types.Log
+		for b := from; b <= to; b++ {
+			logs = append(logs, types.Log{BlockNumber: b})
+		}
+		return logs, nil
+	}
+}
+
+func TestLogScannerMergesInBlockOrder(t *testing.T) {
+	var got []uint64
+	next := uint64(1)
+	err := NewLogScanner(8, 0).Scan(context.Background(), 1, 1000, 37, blockLogs(2*time.Millisecond), func(from, to uint64, logs []types.Log) error {
+		if from != next {
+			t.Fatalf("emitted %d-%d after blocks up to %d", from, to, next-1)
+		}
+		next = to + 1
+		for _, l := range logs {
+			got = append(got, l.BlockNumber)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1000 {
+		t.Fatalf("got %d logs, want 1000", len(got))
+	}
+	for i, b := range got {
+		if b != uint64(i+1) {
+			t.Fatalf("log %d is from block %d, want %d", i, b, i+1)
+		}
+	}
+}
+
+func TestLogScannerShrinksAndGrowsWindows(t *testing.T) {
+	// Blocks 1000-1999 hold too many logs for more than 100 of them at once
+	var mu sync.Mutex
+	var ranges [][2]uint64
+	fetch := func(ctx context.Context, from, to uint64) ([]types.Log, error) {
+		mu.Lock()
+		ranges = append(ranges, [2]uint64{from, to})
+		mu.Unlock()
+		if from <= 1999 && to >= 1000 && to-from >= 100 {
+			return nil, errors.New("query returned more than 10000 results")
+		}
+		return blockLogs(0)(ctx, from, to)
+	}
+	var emitted int
+	err := NewLogScanner(1, 0).Scan(context.Background(), 0, 9999, 1000, fetch, func(from, to uint64, logs []types.Log) error {
+		emitted += len(logs)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emitted != 10000 {
+		t.Errorf("emitted %d logs, want 10000", emitted)
+	}
+	grown := false
+	for _, r := range ranges {
+		grown = grown || r[0] >= 2000 && r[1]-r[0]+1 == 1000
+	}
+	if !grown || len(ranges) > 50 {
+		t.Errorf("made %d calls %v, want windows of 1000 blocks again after block 2000", len(ranges), ranges)
+	}
+}
+
+func TestLogScannerStopsAtTheFailedWindow(t *testing.T) {
+	fetch := func(ctx context.Context, from, to uint64) ([]types.Log, error) {
+		if from <= 500 && to >= 500 {
+			return nil, errors.New("upstream unavailable")
+		}
+		return blockLogs(time.Millisecond)(ctx, from, to)
+	}
+	var scanned uint64
+	err := NewLogScanner(4, 0).Scan(context.Background(), 1, 2000, 100, fetch, func(from, to uint64, logs []types.Log) error {
+		scanned = to
+		return nil
+	})
+	if err == nil || scanned != 400 {
+		t.Errorf("scanned to %d with err %v, want 400 and the window's error", scanned, err)
+	}
+}
+
+func TestLogScannerRateLimit(t *testing.T) {
+	start := time.Now()
+	err := NewLogScanner(4, 50).Scan(context.Background(), 1, 10, 1, blockLogs(0), func(uint64, uint64, []types.Log) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first call goes at once, the other nine 20ms apart
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("10 calls at 50/s took %s", elapsed)
+	}
+}
+
+// BenchmarkLogScanner scans 100 windows from a backend that takes 5ms per
+// call, one window at a time and with the default workers.
+func BenchmarkLogScanner(b *testing.B) {
+	fetch := func(ctx context.Context, from, to uint64) ([]types.Log, error) {
+		time.Sleep(5 * time.Millisecond)
+		return []types.Log{{BlockNumber: from}}, nil
+	}
+	for _, workers := range []int{1, DefaultScanWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			s := NewLogScanner(workers, 0)
+			for i := 0; i < b.N; i++ {
+				s.Scan(context.Background(), 0, 100*DefaultLogRange-1, DefaultLogRange, fetch, func(uint64, uint64, []types.Log) error { return nil })
+			}
+		})
+	}
+}
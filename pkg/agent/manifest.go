@@ -0,0 +1,463 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestVersion is the capability manifest format version this node reads
+// and writes.
+const ManifestVersion = 1
+
+// CapabilityPricing is a pricing hint for a capability; nodes are free to
+// bid differently.
+type CapabilityPricing struct {
+	Amount string `yaml:"amount" json:"amount"`                 // wei
+	Unit   string `yaml:"unit,omitempty" json:"unit,omitempty"` // e.g. "task", "1k tokens"
+}
+
+// CapabilityDef is one capability declared in a manifest.
+type CapabilityDef struct {
+	Name        string                 `yaml:"name" json:"name"`
+	ID          string                 `yaml:"id,omitempty" json:"id,omitempty"` // namespaced identifier, e.g. skill/text-summarization@1
+	Description string                 `yaml:"description,omitempty" json:"description,omitempty"`
+	Handler     string                 `yaml:"handler" json:"handler"` // a RegisterHandler name
+	Schema      map[string]interface{} `yaml:"schema,omitempty" json:"schema,omitempty"`
+	Pricing     *CapabilityPricing     `yaml:"pricing,omitempty" json:"pricing,omitempty"`
+	Version     string                 `yaml:"version,omitempty" json:"version,omitempty"` // bump when answers change; drops cached ones
+	NoCache     bool                   `yaml:"noCache,omitempty" json:"noCache,omitempty"` // never serve answers from the AnswerCache
+	SLO         *CapabilitySLO         `yaml:"slo,omitempty" json:"slo,omitempty"`         // what its runs should meet; see CapabilityAnalytics
+}
+
+// Capability is what the node gossips for the definition.
+func (d CapabilityDef) Capability() AgentCapability {
+	return AgentCapability{Name: d.Name, ID: d.ID, Description: d.Description, Schema: d.Schema, Pricing: d.Pricing}
+}
+
+// CapabilityManifest is a shareable file of capability definitions:
+//
+//	version: 1
+//	capabilities:
+//	  - name: summarize
+//	    id: skill/text-summarization@1
+//	    description: Summarize a document
+//	    handler: echo
+//	    schema:
+//	      type: object
+//	      required: [text]
+//	      properties:
+//	        text: {type: string}
+//	    pricing: {amount: "1000000000000000", unit: task}
+//	    version: "2"
+//	    noCache: false
+//	    slo: {p95: 2s, successRate: 0.99, window: 1h}
+type CapabilityManifest struct {
+	Version      int             `yaml:"version"`
+	Capabilities []CapabilityDef `yaml:"capabilities"`
+}
+
+// ManifestError locates a problem in a manifest file.
+type ManifestError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ManifestError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// capabilityBinding is a loaded capability with its compiled schema and handler.
+type capabilityBinding struct {
+	def     CapabilityDef
+	schema  *taskSchema
+	handler TaskHandler
+}
+
+// LoadCapabilityManifest reads a manifest and checks that each capability
+// names a registered handler and that its schema compiles.
+func LoadCapabilityManifest(path string) ([]CapabilityDef, error) {
+	bindings, err := loadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]CapabilityDef, len(bindings))
+	for i, b := range bindings {
+		defs[i] = b.def
+	}
+	return defs, nil
+}
+
+func loadManifest(path string) ([]capabilityBinding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(path, data)
+}
+
+// parseManifest binds the capabilities of a manifest; file names it in errors.
+func parseManifest(file string, data []byte) ([]capabilityBinding, error) {
+	fail := func(line int, format string, args ...interface{}) error {
+		return &ManifestError{File: file, Line: line, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// yaml.v3 errors read "yaml: line N: ..."
+		return nil, fail(0, "%s", strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if len(doc.Content) == 0 {
+		return nil, fail(0, "empty manifest")
+	}
+	root := doc.Content[0]
+
+	var m CapabilityManifest
+	if err := root.Decode(&m); err != nil {
+		return nil, fail(0, "%s", strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if m.Version != 0 && m.Version != ManifestVersion {
+		return nil, fail(mappingValue(root, "version").Line, "unsupported manifest version %d", m.Version)
+	}
+	caps := mappingValue(root, "capabilities")
+	if caps == nil || len(m.Capabilities) == 0 {
+		return nil, fail(root.Line, "no capabilities declared")
+	}
+
+	var bindings []capabilityBinding
+	seen := map[string]bool{}
+	for i, def := range m.Capabilities {
+		node := caps.Content[i]
+		switch {
+		case def.Name == "":
+			return nil, fail(node.Line, "capability has no name")
+		case seen[def.Name]:
+			return nil, fail(node.Line, "capability %q declared twice", def.Name)
+		case def.Handler == "":
+			return nil, fail(node.Line, "capability %q has no handler", def.Name)
+		}
+		if def.ID != "" {
+			if _, err := ParseCapabilityID(def.ID); err != nil {
+				return nil, fail(mappingValue(node, "id").Line, "capability %q: %v", def.Name, err)
+			}
+		}
+		if def.SLO != nil {
+			if err := def.SLO.validate(); err != nil {
+				return nil, fail(mappingValue(node, "slo").Line, "capability %q: slo: %v", def.Name, err)
+			}
+		}
+		seen[def.Name] = true
+
+		handler, ok := lookupHandler(def.Handler)
+		if !ok {
+			return nil, fail(mappingValue(node, "handler").Line, "capability %q: handler %q is not registered (have %s)",
+				def.Name, def.Handler, strings.Join(HandlerNames(), ", "))
+		}
+		b := capabilityBinding{def: def, handler: handler}
+		if s := mappingValue(node, "schema"); s != nil {
+			compiled, err := compileSchema(s)
+			if err != nil {
+				line := s.Line
+				if se, ok := err.(*schemaError); ok {
+					line = se.line
+				}
+				return nil, fail(line, "capability %q: schema: %v", def.Name, err)
+			}
+			b.schema = compiled
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// mappingValue returns the value node for key in a YAML mapping, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// ExportCapabilityManifest renders defs as a manifest file.
+func ExportCapabilityManifest(defs []CapabilityDef) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(CapabilityManifest{Version: ManifestVersion, Capabilities: defs}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// capabilityTimeout bounds a manifest handler serving one task.
+const capabilityTimeout = 30 * time.Second
+
+// AgentCardType identifies an ERC-8004 agent registration file.
+const AgentCardType = "https://eips.ethereum.org/EIPS/eip-8004#registration-v1"
+
+// AgentCard is the node's ERC-8004 registration file, suitable as the
+// agentURI document.
+type AgentCard struct {
+	Type         string             `json:"type"`
+	Name         string             `json:"name"`
+	Description  string             `json:"description,omitempty"`
+	Services     []AgentCardService `json:"services"`
+	Capabilities []AgentCapability  `json:"capabilities"`
+	Catalog      []CatalogListing   `json:"catalog,omitempty"` // listings for sale, without previews
+	Active       bool               `json:"active"`
+}
+
+// AgentCardService is an endpoint the agent can be reached at.
+type AgentCardService struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	Version  string `json:"version,omitempty"`
+}
+
+// NewAgentCard builds the card for a peer serving capabilities.
+func NewAgentCard(peerID string, capabilities []AgentCapability) AgentCard {
+	if capabilities == nil {
+		capabilities = []AgentCapability{}
+	}
+	return AgentCard{
+		Type:         AgentCardType,
+		Name:         peerID,
+		Description:  "agentmesh node",
+		Services:     []AgentCardService{{Name: "A2A", Endpoint: "p2p://" + peerID, Version: "1.0.0"}},
+		Capabilities: capabilities,
+		Active:       true,
+	}
+}
+
+// LoadCapabilities loads manifests and binds their capabilities to this
+// node's task handler. Call it before Start; the capabilities are advertised
+// with AdvertiseCapabilityWithEth as usual.
+func (n *AgentNode) LoadCapabilities(paths []string) error {
+	loaded := map[string]capabilityBinding{}
+	for _, path := range paths {
+		bindings, err := loadManifest(path)
+		if err != nil {
+			return err
+		}
+		for _, b := range bindings {
+			if _, dup := loaded[b.def.Name]; dup {
+				return &ManifestError{File: path, Msg: fmt.Sprintf("capability %q is already declared by another manifest", b.def.Name)}
+			}
+			loaded[b.def.Name] = b
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.bindings == nil {
+		n.bindings = map[string]capabilityBinding{}
+	}
+	for name, b := range loaded {
+		n.bindings[name] = b
+		if n.Analytics != nil {
+			n.Analytics.SetSLO(name, b.def.SLO)
+		}
+	}
+	return nil
+}
+
+// Capabilities lists the manifest capabilities the node serves, by name.
+func (n *AgentNode) Capabilities() []CapabilityDef {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	defs := make([]CapabilityDef, 0, len(n.bindings))
+	for _, b := range n.bindings {
+		defs = append(defs, b.def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// AgentCard describes the node, its manifest capabilities and its catalog.
+func (n *AgentNode) AgentCard() AgentCard {
+	defs := n.Capabilities()
+	caps := make([]AgentCapability, len(defs))
+	for i, d := range defs {
+		caps[i] = d.Capability()
+	}
+	card := NewAgentCard(n.CurrentHost().ID().String(), caps)
+	if n.Store != nil {
+		listings, err := n.Store.ListListings()
+		if err != nil {
+			fmt.Printf("[Catalog] Failed to list the catalog for the agent card: %v\n", err)
+		}
+		for _, l := range listings {
+			l = l.summary()
+			l.Seller = card.Name
+			card.Catalog = append(card.Catalog, l)
+		}
+	}
+	return card
+}
+
+// binding returns the manifest capability serving requested, by name or
+// capability identifier.
+func (n *AgentNode) binding(requested string) (capabilityBinding, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if b, ok := n.bindings[requested]; ok || !IsCapabilityID(requested) {
+		return b, ok
+	}
+	offered := make([]AgentCapability, 0, len(n.bindings))
+	for _, b := range n.bindings {
+		offered = append(offered, b.def.Capability())
+	}
+	name, ok := bestCapability(requested, offered)
+	return n.bindings[name], ok
+}
+
+// serveCapability runs a task through its capability's handler. The payload,
+// less its "capability" field, must satisfy the capability's schema. ctx
+// carries the trace the task arrived with; taskID names the task in
+// lifecycle events.
+func (n *AgentNode) serveCapability(ctx context.Context, taskID string, b capabilityBinding, msg AgentMessage) AgentMessage {
+	var fields map[string]interface{}
+	if err := UnmarshalPayload(msg, &fields); err != nil {
+		n.taskStage(taskID, StageFailed, b.def.Name, err)
+		return n.errorMessage(ErrorPayload{Code: ErrCodeBadRequest, Message: err.Error()})
+	}
+	payload := map[string]interface{}{}
+	for k, v := range fields {
+		if k != "capability" {
+			payload[k] = v
+		}
+	}
+	if b.schema != nil {
+		if err := b.schema.validate(payload, "payload"); err != nil {
+			n.taskStage(taskID, StageFailed, b.def.Name, err)
+			return n.errorMessage(ErrorPayload{Code: ErrCodeBadRequest, Message: err.Error()})
+		}
+	}
+	n.taskStage(taskID, StageValidated, b.def.Name, nil)
+
+	// The same question gets the answer already worked out, if any, unless
+	// the sender asked for a fresh one
+	req := TaskRequest{ID: msg.ID, Capability: b.def.Name, Payload: payload, Sender: msg.Sender, Node: n}
+	queryHash, hashErr := QueryHash(payload)
+	switch {
+	case hashErr != nil:
+	case msg.Fresh:
+		n.Answers.bypass(b.def)
+	default:
+		if result, ok := n.Answers.Lookup(ctx, b.def, queryHash); ok {
+			return n.answer(ctx, taskID, req, result)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, capabilityTimeout)
+	ctx, noCache := withNoCache(ctx)
+	n.taskStage(taskID, StageDispatched, b.def.Name, nil)
+	result, err := n.runHandler(ctx, taskID, b, req)
+	if err != nil {
+		cancel()
+		n.taskStage(taskID, StageFailed, b.def.Name, err)
+		n.Events.AddError("capability_failed", err, map[string]string{"capability": b.def.Name, "sender": msg.Sender})
+		return n.errorMessage(ErrorPayload{Code: ErrCodeInternal, Message: fmt.Sprintf("%s: %v", b.def.Name, err), Retryable: ctx.Err() != nil})
+	}
+
+	// A streamed result is still being produced, so the handler's context
+	// lasts until it is sent. Streams aren't cached.
+	if stream, ok := result.(*StreamResult); ok {
+		stream.onClose(cancel)
+		n.taskStage(taskID, StageCompleted, b.def.Name, nil)
+		return n.streamMessage(stream)
+	}
+	defer cancel()
+	if hashErr == nil && !noCache.Load() {
+		if err := n.Answers.Store(ctx, b.def, queryHash, result); err != nil {
+			fmt.Printf("[Cache] Failed to cache the answer of %s: %v\n", b.def.Name, err)
+		}
+	}
+	return n.answer(ctx, taskID, req, result)
+}
+
+// answer completes the task with result, signed for its requester by
+// SignAnswer if the node has one.
+func (n *AgentNode) answer(ctx context.Context, taskID string, req TaskRequest, result interface{}) AgentMessage {
+	if n.SignAnswer != nil {
+		signed, err := n.SignAnswer(ctx, req, result)
+		if err != nil {
+			n.taskStage(taskID, StageFailed, req.Capability, err)
+			return n.errorMessage(ErrorPayload{Code: ErrCodeInternal, Message: fmt.Sprintf("%s: signing the answer: %v", req.Capability, err)})
+		}
+		result = signed
+	}
+	n.taskStage(taskID, StageCompleted, req.Capability, nil)
+	return n.responseMessage(result)
+}
+
+// responseMessage carries a capability's answer back to the sender.
+func (n *AgentNode) responseMessage(result interface{}) AgentMessage {
+	return AgentMessage{
+		Type:      "response",
+		Payload:   result,
+		Sender:    n.CurrentHost().ID().String(),
+		Timestamp: time.Now().UnixMilli(),
+	}
+}
+
+// runHandler runs a capability handler inside a span, and records its outcome
+// in the node's metrics and analytics under taskID.
+func (n *AgentNode) runHandler(ctx context.Context, taskID string, b capabilityBinding, req TaskRequest) (result interface{}, err error) {
+	ctx, span := n.tracer().Start(ctx, "task.execute", trace.WithAttributes(capabilityAttr(b.def.Name)))
+	start := time.Now()
+	defer func() {
+		n.Metrics.observeTask(b.def.Name, start, err)
+		endSpan(span, err)
+		n.recordInvocation(ctx, taskID, req, start, err)
+	}()
+	if req.Dir, err = n.taskDir(taskID); err != nil {
+		return nil, fmt.Errorf("task directory: %w", err)
+	}
+	result, err = b.handler(ctx, req)
+	// A streamed result may still be reading from the directory
+	if stream, ok := result.(*StreamResult); ok && err == nil {
+		dir := req.Dir
+		stream.onClose(func() { removeTaskDir(dir) })
+	} else {
+		removeTaskDir(req.Dir)
+	}
+	return result, err
+}
+
+// recordInvocation adds a run of req's capability to the node's analytics.
+func (n *AgentNode) recordInvocation(ctx context.Context, taskID string, req TaskRequest, start time.Time, err error) {
+	if n.Analytics == nil {
+		return
+	}
+	input, _ := json.Marshal(req.Payload)
+	inv := CapabilityInvocation{
+		TaskID:       taskID,
+		Capability:   req.Capability,
+		StartedAt:    start.UnixMilli(),
+		DurationMs:   time.Since(start).Milliseconds(),
+		InputBytes:   int64(len(input)),
+		Outcome:      invocationOutcome(ctx, err),
+		Counterparty: req.Sender,
+	}
+	if rerr := n.Analytics.Record(inv); rerr != nil {
+		fmt.Printf("[Analytics] Failed to record the run of %s: %v\n", req.Capability, rerr)
+	}
+}
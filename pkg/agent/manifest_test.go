@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeManifest(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "caps.yaml")
+	if err := os.WriteFile(path, []byte(strings.TrimLeft(body, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const summarizeManifest = `
+version: 1
+capabilities:
+  - name: summarize
+    description: Summarize a document
+    handler: echo
+    schema:
+      type: object
+      required: [text]
+      additionalProperties: false
+      properties:
+        text: {type: string, minLength: 1}
+        style: {enum: [short, long]}
+    pricing: {amount: "1000", unit: task}
+`
+
+func TestLoadCapabilitiesBadSchemaFailsWithLine(t *testing.T) {
+	path := writeManifest(t, `
+version: 1
+capabilities:
+  - name: summarize
+    handler: echo
+    schema:
+      type: object
+      properties:
+        text: {type: strng}
+`)
+	n := &AgentNode{}
+	err := n.LoadCapabilities([]string{path})
+	if err == nil {
+		t.Fatal("manifest with a bad schema loaded")
+	}
+	var me *ManifestError
+	if !errors.As(err, &me) {
+		t.Fatalf("error %T is not a *ManifestError: %v", err, err)
+	}
+	if me.File != path || me.Line != 8 {
+		t.Errorf("error at %s:%d, want %s:8", me.File, me.Line, path)
+	}
+	if !strings.HasPrefix(err.Error(), path+":8: ") || !strings.Contains(err.Error(), `unknown type "strng"`) {
+		t.Errorf("error = %q", err)
+	}
+	if len(n.Capabilities()) != 0 {
+		t.Error("capabilities were bound despite the error")
+	}
+}
+
+func TestLoadCapabilityManifestErrors(t *testing.T) {
+	tests := []struct {
+		name, body string
+		line       int
+		want       string
+	}{
+		{"unregistered handler", "capabilities:\n  - name: a\n    handler: nope\n", 3, `handler "nope" is not registered`},
+		{"unknown keyword", "capabilities:\n  - name: a\n    handler: echo\n    schema:\n      type: object\n      requird: [x]\n", 6, `unsupported schema keyword "requird"`},
+		{"bad pattern", "capabilities:\n  - name: a\n    handler: echo\n    schema: {type: string, pattern: \"(\"}\n", 4, "invalid pattern"},
+		{"duplicate", "capabilities:\n  - name: a\n    handler: echo\n  - name: a\n    handler: echo\n", 4, "declared twice"},
+		{"no handler", "capabilities:\n  - name: a\n", 2, "has no handler"},
+		{"bad slo", "capabilities:\n  - name: a\n    handler: echo\n    slo: {p95: 2s, successRate: 1.5}\n", 4, "successRate 1.5 is not between 0 and 1"},
+		{"version", "version: 2\ncapabilities:\n  - name: a\n    handler: echo\n", 1, "unsupported manifest version 2"},
+		{"empty", "version: 1\n", 1, "no capabilities declared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeManifest(t, tt.body)
+			_, err := LoadCapabilityManifest(path)
+			var me *ManifestError
+			if !errors.As(err, &me) {
+				t.Fatalf("err = %v, want a *ManifestError", err)
+			}
+			if me.Line != tt.line || !strings.Contains(me.Msg, tt.want) {
+				t.Errorf("got line %d %q, want line %d containing %q", me.Line, me.Msg, tt.line, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapabilitySchemaValidation(t *testing.T) {
+	bindings, err := loadManifest(writeManifest(t, summarizeManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := bindings[0].schema
+
+	valid := []map[string]interface{}{
+		{"text": "hello"},
+		{"text": "hello", "style": "short"},
+	}
+	for _, p := range valid {
+		if err := schema.validate(p, "payload"); err != nil {
+			t.Errorf("validate(%v) = %v", p, err)
+		}
+	}
+	invalid := map[string]map[string]interface{}{
+		"payload: missing required property \"text\"": {},
+		"payload.text: expected string, got integer":  {"text": float64(3)},
+		"payload.text: shorter than 1 characters":     {"text": ""},
+		"payload.style: \"medium\" is not one of":     {"text": "x", "style": "medium"},
+		"payload: unexpected property \"extra\"":      {"text": "x", "extra": true},
+	}
+	for want, p := range invalid {
+		err := schema.validate(p, "payload")
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("validate(%v) = %v, want %q", p, err, want)
+		}
+	}
+}
+
+func TestExportCapabilityManifestRoundTrip(t *testing.T) {
+	defs, err := LoadCapabilityManifest(writeManifest(t, summarizeManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ExportCapabilityManifest(defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadCapabilityManifest(writeManifest(t, string(data)))
+	if err != nil {
+		t.Fatalf("exported manifest does not load: %v\n%s", err, data)
+	}
+	if len(again) != 1 || again[0].Name != "summarize" || again[0].Handler != "echo" ||
+		again[0].Pricing == nil || again[0].Pricing.Amount != "1000" || again[0].Schema["type"] != "object" {
+		t.Errorf("round trip lost data: %+v", again)
+	}
+}
+
+func TestAgentCardListsCapabilities(t *testing.T) {
+	defs, err := LoadCapabilityManifest(writeManifest(t, summarizeManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := NewAgentCard("12D3KooWTest", []AgentCapability{defs[0].Capability()})
+	if card.Type != AgentCardType || len(card.Services) != 1 || card.Services[0].Endpoint != "p2p://12D3KooWTest" {
+		t.Errorf("card = %+v", card)
+	}
+	if len(card.Capabilities) != 1 || card.Capabilities[0].Pricing == nil || card.Capabilities[0].Schema == nil {
+		t.Errorf("card capabilities = %+v, want the schema and pricing", card.Capabilities)
+	}
+}
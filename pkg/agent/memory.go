@@ -1,15 +1,13 @@
 package agent
 
 import (
-	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
-
-	_ "modernc.org/sqlite"
 )
 
 // MemoryChunk represents a unit of shared knowledge.
@@ -24,43 +22,31 @@ type MemoryChunk struct {
 
 // MemoryStore handles local OpenClaw workspace monitoring and remote knowledge indexing.
 type MemoryStore struct {
-	db            *sql.DB
+	meta          MetadataStore
 	workspacePath string // Path to OpenClaw memory directory
 	mu            sync.RWMutex
 }
 
+// NewMemoryStore opens the SQLite metadata database at dbPath.
 func NewMemoryStore(dbPath string, workspacePath string) (*MemoryStore, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	meta, err := OpenMetadataStore(DriverSQLite, dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-
-	// Create tables for REMOTE knowledge discovery
-	schema := `
-	CREATE TABLE IF NOT EXISTS remote_knowledge (
-		topic_hash TEXT PRIMARY KEY,
-		topic TEXT,
-		summary TEXT,
-		author TEXT,
-		provider_id TEXT,
-		price REAL,
-		timestamp INTEGER
-	);
-	CREATE TABLE IF NOT EXISTS remote_tags (
-		tag TEXT,
-		topic_hash TEXT,
-		FOREIGN KEY(topic_hash) REFERENCES remote_knowledge(topic_hash)
-	);
-	CREATE INDEX IF NOT EXISTS idx_remote_tags_tag ON remote_tags(tag);
-	`
-	if _, err := db.Exec(schema); err != nil {
-		return nil, fmt.Errorf("failed to create schema: %w", err)
+		return nil, err
 	}
+	return NewMemoryStoreWithMetadata(meta, workspacePath), nil
+}
 
+// NewMemoryStoreWithMetadata builds a MemoryStore on an already opened MetadataStore.
+func NewMemoryStoreWithMetadata(meta MetadataStore, workspacePath string) *MemoryStore {
 	return &MemoryStore{
-		db:            db,
+		meta:          meta,
 		workspacePath: workspacePath,
-	}, nil
+	}
+}
+
+// Metadata returns the persistent store backing the remote index.
+func (s *MemoryStore) Metadata() MetadataStore {
+	return s.meta
 }
 
 // SearchLocalWorkspace semantically searches the OpenClaw memory directory.
@@ -98,48 +84,12 @@ func (s *MemoryStore) SearchLocalWorkspace(tag string) []MemoryChunk {
 func (s *MemoryStore) IndexRemoteKnowledge(offer KnowledgeOffer, tags []string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
-
-	_, err = tx.Exec(`
-		INSERT OR REPLACE INTO remote_knowledge (topic_hash, topic, summary, author, provider_id, price, timestamp)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		offer.TopicHash, offer.Topic, offer.Summary, offer.Author, offer.Provider, offer.Price, time.Now().Unix())
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	for _, tag := range tags {
-		tx.Exec("INSERT INTO remote_tags (tag, topic_hash) VALUES (?, ?)", tag, offer.TopicHash)
-	}
-
-	return tx.Commit()
+	return s.meta.IndexRemoteKnowledge(offer, tags)
 }
 
 // SearchRemoteIndex finds known remote knowledge providers.
 func (s *MemoryStore) SearchRemoteIndex(tag string) ([]KnowledgeOffer, error) {
-	rows, err := s.db.Query(`
-		SELECT k.topic_hash, k.topic, k.summary, k.provider_id, k.price 
-		FROM remote_knowledge k
-		JOIN remote_tags t ON k.topic_hash = t.topic_hash
-		WHERE t.tag = ?`, tag)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var results []KnowledgeOffer
-	for rows.Next() {
-		var offer KnowledgeOffer
-		if err := rows.Scan(&offer.TopicHash, &offer.Topic, &offer.Summary, &offer.Provider, &offer.Price); err == nil {
-			results = append(results, offer)
-		}
-	}
-	return results, nil
+	return s.meta.SearchRemoteIndex(tag)
 }
 
 // Search returns summaries of memories matching a tag, prioritizes local OpenClaw files.
@@ -164,6 +114,9 @@ func (s *MemoryStore) Search(tag string) ([]MemoryChunk, error) {
 	return localMatches, nil
 }
 
+// errAccessDenied is returned by GetMemory for a topic outside the workspace.
+var errAccessDenied = errors.New("access denied")
+
 // GetMemory returns the contents of a local OpenClaw file by its "topic" (filename).
 // This is used by the MemoryProtocol RPC handler.
 func (s *MemoryStore) GetMemory(topic string) (*MemoryChunk, error) {
@@ -171,10 +124,9 @@ func (s *MemoryStore) GetMemory(topic string) (*MemoryChunk, error) {
 		return nil, nil
 	}
 
-	path := filepath.Join(s.workspacePath, topic)
-	// Security check: ensure path is within workspace
-	if !strings.HasPrefix(filepath.Clean(path), filepath.Clean(s.workspacePath)) {
-		return nil, fmt.Errorf("access denied")
+	path, err := s.memoryPath(topic)
+	if err != nil {
+		return nil, err
 	}
 
 	data, err := os.ReadFile(path)
@@ -194,6 +146,48 @@ func (s *MemoryStore) GetMemory(topic string) (*MemoryChunk, error) {
 	}, nil
 }
 
+// OpenMemory returns the contents of a local OpenClaw file by its topic, like
+// GetMemory, as a stream read from the file, so a file of any size is served
+// without loading it. A topic with no file has none.
+func (s *MemoryStore) OpenMemory(topic string) (*StreamResult, error) {
+	if s.workspacePath == "" {
+		return nil, nil
+	}
+	path, err := s.memoryPath(topic)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return NewStreamResult(f, info.Size()), nil
+}
+
+// memoryPath returns the workspace file of topic.
+func (s *MemoryStore) memoryPath(topic string) (string, error) {
+	path := filepath.Join(s.workspacePath, topic)
+	// Security check: ensure path is within workspace
+	if !strings.HasPrefix(filepath.Clean(path), filepath.Clean(s.workspacePath)) {
+		return "", errAccessDenied
+	}
+	// Tasks' scratch files aren't knowledge to share
+	if rel, err := filepath.Rel(s.workspacePath, path); err == nil {
+		if top, _, _ := strings.Cut(filepath.ToSlash(rel), "/"); top == taskDirsName || top == quarantineName {
+			return "", errAccessDenied
+		}
+	}
+	return path, nil
+}
+
 // Compress simulates context distillation (e.g., using an LLM).
 // In a real implementation, this would call an LLM to summarize logs.
 func Compress(topic string, rawData interface{}) string {
@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// MetadataAddrs is the ERC-8004 metadata key of the multiaddrs an agent's
+// peer listens on, as a JSON array of strings, so a peer resolving the
+// agent can dial it without discovery.
+const MetadataAddrs = "addrs"
+
+// MulticallAddress is where Multicall3 is deployed, the same address on
+// nearly every EVM chain.
+const MulticallAddress = "0xcA11bde05977b3631167028862bE2a173976CA11"
+
+// Multicall3 aggregate3, the only call used.
+const multicallABI = `[
+	{"inputs":[{"components":[{"internalType":"address","name":"target","type":"address"},{"internalType":"bool","name":"allowFailure","type":"bool"},{"internalType":"bytes","name":"callData","type":"bytes"}],"internalType":"struct Multicall3.Call3[]","name":"calls","type":"tuple[]"}],"name":"aggregate3","outputs":[{"components":[{"internalType":"bool","name":"success","type":"bool"},{"internalType":"bytes","name":"returnData","type":"bytes"}],"internalType":"struct Multicall3.Result[]","name":"returnData","type":"tuple[]"}],"stateMutability":"payable","type":"function"}
+]`
+
+var multicall = func() abi.ABI {
+	parsed, _ := abi.JSON(strings.NewReader(multicallABI))
+	return parsed
+}()
+
+// How GetMetadataBatch reads several keys, learned on its first call: the
+// registry's own batch getMetadata, Multicall3, or one call per key.
+const (
+	metadataBatchUnknown int32 = iota
+	metadataBatchRegistry
+	metadataBatchMulticall
+	metadataBatchSequential
+)
+
+// errBatchUnsupported is returned by a batch read whose contract doesn't
+// implement it.
+var errBatchUnsupported = errors.New("batch read not supported")
+
+// Metadata keys resolution reads together.
+var recipientKeys = []string{"peerId", "peerIdBinding", MetadataA2AEndpoint, MetadataAddrs}
+
+// GetMetadataBatch returns an agent's metadata under keys in one call: the
+// registry's getMetadata(uint256,string[]) where it has one, otherwise a
+// Multicall3 of single-key reads, otherwise one call per key. Keys the agent
+// hasn't set are absent from the map.
+func (c *ERC8004Client) GetMetadataBatch(agentId *big.Int, keys []string, at ...BlockTag) (map[string][]byte, error) {
+	block := c.readBlock(at)
+	mode := c.metadataBatch.Load()
+	if mode <= metadataBatchRegistry {
+		vals, err := c.getMetadataRegistry(agentId, keys, block)
+		if err == nil {
+			c.metadataBatch.Store(metadataBatchRegistry)
+			return metadataMap(keys, vals), nil
+		}
+		if !unsupportedCall(err) {
+			return nil, err
+		}
+		mode = metadataBatchMulticall
+		c.metadataBatch.Store(mode)
+	}
+	if mode == metadataBatchMulticall {
+		vals, err := c.getMetadataMulticall(agentId, keys, block)
+		if err == nil {
+			return metadataMap(keys, vals), nil
+		}
+		if !unsupportedCall(err) {
+			return nil, err
+		}
+		fmt.Printf("[ERC8004] Neither the registry nor Multicall3 batch reads; reading metadata one key at a time\n")
+		c.metadataBatch.Store(metadataBatchSequential)
+	}
+
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		v, err := c.GetMetadata(agentId, key, block)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = []byte(v)
+	}
+	return metadataMap(keys, vals), nil
+}
+
+func (c *ERC8004Client) getMetadataRegistry(agentId *big.Int, keys []string, at BlockTag) ([][]byte, error) {
+	data, err := c.identityABI.Pack("getMetadata0", agentId, keys)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.call(c.identityAddr, data, at)
+	if err != nil {
+		return nil, err
+	}
+	var vals [][]byte
+	if err := c.identityABI.UnpackIntoInterface(&vals, "getMetadata0", res); err != nil || len(vals) != len(keys) {
+		return nil, errBatchUnsupported
+	}
+	return vals, nil
+}
+
+type multicallCall struct {
+	Target       common.Address
+	AllowFailure bool
+	CallData     []byte
+}
+
+type multicallResult struct {
+	Success    bool
+	ReturnData []byte
+}
+
+func (c *ERC8004Client) getMetadataMulticall(agentId *big.Int, keys []string, at BlockTag) ([][]byte, error) {
+	calls := make([]multicallCall, len(keys))
+	for i, key := range keys {
+		data, err := c.identityABI.Pack("getMetadata", agentId, key)
+		if err != nil {
+			return nil, err
+		}
+		calls[i] = multicallCall{Target: c.identityAddr, AllowFailure: true, CallData: data}
+	}
+	data, err := multicall.Pack("aggregate3", calls)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.call(common.HexToAddress(MulticallAddress), data, at)
+	if err != nil {
+		return nil, err
+	}
+	out, err := multicall.Unpack("aggregate3", res)
+	if err != nil || len(out) != 1 {
+		return nil, errBatchUnsupported
+	}
+	results := *abi.ConvertType(out[0], new([]multicallResult)).(*[]multicallResult)
+	if len(results) != len(keys) {
+		return nil, errBatchUnsupported
+	}
+
+	vals := make([][]byte, len(keys))
+	for i, r := range results {
+		if !r.Success {
+			return nil, fmt.Errorf("getMetadata(%s) of agent %s failed", keys[i], agentId)
+		}
+		if err := c.identityABI.UnpackIntoInterface(&vals[i], "getMetadata", r.ReturnData); err != nil {
+			return nil, fmt.Errorf("getMetadata(%s) of agent %s: %w", keys[i], agentId, err)
+		}
+	}
+	return vals, nil
+}
+
+// unsupportedCall reports whether err means the contract lacks the call,
+// rather than that the RPC failed.
+func unsupportedCall(err error) bool {
+	_, reverted := revertReason(err)
+	return reverted || errors.Is(err, errBatchUnsupported)
+}
+
+func metadataMap(keys []string, vals [][]byte) map[string][]byte {
+	m := make(map[string][]byte, len(keys))
+	for i, key := range keys {
+		if len(vals[i]) > 0 {
+			m[key] = vals[i]
+		}
+	}
+	return m
+}
+
+// ResolveRecipient returns how an agent is reached: its peerId, checked as
+// ResolvePeerID checks it, and its HTTP endpoint, found as A2AEndpoint finds
+// it. The metadata for both is read in one batch. The error is the peerId's;
+// an endpoint that can't be found is left empty.
+func (c *ERC8004Client) ResolveRecipient(ctx context.Context, agentId *big.Int) (Recipient, error) {
+	meta, err := c.GetMetadataBatch(agentId, recipientKeys)
+	if err != nil {
+		return Recipient{}, err
+	}
+	var to Recipient
+	to.Endpoint, _ = c.a2aEndpoint(ctx, agentId, string(meta[MetadataA2AEndpoint]))
+	to.PeerID, err = c.checkPeerID(agentId, string(meta["peerId"]), string(meta["peerIdBinding"]))
+	if to.PeerID != "" {
+		to.Addrs, _ = parseAgentAddrs(agentId, meta[MetadataAddrs])
+	}
+	return to, err
+}
+
+// GetAgentAddrs returns the multiaddrs an agent published under
+// MetadataAddrs, or none. Malformed entries are skipped with a warning; a
+// value that isn't a JSON array of strings is an error.
+func (c *ERC8004Client) GetAgentAddrs(agentId *big.Int, at ...BlockTag) ([]multiaddr.Multiaddr, error) {
+	raw, err := c.GetMetadata(agentId, MetadataAddrs, at...)
+	if err != nil {
+		return nil, err
+	}
+	return parseAgentAddrs(agentId, []byte(raw))
+}
+
+// parseAgentAddrs parses an agent's MetadataAddrs value. A trailing /p2p
+// component is dropped, as the peerstore keys addresses by peer ID.
+func parseAgentAddrs(agentId *big.Int, raw []byte) ([]multiaddr.Multiaddr, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var entries []string
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("%s metadata of agent %s is not a JSON array of strings: %w", MetadataAddrs, agentId, err)
+	}
+	var addrs []multiaddr.Multiaddr
+	for _, e := range entries {
+		ma, err := multiaddr.NewMultiaddr(e)
+		if err == nil {
+			if transport, _ := peer.SplitAddr(ma); transport != nil {
+				ma = transport
+			} else {
+				err = errors.New("no transport address")
+			}
+		}
+		if err != nil {
+			fmt.Printf("[ERC8004] Ignoring address %q of agent %s: %v\n", e, agentId, err)
+			continue
+		}
+		addrs = append(addrs, ma)
+	}
+	return addrs, nil
+}
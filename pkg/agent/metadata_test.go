@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// metadataRegistry returns a client for a registry holding metadata for
+// agent 1, with the registry's batch getMetadata if hasBatch and a Multicall3
+// if hasMulticall, and a pointer to its count of eth_calls.
+func metadataRegistry(t *testing.T, metadata map[string]string, hasBatch, hasMulticall bool) (*ERC8004Client, *atomic.Int32) {
+	t.Helper()
+	identity, _ := abi.JSON(strings.NewReader(identityABI))
+	var calls atomic.Int32
+	var handle func(to common.Address, input []byte) ([]byte, bool)
+	handle = func(to common.Address, input []byte) ([]byte, bool) {
+		if to == common.HexToAddress(MulticallAddress) {
+			if !hasMulticall {
+				return nil, false
+			}
+			args, _ := multicall.Methods["aggregate3"].Inputs.Unpack(input[4:])
+			var results []multicallResult
+			for _, c := range *abi.ConvertType(args[0], new([]multicallCall)).(*[]multicallCall) {
+				out, ok := handle(c.Target, c.CallData)
+				results = append(results, multicallResult{Success: ok, ReturnData: out})
+			}
+			out, _ := multicall.Methods["aggregate3"].Outputs.Pack(results)
+			return out, true
+		}
+		m, err := identity.MethodById(input)
+		if err != nil {
+			return nil, false
+		}
+		args, _ := m.Inputs.Unpack(input[4:])
+		switch {
+		case m.Name == "getMetadata":
+			out, _ := m.Outputs.Pack([]byte(metadata[args[1].(string)]))
+			return out, true
+		case m.Name == "getMetadata0" && hasBatch:
+			var vals [][]byte
+			for _, key := range args[1].([]string) {
+				vals = append(vals, []byte(metadata[key]))
+			}
+			out, _ := m.Outputs.Pack(vals)
+			return out, true
+		}
+		return nil, false
+	}
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		if method != "eth_call" {
+			return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+		}
+		calls.Add(1)
+		var call struct {
+			To    common.Address `json:"to"`
+			Input hexutil.Bytes  `json:"input"`
+		}
+		json.Unmarshal(params[0], &call)
+		out, ok := handle(call.To, call.Input)
+		if !ok {
+			return nil, &rpcError{Code: 3, Message: "execution reverted"}
+		}
+		return hexutil.Encode(out), nil
+	})
+	c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	t.Cleanup(c.Close)
+	return c, &calls
+}
+
+func TestGetMetadataBatchFallsBack(t *testing.T) {
+	metadata := map[string]string{"peerId": "12D3KooWpeer", MetadataA2AEndpoint: "https://agent.test/a2a"}
+	keys := []string{"peerId", "peerIdBinding", MetadataA2AEndpoint}
+	want := map[string][]byte{"peerId": []byte("12D3KooWpeer"), MetadataA2AEndpoint: []byte("https://agent.test/a2a")}
+
+	tests := []struct {
+		name              string
+		native, multicall bool
+		// eth_calls for the first batch, which finds what the chain
+		// supports, and for later ones
+		first, later int32
+	}{
+		{"registry batch", true, true, 1, 1},
+		{"multicall", false, true, 2, 1},
+		{"one key at a time", false, false, 5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, calls := metadataRegistry(t, metadata, tt.native, tt.multicall)
+			for i, wantCalls := range []int32{tt.first, tt.later} {
+				calls.Store(0)
+				got, err := c.GetMetadataBatch(big.NewInt(1), keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("batch %d = %q, want %q without the unset key", i, got, want)
+				}
+				if n := calls.Load(); n != wantCalls {
+					t.Errorf("batch %d made %d eth_calls, want %d", i, n, wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveRecipientReadsMetadataOnce(t *testing.T) {
+	c, calls := metadataRegistry(t, map[string]string{MetadataA2AEndpoint: "https://agent.test/a2a"}, true, false)
+	to, err := c.ResolveRecipient(context.Background(), big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.PeerID != "" || to.Endpoint != "https://agent.test/a2a" {
+		t.Errorf("recipient = %+v, want only the endpoint", to)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("made %d eth_calls, want 1", n)
+	}
+}
+
+func TestGetAgentAddrsSkipsMalformedEntries(t *testing.T) {
+	good := "/ip4/127.0.0.1/tcp/4001"
+	withPeer := "/ip4/10.0.0.1/udp/4001/quic-v1/p2p/12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA"
+	c, _ := metadataRegistry(t, map[string]string{MetadataAddrs: `["` + good + `", "not-a-multiaddr", "` + withPeer + `"]`}, true, false)
+	addrs, err := c.GetAgentAddrs(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0].String() != good || addrs[1].String() != "/ip4/10.0.0.1/udp/4001/quic-v1" {
+		t.Errorf("addrs = %v, want %s and the QUIC address without its peer ID", addrs, good)
+	}
+
+	// No addresses published is not an error; a value that isn't a list is
+	c, _ = metadataRegistry(t, map[string]string{}, true, false)
+	if addrs, err := c.GetAgentAddrs(big.NewInt(1)); err != nil || len(addrs) != 0 {
+		t.Errorf("unset: %v, %v, want none", addrs, err)
+	}
+	c, _ = metadataRegistry(t, map[string]string{MetadataAddrs: good}, true, false)
+	if _, err := c.GetAgentAddrs(big.NewInt(1)); err == nil {
+		t.Error("read a bare string as a list of addresses")
+	}
+}
@@ -0,0 +1,412 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// DefaultMetricsPushInterval is how often metrics are pushed to a
+// Pushgateway unless configured otherwise.
+const DefaultMetricsPushInterval = 15 * time.Second
+
+// Metrics counts the tasks a node serves and forwards. It is served by
+// GET /metrics, or pushed to a Pushgateway by nodes behind NAT that can't be
+// scraped. A nil *Metrics records nothing.
+type Metrics struct {
+	registry     *prometheus.Registry
+	tasks        *prometheus.CounterVec
+	taskDuration *prometheus.HistogramVec
+	forwards     *prometheus.CounterVec
+	stages       *prometheus.CounterVec
+	rejected     prometheus.Counter
+	compression  *prometheus.HistogramVec
+	compressed   *prometheus.CounterVec
+}
+
+// NewMetrics creates the node's metrics on a registry of their own.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		tasks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agentmesh_tasks_total",
+			Help: "Tasks run through a capability handler, by capability and outcome.",
+		}, []string{"capability", "outcome"}),
+		taskDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "agentmesh_task_duration_seconds",
+			Help:    "Time capability handlers took to run a task.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"capability"}),
+		forwards: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agentmesh_forwards_total",
+			Help: "Tasks relayed to a peer, by capability and outcome.",
+		}, []string{"capability", "outcome"}),
+		stages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agentmesh_task_stages_total",
+			Help: "Tasks reaching each lifecycle stage.",
+		}, []string{"stage"}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agentmesh_tasks_rejected_total",
+			Help: "Peer tasks refused because the task queue was full.",
+		}),
+		compression: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "agentmesh_message_compression_ratio",
+			Help:    "Compressed size of a message payload over its original size, by path and encoding.",
+			Buckets: []float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.8, 1},
+		}, []string{"path", "encoding"}),
+		compressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agentmesh_compressed_bytes_total",
+			Help: "Bytes of message payloads compressed, by path, encoding and whether before or after.",
+		}, []string{"path", "encoding", "size"}),
+	}
+	m.registry.MustRegister(m.tasks, m.taskDuration, m.forwards, m.stages, m.rejected, m.compression, m.compressed)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeTask records a task that started at start and ended with err.
+func (m *Metrics) observeTask(capability string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.tasks.WithLabelValues(capability, outcome(err)).Inc()
+	m.taskDuration.WithLabelValues(capability).Observe(time.Since(start).Seconds())
+}
+
+// observeForward records a relayed task.
+func (m *Metrics) observeForward(capability string, err error) {
+	if m == nil {
+		return
+	}
+	m.forwards.WithLabelValues(capability, outcome(err)).Inc()
+}
+
+// observeStage records a task reaching a lifecycle stage.
+func (m *Metrics) observeStage(stage string) {
+	if m == nil {
+		return
+	}
+	m.stages.WithLabelValues(stage).Inc()
+}
+
+// observeRejected records a peer task refused as busy.
+func (m *Metrics) observeRejected() {
+	if m == nil {
+		return
+	}
+	m.rejected.Inc()
+}
+
+// observeCompression records a payload of original bytes compressed to
+// compressed bytes.
+func (m *Metrics) observeCompression(path, encoding string, original, compressed int) {
+	if m == nil || original == 0 {
+		return
+	}
+	m.compression.WithLabelValues(path, encoding).Observe(float64(compressed) / float64(original))
+	m.compressed.WithLabelValues(path, encoding, "original").Add(float64(original))
+	m.compressed.WithLabelValues(path, encoding, "compressed").Add(float64(compressed))
+}
+
+// watchPool reports the task pool's queue depth and busy workers.
+func (m *Metrics) watchPool(p *TaskPool) {
+	if m == nil || p == nil {
+		return
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agentmesh_task_queue_depth",
+			Help: "Peer tasks waiting for a worker.",
+		}, func() float64 { return float64(p.Queued()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agentmesh_task_workers_active",
+			Help: "Workers running a peer task.",
+		}, func() float64 { return float64(p.Active()) }),
+	)
+}
+
+// watchStreams reports the task streams each peer has open. Only peers with
+// open streams have a series, so they don't outlive the peers.
+func (m *Metrics) watchStreams(l *StreamLimiter) {
+	if m == nil || l == nil {
+		return
+	}
+	m.registry.MustRegister(streamCollector{l})
+}
+
+// watchRPCCache reports the requests each tier of an RPC cache answered and
+// missed.
+func (m *Metrics) watchRPCCache(c *RPCCache) {
+	if m == nil || c == nil {
+		return
+	}
+	counter := func(tier, result string, count func(RPCCacheStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "agentmesh_rpc_cache_requests_total",
+			Help:        "Cacheable RPC requests, by cache tier and whether the cache answered them.",
+			ConstLabels: prometheus.Labels{"tier": tier, "result": result},
+		}, func() float64 { return float64(count(c.Stats())) })
+	}
+	m.registry.MustRegister(
+		counter(RPCCacheBlock, "hit", func(s RPCCacheStats) uint64 { return s.BlockHits }),
+		counter(RPCCacheBlock, "miss", func(s RPCCacheStats) uint64 { return s.BlockMisses }),
+		counter(RPCCacheLatest, "hit", func(s RPCCacheStats) uint64 { return s.LatestHits }),
+		counter(RPCCacheLatest, "miss", func(s RPCCacheStats) uint64 { return s.LatestMisses }),
+	)
+}
+
+// watchAnswerCache reports the queries an answer cache answered, missed and
+// was bypassed for.
+func (m *Metrics) watchAnswerCache(c *AnswerCache) {
+	if m == nil || c == nil {
+		return
+	}
+	counter := func(result string, count func(AnswerCacheStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "agentmesh_answer_cache_requests_total",
+			Help:        "Capability queries the answer cache was asked, by whether it answered them, had no answer or the requester wanted a fresh one.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(count(c.Stats())) })
+	}
+	m.registry.MustRegister(
+		counter("hit", func(s AnswerCacheStats) uint64 { return s.Hits }),
+		counter("miss", func(s AnswerCacheStats) uint64 { return s.Misses }),
+		counter("bypass", func(s AnswerCacheStats) uint64 { return s.Bypassed }),
+	)
+}
+
+// watchPrefilter reports how many chain logs a watcher's prefilter skipped
+// and how many it let through to be decoded.
+func (m *Metrics) watchPrefilter(f *EventPrefilter) {
+	if m == nil || f == nil {
+		return
+	}
+	counter := func(result string, count func(PrefilterStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "agentmesh_watcher_logs_total",
+			Help:        "Task and knowledge request logs the watcher saw, by whether the prefilter skipped them or they were decoded.",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(count(f.Stats())) })
+	}
+	m.registry.MustRegister(
+		counter("prefiltered", func(s PrefilterStats) uint64 { return s.Prefiltered }),
+		counter("decoded", func(s PrefilterStats) uint64 { return s.Decoded }),
+	)
+}
+
+// watchPublisher reports the announcements a publisher has waiting and the
+// ones it dropped, by reason.
+func (m *Metrics) watchPublisher(p *Publisher) {
+	if m == nil || p == nil {
+		return
+	}
+	dropped := func(reason string, count func(PublishStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "agentmesh_pubsub_dropped_total",
+			Help:        "Pubsub announcements dropped instead of published, by reason.",
+			ConstLabels: prometheus.Labels{"reason": reason},
+		}, func() float64 { return float64(count(p.Stats())) })
+	}
+	m.registry.MustRegister(
+		dropped(DropBufferFull, func(s PublishStats) uint64 { return s.Full }),
+		dropped(DropTimeout, func(s PublishStats) uint64 { return s.TimedOut }),
+		dropped(DropError, func(s PublishStats) uint64 { return s.Failed }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "agentmesh_pubsub_published_total",
+			Help: "Pubsub announcements published.",
+		}, func() float64 { return float64(p.Stats().Published) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agentmesh_pubsub_queue_depth",
+			Help: "Pubsub announcements waiting to be published.",
+		}, func() float64 { return float64(p.Stats().Queued) }),
+	)
+}
+
+// watchBootstrap reports how many bootstrap peers are connected.
+func (m *Metrics) watchBootstrap(b *BootstrapPeers) {
+	if m == nil || b == nil || len(b.peers()) == 0 && b.FromRegistry == 0 {
+		return
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agentmesh_bootstrap_peers_connected",
+			Help: "Bootstrap peers connected at their last check.",
+		}, func() float64 { return float64(b.Connected()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agentmesh_bootstrap_peers",
+			Help: "Bootstrap peers configured or found in the registry.",
+		}, func() float64 { return float64(len(b.peers())) }),
+	)
+}
+
+// watchCatchUp reports how far behind the confirmed head each watcher is,
+// and while one catches up, its progress and how long it should still take.
+func (m *Metrics) watchCatchUp(watchers []*EventWatcher) {
+	if m == nil {
+		return
+	}
+	for _, w := range watchers {
+		labels := prometheus.Labels{"chain": strconv.FormatUint(w.ChainID(), 10)}
+		m.registry.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "agentmesh_watcher_blocks_behind",
+				Help:        "Confirmed blocks the watcher had yet to process at its last poll.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(w.Progress().Behind) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "agentmesh_watcher_catchup_ratio",
+				Help:        "Share of the blocks the watcher is catching up on that it has processed; 1 when it isn't catching up.",
+				ConstLabels: labels,
+			}, func() float64 { return w.Progress().Percent / 100 }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "agentmesh_watcher_catchup_eta_seconds",
+				Help:        "How long the watcher's catch-up should still take; 0 when it isn't catching up.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(w.Progress().ETASeconds) }),
+		)
+	}
+}
+
+// watchWrites reports how long a WriteBatcher's commits take and how many
+// writes each carries.
+func (m *Metrics) watchWrites(b *WriteBatcher) {
+	if m == nil || b == nil {
+		return
+	}
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "agentmesh_db_flush_duration_seconds",
+		Help:    "Time taken to commit a batch of database writes, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"outcome"})
+	size := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "agentmesh_db_flush_writes",
+		Help:    "Writes committed together in a batch.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	m.registry.MustRegister(latency, size)
+	b.onFlush = func(writes int, took time.Duration, err error) {
+		latency.WithLabelValues(outcome(err)).Observe(took.Seconds())
+		if err == nil {
+			size.Observe(float64(writes))
+		}
+	}
+}
+
+// watchReadPool reports how long RPC reads wait for a slot of a read pool,
+// and how many run and wait.
+func (m *Metrics) watchReadPool(p *RPCReadPool) {
+	if m == nil || p == nil {
+		return
+	}
+	wait := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "agentmesh_rpc_read_wait_seconds",
+		Help:    "Time RPC reads waited for a slot of the read pool, by lane.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"lane"})
+	waiting := func(lane ReadLane) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "agentmesh_rpc_reads_waiting",
+			Help:        "RPC reads queued for a slot of the read pool, by lane.",
+			ConstLabels: prometheus.Labels{"lane": lane.String()},
+		}, func() float64 { return float64(p.Waiting(lane)) })
+	}
+	m.registry.MustRegister(
+		wait, waiting(ReadInteractive), waiting(ReadBackground),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agentmesh_rpc_reads_in_flight",
+			Help: "RPC reads holding a slot of the read pool.",
+		}, func() float64 { return float64(p.InFlight()) }),
+	)
+	p.mu.Lock()
+	p.onWait = func(lane ReadLane, d time.Duration) { wait.WithLabelValues(lane.String()).Observe(d.Seconds()) }
+	p.mu.Unlock()
+}
+
+// watchResources reports the usage and limits of the node's libp2p resource
+// managers, as libp2p exports them, and what they refused.
+func (m *Metrics) watchResources(r *resourceReporter) {
+	if m == nil || r == nil {
+		return
+	}
+	rcmgr.MustRegisterWith(m.registry)
+	m.registry.MustRegister(resourceCollector{r})
+}
+
+var peerStreamsDesc = prometheus.NewDesc("agentmesh_peer_task_streams", "Task streams each peer has open.", []string{"peer"}, nil)
+
+// streamCollector reads a StreamLimiter's counts when metrics are gathered.
+type streamCollector struct{ l *StreamLimiter }
+
+func (c streamCollector) Describe(ch chan<- *prometheus.Desc) { ch <- peerStreamsDesc }
+
+func (c streamCollector) Collect(ch chan<- prometheus.Metric) {
+	for peer, open := range c.l.Counts() {
+		ch <- prometheus.MustNewConstMetric(peerStreamsDesc, prometheus.GaugeValue, float64(open), peer)
+	}
+}
+
+// resourceCollector reads a resourceReporter's counts when metrics are
+// gathered.
+type resourceCollector struct{ r *resourceReporter }
+
+var resourceBlockedDesc = prometheus.NewDesc("agentmesh_p2p_resources_blocked_total",
+	"Connections, streams and memory reservations libp2p's resource manager refused, by scope class and resource.",
+	[]string{"scope", "resource"}, nil)
+
+func (c resourceCollector) Describe(ch chan<- *prometheus.Desc) { ch <- resourceBlockedDesc }
+
+func (c resourceCollector) Collect(ch chan<- prometheus.Metric) {
+	for k, n := range c.r.Blocked() {
+		ch <- prometheus.MustNewConstMetric(resourceBlockedDesc, prometheus.CounterValue, float64(n), k.scope, k.resource)
+	}
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+// PushMetrics pushes the node's metrics to the Pushgateway at url every
+// interval until the node stops, grouped by the node's peer ID so each node
+// keeps its own series.
+func (n *AgentNode) PushMetrics(url string, interval time.Duration) error {
+	if n.Metrics == nil {
+		return fmt.Errorf("no metrics to push; set Metrics first")
+	}
+	if interval <= 0 {
+		interval = DefaultMetricsPushInterval
+	}
+	var instance string
+	if h := n.CurrentHost(); h != nil {
+		instance = h.ID().String()
+	}
+	pusher := push.New(url, "agentmesh").Gatherer(n.Metrics.registry).Grouping("instance", instance)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := pusher.PushContext(n.ctx); err != nil && n.ctx.Err() == nil {
+					fmt.Printf("[Metrics] Push to %s failed: %v\n", url, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
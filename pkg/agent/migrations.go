@@ -0,0 +1,502 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Migration is a single versioned schema change for the metadata database.
+// Migrations are applied in ascending Version order and are never edited once
+// released; schema changes always go into a new migration appended to the list.
+type Migration struct {
+	Version     int
+	Description string
+	SQL         string
+	Postgres    string // replaces SQL on Postgres when set
+}
+
+// sqlFor returns the migration's SQL for driver; empty means nothing to run.
+func (m Migration) sqlFor(driver string) string {
+	if driver == DriverPostgres && m.Postgres != "" {
+		return m.Postgres
+	}
+	return m.SQL
+}
+
+// migrationLockID keys the Postgres advisory lock that serializes migrations
+// across nodes sharing a database.
+const migrationLockID = 0x6167656e746d7368 // "agentmsh"
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer binary.
+var ErrSchemaTooNew = errors.New("metadata database schema is newer than this binary supports")
+
+// migrations is the ordered list of schema changes. Migration 1 mirrors the
+// original ad-hoc schema (CREATE IF NOT EXISTS) so databases created before
+// versioning was introduced upgrade in place. Migration SQL must run on both
+// SQLite and Postgres; use BIGINT for block numbers and timestamps.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS remote_knowledge (
+			topic_hash TEXT PRIMARY KEY,
+			topic TEXT,
+			summary TEXT,
+			author TEXT,
+			provider_id TEXT,
+			price REAL,
+			timestamp INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS remote_tags (
+			tag TEXT,
+			topic_hash TEXT,
+			FOREIGN KEY(topic_hash) REFERENCES remote_knowledge(topic_hash)
+		);
+		CREATE INDEX IF NOT EXISTS idx_remote_tags_tag ON remote_tags(tag);
+		`,
+	},
+	{
+		Version:     2,
+		Description: "tasks and peers",
+		SQL: `
+		CREATE TABLE tasks (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			client TEXT,
+			topic TEXT,
+			spec_hash TEXT,
+			amount TEXT,
+			status TEXT NOT NULL,
+			created_at INTEGER,
+			updated_at INTEGER
+		);
+		CREATE INDEX idx_tasks_created ON tasks(created_at);
+		CREATE TABLE peers (
+			peer_id TEXT PRIMARY KEY,
+			eth_address TEXT,
+			capability TEXT,
+			last_seen INTEGER,
+			blocked INTEGER NOT NULL DEFAULT 0
+		);
+		`,
+	},
+	{
+		Version:     3,
+		Description: "address book, checkpoints and processed events",
+		SQL: `
+		CREATE TABLE address_book (
+			wallet TEXT PRIMARY KEY,
+			agent_id TEXT,
+			peer_id TEXT,
+			scanned_block BIGINT NOT NULL DEFAULT 0,
+			updated_at BIGINT
+		);
+		CREATE TABLE checkpoints (
+			name TEXT PRIMARY KEY,
+			block BIGINT NOT NULL,
+			updated_at BIGINT
+		);
+		CREATE TABLE processed_events (
+			id TEXT PRIMARY KEY,
+			processed_at BIGINT
+		);
+		`,
+	},
+	{
+		Version:     4,
+		Description: "leader election leases",
+		SQL: `
+		CREATE TABLE leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires_at BIGINT NOT NULL
+		);
+		`,
+	},
+	{
+		Version:     5,
+		Description: "identity key rotations and audit log",
+		SQL: `
+		CREATE TABLE key_rotations (
+			old_peer_id TEXT PRIMARY KEY,
+			new_peer_id TEXT NOT NULL,
+			old_key_path TEXT,
+			rotated_at BIGINT NOT NULL,
+			retire_at BIGINT NOT NULL,
+			retired_at BIGINT
+		);
+		CREATE TABLE audit_log (
+			at BIGINT NOT NULL,
+			kind TEXT NOT NULL,
+			subject TEXT,
+			detail TEXT
+		);
+		CREATE INDEX idx_audit_log_at ON audit_log (at);
+		`,
+	},
+	{
+		// Migrations 1 and 2 declared these INTEGER, which is 32-bit on
+		// Postgres; SQLite integers are already 64-bit.
+		Version:     6,
+		Description: "64-bit timestamps",
+		Postgres: `
+		ALTER TABLE remote_knowledge ALTER COLUMN timestamp TYPE BIGINT;
+		ALTER TABLE tasks ALTER COLUMN created_at TYPE BIGINT, ALTER COLUMN updated_at TYPE BIGINT;
+		ALTER TABLE peers ALTER COLUMN last_seen TYPE BIGINT;
+		`,
+	},
+	{
+		Version:     7,
+		Description: "watcher dead letters",
+		SQL: `
+		CREATE TABLE dead_letters (
+			id TEXT PRIMARY KEY,
+			log TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			last_error TEXT,
+			status TEXT NOT NULL,
+			next_attempt BIGINT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		);
+		`,
+	},
+	{
+		Version:     8,
+		Description: "address book endpoints",
+		SQL:         `ALTER TABLE address_book ADD COLUMN endpoint TEXT;`,
+	},
+	{
+		Version:     9,
+		Description: "task verdicts",
+		SQL:         `ALTER TABLE tasks ADD COLUMN verdict TEXT;`,
+	},
+	{
+		Version:     10,
+		Description: "local reputation ledger",
+		SQL: `
+		CREATE TABLE reputation_ledger (
+			agent_id TEXT PRIMARY KEY,
+			score DOUBLE PRECISION NOT NULL,
+			events INTEGER NOT NULL,
+			updated_at BIGINT NOT NULL
+		);
+		`,
+	},
+	{
+		Version:     11,
+		Description: "validations",
+		SQL: `
+		CREATE TABLE validations (
+			request_hash TEXT PRIMARY KEY,
+			agent_id TEXT NOT NULL,
+			request_uri TEXT NOT NULL,
+			tag TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			response INTEGER NOT NULL DEFAULT 0,
+			reason TEXT NOT NULL DEFAULT '',
+			block BIGINT NOT NULL,
+			deadline BIGINT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		);
+		CREATE INDEX idx_validations_created ON validations(created_at);
+		`,
+	},
+	{
+		Version:     12,
+		Description: "negotiated agreements",
+		SQL: `
+		CREATE TABLE agreements (
+			negotiation_id TEXT PRIMARY KEY,
+			asset_hash TEXT NOT NULL,
+			price TEXT NOT NULL,
+			token TEXT NOT NULL DEFAULT '',
+			requester TEXT NOT NULL,
+			responder TEXT NOT NULL,
+			agreement TEXT NOT NULL,
+			created_at BIGINT NOT NULL
+		);
+		CREATE INDEX idx_agreements_created ON agreements(created_at);
+		`,
+	},
+	{
+		Version:     13,
+		Description: "peer misbehavior and bans",
+		SQL: `
+		ALTER TABLE peers ADD COLUMN misbehavior DOUBLE PRECISION NOT NULL DEFAULT 0;
+		ALTER TABLE peers ADD COLUMN misbehavior_at BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE peers ADD COLUMN banned_until BIGINT NOT NULL DEFAULT 0;
+		CREATE TABLE peer_bans (
+			peer_id TEXT NOT NULL,
+			violation TEXT NOT NULL,
+			score DOUBLE PRECISION NOT NULL,
+			started_at BIGINT NOT NULL,
+			ends_at BIGINT NOT NULL
+		);
+		CREATE INDEX idx_peer_bans_peer ON peer_bans(peer_id, started_at);
+		`,
+	},
+	{
+		Version:     14,
+		Description: "task result verifications",
+		SQL:         `ALTER TABLE tasks ADD COLUMN verification TEXT;`,
+	},
+	{
+		Version:     15,
+		Description: "capability answer cache",
+		SQL: `
+		CREATE TABLE answer_cache (
+			capability TEXT NOT NULL,
+			query_hash TEXT NOT NULL,
+			version TEXT NOT NULL DEFAULT '',
+			answer_hash TEXT NOT NULL,
+			uri TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			created_at BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL,
+			PRIMARY KEY (capability, query_hash)
+		);
+		CREATE INDEX idx_answer_cache_created ON answer_cache(created_at);
+		`,
+	},
+	{
+		Version:     16,
+		Description: "task deadlines and capability run durations",
+		SQL: `
+		ALTER TABLE tasks ADD COLUMN deadline BIGINT NOT NULL DEFAULT 0;
+		CREATE TABLE task_runs (
+			capability TEXT NOT NULL,
+			duration_ms BIGINT NOT NULL,
+			finished_at BIGINT NOT NULL
+		);
+		CREATE INDEX idx_task_runs_capability ON task_runs(capability, finished_at);
+		`,
+	},
+	{
+		Version:     17,
+		Description: "RPC answer cache",
+		SQL: `
+		CREATE TABLE rpc_cache (
+			cache_key TEXT PRIMARY KEY,
+			chain_id BIGINT NOT NULL,
+			contract TEXT NOT NULL DEFAULT '',
+			method TEXT NOT NULL,
+			result TEXT NOT NULL,
+			created_at BIGINT NOT NULL
+		);
+		`,
+	},
+	{
+		Version:     18,
+		Description: "knowledge deliveries awaiting acknowledgement",
+		SQL: `
+		CREATE TABLE knowledge_deliveries (
+			id TEXT PRIMARY KEY,
+			task_id TEXT NOT NULL DEFAULT '',
+			peer_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			delivery TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		);
+		CREATE INDEX idx_knowledge_deliveries_status ON knowledge_deliveries(status);
+		`,
+	},
+	{
+		Version:     19,
+		Description: "chain IDs of tasks and dead letters",
+		SQL: `
+		ALTER TABLE tasks ADD COLUMN chain_id BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE dead_letters ADD COLUMN chain_id BIGINT NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		Version:     20,
+		Description: "catalog listings",
+		SQL: `
+		CREATE TABLE catalog_listings (
+			id TEXT PRIMARY KEY,
+			asset_hash TEXT NOT NULL,
+			artifact_path TEXT NOT NULL,
+			listing TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		);
+		CREATE UNIQUE INDEX idx_catalog_listings_asset ON catalog_listings(asset_hash);
+		`,
+	},
+	{
+		Version:     21,
+		Description: "interaction records",
+		SQL: `
+		CREATE TABLE interactions (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			reference TEXT NOT NULL,
+			record TEXT NOT NULL,
+			anchor_root TEXT,
+			completed_at BIGINT NOT NULL
+		);
+		CREATE INDEX idx_interactions_completed ON interactions(completed_at);
+		`,
+	},
+	{
+		Version:     22,
+		Description: "sessions",
+		SQL: `
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			peer_id TEXT NOT NULL,
+			closed TEXT NOT NULL,
+			session TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			last_active BIGINT NOT NULL
+		);
+		CREATE TABLE session_messages (
+			session_id TEXT NOT NULL,
+			direction TEXT NOT NULL,
+			seq BIGINT NOT NULL,
+			body TEXT NOT NULL,
+			at BIGINT NOT NULL,
+			PRIMARY KEY (session_id, direction, seq)
+		);
+		`,
+	},
+	{
+		Version:     23,
+		Description: "capital reservations",
+		SQL: `
+		CREATE TABLE capital_reservations (
+			task_id TEXT PRIMARY KEY,
+			token TEXT NOT NULL,
+			amount TEXT NOT NULL,
+			state TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			updated_at BIGINT NOT NULL
+		);
+		`,
+	},
+	{
+		Version:     24,
+		Description: "capability analytics",
+		SQL: `
+		CREATE TABLE capability_invocations (
+			task_id TEXT NOT NULL,
+			capability TEXT NOT NULL,
+			started_at BIGINT NOT NULL,
+			duration_ms BIGINT NOT NULL,
+			input_bytes BIGINT NOT NULL,
+			outcome TEXT NOT NULL,
+			counterparty TEXT NOT NULL,
+			revenue TEXT NOT NULL
+		);
+		CREATE INDEX idx_capability_invocations_started ON capability_invocations (capability, started_at);
+		CREATE INDEX idx_capability_invocations_task ON capability_invocations (task_id);
+		CREATE TABLE capability_days (
+			day TEXT NOT NULL,
+			capability TEXT NOT NULL,
+			invocations BIGINT NOT NULL,
+			failures BIGINT NOT NULL,
+			timeouts BIGINT NOT NULL,
+			avg_ms BIGINT NOT NULL,
+			p95_ms BIGINT NOT NULL,
+			input_bytes BIGINT NOT NULL,
+			revenue TEXT NOT NULL,
+			counterparties BIGINT NOT NULL,
+			PRIMARY KEY (day, capability)
+		);
+		`,
+	},
+}
+
+// LatestSchemaVersion returns the highest migration version known to this binary.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version currently recorded in the database, or 0
+// if no migration has been applied yet.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// migrate brings the database up to LatestSchemaVersion. Each pending migration
+// runs in its own transaction together with its schema_migrations row, so a
+// failure leaves the database at the last fully applied version. On Postgres
+// an advisory lock makes nodes starting together migrate one at a time.
+func migrate(s *sqlStore) error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if s.driver == DriverPostgres {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", int64(migrationLockID)); err != nil {
+			return fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", int64(migrationLockID))
+	}
+
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		applied_at BIGINT
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	// Read the version under the lock; another node may have just migrated
+	var version sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	current := int(version.Int64)
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("%w: database is at version %d, binary supports up to %d", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if stmt := m.sqlFor(s.driver); stmt != "" {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+			}
+		}
+		_, err = tx.Exec(s.rebind("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)"),
+			m.Version, m.Description, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", m.Version, err)
+		}
+		// Not stdout, which CLI commands keep for their results
+		fmt.Fprintf(os.Stderr, "[DB] Applied migration %d: %s\n", m.Version, m.Description)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// appliedMigrations returns the versions and descriptions recorded in the
+// SQLite database at path, in the order they were applied.
+func appliedMigrations(t *testing.T, path string) []Migration {
+	t.Helper()
+	db, err := sql.Open(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT version, description FROM schema_migrations ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var applied []Migration
+	for rows.Next() {
+		var m Migration
+		if err := rows.Scan(&m.Version, &m.Description); err != nil {
+			t.Fatal(err)
+		}
+		applied = append(applied, m)
+	}
+	return applied
+}
+
+// checkMigrated fails t unless every migration was applied to the database
+// at path once, in order.
+func checkMigrated(t *testing.T, path string) {
+	t.Helper()
+	applied := appliedMigrations(t, path)
+	if len(applied) != LatestSchemaVersion() {
+		t.Fatalf("%d migrations recorded, want %d", len(applied), LatestSchemaVersion())
+	}
+	for i, m := range applied {
+		if m.Version != migrations[i].Version || m.Description != migrations[i].Description {
+			t.Errorf("migration %d recorded as %d %q, want %d %q", i+1, m.Version, m.Description, migrations[i].Version, migrations[i].Description)
+		}
+	}
+}
+
+func TestFreshDatabaseIsMigratedToTheLatestVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.db")
+	store, err := OpenMetadataStore(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	checkMigrated(t, path)
+
+	// Opening it again has nothing left to apply
+	if store, err = OpenMetadataStore(DriverSQLite, path); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	checkMigrated(t, path)
+}
+
+func TestDatabaseFromBeforeVersioningUpgradesInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.db")
+	db, err := sql.Open(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The schema MemoryStore created before migrations, with an offer in it
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS remote_knowledge (
+		topic_hash TEXT PRIMARY KEY,
+		topic TEXT,
+		summary TEXT,
+		author TEXT,
+		provider_id TEXT,
+		price REAL,
+		timestamp INTEGER
+	);
+	CREATE TABLE IF NOT EXISTS remote_tags (
+		tag TEXT,
+		topic_hash TEXT,
+		FOREIGN KEY(topic_hash) REFERENCES remote_knowledge(topic_hash)
+	);
+	CREATE INDEX IF NOT EXISTS idx_remote_tags_tag ON remote_tags(tag);
+	INSERT INTO remote_knowledge (topic_hash, topic, summary, author, provider_id, price, timestamp)
+		VALUES ('0xabc', 'tides', 'tide tables', 'someone', 'peer-1', 0.5, 1700000000);
+	INSERT INTO remote_tags (tag, topic_hash) VALUES ('ocean', '0xabc');
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenMetadataStore(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	offers, err := store.SearchRemoteIndex("ocean")
+	if err != nil || len(offers) != 1 || offers[0].Topic != "tides" || offers[0].Provider != "peer-1" {
+		t.Errorf("offers after the upgrade = %+v, %v; want the tides offer kept", offers, err)
+	}
+	checkMigrated(t, path)
+}
+
+func TestNewerSchemaIsRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.db")
+	store, err := OpenMetadataStore(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	db, err := sql.Open(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'from the future', 0)", LatestSchemaVersion()+1)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := NewAgentNode(path, t.TempDir()); !errors.Is(err, ErrSchemaTooNew) {
+		if n != nil {
+			n.Stop()
+		}
+		t.Fatalf("NewAgentNode on a newer schema: %v, want ErrSchemaTooNew", err)
+	}
+	if applied := appliedMigrations(t, path); len(applied) != LatestSchemaVersion()+1 {
+		t.Errorf("%d migrations recorded after the refusal, want the database left alone", len(applied))
+	}
+}
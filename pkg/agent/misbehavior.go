@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Violations a PeerGuard scores.
+const (
+	ViolationBadSignature      = "bad_signature"      // a packet or offer whose signature didn't verify
+	ViolationOversized         = "oversized"          // a message over the size limit
+	ViolationProtocolError     = "protocol_error"     // a request that couldn't be read or parsed
+	ViolationAbandonedTransfer = "abandoned_transfer" // it went away before taking what it asked for
+	ViolationFailedPayment     = "failed_payment"     // it didn't pay what it agreed to (recorded by Go code through AgentNode.ReportMisbehavior)
+)
+
+// MisbehaviorConfig shapes how a PeerGuard scores violations and bans peers.
+type MisbehaviorConfig struct {
+	Points    map[string]float64 `json:"points"`    // score added per violation
+	HalfLife  time.Duration      `json:"halfLife"`  // how long a score takes to decay halfway to 0
+	Threshold float64            `json:"threshold"` // score at which a peer is banned
+	Ban       time.Duration      `json:"ban"`       // first ban; each later one is twice as long
+	MaxBan    time.Duration      `json:"maxBan"`    // longest ban
+}
+
+// DefaultMisbehaviorConfig bans a peer after four forged packets, or ten
+// unreadable requests, in quick succession. Bans start at ten minutes and
+// double up to a day; longer takes an operator block.
+func DefaultMisbehaviorConfig() MisbehaviorConfig {
+	return MisbehaviorConfig{
+		Points: map[string]float64{
+			ViolationBadSignature:      25,
+			ViolationOversized:         20,
+			ViolationProtocolError:     10,
+			ViolationAbandonedTransfer: 5,
+			ViolationFailedPayment:     50,
+		},
+		HalfLife:  time.Hour,
+		Threshold: 100,
+		Ban:       10 * time.Minute,
+		MaxBan:    24 * time.Hour,
+	}
+}
+
+// Validate reports a configuration the guard can't ban with.
+func (c MisbehaviorConfig) Validate() error {
+	switch {
+	case c.HalfLife <= 0:
+		return fmt.Errorf("half-life must be positive")
+	case c.Threshold <= 0:
+		return fmt.Errorf("threshold must be positive")
+	case c.Ban <= 0:
+		return fmt.Errorf("ban duration must be positive")
+	case c.MaxBan < c.Ban:
+		return fmt.Errorf("max ban %s is shorter than the first ban %s", c.MaxBan, c.Ban)
+	}
+	return nil
+}
+
+// ParseMisbehaviorPoints reads points written as "oversized=40,protocol_error=5"
+// over the defaults; violations left out keep their default points.
+func ParseMisbehaviorPoints(s string) (map[string]float64, error) {
+	points := DefaultMisbehaviorConfig().Points
+	if strings.TrimSpace(s) == "" {
+		return points, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		violation, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if _, known := points[violation]; !ok || !known {
+			return nil, fmt.Errorf("invalid points %q: want violation=value with violation one of %s", part, strings.Join(violations(), ", "))
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid points %q: want a number of at least 0", part)
+		}
+		points[violation] = v
+	}
+	return points, nil
+}
+
+func violations() []string {
+	var names []string
+	for v := range DefaultMisbehaviorConfig().Points {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// decay returns a misbehavior score after elapsed time has passed.
+func (c MisbehaviorConfig) decay(score float64, elapsed time.Duration) float64 {
+	return halfLifeDecay(score, elapsed, c.HalfLife)
+}
+
+// banFor is the length of a peer's ban after it was banned prior times.
+func (c MisbehaviorConfig) banFor(prior int) time.Duration {
+	d := c.Ban
+	for i := 0; i < prior && d < c.MaxBan; i++ {
+		d *= 2
+	}
+	return min(d, c.MaxBan)
+}
+
+// PeerStanding is a peer's record with its misbehavior score decayed to now,
+// and the bans it has served.
+type PeerStanding struct {
+	PeerRecord
+	Banned bool      `json:"banned"` // a temporary ban is in force
+	Bans   []PeerBan `json:"bans"`
+}
+
+// PeerGuard scores the protocol violations of each peer in the metadata
+// store. Scores decay over time; a peer whose score reaches the threshold is
+// banned for a while, twice as long as its previous ban, and its score starts
+// over. The node's connection gater refuses banned peers both ways. A guard
+// never blocks a peer for good: that is left to the operator. A nil
+// *PeerGuard bans nobody.
+type PeerGuard struct {
+	Config MisbehaviorConfig
+
+	store MetadataStore
+	clock Clock
+	mu    sync.Mutex
+}
+
+func NewPeerGuard(store MetadataStore, config MisbehaviorConfig) *PeerGuard {
+	return &PeerGuard{Config: config, store: store, clock: SystemClock}
+}
+
+// SetClock replaces the clock scores decay and bans expire by.
+func (g *PeerGuard) SetClock(clock Clock) {
+	g.clock = clock
+}
+
+// Record adds the points of violation to peerID's score, returning the ban
+// it triggered, if any. Violations by a peer already banned aren't counted.
+func (g *PeerGuard) Record(peerID, violation string) (*PeerBan, error) {
+	if g == nil {
+		return nil, nil
+	}
+	points, ok := g.Config.Points[violation]
+	if !ok {
+		return nil, fmt.Errorf("unknown violation %q", violation)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock.Now()
+	p, err := g.store.GetPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		p = &PeerRecord{PeerID: peerID}
+	}
+	if p.BannedUntil > now.UnixMilli() {
+		return nil, nil
+	}
+	score := g.Config.decay(p.Misbehavior, now.Sub(time.UnixMilli(p.MisbehaviorAt))) + points
+	if score < g.Config.Threshold {
+		return nil, g.store.SetPeerMisbehavior(peerID, score, now.UnixMilli(), p.BannedUntil)
+	}
+
+	prior, err := g.store.ListPeerBans(peerID)
+	if err != nil {
+		return nil, err
+	}
+	ban := PeerBan{
+		PeerID:    peerID,
+		Violation: violation,
+		Score:     score,
+		StartedAt: now.UnixMilli(),
+		Until:     now.Add(g.Config.banFor(len(prior))).UnixMilli(),
+	}
+	if err := g.store.AddPeerBan(ban); err != nil {
+		return nil, err
+	}
+	if err := g.store.SetPeerMisbehavior(peerID, 0, now.UnixMilli(), ban.Until); err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+// Banned reports whether peerID is serving a temporary ban.
+func (g *PeerGuard) Banned(peerID string) bool {
+	if g == nil {
+		return false
+	}
+	p, err := g.store.GetPeer(peerID)
+	return err == nil && p != nil && p.BannedUntil > g.clock.Now().UnixMilli()
+}
+
+// Standing returns peerID's record and bans, or nil if the node knows
+// nothing of it.
+func (g *PeerGuard) Standing(peerID string) (*PeerStanding, error) {
+	p, err := g.store.GetPeer(peerID)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	bans, err := g.store.ListPeerBans(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if bans == nil {
+		bans = []PeerBan{}
+	}
+	now := g.clock.Now()
+	p.Misbehavior = g.Config.decay(p.Misbehavior, now.Sub(time.UnixMilli(p.MisbehaviorAt)))
+	return &PeerStanding{PeerRecord: *p, Banned: p.BannedUntil > now.UnixMilli(), Bans: bans}, nil
+}
+
+// ReportMisbehavior scores a violation by peerID, one of the Violation
+// constants. A peer it gets banned is dropped from the routing table and
+// disconnected.
+func (n *AgentNode) ReportMisbehavior(peerID, violation string) {
+	ban, err := n.Guard.Record(peerID, violation)
+	if err != nil {
+		fmt.Printf("[Security] Failed to record %s by %s: %v\n", violation, peerID, err)
+		return
+	}
+	if ban == nil {
+		return
+	}
+	until := time.UnixMilli(ban.Until)
+	fmt.Printf("[Security] Banned %s until %s after %s (score %.0f)\n", peerID, until.Format(time.RFC3339), violation, ban.Score)
+	n.Events.Add("peer_banned", ban)
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return
+	}
+	n.Routes.Remove(pid)
+	n.Directory.Remove(pid)
+	n.Latencies.Remove(pid)
+	n.mu.RLock()
+	hosts := append([]host.Host{n.Host}, n.retiring...)
+	n.mu.RUnlock()
+	for _, h := range hosts {
+		if h != nil {
+			h.Network().ClosePeer(pid)
+		}
+	}
+}
+
+// peerGater refuses connections, both ways, to peers the node's PeerGuard
+// banned. Inbound connections are let through to the security handshake,
+// when the remote peer is known. Peers the operator blocked still connect, to
+// be answered with a forbidden error.
+type peerGater struct {
+	n *AgentNode
+}
+
+func (g peerGater) allowed(p peer.ID) bool {
+	return !g.n.Guard.Banned(p.String())
+}
+
+func (g peerGater) InterceptPeerDial(p peer.ID) bool                        { return g.allowed(p) }
+func (g peerGater) InterceptAddrDial(p peer.ID, _ multiaddr.Multiaddr) bool { return g.allowed(p) }
+func (g peerGater) InterceptAccept(network.ConnMultiaddrs) bool             { return true }
+func (g peerGater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return g.allowed(p)
+}
+func (g peerGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) { return true, 0 }
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestMisbehavingPeerIsBannedUntilTheBanExpires(t *testing.T) {
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	n := startTestNode(t)
+	n.Guard.SetClock(clock)
+	offender := startTestNode(t)
+	id := offender.CurrentHost().ID()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dial := func(from, to *AgentNode) error {
+		info, err := peer.AddrInfoFromString(dialAddr(to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return from.CurrentHost().Connect(ctx, *info)
+	}
+
+	// An oversized request scores without banning
+	request(t, offender, n, TaskProtocol, binary.AppendUvarint(nil, maxMessageSize+1))
+	if p, _ := n.Peer(id.String()); p == nil || p.Misbehavior != 20 || p.Banned {
+		t.Fatalf("standing after an oversized request = %+v, want a score of 20 and no ban", p)
+	}
+
+	// Four forged packets on top cross the threshold of 100
+	for i := 0; i < 4; i++ {
+		n.ReportMisbehavior(id.String(), ViolationBadSignature)
+	}
+	if n.CurrentHost().Network().Connectedness(id) == network.Connected {
+		t.Error("banned peer is still connected")
+	}
+	if err := dial(n, offender); err == nil {
+		t.Error("dial to a banned peer succeeded")
+	}
+	// The offender may finish its side of the handshake before n drops it
+	dial(offender, n)
+	for deadline := time.Now().Add(5 * time.Second); offender.CurrentHost().Network().Connectedness(n.CurrentHost().ID()) == network.Connected; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("dial from a banned peer was accepted")
+		}
+	}
+	p, err := n.Peer(id.String())
+	if err != nil || p == nil || !p.Banned || len(p.Bans) != 1 {
+		t.Fatalf("standing = %+v, %v, want one ban in force", p, err)
+	}
+	if b := p.Bans[0]; b.Violation != ViolationBadSignature || time.Duration(b.Until-b.StartedAt)*time.Millisecond != 10*time.Minute {
+		t.Errorf("ban = %+v, want a ten minute ban for %s", b, ViolationBadSignature)
+	}
+
+	// The ban expires on the guard's clock
+	clock.Advance(10 * time.Minute)
+	if err := dial(n, offender); err != nil {
+		t.Errorf("dial after the ban expired: %v", err)
+	}
+
+	// The score started over, and the next ban is twice as long
+	for i := 0; i < 3; i++ {
+		n.ReportMisbehavior(id.String(), ViolationBadSignature)
+	}
+	if n.Guard.Banned(id.String()) {
+		t.Fatal("banned again before crossing the threshold")
+	}
+	n.ReportMisbehavior(id.String(), ViolationBadSignature)
+	if p, _ = n.Peer(id.String()); len(p.Bans) != 2 || time.Duration(p.Bans[1].Until-p.Bans[1].StartedAt)*time.Millisecond != 20*time.Minute {
+		t.Errorf("bans = %+v, want a second one of twenty minutes", p.Bans)
+	}
+}
@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// DefaultNameTTL is how long a NameResolver keeps a name, or the lack of
+	// one, before looking it up again.
+	DefaultNameTTL = time.Hour
+	// DefaultNameTimeout is how long a display path waits for names it
+	// doesn't know yet before showing raw identifiers.
+	DefaultNameTimeout = 250 * time.Millisecond
+	// maxCachedNames bounds a NameResolver's cache; past it, expired names
+	// are dropped, and if none expired, all of them.
+	maxCachedNames = 10000
+)
+
+// NameResolver gives wallets and peers human-readable names for display: the
+// wallet's primary ENS name, or failing that the name on the agent card of
+// the agent it registered. A peer is named after its wallet. Names are only
+// ever shown next to the raw identifiers, never in their place in JSON.
+//
+// Resolution is best effort. Lookups run in the background, and callers wait
+// at most Timeout for them; an identifier without a name yet is shown raw
+// and named once its lookup completes. A nil *NameResolver names nothing.
+type NameResolver struct {
+	TTL     time.Duration // how long names are cached; 0 means DefaultNameTTL
+	Timeout time.Duration // how long Names waits; 0 means DefaultNameTimeout
+
+	client   *ERC8004Client
+	registry common.Address // ENS
+	store    MetadataStore
+	clock    Clock
+
+	mu      sync.Mutex
+	names   map[string]cachedName    // by wallet address or peer ID
+	lookups map[string]chan struct{} // in flight, closed once done
+	addrs   map[string]cachedAddress // by ENS name
+}
+
+type cachedName struct {
+	name    string // "" if there is none
+	expires time.Time
+}
+
+type cachedAddress struct {
+	addr    common.Address
+	err     error
+	expires time.Time
+}
+
+// NewNameResolver resolves ENS names through the registry at registry, and
+// agent cards through client's IdentityRegistry, for agents found in store's
+// address book. store also maps peers to their wallets.
+func NewNameResolver(client *ERC8004Client, registry common.Address, store MetadataStore) *NameResolver {
+	return &NameResolver{
+		client:   client,
+		registry: registry,
+		store:    store,
+		clock:    SystemClock,
+		names:    map[string]cachedName{},
+		lookups:  map[string]chan struct{}{},
+		addrs:    map[string]cachedAddress{},
+	}
+}
+
+// Names returns the names of ids, wallet addresses or peer IDs, that have
+// one, waiting at most Timeout for all of them together.
+func (r *NameResolver) Names(ctx context.Context, ids ...string) map[string]string {
+	if r == nil {
+		return nil
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultNameTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	names := map[string]string{}
+	for _, id := range ids {
+		name, pending := r.cached(id)
+		if pending != nil {
+			// Once out of time, the remaining ids only get cached names
+			select {
+			case <-pending:
+			case <-ctx.Done():
+			}
+			name, _ = r.cached(id)
+		}
+		if name != "" {
+			names[id] = name
+		}
+	}
+	return names
+}
+
+// Name returns the name of id, a wallet address or peer ID, if it is already
+// known, without waiting. An unknown one is looked up for next time.
+func (r *NameResolver) Name(id string) string {
+	if r == nil {
+		return ""
+	}
+	name, _ := r.cached(id)
+	return name
+}
+
+// Display formats id with its name, if known, for logs:
+// "alice.eth (0x12…)", or id alone. It never waits.
+func (r *NameResolver) Display(id string) string {
+	if name := r.Name(id); name != "" {
+		return fmt.Sprintf("%s (%s)", name, id)
+	}
+	return id
+}
+
+// Address resolves an ENS name to the wallet it stands for, caching the
+// answer for TTL.
+func (r *NameResolver) Address(name string) (common.Address, error) {
+	name = strings.ToLower(name)
+	r.mu.Lock()
+	c, ok := r.addrs[name]
+	r.mu.Unlock()
+	if ok && r.clock.Now().Before(c.expires) {
+		return c.addr, c.err
+	}
+	if r.client == nil {
+		return common.Address{}, fmt.Errorf("no chain to resolve %s on", name)
+	}
+	addr, err := r.client.ResolveENS(r.registry, name)
+	r.mu.Lock()
+	r.addrs[name] = cachedAddress{addr: addr, err: err, expires: r.clock.Now().Add(r.ttl())}
+	r.mu.Unlock()
+	return addr, err
+}
+
+func (r *NameResolver) ttl() time.Duration {
+	if r.TTL <= 0 {
+		return DefaultNameTTL
+	}
+	return r.TTL
+}
+
+// cached returns id's cached name. If there is none, or it expired, it
+// starts a lookup and returns the channel closed once the lookup is done.
+func (r *NameResolver) cached(id string) (string, <-chan struct{}) {
+	if !isNameable(id) {
+		return "", nil
+	}
+	if common.IsHexAddress(id) {
+		id = common.HexToAddress(id).Hex()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.names[id]
+	if ok && r.clock.Now().Before(c.expires) {
+		return c.name, nil
+	}
+	if done, ok := r.lookups[id]; ok {
+		return c.name, done
+	}
+	done := make(chan struct{})
+	r.lookups[id] = done
+	go func() {
+		name := r.lookup(id)
+		r.mu.Lock()
+		r.prune()
+		r.names[id] = cachedName{name: name, expires: r.clock.Now().Add(r.ttl())}
+		delete(r.lookups, id)
+		r.mu.Unlock()
+		close(done)
+	}()
+	// An expired name is still shown while it is looked up again
+	return c.name, done
+}
+
+// prune makes room in a full cache. r.mu must be held.
+func (r *NameResolver) prune() {
+	if len(r.names) < maxCachedNames {
+		return
+	}
+	now := r.clock.Now()
+	for id, c := range r.names {
+		if !now.Before(c.expires) {
+			delete(r.names, id)
+		}
+	}
+	if len(r.names) >= maxCachedNames {
+		clear(r.names)
+	}
+}
+
+// lookup finds id's name, or "".
+func (r *NameResolver) lookup(id string) string {
+	if !common.IsHexAddress(id) {
+		// A peer is named after its wallet
+		wallet := r.peerWallet(id)
+		if wallet == "" {
+			return ""
+		}
+		name, pending := r.cached(wallet)
+		if pending != nil {
+			<-pending
+			name, _ = r.cached(wallet)
+		}
+		return name
+	}
+	wallet := common.HexToAddress(id)
+	if r.client == nil {
+		return ""
+	}
+	if name, err := r.client.ReverseENS(r.registry, wallet); err == nil {
+		return name
+	}
+	return r.cardName(wallet)
+}
+
+// peerWallet returns the wallet a peer announced, or that the address book
+// resolved to it.
+func (r *NameResolver) peerWallet(peerID string) string {
+	if r.store == nil {
+		return ""
+	}
+	if p, _ := r.store.GetPeer(peerID); p != nil && common.IsHexAddress(p.EthAddress) {
+		return common.HexToAddress(p.EthAddress).Hex()
+	}
+	if e, _ := r.store.LookupPeerAddress(peerID); e != nil && common.IsHexAddress(e.Wallet) {
+		return common.HexToAddress(e.Wallet).Hex()
+	}
+	return ""
+}
+
+// cardName returns the name on the agent card of the agent the address book
+// has for wallet. Wallets it has no agent for aren't searched for, which
+// takes a registry scan.
+func (r *NameResolver) cardName(wallet common.Address) string {
+	if r.store == nil {
+		return ""
+	}
+	e, _ := r.store.LookupAddress(wallet.Hex())
+	if e == nil || e.AgentID == "" {
+		return ""
+	}
+	agentID, ok := new(big.Int).SetString(e.AgentID, 10)
+	if !ok {
+		return ""
+	}
+	uri, err := r.client.GetAgentURI(agentID)
+	if err != nil || !isHTTPURL(uri) {
+		return ""
+	}
+	card, err := FetchAgentCard(context.Background(), uri)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(card.Name)
+}
+
+// peerIDPattern matches the base58 peer IDs of Ed25519 and RSA keys.
+var peerIDPattern = regexp.MustCompile(`^(12D3Koo|Qm)[1-9A-HJ-NP-Za-km-z]{40,}$`)
+
+// isNameable reports whether id is a wallet address or peer ID.
+func isNameable(id string) bool {
+	return common.IsHexAddress(id) && strings.HasPrefix(id, "0x") || peerIDPattern.MatchString(id)
+}
+
+// identifierPattern finds wallet addresses and peer IDs in text.
+var identifierPattern = regexp.MustCompile(`0x[0-9a-fA-F]{40}\b|\b(12D3Koo|Qm)[1-9A-HJ-NP-Za-km-z]{40,}`)
+
+// identifiersIn returns the distinct wallet addresses and peer IDs in text.
+func identifiersIn(text string) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range identifierPattern.FindAllString(text, -1) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// fakeENS serves an ENS registry and one resolver holding reverse records,
+// from wallet to name, and forward ones, from name to wallet. Lookups of
+// the reverse record of slow wait for release.
+type fakeENS struct {
+	registry, resolver common.Address
+	reverse            map[common.Address]string
+	forward            map[string]common.Address
+	slow               common.Address
+	release            chan struct{}
+}
+
+func (f *fakeENS) handle(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	if method != "eth_call" {
+		return nil, &rpcError{Code: -32601, Message: method + " not served"}
+	}
+	var call struct {
+		To    common.Address `json:"to"`
+		Input hexutil.Bytes  `json:"input"`
+	}
+	json.Unmarshal(params[0], &call)
+	m, err := ens.MethodById(call.Input[:4])
+	if err != nil {
+		return nil, &rpcError{Code: 3, Message: err.Error()}
+	}
+	args, _ := m.Inputs.Unpack(call.Input[4:])
+	node := common.Hash(args[0].([32]byte))
+	var out []byte
+	switch {
+	case m.Name == "resolver" && call.To == f.registry:
+		if node == reverseNode(f.slow) {
+			<-f.release
+		}
+		out, _ = m.Outputs.Pack(f.resolver)
+	case m.Name == "name" && call.To == f.resolver:
+		var name string
+		for wallet, n := range f.reverse {
+			if reverseNode(wallet) == node {
+				name = n
+			}
+		}
+		out, _ = m.Outputs.Pack(name)
+	case m.Name == "addr" && call.To == f.resolver:
+		var addr common.Address
+		for name, wallet := range f.forward {
+			if namehash(name) == node {
+				addr = wallet
+			}
+		}
+		out, _ = m.Outputs.Pack(addr)
+	default:
+		return nil, &rpcError{Code: 3, Message: "execution reverted"}
+	}
+	return hexutil.Encode(out), nil
+}
+
+func TestNamesAreVerifiedCachedAndNeverWaitedOnLong(t *testing.T) {
+	alice := common.HexToAddress("0x00000000000000000000000000000000000a11ce")
+	mallory := common.HexToAddress("0x000000000000000000000000000000000000bad1")
+	slow := common.HexToAddress("0x0000000000000000000000000000000000005105")
+	f := &fakeENS{
+		registry: common.HexToAddress(DefaultENSRegistry),
+		resolver: common.HexToAddress("0x00000000000000000000000000000000000000e5"),
+		// mallory claims alice's name, which doesn't resolve to them
+		reverse: map[common.Address]string{alice: "alice.eth", mallory: "alice.eth", slow: "slow.eth"},
+		forward: map[string]common.Address{"alice.eth": alice, "slow.eth": slow},
+		slow:    slow,
+		release: make(chan struct{}),
+	}
+	defer close(f.release)
+	client := NewERC8004Client(newFakeRPC(t, f.handle), zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	t.Cleanup(client.Close)
+
+	key, _, _ := crypto.GenerateEd25519Key(nil)
+	pid, _ := peer.IDFromPrivateKey(key)
+	store := newTestStore(t)
+	store.TouchPeer(pid.String(), alice.Hex(), "summarize")
+
+	r := NewNameResolver(client, f.registry, store)
+	r.Timeout = 200 * time.Millisecond
+	// Lowercase addresses are named like checksummed ones
+	lower := "0x00000000000000000000000000000000000a11ce"
+	start := time.Now()
+	names := r.Names(context.Background(), lower, mallory.Hex(), pid.String(), slow.Hex())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Names waited %v on a lookup that doesn't return", elapsed)
+	}
+	if names[lower] != "alice.eth" || names[pid.String()] != "alice.eth" || len(names) != 2 {
+		t.Errorf("named %v, want alice's wallet and peer only", names)
+	}
+	if got := r.Display(alice.Hex()); got != "alice.eth ("+alice.Hex()+")" {
+		t.Errorf("displayed alice as %q", got)
+	}
+	if got := r.Display(mallory.Hex()); got != mallory.Hex() {
+		t.Errorf("displayed mallory as %q, an unverified name", got)
+	}
+	if addr, err := r.Address("Alice.eth"); err != nil || addr != alice {
+		t.Errorf("resolved alice.eth to %s, %v", addr.Hex(), err)
+	}
+
+	// Events name what the resolver already knows, without waiting
+	events := NewEventLog(10)
+	events.useNames(r)
+	e := events.Add("payment", map[string]string{"from": alice.Hex(), "to": slow.Hex()})
+	if len(e.Names) != 1 || e.Names[alice.Hex()] != "alice.eth" {
+		t.Errorf("event names %v, want alice's only", e.Names)
+	}
+
+	// A nil resolver names nothing
+	var none *NameResolver
+	if none.Names(context.Background(), alice.Hex()) != nil || none.Display(alice.Hex()) != alice.Hex() {
+		t.Error("a nil resolver named alice")
+	}
+}
@@ -0,0 +1,833 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DefaultNegotiationRounds is how many offers, counting both sides', a
+// negotiation may take before it fails.
+const DefaultNegotiationRounds = 8
+
+// DefaultNegotiationTimeout bounds a whole negotiation when the caller's
+// context sets no deadline, and every negotiation a peer opens with us.
+const DefaultNegotiationTimeout = time.Minute
+
+// DefaultOfferTTL is how long the terms of an offer stand when the opening
+// offer sets no Expiry.
+const DefaultOfferTTL = time.Hour
+
+// DefaultQuoteTTL is how long the price of each offer the node signs, and
+// of each counter amount it quotes in a decline, stands.
+const DefaultQuoteTTL = time.Minute
+
+// DefaultClockSkew is how far a counterparty's clock may be off the node's.
+// Expiries are judged with that much leeway; a peer further off is flagged.
+const DefaultClockSkew = 30 * time.Second
+
+// ErrNegotiationFailed is returned when a negotiation ends without an
+// agreement: a side walked away, the rounds ran out, or an offer was invalid.
+var ErrNegotiationFailed = errors.New("negotiation failed")
+
+// ErrClockSkew is returned for an offer stamped further from the node's
+// clock than the skew it tolerates.
+var ErrClockSkew = errors.New("peer clock skewed")
+
+// OfferExpiredError is returned when an offer is accepted after its
+// ExpiresAt, past the clock skew tolerated. It wraps ErrNegotiationFailed.
+type OfferExpiredError struct {
+	NegotiationID string
+	Round         int
+	ExpiresAt     int64 // unix ms
+	AcceptedAt    int64 // unix ms, by the proposing side's clock
+}
+
+func (e *OfferExpiredError) Error() string {
+	late := time.Duration(e.AcceptedAt-e.ExpiresAt) * time.Millisecond
+	return fmt.Sprintf("%v: offer %d of %s accepted %s after it expired", ErrNegotiationFailed, e.Round, e.NegotiationID, late)
+}
+
+func (e *OfferExpiredError) Unwrap() error { return ErrNegotiationFailed }
+
+// OfferTiming bounds how long the prices the node offers stand, and how far
+// off a counterparty's clock may be. The zero value uses the defaults.
+type OfferTiming struct {
+	TTL       time.Duration // how long each offer's price stands; 0 means DefaultQuoteTTL
+	ClockSkew time.Duration // 0 means DefaultClockSkew
+	Clock     Clock         // offers are stamped and judged by; nil means SystemClock
+}
+
+func (t OfferTiming) ttl() time.Duration {
+	if t.TTL <= 0 {
+		return DefaultQuoteTTL
+	}
+	return t.TTL
+}
+
+func (t OfferTiming) skew() time.Duration {
+	if t.ClockSkew <= 0 {
+		return DefaultClockSkew
+	}
+	return t.ClockSkew
+}
+
+func (t OfferTiming) now() time.Time {
+	if t.Clock == nil {
+		return SystemClock.Now()
+	}
+	return t.Clock.Now()
+}
+
+// expired reports whether expiresAt, unix ms, passed more than the skew
+// tolerated ago. 0 never expires.
+func (t OfferTiming) expired(expiresAt int64) bool {
+	return expiresAt != 0 && t.now().Sub(time.UnixMilli(expiresAt)) > t.skew()
+}
+
+// Negotiation message types.
+const (
+	negotiateOffer     = "offer"
+	negotiateAccept    = "accept"    // carries the Agreement signed by the accepting side
+	negotiateAgreement = "agreement" // carries it back signed by both
+	negotiateReject    = "reject"
+)
+
+// HashAsset returns the AssetHash of an asset description: the keccak256 of
+// the task payload or knowledge request being priced.
+func HashAsset(description []byte) string {
+	return ethcrypto.Keccak256Hash(description).Hex()
+}
+
+// Offer proposes a price for an asset. Every offer of a negotiation shares
+// its NegotiationID, asset, token and expiry; only the price moves, and each
+// price stands only until the offer's own ExpiresAt.
+type Offer struct {
+	NegotiationID string   `json:"negotiationId"`
+	Round         int      `json:"round"`               // 1 for the opening offer
+	AssetHash     string   `json:"assetHash"`           // see HashAsset
+	Price         *big.Int `json:"price"`               // in the token's smallest unit
+	Token         string   `json:"token,omitempty"`     // ERC-20 address; empty for ETH
+	Expiry        int64    `json:"expiry"`              // unix ms after which the terms can't be agreed
+	IssuedAt      int64    `json:"issuedAt,omitempty"`  // unix ms it was signed
+	ExpiresAt     int64    `json:"expiresAt,omitempty"` // unix ms after which its price can't be accepted; 0 for never
+	From          string   `json:"from"`                // peer ID of the side proposing it
+	Signature     string   `json:"signature"`           // base64, by From's key over signedBytes
+}
+
+func (o Offer) signedBytes() []byte {
+	return signedDocument("agentmesh-offer:", struct {
+		NegotiationID string `json:"negotiationId"`
+		Round         int    `json:"round"`
+		AssetHash     string `json:"assetHash"`
+		Price         string `json:"price"`
+		Token         string `json:"token"`
+		Expiry        int64  `json:"expiry"`
+		IssuedAt      int64  `json:"issuedAt,omitempty"`
+		ExpiresAt     int64  `json:"expiresAt,omitempty"`
+		From          string `json:"from"`
+	}{o.NegotiationID, o.Round, o.AssetHash, o.Price.String(), strings.ToLower(o.Token), o.Expiry, o.IssuedAt, o.ExpiresAt, o.From})
+}
+
+// legacySignedBytes is what offers were signed over before canonical JSON,
+// and before they were stamped.
+func (o Offer) legacySignedBytes() []byte {
+	return []byte(fmt.Sprintf("agentmesh-offer:%s:%d:%s:%s:%s:%d:%s",
+		o.NegotiationID, o.Round, o.AssetHash, o.Price, strings.ToLower(o.Token), o.Expiry, o.From))
+}
+
+// Verify checks the offer signature against the proposing peer ID.
+func (o Offer) Verify() bool {
+	if o.Price == nil {
+		return false
+	}
+	if verifyPeerSignature(o.From, o.signedBytes(), o.Signature) {
+		return true
+	}
+	return o.IssuedAt == 0 && o.ExpiresAt == 0 && verifyPeerSignature(o.From, o.legacySignedBytes(), o.Signature)
+}
+
+// Agreement is the outcome of a successful negotiation: the accepted terms,
+// signed by both sides. Both persist it, and its Hash can be attached to the
+// on-chain settlement as evidence of what was agreed.
+type Agreement struct {
+	NegotiationID string   `json:"negotiationId"`
+	AssetHash     string   `json:"assetHash"`
+	Price         *big.Int `json:"price"`
+	Token         string   `json:"token,omitempty"`
+	Expiry        int64    `json:"expiry"`
+	Requester     string   `json:"requester"` // peer ID of the paying side, which opened the negotiation
+	Responder     string   `json:"responder"` // peer ID of the side being paid
+	Rounds        int      `json:"rounds"`    // offers it took
+	RequesterSig  string   `json:"requesterSig"`
+	ResponderSig  string   `json:"responderSig"`
+	// A side with a wallet also signs the terms' EIP-712 TypedData with it,
+	// for contracts and wallets to check
+	RequesterWallet    string `json:"requesterWallet,omitempty"`
+	RequesterWalletSig string `json:"requesterWalletSig,omitempty"` // hex
+	ResponderWallet    string `json:"responderWallet,omitempty"`
+	ResponderWalletSig string `json:"responderWalletSig,omitempty"` // hex
+	CreatedAt          int64  `json:"createdAt,omitempty"`          // unix ms it was saved locally; not signed
+}
+
+func (a Agreement) signedBytes() []byte {
+	return signedDocument("agentmesh-agreement:", struct {
+		NegotiationID string `json:"negotiationId"`
+		AssetHash     string `json:"assetHash"`
+		Price         string `json:"price"`
+		Token         string `json:"token"`
+		Expiry        int64  `json:"expiry"`
+		Requester     string `json:"requester"`
+		Responder     string `json:"responder"`
+		Rounds        int    `json:"rounds"`
+	}{a.NegotiationID, a.AssetHash, a.Price.String(), strings.ToLower(a.Token), a.Expiry, a.Requester, a.Responder, a.Rounds})
+}
+
+// legacySignedBytes is what agreements were signed over before canonical
+// JSON.
+func (a Agreement) legacySignedBytes() []byte {
+	return []byte(fmt.Sprintf("agentmesh-agreement:%s:%s:%s:%s:%d:%s:%s:%d",
+		a.NegotiationID, a.AssetHash, a.Price, strings.ToLower(a.Token), a.Expiry, a.Requester, a.Responder, a.Rounds))
+}
+
+// Verify checks that both sides signed the agreement, in the same form, and
+// that the wallets named signed its EIP-712 form.
+func (a Agreement) Verify() bool {
+	if a.Price == nil || !a.verifyWalletSig(a.RequesterWallet, a.RequesterWalletSig) || !a.verifyWalletSig(a.ResponderWallet, a.ResponderWalletSig) {
+		return false
+	}
+	for _, signed := range [][]byte{a.signedBytes(), a.legacySignedBytes()} {
+		if verifyPeerSignature(a.Requester, signed, a.RequesterSig) && verifyPeerSignature(a.Responder, signed, a.ResponderSig) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash identifies the agreed terms, for use as settlement evidence.
+func (a Agreement) Hash() common.Hash {
+	return ethcrypto.Keccak256Hash(a.signedBytes())
+}
+
+// NegotiationState is what a strategy decides on.
+type NegotiationState struct {
+	Buyer     bool     // we pay, so lower prices are better
+	MaxRounds int      // offers the negotiation may take
+	Offer     Offer    // the other side's latest offer
+	Last      *big.Int // our latest price; nil before we proposed one
+}
+
+// NegotiationDecision answers an offer: Accept it, or counter with
+// Counter. With neither, the negotiation is abandoned for Reason.
+type NegotiationDecision struct {
+	Accept  bool
+	Counter *big.Int
+	Reason  string
+}
+
+// NegotiationStrategy decides how a side answers each offer it receives.
+type NegotiationStrategy interface {
+	Decide(state NegotiationState) NegotiationDecision
+}
+
+// NegotiationHandler picks the strategy a node answers the opening offer of
+// peerID with, as the paid side; nil declines to negotiate.
+type NegotiationHandler func(peerID string, offer Offer) NegotiationStrategy
+
+// atLeastAsGood reports whether price a is no worse than b for the side.
+func atLeastAsGood(buyer bool, a, b *big.Int) bool {
+	if buyer {
+		return a.Cmp(b) <= 0
+	}
+	return a.Cmp(b) >= 0
+}
+
+// TakeItOrLeaveIt names one price and never moves from it: an offer at least
+// as good is accepted, anything else is answered with Price again until the
+// other side gives in or the rounds run out.
+type TakeItOrLeaveIt struct {
+	Price *big.Int
+}
+
+func (s TakeItOrLeaveIt) Decide(state NegotiationState) NegotiationDecision {
+	if atLeastAsGood(state.Buyer, state.Offer.Price, s.Price) {
+		return NegotiationDecision{Accept: true}
+	}
+	return NegotiationDecision{Counter: s.Price}
+}
+
+// Requoter is a NegotiationStrategy that prices an offer of ours again when
+// the other side accepted it after it expired. Strategies that aren't offer
+// the expired price again. A nil price walks away.
+type Requoter interface {
+	Requote(expired Offer) *big.Int
+}
+
+// LinearConcession opens at Start and concedes an equal step with each
+// proposal, reaching Limit on its Rounds-th. It accepts any offer at least as
+// good as what it would propose next.
+type LinearConcession struct {
+	Start, Limit *big.Int
+	Rounds       int // proposals to reach Limit in; non-positive means half the negotiation's rounds
+}
+
+func (s LinearConcession) Decide(state NegotiationState) NegotiationDecision {
+	next := s.next(state)
+	if atLeastAsGood(state.Buyer, state.Offer.Price, next) {
+		return NegotiationDecision{Accept: true}
+	}
+	return NegotiationDecision{Counter: next}
+}
+
+// next returns the price to propose after last.
+func (s LinearConcession) next(state NegotiationState) *big.Int {
+	if state.Last == nil {
+		return s.Start
+	}
+	rounds := s.Rounds
+	if rounds <= 0 {
+		rounds = state.MaxRounds / 2
+	}
+	diff := new(big.Int).Sub(s.Limit, s.Start)
+	step := new(big.Int).Set(diff)
+	if rounds > 1 {
+		// Round the step away from zero so the last proposal reaches Limit
+		n := big.NewInt(int64(rounds - 1))
+		step.Quo(step, n)
+		if new(big.Int).Mul(step, n).Cmp(diff) != 0 {
+			step.Add(step, big.NewInt(int64(diff.Sign())))
+		}
+	}
+	next := new(big.Int).Add(state.Last, step)
+	if (diff.Sign() > 0 && next.Cmp(s.Limit) > 0) || (diff.Sign() < 0 && next.Cmp(s.Limit) < 0) {
+		next.Set(s.Limit)
+	}
+	return next
+}
+
+// negotiationMessage is one message of the negotiate protocol. A peer that
+// can't negotiate answers with an AgentMessage of type error instead.
+type negotiationMessage struct {
+	Type      string     `json:"type"`
+	Offer     *Offer     `json:"offer,omitempty"`
+	Agreement *Agreement `json:"agreement,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+// negotiation is one side of a negotiation on a stream.
+type negotiation struct {
+	n         *AgentNode
+	s         network.Stream
+	key       crypto.PrivKey
+	self      string
+	peer      string
+	buyer     bool
+	strategy  NegotiationStrategy
+	maxRounds int
+
+	// The terms every offer shares, fixed by the opening offer
+	id, asset, token string
+	expiry           int64
+
+	mine   *Offer // our latest offer
+	theirs *Offer // theirs
+}
+
+func (n *AgentNode) newNegotiation(s network.Stream, buyer bool) *negotiation {
+	n.mu.RLock()
+	key := n.privKey
+	n.mu.RUnlock()
+	maxRounds := n.NegotiationRounds
+	if maxRounds <= 0 {
+		maxRounds = DefaultNegotiationRounds
+	}
+	return &negotiation{
+		n:         n,
+		s:         s,
+		key:       key,
+		self:      s.Conn().LocalPeer().String(),
+		peer:      s.Conn().RemotePeer().String(),
+		buyer:     buyer,
+		maxRounds: maxRounds,
+	}
+}
+
+// Negotiate opens a negotiation with peerID over the price of an asset, as
+// the paying side. initial is the opening offer: AssetHash and Price are
+// required, Token and Expiry optional. strategy answers the peer's
+// counteroffers. The agreement is returned and saved once both sides signed
+// it; otherwise the error wraps ErrNegotiationFailed or says why the peer
+// couldn't be reached. The negotiation ends with ctx, or after
+// DefaultNegotiationTimeout if ctx has no deadline.
+func (n *AgentNode) Negotiate(ctx context.Context, peerID string, initial Offer, strategy NegotiationStrategy) (*Agreement, error) {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer id: %w", err)
+	}
+	if initial.AssetHash == "" || initial.Price == nil || initial.Price.Sign() < 0 {
+		return nil, fmt.Errorf("an offer needs an asset hash and a non-negative price")
+	}
+	if err := n.permit(pid, PolicyActionNegotiate); err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultNegotiationTimeout)
+		defer cancel()
+	}
+	s, err := n.CurrentHost().NewStream(ctx, pid, protocol.ID(NegotiateProtocol))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	s.SetDeadline(deadline)
+
+	g := n.newNegotiation(s, true)
+	g.strategy = strategy
+	g.id, g.asset, g.token, g.expiry = newMessageID(), initial.AssetHash, initial.Token, initial.Expiry
+	if g.expiry == 0 {
+		g.expiry = n.Offers.now().Add(DefaultOfferTTL).UnixMilli()
+	}
+	if err := g.propose(1, initial.Price); err != nil {
+		return nil, err
+	}
+	return g.run()
+}
+
+// SetNegotiationHandler lets peers open negotiations with the node, answered
+// with the strategy h picks. Without one, or where h picks none, an artifact
+// the node lists in its catalog is sold at its listed price; other
+// negotiations are refused.
+func (n *AgentNode) SetNegotiationHandler(h NegotiationHandler) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.negotiator = h
+}
+
+// handleNegotiation answers a negotiation a peer opened, as the paid side.
+func (n *AgentNode) handleNegotiation(s network.Stream) {
+	if n.checkBlocked(s) {
+		return
+	}
+	data, ok := n.readRequest(s)
+	if !ok {
+		return
+	}
+	var m negotiationMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		n.misbehaved(s, ViolationProtocolError)
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "invalid JSON: " + err.Error()})
+		return
+	}
+	if m.Type != negotiateOffer || m.Offer == nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "a negotiation opens with an offer"})
+		return
+	}
+	n.mu.RLock()
+	handler := n.negotiator
+	n.mu.RUnlock()
+	// What the node lists is sold at its price, handler or not
+	listed := n.listingStrategy(m.Offer.AssetHash)
+	if handler == nil && listed == nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeUnsupported, Message: "this node doesn't negotiate"})
+		return
+	}
+	s.SetDeadline(time.Now().Add(DefaultNegotiationTimeout))
+
+	g := n.newNegotiation(s, false)
+	o := m.Offer
+	g.id, g.asset, g.token, g.expiry = o.NegotiationID, o.AssetHash, o.Token, o.Expiry
+	if err := g.check(o); err != nil {
+		g.refuse(err.Error())
+		return
+	}
+	if handler != nil {
+		g.strategy = handler(g.peer, *o)
+	}
+	if g.strategy == nil {
+		g.strategy = listed
+	}
+	if g.strategy == nil {
+		g.refuse("declined")
+		return
+	}
+	g.theirs = o
+	agreement, done, err := g.answer()
+	if !done {
+		agreement, err = g.run()
+	}
+	if err != nil {
+		fmt.Printf("[Negotiate] Negotiation %s with %s failed: %v\n", g.id, g.n.Names.Display(g.peer), err)
+		return
+	}
+	fmt.Printf("[Negotiate] Agreed %s with %s for %s\n", agreement.Price, g.n.Names.Display(g.peer), agreement.AssetHash)
+}
+
+// run exchanges offers until an agreement is signed or a side gives up.
+func (g *negotiation) run() (*Agreement, error) {
+	for {
+		m, err := g.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch m.Type {
+		case negotiateOffer:
+			if err := g.check(m.Offer); err != nil {
+				g.refuse(err.Error())
+				return nil, err
+			}
+			g.theirs = m.Offer
+			if agreement, done, err := g.answer(); done {
+				return agreement, err
+			}
+		case negotiateAccept:
+			if agreement, done, err := g.countersign(m.Agreement); done {
+				return agreement, err
+			}
+		case negotiateReject:
+			return nil, fmt.Errorf("%w: %s walked away: %s", ErrNegotiationFailed, g.peer, m.Reason)
+		default:
+			err := fmt.Errorf("%w: unexpected %q message", ErrNegotiationFailed, m.Type)
+			g.refuse(err.Error())
+			return nil, err
+		}
+	}
+}
+
+// answer lets the strategy judge their latest offer. done is false when a
+// counteroffer was sent and the negotiation goes on.
+func (g *negotiation) answer() (agreement *Agreement, done bool, err error) {
+	state := NegotiationState{Buyer: g.buyer, MaxRounds: g.maxRounds, Offer: *g.theirs}
+	if g.mine != nil {
+		state.Last = g.mine.Price
+	}
+	d := g.strategy.Decide(state)
+	if d.Accept && g.n.Offers.expired(g.theirs.ExpiresAt) {
+		// Their price lapsed before it reached us: offer it back, freshly
+		// stamped, rather than accept what they would refuse
+		d = NegotiationDecision{Counter: g.theirs.Price}
+	}
+	switch {
+	case d.Accept:
+		a, err := g.accept()
+		return a, true, err
+	case d.Counter != nil && d.Counter.Sign() >= 0:
+		if g.theirs.Round >= g.maxRounds {
+			err := fmt.Errorf("%w: no agreement within %d rounds", ErrNegotiationFailed, g.maxRounds)
+			g.refuse(err.Error())
+			return nil, true, err
+		}
+		return nil, false, g.propose(g.theirs.Round+1, d.Counter)
+	default:
+		g.refuse(d.Reason)
+		return nil, true, fmt.Errorf("%w: walked away: %s", ErrNegotiationFailed, d.Reason)
+	}
+}
+
+// propose signs and sends our offer of price for round, standing for the
+// quote TTL or until the terms expire, whichever is sooner.
+func (g *negotiation) propose(round int, price *big.Int) error {
+	now := g.n.Offers.now()
+	expiresAt := min(now.Add(g.n.Offers.ttl()).UnixMilli(), g.expiry)
+	o := Offer{NegotiationID: g.id, Round: round, AssetHash: g.asset, Price: new(big.Int).Set(price), Token: g.token, Expiry: g.expiry,
+		IssuedAt: now.UnixMilli(), ExpiresAt: expiresAt, From: g.self}
+	sig, err := g.key.Sign(o.signedBytes())
+	if err != nil {
+		return err
+	}
+	o.Signature = base64.StdEncoding.EncodeToString(sig)
+	g.mine = &o
+	return g.send(negotiationMessage{Type: negotiateOffer, Offer: &o})
+}
+
+// accept signs an agreement on their latest offer and waits for it to come
+// back countersigned, or for a new offer if we accepted too late.
+func (g *negotiation) accept() (*Agreement, error) {
+	a := Agreement{NegotiationID: g.id, AssetHash: g.asset, Price: g.theirs.Price, Token: g.token, Expiry: g.expiry, Rounds: g.theirs.Round}
+	if g.buyer {
+		a.Requester, a.Responder = g.self, g.peer
+	} else {
+		a.Requester, a.Responder = g.peer, g.self
+	}
+	if err := g.sign(&a); err != nil {
+		return nil, err
+	}
+	if err := g.send(negotiationMessage{Type: negotiateAccept, Agreement: &a}); err != nil {
+		return nil, err
+	}
+	m, err := g.receive()
+	if err != nil {
+		return nil, err
+	}
+	switch m.Type {
+	case negotiateReject:
+		return nil, fmt.Errorf("%w: %s walked away: %s", ErrNegotiationFailed, g.peer, m.Reason)
+	case negotiateOffer:
+		if err := g.check(m.Offer); err != nil {
+			g.refuse(err.Error())
+			return nil, err
+		}
+		g.theirs = m.Offer
+		agreement, done, err := g.answer()
+		if !done {
+			return g.run()
+		}
+		return agreement, err
+	}
+	if m.Type != negotiateAgreement || m.Agreement == nil || string(m.Agreement.signedBytes()) != string(a.signedBytes()) || !m.Agreement.Verify() {
+		return nil, fmt.Errorf("%w: %s didn't countersign the agreement", ErrNegotiationFailed, g.peer)
+	}
+	return g.save(*m.Agreement), nil
+}
+
+// countersign checks an agreement they signed on our latest offer, signs it
+// too and sends it back. done is false when the offer had expired and was
+// made again.
+func (g *negotiation) countersign(a *Agreement) (agreement *Agreement, done bool, err error) {
+	if a == nil || g.mine == nil {
+		err := fmt.Errorf("%w: nothing to agree on", ErrNegotiationFailed)
+		g.refuse(err.Error())
+		return nil, true, err
+	}
+	want := Agreement{NegotiationID: g.id, AssetHash: g.asset, Price: g.mine.Price, Token: g.token, Expiry: g.expiry, Rounds: g.mine.Round}
+	theirSig, theirWallet, theirWalletSig := a.ResponderSig, a.ResponderWallet, a.ResponderWalletSig
+	if g.buyer {
+		want.Requester, want.Responder = g.self, g.peer
+	} else {
+		want.Requester, want.Responder = g.peer, g.self
+		theirSig, theirWallet, theirWalletSig = a.RequesterSig, a.RequesterWallet, a.RequesterWalletSig
+	}
+	if string(a.signedBytes()) != string(want.signedBytes()) || !verifyPeerSignature(g.peer, want.signedBytes(), theirSig) ||
+		!want.verifyWalletSig(theirWallet, theirWalletSig) {
+		err := fmt.Errorf("%w: the agreement doesn't match our offer", ErrNegotiationFailed)
+		g.refuse(err.Error())
+		return nil, true, err
+	}
+	now := g.n.Offers.now().UnixMilli()
+	if now > g.expiry {
+		err := fmt.Errorf("%w: the offer expired", ErrNegotiationFailed)
+		g.refuse(err.Error())
+		return nil, true, err
+	}
+	if g.n.Offers.expired(g.mine.ExpiresAt) {
+		expired := &OfferExpiredError{NegotiationID: g.id, Round: g.mine.Round, ExpiresAt: g.mine.ExpiresAt, AcceptedAt: now}
+		if err := g.requote(expired); err != nil {
+			return nil, true, err
+		}
+		return nil, false, nil
+	}
+	if g.buyer {
+		want.ResponderSig, want.ResponderWallet, want.ResponderWalletSig = theirSig, theirWallet, theirWalletSig
+	} else {
+		want.RequesterSig, want.RequesterWallet, want.RequesterWalletSig = theirSig, theirWallet, theirWalletSig
+	}
+	if err := g.sign(&want); err != nil {
+		return nil, true, err
+	}
+	if err := g.send(negotiationMessage{Type: negotiateAgreement, Agreement: &want}); err != nil {
+		return nil, true, err
+	}
+	return g.save(want), true, nil
+}
+
+// requote answers a late acceptance of our offer with a fresh one in the
+// next round, priced again if the strategy is a Requoter. Without a round
+// or a price left, the negotiation fails with expired.
+func (g *negotiation) requote(expired *OfferExpiredError) error {
+	fmt.Printf("[Negotiate] %s; quoting %s again\n", expired, g.n.Names.Display(g.peer))
+	price := g.mine.Price
+	if r, ok := g.strategy.(Requoter); ok {
+		price = r.Requote(*g.mine)
+	}
+	if price == nil || price.Sign() < 0 || g.mine.Round >= g.maxRounds {
+		g.refuse(expired.Error())
+		return expired
+	}
+	return g.propose(g.mine.Round+1, price)
+}
+
+// check validates an offer from the other side.
+func (g *negotiation) check(o *Offer) error {
+	switch {
+	case o == nil:
+		return fmt.Errorf("%w: empty offer", ErrNegotiationFailed)
+	case o.From != g.peer || !o.Verify():
+		return fmt.Errorf("%w: offer not signed by %s", ErrNegotiationFailed, g.peer)
+	case o.NegotiationID != g.id || o.AssetHash != g.asset || !strings.EqualFold(o.Token, g.token) || o.Expiry != g.expiry:
+		return fmt.Errorf("%w: offer changes the terms", ErrNegotiationFailed)
+	case o.Price.Sign() < 0:
+		return fmt.Errorf("%w: negative price", ErrNegotiationFailed)
+	case o.ExpiresAt != 0 && o.ExpiresAt < o.IssuedAt:
+		return fmt.Errorf("%w: offer expires before it was issued", ErrNegotiationFailed)
+	case g.n.Offers.now().UnixMilli() > o.Expiry:
+		return fmt.Errorf("%w: the offer expired", ErrNegotiationFailed)
+	case o.Round > g.maxRounds:
+		return fmt.Errorf("%w: no agreement within %d rounds", ErrNegotiationFailed, g.maxRounds)
+	}
+	// The round after the latest offer, or after theirs we accepted too late
+	want := 1
+	if g.mine != nil {
+		want = g.mine.Round + 1
+	}
+	if g.theirs != nil && g.theirs.Round >= want {
+		want = g.theirs.Round + 1
+	}
+	if o.Round != want {
+		return fmt.Errorf("%w: offer for round %d, expected %d", ErrNegotiationFailed, o.Round, want)
+	}
+	if err := g.n.checkClock(g.s.Conn().RemotePeer(), o.IssuedAt); err != nil {
+		return fmt.Errorf("%w: %w", ErrNegotiationFailed, err)
+	}
+	return nil
+}
+
+// checkClock compares issuedAt, unix ms pid stamped a message with, to the
+// node's clock. A peer off by more than the skew tolerated is flagged in
+// the Directory, and ErrClockSkew returned; one back in line is cleared.
+func (n *AgentNode) checkClock(pid peer.ID, issuedAt int64) error {
+	if issuedAt == 0 {
+		return nil
+	}
+	off := time.UnixMilli(issuedAt).Sub(n.Offers.now())
+	if off.Abs() <= n.Offers.skew() {
+		n.Directory.flagSkew(pid, 0)
+		return nil
+	}
+	n.Directory.flagSkew(pid, off)
+	fmt.Printf("[Negotiate] %s's clock is %s off ours\n", n.Names.Display(pid.String()), off)
+	return fmt.Errorf("%w: %s is %s off", ErrClockSkew, pid, off)
+}
+
+// sign adds our signature to a, and our wallet's if we have one.
+func (g *negotiation) sign(a *Agreement) error {
+	sig, err := g.key.Sign(a.signedBytes())
+	if err != nil {
+		return err
+	}
+	var wallet, walletSig string
+	if signer := g.n.signer(); signer != nil {
+		typed, err := signer.SignTypedData(a.TypedData())
+		if err != nil {
+			return fmt.Errorf("signing the agreement with %s: %w", signer.Account().Hex(), err)
+		}
+		wallet, walletSig = signer.Account().Hex(), hexutil.Encode(typed)
+	}
+	if g.buyer {
+		a.RequesterSig, a.RequesterWallet, a.RequesterWalletSig = base64.StdEncoding.EncodeToString(sig), wallet, walletSig
+	} else {
+		a.ResponderSig, a.ResponderWallet, a.ResponderWalletSig = base64.StdEncoding.EncodeToString(sig), wallet, walletSig
+	}
+	return nil
+}
+
+// save persists a signed agreement. A failure is logged, not returned: the
+// agreement binds both sides either way.
+func (g *negotiation) save(a Agreement) *Agreement {
+	a.CreatedAt = time.Now().UnixMilli()
+	if err := g.n.Store.SaveAgreement(a); err != nil {
+		fmt.Printf("[DB] Failed to save agreement %s: %v\n", a.NegotiationID, err)
+		g.n.Events.AddError("agreement_save_failed", err, map[string]string{"negotiationId": a.NegotiationID})
+	}
+	g.n.Events.Add("agreement", a)
+	return &a
+}
+
+func (g *negotiation) refuse(reason string) {
+	g.send(negotiationMessage{Type: negotiateReject, Reason: reason})
+}
+
+func (g *negotiation) send(m negotiationMessage) error {
+	data, _ := json.Marshal(m)
+	return writeLP(g.s, data)
+}
+
+// receive reads the next message, turning an error or moved answer into an
+// error.
+func (g *negotiation) receive() (negotiationMessage, error) {
+	data, err := readLP(g.s)
+	if err != nil {
+		return negotiationMessage{}, err
+	}
+	var m negotiationMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("unreadable negotiation message from %s: %w", g.peer, err)
+	}
+	switch m.Type {
+	case MessageError:
+		var msg AgentMessage
+		json.Unmarshal(data, &msg)
+		return m, peerError(g.peer, msg)
+	case MessageMoved:
+		return m, fmt.Errorf("peer %s has moved", g.peer)
+	}
+	return m, nil
+}
+
+func (s *sqlStore) SaveAgreement(a Agreement) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`
+		INSERT INTO agreements (negotiation_id, asset_hash, price, token, requester, responder, agreement, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(negotiation_id) DO NOTHING`,
+		a.NegotiationID, a.AssetHash, a.Price.String(), a.Token, a.Requester, a.Responder, string(data), a.CreatedAt)
+	return err
+}
+
+// GetAgreement returns the agreement a negotiation reached, or nil if there
+// is none.
+func (s *sqlStore) GetAgreement(negotiationID string) (*Agreement, error) {
+	var data string
+	err := s.queryRow("SELECT agreement FROM agreements WHERE negotiation_id = ?", negotiationID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var a Agreement
+	if err := json.Unmarshal([]byte(data), &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// ListAgreements returns every agreement, newest first.
+func (s *sqlStore) ListAgreements() ([]Agreement, error) {
+	rows, err := s.query("SELECT agreement FROM agreements ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Agreement
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var a Agreement
+		if err := json.Unmarshal([]byte(data), &a); err != nil {
+			return nil, err
+		}
+		results = append(results, a)
+	}
+	return results, rows.Err()
+}
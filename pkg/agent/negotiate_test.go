@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+)
+
+func TestNegotiationStrategies(t *testing.T) {
+	linear := func(start, limit int64) NegotiationStrategy {
+		return LinearConcession{Start: big.NewInt(start), Limit: big.NewInt(limit)}
+	}
+	firm := func(price int64) NegotiationStrategy { return TakeItOrLeaveIt{Price: big.NewInt(price)} }
+
+	cases := []struct {
+		name          string
+		opening       int64
+		buyer, seller NegotiationStrategy
+		price         int64 // agreed; 0 means no agreement
+	}{
+		// Buyer 50, 67, 84, 100; seller 150, 130, 110, then takes 100
+		{"linear against linear", 50, linear(50, 100), linear(150, 90), 100},
+		// The seller concedes 150, 123, 96 and takes the buyer's 80 over its 69
+		{"firm buyer", 80, firm(80), linear(150, 69), 80},
+		{"firm seller", 40, linear(40, 100), firm(90), 90},
+		{"firm against firm", 50, firm(50), firm(100), 0},
+		{"limits never meet", 10, linear(10, 50), linear(200, 80), 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := startTestNode(t), startTestNode(t)
+			b.SetNegotiationHandler(func(peerID string, offer Offer) NegotiationStrategy { return c.seller })
+			if _, err := a.addTarget(dialAddr(b)); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			opening := Offer{AssetHash: HashAsset([]byte(`{"capability":"summarize"}`)), Price: big.NewInt(c.opening)}
+			agreement, err := a.Negotiate(ctx, b.CurrentHost().ID().String(), opening, c.buyer)
+			if c.price == 0 {
+				if !errors.Is(err, ErrNegotiationFailed) {
+					t.Fatalf("Negotiate = %+v, %v; want ErrNegotiationFailed", agreement, err)
+				}
+				if saved, _ := a.Store.ListAgreements(); len(saved) != 0 {
+					t.Errorf("saved %d agreements after a failed negotiation", len(saved))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !agreement.Verify() || agreement.Price.Int64() != c.price || agreement.Rounds > DefaultNegotiationRounds {
+				t.Fatalf("agreement = %+v, want both signatures on %d", agreement, c.price)
+			}
+			if agreement.Requester != a.CurrentHost().ID().String() || agreement.Responder != b.CurrentHost().ID().String() {
+				t.Errorf("requester %s, responder %s", agreement.Requester, agreement.Responder)
+			}
+
+			// Both sides keep the same agreement
+			mine, err := a.Store.GetAgreement(agreement.NegotiationID)
+			if err != nil || mine == nil || mine.Hash() != agreement.Hash() {
+				t.Errorf("requester saved %+v, %v", mine, err)
+			}
+			var theirs *Agreement
+			for deadline := time.Now().Add(5 * time.Second); theirs == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				theirs, _ = b.Store.GetAgreement(agreement.NegotiationID)
+			}
+			if theirs == nil || !theirs.Verify() || theirs.Hash() != agreement.Hash() {
+				t.Errorf("responder saved %+v", theirs)
+			}
+		})
+	}
+}
+
+func TestNegotiationNeedsAWillingPeer(t *testing.T) {
+	a, b := startTestNode(t), startTestNode(t)
+	if _, err := a.addTarget(dialAddr(b)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opening := Offer{AssetHash: HashAsset([]byte("report")), Price: big.NewInt(1)}
+	_, err := a.Negotiate(ctx, b.CurrentHost().ID().String(), opening, TakeItOrLeaveIt{Price: big.NewInt(1)})
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Code != ErrCodeUnsupported {
+		t.Errorf("Negotiate with a node without a handler = %v, want %s", err, ErrCodeUnsupported)
+	}
+}
+
+// lateStrategy takes delay, by clock, to make its first decision.
+type lateStrategy struct {
+	NegotiationStrategy
+	clock *testutil.FakeClock
+	delay time.Duration
+	once  sync.Once
+}
+
+func (s *lateStrategy) Decide(state NegotiationState) NegotiationDecision {
+	s.once.Do(func() { s.clock.Advance(s.delay) })
+	return s.NegotiationStrategy.Decide(state)
+}
+
+// requoteAt quotes price again for an expired offer.
+type requoteAt struct {
+	TakeItOrLeaveIt
+	price int64
+}
+
+func (s requoteAt) Requote(Offer) *big.Int { return big.NewInt(s.price) }
+
+func TestOfferExpiry(t *testing.T) {
+	late := DefaultQuoteTTL + DefaultClockSkew + time.Second
+	firm := TakeItOrLeaveIt{Price: big.NewInt(100)}
+	cases := []struct {
+		name     string
+		delay    time.Duration // for the seller's acceptance to reach the buyer
+		buyer    NegotiationStrategy
+		rounds   int   // buyer's; 0 means the default
+		price    int64 // agreed; 0 means the late acceptance fails
+		agreedIn int
+	}{
+		{"accepted just before", DefaultQuoteTTL - time.Second, firm, 0, 100, 1},
+		{"accepted within the skew", DefaultQuoteTTL + DefaultClockSkew - time.Second, firm, 0, 100, 1},
+		{"accepted just after", late, firm, 0, 100, 2},
+		{"requoted", late, requoteAt{firm, 110}, 0, 110, 2},
+		{"no round to requote in", late, firm, 1, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := startTestNode(t), startTestNode(t)
+			now := time.UnixMilli(1700000000000)
+			clock := testutil.NewFakeClock(now)
+			a.Offers.Clock, b.Offers.Clock = clock, testutil.NewFakeClock(now)
+			// The seller's clock stands still, so it must tolerate the buyer's moving on
+			b.Offers.ClockSkew = 10 * time.Minute
+			a.NegotiationRounds = c.rounds
+			seller := &lateStrategy{NegotiationStrategy: TakeItOrLeaveIt{Price: big.NewInt(90)}, clock: clock, delay: c.delay}
+			b.SetNegotiationHandler(func(peerID string, offer Offer) NegotiationStrategy { return seller })
+			if _, err := a.addTarget(dialAddr(b)); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			opening := Offer{AssetHash: HashAsset([]byte("report")), Price: big.NewInt(100)}
+			agreement, err := a.Negotiate(ctx, b.CurrentHost().ID().String(), opening, c.buyer)
+			if c.price == 0 {
+				var expired *OfferExpiredError
+				if !errors.As(err, &expired) || !errors.Is(err, ErrNegotiationFailed) || expired.Round != 1 {
+					t.Fatalf("Negotiate = %+v, %v; want the offer expired", agreement, err)
+				}
+				if late := time.Duration(expired.AcceptedAt-expired.ExpiresAt) * time.Millisecond; late != DefaultClockSkew+time.Second {
+					t.Errorf("accepted %s late, want %s", late, DefaultClockSkew+time.Second)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !agreement.Verify() || agreement.Price.Int64() != c.price || agreement.Rounds != c.agreedIn {
+				t.Errorf("agreement = %+v, want %d in round %d", agreement, c.price, c.agreedIn)
+			}
+		})
+	}
+}
+
+func TestLateAnswerOffersThePriceBack(t *testing.T) {
+	a, b := startTestNode(t), startTestNode(t)
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	a.Offers.Clock, b.Offers.Clock = clock, clock
+	// The seller takes past the buyer's expiry to take its price
+	seller := &lateStrategy{NegotiationStrategy: TakeItOrLeaveIt{Price: big.NewInt(90)}, clock: clock, delay: DefaultQuoteTTL + DefaultClockSkew + time.Second}
+	b.SetNegotiationHandler(func(peerID string, offer Offer) NegotiationStrategy { return seller })
+	if _, err := a.addTarget(dialAddr(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opening := Offer{AssetHash: HashAsset([]byte("report")), Price: big.NewInt(100)}
+	agreement, err := a.Negotiate(ctx, b.CurrentHost().ID().String(), opening, TakeItOrLeaveIt{Price: big.NewInt(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agreement.Price.Int64() != 100 || agreement.Rounds != 2 {
+		t.Errorf("agreement = %+v, want the buyer's 100 offered back in round 2", agreement)
+	}
+}
+
+func TestSkewedPeersAreFlagged(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		ahead   time.Duration // b's clock, against a's
+		flagged bool
+	}{
+		{"within the tolerance", DefaultClockSkew - time.Second, false},
+		{"blatantly skewed", 5 * time.Minute, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := startTestNode(t), startTestNode(t)
+			now := time.UnixMilli(1700000000000)
+			a.Offers.Clock, b.Offers.Clock = testutil.NewFakeClock(now), testutil.NewFakeClock(now.Add(c.ahead))
+			b.SetNegotiationHandler(func(peerID string, offer Offer) NegotiationStrategy { return TakeItOrLeaveIt{Price: big.NewInt(90)} })
+			if _, err := a.addTarget(dialAddr(b)); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			opening := Offer{AssetHash: HashAsset([]byte("report")), Price: big.NewInt(100)}
+			_, err := a.Negotiate(ctx, b.CurrentHost().ID().String(), opening, TakeItOrLeaveIt{Price: big.NewInt(100)})
+			skew, flagged := b.Directory.ClockSkew(a.CurrentHost().ID())
+			if flagged != c.flagged {
+				t.Fatalf("flagged = %v (%s), want %v", flagged, skew, c.flagged)
+			}
+			if !c.flagged {
+				if err != nil {
+					t.Errorf("Negotiate within the tolerance: %v", err)
+				}
+				return
+			}
+			if skew != -c.ahead {
+				t.Errorf("skew = %s, want %s", skew, -c.ahead)
+			}
+			if !errors.Is(err, ErrNegotiationFailed) {
+				t.Errorf("Negotiate with a skewed peer = %v, want it refused", err)
+			}
+		})
+	}
+}
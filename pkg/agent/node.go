@@ -6,11 +6,18 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"net/http"
 	"sync"
 	"time"
 
+	"agentmesh/pkg/agent/canonical"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -18,7 +25,11 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
-	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multiaddr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -26,10 +37,37 @@ const (
 	KnowledgeDiscoveryTopic = "agentmesh:knowledge_discovery"
 	TaskProtocol            = "/agentmesh/task/1.0.0"
 	MemoryProtocol          = "/agentmesh/memory/1.0.0"
+	PingProtocol            = "/agentmesh/ping/1.0.0"
+	NegotiateProtocol       = "/agentmesh/negotiate/1.0.0"
+	CatalogProtocol         = "/agentmesh/catalog/1.0.0"
+	HistoryProtocol         = "/agentmesh/history/1.0.0"
+	PEXProtocol             = "/agentmesh/pex/1.0.0"
+	SessionProtocol         = "/agentmesh/session/1.0.0"
 )
 
+// MessageMoved is the AgentMessage type a rotated-out peer ID answers with;
+// its payload is a MovedNotice.
+const MessageMoved = "moved"
+
+// announceInterval is how often the node repeats its capability
+// announcements.
+const announceInterval = 5 * time.Second
+
 type CapabilityCallback func(peerID string, capability AgentCapability)
 
+// Announcement is a capability announcement as the node received it.
+// Verified is false when its signatures didn't verify and the node took it
+// anyway, under VerifyPermissive.
+type Announcement struct {
+	PeerID     string
+	EthAddress string
+	Capability AgentCapability
+	Verified   bool
+}
+
+// AnnouncementCallback gets each capability announcement the node accepts.
+type AnnouncementCallback func(a Announcement)
+
 // ReputationChecker is a function that verifies an agent's reputation.
 // Returns true if the agent is reputable, false otherwise.
 type ReputationChecker func(peerID string, ethAddress string) (bool, error)
@@ -40,28 +78,128 @@ type AgentNode struct {
 	DiscoveryTopic    *pubsub.Topic
 	KnowledgeTopic    *pubsub.Topic
 	Memory            *MemoryStore
+	Store             MetadataStore
 	Watcher           *EventWatcher
+	Elector           *LeaderElector
 	ERCClient         *ERC8004Client
+	Chains            []*Chain // deployments worked on, the primary first, whose client and watcher are also ERCClient and Watcher; nil on one chain
+	Wallet            *Wallet
+	Signer            Signer // signs agreements and receipts with EIP-712; nil for Wallet
+	MaxBlockLag       uint64 // readiness threshold for the watcher; 0 means DefaultMaxBlockLag
+	IdentityPath      string // key file rewritten by RotateIdentity, if set
+	Routes            *RoutingTable
+	Directory         *PeerDirectory       // verified peers and their announcements, shared over PEX
+	PEX               *PeerExchange        // swaps samples of the Directory with connected peers; nil disables it
+	Bootstrap         *BootstrapPeers      // dialed at startup and kept connected; nil for none
+	Latencies         *PeerLatencies       // round trips to routed peers, measured by Probe
+	Probe             *LatencyProbe        // pings the peers in Routes; nil disables it
+	Events            *EventLog            // recent activity, served by GET /events
+	Answers           *AnswerCache         // answers to repeated capability queries; nil to always run the handler
+	SignAnswer        AnswerSigner         // signs each capability answer for the requester it goes to; nil sends answers as they are
+	Capital           *CapitalTracker      // reserves each bid's stake against a budget; nil bids without one
+	Analytics         *CapabilityAnalytics // each capability run, by day, and SLO breaches; nil records none
+	Archive           *EventArchive        // the chain events acted on, by day; nil keeps none
+	Forwarding        bool                 // relay tasks for capabilities we don't serve to a capable peer
+	MaxHops           int                  // forwarding limit per task; 0 means DefaultMaxHops
+	Market            *KnowledgeMarket     // for POST /v1/knowledge/requests
+	APIToken          string               // bearer token for the /v1 API; empty disables it
+	APIAuth           string               // how the HTTP API authenticates: APIAuthBearer (the default), APIAuthHMAC or APIAuthNone
+	APISecret         string               // key requests are signed with under APIAuthHMAC
+	ResultsDir        string               // where local task results are written; empty means DefaultResultsDir
+	TaskDirRetention  TaskDirRetention     // what Start does with task scratch directories a crash left in the workspace
+	TracerProvider    trace.TracerProvider // spans for tasks, P2P streams and chain calls; nil disables tracing
+	Metrics           *Metrics             // task counters and latencies; nil disables them
+	History           *PeerHistory         // outcomes of exchanges with each counterparty
+	Selection         *SelectionPolicy     // ranks counterparties to forward and delegate to; nil keeps routing order
+	Ledger            *ReputationLedger    // the node's own reputation scores; nil keeps none
+	Workers           *TaskPool            // runs the tasks peers send; nil runs each on its stream's goroutine
+	StreamLimit       *StreamLimiter       // task streams each peer may have open at once; nil for no limit
+	Scheduler         *TaskScheduler       // orders the tasks submitted to the /v1 API
+	Writes            *WriteBatcher        // batches the event pipeline's and local task runner's writes; nil writes each at once
+	Publisher         *Publisher           // sends capability announcements off the announcer's goroutine; nil publishes each inline
+	Compression       *Compression         // compresses large task messages and announcements; nil sends them as they are
+	MaxDecompressed   int                  // bytes a received compressed payload may expand to; 0 means DefaultMaxDecompressed
+	AckTimeout        time.Duration        // how long a requester has to acknowledge delivered knowledge; 0 means DefaultAckTimeout
+	RedeliverAfter    time.Duration        // when an answer whose requester couldn't be reached is sent again; 0 waits for the next start
+	SettleKnowledge   SettleFunc           // called once a requester acknowledged an answer, e.g. to claim its bounty; nil settles at once
+	OnKnowledge       KnowledgeHandler     // gets the answers other nodes deliver to this one; nil only records them
+	Courtesy          *CourtesyReplies     // tells requesters of skipped tasks and knowledge requests why; nil stays silent
+	OnDecline         DeclineHandler       // gets the declines other nodes send this one; nil only records them
+	SessionTTL        time.Duration        // how long a session may sit idle before it is closed; 0 means DefaultSessionTTL
+	OnSessionClose    SessionCloseHandler  // told of sessions closed by either side or for idling; nil only records them
+	AnchorInterval    time.Duration        // how often countersigned interaction records are anchored on-chain; 0 never
+	Gossip            *GossipVerifier      // vets advertisers before they are routed to; nil trusts every valid advertisement
+	PublishPeerID     bool                 // point the wallet's agent at the node's peer ID at startup if it names another
+	Verification      VerificationMode     // what becomes of announcements and moved notices whose signatures don't verify; "" is VerifyStrict
+	NegotiationRounds int                  // offers a negotiation may take; 0 means DefaultNegotiationRounds
+	Offers            OfferTiming          // how long offered and quoted prices stand, and the clock skew tolerated
+	Guard             *PeerGuard           // scores protocol violations and bans repeat offenders; nil bans none
+	Resources         ResourceLimits       // connections, streams and memory libp2p may use; the zero value scales them to the machine
+	PeerRouting       routing.PeerRouting  // finds the addresses of peers the node can't otherwise reach, e.g. a DHT; nil for none
+	Relays            []peer.AddrInfo      // circuit relays to reach peers through when nothing else works
+	Names             *NameResolver        // names counterparties in the status, peer list, events and logs; nil shows raw identifiers
+	Policy            *IdentityPolicy      // counterparties the node deals with; nil allows all
+	DiagnosticConfig  map[string]string    // effective settings, secrets redacted, included in GET /diagnostics
+	capabilities      *CapabilitySet       // advertised; see advertised
+	announceOnce      sync.Once
+	catalog           *catalogState                // remote catalogs and the announcer's wake-up; see catalogs
+	commits           *commitLog                   // results delivered under commitment; see commitments
+	agentID           *big.Int                     // the wallet's agent, once found; see AgentID
+	bindings          map[string]capabilityBinding // manifest capabilities, by name
+	resources         *resourceReporter            // what the hosts' resource managers refused
 	onCapCallbacks    []CapabilityCallback
+	onAnnounce        []AnnouncementCallback
 	reputationChecker ReputationChecker
+	negotiator        NegotiationHandler
+	sessions          *sessionTable // loaded sessions and their handler; see sessionTable
 	mu                sync.RWMutex
 	ctx               context.Context
 	cancel            context.CancelFunc
 	privKey           crypto.PrivKey
+	listenAddrs       []multiaddr.Multiaddr
+	stack             *p2pStack
+	retiring          []host.Host // rotated-out identities in their grace period
+	api               *http.Server
+	grpc              *grpc.Server
+	grpcAddr          string
+	startedAt         time.Time
+	localOnce         sync.Once
+	localWG           sync.WaitGroup
+	lifecycle         lifecycleBus
+	bootSteps         []BootStep
+	boot              bootGraph
 }
 
+// NewAgentNode creates a node backed by the SQLite database at dbPath.
 func NewAgentNode(dbPath string, workspacePath string) (*AgentNode, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	store, err := NewMemoryStore(dbPath, workspacePath)
+	store, err := OpenMetadataStore(DriverSQLite, dbPath)
 	if err != nil {
-		cancel()
 		return nil, err
 	}
+	return NewAgentNodeWithStore(store, workspacePath), nil
+}
+
+// NewAgentNodeWithStore creates a node on an already opened MetadataStore,
+// e.g. a Postgres store shared by several node processes.
+func NewAgentNodeWithStore(store MetadataStore, workspacePath string) *AgentNode {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &AgentNode{
-		ctx:    ctx,
-		cancel: cancel,
-		Memory: store,
-	}, nil
+		ctx:         ctx,
+		cancel:      cancel,
+		Memory:      NewMemoryStoreWithMetadata(store, workspacePath),
+		Store:       store,
+		Routes:      NewRoutingTable(DefaultRouteTTL),
+		Directory:   NewPeerDirectory(DefaultRouteTTL),
+		Latencies:   NewPeerLatencies(),
+		History:     NewPeerHistory(),
+		Events:      NewEventLog(DefaultEventBuffer),
+		Workers:     NewTaskPool(DefaultTaskWorkers, DefaultTaskQueue),
+		StreamLimit: NewStreamLimiter(DefaultStreamsPerPeer),
+		Scheduler:   NewTaskScheduler(DefaultLocalQueueSize),
+		Guard:       NewPeerGuard(store, DefaultMisbehaviorConfig()),
+		Publisher:   NewPublisher(DefaultPublishBuffer),
+		resources:   newResourceReporter(),
+	}
 }
 
 // SetReputationChecker sets a custom function that is called to verify an agent's reputation.
@@ -71,161 +209,326 @@ func (n *AgentNode) SetReputationChecker(checker ReputationChecker) {
 	n.reputationChecker = checker
 }
 
-func (n *AgentNode) Start(listenAddr string) error {
-	// Generate or load identity
-	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+// SetIdentity sets the libp2p key used by Start. Without it, Start generates
+// an ephemeral identity.
+func (n *AgentNode) SetIdentity(priv crypto.PrivKey) {
+	n.privKey = priv
+}
+
+// CurrentHost returns the host of the node's current identity. Code running
+// alongside the node must use it rather than the Host field, which
+// RotateIdentity swaps while the node runs.
+func (n *AgentNode) CurrentHost() host.Host {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.Host
+}
+
+func (n *AgentNode) Start(listenAddrs ...string) error {
+	addrs, err := ParseListenAddrs(listenAddrs)
 	if err != nil {
-		return fmt.Errorf("failed to generate key: %w", err)
+		return err
 	}
-	n.privKey = priv
 
+	// Use the configured identity or fall back to an ephemeral one
+	priv := n.privKey
+	if priv == nil {
+		var err error
+		priv, _, err = crypto.GenerateKeyPair(crypto.Ed25519, -1)
+		if err != nil {
+			return fmt.Errorf("failed to generate key: %w", err)
+		}
+		n.privKey = priv
+	}
+
+	n.listenAddrs = addrs
+
+	// The store and host come up together; the chain doesn't hold them up
+	var rotations []KeyRotation
+	steps := []BootStep{
+		{Name: "store", Run: func(context.Context) error {
+			rotations = n.pendingRotations()
+			return nil
+		}},
+		n.taskDirsStep(),
+		{Name: "host", After: []string{"workspace"}, Run: func(context.Context) error { return n.startP2P(priv) }},
+		{Name: "rotations", After: []string{"store", "host"}, Run: func(context.Context) error {
+			n.resumeRotations(rotations)
+			return nil
+		}},
+		n.deliveriesStep(),
+		n.catalogStep(),
+		n.historyStep(),
+		n.bootstrapStep(),
+		n.pexStep(),
+		n.probeStep(),
+		n.sessionsStep(),
+		n.capitalStep(),
+		n.analyticsStep(),
+		n.archiveStep(),
+	}
+	if n.ERCClient != nil {
+		steps = append(steps, n.chainStep())
+		if n.Wallet != nil {
+			steps = append(steps, n.agentStep())
+		}
+	}
+	n.mu.RLock()
+	steps = append(steps, n.bootSteps...)
+	n.mu.RUnlock()
+	if err := n.boot.run(n.ctx, steps); err != nil {
+		return err
+	}
+	n.Metrics.watchPool(n.Workers)
+	n.Metrics.watchStreams(n.StreamLimit)
+	n.Metrics.watchRPCCache(n.ERCClient.RPCCache())
+	n.Metrics.watchAnswerCache(n.Answers)
+	n.Metrics.watchReadPool(n.ERCClient.ReadPool())
+	n.Metrics.watchWrites(n.Writes)
+	n.Metrics.watchPrefilter(n.Watcher.Prefilter())
+	n.Metrics.watchPublisher(n.Publisher)
+	n.Metrics.watchBootstrap(n.Bootstrap)
+	n.Metrics.watchCatchUp(n.watchers())
+	n.Metrics.watchResources(n.resources)
+	n.Events.useNames(n.Names)
+	n.startedAt = time.Now()
+
+	return nil
+}
+
+// p2pStack is one identity's host with its pubsub subscriptions. Rotating
+// the identity starts a new stack and stops the old one's pubsub.
+type p2pStack struct {
+	host   host.Host
+	topics []*pubsub.Topic
+	subs   []*pubsub.Subscription
+}
+
+// stop leaves pubsub; the host itself stays open.
+func (st *p2pStack) stop() {
+	if st == nil {
+		return
+	}
+	for _, sub := range st.subs {
+		sub.Cancel()
+	}
+	for _, t := range st.topics {
+		t.Close()
+	}
+}
+
+func (n *AgentNode) newHost(priv crypto.PrivKey, listenAddrs []multiaddr.Multiaddr) (host.Host, error) {
 	// Resource Manager for DoS protection
-	limiter := rcmgr.NewFixedLimiter(rcmgr.InfiniteLimits)
-	rm, err := rcmgr.NewResourceManager(limiter)
+	rm, err := n.Resources.resourceManager(n.resources)
 	if err != nil {
-		return fmt.Errorf("failed to create resource manager: %w", err)
+		return nil, err
 	}
 
-	h, err := libp2p.New(
-		libp2p.ListenAddrStrings(listenAddr),
+	return libp2p.New(
+		libp2p.ListenAddrs(listenAddrs...),
+		transportOptions,
 		libp2p.Identity(priv),
 		libp2p.ResourceManager(rm),
+		libp2p.ConnectionGater(peerGater{n}),
 	)
+}
+
+// startP2P brings up a host for priv, joins the topics and installs the
+// protocol handlers, making it the node's primary identity.
+func (n *AgentNode) startP2P(priv crypto.PrivKey) error {
+	h, err := n.newHost(priv, n.listenAddrs)
+	if err != nil && n.CurrentHost() != nil {
+		// The old identity still holds fixed listen ports during rotation
+		fmt.Printf("[P2P] %v unavailable (%v), listening on ephemeral ports\n", n.listenAddrs, err)
+		h, err = n.newHost(priv, ephemeralAddrs(n.listenAddrs))
+	}
 	if err != nil {
 		return err
 	}
-	n.Host = h
 
 	// Note: DHT disabled temporarily due to Go toolchain issue
 	// Will be re-enabled once toolchain is fixed
 
-	ps, err := pubsub.NewGossipSub(n.ctx, n.Host)
-	if err != nil {
+	fail := func(err error) error {
+		h.Close()
 		return err
 	}
-	n.PubSub = ps
 
-	topic, err := n.PubSub.Join(DiscoveryTopic)
+	ps, err := pubsub.NewGossipSub(n.ctx, h)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	n.DiscoveryTopic = topic
 
-	kTopic, err := n.PubSub.Join(KnowledgeDiscoveryTopic)
+	topic, err := ps.Join(DiscoveryTopic)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	n.KnowledgeTopic = kTopic
 
-	sub, err := n.DiscoveryTopic.Subscribe()
+	kTopic, err := ps.Join(KnowledgeDiscoveryTopic)
 	if err != nil {
-		return err
+		return fail(err)
 	}
 
-	kSub, err := n.KnowledgeTopic.Subscribe()
+	sub, err := topic.Subscribe()
 	if err != nil {
-		return err
+		return fail(err)
 	}
 
-	go n.discoveryLoop(sub)
-	go n.knowledgeDiscoveryLoop(kSub)
-	n.SetupHandlers()
+	kSub, err := kTopic.Subscribe()
+	if err != nil {
+		return fail(err)
+	}
 
+	n.mu.Lock()
+	n.Host = h
+	n.PubSub = ps
+	n.DiscoveryTopic = topic
+	n.KnowledgeTopic = kTopic
+	n.privKey = priv
+	n.stack = &p2pStack{host: h, topics: []*pubsub.Topic{topic, kTopic}, subs: []*pubsub.Subscription{sub, kSub}}
+	n.mu.Unlock()
+
+	go n.discoveryLoop(h, sub)
+	go n.knowledgeDiscoveryLoop(h, kSub)
+	n.SetupHandlers()
 	return nil
 }
 
-func (n *AgentNode) discoveryLoop(sub *pubsub.Subscription) {
+func (n *AgentNode) discoveryLoop(h host.Host, sub *pubsub.Subscription) {
 	for {
 		msg, err := sub.Next(n.ctx)
 		if err != nil {
 			return
 		}
 
-		if msg.ReceivedFrom == n.Host.ID() {
+		if msg.ReceivedFrom == h.ID() {
 			continue
 		}
 
-		var packet SignedPacket
-		if err := json.Unmarshal(msg.Data, &packet); err != nil {
+		data, err := n.receivedPubsubData(msg.Data)
+		if err != nil {
+			n.ReportMisbehavior(msg.GetFrom().String(), payloadViolation(err))
 			continue
 		}
-
-		// Verify signature
-		if !n.verifySignature(packet) {
-			fmt.Printf("[Security] Rejected packet from %s: invalid signature\n", packet.PeerID)
+		var packet SignedPacket
+		if err := json.Unmarshal(data, &packet); err != nil {
+			n.ReportMisbehavior(msg.GetFrom().String(), ViolationProtocolError)
 			continue
 		}
-
-		// Data is now a JSON string, parse it
-		var data struct {
-			Capability AgentCapability `json:"capability"`
-			EthAddress string          `json:"ethAddress,omitempty"`
-		}
-		if err := json.Unmarshal([]byte(packet.Data), &data); err != nil {
-			continue
+		// Pubsub signs messages, so a forgery is the author's, not the relay's
+		if !n.handleAdvertisement(packet) {
+			n.ReportMisbehavior(msg.GetFrom().String(), ViolationBadSignature)
 		}
+	}
+}
 
-		// Reputation check (if configured)
-		n.mu.RLock()
-		checker := n.reputationChecker
-		n.mu.RUnlock()
+// handleAdvertisement routes to the sender of a capability announcement once
+// its signatures and reputation check out. It reports false when a signature
+// doesn't verify and the announcement was rejected for it.
+func (n *AgentNode) handleAdvertisement(packet SignedPacket) bool {
+	if n.Store.IsPeerBlocked(packet.PeerID) {
+		return true
+	}
 
-		if checker != nil && data.EthAddress != "" {
-			reputable, err := checker(packet.PeerID, data.EthAddress)
-			if err != nil || !reputable {
-				fmt.Printf("[Reputation] Rejected agent %s (Eth: %s): low or invalid reputation\n", packet.PeerID, data.EthAddress)
-				continue
-			}
-		}
+	// Verify signature
+	accept, verified := n.Verification.admit("packet", packet.PeerID, packet.Verify)
+	if !accept {
+		return false
+	}
 
-		n.mu.RLock()
-		callbacks := make([]CapabilityCallback, len(n.onCapCallbacks))
-		copy(callbacks, n.onCapCallbacks)
-		n.mu.RUnlock()
+	// Data is now a JSON string, parse it
+	var data struct {
+		Capability AgentCapability `json:"capability"`
+		EthAddress string          `json:"ethAddress,omitempty"`
+		Timestamp  int64           `json:"timestamp"`
+	}
+	if err := json.Unmarshal([]byte(packet.Data), &data); err != nil {
+		return true
+	}
 
-		for _, cb := range callbacks {
-			cb(packet.PeerID, data.Capability)
+	walletProven := packet.WalletSig != ""
+	if walletProven {
+		accept, walletProven = n.Verification.admit("wallet signature for "+data.EthAddress, packet.PeerID, func() bool {
+			return n.verifyWalletSig(data.EthAddress, packet)
+		})
+		if !accept {
+			return false
 		}
+		verified = verified && walletProven
 	}
-}
 
-// signData signs the data using the node's private key.
-func (n *AgentNode) signData(data []byte) (string, error) {
-	rawKey, err := n.privKey.Raw()
-	if err != nil {
-		return "", err
+	// Peers not yet verified are heard at a limited rate, so a flood of
+	// fresh peer IDs can't fill the table
+	pid, err := peer.Decode(packet.PeerID)
+	if err != nil || !n.Routes.Admit(pid) {
+		return true
 	}
-	// Ed25519 private key is 64 bytes (seed + public key), but crypto/ed25519 expects 64 bytes
-	privKey := ed25519.PrivateKey(rawKey)
-	sig := ed25519.Sign(privKey, data)
-	return base64.StdEncoding.EncodeToString(sig), nil
-}
 
-// verifySignature verifies the signature on a SignedPacket.
-func (n *AgentNode) verifySignature(packet SignedPacket) bool {
-	// Decode the PeerID to get the public key
-	pid, err := peer.Decode(packet.PeerID)
-	if err != nil {
-		return false
+	// Reputation check (if configured)
+	n.mu.RLock()
+	checker := n.reputationChecker
+	n.mu.RUnlock()
+
+	if checker != nil && data.EthAddress != "" {
+		reputable, err := checker(packet.PeerID, data.EthAddress)
+		if err != nil || !reputable {
+			fmt.Printf("[Reputation] Rejected agent %s (Eth: %s): low or invalid reputation\n", packet.PeerID, n.Names.Display(data.EthAddress))
+			return true
+		}
 	}
 
-	pubKey, err := pid.ExtractPublicKey()
-	if err != nil {
-		return false
+	if err := n.Store.TouchPeer(packet.PeerID, data.EthAddress, data.Capability.Name); err != nil {
+		fmt.Printf("[DB] Failed to record peer %s: %v\n", packet.PeerID, err)
+		n.Events.AddError("peer_record_failed", err, map[string]string{"peerId": packet.PeerID})
+	}
+	if data.Capability.Name != "" {
+		// A capability is routed by its name and, if it has a valid one, its
+		// identifier. The wallet signature was checked above, if there was
+		// one; an announcement taken unverified stays quarantined
+		keys := []string{data.Capability.Name}
+		if _, err := ParseCapabilityID(data.Capability.ID); err == nil {
+			keys = append(keys, data.Capability.ID)
+		}
+		vetted := verified && n.Gossip.Verify(n.ctx, packet.PeerID, data.EthAddress, walletProven).Verified
+		for _, key := range keys {
+			if vetted {
+				n.Routes.Add(key, pid)
+			} else {
+				n.Routes.Quarantine(key, pid)
+			}
+		}
+		if vetted {
+			n.Directory.observe(pid, data.Capability.Name, packet, time.UnixMilli(data.Timestamp))
+		}
 	}
 
-	rawPub, err := pubKey.Raw()
-	if err != nil {
-		return false
+	n.mu.RLock()
+	callbacks := make([]CapabilityCallback, len(n.onCapCallbacks))
+	copy(callbacks, n.onCapCallbacks)
+	announced := make([]AnnouncementCallback, len(n.onAnnounce))
+	copy(announced, n.onAnnounce)
+	n.mu.RUnlock()
+
+	for _, cb := range callbacks {
+		cb(packet.PeerID, data.Capability)
+	}
+	a := Announcement{PeerID: packet.PeerID, EthAddress: data.EthAddress, Capability: data.Capability, Verified: verified}
+	for _, cb := range announced {
+		cb(a)
 	}
+	return true
+}
 
-	sig, err := base64.StdEncoding.DecodeString(packet.Signature)
+// signData signs the data with a node identity key.
+func signData(priv crypto.PrivKey, data []byte) (string, error) {
+	rawKey, err := priv.Raw()
 	if err != nil {
-		return false
+		return "", err
 	}
-
-	// Data is now stored as the exact JSON string that was signed
-	return ed25519.Verify(rawPub, []byte(packet.Data), sig)
+	// Ed25519 private key is 64 bytes (seed + public key), but crypto/ed25519 expects 64 bytes
+	privKey := ed25519.PrivateKey(rawKey)
+	sig := ed25519.Sign(privKey, data)
+	return base64.StdEncoding.EncodeToString(sig), nil
 }
 
 func (n *AgentNode) OnCapability(cb CapabilityCallback) {
@@ -234,122 +537,315 @@ func (n *AgentNode) OnCapability(cb CapabilityCallback) {
 	n.onCapCallbacks = append(n.onCapCallbacks, cb)
 }
 
+// OnAnnouncement registers cb for every capability announcement the node
+// accepts, with whether its signatures verified.
+func (n *AgentNode) OnAnnouncement(cb AnnouncementCallback) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onAnnounce = append(n.onAnnounce, cb)
+}
+
 func (n *AgentNode) AdvertiseCapability(capability AgentCapability) {
 	n.AdvertiseCapabilityWithEth(capability, "")
 }
 
 // AdvertiseCapabilityWithEth advertises with an optional Ethereum address for reputation lookup.
+// Advertising starts once the node is ready, so peers aren't sent work the
+// node can't take yet.
 func (n *AgentNode) AdvertiseCapabilityWithEth(capability AgentCapability, ethAddress string) {
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-
-		broadcast := func() {
-			data := map[string]interface{}{
-				"capability": capability,
-				"timestamp":  time.Now().UnixMilli(),
-			}
-			if ethAddress != "" {
-				data["ethAddress"] = ethAddress
-			}
+	n.advertise(ethAddress, capability)
+}
 
-			dataBytes, _ := json.Marshal(data)
-			sig, err := n.signData(dataBytes)
-			if err != nil {
-				fmt.Printf("[Signing Error] %v\n", err)
-				return
-			}
+// WithdrawCapability stops advertising the named capability, reporting
+// whether it was advertised. Peers drop their route to the node once it
+// expires.
+func (n *AgentNode) WithdrawCapability(name string) bool {
+	return n.advertised().Remove(name) > 0
+}
 
-			packet := SignedPacket{
-				Data:      string(dataBytes), // Store as string for deterministic verification
-				PeerID:    n.Host.ID().String(),
-				Signature: sig,
-			}
-			bytes, _ := json.Marshal(packet)
-			n.DiscoveryTopic.Publish(n.ctx, bytes)
-		}
+// AdvertisedCapabilities returns the capabilities the node advertises,
+// sorted by name.
+func (n *AgentNode) AdvertisedCapabilities() []AgentCapability {
+	return n.advertised().Snapshot()
+}
 
-		broadcast()
-		for {
-			select {
-			case <-n.ctx.Done():
-				return
-			case <-ticker.C:
-				broadcast()
-			}
+// advertised returns the node's capability set, creating it on first use.
+func (n *AgentNode) advertised() *CapabilitySet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.capabilities == nil {
+		n.capabilities = NewCapabilitySet()
+	}
+	return n.capabilities
+}
+
+// advertise adds caps to the advertised set as one change and starts the
+// announcer on first use.
+func (n *AgentNode) advertise(ethAddress string, caps ...AgentCapability) {
+	set := n.advertised()
+	set.Add(ethAddress, caps...)
+	n.announceOnce.Do(func() { go n.announce(set) })
+}
+
+// announce publishes every advertised capability every announceInterval and
+// whenever the set changes, until the node stops. Each round publishes one
+// snapshot of the set, under one identity.
+func (n *AgentNode) announce(set *CapabilitySet) {
+	if err := n.WaitReady(n.ctx); err != nil {
+		return
+	}
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		n.broadcastCapabilities(set.snapshot())
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-set.changed:
 		}
-	}()
+	}
 }
 
-func (n *AgentNode) SetupHandlers() {
-	n.Host.SetStreamHandler(protocol.ID(TaskProtocol), func(s network.Stream) {
-		defer s.Close()
+// broadcastCapabilities announces each capability on the discovery topic.
+func (n *AgentNode) broadcastCapabilities(caps []advertisedCapability) {
+	// Announce under the current identity, which rotation may have changed
+	n.mu.RLock()
+	h, topic, priv := n.Host, n.DiscoveryTopic, n.privKey
+	n.mu.RUnlock()
 
-		data, err := readLP(s)
+	for _, c := range caps {
+		packet, err := n.capabilityPacket(h, priv, c)
 		if err != nil {
+			fmt.Printf("[Signing Error] %v\n", err)
+			continue
+		}
+		bytes, _ := json.Marshal(packet)
+		bytes = n.pubsubData(bytes)
+		if n.Publisher != nil {
+			n.Publisher.Publish(topic, bytes)
+		} else if err := topic.Publish(n.ctx, bytes); err != nil && n.ctx.Err() == nil {
+			fmt.Printf("[PubSub] Publish failed: %v\n", err)
+		}
+	}
+}
+
+// capabilityPacket is the signed announcement of c by the identity of h,
+// whose key is priv.
+func (n *AgentNode) capabilityPacket(h host.Host, priv crypto.PrivKey, c advertisedCapability) (SignedPacket, error) {
+	data := map[string]interface{}{
+		"capability": c.AgentCapability,
+		"timestamp":  time.Now().UnixMilli(),
+	}
+	if c.ethAddress != "" {
+		data["ethAddress"] = c.ethAddress
+	}
+
+	dataBytes, err := canonical.Marshal(data)
+	if err != nil {
+		return SignedPacket{}, err
+	}
+	sig, err := signData(priv, dataBytes)
+	if err != nil {
+		return SignedPacket{}, err
+	}
+
+	packet := SignedPacket{
+		Data:      string(dataBytes), // canonical JSON, sent as the exact bytes signed
+		PeerID:    h.ID().String(),
+		Signature: sig,
+	}
+	// Prove the advertised address is ours when we hold its key
+	if n.Wallet != nil && common.HexToAddress(c.ethAddress) == n.Wallet.Address {
+		if walletSig, err := n.Wallet.SignMessage(dataBytes); err == nil {
+			packet.WalletSig = hexutil.Encode(walletSig)
+		}
+	}
+	return packet, nil
+}
+
+func (n *AgentNode) SetupHandlers() {
+	// Every failure is answered with an error message carrying an
+	// ErrorPayload, so peers never have to guess from a reset stream
+	h := n.CurrentHost()
+	h.SetStreamHandler(protocol.ID(TaskProtocol), n.handleStream("task", func(s network.Stream) {
+		if n.checkBlocked(s) {
+			return
+		}
+		release, ok := n.admitStream(s)
+		if !ok {
+			return
+		}
+		defer release()
+		data, ok := n.readRequest(s)
+		if !ok {
 			return
 		}
 
 		var msg AgentMessage
 		if err := json.Unmarshal(data, &msg); err != nil {
+			n.misbehaved(s, ViolationProtocolError)
+			n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "invalid JSON: " + err.Error()})
+			return
+		}
+		n.noteEncodings(s.Conn().RemotePeer(), &msg)
+		if err := n.decodePayload(&msg); err != nil {
+			n.misbehaved(s, payloadViolation(err))
+			n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "unreadable payload: " + err.Error()})
+			return
+		}
+		switch msg.Type {
+		case MessageKnowledge:
+			n.receiveKnowledge(s, msg)
+			return
+		case MessageDecline:
+			n.receiveDecline(s, msg)
+			return
+		}
+		if msg.Type != "task" {
+			n.replyError(s, ErrorPayload{Code: ErrCodeUnsupported, Message: fmt.Sprintf("unsupported message type %q", msg.Type)})
 			return
 		}
 
-		if msg.Type == "task" {
-			response := AgentMessage{
-				Type: "response",
-				Payload: map[string]interface{}{
-					"status":  "success",
-					"agent":   n.Host.ID().String(),
-					"message": "Task processed successfully",
-				},
-				Sender:    n.Host.ID().String(),
-				Timestamp: time.Now().UnixMilli(),
+		// The span continues the sender's trace, so a delegated task shows
+		// up as one trace across nodes
+		capability := taskCapability(msg.Payload)
+		ctx, span := n.tracer().Start(extractTrace(n.ctx, msg), "p2p.handle_task", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("agentmesh.peer", s.Conn().RemotePeer().String()), capabilityAttr(capability)))
+		defer span.End()
+
+		// Responses carry the task's correlation ID, and results are
+		// committed to before they are sent when the sender asked
+		reply := func(resp AgentMessage) {
+			resp.ID = msg.ID
+			if resp.result != nil {
+				// Streams aren't committed to, since their hash is only
+				// known at the end; a committing sender gets them whole
+				if err := n.sendStream(s, resp, msg.Stream && !msg.Commit); err != nil {
+					fmt.Printf("[P2P] Streaming the result of %s to %s failed: %v\n", msg.ID, s.Conn().RemotePeer(), err)
+				}
+				return
+			}
+			// Large responses are compressed if the sender reads them so
+			resp.AcceptEncoding = acceptedEncodings
+			n.compressMessage(&resp, msg.AcceptEncoding)
+			respBytes, _ := json.Marshal(resp)
+			if msg.Commit && resp.Type != MessageError {
+				n.commitResult(s, msg.ID, respBytes)
+				return
 			}
-			respBytes, _ := json.Marshal(response)
 			writeLP(s, respBytes)
 		}
-	})
-
-	n.Host.SetStreamHandler(protocol.ID(MemoryProtocol), func(s network.Stream) {
-		defer s.Close()
+		taskID := peerTaskID(msg)
+		n.EmitLifecycle(LifecycleEvent{TaskID: taskID, Stage: StageReceived, Capability: capability, Peer: s.Conn().RemotePeer().String()})
+		if b, ok := n.binding(capability); ok {
+			n.runTask(ctx, taskID, capability, reply, func() { reply(n.serveCapability(ctx, taskID, b, msg)) })
+			return
+		}
+		if n.Forwarding && capability != "" && !n.serves(capability) {
+			from := s.Conn().RemotePeer()
+			n.runTask(ctx, taskID, capability, reply, func() { reply(n.forwardTask(ctx, taskID, msg, capability, from)) })
+			return
+		}
 
-		data, err := readLP(s)
-		if err != nil {
+		n.taskStage(taskID, StageCompleted, capability, nil)
+
+		reply(AgentMessage{
+			Type: "response",
+			Payload: map[string]interface{}{
+				"status":  "success",
+				"agent":   s.Conn().LocalPeer().String(),
+				"message": "Task processed successfully",
+			},
+			Sender:    s.Conn().LocalPeer().String(),
+			Timestamp: time.Now().UnixMilli(),
+		})
+	}))
+
+	h.SetStreamHandler(protocol.ID(PingProtocol), n.handleStream("ping", func(s network.Stream) {
+		if _, ok := n.readRequest(s); !ok {
 			return
 		}
+		data, _ := json.Marshal(PingResponse{PeerID: s.Conn().LocalPeer().String(), Time: time.Now().UnixMilli()})
+		writeLP(s, data)
+	}))
 
-		var req struct {
-			Type      string `json:"type"`
-			TopicHash string `json:"topicHash"`
+	h.SetStreamHandler(protocol.ID(MemoryProtocol), n.handleStream("memory", func(s network.Stream) {
+		if n.checkBlocked(s) {
+			return
+		}
+		data, ok := n.readRequest(s)
+		if !ok {
+			return
 		}
+
+		var req memoryRequest
 		if err := json.Unmarshal(data, &req); err != nil {
+			n.misbehaved(s, ViolationProtocolError)
+			n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "invalid JSON: " + err.Error()})
+			return
+		}
+		if req.Type != "get_memory" {
+			n.replyError(s, ErrorPayload{Code: ErrCodeUnsupported, Message: fmt.Sprintf("unsupported request type %q", req.Type)})
 			return
 		}
 
-		if req.Type == "get_memory" {
-			chunk, err := n.Memory.GetMemory(req.TopicHash)
-			if err == nil && chunk != nil {
-				respBytes, _ := json.Marshal(chunk)
-				writeLP(s, respBytes)
+		if req.Stream {
+			n.serveMemoryStream(s, req.TopicHash)
+			return
+		}
+		chunk, err := n.Memory.GetMemory(req.TopicHash)
+		switch {
+		case errors.Is(err, errAccessDenied):
+			n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: err.Error()})
+		case err != nil:
+			n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "failed to read memory", Retryable: true})
+		case chunk == nil:
+			n.replyError(s, ErrorPayload{Code: ErrCodeNotFound, Message: fmt.Sprintf("no memory for %q", req.TopicHash)})
+		default:
+			if err := writeMessage(s, chunk); err != nil {
+				n.misbehaved(s, ViolationAbandonedTransfer)
 			}
 		}
-	})
+	}))
+
+	h.SetStreamHandler(protocol.ID(NegotiateProtocol), n.handleStream("negotiate", n.handleNegotiation))
+	h.SetStreamHandler(protocol.ID(CatalogProtocol), n.handleStream("catalog", n.handleCatalog))
+	h.SetStreamHandler(protocol.ID(HistoryProtocol), n.handleStream("history", n.handleInteraction))
+	h.SetStreamHandler(protocol.ID(SessionProtocol), n.handleStream("session", n.handleSession))
+	if n.PEX != nil {
+		h.SetStreamHandler(protocol.ID(PEXProtocol), n.handleStream("pex", n.handlePEX))
+	}
 }
 
-func (n *AgentNode) knowledgeDiscoveryLoop(sub *pubsub.Subscription) {
+func (n *AgentNode) knowledgeDiscoveryLoop(h host.Host, sub *pubsub.Subscription) {
 	for {
 		msg, err := sub.Next(n.ctx)
 		if err != nil {
 			return
 		}
 
-		if msg.ReceivedFrom == n.Host.ID() {
+		if msg.ReceivedFrom == h.ID() {
+			continue
+		}
+
+		data, err := n.receivedPubsubData(msg.Data)
+		if err != nil {
+			n.ReportMisbehavior(msg.GetFrom().String(), payloadViolation(err))
+			continue
+		}
+
+		// Catalogs are announced signed; queries aren't
+		var packet SignedPacket
+		if err := json.Unmarshal(data, &packet); err == nil && packet.Signature != "" {
+			if !n.handleCatalogAnnouncement(packet) {
+				n.ReportMisbehavior(msg.GetFrom().String(), ViolationBadSignature)
+			}
 			continue
 		}
 
 		var query KnowledgeDiscoveryMsg
-		if err := json.Unmarshal(msg.Data, &query); err != nil {
+		if err := json.Unmarshal(data, &query); err != nil {
 			continue
 		}
 
@@ -374,30 +870,129 @@ func (n *AgentNode) knowledgeDiscoveryLoop(sub *pubsub.Subscription) {
 	}
 }
 
-func (n *AgentNode) SendTask(ctx context.Context, targetAddr string, payload interface{}) (interface{}, error) {
+// addTarget accepts a full multiaddr with /p2p/ or a bare peer ID and
+// returns the peer ID, remembering any addresses given.
+func (n *AgentNode) addTarget(targetAddr string) (peer.ID, error) {
 	info, err := peer.AddrInfoFromString(targetAddr)
-	var pid peer.ID
 	if err != nil {
-		pid, err = peer.Decode(targetAddr)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		pid = info.ID
-		n.Host.Peerstore().AddAddrs(pid, info.Addrs, time.Hour)
+		return peer.Decode(targetAddr)
+	}
+	n.CurrentHost().Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
+	return info.ID, nil
+}
+
+// SendTask sends a task to a peer and returns the response payload. A peer
+// that rotated its identity answers with a signed MovedNotice, which is
+// followed once to the new peer ID.
+// A peer that fails the task answers with an error message, returned as a
+// *PeerError.
+func (n *AgentNode) SendTask(ctx context.Context, targetAddr string, payload interface{}) (interface{}, error) {
+	pid, err := n.addTarget(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.permit(pid, PolicyActionDeliver); err != nil {
+		return nil, err
 	}
+	resp, err := n.exchangeFollowingMoves(ctx, pid, n.taskMessage(payload))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Payload, nil
+}
 
-	s, err := n.Host.NewStream(ctx, pid, protocol.ID(TaskProtocol))
+// SendTaskStream sends a task to a peer, like SendTask, and returns its
+// result as a stream. A result the handler streams is read from the peer as
+// it is needed, so it never has to fit in memory; any other result comes as
+// its JSON, through AsStream. The caller must read or Close the result.
+func (n *AgentNode) SendTaskStream(ctx context.Context, targetAddr string, payload interface{}) (*StreamResult, error) {
+	pid, err := n.addTarget(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.permit(pid, PolicyActionDeliver); err != nil {
+		return nil, err
+	}
+	msg := n.taskMessage(payload)
+	msg.Stream = true
+	resp, err := n.exchangeFollowingMoves(ctx, pid, msg)
 	if err != nil {
 		return nil, err
 	}
-	defer s.Close()
+	if resp.result != nil {
+		return resp.result, nil
+	}
+	return AsStream(resp.Payload)
+}
 
-	msg := AgentMessage{
+// taskMessage wraps payload in a task message from this node.
+func (n *AgentNode) taskMessage(payload interface{}) AgentMessage {
+	return AgentMessage{
+		ID:        newMessageID(),
 		Type:      "task",
 		Payload:   payload,
-		Sender:    n.Host.ID().String(),
+		Sender:    n.CurrentHost().ID().String(),
 		Timestamp: time.Now().UnixMilli(),
+
+		AcceptEncoding: acceptedEncodings,
+	}
+}
+
+// exchangeFollowingMoves is exchange, following a moved notice once.
+func (n *AgentNode) exchangeFollowingMoves(ctx context.Context, pid peer.ID, msg AgentMessage) (*AgentMessage, error) {
+	resp, err := n.exchange(ctx, pid, msg)
+	if err != nil || resp.Type != MessageMoved {
+		return resp, err
+	}
+
+	notice, err := n.decodeMoved(pid, resp.Payload)
+	if err != nil || notice.OldPeerID != pid.String() {
+		return nil, fmt.Errorf("peer %s sent an invalid moved notice", pid)
+	}
+	newID, err := peer.Decode(notice.NewPeerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range notice.NewAddrs {
+		if ma, err := multiaddr.NewMultiaddr(a); err == nil {
+			n.CurrentHost().Peerstore().AddAddr(newID, ma, time.Hour)
+		}
+	}
+	fmt.Printf("[P2P] %s moved to %s, retrying\n", pid, newID)
+
+	resp, err = n.exchange(ctx, newID, msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type == MessageMoved {
+		return nil, fmt.Errorf("peer %s moved again", newID)
+	}
+	return resp, nil
+}
+
+// exchange sends msg on the task protocol and reads the single response.
+func (n *AgentNode) exchange(ctx context.Context, pid peer.ID, msg AgentMessage) (resp *AgentMessage, err error) {
+	ctx, span := n.tracer().Start(ctx, "p2p.task", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("agentmesh.peer", pid.String()), capabilityAttr(taskCapability(msg.Payload))))
+	defer func() { endSpan(span, err) }()
+	injectTrace(ctx, &msg)
+	if msg.Type == "task" && wantsFreshAnswer(ctx) {
+		msg.Fresh = true
+	}
+	n.compressFor(pid, &msg)
+
+	s, err := n.CurrentHost().NewStream(ctx, pid, protocol.ID(TaskProtocol))
+	if err != nil {
+		return nil, err
+	}
+	streaming := false
+	defer func() {
+		if !streaming {
+			s.Close()
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
 	}
 
 	bytes, _ := json.Marshal(msg)
@@ -410,27 +1005,119 @@ func (n *AgentNode) SendTask(ctx context.Context, targetAddr string, payload int
 		return nil, err
 	}
 
-	var resp AgentMessage
-	if err := json.Unmarshal(respBytes, &resp); err != nil {
+	resp = new(AgentMessage)
+	if err := json.Unmarshal(respBytes, resp); err != nil {
 		return nil, err
 	}
+	n.noteEncodings(pid, resp)
+	if err := n.decodePayload(resp); err != nil {
+		return nil, fmt.Errorf("peer %s: %w", pid, err)
+	}
+	if resp.Type == MessageError {
+		return nil, peerError(pid.String(), *resp)
+	}
+	// The frames of a streamed result follow, and are read off s as the
+	// caller reads the result
+	if resp.Type == MessageStream && msg.Stream {
+		header, err := decodeStreamHeader(resp.Payload)
+		if err != nil {
+			return nil, err
+		}
+		resp.result = readFrames(s, s, header)
+		streaming = true
+	}
+	return resp, nil
+}
 
-	return resp.Payload, nil
+// decodeMoved extracts the MovedNotice of a moved message from pid and
+// verifies it as the node's Verification mode says.
+func (n *AgentNode) decodeMoved(pid peer.ID, payload interface{}) (*MovedNotice, error) {
+	var notice MovedNotice
+	if err := UnmarshalPayload(AgentMessage{Type: MessageMoved, Payload: payload}, &notice); err != nil {
+		return nil, err
+	}
+	accept, verified := n.Verification.admit("moved notice", pid.String(), notice.Verify)
+	if !accept {
+		return nil, fmt.Errorf("bad moved notice signature")
+	}
+	notice.Verified = verified
+	return &notice, nil
+}
+
+// BlockPeer persists a block on a peer and drops any open connection to it.
+func (n *AgentNode) BlockPeer(peerID string) error {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer id: %w", err)
+	}
+	if err := n.Store.SetPeerBlocked(peerID, true); err != nil {
+		return err
+	}
+	n.Routes.Remove(pid)
+	n.Directory.Remove(pid)
+	n.Latencies.Remove(pid)
+	if h := n.CurrentHost(); h != nil {
+		h.Network().ClosePeer(pid)
+	}
+	return nil
 }
 
 func (n *AgentNode) Stop() error {
 	n.cancel()
-	return n.Host.Close()
+	n.boot.wait()
+	if n.api != nil {
+		n.api.Close()
+	}
+	if n.grpc != nil {
+		n.grpc.Stop()
+	}
+	n.localWG.Wait()
+	if err := n.Archive.Close(); err != nil {
+		fmt.Printf("[Archive] Failed to close the event archive: %v\n", err)
+	}
+	if n.Workers != nil {
+		n.Workers.Close()
+	}
+	if n.Publisher != nil {
+		n.Publisher.Close()
+	}
+	n.mu.Lock()
+	for _, h := range n.retiring {
+		h.Close()
+	}
+	n.retiring = nil
+	h := n.Host
+	n.mu.Unlock()
+	if n.Writes != nil {
+		if err := n.Writes.Flush(); err != nil {
+			fmt.Printf("[DB] Failed to flush writes on stop: %v\n", err)
+		}
+	}
+	defer n.Store.Close()
+	if h == nil {
+		return nil
+	}
+	return h.Close()
 }
 
 // Helpers
 
+// maxMessageSize caps a length-prefixed message, so a bad prefix can't make
+// the reader allocate gigabytes.
+const maxMessageSize = 4 << 20
+
+// errMessageTooLarge is returned by readLP for a message over maxMessageSize.
+var errMessageTooLarge = errors.New("message exceeds the size limit")
+
 func readLP(r io.Reader) ([]byte, error) {
-	br := &byteReader{r}
+	br := &byteReader{Reader: r}
 	length, err := binary.ReadUvarint(br)
 	if err != nil {
 		return nil, err
 	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", errMessageTooLarge, length, maxMessageSize)
+	}
 
 	buf := make([]byte, length)
 	_, err = io.ReadFull(r, buf)
@@ -447,15 +1134,17 @@ func writeLP(w io.Writer, data []byte) error {
 	return err
 }
 
+// byteReader reads a length prefix a byte at a time, into its own buffer so
+// that a byte costs no allocation.
 type byteReader struct {
 	io.Reader
+	b [1]byte
 }
 
 func (br *byteReader) ReadByte() (byte, error) {
-	var b [1]byte
-	n, err := br.Reader.Read(b[:])
+	n, err := br.Reader.Read(br.b[:])
 	if n == 1 {
-		return b[0], nil
+		return br.b[0], nil
 	}
 	if err == nil {
 		err = io.EOF
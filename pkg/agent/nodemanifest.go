@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+)
+
+// NodeManifestVersion is the signed node manifest format this node writes.
+const NodeManifestVersion = 1
+
+// NodeManifestMetadataKey is the ERC-8004 metadata key the manifest URI is
+// published under, next to "peerId".
+const NodeManifestMetadataKey = "agentManifest"
+
+// publishTimeout bounds uploading or fetching a manifest.
+const publishTimeout = 30 * time.Second
+
+// ErrManifestSignature is returned for a manifest its peer key didn't sign.
+var ErrManifestSignature = errors.New("manifest signature does not match its peer ID")
+
+// NodeManifest describes a node for discovery: where to reach it and what it
+// serves.
+type NodeManifest struct {
+	Version      int               `json:"version"`
+	PeerID       string            `json:"peerId"`
+	Addrs        []string          `json:"addrs"`
+	Capabilities []AgentCapability `json:"capabilities"`
+	IssuedAt     int64             `json:"issuedAt"` // unix seconds
+}
+
+// SignedNodeManifest is the published document. The manifest is kept as the
+// canonical JSON string that was signed, like SignedPacket.
+type SignedNodeManifest struct {
+	Manifest  string `json:"manifest"`
+	Signature string `json:"signature"` // base64, by the peer key over signedBytes
+}
+
+func (m SignedNodeManifest) signedBytes() []byte {
+	return []byte("agentmesh-manifest:" + m.Manifest)
+}
+
+// Decode verifies the signature against the peer ID the manifest names and
+// returns the manifest.
+func (m SignedNodeManifest) Decode() (*NodeManifest, error) {
+	var manifest NodeManifest
+	if err := json.Unmarshal([]byte(m.Manifest), &manifest); err != nil {
+		return nil, fmt.Errorf("malformed manifest: %w", err)
+	}
+	if manifest.Version != NodeManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+	// Manifests signed before canonicalization verify as they are
+	verified := canonical.Verify([]byte(m.Manifest), func(signed []byte) bool {
+		return verifyPeerSignature(manifest.PeerID, SignedNodeManifest{Manifest: string(signed)}.signedBytes(), m.Signature)
+	})
+	if !verified {
+		return nil, ErrManifestSignature
+	}
+	return &manifest, nil
+}
+
+// BuildManifest describes the running node, signed by its current identity.
+// It lists the advertised capabilities and those loaded from capability
+// manifests.
+func (n *AgentNode) BuildManifest() (SignedNodeManifest, error) {
+	n.mu.RLock()
+	h, priv := n.Host, n.privKey
+	caps := map[string]AgentCapability{}
+	for name, b := range n.bindings {
+		caps[name] = b.def.Capability()
+	}
+	advertised := n.capabilities
+	n.mu.RUnlock()
+	for _, c := range advertised.Snapshot() {
+		caps[c.Name] = c
+	}
+	if h == nil || priv == nil {
+		return SignedNodeManifest{}, fmt.Errorf("node is not started")
+	}
+
+	manifest := NodeManifest{
+		Version:      NodeManifestVersion,
+		PeerID:       h.ID().String(),
+		Addrs:        []string{},
+		Capabilities: make([]AgentCapability, 0, len(caps)),
+		IssuedAt:     time.Now().Unix(),
+	}
+	for _, a := range h.Addrs() {
+		manifest.Addrs = append(manifest.Addrs, a.String())
+	}
+	for _, c := range caps {
+		manifest.Capabilities = append(manifest.Capabilities, c)
+	}
+	sort.Slice(manifest.Capabilities, func(i, j int) bool { return manifest.Capabilities[i].Name < manifest.Capabilities[j].Name })
+
+	raw, err := canonical.Marshal(manifest)
+	if err != nil {
+		return SignedNodeManifest{}, err
+	}
+	signed := SignedNodeManifest{Manifest: string(raw)}
+	sig, err := priv.Sign(signed.signedBytes())
+	if err != nil {
+		return SignedNodeManifest{}, err
+	}
+	signed.Signature = base64.StdEncoding.EncodeToString(sig)
+	return signed, nil
+}
+
+// PublishManifest builds the node's manifest, stores it and returns its URI,
+// to be set as the NodeManifestMetadataKey metadata with SetMetadata.
+func (n *AgentNode) PublishManifest(store ContentStore) (string, error) {
+	signed, err := n.BuildManifest()
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(signed)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, publishTimeout)
+	defer cancel()
+	uri, err := store.Put(ctx, raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to store manifest: %w", err)
+	}
+	return uri, nil
+}
+
+// FetchManifest reads the manifest at uri and verifies its signature.
+func FetchManifest(ctx context.Context, store ContentStore, uri string) (*NodeManifest, error) {
+	raw, err := store.Get(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	var signed SignedNodeManifest
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		return nil, fmt.Errorf("%s is not a signed manifest: %w", uri, err)
+	}
+	return signed.Decode()
+}
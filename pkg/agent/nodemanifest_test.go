@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPublishAndFetchManifest(t *testing.T) {
+	n := startTestNode(t)
+	if err := n.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	n.AdvertiseCapability(AgentCapability{Name: "memory.search", Description: "Search the workspace"})
+
+	store := DirContentStore{Dir: t.TempDir()}
+	uri, err := n.PublishManifest(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "file://") {
+		t.Errorf("URI = %s, want a file:// URI", uri)
+	}
+
+	m, err := FetchManifest(context.Background(), store, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.PeerID != n.CurrentHost().ID().String() || len(m.Addrs) == 0 {
+		t.Errorf("manifest = %+v, want peer %s with its addrs", m, n.CurrentHost().ID())
+	}
+	if len(m.Capabilities) != 2 || m.Capabilities[0].Name != "memory.search" || m.Capabilities[1].Name != "summarize" {
+		t.Fatalf("capabilities = %+v, want memory.search and summarize", m.Capabilities)
+	}
+	if m.Capabilities[1].Pricing == nil || m.Capabilities[1].Pricing.Amount != "1000" {
+		t.Errorf("summarize lost its pricing: %+v", m.Capabilities[1])
+	}
+}
+
+func TestManifestRejectsForgery(t *testing.T) {
+	n := startTestNode(t)
+	other := startTestNode(t)
+	signed, err := n.BuildManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signed.Decode(); err != nil {
+		t.Fatalf("untouched manifest: %v", err)
+	}
+
+	// Claiming another node's peer ID with our signature
+	forged := signed
+	forged.Manifest = strings.Replace(signed.Manifest, n.CurrentHost().ID().String(), other.CurrentHost().ID().String(), 1)
+	if _, err := forged.Decode(); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("forged peer ID: err = %v, want ErrManifestSignature", err)
+	}
+
+	// Editing the capabilities after signing
+	edited := signed
+	edited.Manifest = strings.Replace(signed.Manifest, `"capabilities":[]`, `"capabilities":[{"name":"free-money","description":""}]`, 1)
+	if edited.Manifest == signed.Manifest {
+		t.Fatal("test edit did not apply")
+	}
+	if _, err := edited.Decode(); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("edited capabilities: err = %v, want ErrManifestSignature", err)
+	}
+}
+
+func TestDirContentStoreDetectsChangedContent(t *testing.T) {
+	store := DirContentStore{Dir: t.TempDir()}
+	uri, err := store.Put(context.Background(), []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(uri)
+	if err := os.WriteFile(u.Path, []byte(`{"a":2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(context.Background(), uri); err == nil {
+		t.Error("Get returned content that no longer matches its hash")
+	}
+}
+
+// fakeKubo serves the two Kubo RPC endpoints IPFSContentStore uses.
+func fakeKubo(t *testing.T) string {
+	t.Helper()
+	var mu sync.Mutex
+	blocks := map[string][]byte{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v0/add", func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		sum := sha256.Sum256(data)
+		cid := "bafkrei" + hex.EncodeToString(sum[:8])
+		mu.Lock()
+		blocks[cid] = data
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"Name": "manifest.json", "Hash": cid, "Size": "1"})
+	})
+	mux.HandleFunc("POST /api/v0/cat", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		data, ok := blocks[r.URL.Query().Get("arg")]
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"Message": "block was not found locally (offline)", "Code": 0, "Type": "error"})
+			return
+		}
+		w.Write(data)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestIPFSContentStore(t *testing.T) {
+	n := startTestNode(t)
+	store := IPFSContentStore{API: fakeKubo(t)}
+
+	uri, err := n.PublishManifest(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "ipfs://bafkrei") {
+		t.Errorf("URI = %s, want an ipfs:// CID", uri)
+	}
+	m, err := FetchManifest(context.Background(), store, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.PeerID != n.CurrentHost().ID().String() {
+		t.Errorf("peer ID = %s, want %s", m.PeerID, n.CurrentHost().ID())
+	}
+
+	_, err = store.Get(context.Background(), "ipfs://bafkreimissing")
+	if err == nil || !strings.Contains(err.Error(), "block was not found") {
+		t.Errorf("missing CID: err = %v, want the daemon's message", err)
+	}
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+
+	"agentmesh/pkg/agent/canonical"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SignPacket signs the JSON document data with the libp2p key priv. The
+// packet carries data in canonical form, the bytes signed, so it verifies
+// however the document was formatted. It needs no running node, so keys kept
+// offline can sign manifests and attestations.
+func SignPacket(priv crypto.PrivKey, data []byte) (SignedPacket, error) {
+	signed, err := canonical.Transform(data)
+	if err != nil {
+		return SignedPacket{}, fmt.Errorf("data is not a JSON document: %w", err)
+	}
+	pid, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return SignedPacket{}, err
+	}
+	sig, err := signData(priv, signed)
+	if err != nil {
+		return SignedPacket{}, err
+	}
+	return SignedPacket{Data: string(signed), Signature: sig, PeerID: pid.String()}, nil
+}
+
+// Verify reports whether Signature is the signature of Data by the key
+// behind PeerID. WalletSig is not checked; that takes the chain for
+// smart-contract wallets.
+func (p SignedPacket) Verify() bool {
+	// Decode the PeerID to get the public key
+	pid, err := peer.Decode(p.PeerID)
+	if err != nil {
+		return false
+	}
+
+	pubKey, err := pid.ExtractPublicKey()
+	if err != nil {
+		return false
+	}
+
+	rawPub, err := pubKey.Raw()
+	if err != nil {
+		return false
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(p.Signature)
+	if err != nil {
+		return false
+	}
+
+	// Data is the canonical JSON that was signed, or for older senders the
+	// exact encoding/json output
+	return canonical.Verify([]byte(p.Data), func(signed []byte) bool {
+		return ed25519.Verify(rawPub, signed, sig)
+	})
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ErrInvalidPayload is returned for a message whose payload doesn't decode
+// into the payload registered for its type, or doesn't validate as one.
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// PayloadValidator is implemented by payloads with rules beyond their JSON
+// shape. Validate is called on each one decoded by UnmarshalPayload.
+type PayloadValidator interface {
+	Validate() error
+}
+
+// payloadTypes maps a message type to the type its payload decodes into.
+var payloadTypes = struct {
+	sync.RWMutex
+	m map[string]reflect.Type
+}{m: map[string]reflect.Type{}}
+
+// The payloads of the node's own message types. Tasks and responses carry
+// whatever their capability takes and returns, so they have none.
+func init() {
+	RegisterPayload(MessageError, ErrorPayload{})
+	RegisterPayload(MessageDecline, DeclineNotice{})
+	RegisterPayload(MessageKnowledge, KnowledgeAnswer{})
+	RegisterPayload(MessageDeliveryAck, DeliveryAck{})
+	RegisterPayload(MessageInteraction, InteractionRecord{})
+	RegisterPayload(MessagePeers, SignedPacket{})
+	RegisterPayload(MessageMoved, MovedNotice{})
+	RegisterPayload(MessageStream, StreamHeader{})
+	RegisterPayload(MessageCommitment, "")
+	RegisterPayload(MessageCommitAck, "")
+	RegisterPayload(MessageCatalog, CatalogPage{})
+	RegisterPayload(MessagePurchased, purchaseReply{})
+	for _, t := range []string{MessageSessionOpen, MessageSessionMessage, MessageSessionResume, MessageSessionClose, MessageSessionAck} {
+		RegisterPayload(t, sessionFrame{})
+	}
+}
+
+// RegisterPayload declares that messages of msgType carry a payload of
+// payload's type, given as its zero value. Messages read off a stream whose
+// payload doesn't decode into it are rejected, and UnmarshalPayload only
+// decodes them into it. Registering a type twice panics.
+func RegisterPayload(msgType string, payload interface{}) {
+	payloadTypes.Lock()
+	defer payloadTypes.Unlock()
+	if _, ok := payloadTypes.m[msgType]; ok {
+		panic(fmt.Sprintf("agent: payload of %q messages registered twice", msgType))
+	}
+	payloadTypes.m[msgType] = reflect.TypeOf(payload)
+}
+
+func payloadType(msgType string) (reflect.Type, bool) {
+	payloadTypes.RLock()
+	defer payloadTypes.RUnlock()
+	t, ok := payloadTypes.m[msgType]
+	return t, ok
+}
+
+// UnmarshalPayload decodes msg's payload into out, a pointer to the type
+// registered for msg's type, if any, and validates it. Its errors match
+// ErrInvalidPayload, but for an out of the wrong type.
+func UnmarshalPayload(msg AgentMessage, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("payload of %q message decoded into %T, not a pointer", msg.Type, out)
+	}
+	if t, ok := payloadType(msg.Type); ok && rv.Elem().Type() != t {
+		return fmt.Errorf("payload of %q message decoded into %T, not *%s", msg.Type, out, t)
+	}
+	if msg.Encoding != "" {
+		return fmt.Errorf("%w: %q message still %s-compressed", ErrInvalidPayload, msg.Type, msg.Encoding)
+	}
+	if msg.Payload == nil {
+		return fmt.Errorf("%w: %q message has none", ErrInvalidPayload, msg.Type)
+	}
+	// Payloads built in-process already have the type
+	if v := reflect.ValueOf(msg.Payload); v.Type() == rv.Elem().Type() {
+		rv.Elem().Set(v)
+	} else {
+		raw, err := json.Marshal(msg.Payload)
+		if err == nil {
+			err = json.Unmarshal(raw, out)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %q message: %v", ErrInvalidPayload, msg.Type, err)
+		}
+	}
+	if v, ok := out.(PayloadValidator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("%w: %q message: %v", ErrInvalidPayload, msg.Type, err)
+		}
+	}
+	return nil
+}
+
+// checkPayload rejects msg if its payload isn't what its type declares.
+// Compressed payloads are checked once decompressed, and messages of
+// unregistered types pass.
+func checkPayload(msg *AgentMessage) error {
+	t, ok := payloadType(msg.Type)
+	if !ok || msg.Encoding != "" {
+		return nil
+	}
+	return UnmarshalPayload(*msg, reflect.New(t).Interface())
+}
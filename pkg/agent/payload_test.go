@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// received is msg as a peer reads it, its payload decoded from JSON.
+func received(t *testing.T, msg AgentMessage) AgentMessage {
+	t.Helper()
+	var out AgentMessage
+	if err := json.Unmarshal(mustMarshal(t, msg), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestUnmarshalPayload(t *testing.T) {
+	notice := DeclineNotice{TaskID: "task:7", Reason: DeclineAtCapacity, RetryAfter: 30}
+	var got DeclineNotice
+	if err := UnmarshalPayload(received(t, AgentMessage{Type: MessageDecline, Payload: notice}), &got); err != nil || got != notice {
+		t.Errorf("decoded %+v, %v; want %+v", got, err, notice)
+	}
+	got = DeclineNotice{}
+	if err := UnmarshalPayload(AgentMessage{Type: MessageDecline, Payload: notice}, &got); err != nil || got != notice {
+		t.Errorf("decoded an in-process payload as %+v, %v", got, err)
+	}
+
+	for name, msg := range map[string]AgentMessage{
+		"wrong shape":      received(t, AgentMessage{Type: MessageDecline, Payload: "declined"}),
+		"invalid":          received(t, AgentMessage{Type: MessageDecline, Payload: DeclineNotice{Reason: DeclineAtCapacity}}),
+		"missing":          {Type: MessageDecline},
+		"still compressed": {Type: MessageDecline, Encoding: EncodingGzip, Payload: "H4sI"},
+	} {
+		if err := UnmarshalPayload(msg, new(DeclineNotice)); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("%s: err = %v, want ErrInvalidPayload", name, err)
+		}
+	}
+	// Declines only decode into a DeclineNotice
+	if err := UnmarshalPayload(received(t, AgentMessage{Type: MessageDecline, Payload: notice}), new(DeliveryAck)); err == nil || errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("decoding a decline into a DeliveryAck: %v", err)
+	}
+
+	// Unregistered types decode into whatever they are asked to
+	var fields map[string]interface{}
+	if err := UnmarshalPayload(received(t, AgentMessage{Type: "task", Payload: map[string]string{"capability": "summarize"}}), &fields); err != nil || fields["capability"] != "summarize" {
+		t.Errorf("task payload = %v, %v", fields, err)
+	}
+	if err := UnmarshalPayload(received(t, AgentMessage{Type: "task", Payload: "hello"}), &fields); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("decoding a string task payload into a map: %v", err)
+	}
+}
+
+func TestMessagesWithTheWrongPayloadAreRejected(t *testing.T) {
+	sender, worker := connectedPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := sender.CurrentHost().NewStream(ctx, worker.CurrentHost().ID(), protocol.ID(TaskProtocol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := writeMessage(s, AgentMessage{Type: MessageDecline, Payload: []string{"not", "a", "notice"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pe := peerError(worker.CurrentHost().ID().String(), *resp); resp.Type != MessageError || pe.Code != ErrCodeBadRequest {
+		t.Fatalf("response = %+v, want a bad_request error", resp)
+	}
+	rec, err := worker.Store.GetPeer(sender.CurrentHost().ID().String())
+	if err != nil || rec == nil || rec.Misbehavior != DefaultMisbehaviorConfig().Points[ViolationProtocolError] {
+		t.Errorf("sender's record = %+v, %v; want scored for a protocol error", rec, err)
+	}
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PeerRecord is what the node remembers about a peer seen on the mesh.
+type PeerRecord struct {
+	PeerID        string  `json:"peerId"`
+	EthAddress    string  `json:"ethAddress,omitempty"`
+	Capability    string  `json:"capability,omitempty"`
+	LastSeen      int64   `json:"lastSeen"`
+	Blocked       bool    `json:"blocked"`                 // by the operator, until unblocked
+	Misbehavior   float64 `json:"misbehavior,omitempty"`   // score as of MisbehaviorAt; see PeerGuard
+	MisbehaviorAt int64   `json:"misbehaviorAt,omitempty"` // unix ms of the last violation
+	BannedUntil   int64   `json:"bannedUntil,omitempty"`   // unix ms the latest temporary ban ends
+	Name          string  `json:"name,omitempty"`          // the peer's name, from its wallet's ENS name or agent card; not stored
+}
+
+// PeerBan is one temporary ban a PeerGuard put on a peer.
+type PeerBan struct {
+	PeerID    string  `json:"peerId"`
+	Violation string  `json:"violation"` // the one that crossed the threshold
+	Score     float64 `json:"score"`     // misbehavior score when it did
+	StartedAt int64   `json:"startedAt"` // unix ms
+	Until     int64   `json:"until"`     // unix ms
+}
+
+const peerColumns = "peer_id, eth_address, capability, last_seen, blocked, misbehavior, misbehavior_at, banned_until"
+
+func scanPeer(row interface{ Scan(...interface{}) error }) (PeerRecord, error) {
+	var p PeerRecord
+	err := row.Scan(&p.PeerID, &p.EthAddress, &p.Capability, &p.LastSeen, &p.Blocked, &p.Misbehavior, &p.MisbehaviorAt, &p.BannedUntil)
+	return p, err
+}
+
+// TouchPeer records a verified announcement from a peer.
+func (s *sqlStore) TouchPeer(peerID, ethAddress, capability string) error {
+	_, err := s.exec(`
+		INSERT INTO peers (peer_id, eth_address, capability, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT(peer_id) DO UPDATE SET eth_address = excluded.eth_address, capability = excluded.capability, last_seen = excluded.last_seen`,
+		peerID, ethAddress, capability, time.Now().Unix())
+	return err
+}
+
+// ListPeers returns all known peers, most recently seen first.
+func (s *sqlStore) ListPeers() ([]PeerRecord, error) {
+	rows, err := s.query("SELECT " + peerColumns + " FROM peers ORDER BY last_seen DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []PeerRecord
+	for rows.Next() {
+		if p, err := scanPeer(rows); err == nil {
+			results = append(results, p)
+		}
+	}
+	return results, rows.Err()
+}
+
+// GetPeer returns the record of a peer, or nil if the node has none.
+func (s *sqlStore) GetPeer(peerID string) (*PeerRecord, error) {
+	p, err := scanPeer(s.queryRow("SELECT "+peerColumns+" FROM peers WHERE peer_id = ?", peerID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SetPeerMisbehavior stores a peer's misbehavior score as of at and the end
+// of its latest ban, creating its record if needed.
+func (s *sqlStore) SetPeerMisbehavior(peerID string, score float64, at, bannedUntil int64) error {
+	_, err := s.exec(`
+		INSERT INTO peers (peer_id, eth_address, capability, last_seen, misbehavior, misbehavior_at, banned_until) VALUES (?, '', '', 0, ?, ?, ?)
+		ON CONFLICT(peer_id) DO UPDATE SET misbehavior = excluded.misbehavior, misbehavior_at = excluded.misbehavior_at, banned_until = excluded.banned_until`,
+		peerID, score, at, bannedUntil)
+	return err
+}
+
+// AddPeerBan appends a ban to a peer's history.
+func (s *sqlStore) AddPeerBan(b PeerBan) error {
+	_, err := s.exec("INSERT INTO peer_bans (peer_id, violation, score, started_at, ends_at) VALUES (?, ?, ?, ?, ?)",
+		b.PeerID, b.Violation, b.Score, b.StartedAt, b.Until)
+	return err
+}
+
+// ListPeerBans returns a peer's bans, oldest first.
+func (s *sqlStore) ListPeerBans(peerID string) ([]PeerBan, error) {
+	rows, err := s.query("SELECT peer_id, violation, score, started_at, ends_at FROM peer_bans WHERE peer_id = ? ORDER BY started_at", peerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []PeerBan
+	for rows.Next() {
+		var b PeerBan
+		if err := rows.Scan(&b.PeerID, &b.Violation, &b.Score, &b.StartedAt, &b.Until); err != nil {
+			return nil, err
+		}
+		results = append(results, b)
+	}
+	return results, rows.Err()
+}
+
+// SetPeerBlocked blocks or unblocks a peer, creating its record if needed.
+func (s *sqlStore) SetPeerBlocked(peerID string, blocked bool) error {
+	_, err := s.exec(`
+		INSERT INTO peers (peer_id, eth_address, capability, last_seen, blocked) VALUES (?, '', '', 0, ?)
+		ON CONFLICT(peer_id) DO UPDATE SET blocked = excluded.blocked`,
+		peerID, boolToInt(blocked))
+	return err
+}
+
+// IsPeerBlocked reports whether the operator has blocked a peer.
+func (s *sqlStore) IsPeerBlocked(peerID string) bool {
+	var blocked bool
+	if err := s.queryRow("SELECT blocked FROM peers WHERE peer_id = ?", peerID).Scan(&blocked); err != nil {
+		return false
+	}
+	return blocked
+}
+
+// boolToInt stores flags as 0/1 so the column type is portable across drivers.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
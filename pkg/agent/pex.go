@@ -0,0 +1,595 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// MessagePeers is the AgentMessage type of a peer exchange sample, sent
+// both ways; its payload is a SignedPacket over a PEXSample.
+const MessagePeers = "peers"
+
+// Defaults of the peer exchange.
+const (
+	DefaultPEXInterval = time.Minute
+	DefaultPEXSample   = 32
+)
+
+// Limits on what one sample entry may carry; the rest is ignored.
+const (
+	maxPEXAddrs         = 8
+	maxPEXAnnouncements = 16
+)
+
+// pexTimeout bounds one exchange, both samples included.
+const pexTimeout = 15 * time.Second
+
+// pexAddrTTL is how long addresses learned over PEX stay in the peerstore
+// unless the peer is connected.
+const pexAddrTTL = 10 * time.Minute
+
+// PeerExchange makes the node swap samples of its PeerDirectory with the
+// peers it is connected to, so a mesh without a DHT still learns of peers
+// a hop or more away. Each entry a peer sends is checked like the gossip
+// it came from: its announcements must be signed by the peer they describe
+// and pass the node's Sybil checks before the entry is taken.
+type PeerExchange struct {
+	Interval time.Duration // between exchange rounds; 0 means DefaultPEXInterval
+	Sample   int           // entries sent, and taken, per exchange; 0 means DefaultPEXSample
+	Trusted  []peer.ID     // the only peers exchanged with; empty for every connected peer
+}
+
+func (x *PeerExchange) interval() time.Duration {
+	if x.Interval <= 0 {
+		return DefaultPEXInterval
+	}
+	return x.Interval
+}
+
+func (x *PeerExchange) sample() int {
+	if x.Sample <= 0 {
+		return DefaultPEXSample
+	}
+	return x.Sample
+}
+
+// trusts reports whether the node exchanges with pid.
+func (x *PeerExchange) trusts(pid peer.ID) bool {
+	return len(x.Trusted) == 0 || slices.Contains(x.Trusted, pid)
+}
+
+// PEXEntry is one peer in a sample: where to reach it, and the signed
+// announcements that vouch for it.
+type PEXEntry struct {
+	PeerID   string   `json:"peerId"`
+	Addrs    []string `json:"addrs,omitempty"`
+	LastSeen int64    `json:"lastSeen"` // unix ms of its latest announcement
+	// Capabilities hashes each of Announcements, in order: the hex SHA-256
+	// of its Data. Receivers skip the announcements they already have.
+	Capabilities  []string       `json:"capabilities,omitempty"`
+	Announcements []SignedPacket `json:"announcements,omitempty"`
+}
+
+// PEXSample is what a node sends in an exchange: itself first, then some of
+// the peers in its directory.
+type PEXSample struct {
+	Peers     []PEXEntry `json:"peers"`
+	Timestamp int64      `json:"timestamp"`
+}
+
+// PeerDirectory keeps the latest announcement of each capability of every
+// peer whose announcements verified and passed the Sybil checks, until it
+// hasn't announced for the TTL. Unlike the RoutingTable, it keeps the
+// signed announcements themselves, so they can be passed on. It also flags
+// peers whose clocks were found off.
+type PeerDirectory struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	clock Clock
+	peers map[peer.ID]map[string]directoryAnnouncement // by capability name
+	skew  map[peer.ID]time.Duration                    // how far off the flagged peers' clocks are
+}
+
+type directoryAnnouncement struct {
+	packet SignedPacket
+	hash   string
+	at     time.Time
+}
+
+// NewPeerDirectory returns an empty directory whose entries expire ttl
+// after the announcement they came from was signed; non-positive values
+// mean DefaultRouteTTL.
+func NewPeerDirectory(ttl time.Duration) *PeerDirectory {
+	if ttl <= 0 {
+		ttl = DefaultRouteTTL
+	}
+	return &PeerDirectory{ttl: ttl, clock: SystemClock, peers: make(map[peer.ID]map[string]directoryAnnouncement), skew: make(map[peer.ID]time.Duration)}
+}
+
+// SetClock replaces the clock entries expire by.
+func (d *PeerDirectory) SetClock(clock Clock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clock = clock
+}
+
+// announcementHash identifies an announcement in a PEXEntry.
+func announcementHash(p SignedPacket) string {
+	sum := sha256.Sum256([]byte(p.Data))
+	return hex.EncodeToString(sum[:])
+}
+
+// observe records packet, pid's announcement of capability signed at at.
+// Announcements older than the one kept, or than the TTL, are ignored; one
+// from the future counts as signed now.
+func (d *PeerDirectory) observe(pid peer.ID, capability string, packet SignedPacket, at time.Time) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.clock.Now()
+	if at.After(now) {
+		at = now
+	}
+	if now.Sub(at) >= d.ttl {
+		return
+	}
+	caps := d.peers[pid]
+	if caps == nil {
+		caps = make(map[string]directoryAnnouncement)
+		d.peers[pid] = caps
+	}
+	if old, ok := caps[capability]; ok && old.at.After(at) {
+		return
+	}
+	caps[capability] = directoryAnnouncement{packet: packet, hash: announcementHash(packet), at: at}
+}
+
+// prune drops what expired by now. The caller holds mu.
+func (d *PeerDirectory) prune(now time.Time) {
+	for pid, caps := range d.peers {
+		for capability, a := range caps {
+			if now.Sub(a.at) >= d.ttl {
+				delete(caps, capability)
+			}
+		}
+		if len(caps) == 0 {
+			delete(d.peers, pid)
+		}
+	}
+}
+
+// Has reports whether the directory has a live entry for pid.
+func (d *PeerDirectory) Has(pid peer.ID) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(d.clock.Now())
+	return len(d.peers[pid]) > 0
+}
+
+// knows reports whether the directory holds the announcement of pid that
+// hashes to hash.
+func (d *PeerDirectory) knows(pid peer.ID, hash string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range d.peers[pid] {
+		if a.hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// stale reports whether packet was signed longer than the TTL ago, so it
+// no longer vouches for its peer.
+func (d *PeerDirectory) stale(packet SignedPacket) bool {
+	if d == nil {
+		return false
+	}
+	var data struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	if json.Unmarshal([]byte(packet.Data), &data) != nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.clock.Now().Sub(time.UnixMilli(data.Timestamp)) >= d.ttl
+}
+
+// Remove forgets pid, e.g. once it is blocked.
+func (d *PeerDirectory) Remove(pid peer.ID) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.peers, pid)
+	delete(d.skew, pid)
+}
+
+// flagSkew flags pid's clock as off by skew, ahead if positive; 0 clears
+// the flag.
+func (d *PeerDirectory) flagSkew(pid peer.ID, skew time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if skew == 0 {
+		delete(d.skew, pid)
+		return
+	}
+	d.skew[pid] = skew
+}
+
+// ClockSkew returns how far off pid's clock was last found, ahead if
+// positive, if it was flagged for being off by more than the node
+// tolerates.
+func (d *PeerDirectory) ClockSkew(pid peer.ID) (time.Duration, bool) {
+	if d == nil {
+		return 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	skew, ok := d.skew[pid]
+	return skew, ok
+}
+
+// Len returns how many peers the directory has.
+func (d *PeerDirectory) Len() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(d.clock.Now())
+	return len(d.peers)
+}
+
+// Snapshot returns every peer in the directory, most recently seen first,
+// without addresses.
+func (d *PeerDirectory) Snapshot() []PEXEntry {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(d.clock.Now())
+	entries := make([]PEXEntry, 0, len(d.peers))
+	for pid, caps := range d.peers {
+		entries = append(entries, directoryEntry(pid, caps))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].LastSeen != entries[j].LastSeen {
+			return entries[i].LastSeen > entries[j].LastSeen
+		}
+		return entries[i].PeerID < entries[j].PeerID
+	})
+	return entries
+}
+
+// sample returns up to max peers picked at random, leaving out exclude.
+func (d *PeerDirectory) sample(max int, exclude peer.ID) []PEXEntry {
+	if d == nil || max <= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(d.clock.Now())
+	pids := make([]peer.ID, 0, len(d.peers))
+	for pid := range d.peers {
+		if pid != exclude {
+			pids = append(pids, pid)
+		}
+	}
+	rand.Shuffle(len(pids), func(i, j int) { pids[i], pids[j] = pids[j], pids[i] })
+	if len(pids) > max {
+		pids = pids[:max]
+	}
+	entries := make([]PEXEntry, len(pids))
+	for i, pid := range pids {
+		entries[i] = directoryEntry(pid, d.peers[pid])
+	}
+	return entries
+}
+
+func directoryEntry(pid peer.ID, caps map[string]directoryAnnouncement) PEXEntry {
+	e := PEXEntry{PeerID: pid.String()}
+	names := make([]string, 0, len(caps))
+	for name := range caps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := caps[name]
+		e.Announcements = append(e.Announcements, a.packet)
+		e.Capabilities = append(e.Capabilities, a.hash)
+		if ms := a.at.UnixMilli(); ms > e.LastSeen {
+			e.LastSeen = ms
+		}
+	}
+	return e
+}
+
+// pexStep starts the exchange rounds once the node is ready, if PEX is on.
+// The first round waits an interval, for connections to come up.
+func (n *AgentNode) pexStep() BootStep {
+	return BootStep{Name: "pex", After: []string{"store", "host"}, Run: func(context.Context) error {
+		if n.PEX == nil {
+			return nil
+		}
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			if err := n.WaitReady(n.ctx); err != nil {
+				return
+			}
+			ticker := time.NewTicker(n.PEX.interval())
+			defer ticker.Stop()
+			for {
+				select {
+				case <-n.ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				n.exchangePeers(n.ctx)
+			}
+		}()
+		return nil
+	}}
+}
+
+// exchangePeers runs one round: a sample is swapped with each connected,
+// trusted peer in turn.
+func (n *AgentNode) exchangePeers(ctx context.Context) {
+	h := n.CurrentHost()
+	for _, pid := range h.Network().Peers() {
+		if !n.PEX.trusts(pid) {
+			continue
+		}
+		// Peers known to speak other protocols but not this one are older
+		// nodes, or have PEX off
+		if protos, _ := h.Peerstore().GetProtocols(pid); len(protos) > 0 && !slices.Contains(protos, protocol.ID(PEXProtocol)) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, pexTimeout)
+		err := n.exchangeWith(ctx, pid)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("[PEX] Exchange with %s failed: %v\n", pid, err)
+		}
+	}
+}
+
+// exchangeWith sends pid a sample and takes in the one it answers with.
+func (n *AgentNode) exchangeWith(ctx context.Context, pid peer.ID) error {
+	h := n.CurrentHost()
+	msg, err := n.pexMessage(pid)
+	if err != nil {
+		return err
+	}
+	s, err := h.NewStream(ctx, pid, protocol.ID(PEXProtocol))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	if err := writeMessage(s, msg); err != nil {
+		return err
+	}
+	resp, err := readMessage(s)
+	if errors.Is(err, ErrInvalidPayload) {
+		n.ReportMisbehavior(pid.String(), ViolationProtocolError)
+	}
+	if err != nil {
+		return err
+	}
+	switch resp.Type {
+	case MessageError:
+		return peerError(pid.String(), *resp)
+	case MessagePeers:
+	default:
+		return fmt.Errorf("peer %s answered a sample with %q", pid, resp.Type)
+	}
+	if err := n.mergeSample(ctx, pid, resp); err != nil {
+		n.ReportMisbehavior(pid.String(), violationOf(err))
+		return err
+	}
+	return nil
+}
+
+// handlePEX answers a peer's sample with the node's own, then takes the
+// peer's in.
+func (n *AgentNode) handlePEX(s network.Stream) {
+	if n.checkBlocked(s) {
+		return
+	}
+	from := s.Conn().RemotePeer()
+	if !n.PEX.trusts(from) {
+		n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "peer exchange is limited to trusted peers"})
+		return
+	}
+	msg, err := readMessage(s)
+	if err != nil || msg.Type != MessagePeers {
+		n.misbehaved(s, ViolationProtocolError)
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "expected a peer sample"})
+		return
+	}
+	reply, err := n.pexMessage(from)
+	if err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "could not sign a sample", Retryable: true})
+		return
+	}
+	if err := writeMessage(s, reply); err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, pexTimeout)
+	defer cancel()
+	if err := n.mergeSample(ctx, from, msg); err != nil {
+		fmt.Printf("[PEX] Sample from %s rejected: %v\n", from, err)
+		n.misbehaved(s, violationOf(err))
+	}
+}
+
+// pexMessage is the node's signed sample for pid: its own entry, with what
+// it advertises, and a random pick of its directory.
+func (n *AgentNode) pexMessage(pid peer.ID) (AgentMessage, error) {
+	n.mu.RLock()
+	h, priv := n.Host, n.privKey
+	n.mu.RUnlock()
+
+	sample := PEXSample{Timestamp: time.Now().UnixMilli()}
+	self := PEXEntry{PeerID: h.ID().String(), Addrs: addrStrings(h.Addrs()), LastSeen: sample.Timestamp}
+	for _, c := range n.advertised().snapshot() {
+		packet, err := n.capabilityPacket(h, priv, c)
+		if err != nil {
+			return AgentMessage{}, err
+		}
+		self.Announcements = append(self.Announcements, packet)
+		self.Capabilities = append(self.Capabilities, announcementHash(packet))
+	}
+	sample.Peers = append(sample.Peers, self)
+	for _, e := range n.Directory.sample(n.PEX.sample()-1, pid) {
+		if id, err := peer.Decode(e.PeerID); err == nil {
+			e.Addrs = addrStrings(h.Peerstore().Addrs(id))
+		}
+		sample.Peers = append(sample.Peers, e)
+	}
+
+	packet, err := signSample(priv, sample)
+	if err != nil {
+		return AgentMessage{}, err
+	}
+	return AgentMessage{Type: MessagePeers, Payload: packet, Sender: h.ID().String(), Timestamp: sample.Timestamp}, nil
+}
+
+// signSample signs sample with the libp2p key priv.
+func signSample(priv crypto.PrivKey, sample PEXSample) (SignedPacket, error) {
+	data, err := json.Marshal(sample)
+	if err != nil {
+		return SignedPacket{}, err
+	}
+	return SignPacket(priv, data)
+}
+
+// errBadSample and errForgedSample tell mergeSample's callers which
+// violation a rejected sample was.
+var (
+	errBadSample    = errors.New("unreadable peer sample")
+	errForgedSample = errors.New("peer sample doesn't verify")
+)
+
+func violationOf(err error) string {
+	if errors.Is(err, errForgedSample) {
+		return ViolationBadSignature
+	}
+	return ViolationProtocolError
+}
+
+// mergeSample takes in the sample from sent. The sample must be signed by
+// from; each announcement in it by the peer its entry is for. Those are
+// handled like gossip, so only peers they vouch for that pass the Sybil
+// checks enter the directory, and only their addresses are kept. Entries
+// beyond the node's own sample size are ignored.
+func (n *AgentNode) mergeSample(ctx context.Context, from peer.ID, msg *AgentMessage) error {
+	var packet SignedPacket
+	if err := UnmarshalPayload(*msg, &packet); err != nil {
+		return fmt.Errorf("%w: %v", errBadSample, err)
+	}
+	if packet.PeerID != from.String() {
+		return fmt.Errorf("%w: signed by %s", errForgedSample, packet.PeerID)
+	}
+	if accept, _ := n.Verification.admit("peer sample", packet.PeerID, packet.Verify); !accept {
+		return errForgedSample
+	}
+	var sample PEXSample
+	if err := json.Unmarshal([]byte(packet.Data), &sample); err != nil {
+		return fmt.Errorf("%w: %v", errBadSample, err)
+	}
+	if len(sample.Peers) > n.PEX.sample() {
+		sample.Peers = sample.Peers[:n.PEX.sample()]
+	}
+
+	h := n.CurrentHost()
+	forged := false
+	for _, e := range sample.Peers {
+		pid, err := peer.Decode(e.PeerID)
+		if err != nil || pid == h.ID() || n.Store.IsPeerBlocked(e.PeerID) {
+			continue
+		}
+		for i, a := range e.Announcements {
+			if i == maxPEXAnnouncements {
+				break
+			}
+			if a.PeerID != e.PeerID || (i < len(e.Capabilities) && n.Directory.knows(pid, e.Capabilities[i])) || n.Directory.stale(a) {
+				continue
+			}
+			// The sender vouched for it; a forgery is on the sender
+			if !n.handleAdvertisement(a) {
+				forged = true
+			}
+		}
+		if !n.Directory.Has(pid) {
+			continue
+		}
+		var addrs []multiaddr.Multiaddr
+		for _, s := range e.Addrs {
+			if len(addrs) == maxPEXAddrs {
+				break
+			}
+			if addr, err := multiaddr.NewMultiaddr(s); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+		h.Peerstore().AddAddrs(pid, addrs, pexAddrTTL)
+		if h.Network().Connectedness(pid) != network.Connected && ctx.Err() == nil {
+			if err := h.Connect(ctx, peer.AddrInfo{ID: pid, Addrs: addrs}); err == nil {
+				fmt.Printf("[PEX] Connected to %s, learned from %s\n", pid, from)
+			}
+		}
+	}
+	if forged {
+		return fmt.Errorf("%w: an announcement in it is forged", errForgedSample)
+	}
+	return nil
+}
+
+// addrStrings formats addrs for a PEXEntry, at most maxPEXAddrs of them.
+func addrStrings(addrs []multiaddr.Multiaddr) []string {
+	if len(addrs) > maxPEXAddrs {
+		addrs = addrs[:maxPEXAddrs]
+	}
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
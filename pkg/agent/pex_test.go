@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// pexNode starts a node with PEX on that advertises capability, without
+// announcing it over gossip.
+func pexNode(t *testing.T, capability string) *AgentNode {
+	t.Helper()
+	n := newTestNode(t)
+	n.PEX = &PeerExchange{Interval: time.Hour}
+	n.advertised().Add("", AgentCapability{Name: capability})
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func connect(t *testing.T, from, to *AgentNode) {
+	t.Helper()
+	info, err := peer.AddrInfoFromString(dialAddr(to))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.CurrentHost().Connect(context.Background(), *info); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPEXLineTopology(t *testing.T) {
+	var nodes []*AgentNode
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, pexNode(t, fmt.Sprintf("cap-%d", i)))
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	connect(t, a, b)
+	connect(t, b, c)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	round := func() {
+		for _, n := range nodes {
+			n.exchangePeers(ctx)
+		}
+	}
+	aID, cID := a.CurrentHost().ID(), c.CurrentHost().ID()
+
+	// a may swap with b before b has heard of c
+	round()
+	if !b.Directory.Has(aID) || !b.Directory.Has(cID) {
+		t.Fatalf("after one round b knows a: %v, c: %v", b.Directory.Has(aID), b.Directory.Has(cID))
+	}
+
+	round()
+	if !a.Directory.Has(cID) || !c.Directory.Has(aID) {
+		t.Fatalf("after two rounds a knows c: %v, c knows a: %v", a.Directory.Has(cID), c.Directory.Has(aID))
+	}
+	if got := a.Routes.Lookup("cap-2"); len(got) != 1 || got[0] != cID {
+		t.Errorf("a routes cap-2 to %v, want c", got)
+	}
+	if a.CurrentHost().Network().Connectedness(cID) != network.Connected {
+		t.Error("a didn't connect to c")
+	}
+}
+
+func TestPEXRejectsForgedAnnouncements(t *testing.T) {
+	a, b := pexNode(t, "honest"), pexNode(t, "forger")
+	connect(t, a, b)
+
+	// b vouches for a third peer with an announcement it signed itself
+	msg, err := b.pexMessage(a.CurrentHost().ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim := newTestNode(t)
+	if err := victim.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	var forged PEXSample
+	if err := json.Unmarshal([]byte(msg.Payload.(SignedPacket).Data), &forged); err != nil {
+		t.Fatal(err)
+	}
+	entry := forged.Peers[0]
+	entry.PeerID = victim.CurrentHost().ID().String()
+	entry.Announcements = append([]SignedPacket(nil), entry.Announcements...)
+	for i := range entry.Announcements {
+		entry.Announcements[i].PeerID = entry.PeerID
+	}
+	entry.Capabilities = nil
+	forged.Peers = append(forged.Peers, entry)
+	b.mu.RLock()
+	priv := b.privKey
+	b.mu.RUnlock()
+	if msg.Payload, err = signSample(priv, forged); err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.mergeSample(context.Background(), b.CurrentHost().ID(), &msg)
+	if violationOf(err) != ViolationBadSignature {
+		t.Fatalf("err = %v, want a forged sample", err)
+	}
+	if a.Directory.Has(victim.CurrentHost().ID()) {
+		t.Error("the forged entry was taken")
+	}
+	if !a.Directory.Has(b.CurrentHost().ID()) {
+		t.Error("b's own entry wasn't taken")
+	}
+
+	// A sample b didn't sign is refused whole
+	if err := a.mergeSample(context.Background(), victim.CurrentHost().ID(), &msg); violationOf(err) != ViolationBadSignature {
+		t.Errorf("sample relayed by another peer: err = %v", err)
+	}
+}
+
+func TestPEXTrustedOnly(t *testing.T) {
+	a, b := pexNode(t, "a"), pexNode(t, "b")
+	connect(t, a, b)
+	b.PEX.Trusted = []peer.ID{"12D3KooWSomeoneElse"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var pe *PeerError
+	if err := a.exchangeWith(ctx, b.CurrentHost().ID()); !errors.As(err, &pe) || pe.Code != ErrCodeForbidden {
+		t.Fatalf("err = %v, want forbidden", err)
+	}
+	if a.Directory.Has(b.CurrentHost().ID()) || b.Directory.Has(a.CurrentHost().ID()) {
+		t.Error("an untrusted exchange went through")
+	}
+}
+
+func TestDirectoryExpiresAnnouncements(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+	n := newTestNode(t)
+	n.Directory.SetClock(clock)
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := peer.IDFromPrivateKey(priv)
+	data, _ := json.Marshal(map[string]interface{}{"capability": AgentCapability{Name: "summarize"}, "timestamp": clock.Now().UnixMilli()})
+	packet, err := SignPacket(priv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.handleAdvertisement(packet)
+	if !n.Directory.Has(pid) || n.Directory.stale(packet) {
+		t.Fatal("a fresh announcement wasn't taken")
+	}
+	if got := n.Directory.Snapshot(); len(got) != 1 || len(got[0].Capabilities) != 1 || got[0].Capabilities[0] != announcementHash(packet) {
+		t.Errorf("snapshot = %+v", got)
+	}
+
+	// Passing it on later doesn't bring the peer back
+	clock.Advance(DefaultRouteTTL)
+	if n.Directory.Has(pid) || !n.Directory.stale(packet) {
+		t.Error("the announcement outlived the TTL")
+	}
+	n.Directory.observe(pid, "summarize", packet, clock.Now().Add(-DefaultRouteTTL))
+	if n.Directory.Len() != 0 {
+		t.Error("an expired announcement was taken")
+	}
+}
@@ -0,0 +1,430 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gopkg.in/yaml.v3"
+)
+
+// Effects of a policy rule, and the policy's default.
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// Interactions a policy is checked before.
+const (
+	PolicyActionBid       = "bid"       // bidding on a client's escrow task
+	PolicyActionAnswer    = "answer"    // answering a knowledge request
+	PolicyActionServe     = "serve"     // serving a peer's request on a task, memory or negotiation stream
+	PolicyActionDeliver   = "deliver"   // sending a message, such as a delegated task or an answer
+	PolicyActionNegotiate = "negotiate" // opening a negotiation
+)
+
+// DefaultPolicyReload is how often a policy's file and list contract are
+// checked for changes.
+const DefaultPolicyReload = 10 * time.Second
+
+// ErrPolicyDenied is returned for interactions the identity policy refuses.
+var ErrPolicyDenied = errors.New("denied by identity policy")
+
+// Identity list contract allowed() and denied(), each returning the wallets
+// on its list.
+const identityListABI = `[
+	{"inputs":[],"name":"allowed","outputs":[{"internalType":"address[]","name":"","type":"address[]"}],"stateMutability":"view","type":"function"},
+	{"inputs":[],"name":"denied","outputs":[{"internalType":"address[]","name":"","type":"address[]"}],"stateMutability":"view","type":"function"}
+]`
+
+var identityList = func() abi.ABI {
+	parsed, _ := abi.JSON(strings.NewReader(identityListABI))
+	return parsed
+}()
+
+// PolicyRule allows or denies one counterparty, named by exactly one of its
+// identities. An ENS name stands for the wallet it resolves to.
+type PolicyRule struct {
+	Effect  string `json:"effect" yaml:"-"`
+	AgentID string `json:"agentId,omitempty" yaml:"agentId"`
+	Wallet  string `json:"wallet,omitempty" yaml:"wallet"`
+	PeerID  string `json:"peerId,omitempty" yaml:"peerId"`
+	ENS     string `json:"ens,omitempty" yaml:"ens"`
+	Source  string `json:"source" yaml:"-"` // the file or list contract the rule came from
+
+	resolved common.Address // of ENS
+}
+
+func (r PolicyRule) String() string {
+	switch {
+	case r.AgentID != "":
+		return fmt.Sprintf("%s agentId %s (%s)", r.Effect, r.AgentID, r.Source)
+	case r.Wallet != "":
+		return fmt.Sprintf("%s wallet %s (%s)", r.Effect, r.Wallet, r.Source)
+	case r.PeerID != "":
+		return fmt.Sprintf("%s peerId %s (%s)", r.Effect, r.PeerID, r.Source)
+	}
+	return fmt.Sprintf("%s ens %s (%s)", r.Effect, r.ENS, r.Source)
+}
+
+func (r PolicyRule) matches(c Counterparty) bool {
+	switch {
+	case r.AgentID != "":
+		return r.AgentID == c.AgentID
+	case r.Wallet != "":
+		return c.Wallet != "" && strings.EqualFold(r.Wallet, c.Wallet)
+	case r.PeerID != "":
+		return r.PeerID == c.PeerID
+	}
+	return r.resolved != (common.Address{}) && strings.EqualFold(r.resolved.Hex(), c.Wallet)
+}
+
+// Counterparty is what the node knows of who it is about to deal with. Any
+// identity may be "".
+type Counterparty struct {
+	AgentID string `json:"agentId,omitempty"`
+	Wallet  string `json:"wallet,omitempty"`
+	PeerID  string `json:"peerId,omitempty"`
+}
+
+func (c Counterparty) String() string {
+	switch {
+	case c.AgentID != "":
+		return "agent " + c.AgentID
+	case c.Wallet != "":
+		return c.Wallet
+	}
+	return c.PeerID
+}
+
+// PolicyDecision is the outcome of checking a counterparty, with the rule
+// that decided it; a nil Rule means the default did.
+type PolicyDecision struct {
+	Action       string       `json:"action"`
+	Counterparty Counterparty `json:"counterparty"`
+	Allowed      bool         `json:"allowed"`
+	Rule         *PolicyRule  `json:"rule,omitempty"`
+}
+
+// policyFile is the layout of a policy file:
+//
+//	default: deny
+//	allow:
+//	  - agentId: "12"
+//	  - wallet: "0x..."
+//	  - ens: partner.eth
+//	deny:
+//	  - peerId: 12D3Koo...
+type policyFile struct {
+	Default string       `yaml:"default"`
+	Allow   []PolicyRule `yaml:"allow"`
+	Deny    []PolicyRule `yaml:"deny"`
+}
+
+// IdentityPolicy decides which counterparties the node will deal with, from
+// rules in a local file and, optionally, an on-chain list contract. A deny
+// rule matching any of a counterparty's identities wins over allow rules;
+// counterparties no rule matches get the default. Each decision is kept in
+// the audit log with the rule that made it. The file and list are reloaded
+// by Watch. A nil *IdentityPolicy allows everyone.
+type IdentityPolicy struct {
+	DefaultDeny bool // deny counterparties no rule matches, unless the file sets its own default
+
+	path     string
+	store    MetadataStore
+	chain    *ERC8004Client
+	list     *common.Address
+	registry common.Address // ENS
+	clock    Clock
+
+	mu          sync.RWMutex
+	rules       []PolicyRule
+	fileDefault string
+	loaded      []byte // file contents the rules were built from
+	chainRules  []PolicyRule
+}
+
+// NewIdentityPolicy loads the policy in path, which may be "" for a policy
+// of only a list contract and the default. Decisions are audited in store.
+func NewIdentityPolicy(path string, store MetadataStore) (*IdentityPolicy, error) {
+	p := &IdentityPolicy{path: path, store: store, clock: SystemClock, registry: common.HexToAddress(DefaultENSRegistry)}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UseChain has the policy resolve ENS names through the registry at
+// ensRegistry, and, if listAddr isn't "", take rules from the identity list
+// contract there. Both go through client. It reloads the policy.
+func (p *IdentityPolicy) UseChain(client *ERC8004Client, ensRegistry, listAddr string) error {
+	p.mu.Lock()
+	p.chain = client
+	p.registry = common.HexToAddress(ensRegistry)
+	if listAddr != "" {
+		addr := common.HexToAddress(listAddr)
+		p.list = &addr
+	}
+	p.loaded = nil
+	p.mu.Unlock()
+	return p.Reload()
+}
+
+// SetClock replaces the clock Watch polls on.
+func (p *IdentityPolicy) SetClock(clock Clock) {
+	p.clock = clock
+}
+
+// Reload rereads the policy file, if it changed, and the list contract. On
+// error the rules in force are kept.
+func (p *IdentityPolicy) Reload() error {
+	p.mu.RLock()
+	loaded, chain, list := p.loaded, p.chain, p.list
+	p.mu.RUnlock()
+
+	var data []byte
+	if p.path != "" {
+		var err error
+		if data, err = os.ReadFile(p.path); err != nil {
+			return fmt.Errorf("policy: %w", err)
+		}
+	}
+	fileChanged := loaded == nil || !bytes.Equal(data, loaded)
+	var rules []PolicyRule
+	var def string
+	if fileChanged {
+		var err error
+		if rules, def, err = p.parse(data); err != nil {
+			return err
+		}
+		if err := p.resolveENS(rules); err != nil {
+			return err
+		}
+	}
+	var chainRules []PolicyRule
+	if list != nil && chain != nil {
+		var err error
+		if chainRules, err = fetchIdentityList(chain, *list); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fileChanged {
+		if loaded != nil {
+			fmt.Printf("[Policy] Reloaded %s: %d rules\n", p.path, len(rules))
+		}
+		p.rules, p.fileDefault = rules, def
+		if p.loaded = data; data == nil {
+			p.loaded = []byte{}
+		}
+	}
+	if list != nil && chain != nil {
+		p.chainRules = chainRules
+	}
+	return nil
+}
+
+func (p *IdentityPolicy) parse(data []byte) ([]PolicyRule, string, error) {
+	var f policyFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, "", fmt.Errorf("policy %s: %w", p.path, err)
+	}
+	if f.Default != "" && f.Default != PolicyAllow && f.Default != PolicyDeny {
+		return nil, "", fmt.Errorf("policy %s: default must be %s or %s, not %q", p.path, PolicyAllow, PolicyDeny, f.Default)
+	}
+	var rules []PolicyRule
+	for _, list := range []struct {
+		effect string
+		rules  []PolicyRule
+	}{{PolicyDeny, f.Deny}, {PolicyAllow, f.Allow}} {
+		for i, r := range list.rules {
+			set := 0
+			for _, v := range []string{r.AgentID, r.Wallet, r.PeerID, r.ENS} {
+				if v != "" {
+					set++
+				}
+			}
+			if set != 1 {
+				return nil, "", fmt.Errorf("policy %s: %s rule %d must name exactly one of agentId, wallet, peerId or ens", p.path, list.effect, i+1)
+			}
+			if r.Wallet != "" && !common.IsHexAddress(r.Wallet) {
+				return nil, "", fmt.Errorf("policy %s: %s rule %d: %q is not an address", p.path, list.effect, i+1, r.Wallet)
+			}
+			if r.PeerID != "" {
+				if _, err := peer.Decode(r.PeerID); err != nil {
+					return nil, "", fmt.Errorf("policy %s: %s rule %d: invalid peerId: %w", p.path, list.effect, i+1, err)
+				}
+			}
+			r.Effect, r.Source = list.effect, "file:"+p.path
+			rules = append(rules, r)
+		}
+	}
+	return rules, f.Default, nil
+}
+
+// resolveENS looks up the wallets of ENS rules. Without a chain client they
+// match nobody.
+func (p *IdentityPolicy) resolveENS(rules []PolicyRule) error {
+	p.mu.RLock()
+	chain, registry := p.chain, p.registry
+	p.mu.RUnlock()
+	for i, r := range rules {
+		if r.ENS == "" || chain == nil {
+			continue
+		}
+		addr, err := chain.ResolveENS(registry, r.ENS)
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", p.path, err)
+		}
+		rules[i].resolved = addr
+	}
+	return nil
+}
+
+// fetchIdentityList reads the wallets on the identity list contract at list.
+func fetchIdentityList(chain *ERC8004Client, list common.Address) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	source := "chain:" + list.Hex()
+	for _, effect := range []string{PolicyDeny, PolicyAllow} {
+		method := map[string]string{PolicyDeny: "denied", PolicyAllow: "allowed"}[effect]
+		data, _ := identityList.Pack(method)
+		res, err := chain.call(list, data, chain.readBlock(nil))
+		if err != nil {
+			return nil, fmt.Errorf("policy list %s: %s(): %w", list.Hex(), method, err)
+		}
+		out, err := identityList.Unpack(method, res)
+		if err != nil {
+			return nil, fmt.Errorf("policy list %s: %s(): %w", list.Hex(), method, err)
+		}
+		for _, addr := range out[0].([]common.Address) {
+			rules = append(rules, PolicyRule{Effect: effect, Wallet: addr.Hex(), Source: source})
+		}
+	}
+	return rules, nil
+}
+
+// Watch reloads the policy every interval until ctx is done. Failed reloads
+// are logged and keep the rules in force.
+func (p *IdentityPolicy) Watch(ctx context.Context, interval time.Duration) {
+	if p == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.clock.After(interval):
+			}
+			if err := p.Reload(); err != nil {
+				fmt.Printf("[Policy] Keeping the rules in force: %v\n", err)
+			}
+		}
+	}()
+}
+
+// Decide checks c for action without recording the decision. Identities c
+// lacks are filled in from the address book.
+func (p *IdentityPolicy) Decide(c Counterparty, action string) PolicyDecision {
+	if p == nil {
+		return PolicyDecision{Action: action, Counterparty: c, Allowed: true}
+	}
+	c = p.complete(c)
+	d := PolicyDecision{Action: action, Counterparty: c}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var allow *PolicyRule
+	for _, rules := range [][]PolicyRule{p.rules, p.chainRules} {
+		for i := range rules {
+			r := &rules[i]
+			if !r.matches(c) {
+				continue
+			}
+			if r.Effect == PolicyDeny {
+				rule := *r
+				d.Rule = &rule
+				return d
+			}
+			if allow == nil {
+				allow = r
+			}
+		}
+	}
+	if allow != nil {
+		rule := *allow
+		d.Allowed, d.Rule = true, &rule
+		return d
+	}
+	switch p.fileDefault {
+	case PolicyAllow:
+		d.Allowed = true
+	case PolicyDeny:
+	default:
+		d.Allowed = !p.DefaultDeny
+	}
+	return d
+}
+
+// complete fills in the identities c lacks from the address book entry of
+// its wallet or peer ID.
+func (p *IdentityPolicy) complete(c Counterparty) Counterparty {
+	var entry *AddressBookEntry
+	if c.Wallet != "" {
+		entry, _ = p.store.LookupAddress(common.HexToAddress(c.Wallet).Hex())
+	} else if c.PeerID != "" {
+		entry, _ = p.store.LookupPeerAddress(c.PeerID)
+	}
+	if entry == nil {
+		return c
+	}
+	if c.AgentID == "" {
+		c.AgentID = entry.AgentID
+	}
+	if c.Wallet == "" {
+		c.Wallet = entry.Wallet
+	}
+	if c.PeerID == "" {
+		c.PeerID = entry.PeerID
+	}
+	return c
+}
+
+// Check decides c for action and records the decision in the audit log. It
+// returns an error wrapping ErrPolicyDenied if c is denied.
+func (p *IdentityPolicy) Check(c Counterparty, action string) error {
+	if p == nil {
+		return nil
+	}
+	d := p.Decide(c, action)
+	rule := "default " + PolicyAllow
+	if d.Rule != nil {
+		rule = d.Rule.String()
+	} else if !d.Allowed {
+		rule = "default " + PolicyDeny
+	}
+	detail, _ := json.Marshal(d)
+	if err := p.store.AppendAudit(AuditPolicy, d.Counterparty.String(), string(detail)); err != nil {
+		fmt.Printf("[Policy] Failed to audit the decision on %s: %v\n", d.Counterparty, err)
+	}
+	if d.Allowed {
+		return nil
+	}
+	fmt.Printf("[Policy] Refused to %s %s: %s\n", action, d.Counterparty, rule)
+	return fmt.Errorf("%w: %s", ErrPolicyDenied, rule)
+}
+
+// permit checks the peer pid against the node's identity policy.
+func (n *AgentNode) permit(pid peer.ID, action string) error {
+	return n.Policy.Check(Counterparty{PeerID: pid.String()}, action)
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func writePolicy(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.TrimLeft(body, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicyDenyTakesPrecedence(t *testing.T) {
+	n := newTestNode(t)
+	wallet := common.HexToAddress("0x00000000000000000000000000000000000000aa").Hex()
+	denied := randomPeer(t)
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, `
+default: deny
+allow:
+  - wallet: `+wallet+`
+  - agentId: "7"
+deny:
+  - peerId: `+denied.String()+`
+`)
+	policy, err := NewIdentityPolicy(path, n.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Check(Counterparty{Wallet: wallet}, PolicyActionBid); err != nil {
+		t.Fatalf("allowed wallet was refused: %v", err)
+	}
+
+	// Once the address book ties the wallet to the denied peer, the deny
+	// rule wins over both allow rules
+	n.Store.SaveAddress(AddressBookEntry{Wallet: wallet, AgentID: "7", PeerID: denied.String()})
+	for _, c := range []Counterparty{{Wallet: wallet}, {AgentID: "7", PeerID: denied.String()}} {
+		d := policy.Decide(c, PolicyActionBid)
+		if d.Allowed || d.Rule == nil || d.Rule.PeerID != denied.String() {
+			t.Errorf("decision on %+v = %+v, want the peerId deny rule", c, d)
+		}
+	}
+	err = policy.Check(Counterparty{Wallet: wallet}, PolicyActionBid)
+	if !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("err = %v, want ErrPolicyDenied", err)
+	}
+
+	// The decision is audited with the rule that made it
+	var detail string
+	db := n.Store.(*sqlStore).db
+	if err := db.QueryRow("SELECT detail FROM audit_log WHERE kind = ? ORDER BY rowid DESC LIMIT 1", AuditPolicy).Scan(&detail); err != nil {
+		t.Fatal(err)
+	}
+	var d PolicyDecision
+	if err := json.Unmarshal([]byte(detail), &d); err != nil || d.Allowed || d.Rule == nil || d.Rule.Source != "file:"+path {
+		t.Errorf("audited %s, want the denial with its rule and source", detail)
+	}
+}
+
+func TestPolicyReloadsWhenTheFileChanges(t *testing.T) {
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	n := newTestNode(t)
+	client := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, "deny: []\n")
+	policy, err := NewIdentityPolicy(path, n.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.SetClock(clock)
+	policy.Watch(t.Context(), time.Second)
+
+	intake := NewTaskIntake(n.Store, nil, nil)
+	intake.UsePolicy(policy)
+	task := func(id int64) Decision {
+		return intake.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(id), Client: client, Payment: big.NewInt(100)})
+	}
+	if d := task(1); d.Action != ActionBid {
+		t.Fatalf("decision before the deny rule = %+v, want a bid", d)
+	}
+
+	writePolicy(t, path, "deny:\n  - wallet: "+client.Hex()+"\n")
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	for deadline := time.Now().Add(5 * time.Second); policy.Decide(Counterparty{Wallet: client.Hex()}, PolicyActionBid).Allowed; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the deny rule written to the file was never loaded")
+		}
+	}
+	if d := task(2); d.Action != ActionSkip || !strings.Contains(d.Reason, ErrPolicyDenied.Error()) {
+		t.Errorf("decision after the deny rule = %+v, want a skip by policy", d)
+	}
+
+	// A broken file keeps the rules in force
+	writePolicy(t, path, "deny:\n  - wallet: nope\n")
+	if err := policy.Reload(); err == nil {
+		t.Error("policy with an invalid wallet reloaded")
+	}
+	if policy.Decide(Counterparty{Wallet: client.Hex()}, PolicyActionBid).Allowed {
+		t.Error("the deny rule was dropped by a failed reload")
+	}
+}
+
+func TestDefaultDenyRefusesUnknownPeers(t *testing.T) {
+	n := startTestNode(t)
+	known := startTestNode(t)
+	stranger := startTestNode(t)
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, "allow:\n  - peerId: "+known.CurrentHost().ID().String()+"\n")
+	policy, err := NewIdentityPolicy(path, n.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.DefaultDeny = true
+	n.Policy = policy
+
+	task := []byte(`{"type":"task","payload":{"text":"hi"}}`)
+	if p := request(t, stranger, n, TaskProtocol, lp(task)); p.Code != ErrCodeForbidden || !strings.Contains(p.Message, "default deny") {
+		t.Errorf("unknown peer's task answered with %+v, want forbidden by the default", p)
+	}
+	if _, err := known.SendTask(t.Context(), dialAddr(n), map[string]interface{}{"text": "hi"}); err != nil {
+		t.Errorf("allowed peer's task: %v", err)
+	}
+	if _, err := n.SendTask(t.Context(), dialAddr(stranger), map[string]interface{}{"text": "hi"}); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("SendTask to an unknown peer: %v, want ErrPolicyDenied", err)
+	}
+}
@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Bloom filters of a prefilter take bloomBitsPerEntry bits and bloomHashes
+// probes per entry, for about one false positive in 1700 lookups, and at
+// least bloomMinBits: the fill of smaller filters varies too much with their
+// seeds. A false positive only costs a decode.
+const (
+	bloomBitsPerEntry = 16
+	bloomHashes       = 8
+	bloomMinBits      = 1024
+)
+
+// bloomSeed seeds each Bloom filter's hashes; tests replace it to get the
+// same filters on every run.
+var bloomSeed = rand.Uint64
+
+// topicBloom is a Bloom filter of 32-byte log topics. It lives only in
+// memory, so it hashes with a per-filter seed.
+type topicBloom struct {
+	bits   []uint64
+	m      uint64
+	s1, s2 uint64
+}
+
+func newTopicBloom(topics []common.Hash) *topicBloom {
+	m := uint64(max(len(topics)*bloomBitsPerEntry, bloomMinBits))
+	b := &topicBloom{bits: make([]uint64, (m+63)/64), m: m, s1: bloomSeed(), s2: bloomSeed()}
+	for _, t := range topics {
+		b.probe(t, func(i uint64) bool { b.bits[i/64] |= 1 << (i % 64); return true })
+	}
+	return b
+}
+
+// probe calls fn with each of t's bit positions until it returns false, and
+// reports whether it never did.
+func (b *topicBloom) probe(t common.Hash, fn func(i uint64) bool) bool {
+	// Double hashing: two hashes give every probe position
+	h1, h2 := topicHash(b.s1, t), topicHash(b.s2, t)|1
+	for k := uint64(0); k < bloomHashes; k++ {
+		if !fn((h1 + k*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+// topicHash hashes t with seed, mixing in one 8-byte word at a time with
+// the splitmix64 finalizer.
+func topicHash(seed uint64, t common.Hash) uint64 {
+	h := seed
+	for i := 0; i < len(t); i += 8 {
+		h ^= binary.LittleEndian.Uint64(t[i:])
+		h ^= h >> 30
+		h *= 0xbf58476d1ce4e5b9
+		h ^= h >> 27
+		h *= 0x94d049bb133111eb
+		h ^= h >> 31
+	}
+	return h
+}
+
+// mayContain reports false only for a topic never added.
+func (b *topicBloom) mayContain(t common.Hash) bool {
+	return b.probe(t, func(i uint64) bool { return b.bits[i/64]&(1<<(i%64)) != 0 })
+}
+
+// EventPrefilter lets the watcher skip task and knowledge request logs this
+// node would never act on, by their indexed topics, before it decodes their
+// data. It never drops a log that matches: its filters can only err on the
+// side of letting one through, and those are skipped further on as before.
+type EventPrefilter struct {
+	requesters *topicBloom // nil admits every requester
+	topics     *topicBloom // nil admits every knowledge topic
+
+	prefiltered atomic.Uint64
+	decoded     atomic.Uint64
+}
+
+// PrefilterStats counts the logs an EventPrefilter looked at.
+type PrefilterStats struct {
+	Prefiltered uint64 `json:"prefiltered"` // skipped without decoding
+	Decoded     uint64 `json:"decoded"`
+}
+
+// NewEventPrefilter admits tasks created by, and knowledge requested by, the
+// given requesters, and knowledge requests on the given topics, matched by
+// the keccak256 hash the market indexes them under. An empty list admits
+// any requester, or any topic; both empty make a prefilter that only counts.
+func NewEventPrefilter(requesters []common.Address, topics []string) *EventPrefilter {
+	f := &EventPrefilter{}
+	if len(requesters) > 0 {
+		hashes := make([]common.Hash, len(requesters))
+		for i, r := range requesters {
+			hashes[i] = common.BytesToHash(r.Bytes())
+		}
+		f.requesters = newTopicBloom(hashes)
+	}
+	if len(topics) > 0 {
+		hashes := make([]common.Hash, len(topics))
+		for i, t := range topics {
+			hashes[i] = crypto.Keccak256Hash([]byte(t))
+		}
+		f.topics = newTopicBloom(hashes)
+	}
+	return f
+}
+
+// Stats returns how many logs were skipped and how many decoded so far.
+func (f *EventPrefilter) Stats() PrefilterStats {
+	return PrefilterStats{Prefiltered: f.prefiltered.Load(), Decoded: f.decoded.Load()}
+}
+
+// admitTask checks a TaskCreated log: topics are the event ID, task ID and
+// client.
+func (f *EventPrefilter) admitTask(vLog types.Log) bool {
+	return f.count(len(vLog.Topics) < 3 || f.requesters == nil || f.requesters.mayContain(vLog.Topics[2]))
+}
+
+// admitQuery checks a KnowledgeRequested log: topics are the event ID,
+// request ID, requester and topic hash.
+func (f *EventPrefilter) admitQuery(vLog types.Log) bool {
+	if len(vLog.Topics) < 4 {
+		// Malformed: let decoding report it
+		return f.count(true)
+	}
+	return f.count((f.requesters == nil || f.requesters.mayContain(vLog.Topics[2])) &&
+		(f.topics == nil || f.topics.mayContain(vLog.Topics[3])))
+}
+
+func (f *EventPrefilter) count(admit bool) bool {
+	if admit {
+		f.decoded.Add(1)
+	} else {
+		f.prefiltered.Add(1)
+	}
+	return admit
+}
+
+// WithPrefilter skips task and knowledge request logs f doesn't admit
+// without decoding or delivering them. Their blocks are still checkpointed.
+func WithPrefilter(f *EventPrefilter) WatcherOption {
+	return func(w *EventWatcher) {
+		w.prefilter = f
+	}
+}
+
+// Prefilter returns the watcher's prefilter, if it has one.
+func (w *EventWatcher) Prefilter() *EventPrefilter {
+	if w == nil {
+		return nil
+	}
+	return w.prefilter
+}
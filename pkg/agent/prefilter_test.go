@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// syntheticLogs returns n task and knowledge request logs from escrow and
+// market, spread over 1000 requesters and as many topics, one block each.
+func syntheticLogs(w *EventWatcher, escrow, market common.Address, n int) []types.Log {
+	taskEvent, queryEvent := w.escrowABI.Events["TaskCreated"], w.marketABI.Events["KnowledgeRequested"]
+	logs := make([]types.Log, n)
+	for i := range logs {
+		requester := common.BigToHash(big.NewInt(int64(0xa000 + i%1000)))
+		id := common.BigToHash(big.NewInt(int64(i)))
+		block := uint64(i + 1)
+		if i%2 == 0 {
+			data, _ := taskEvent.Inputs.NonIndexed().Pack([32]byte{1}, big.NewInt(1000))
+			logs[i] = types.Log{Address: escrow, Topics: []common.Hash{taskEvent.ID, id, requester}, Data: data, BlockNumber: block}
+			continue
+		}
+		topic := fmt.Sprintf("topic-%d", i%997)
+		data, _ := queryEvent.Inputs.NonIndexed().Pack(topic, big.NewInt(10))
+		logs[i] = types.Log{Address: market, Topics: []common.Hash{queryEvent.ID, id, requester, crypto.Keccak256Hash([]byte(topic))}, Data: data, BlockNumber: block}
+	}
+	return logs
+}
+
+// prefilterWatcher returns a watcher that records the events delivered to it.
+func prefilterWatcher(t testing.TB, f *EventPrefilter) (*EventWatcher, *[]string) {
+	t.Helper()
+	var delivered []string
+	w, err := NewEventWatcher("http://127.0.0.1:1", []string{zeroAddressHex}, []string{"0x00000000000000000000000000000000000000bb"},
+		func(e TaskCreatedEvent) {
+			delivered = append(delivered, fmt.Sprintf("task %s from %s", e.TaskId, e.Client.Hex()))
+		},
+		func(q KnowledgeRequestedEvent) {
+			delivered = append(delivered, fmt.Sprintf("query %s from %s on %s", q.RequestId, q.Requester.Hex(), q.Topic))
+		},
+		WithPrefilter(f), WithDeferredHead())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, &delivered
+}
+
+// seedBlooms makes the Bloom filters built until the test ends the same on
+// every run.
+func seedBlooms(t *testing.T, seed uint64) {
+	t.Helper()
+	prev := bloomSeed
+	bloomSeed = rand.New(rand.NewPCG(seed, seed)).Uint64
+	t.Cleanup(func() { bloomSeed = prev })
+}
+
+func TestPrefilterDropsNoRelevantEvent(t *testing.T) {
+	seedBlooms(t, 1)
+	var requesters []common.Address
+	for i := 0; i < 50; i++ {
+		requesters = append(requesters, common.BigToAddress(big.NewInt(int64(0xa000+i*7))))
+	}
+	topics := []string{"topic-3", "topic-500", "topic-996", "not requested"}
+	market := common.HexToAddress("0xbb")
+
+	// Every event delivered without the prefilter and relevant to it must be
+	// delivered with it
+	all, allDelivered := prefilterWatcher(t, nil)
+	logs := syntheticLogs(all, common.Address{}, market, 20000)
+	if err := all.processLogs(1, 20000, logs); err != nil {
+		t.Fatal(err)
+	}
+	f := NewEventPrefilter(requesters, topics)
+	w, delivered := prefilterWatcher(t, f)
+	if err := w.processLogs(1, 20000, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	relevant := map[string]bool{}
+	for i, e := range *allDelivered {
+		l := logs[i]
+		from := common.BytesToAddress(l.Topics[2].Bytes())
+		wanted := false
+		for _, r := range requesters {
+			wanted = wanted || r == from
+		}
+		if len(l.Topics) == 4 {
+			onTopic := false
+			for _, topic := range topics {
+				onTopic = onTopic || crypto.Keccak256Hash([]byte(topic)) == l.Topics[3]
+			}
+			wanted = wanted && onTopic
+		}
+		if wanted {
+			relevant[e] = true
+		}
+	}
+	got := map[string]bool{}
+	for _, e := range *delivered {
+		got[e] = true
+	}
+	for e := range relevant {
+		if !got[e] {
+			t.Errorf("prefilter dropped %s", e)
+		}
+	}
+	stats := f.Stats()
+	if stats.Prefiltered+stats.Decoded != 20000 || int(stats.Decoded) != len(*delivered) {
+		t.Errorf("stats %+v for %d logs and %d delivered", stats, len(logs), len(*delivered))
+	}
+	// False positives are rare, and the intake skips them as before. Each
+	// admits all 20 logs of its requester, or a topic's logs. The seeded
+	// filters let one requester's through
+	if len(relevant) == 0 || len(*delivered) > len(relevant)+20 {
+		t.Errorf("delivered %d events, %d of them relevant", len(*delivered), len(relevant))
+	}
+	if w.LastBlock() != 20000 {
+		t.Errorf("last block %d, want the skipped logs' blocks checkpointed too", w.LastBlock())
+	}
+}
+
+func BenchmarkPrefilter(b *testing.B) {
+	requesters := []common.Address{common.BigToAddress(big.NewInt(0xa000)), common.BigToAddress(big.NewInt(0xa001))}
+	for _, bench := range []struct {
+		name string
+		f    *EventPrefilter
+	}{
+		{"decode-all", nil},
+		{"prefiltered", NewEventPrefilter(requesters, []string{"topic-1"})},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			w, _ := prefilterWatcher(b, bench.f)
+			w.onTask, w.onQuery = func(TaskCreatedEvent) error { return nil }, func(KnowledgeRequestedEvent) error { return nil }
+			logs := syntheticLogs(w, common.Address{}, common.HexToAddress("0xbb"), 100000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.processLogs(1, 100000, logs)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(logs)), "ns/log")
+		})
+	}
+}
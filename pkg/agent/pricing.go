@@ -0,0 +1,490 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/yaml.v3"
+)
+
+// What a capability's per-unit price is charged on.
+const (
+	PriceUnitKiB    = "kib"    // each KiB of the task's input
+	PriceUnitSecond = "second" // each second of compute the capability's past runs took, on average
+)
+
+// CurrencyWei prices in wei of the payment token, needing no conversion.
+const CurrencyWei = "wei"
+
+// DefaultOracleMaxAge is how old an oracle's latest answer may be before
+// quotes converted with it fail.
+const DefaultOracleMaxAge = time.Hour
+
+// CapabilityPrice is how a PricingEngine prices one capability. Amounts
+// are decimals in the engine's currency.
+type CapabilityPrice struct {
+	Base     string  `yaml:"base" json:"base"`
+	PerUnit  string  `yaml:"perUnit,omitempty" json:"perUnit,omitempty"`
+	Unit     string  `yaml:"unit,omitempty" json:"unit,omitempty"`         // PriceUnitKiB or PriceUnitSecond, for PerUnit
+	MinUnits float64 `yaml:"minUnits,omitempty" json:"minUnits,omitempty"` // charged at least, such as before any run is recorded
+	// Discount is the most taken off for a counterparty of perfect
+	// reputation, 0 to 1; Premium the most added for one of none. Neither
+	// applies to counterparties without feedback.
+	Discount float64 `yaml:"discount,omitempty" json:"discount,omitempty"`
+	Premium  float64 `yaml:"premium,omitempty" json:"premium,omitempty"`
+	// LoadMultiplier is what the price is multiplied by when every worker is
+	// taken and the queue is full, rising linearly from 1 when idle; 0 or 1
+	// for prices that don't follow load.
+	LoadMultiplier float64 `yaml:"loadMultiplier,omitempty" json:"loadMultiplier,omitempty"`
+}
+
+func (p CapabilityPrice) validate() error {
+	if _, err := parsePriceAmount(p.Base); err != nil {
+		return fmt.Errorf("base: %w", err)
+	}
+	if p.PerUnit != "" {
+		if _, err := parsePriceAmount(p.PerUnit); err != nil {
+			return fmt.Errorf("perUnit: %w", err)
+		}
+		if p.Unit != PriceUnitKiB && p.Unit != PriceUnitSecond {
+			return fmt.Errorf("unit %q is neither %s nor %s", p.Unit, PriceUnitKiB, PriceUnitSecond)
+		}
+	}
+	switch {
+	case p.MinUnits < 0:
+		return errors.New("minUnits can't be negative")
+	case p.Discount < 0 || p.Discount > 1:
+		return errors.New("discount must be between 0 and 1")
+	case p.Premium < 0:
+		return errors.New("premium can't be negative")
+	case p.LoadMultiplier < 0:
+		return errors.New("loadMultiplier can't be negative")
+	}
+	return nil
+}
+
+// parsePriceAmount parses a non-negative decimal amount.
+func parsePriceAmount(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || r.Sign() < 0 {
+		return nil, fmt.Errorf("%q is not a non-negative amount", s)
+	}
+	return r, nil
+}
+
+// PriceSource converts prices to the payment token.
+type PriceSource interface {
+	// Rate returns what one unit of currency is worth, in wei of the token.
+	Rate(ctx context.Context, currency string) (*big.Rat, error)
+}
+
+// StaticRates is a PriceSource of fixed rates: wei per unit, by currency.
+type StaticRates map[string]*big.Rat
+
+func (s StaticRates) Rate(ctx context.Context, currency string) (*big.Rat, error) {
+	r, ok := s[currency]
+	if !ok {
+		return nil, fmt.Errorf("no rate for %s", currency)
+	}
+	return r, nil
+}
+
+// Chainlink AggregatorV3 decimals() and latestRoundData().
+const priceFeedABI = `[
+	{"inputs":[],"name":"decimals","outputs":[{"internalType":"uint8","name":"","type":"uint8"}],"stateMutability":"view","type":"function"},
+	{"inputs":[],"name":"latestRoundData","outputs":[{"internalType":"uint80","name":"roundId","type":"uint80"},{"internalType":"int256","name":"answer","type":"int256"},{"internalType":"uint256","name":"startedAt","type":"uint256"},{"internalType":"uint256","name":"updatedAt","type":"uint256"},{"internalType":"uint80","name":"answeredInRound","type":"uint80"}],"stateMutability":"view","type":"function"}
+]`
+
+var priceFeed = func() abi.ABI {
+	parsed, _ := abi.JSON(strings.NewReader(priceFeedABI))
+	return parsed
+}()
+
+// OracleRate is a PriceSource reading a Chainlink-style aggregator that
+// prices the payment token in Currency, such as an ETH/USD feed. The
+// token has Decimals decimals; 0 means 18, as ETH does.
+type OracleRate struct {
+	Client   *ERC8004Client
+	Feed     common.Address
+	Currency string
+	Decimals int
+	MaxAge   time.Duration // 0 means DefaultOracleMaxAge
+}
+
+func (o *OracleRate) Rate(ctx context.Context, currency string) (*big.Rat, error) {
+	if currency != o.Currency {
+		return nil, fmt.Errorf("the oracle prices %s, not %s", o.Currency, currency)
+	}
+	out, err := o.read("decimals")
+	if err != nil {
+		return nil, err
+	}
+	feedDecimals := out[0].(uint8)
+	if out, err = o.read("latestRoundData"); err != nil {
+		return nil, err
+	}
+	answer, updated := out[1].(*big.Int), out[3].(*big.Int)
+	if answer.Sign() <= 0 {
+		return nil, fmt.Errorf("oracle %s answered %s", o.Feed.Hex(), answer)
+	}
+	maxAge := o.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultOracleMaxAge
+	}
+	if age := o.Client.Clock().Now().Sub(time.Unix(updated.Int64(), 0)); age > maxAge {
+		return nil, fmt.Errorf("oracle %s last answered %s ago", o.Feed.Hex(), age.Round(time.Second))
+	}
+	decimals := o.Decimals
+	if decimals <= 0 {
+		decimals = 18
+	}
+	// answer/10^feedDecimals of the currency buys one token of 10^decimals wei
+	wei := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)+int64(feedDecimals)), nil)
+	return new(big.Rat).SetFrac(wei, answer), nil
+}
+
+func (o *OracleRate) read(method string) ([]interface{}, error) {
+	data, err := priceFeed.Pack(method)
+	if err != nil {
+		return nil, err
+	}
+	res, err := o.Client.call(o.Feed, data, o.Client.readBlock(nil))
+	if err != nil {
+		return nil, fmt.Errorf("oracle %s %s: %w", o.Feed.Hex(), method, err)
+	}
+	out, err := priceFeed.Unpack(method, res)
+	if err != nil {
+		return nil, fmt.Errorf("oracle %s %s: %w", o.Feed.Hex(), method, err)
+	}
+	return out, nil
+}
+
+// CounterpartyReputation returns a counterparty's reputation on a
+// capability, 0 to 1, and whether it has any feedback.
+type CounterpartyReputation func(ctx context.Context, c Counterparty, capability string) (float64, bool, error)
+
+// PriceQuote is a price and how it was arrived at, kept for audit. Amounts
+// before conversion are in Currency; Price is in wei of the payment token.
+// A capability the engine has no price for gets a quote declining paid
+// work for it, with no Price.
+type PriceQuote struct {
+	Capability   string   `json:"capability"`
+	TaskID       string   `json:"taskId,omitempty"`
+	Counterparty string   `json:"counterparty,omitempty"`
+	Currency     string   `json:"currency,omitempty"`
+	Base         string   `json:"base,omitempty"`
+	PerUnit      string   `json:"perUnit,omitempty"`
+	Units        string   `json:"units,omitempty"`
+	Unit         string   `json:"unit,omitempty"`
+	Reputation   string   `json:"reputation,omitempty"` // multiplier for the counterparty's reputation
+	Load         string   `json:"load,omitempty"`       // multiplier for the node's load
+	Rate         string   `json:"rate,omitempty"`       // wei per unit of Currency
+	Price        *big.Int `json:"price,omitempty"`
+	Declined     string   `json:"declined,omitempty"` // why paid work is declined
+}
+
+func (q PriceQuote) String() string {
+	if q.Declined != "" {
+		return fmt.Sprintf("declined paid work on %s: %s", q.Capability, q.Declined)
+	}
+	s := fmt.Sprintf("%s wei for %s: base %s", q.Price, q.Capability, q.Base)
+	if q.PerUnit != "" {
+		s += fmt.Sprintf(" + %s x %s %s", q.PerUnit, q.Units, q.Unit)
+	}
+	s += fmt.Sprintf(" %s, reputation x%s, load x%s", q.Currency, q.Reputation, q.Load)
+	if q.Currency != CurrencyWei {
+		s += fmt.Sprintf(", at %s wei/%s", q.Rate, q.Currency)
+	}
+	return s
+}
+
+// PricingEngine quotes what the node charges for a capability: a base
+// price, plus a price per unit of input or of estimated compute, adjusted
+// for the counterparty's reputation and the node's load, and converted to
+// the payment token. Capabilities it has no price for, and no Default
+// covers, are quoted as declining paid work.
+type PricingEngine struct {
+	Currency     string                     // prices are in; "" or CurrencyWei for wei
+	Capabilities map[string]CapabilityPrice // by capability name or ID
+	Default      *CapabilityPrice           // for capabilities not listed; nil declines them
+	Source       PriceSource                // converts Currency to wei; unused for wei
+	Reputation   CounterpartyReputation     // nil leaves reputation out
+	Load         func() float64             // the node's load, 0 to 1, like TaskPool.Load; nil for none
+	// Estimate is how long a capability's runs take, like
+	// MetadataStore.EstimateTaskRun, for PriceUnitSecond
+	Estimate func(capability string) (time.Duration, bool, error)
+	// Record, when set, is given every quote, declined or not
+	Record func(PriceQuote)
+}
+
+// pricingFile is the layout of a pricing file:
+//
+//	currency: USD
+//	rates: {USD: "400000000000000"}  # wei per USD
+//	oracle:                          # or an ETH/USD feed instead of rates
+//	  feed: "0x..."
+//	  maxAge: 1h
+//	default: {base: "0.05"}
+//	capabilities:
+//	  summarize:
+//	    base: "0.02"
+//	    perUnit: "0.001"
+//	    unit: kib
+//	    discount: 0.2
+//	    premium: 0.5
+//	    loadMultiplier: 2
+type pricingFile struct {
+	Currency string            `yaml:"currency"`
+	Rates    map[string]string `yaml:"rates"`
+	Oracle   *struct {
+		Feed     string        `yaml:"feed"`
+		Decimals int           `yaml:"decimals"`
+		MaxAge   time.Duration `yaml:"maxAge"`
+	} `yaml:"oracle"`
+	Default      *CapabilityPrice           `yaml:"default"`
+	Capabilities map[string]CapabilityPrice `yaml:"capabilities"`
+}
+
+// LoadPricing reads a pricing engine from a YAML file. An oracle is read
+// through chain.
+func LoadPricing(path string, chain *ERC8004Client) (*PricingEngine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("pricing: %w", err)
+	}
+	var f pricingFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("pricing %s: %w", path, err)
+	}
+	e := &PricingEngine{Currency: f.Currency, Capabilities: f.Capabilities, Default: f.Default}
+	for name, p := range f.Capabilities {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("pricing %s: capability %s: %w", path, name, err)
+		}
+	}
+	if f.Default != nil {
+		if err := f.Default.validate(); err != nil {
+			return nil, fmt.Errorf("pricing %s: default: %w", path, err)
+		}
+	}
+	switch {
+	case f.Oracle != nil && len(f.Rates) > 0:
+		return nil, fmt.Errorf("pricing %s: both rates and an oracle", path)
+	case f.Oracle != nil:
+		if !common.IsHexAddress(f.Oracle.Feed) {
+			return nil, fmt.Errorf("pricing %s: oracle feed %q is not an address", path, f.Oracle.Feed)
+		}
+		if chain == nil {
+			return nil, fmt.Errorf("pricing %s: the oracle needs a chain client", path)
+		}
+		e.Source = &OracleRate{Client: chain, Feed: common.HexToAddress(f.Oracle.Feed), Currency: f.Currency, Decimals: f.Oracle.Decimals, MaxAge: f.Oracle.MaxAge}
+	case len(f.Rates) > 0:
+		rates := StaticRates{}
+		for currency, s := range f.Rates {
+			r, err := parsePriceAmount(s)
+			if err != nil || r.Sign() == 0 {
+				return nil, fmt.Errorf("pricing %s: rate of %s: %q is not a positive amount", path, currency, s)
+			}
+			rates[currency] = r
+		}
+		e.Source = rates
+	}
+	if e.Source == nil && e.currency() != CurrencyWei {
+		return nil, fmt.Errorf("pricing %s: prices in %s need rates or an oracle", path, f.Currency)
+	}
+	return e, nil
+}
+
+func (e *PricingEngine) currency() string {
+	if e.Currency == "" {
+		return CurrencyWei
+	}
+	return e.Currency
+}
+
+// Quote prices capability for task, logging the breakdown. A quote that
+// declines paid work isn't an error; failing to convert the price is.
+func (e *PricingEngine) Quote(ctx context.Context, capability string, task TaskContext) (PriceQuote, error) {
+	q := PriceQuote{Capability: capability, TaskID: task.TaskID, Currency: e.currency()}
+	if task.Counterparty != nil {
+		q.Counterparty = task.Counterparty.String()
+	}
+	p, ok := e.Capabilities[capability]
+	if !ok && e.Default != nil {
+		p, ok = *e.Default, true
+	}
+	if !ok {
+		q.Declined = "no price is set for it"
+		e.record(q)
+		return q, nil
+	}
+
+	total, err := parsePriceAmount(p.Base)
+	if err != nil {
+		return q, fmt.Errorf("price of %s: base: %w", capability, err)
+	}
+	q.Base = decimalString(total)
+	if p.PerUnit != "" {
+		perUnit, err := parsePriceAmount(p.PerUnit)
+		if err != nil {
+			return q, fmt.Errorf("price of %s: perUnit: %w", capability, err)
+		}
+		units := e.units(p, capability, task)
+		q.PerUnit, q.Units, q.Unit = decimalString(perUnit), decimalString(units), p.Unit
+		total.Add(total, units.Mul(units, perUnit))
+	}
+	reputation := e.reputationFactor(ctx, p, capability, task)
+	load := e.loadFactor(p)
+	q.Reputation, q.Load = decimalString(reputation), decimalString(load)
+	total.Mul(total, reputation).Mul(total, load)
+
+	if q.Currency != CurrencyWei {
+		if e.Source == nil {
+			return q, fmt.Errorf("price of %s: nothing converts %s to wei", capability, q.Currency)
+		}
+		rate, err := e.Source.Rate(ctx, q.Currency)
+		if err != nil {
+			return q, fmt.Errorf("price of %s: %w", capability, err)
+		}
+		q.Rate = decimalString(rate)
+		total.Mul(total, rate)
+	}
+	// Round up: a quote never undercuts the configured price
+	q.Price = new(big.Int).Add(total.Num(), total.Denom())
+	q.Price.Sub(q.Price, big.NewInt(1)).Quo(q.Price, total.Denom())
+	e.record(q)
+	return q, nil
+}
+
+func (e *PricingEngine) record(q PriceQuote) {
+	if q.TaskID != "" {
+		fmt.Printf("[Pricing] Task %s: %s\n", q.TaskID, q)
+	} else {
+		fmt.Printf("[Pricing] Quoted %s\n", q)
+	}
+	if e.Record != nil {
+		e.Record(q)
+	}
+}
+
+// units returns how many units of p.Unit the task is charged for.
+func (e *PricingEngine) units(p CapabilityPrice, capability string, task TaskContext) *big.Rat {
+	units := new(big.Rat)
+	switch p.Unit {
+	case PriceUnitKiB:
+		units.SetFrac64(task.InputBytes, 1024)
+	case PriceUnitSecond:
+		if e.Estimate == nil {
+			break
+		}
+		if d, ok, err := e.Estimate(capability); err != nil {
+			fmt.Printf("[Pricing] Failed to estimate the runs of %s: %v\n", capability, err)
+		} else if ok {
+			units.SetFrac64(d.Milliseconds(), 1000)
+		}
+	}
+	if min := decimalRat(p.MinUnits); units.Cmp(min) < 0 {
+		units = min
+	}
+	return units
+}
+
+// reputationFactor is 1 for a counterparty of middling reputation, falling
+// to 1-Discount at perfect reputation and rising to 1+Premium at none.
+func (e *PricingEngine) reputationFactor(ctx context.Context, p CapabilityPrice, capability string, task TaskContext) *big.Rat {
+	if e.Reputation == nil || task.Counterparty == nil || (p.Discount == 0 && p.Premium == 0) {
+		return big.NewRat(1, 1)
+	}
+	r, ok, err := e.Reputation(ctx, *task.Counterparty, capability)
+	if err != nil {
+		fmt.Printf("[Pricing] Failed to read the reputation of %s, pricing without it: %v\n", task.Counterparty, err)
+		return big.NewRat(1, 1)
+	}
+	if !ok {
+		return big.NewRat(1, 1)
+	}
+	r = clamp01(r)
+	if r >= 0.5 {
+		return decimalRat(1 - p.Discount*(2*r-1))
+	}
+	return decimalRat(1 + p.Premium*(1-2*r))
+}
+
+// loadFactor rises linearly from 1 at no load to p.LoadMultiplier at full.
+func (e *PricingEngine) loadFactor(p CapabilityPrice) *big.Rat {
+	if e.Load == nil || p.LoadMultiplier <= 1 {
+		return big.NewRat(1, 1)
+	}
+	return decimalRat(1 + (p.LoadMultiplier-1)*clamp01(e.Load()))
+}
+
+// Strategy returns how the node negotiates capability for task as the paid
+// side: holding out for the quote. A quote declining paid work, or one that
+// can't be made, walks away.
+func (e *PricingEngine) Strategy(ctx context.Context, capability string, task TaskContext) NegotiationStrategy {
+	q, err := e.Quote(ctx, capability, task)
+	switch {
+	case err != nil:
+		fmt.Printf("[Pricing] Not negotiating %s: %v\n", capability, err)
+		return walkAway{reason: "no price"}
+	case q.Declined != "":
+		return walkAway{reason: "declined"}
+	}
+	return &quotedStrategy{TakeItOrLeaveIt: TakeItOrLeaveIt{Price: q.Price}, ctx: ctx, engine: e, capability: capability, task: task}
+}
+
+// quotedStrategy holds to the engine's quote, and quotes again when an
+// offer of it expired before it was accepted.
+type quotedStrategy struct {
+	TakeItOrLeaveIt
+	ctx        context.Context
+	engine     *PricingEngine
+	capability string
+	task       TaskContext
+}
+
+func (s *quotedStrategy) Requote(expired Offer) *big.Int {
+	q, err := s.engine.Quote(s.ctx, s.capability, s.task)
+	switch {
+	case err != nil:
+		fmt.Printf("[Pricing] Not quoting %s again: %v\n", s.capability, err)
+		return nil
+	case q.Declined != "":
+		return nil
+	}
+	s.Price = q.Price
+	return q.Price
+}
+
+// walkAway abandons a negotiation on the first offer.
+type walkAway struct {
+	reason string
+}
+
+func (s walkAway) Decide(NegotiationState) NegotiationDecision {
+	return NegotiationDecision{Reason: s.reason}
+}
+
+// decimalRat is f rounded to six decimal places, exactly, so multipliers
+// such as 0.8 don't carry binary noise into prices.
+func decimalRat(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', 6, 64))
+	return r
+}
+
+// decimalString formats r as a decimal, to nine places at most.
+func decimalString(r *big.Rat) string {
+	s := r.FloatString(9)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestQuoteArithmetic(t *testing.T) {
+	var recorded []PriceQuote
+	e := &PricingEngine{
+		Currency: "USD",
+		Capabilities: map[string]CapabilityPrice{
+			"summarize": {Base: "0.02", PerUnit: "0.001", Unit: PriceUnitKiB, Discount: 0.2, Premium: 0.5, LoadMultiplier: 2},
+		},
+		Source: StaticRates{"USD": big.NewRat(400_000_000_000_000, 1)},
+		Reputation: func(ctx context.Context, c Counterparty, capability string) (float64, bool, error) {
+			return map[string]float64{"trusted": 1, "shady": 0.25}[c.AgentID], c.AgentID != "new", nil
+		},
+		Load:   func() float64 { return 0.5 },
+		Record: func(q PriceQuote) { recorded = append(recorded, q) },
+	}
+	quote := func(agentID string) PriceQuote {
+		t.Helper()
+		q, err := e.Quote(context.Background(), "summarize", TaskContext{TaskID: "task:1", Counterparty: &Counterparty{AgentID: agentID}, InputBytes: 3072})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	// (0.02 + 0.001 x 3 KiB) x 0.8 for perfect reputation x 1.5 at half load, at 4e14 wei/USD
+	q := quote("trusted")
+	if q.Price.String() != "11040000000000" {
+		t.Errorf("price = %s, want 11040000000000", q.Price)
+	}
+	want := PriceQuote{Capability: "summarize", TaskID: "task:1", Counterparty: "agent trusted", Currency: "USD", Base: "0.02", PerUnit: "0.001", Units: "3", Unit: PriceUnitKiB, Reputation: "0.8", Load: "1.5", Rate: "400000000000000"}
+	want.Price = q.Price
+	if q != want {
+		t.Errorf("breakdown = %+v, want %+v", q, want)
+	}
+	if len(recorded) != 1 || recorded[0] != q {
+		t.Errorf("recorded %+v", recorded)
+	}
+
+	// 1 + 0.5 x (1 - 2 x 0.25) = 1.25 for poor reputation; none for no feedback
+	if q := quote("shady"); q.Reputation != "1.25" || q.Price.String() != "17250000000000" {
+		t.Errorf("poor reputation: x%s, %s wei", q.Reputation, q.Price)
+	}
+	if q := quote("new"); q.Reputation != "1" || q.Price.String() != "13800000000000" {
+		t.Errorf("no feedback: x%s, %s wei", q.Reputation, q.Price)
+	}
+}
+
+func TestQuoteRoundsUp(t *testing.T) {
+	e := &PricingEngine{Default: &CapabilityPrice{Base: "10", PerUnit: "1", Unit: PriceUnitKiB}}
+	q, err := e.Quote(context.Background(), "anything", TaskContext{InputBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Price.Int64() != 11 {
+		t.Errorf("10 + 1/1024 wei quoted %s, want 11", q.Price)
+	}
+}
+
+func TestQuoteEstimatedCompute(t *testing.T) {
+	estimates := map[string]time.Duration{"render": 2500 * time.Millisecond}
+	e := &PricingEngine{
+		Capabilities: map[string]CapabilityPrice{
+			"render": {Base: "100", PerUnit: "40", Unit: PriceUnitSecond, MinUnits: 1},
+			"fresh":  {Base: "100", PerUnit: "40", Unit: PriceUnitSecond, MinUnits: 1},
+		},
+		Estimate: func(capability string) (time.Duration, bool, error) {
+			d, ok := estimates[capability]
+			return d, ok, nil
+		},
+	}
+	for capability, want := range map[string]int64{"render": 200, "fresh": 140} {
+		q, err := e.Quote(context.Background(), capability, TaskContext{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Price.Int64() != want {
+			t.Errorf("%s quoted %s (%s units), want %d", capability, q.Price, q.Units, want)
+		}
+	}
+}
+
+func TestQuoteFollowsLoad(t *testing.T) {
+	pool := NewTaskPool(2, 2)
+	defer pool.Close()
+	e := &PricingEngine{
+		Capabilities: map[string]CapabilityPrice{
+			"busy":   {Base: "1000", LoadMultiplier: 3},
+			"steady": {Base: "1000"},
+		},
+		Load: pool.Load,
+	}
+	price := func(capability string) int64 {
+		t.Helper()
+		q, err := e.Quote(context.Background(), capability, TaskContext{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.Price.Int64()
+	}
+	if got := price("busy"); got != 1000 {
+		t.Errorf("idle: %d, want 1000", got)
+	}
+
+	// Take both workers, and one of the two queue slots. Each job goes in
+	// once the one before it is placed, so none finds the pool full
+	release := make(chan struct{})
+	defer close(release)
+	errs := make(chan error, 3)
+	waitFor := func(what string, placed func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !placed(); time.Sleep(time.Millisecond) {
+			select {
+			case err := <-errs:
+				t.Fatalf("Do returned %v before its job was released", err)
+			default:
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %d active, %d queued", what, pool.Active(), pool.Queued())
+			}
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		go func() { errs <- pool.Do(context.Background(), func() { <-release }) }()
+		if i < 3 {
+			waitFor("worker not taken", func() bool { return pool.Active() == i })
+		}
+	}
+	waitFor("job not queued", func() bool { return pool.Active() == 2 && pool.Queued() == 1 })
+	if got := pool.Load(); got != 0.75 {
+		t.Fatalf("load = %v, want 0.75", got)
+	}
+	if got := price("busy"); got != 2500 {
+		t.Errorf("at 0.75 load: %d, want 2500", got)
+	}
+	if got := price("steady"); got != 1000 {
+		t.Errorf("a price without a load multiplier moved to %d", got)
+	}
+
+	e.Load = func() float64 { return 4 }
+	if got := price("busy"); got != 3000 {
+		t.Errorf("over full load: %d, want capped at 3000", got)
+	}
+}
+
+func TestZeroConfigDeclinesPaidWork(t *testing.T) {
+	e := &PricingEngine{}
+	q, err := e.Quote(context.Background(), "summarize", TaskContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Declined == "" || q.Price != nil {
+		t.Errorf("quote = %+v, want paid work declined", q)
+	}
+
+	in := NewTaskIntake(newTestStore(t), nil, nil)
+	in.UsePricing(e, "summarize")
+	d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(1), Payment: big.NewInt(1e18)})
+	if d.Action != ActionSkip || d.Code != DeclineNotInterested {
+		t.Errorf("decision = %+v, want skipped", d)
+	}
+
+	s := e.Strategy(context.Background(), "summarize", TaskContext{})
+	if got := s.Decide(NegotiationState{Offer: Offer{Price: big.NewInt(1e18)}}); got.Accept || got.Counter != nil {
+		t.Errorf("strategy = %+v, want it to walk away", got)
+	}
+}
+
+func TestIntakeAsksForTheQuote(t *testing.T) {
+	e := &PricingEngine{Capabilities: map[string]CapabilityPrice{"summarize": {Base: "5000"}}}
+	in := NewTaskIntake(newTestStore(t), nil, nil)
+	in.UsePricing(e, "summarize")
+
+	d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(1), Payment: big.NewInt(4999)})
+	if d.Action != ActionSkip || d.Code != DeclinePriceTooLow || d.CounterAmount != "5000" {
+		t.Errorf("underpaying task: %+v, want a counter of 5000", d)
+	}
+	if d := in.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(2), Payment: big.NewInt(5000)}); d.Action != ActionBid {
+		t.Errorf("task paying the quote: %+v, want a bid", d)
+	}
+
+	s := e.Strategy(context.Background(), "summarize", TaskContext{})
+	if got := s.Decide(NegotiationState{Offer: Offer{Price: big.NewInt(4000)}}); got.Counter == nil || got.Counter.Int64() != 5000 {
+		t.Errorf("strategy = %+v, want a counter at the quote", got)
+	}
+}
+
+func TestOracleRate(t *testing.T) {
+	feed := common.HexToAddress("0xfeed")
+	updated := time.Now()
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		if method != "eth_call" {
+			return nil, &rpcError{Code: -32601, Message: method + " not served"}
+		}
+		var call struct {
+			To    common.Address `json:"to"`
+			Input hexutil.Bytes  `json:"input"`
+		}
+		json.Unmarshal(params[0], &call)
+		m, err := priceFeed.MethodById(call.Input[:4])
+		if err != nil || call.To != feed {
+			return nil, &rpcError{Code: 3, Message: "execution reverted"}
+		}
+		var out []byte
+		if m.Name == "decimals" {
+			out, _ = m.Outputs.Pack(uint8(8))
+		} else {
+			// 2500 USD per ETH
+			out, _ = m.Outputs.Pack(big.NewInt(1), big.NewInt(2500e8), big.NewInt(0), big.NewInt(updated.Unix()), big.NewInt(1))
+		}
+		return hexutil.Bytes(out), nil
+	})
+	client := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	t.Cleanup(client.Close)
+
+	e := &PricingEngine{
+		Currency:     "USD",
+		Capabilities: map[string]CapabilityPrice{"summarize": {Base: "1"}},
+		Source:       &OracleRate{Client: client, Feed: feed, Currency: "USD"},
+	}
+	q, err := e.Quote(context.Background(), "summarize", TaskContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Price.String() != "400000000000000" {
+		t.Errorf("1 USD at 2500 USD/ETH = %s wei, want 400000000000000", q.Price)
+	}
+
+	updated = updated.Add(-2 * DefaultOracleMaxAge)
+	if _, err := e.Quote(context.Background(), "summarize", TaskContext{}); err == nil || !strings.Contains(err.Error(), "last answered") {
+		t.Errorf("stale answer: err = %v", err)
+	}
+}
+
+func TestLoadPricing(t *testing.T) {
+	write := func(body string) string {
+		path := filepath.Join(t.TempDir(), "pricing.yaml")
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	e, err := LoadPricing(write(`
+currency: USD
+rates: {USD: "400000000000000"}
+capabilities:
+  summarize: {base: "0.02", perUnit: "0.001", unit: kib, loadMultiplier: 2}
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := e.Quote(context.Background(), "summarize", TaskContext{InputBytes: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Price.String() != "8800000000000" {
+		t.Errorf("price = %s, want 8800000000000", q.Price)
+	}
+
+	for name, body := range map[string]string{
+		"no unit":       "capabilities: {a: {base: '1', perUnit: '1'}}",
+		"negative base": "capabilities: {a: {base: '-1'}}",
+		"no rates":      "currency: USD\ncapabilities: {a: {base: '1'}}",
+		"oracle, chain": "currency: USD\noracle: {feed: '0x0000000000000000000000000000000000000001'}",
+	} {
+		if _, err := LoadPricing(write(body), nil); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
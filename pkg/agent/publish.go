@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Publisher defaults: how many announcements may wait to go out, and how long
+// one may take before it is given up.
+const (
+	DefaultPublishBuffer  = 64
+	DefaultPublishTimeout = 5 * time.Second
+)
+
+// publishFullWarning is how long the publish buffer may stay full before a
+// warning is logged, and how often the warning repeats while it does.
+const publishFullWarning = 30 * time.Second
+
+// Reasons a Publisher drops an announcement, the reason label of
+// agentmesh_pubsub_dropped_total.
+const (
+	DropBufferFull = "buffer_full"
+	DropTimeout    = "timeout"
+	DropError      = "error"
+)
+
+// Publisher publishes pubsub messages on its own goroutine, so a slow network
+// never holds up the code announcing. Messages wait in a bounded buffer; one
+// that finds it full, or isn't published within Timeout, is dropped and
+// counted instead of blocking.
+type Publisher struct {
+	Timeout time.Duration // per message; set before the first Publish
+
+	queue chan publication
+	send  func(ctx context.Context, topic *pubsub.Topic, data []byte) error
+
+	published atomic.Uint64
+	full      atomic.Uint64
+	timedOut  atomic.Uint64
+	failed    atomic.Uint64
+
+	mu        sync.Mutex
+	fullSince time.Time // zero while the buffer has room
+	warned    time.Time
+
+	start  sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type publication struct {
+	topic *pubsub.Topic
+	data  []byte
+}
+
+// PublishStats counts what became of the messages given to a Publisher.
+type PublishStats struct {
+	Queued    int    `json:"queued"`
+	Published uint64 `json:"published"`
+	Full      uint64 `json:"buffer_full"` // dropped: the buffer was full
+	TimedOut  uint64 `json:"timeout"`     // dropped: not published within Timeout
+	Failed    uint64 `json:"error"`       // dropped: pubsub refused it
+}
+
+// Dropped returns how many messages were dropped, for any reason.
+func (s PublishStats) Dropped() uint64 {
+	return s.Full + s.TimedOut + s.Failed
+}
+
+// NewPublisher creates a publisher with room for buffer waiting messages. A
+// negative size takes the default. The worker starts with the first message.
+func NewPublisher(buffer int) *Publisher {
+	if buffer < 0 {
+		buffer = DefaultPublishBuffer
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Publisher{
+		Timeout: DefaultPublishTimeout,
+		queue:   make(chan publication, buffer),
+		send: func(ctx context.Context, topic *pubsub.Topic, data []byte) error {
+			return topic.Publish(ctx, data)
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Publish queues data for topic and returns at once. It reports false if the
+// message was dropped because the buffer is full or the publisher closed.
+func (p *Publisher) Publish(topic *pubsub.Topic, data []byte) bool {
+	p.start.Do(func() {
+		p.wg.Add(1)
+		go p.work()
+	})
+	if p.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case p.queue <- publication{topic: topic, data: data}:
+		p.mu.Lock()
+		p.fullSince = time.Time{}
+		p.mu.Unlock()
+		return true
+	default:
+		p.full.Add(1)
+		p.warnFull()
+		return false
+	}
+}
+
+// warnFull logs a warning once the buffer has been full for
+// publishFullWarning, and again every publishFullWarning while it stays full.
+func (p *Publisher) warnFull() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.fullSince.IsZero() {
+		p.fullSince = now
+		return
+	}
+	if now.Sub(p.fullSince) < publishFullWarning || now.Sub(p.warned) < publishFullWarning {
+		return
+	}
+	p.warned = now
+	fmt.Printf("[PubSub] Publish buffer full for %s, %d announcements dropped so far; the network is slower than the node announces\n",
+		now.Sub(p.fullSince).Round(time.Second), p.full.Load())
+}
+
+func (p *Publisher) work() {
+	defer p.wg.Done()
+	// pubsub doesn't give up a publish when its context ends, so one that
+	// times out is left to finish on its own. Only one is ever left at a
+	// time: the next message waits for it, within its own Timeout.
+	var inflight chan struct{}
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case m := <-p.queue:
+			inflight = p.publish(m, inflight)
+		}
+	}
+}
+
+// publish sends m once the previous publish, if still running, is done. It
+// returns the channel closed when m's publish returns.
+func (p *Publisher) publish(m publication, previous chan struct{}) chan struct{} {
+	ctx, cancel := context.WithTimeout(p.ctx, p.Timeout)
+	defer cancel()
+	if previous != nil {
+		select {
+		case <-previous:
+		case <-ctx.Done():
+			p.dropped(ctx.Err())
+			return previous
+		}
+	}
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		err = p.send(ctx, m.topic, m.data)
+	}()
+	select {
+	case <-done:
+		if err != nil {
+			p.dropped(err)
+		} else {
+			p.published.Add(1)
+		}
+	case <-ctx.Done():
+		p.dropped(ctx.Err())
+	}
+	return done
+}
+
+func (p *Publisher) dropped(err error) {
+	switch {
+	case p.ctx.Err() != nil:
+		// Closing, not a slow network
+	case err == context.DeadlineExceeded:
+		p.timedOut.Add(1)
+	default:
+		p.failed.Add(1)
+		fmt.Printf("[PubSub] Publish failed: %v\n", err)
+	}
+}
+
+// Stats returns how many messages wait and what became of the others.
+func (p *Publisher) Stats() PublishStats {
+	return PublishStats{
+		Queued:    len(p.queue),
+		Published: p.published.Load(),
+		Full:      p.full.Load(),
+		TimedOut:  p.timedOut.Load(),
+		Failed:    p.failed.Load(),
+	}
+}
+
+// Close stops the worker. Messages still queued are discarded.
+func (p *Publisher) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+func TestPublisherDropsInsteadOfBlocking(t *testing.T) {
+	p := NewPublisher(4)
+	p.Timeout = 50 * time.Millisecond
+	stalled := make(chan struct{})
+	p.send = func(ctx context.Context, _ *pubsub.Topic, _ []byte) error {
+		// A network that doesn't take the message until it recovers,
+		// whatever the context
+		<-stalled
+		return nil
+	}
+	defer p.Close()
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		p.Publish(nil, []byte("announcement"))
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("publishing 20 announcements took %s on a stalled network", took)
+	}
+	if s := p.Stats(); s.Full < 15 {
+		t.Errorf("%d dropped for a full buffer, want at least 15 of 20 with room for 4", s.Full)
+	}
+
+	// What was buffered times out, and every announcement is accounted for
+	for deadline := time.Now().Add(2 * time.Second); p.Stats().Dropped() < 20; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v, want all 20 dropped", p.Stats())
+		}
+	}
+	if s := p.Stats(); s.TimedOut == 0 || s.Published != 0 || s.Failed != 0 {
+		t.Errorf("stats %+v, want the buffered ones timed out", s)
+	}
+
+	// Once the network recovers announcements go out again
+	close(stalled)
+	if !p.Publish(nil, []byte("announcement")) {
+		t.Fatal("dropped with the buffer empty")
+	}
+	for deadline := time.Now().Add(2 * time.Second); p.Stats().Published != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v, want one published", p.Stats())
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package agent
+
+// raceEnabled is set when the race detector slows the tests down, which
+// throws off comparisons of how fast two code paths run.
+const raceEnabled = true
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// The ways reachPeer tries to reach a peer, in the order it tries them.
+const (
+	ReachPeerstore = "peerstore" // addresses the node already knows
+	ReachMetadata  = "metadata"  // the addrs the agent published in its ERC-8004 metadata
+	ReachDHT       = "dht"       // the node's PeerRouting
+	ReachRelay     = "relay"     // a circuit through one of the node's Relays
+)
+
+// reachStepTimeout bounds each way reachPeer tries.
+const reachStepTimeout = 10 * time.Second
+
+// ErrUnreachable is returned, as an *UnreachableError, when no way of
+// reaching a peer worked.
+var ErrUnreachable = errors.New("peer unreachable")
+
+// ReachAttempt is one way of reaching a peer that failed, and why.
+type ReachAttempt struct {
+	Method string `json:"method"`
+	Err    string `json:"error"`
+}
+
+// UnreachableError lists how the node tried to reach a peer. It matches
+// ErrUnreachable under errors.Is; use errors.As to see the attempts.
+type UnreachableError struct {
+	PeerID string
+	Tried  []ReachAttempt
+}
+
+func (e *UnreachableError) Error() string {
+	parts := make([]string, len(e.Tried))
+	for i, a := range e.Tried {
+		parts[i] = a.Method + ": " + a.Err
+	}
+	return fmt.Sprintf("peer %s unreachable (%s)", e.PeerID, strings.Join(parts, "; "))
+}
+
+func (e *UnreachableError) Is(target error) bool {
+	return target == ErrUnreachable
+}
+
+// reachPeer connects to pid unless the node is connected already. It tries
+// the peerstore's addresses, then the addresses the agent bound to pid
+// published in its metadata, then the node's PeerRouting, then a circuit
+// through each of its Relays, and returns an *UnreachableError if none
+// worked.
+func (n *AgentNode) reachPeer(ctx context.Context, pid peer.ID) error {
+	h := n.CurrentHost()
+	if h.Network().Connectedness(pid) == network.Connected {
+		return nil
+	}
+	unreachable := &UnreachableError{PeerID: pid.String()}
+	steps := []struct {
+		method string
+		addrs  func(ctx context.Context) ([]multiaddr.Multiaddr, error)
+	}{
+		{ReachPeerstore, func(context.Context) ([]multiaddr.Multiaddr, error) {
+			return h.Peerstore().Addrs(pid), nil
+		}},
+		{ReachMetadata, func(context.Context) ([]multiaddr.Multiaddr, error) {
+			return n.metadataAddrs(pid)
+		}},
+		{ReachDHT, func(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+			if n.PeerRouting == nil {
+				return nil, errors.New("no peer routing configured")
+			}
+			info, err := n.PeerRouting.FindPeer(ctx, pid)
+			return info.Addrs, err
+		}},
+		{ReachRelay, func(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+			return n.relayAddrs(ctx)
+		}},
+	}
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			unreachable.Tried = append(unreachable.Tried, ReachAttempt{Method: step.method, Err: err.Error()})
+			continue
+		}
+		stepCtx, cancel := context.WithTimeout(ctx, reachStepTimeout)
+		addrs, err := step.addrs(stepCtx)
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no addresses")
+		}
+		if err == nil {
+			h.Peerstore().AddAddrs(pid, addrs, time.Hour)
+			// Relays give limited connections, which the exchange may use
+			err = h.Connect(network.WithAllowLimitedConn(stepCtx, "deliver"), peer.AddrInfo{ID: pid, Addrs: addrs})
+		}
+		cancel()
+		if err == nil {
+			return nil
+		}
+		unreachable.Tried = append(unreachable.Tried, ReachAttempt{Method: step.method, Err: err.Error()})
+	}
+	return unreachable
+}
+
+// metadataAddrs returns the addresses published by the agent the address
+// book resolved pid to.
+func (n *AgentNode) metadataAddrs(pid peer.ID) ([]multiaddr.Multiaddr, error) {
+	if n.ERCClient == nil {
+		return nil, errors.New("no chain client")
+	}
+	e, err := n.Store.LookupPeerAddress(pid.String())
+	if err != nil {
+		return nil, err
+	}
+	agentId, ok := new(big.Int), false
+	if e != nil {
+		_, ok = agentId.SetString(e.AgentID, 10)
+	}
+	if !ok {
+		return nil, errors.New("no agent known for the peer")
+	}
+	return n.ERCClient.GetAgentAddrs(agentId)
+}
+
+// relayAddrs connects to the node's relays and returns a circuit address
+// through each that answered.
+func (n *AgentNode) relayAddrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	if len(n.Relays) == 0 {
+		return nil, errors.New("no relays configured")
+	}
+	h := n.CurrentHost()
+	var addrs []multiaddr.Multiaddr
+	var errs []error
+	for _, relay := range n.Relays {
+		if err := h.Connect(ctx, relay); err != nil {
+			errs = append(errs, fmt.Errorf("relay %s: %w", relay.ID, err))
+			continue
+		}
+		circuit, err := multiaddr.NewMultiaddr("/p2p/" + relay.ID.String() + "/p2p-circuit")
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, circuit)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return addrs, nil
+}
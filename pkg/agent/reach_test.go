@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// staticRouting is a PeerRouting that knows a fixed set of peers.
+type staticRouting map[peer.ID]peer.AddrInfo
+
+func (r staticRouting) FindPeer(_ context.Context, pid peer.ID) (peer.AddrInfo, error) {
+	if info, ok := r[pid]; ok {
+		return info, nil
+	}
+	return peer.AddrInfo{}, errors.New("not found")
+}
+
+func TestUnreachablePeersAreTriedEveryWayAndReported(t *testing.T) {
+	requester, responder := startTestNode(t), startTestNode(t)
+	rh := requester.CurrentHost()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	answer := KnowledgeAnswer{RequestID: "7", Topic: "go", Content: "channels"}
+
+	// The responder knows nothing but the requester's peer ID
+	_, err := responder.DeliverKnowledge(ctx, "query:7", rh.ID().String(), answer)
+	var unreachable *UnreachableError
+	if !errors.Is(err, ErrUnreachable) || !errors.As(err, &unreachable) {
+		t.Fatalf("delivery failed with %v, want ErrUnreachable", err)
+	}
+	var methods []string
+	for _, a := range unreachable.Tried {
+		methods = append(methods, a.Method)
+	}
+	if len(methods) != 4 || methods[0] != ReachPeerstore || methods[1] != ReachMetadata || methods[2] != ReachDHT || methods[3] != ReachRelay {
+		t.Errorf("tried %v, want peerstore, metadata, dht and relay in order", methods)
+	}
+	if unreachable.Tried[3].Err != "no relays configured" {
+		t.Errorf("relay failed with %q", unreachable.Tried[3].Err)
+	}
+
+	// Peer routing finds it
+	responder.PeerRouting = staticRouting{rh.ID(): {ID: rh.ID(), Addrs: rh.Addrs()}}
+	if _, err := responder.DeliverKnowledge(ctx, "query:7", rh.ID().String(), answer); err != nil {
+		t.Fatalf("delivery through peer routing: %v", err)
+	}
+}
+
+func TestPeersAreReachedThroughARelay(t *testing.T) {
+	rh, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.DisableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rh.Close() })
+	if _, err := relay.New(rh); err != nil {
+		t.Fatal(err)
+	}
+	relayInfo := peer.AddrInfo{ID: rh.ID(), Addrs: rh.Addrs()}
+
+	requester, responder := startTestNode(t), startTestNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	// The requester is only reachable through its reservation on the relay
+	if err := requester.CurrentHost().Connect(ctx, relayInfo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Reserve(ctx, requester.CurrentHost(), relayInfo); err != nil {
+		t.Fatal(err)
+	}
+	responder.Relays = []peer.AddrInfo{relayInfo}
+
+	answer := KnowledgeAnswer{RequestID: "8", Topic: "go", Content: "select"}
+	d, err := responder.DeliverKnowledge(ctx, "query:8", requester.CurrentHost().ID().String(), answer)
+	if err != nil || d.Status != DeliverySettled {
+		t.Fatalf("delivery through the relay: %+v, %v", d, err)
+	}
+	for _, c := range responder.CurrentHost().Network().ConnsToPeer(requester.CurrentHost().ID()) {
+		if _, err := c.RemoteMultiaddr().ValueForProtocol(multiaddr.P_CIRCUIT); err != nil {
+			t.Errorf("reached the requester at %s, not through the relay", c.RemoteMultiaddr())
+		}
+	}
+}
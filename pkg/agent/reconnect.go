@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Re-dial backoff for a dropped RPC connection. Variables so tests can
+// shorten them.
+var (
+	redialAttempts  = 5
+	redialBaseDelay = 250 * time.Millisecond
+	redialMaxDelay  = 8 * time.Second
+)
+
+// keepsConnection reports whether rpcURL is a transport holding one
+// connection open, websocket or IPC, which can drop and must be re-dialled.
+// HTTP connects per request.
+func keepsConnection(rpcURL string) bool {
+	u := strings.ToLower(rpcURL)
+	return strings.HasPrefix(u, "ws://") || strings.HasPrefix(u, "wss://") || !strings.Contains(u, "://")
+}
+
+// IsConnected reports whether the RPC connection is usable. It turns false
+// when a call fails on a dropped connection and true again once a re-dial
+// succeeds.
+func (c *ERC8004Client) IsConnected() bool {
+	return !c.disconnected.Load()
+}
+
+// conn returns the current connection and its generation, which increases
+// with every re-dial.
+func (c *ERC8004Client) conn() (*ethclient.Client, TxBackend, uint64) {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.client, c.backend, c.connGen
+}
+
+// read runs a read-only RPC call, once it holds a slot of the client's read
+// pool in ctx's lane. If it fails because the connection dropped, the client
+// is re-dialled with backoff and the call runs once more. Transactions don't
+// go through here: a send that failed mid-flight may still have been
+// accepted, so it is never repeated blindly.
+func (c *ERC8004Client) read(ctx context.Context, fn func(client *ethclient.Client, backend TxBackend) error) error {
+	client, backend, gen := c.conn()
+	err := c.pooled(ctx, func() error { return fn(client, backend) })
+	if !c.redials || !isConnError(err) {
+		return err
+	}
+	// The slot isn't held while re-dialling
+	if rerr := c.redial(gen); rerr != nil {
+		return fmt.Errorf("%w (re-dial failed: %v)", err, rerr)
+	}
+	client, backend, _ = c.conn()
+	return c.pooled(ctx, func() error { return fn(client, backend) })
+}
+
+// noteConnError marks the connection dead if err shows it dropped, so the
+// next call re-dials first.
+func (c *ERC8004Client) noteConnError(gen uint64, err error) {
+	if c.redials && isConnError(err) {
+		go c.redial(gen)
+	}
+}
+
+// redial replaces the connection of generation gen, retrying with
+// exponential backoff. Concurrent callers that saw the same dead connection
+// wait for one re-dial instead of each dialling. Calls keep using the old
+// connection, and failing fast, until the new one is in place.
+func (c *ERC8004Client) redial(gen uint64) error {
+	c.redialMu.Lock()
+	defer c.redialMu.Unlock()
+	if _, _, current := c.conn(); current != gen {
+		// Someone else already re-dialled
+		return nil
+	}
+	c.disconnected.Store(true)
+
+	delay := redialBaseDelay
+	var err error
+	for attempt := 1; attempt <= redialAttempts; attempt++ {
+		var client *ethclient.Client
+		if client, err = dialChecked(c.rpcURL); err == nil {
+			c.connMu.Lock()
+			old := c.client
+			if c.backend == TxBackend(old) {
+				c.backend = client
+			}
+			c.client = client
+			c.connGen++
+			c.connMu.Unlock()
+			old.Close()
+
+			c.disconnected.Store(false)
+			fmt.Printf("[ERC8004] Reconnected to RPC after %d attempt(s)\n", attempt)
+			return nil
+		}
+		fmt.Printf("[ERC8004] RPC re-dial attempt %d failed: %v\n", attempt, err)
+		if attempt < redialAttempts {
+			<-c.Clock().After(delay)
+			delay = min(2*delay, redialMaxDelay)
+		}
+	}
+	return err
+}
+
+// dialChecked dials rpcURL and makes sure the node answers before the
+// connection is trusted.
+func dialChecked(rpcURL string) (*ethclient.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := ethclient.DialContext(ctx, rpcURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.ChainID(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// isConnError reports whether err means the connection itself failed, as
+// opposed to the node answering with an error.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var rpcErr rpc.Error
+	var httpErr rpc.HTTPError
+	if errors.As(err, &rpcErr) || errors.As(err, &httpErr) {
+		return false
+	}
+	if errors.Is(err, rpc.ErrClientQuit) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || strings.Contains(err.Error(), "websocket: close")
+}
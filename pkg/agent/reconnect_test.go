@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// walletRPC answers eth_chainId, and every eth_call with wallet, as an
+// identity registry's getAgentWallet would.
+type walletRPC struct {
+	wallet common.Address
+}
+
+func (s *walletRPC) ChainId() hexutil.Uint64 {
+	return 84532
+}
+
+func (s *walletRPC) Call(args map[string]interface{}, block string) hexutil.Bytes {
+	return common.LeftPadBytes(s.wallet.Bytes(), 32)
+}
+
+// serveWebsocketRPC serves walletRPC over a websocket on addr and returns
+// the address it listens on and a func that drops it, connections included.
+func serveWebsocketRPC(t *testing.T, addr string, wallet common.Address) (string, func()) {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("eth", &walletRPC{wallet: wallet}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewUnstartedServer(srv.WebsocketHandler([]string{"*"}))
+	hs.Listener.Close()
+	hs.Listener = ln
+	hs.Start()
+
+	stopped := false
+	stop := func() {
+		if !stopped {
+			stopped = true
+			// Stopping the RPC server closes the hijacked websocket connections
+			srv.Stop()
+			hs.Close()
+		}
+	}
+	t.Cleanup(stop)
+	return ln.Addr().String(), stop
+}
+
+// fastRedial shortens the re-dial backoff for the test.
+func fastRedial(t *testing.T, attempts int) {
+	attemptsBefore, delayBefore := redialAttempts, redialBaseDelay
+	t.Cleanup(func() { redialAttempts, redialBaseDelay = attemptsBefore, delayBefore })
+	redialAttempts, redialBaseDelay = attempts, 50*time.Millisecond
+}
+
+func TestClientRedialsDroppedWebsocket(t *testing.T) {
+	fastRedial(t, 20)
+	wallet := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	addr, drop := serveWebsocketRPC(t, "127.0.0.1:0", wallet)
+
+	client := NewERC8004Client("ws://"+addr, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	if client == nil {
+		t.Fatal("failed to dial the websocket RPC")
+	}
+	defer client.Close()
+	if got, err := client.GetAgentWallet(big.NewInt(1)); err != nil || got != wallet {
+		t.Fatalf("GetAgentWallet = %s, %v", got.Hex(), err)
+	}
+
+	// The provider goes away and comes back on the same address
+	drop()
+	restarted := make(chan struct{})
+	go func() {
+		defer close(restarted)
+		time.Sleep(300 * time.Millisecond)
+		serveWebsocketRPC(t, addr, wallet)
+	}()
+
+	got, err := client.GetAgentWallet(big.NewInt(1))
+	<-restarted
+	if err != nil || got != wallet {
+		t.Fatalf("GetAgentWallet across the outage = %s, %v", got.Hex(), err)
+	}
+	if !client.IsConnected() {
+		t.Error("IsConnected = false after a successful re-dial")
+	}
+}
+
+func TestClientReportsLostConnection(t *testing.T) {
+	fastRedial(t, 2)
+	wallet := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	addr, drop := serveWebsocketRPC(t, "127.0.0.1:0", wallet)
+
+	client := NewERC8004Client("ws://"+addr, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	if client == nil {
+		t.Fatal("failed to dial the websocket RPC")
+	}
+	defer client.Close()
+	if !client.IsConnected() {
+		t.Fatal("IsConnected = false on a fresh connection")
+	}
+
+	drop()
+	if _, err := client.GetAgentWallet(big.NewInt(1)); err == nil {
+		t.Fatal("GetAgentWallet succeeded with the provider down")
+	}
+	if client.IsConnected() {
+		t.Error("IsConnected = true after re-dialling failed")
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{rpc.ErrClientQuit, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: net.ErrClosed}, true},
+		{rpc.HTTPError{StatusCode: 429, Status: "429 Too Many Requests"}, false},
+	}
+	for _, tt := range tests {
+		if got := isConnError(tt.err); got != tt.want {
+			t.Errorf("isConnError(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
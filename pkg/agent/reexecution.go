@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"agentmesh/pkg/agent/canonical"
+)
+
+// Names of the VerificationStrategy implementations, as recorded on a
+// Reexecution.
+const (
+	StrategyExactHash  = "exact-hash"
+	StrategyStructural = "structural"
+	StrategyTolerance  = "tolerance"
+)
+
+// ExecutorLocal names the node itself as the executor of a re-execution.
+const ExecutorLocal = "local"
+
+// VerificationStrategy decides whether two executions of the same task
+// agree. Both results are given as decoded JSON.
+type VerificationStrategy interface {
+	Name() string
+	// Compare reports whether the results agree and, if they don't, where
+	// they first differ.
+	Compare(first, second interface{}) (ok bool, diff string)
+}
+
+// ExactHash requires the results to hash the same, as canonical JSON. It
+// suits capabilities whose output is deterministic.
+type ExactHash struct{}
+
+func (ExactHash) Name() string { return StrategyExactHash }
+
+func (ExactHash) Compare(first, second interface{}) (bool, string) {
+	a, b := resultHash(first), resultHash(second)
+	if a != b {
+		return false, fmt.Sprintf("result hashes %s and %s differ", a, b)
+	}
+	return true, ""
+}
+
+// StructuralMatch requires the results to be equal as JSON values, whatever
+// their key order, except at the Ignore paths, such as "generatedAt" or
+// "items[0].id", which may differ.
+type StructuralMatch struct {
+	Ignore []string
+}
+
+func (StructuralMatch) Name() string { return StrategyStructural }
+
+func (m StructuralMatch) Compare(first, second interface{}) (bool, string) {
+	diff := compareJSON(first, second, "", m.Ignore, func(a, b float64) bool { return a == b })
+	return diff == "", diff
+}
+
+// ToleranceMatch is StructuralMatch with numbers that may differ by up to
+// Absolute, or by up to Relative of the larger of the two, for capabilities
+// whose floating-point output varies from run to run.
+type ToleranceMatch struct {
+	Absolute float64
+	Relative float64
+	Ignore   []string
+}
+
+func (ToleranceMatch) Name() string { return StrategyTolerance }
+
+func (m ToleranceMatch) Compare(first, second interface{}) (bool, string) {
+	diff := compareJSON(first, second, "", m.Ignore, func(a, b float64) bool {
+		d := math.Abs(a - b)
+		return d <= m.Absolute || d <= m.Relative*math.Max(math.Abs(a), math.Abs(b))
+	})
+	return diff == "", diff
+}
+
+// compareJSON returns where decoded JSON values a and b first differ, with
+// numbers compared by equal, or "" if they don't. path is where they are,
+// "" for the top.
+func compareJSON(a, b interface{}, path string, ignore []string, equal func(a, b float64) bool) string {
+	if ignored(path, ignore) {
+		return ""
+	}
+	where := path
+	if where == "" {
+		where = "the result"
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf("%s: an object and %s", where, jsonKind(b))
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub := k
+			if path != "" {
+				sub = path + "." + k
+			}
+			va, inA := a[k]
+			vb, inB := b[k]
+			if inA != inB && !ignored(sub, ignore) {
+				return fmt.Sprintf("%s: only one result has it", sub)
+			}
+			if diff := compareJSON(va, vb, sub, ignore, equal); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			return fmt.Sprintf("%s: an array and %s", where, jsonKind(b))
+		}
+		if len(a) != len(b) {
+			return fmt.Sprintf("%s: %d and %d items", where, len(a), len(b))
+		}
+		for i := range a {
+			if diff := compareJSON(a[i], b[i], fmt.Sprintf("%s[%d]", path, i), ignore, equal); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case float64:
+		b, ok := b.(float64)
+		if !ok || !equal(a, b) {
+			return fmt.Sprintf("%s: %v and %v", where, a, b)
+		}
+		return ""
+	default:
+		if a != b {
+			return fmt.Sprintf("%s: %v and %v", where, a, b)
+		}
+		return ""
+	}
+}
+
+func ignored(path string, ignore []string) bool {
+	for _, p := range ignore {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// resultHash is the keccak256 hash of result as canonical JSON.
+func resultHash(result interface{}) string {
+	raw, err := canonical.Marshal(result)
+	if err != nil {
+		return ""
+	}
+	return ethcrypto.Keccak256Hash(raw).Hex()
+}
+
+// Reexecutor runs a task a second time, returning its result and who ran
+// it: a peer ID or ExecutorLocal.
+type Reexecutor func(ctx context.Context, payload interface{}) (result interface{}, executor string, err error)
+
+// PeerReexecutor sends the task to pid, a second agent, as SendTask does.
+func (n *AgentNode) PeerReexecutor(pid peer.ID) Reexecutor {
+	return func(ctx context.Context, payload interface{}) (interface{}, string, error) {
+		if err := n.permit(pid, PolicyActionDeliver); err != nil {
+			return nil, "", err
+		}
+		resp, err := n.exchangeFollowingMoves(ctx, pid, n.taskMessage(payload))
+		if err != nil {
+			return nil, "", err
+		}
+		return resp.Payload, pid.String(), nil
+	}
+}
+
+// LocalReexecutor runs the task through the node's own handler for its
+// capability.
+func (n *AgentNode) LocalReexecutor() Reexecutor {
+	return func(ctx context.Context, payload interface{}) (interface{}, string, error) {
+		capability := taskCapability(payload)
+		b, ok := n.binding(capability)
+		if !ok {
+			return nil, "", fmt.Errorf("%w %q", ErrUnknownCapability, capability)
+		}
+		req := TaskRequest{Capability: b.def.Name, Payload: map[string]interface{}{}, Sender: n.CurrentHost().ID().String(), Node: n}
+		fields, _ := payload.(map[string]interface{})
+		for k, v := range fields {
+			if k != "capability" {
+				req.Payload[k] = v
+			}
+		}
+		ctx, cancel := context.WithTimeout(ctx, capabilityTimeout)
+		defer cancel()
+		result, err := n.runHandler(ctx, "", b, req)
+		if err != nil {
+			return nil, "", err
+		}
+		if stream, ok := result.(*StreamResult); ok {
+			stream.Close()
+			return nil, "", fmt.Errorf("%s streams its result, which can't be compared", b.def.Name)
+		}
+		return result, ExecutorLocal, nil
+	}
+}
+
+// Reexecution records a task run a second time to check the result of the
+// first, and how the two compared. It is kept on the task record with the
+// verifier's report.
+type Reexecution struct {
+	Strategy   string `json:"strategy"`
+	Executor   string `json:"executor"`   // who ran it again: a peer ID or "local"
+	FirstHash  string `json:"firstHash"`  // of the delivered result, as canonical JSON
+	SecondHash string `json:"secondHash"` // of the second result, likewise
+	Matched    bool   `json:"matched"`
+	Diff       string `json:"diff,omitempty"` // where the results differ
+}
+
+// ReexecutionVerifier checks a delegated result by running the task again
+// with run and comparing the two results, for DelegateVerified. Each
+// capability is compared by its strategy in strategies, or by ExactHash if
+// it has none. A mismatch fails the result, so it is disputed; a second run
+// that fails leaves it unverified.
+func ReexecutionVerifier(run Reexecutor, strategies map[string]VerificationStrategy) VerifierFunc {
+	return func(ctx context.Context, payload, result interface{}) (VerifierReport, error) {
+		var strategy VerificationStrategy = ExactHash{}
+		if s, ok := strategies[taskCapability(payload)]; ok {
+			strategy = s
+		}
+		second, executor, err := run(ctx, payload)
+		if err != nil {
+			return VerifierReport{}, fmt.Errorf("re-execution failed: %w", err)
+		}
+		first, err := asJSON(result)
+		if err != nil {
+			return VerifierReport{}, err
+		}
+		if second, err = asJSON(second); err != nil {
+			return VerifierReport{}, fmt.Errorf("re-execution result: %w", err)
+		}
+
+		ok, diff := strategy.Compare(first, second)
+		rx := &Reexecution{Strategy: strategy.Name(), Executor: executor, FirstHash: resultHash(first),
+			SecondHash: resultHash(second), Matched: ok, Diff: diff}
+		report := VerifierReport{Passed: ok, Reexecution: rx}
+		if !ok {
+			report.Output = fmt.Sprintf("results differ (%s): %s", strategy.Name(), diff)
+		}
+		return report, nil
+	}
+}
+
+// asJSON returns v as it would decode from JSON, so results from handlers
+// and from the wire compare alike.
+func asJSON(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(raw, &out)
+	return out, err
+}
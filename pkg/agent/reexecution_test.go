@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const scoreManifest = `
+version: 1
+capabilities:
+  - name: score
+    description: Score a document
+    handler: echo
+`
+
+func TestReexecutionVerifier(t *testing.T) {
+	delegator, worker := connectedPair(t)
+	for _, n := range []*AgentNode{delegator, worker} {
+		if err := n.LoadCapabilities([]string{writeManifest(t, scoreManifest)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pid := worker.CurrentHost().ID()
+	payload := map[string]interface{}{"capability": "score", "text": "a long document", "score": 0.75}
+
+	// rerun stands in for a second agent whose score is slightly off
+	rerun := func(score float64) Reexecutor {
+		return func(ctx context.Context, payload interface{}) (interface{}, string, error) {
+			return map[string]interface{}{"text": "a long document", "score": score}, "second", nil
+		}
+	}
+
+	tests := []struct {
+		name     string
+		taskID   int64
+		run      Reexecutor
+		strategy VerificationStrategy
+		outcome  string
+	}{
+		{"exact match run locally", 1, delegator.LocalReexecutor(), nil, VerificationApproved},
+		{"within tolerance", 2, rerun(0.7500001), ToleranceMatch{Absolute: 1e-3}, VerificationApproved},
+		{"outside tolerance", 3, rerun(0.8), ToleranceMatch{Absolute: 1e-3}, VerificationDisputed},
+		{"floats differ under exact hash", 4, rerun(0.7500001), nil, VerificationDisputed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategies := map[string]VerificationStrategy{}
+			if tt.strategy != nil {
+				strategies["score"] = tt.strategy
+			}
+			settle := &fakeSettlement{}
+			_, v, err := delegator.DelegateVerified(ctx, pid, big.NewInt(tt.taskID), payload, ReexecutionVerifier(tt.run, strategies), settle)
+			if tt.outcome == VerificationDisputed && !errors.Is(err, ErrResultRejected) {
+				t.Fatalf("err = %v, want ErrResultRejected", err)
+			}
+			if tt.outcome == VerificationApproved && err != nil {
+				t.Fatalf("DelegateVerified: %v", err)
+			}
+			if v.Outcome != tt.outcome {
+				t.Errorf("outcome = %s, want %s", v.Outcome, tt.outcome)
+			}
+			if tt.outcome == VerificationDisputed && len(settle.disputed) != 1 {
+				t.Errorf("settlement = %+v, want one dispute", settle)
+			}
+
+			// Both executions and how they compared are on the task record
+			record, _ := delegator.Store.GetTask(fmt.Sprintf("task:%d", tt.taskID))
+			if record == nil || record.Verification == nil || record.Verification.Verifier == nil || record.Verification.Verifier.Reexecution == nil {
+				t.Fatalf("record = %+v, want its re-execution", record)
+			}
+			rx := record.Verification.Verifier.Reexecution
+			if rx.FirstHash == "" || rx.SecondHash == "" || rx.Matched != (tt.outcome == VerificationApproved) {
+				t.Errorf("re-execution = %+v", rx)
+			}
+			if !rx.Matched && rx.Diff == "" {
+				t.Errorf("re-execution %+v doesn't say where the results differ", rx)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Recorded event kinds.
+const (
+	RecordedTaskCreated        = "task_created"
+	RecordedKnowledgeRequested = "knowledge_requested"
+)
+
+// RecordedEvent is one line of a recording made by 'agent record': a chain
+// event in a flat, hand-editable form, stamped with when it was observed.
+type RecordedEvent struct {
+	Kind    string `json:"kind"`
+	Block   uint64 `json:"block,omitempty"`
+	Time    int64  `json:"time"`    // unix ms when observed
+	ID      string `json:"id"`      // taskId or requestId
+	Account string `json:"account"` // task client or knowledge requester
+	Hash    string `json:"hash"`    // specHash or topicHash
+	Amount  string `json:"amount"`  // payment or bounty, wei
+	Topic   string `json:"topic,omitempty"`
+	PeerID  string `json:"peerId,omitempty"` // requester's peerId, if it resolved when recorded
+	// Endpoint is the requester's HTTP endpoint, if it resolved to one
+	Endpoint string `json:"endpoint,omitempty"`
+	// Contract is the escrow or market the event came from, when it wasn't
+	// the first the recording watched
+	Contract string `json:"contract,omitempty"`
+	ChainID  uint64 `json:"chainId,omitempty"` // the chain it came from, if the watcher was bound to one
+	// OtherChain is set when ChainID wasn't the recording node's primary
+	// chain, so the event's task ID names it
+	OtherChain bool `json:"otherChain,omitempty"`
+}
+
+// RecordTask converts a TaskCreated event for recording.
+func RecordTask(e TaskCreatedEvent) RecordedEvent {
+	r := RecordedEvent{
+		Kind:    RecordedTaskCreated,
+		Block:   e.Block,
+		Time:    time.Now().UnixMilli(),
+		ID:      e.TaskId.String(),
+		Account: e.Client.Hex(),
+		Hash:    common.Hash(e.SpecHash).Hex(),
+		Amount:  e.Payment.String(),
+	}
+	if e.qualified {
+		r.Contract = e.Contract.Hex()
+	}
+	r.ChainID, r.OtherChain = e.ChainID, e.chainQualified
+	return r
+}
+
+// RecordQuery converts a KnowledgeRequested event for recording.
+func RecordQuery(q KnowledgeRequestedEvent) RecordedEvent {
+	r := RecordedEvent{
+		Kind:    RecordedKnowledgeRequested,
+		Block:   q.Block,
+		Time:    time.Now().UnixMilli(),
+		ID:      q.RequestId.String(),
+		Account: q.Requester.Hex(),
+		Hash:    common.Hash(q.TopicHash).Hex(),
+		Amount:  q.Bounty.String(),
+		Topic:   q.Topic,
+	}
+	if q.qualified {
+		r.Contract = q.Contract.Hex()
+	}
+	r.ChainID, r.OtherChain = q.ChainID, q.chainQualified
+	return r
+}
+
+// TaskEvent converts a recorded task_created event back.
+func (r RecordedEvent) TaskEvent() (TaskCreatedEvent, error) {
+	id, amount, err := r.numbers()
+	if err != nil {
+		return TaskCreatedEvent{}, err
+	}
+	return TaskCreatedEvent{
+		TaskId:         id,
+		Client:         common.HexToAddress(r.Account),
+		SpecHash:       common.HexToHash(r.Hash),
+		Payment:        amount,
+		Block:          r.Block,
+		Contract:       common.HexToAddress(r.Contract),
+		ChainID:        r.ChainID,
+		qualified:      r.Contract != "",
+		chainQualified: r.OtherChain,
+	}, nil
+}
+
+// QueryEvent converts a recorded knowledge_requested event back.
+func (r RecordedEvent) QueryEvent() (KnowledgeRequestedEvent, error) {
+	id, amount, err := r.numbers()
+	if err != nil {
+		return KnowledgeRequestedEvent{}, err
+	}
+	return KnowledgeRequestedEvent{
+		RequestId:      id,
+		Requester:      common.HexToAddress(r.Account),
+		Topic:          r.Topic,
+		TopicHash:      common.HexToHash(r.Hash),
+		Bounty:         amount,
+		Block:          r.Block,
+		Contract:       common.HexToAddress(r.Contract),
+		ChainID:        r.ChainID,
+		qualified:      r.Contract != "",
+		chainQualified: r.OtherChain,
+	}, nil
+}
+
+func (r RecordedEvent) numbers() (*big.Int, *big.Int, error) {
+	id, ok := new(big.Int).SetString(r.ID, 10)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid id %q", r.ID)
+	}
+	amount := new(big.Int)
+	if r.Amount != "" {
+		if _, ok := amount.SetString(r.Amount, 10); !ok {
+			return nil, nil, fmt.Errorf("invalid amount %q", r.Amount)
+		}
+	}
+	return id, amount, nil
+}
+
+// ReadRecordedEvents parses a JSONL recording. Blank lines are ignored.
+func ReadRecordedEvents(r io.Reader) ([]RecordedEvent, error) {
+	var events []RecordedEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.Kind != RecordedTaskCreated && e.Kind != RecordedKnowledgeRequested {
+			return nil, fmt.Errorf("line %d: unknown event kind %q", line, e.Kind)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// ReplaySource delivers recorded events to the same callbacks the live
+// EventWatcher would, so the intake pipeline can be exercised offline.
+type ReplaySource struct {
+	events  []RecordedEvent
+	onTask  TaskCreatedHandler
+	onQuery KnowledgeRequestedHandler
+
+	// Speed compresses the recorded gaps between events: 1 replays in real
+	// time, 10 ten times faster, 0 without any delay.
+	Speed float64
+	// Step, when set, is called before each event and can block, e.g. until
+	// the user presses Enter. Speed is ignored while stepping.
+	Step func(e RecordedEvent)
+}
+
+func NewReplaySource(events []RecordedEvent, onTask TaskCreatedHandler, onQuery KnowledgeRequestedHandler) *ReplaySource {
+	return &ReplaySource{events: events, onTask: onTask, onQuery: onQuery}
+}
+
+// Start replays every event in order and returns when done or when ctx ends.
+func (r *ReplaySource) Start(ctx context.Context) {
+	for i, e := range r.events {
+		if r.Step != nil {
+			r.Step(e)
+		} else if r.Speed > 0 && i > 0 && e.Time > r.events[i-1].Time {
+			gap := time.Duration(float64(time.Duration(e.Time-r.events[i-1].Time)*time.Millisecond) / r.Speed)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(gap):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch e.Kind {
+		case RecordedTaskCreated:
+			ev, err := e.TaskEvent()
+			if err != nil {
+				fmt.Printf("[Replay] Skipping task %s: %v\n", e.ID, err)
+				continue
+			}
+			if r.onTask != nil {
+				if err := r.onTask(ev); err != nil {
+					fmt.Printf("[Replay] Task %s failed: %v\n", e.ID, err)
+				}
+			}
+		case RecordedKnowledgeRequested:
+			ev, err := e.QueryEvent()
+			if err != nil {
+				fmt.Printf("[Replay] Skipping request %s: %v\n", e.ID, err)
+				continue
+			}
+			if r.onQuery != nil {
+				if err := r.onQuery(ev); err != nil {
+					fmt.Printf("[Replay] Request %s failed: %v\n", e.ID, err)
+				}
+			}
+		}
+	}
+}
@@ -2,22 +2,32 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ABIs for ERC-8004 v2.0.0
 const (
 	identityABI = `[
 		{"inputs":[{"internalType":"uint256","name":"agentId","type":"uint256"}],"name":"getAgentWallet","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},
+		{"inputs":[{"internalType":"uint256","name":"tokenId","type":"uint256"}],"name":"tokenURI","outputs":[{"internalType":"string","name":"","type":"string"}],"stateMutability":"view","type":"function"},
 		{"inputs":[{"internalType":"uint256","name":"tokenId","type":"uint256"}],"name":"ownerOf","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},
-		{"inputs":[{"internalType":"uint256","name":"agentId","type":"uint256"},{"internalType":"string","name":"metadataKey","type":"string"}],"name":"getMetadata","outputs":[{"internalType":"bytes","name":"","type":"bytes"}],"stateMutability":"view","type":"function"}
+		{"inputs":[{"internalType":"uint256","name":"agentId","type":"uint256"},{"internalType":"string","name":"metadataKey","type":"string"}],"name":"getMetadata","outputs":[{"internalType":"bytes","name":"","type":"bytes"}],"stateMutability":"view","type":"function"},
+		{"inputs":[{"internalType":"uint256","name":"agentId","type":"uint256"},{"internalType":"string[]","name":"metadataKeys","type":"string[]"}],"name":"getMetadata","outputs":[{"internalType":"bytes[]","name":"","type":"bytes[]"}],"stateMutability":"view","type":"function"},
+		{"inputs":[{"internalType":"string","name":"agentURI","type":"string"}],"name":"register","outputs":[{"internalType":"uint256","name":"agentId","type":"uint256"}],"stateMutability":"nonpayable","type":"function"},
+		{"inputs":[{"internalType":"uint256","name":"agentId","type":"uint256"},{"internalType":"string","name":"metadataKey","type":"string"},{"internalType":"bytes","name":"metadataValue","type":"bytes"}],"name":"setMetadata","outputs":[],"stateMutability":"nonpayable","type":"function"}
 	]`
 	reputationABI = `[
 		{"inputs":[
@@ -39,13 +49,32 @@ const (
 		],"name":"getSummary","outputs":[
 			{"internalType":"uint64","name":"count","type":"uint64"},
 			{"internalType":"uint8","name":"avgResponse","type":"uint8"}
-		],"stateMutability":"view","type":"function"}
+		],"stateMutability":"view","type":"function"},
+		{"inputs":[
+			{"internalType":"bytes32","name":"requestHash","type":"bytes32"},
+			{"internalType":"uint8","name":"response","type":"uint8"},
+			{"internalType":"string","name":"responseURI","type":"string"},
+			{"internalType":"bytes32","name":"responseHash","type":"bytes32"},
+			{"internalType":"string","name":"tag","type":"string"}
+		],"name":"validationResponse","outputs":[],"stateMutability":"nonpayable","type":"function"},
+		{"anonymous":false,"inputs":[
+			{"indexed":true,"internalType":"address","name":"validatorAddress","type":"address"},
+			{"indexed":true,"internalType":"uint256","name":"agentId","type":"uint256"},
+			{"indexed":true,"internalType":"bytes32","name":"requestHash","type":"bytes32"},
+			{"indexed":false,"internalType":"uint8","name":"response","type":"uint8"},
+			{"indexed":false,"internalType":"string","name":"responseURI","type":"string"},
+			{"indexed":false,"internalType":"bytes32","name":"responseHash","type":"bytes32"},
+			{"indexed":false,"internalType":"string","name":"tag","type":"string"}
+		],"name":"ValidationResponse","type":"event"}
 	]`
 )
 
+// registeredEventSig is Keccak256("Registered(uint256,string,address)") emitted by the IdentityRegistry.
+var registeredEventSig = common.HexToHash("ca52e62c367d81bb2e328eb795f7c7ba24afb478408a26c0e201d155c449bc4a")
+
 // ERC8004Client provides methods to query the ERC-8004 v2.0.0 Registries on-chain.
 type ERC8004Client struct {
-	client       *ethclient.Client
+	rpcURL       string
 	identityAddr common.Address
 	reputAddr    common.Address
 	validAddr    common.Address
@@ -53,6 +82,40 @@ type ERC8004Client struct {
 	identityABI   abi.ABI
 	reputationABI abi.ABI
 	validationABI abi.ABI
+	escrowABI     abi.ABI
+	marketABI     abi.ABI
+
+	summaryBatchSize int
+	strictBinding    bool
+	verification     VerificationMode
+	blockTag         BlockTag     // the block reads see by default; see SetBlockTag
+	metadataBatch    atomic.Int32 // how GetMetadataBatch reads, once learned
+	scanner          *LogScanner  // registry log scans; nil for the defaults
+	readPool         *RPCReadPool // caps reads in flight; nil for no cap
+	validations      validationCache
+
+	// The connection, replaced when a websocket or IPC connection drops
+	connMu       sync.RWMutex
+	client       *ethclient.Client
+	backend      TxBackend // client, unless replaced with SetTxBackend
+	rpcCache     *RPCCache // reads go through it, if set
+	connGen      uint64
+	redials      bool
+	redialMu     sync.Mutex
+	disconnected atomic.Bool
+
+	// Dry-run mode: write paths are simulated and journaled, never sent
+	dryRun   bool
+	journal  MetadataStore
+	governor *TxGovernor
+	simMu    sync.Mutex
+	sims     []TxSimulation
+
+	tracing trace.TracerProvider
+	clock   Clock
+
+	chainID       uint64 // the chain transactions must go to; 0 for any
+	registryBlock uint64 // where registry log scans start; 0 for registryDeployBlock
 }
 
 func NewERC8004Client(rpcURL string, identityAddr, reputAddr, validAddr string) *ERC8004Client {
@@ -65,22 +128,32 @@ func NewERC8004Client(rpcURL string, identityAddr, reputAddr, validAddr string)
 	iABI, _ := abi.JSON(strings.NewReader(identityABI))
 	rABI, _ := abi.JSON(strings.NewReader(reputationABI))
 	vABI, _ := abi.JSON(strings.NewReader(validationABI))
+	eABI, _ := abi.JSON(strings.NewReader(taskEscrowABI))
+	mABI, _ := abi.JSON(strings.NewReader(knowledgeMarketABI))
 
 	return &ERC8004Client{
+		rpcURL:        rpcURL,
 		client:        client,
+		backend:       client,
+		redials:       keepsConnection(rpcURL),
 		identityAddr:  common.HexToAddress(identityAddr),
 		reputAddr:     common.HexToAddress(reputAddr),
 		validAddr:     common.HexToAddress(validAddr),
 		identityABI:   iABI,
 		reputationABI: rABI,
 		validationABI: vABI,
+		escrowABI:     eABI,
+		marketABI:     mABI,
+		clock:         SystemClock,
 	}
 }
 
-// GetAgentWallet returns the verified wallet address for an agent ID.
-func (c *ERC8004Client) GetAgentWallet(agentId *big.Int) (common.Address, error) {
+// GetAgentWallet returns the verified wallet address for an agent ID. Like
+// the other typed reads, it is made against at, if given, or the client's
+// default block.
+func (c *ERC8004Client) GetAgentWallet(agentId *big.Int, at ...BlockTag) (common.Address, error) {
 	data, _ := c.identityABI.Pack("getAgentWallet", agentId)
-	res, err := c.call(c.identityAddr, data)
+	res, err := c.call(c.identityAddr, data, c.readBlock(at))
 	if err != nil {
 		return common.Address{}, err
 	}
@@ -90,12 +163,12 @@ func (c *ERC8004Client) GetAgentWallet(agentId *big.Int) (common.Address, error)
 }
 
 // GetMetadata retrieves a specific metadata value for an agent.
-func (c *ERC8004Client) GetMetadata(agentId *big.Int, key string) (string, error) {
+func (c *ERC8004Client) GetMetadata(agentId *big.Int, key string, at ...BlockTag) (string, error) {
 	data, err := c.identityABI.Pack("getMetadata", agentId, key)
 	if err != nil {
 		return "", err
 	}
-	res, err := c.call(c.identityAddr, data)
+	res, err := c.call(c.identityAddr, data, c.readBlock(at))
 	if err != nil {
 		return "", err
 	}
@@ -104,50 +177,198 @@ func (c *ERC8004Client) GetMetadata(agentId *big.Int, key string) (string, error
 	return string(val), err
 }
 
+// registryDeployBlock is where scans of the IdentityRegistry's logs start:
+// its deployment block on Base Sepolia.
+const registryDeployBlock = 12345678
+
+// registryLogRange is the most blocks one eth_getLogs call of a registry
+// scan asks for. The scans filter on the registry and an indexed topic, so
+// even a range of months holds few logs: the first lookup of a wallet takes
+// tens of calls rather than the thousands DefaultLogRange windows would,
+// and the LogScanner narrows the range for RPCs that refuse it.
+const registryLogRange = 500_000
+
+// SetRegistryDeployBlock sets where scans of the IdentityRegistry's logs
+// start, for a registry deployed elsewhere than on Base Sepolia. 0 restores
+// the default.
+func (c *ERC8004Client) SetRegistryDeployBlock(block uint64) {
+	c.registryBlock = block
+}
+
+// ErrWalletNotRegistered means a registry scan found no agent registered by
+// the wallet.
+var ErrWalletNotRegistered = errors.New("no agent identity NFT found in the registry")
+
+// WalletScan is the progress of a search of the IdentityRegistry for the
+// agent a wallet registered. Passing it back to ScanAgentIdByWallet resumes
+// the search after ScannedBlock.
+type WalletScan struct {
+	AgentID      *big.Int // latest agent registered by the wallet so far, or nil
+	ScannedBlock uint64   // last block searched; 0 before the first chunk
+}
+
 // GetAgentIdByWallet attempts to find an agent ID owned by a wallet by scanning logs.
 func (c *ERC8004Client) GetAgentIdByWallet(wallet common.Address) (*big.Int, error) {
-	// Registered(uint256 indexed agentId, string agentURI, address indexed owner)
-	// Topic 0: Keccak256("Registered(uint256,string,address)")
-	// Topic 2: address (indexed owner)
-	sigHash := common.HexToHash("ca52e62c367d81bb2e328eb795f7c7ba24afb478408a26c0e201d155c449bc4a")
-
-	query := ethereum.FilterQuery{
-		FromBlock: big.NewInt(12345678), // Registry deployment block on Base Sepolia
-		ToBlock:   nil,
-		Addresses: []common.Address{c.identityAddr},
-		Topics: [][]common.Hash{
-			{sigHash},
-			nil,
-			{common.BytesToHash(wallet.Bytes())},
-		},
-	}
-
-	logs, err := c.client.FilterLogs(context.Background(), query)
+	return c.GetAgentIdByWalletContext(context.Background(), wallet)
+}
+
+// GetAgentIdByWalletContext is GetAgentIdByWallet, giving up once ctx is done.
+func (c *ERC8004Client) GetAgentIdByWalletContext(ctx context.Context, wallet common.Address) (*big.Int, error) {
+	scan, err := c.ScanAgentIdByWallet(ctx, wallet, WalletScan{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to filter registry logs: %w", err)
+		return nil, err
 	}
+	return scan.AgentID, nil
+}
 
-	if len(logs) == 0 {
-		return nil, fmt.Errorf("no agent identity NFT found for wallet %s in the registry", wallet.Hex())
+// SetLogScanner sets the scanner registry log scans use, to share its rate
+// limit or change its workers. nil restores the defaults.
+func (c *ERC8004Client) SetLogScanner(s *LogScanner) {
+	c.scanner = s
+}
+
+// ScanAgentIdByWallet searches the registry's Registered logs for wallet, in
+// windows of up to registryLogRange blocks fetched concurrently by the
+// client's LogScanner, from the block after prev.ScannedBlock up to the head. The
+// progress made, up to the last window searched before an error or
+// cancellation, is returned along with the error, so a later scan can resume
+// from it.
+func (c *ERC8004Client) ScanAgentIdByWallet(ctx context.Context, wallet common.Address, prev WalletScan) (WalletScan, error) {
+	scan := prev
+	var head uint64
+	err := c.read(ctx, func(_ *ethclient.Client, b TxBackend) error {
+		h, err := b.HeaderByNumber(ctx, nil)
+		if err == nil {
+			head = h.Number.Uint64()
+		}
+		return err
+	})
+	if err != nil {
+		return scan, fmt.Errorf("failed to read the head block: %w", err)
 	}
 
-	// agentId is indexed, so it's in Topics[1]
-	return new(big.Int).SetBytes(logs[len(logs)-1].Topics[1].Bytes()), nil
+	from := uint64(registryDeployBlock)
+	if c.registryBlock > 0 {
+		from = c.registryBlock
+	}
+	if scan.ScannedBlock >= from {
+		from = scan.ScannedBlock + 1
+	}
+	err = c.scanner.Scan(ctx, from, head, registryLogRange, c.registeredLogs(&wallet), func(_, to uint64, logs []types.Log) error {
+		if len(logs) > 0 {
+			// agentId is indexed, so it's in Topics[1]
+			scan.AgentID = new(big.Int).SetBytes(logs[len(logs)-1].Topics[1].Bytes())
+		}
+		scan.ScannedBlock = to
+		return nil
+	})
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		// The RPC error doesn't reliably wrap the context's
+		return scan, fmt.Errorf("registry scan stopped after block %d: %w", scan.ScannedBlock, ctxErr)
+	}
+	if err != nil {
+		return scan, fmt.Errorf("failed to filter registry logs: %w", err)
+	}
+
+	if scan.AgentID == nil {
+		return scan, fmt.Errorf("%w for wallet %s", ErrWalletNotRegistered, wallet.Hex())
+	}
+	return scan, nil
+}
+
+// registeredLogs fetches the registry's Registered logs, those of agents
+// owned by owner if it isn't nil.
+func (c *ERC8004Client) registeredLogs(owner *common.Address) LogFetcher {
+	return func(ctx context.Context, from, to uint64) ([]types.Log, error) {
+		// Registered(uint256 indexed agentId, string agentURI, address indexed owner)
+		// Topic 2: address (indexed owner)
+		topics := [][]common.Hash{{registeredEventSig}}
+		if owner != nil {
+			topics = append(topics, nil, []common.Hash{common.BytesToHash(owner.Bytes())})
+		}
+		query := ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{c.identityAddr},
+			Topics:    topics,
+		}
+		var logs []types.Log
+		err := c.read(ctx, func(_ *ethclient.Client, b TxBackend) (err error) {
+			logs, err = b.FilterLogs(ctx, query)
+			return err
+		})
+		return logs, err
+	}
+}
+
+// DefaultSummaryBatchSize is the most client addresses sent in one getSummary
+// call. The registry loops over the list on-chain, so eth_call gas grows with
+// it; 100 stays well under public RPC gas caps.
+const DefaultSummaryBatchSize = 100
+
+// SetSummaryBatchSize changes how many client addresses GetReputationSummaryForClients
+// sends per getSummary call. Non-positive values restore DefaultSummaryBatchSize.
+func (c *ERC8004Client) SetSummaryBatchSize(n int) {
+	if n <= 0 {
+		n = DefaultSummaryBatchSize
+	}
+	c.summaryBatchSize = n
+}
+
+// ReputationSummary is the result of the registry's getSummary: Count
+// feedback entries averaging Value, a fixed-point number with Decimals places.
+type ReputationSummary struct {
+	Count    uint64
+	Value    *big.Int
+	Decimals uint8
 }
 
 // GetReputationSummary returns aggregated signal for an agent.
-func (c *ERC8004Client) GetReputationSummary(agentId *big.Int, tag1, tag2 string, querierAddr common.Address) (uint64, *big.Int, uint8, error) {
+func (c *ERC8004Client) GetReputationSummary(agentId *big.Int, tag1, tag2 string, querierAddr common.Address, at ...BlockTag) (uint64, *big.Int, uint8, error) {
 	// The client list should ideally contain the querier's address for personalized reputation,
 	// or be used according to the specific consumer's logic.
-	clients := []common.Address{querierAddr}
+	s, err := c.GetReputationSummaryForClients(agentId, []common.Address{querierAddr}, tag1, tag2, at...)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return s.Count, s.Value, s.Decimals, nil
+}
+
+// GetReputationSummaryForClients returns the summary over feedback from any
+// of clients. Long lists are split into batches of the configured size, which
+// keeps each call from reverting or running out of gas, and the per-batch
+// averages are merged weighted by their counts.
+func (c *ERC8004Client) GetReputationSummaryForClients(agentId *big.Int, clients []common.Address, tag1, tag2 string, at ...BlockTag) (ReputationSummary, error) {
+	block := c.readBlock(at)
+	size := c.summaryBatchSize
+	if size <= 0 {
+		size = DefaultSummaryBatchSize
+	}
 
+	var batches []ReputationSummary
+	// An empty list still makes a single call, as before batching
+	for start := 0; ; start += size {
+		end := min(start+size, len(clients))
+		s, err := c.getSummary(agentId, clients[start:end], tag1, tag2, block)
+		if err != nil {
+			return ReputationSummary{}, fmt.Errorf("reputation registry query failed (clients %d-%d): %w", start, end, err)
+		}
+		batches = append(batches, s)
+		if end == len(clients) {
+			break
+		}
+	}
+	return mergeSummaries(batches), nil
+}
+
+func (c *ERC8004Client) getSummary(agentId *big.Int, clients []common.Address, tag1, tag2 string, at BlockTag) (ReputationSummary, error) {
 	data, err := c.reputationABI.Pack("getSummary", agentId, clients, tag1, tag2)
 	if err != nil {
-		return 0, nil, 0, err
+		return ReputationSummary{}, err
 	}
-	res, err := c.call(c.reputAddr, data)
+	res, err := c.call(c.reputAddr, data, at)
 	if err != nil {
-		return 0, nil, 0, fmt.Errorf("reputation registry query failed: %w", err)
+		return ReputationSummary{}, err
 	}
 
 	type Summary struct {
@@ -156,16 +377,134 @@ func (c *ERC8004Client) GetReputationSummary(agentId *big.Int, tag1, tag2 string
 		SummaryValueDecimals uint8
 	}
 	var s Summary
-	err = c.reputationABI.UnpackIntoInterface(&s, "getSummary", res)
-	return s.Count, s.SummaryValue, s.SummaryValueDecimals, err
+	if err := c.reputationABI.UnpackIntoInterface(&s, "getSummary", res); err != nil {
+		return ReputationSummary{}, err
+	}
+	return ReputationSummary{Count: s.Count, Value: s.SummaryValue, Decimals: s.SummaryValueDecimals}, nil
+}
+
+// mergeSummaries combines per-batch averages into one, weighting each by its
+// count after scaling all values to the largest number of decimals.
+func mergeSummaries(batches []ReputationSummary) ReputationSummary {
+	out := ReputationSummary{Value: new(big.Int)}
+	for _, b := range batches {
+		if b.Decimals > out.Decimals {
+			out.Decimals = b.Decimals
+		}
+	}
+
+	weighted := new(big.Int)
+	for _, b := range batches {
+		if b.Count == 0 || b.Value == nil {
+			continue
+		}
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(out.Decimals-b.Decimals)), nil)
+		v := new(big.Int).Mul(b.Value, scale)
+		weighted.Add(weighted, v.Mul(v, new(big.Int).SetUint64(b.Count)))
+		out.Count += b.Count
+	}
+	if out.Count > 0 {
+		// Quo truncates toward zero, like the registry's own integer average
+		out.Value.Quo(weighted, new(big.Int).SetUint64(out.Count))
+	}
+	return out
+}
+
+// Register mints a new agent identity pointing at agentURI and returns its agentId.
+func (c *ERC8004Client) Register(w *Wallet, agentURI string) (*big.Int, error) {
+	data, err := c.identityABI.Pack("register", agentURI)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := c.transact(w, c.identityAddr, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("identity registration failed: %w", err)
+	}
+	if receipt == nil {
+		// The agentId only exists once the registration is mined
+		return nil, ErrDryRun
+	}
+
+	for _, l := range receipt.Logs {
+		if l.Address == c.identityAddr && len(l.Topics) > 1 && l.Topics[0] == registeredEventSig {
+			return new(big.Int).SetBytes(l.Topics[1].Bytes()), nil
+		}
+	}
+	return nil, fmt.Errorf("registration mined in %s but no Registered event was found", receipt.TxHash.Hex())
+}
+
+// SetMetadata writes a metadata value for an agent owned by the wallet.
+func (c *ERC8004Client) SetMetadata(w *Wallet, agentId *big.Int, key string, value []byte) error {
+	_, err := c.setMetadata(w, agentId, key, value)
+	return err
+}
+
+// setMetadata is SetMetadata, returning the receipt of the transaction, or
+// nil on a dry run.
+func (c *ERC8004Client) setMetadata(w *Wallet, agentId *big.Int, key string, value []byte) (*types.Receipt, error) {
+	data, err := c.identityABI.Pack("setMetadata", agentId, key, value)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := c.transact(w, c.identityAddr, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("setMetadata(%s) failed: %w", key, err)
+	}
+	return receipt, nil
 }
 
-func (c *ERC8004Client) call(to common.Address, data []byte) ([]byte, error) {
+// SubmitValidationResponse answers a ValidationRegistry request addressed to
+// the wallet with a response from 0 (failed) to 100 (passed), optionally
+// pointing at evidence, under tag.
+func (c *ERC8004Client) SubmitValidationResponse(w *Wallet, requestHash [32]byte, response uint8, responseURI string, responseHash [32]byte, tag string) error {
+	data, err := c.validationABI.Pack("validationResponse", requestHash, response, responseURI, responseHash, tag)
+	if err != nil {
+		return err
+	}
+	if _, err := c.transact(w, c.validAddr, data, nil); err != nil {
+		return fmt.Errorf("validationResponse failed: %w", err)
+	}
+	return nil
+}
+
+// Balance returns the native token balance of an address.
+func (c *ERC8004Client) Balance(addr common.Address, at ...BlockTag) (*big.Int, error) {
+	block := c.readBlock(at)
+	var bal *big.Int
+	err := c.read(context.Background(), func(client *ethclient.Client, _ TxBackend) (err error) {
+		bal, err = client.BalanceAt(context.Background(), addr, block.number())
+		return err
+	})
+	return bal, err
+}
+
+// HeadBlock returns the latest block number, as a cheap RPC liveness probe.
+func (c *ERC8004Client) HeadBlock(ctx context.Context) (uint64, error) {
+	var head uint64
+	err := c.read(ctx, func(client *ethclient.Client, _ TxBackend) (err error) {
+		head, err = client.BlockNumber(ctx)
+		return err
+	})
+	return head, err
+}
+
+// call makes an eth_call against block at.
+func (c *ERC8004Client) call(to common.Address, data []byte, at BlockTag) (res []byte, err error) {
+	_, span := c.tracer().Start(context.Background(), "eth.call", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("eth.method", c.methodName(data)), attribute.String("eth.to", to.Hex()), attribute.String("eth.block", string(at))))
+	defer func() { endSpan(span, err) }()
+
 	msg := ethereum.CallMsg{To: &to, Data: data}
-	return c.client.CallContract(context.Background(), msg, nil)
+	err = c.read(context.Background(), func(_ *ethclient.Client, b TxBackend) (err error) {
+		res, err = b.CallContract(context.Background(), msg, at.number())
+		return err
+	})
+	return res, err
 }
 
 func (c *ERC8004Client) Close() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 	if c.client != nil {
 		c.client.Close()
 	}
@@ -0,0 +1,296 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// newReputationChain serves a reputation registry whose getSummary averages
+// the scores of the listed clients that left feedback, with 2 decimals. The
+// returned func lists the size of each client list it was called with.
+func newReputationChain(t *testing.T, scores map[common.Address]int64) (*ERC8004Client, func() []int) {
+	t.Helper()
+	repABI, _ := abi.JSON(strings.NewReader(reputationABI))
+	method := repABI.Methods["getSummary"]
+
+	var mu sync.Mutex
+	var batches []int
+	url := newFakeRPC(t, func(m string, params []json.RawMessage) (interface{}, *rpcError) {
+		if m != "eth_call" {
+			return nil, &rpcError{Code: -32601, Message: "unexpected " + m}
+		}
+		var call struct {
+			Input hexutil.Bytes `json:"input"`
+			Data  hexutil.Bytes `json:"data"`
+		}
+		json.Unmarshal(params[0], &call)
+		input := call.Input
+		if len(input) == 0 {
+			input = call.Data
+		}
+		args, err := method.Inputs.Unpack(input[4:])
+		if err != nil {
+			return nil, &rpcError{Code: 3, Message: err.Error()}
+		}
+		clients := args[1].([]common.Address)
+		mu.Lock()
+		batches = append(batches, len(clients))
+		mu.Unlock()
+
+		var count uint64
+		sum := new(big.Int)
+		for _, c := range clients {
+			if s, ok := scores[c]; ok {
+				count++
+				sum.Add(sum, big.NewInt(s*100))
+			}
+		}
+		if count > 0 {
+			sum.Quo(sum, new(big.Int).SetUint64(count))
+		}
+		out, err := method.Outputs.Pack(count, sum, uint8(2))
+		if err != nil {
+			return nil, &rpcError{Code: -32603, Message: err.Error()}
+		}
+		return hexutil.Encode(out), nil
+	})
+	client := NewERC8004Client(url, zeroAddressHex, "0x00000000000000000000000000000000000000a5", zeroAddressHex)
+	if client == nil {
+		t.Fatal("failed to dial the fake RPC")
+	}
+	t.Cleanup(client.Close)
+	return client, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), batches...)
+	}
+}
+
+func TestReputationSummaryBatchesHundredsOfClients(t *testing.T) {
+	// 300 clients: the first hundred scored 80, the next 60, then 50 scored
+	// 20 and 50 that never left feedback. Every batch average is exact, so
+	// the merged result must equal the average over all 250 entries.
+	clients := make([]common.Address, 300)
+	scores := map[common.Address]int64{}
+	for i := range clients {
+		clients[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+		switch {
+		case i < 100:
+			scores[clients[i]] = 80
+		case i < 200:
+			scores[clients[i]] = 60
+		case i < 250:
+			scores[clients[i]] = 20
+		}
+	}
+	client, batches := newReputationChain(t, scores)
+
+	s, err := client.GetReputationSummaryForClients(big.NewInt(1), clients, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := batches(); len(got) != 3 || got[0] != 100 || got[1] != 100 || got[2] != 100 {
+		t.Errorf("getSummary called with %v clients, want 3 batches of 100", got)
+	}
+	// (100*80 + 100*60 + 50*20) / 250 = 60, where an unweighted mean of the
+	// batch averages would give 53.33
+	if s.Count != 250 || s.Value.Cmp(big.NewInt(6000)) != 0 || s.Decimals != 2 {
+		t.Errorf("summary = %d entries averaging %s (%d decimals), want 250 averaging 6000 (2)", s.Count, s.Value, s.Decimals)
+	}
+}
+
+func TestReputationSummaryBatchSize(t *testing.T) {
+	clients := make([]common.Address, 250)
+	scores := map[common.Address]int64{}
+	for i := range clients {
+		clients[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+		scores[clients[i]] = 50
+	}
+	client, batches := newReputationChain(t, scores)
+	client.SetSummaryBatchSize(120)
+
+	s, err := client.GetReputationSummaryForClients(big.NewInt(1), clients, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := batches(); len(got) != 3 || got[0] != 120 || got[1] != 120 || got[2] != 10 {
+		t.Errorf("getSummary called with %v clients, want 120, 120, 10", got)
+	}
+	if s.Count != 250 || s.Value.Cmp(big.NewInt(5000)) != 0 {
+		t.Errorf("summary = %d entries averaging %s, want 250 averaging 5000", s.Count, s.Value)
+	}
+}
+
+func TestMergeSummaries(t *testing.T) {
+	tests := []struct {
+		name    string
+		batches []ReputationSummary
+		want    ReputationSummary
+	}{
+		{
+			name: "weighted by count",
+			batches: []ReputationSummary{
+				{Count: 3, Value: big.NewInt(90)},
+				{Count: 1, Value: big.NewInt(10)},
+			},
+			want: ReputationSummary{Count: 4, Value: big.NewInt(70)},
+		},
+		{
+			name: "scaled to the most decimals",
+			batches: []ReputationSummary{
+				{Count: 2, Value: big.NewInt(15), Decimals: 1},  // 1.5
+				{Count: 1, Value: big.NewInt(300), Decimals: 2}, // 3.00
+			},
+			want: ReputationSummary{Count: 3, Value: big.NewInt(200), Decimals: 2},
+		},
+		{
+			name: "empty batches ignored",
+			batches: []ReputationSummary{
+				{Count: 0, Value: big.NewInt(0)},
+				{Count: 2, Value: big.NewInt(40)},
+				{Count: 0, Value: nil},
+			},
+			want: ReputationSummary{Count: 2, Value: big.NewInt(40)},
+		},
+		{
+			name: "truncates toward zero",
+			batches: []ReputationSummary{
+				{Count: 1, Value: big.NewInt(-5)},
+				{Count: 2, Value: big.NewInt(0)},
+			},
+			want: ReputationSummary{Count: 3, Value: big.NewInt(-1)},
+		},
+		{
+			name:    "no feedback",
+			batches: []ReputationSummary{{Count: 0, Value: big.NewInt(0)}},
+			want:    ReputationSummary{Count: 0, Value: big.NewInt(0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeSummaries(tt.batches)
+			if got.Count != tt.want.Count || got.Value.Cmp(tt.want.Value) != 0 || got.Decimals != tt.want.Decimals {
+				t.Errorf("mergeSummaries = %d/%s/%d, want %d/%s/%d",
+					got.Count, got.Value, got.Decimals, tt.want.Count, tt.want.Value, tt.want.Decimals)
+			}
+		})
+	}
+}
+
+func TestScanAgentIdByWalletStopsWhenCancelled(t *testing.T) {
+	wallet := common.HexToAddress("0xa11ce")
+	chain := &fakeChain{head: registryDeployBlock + 10*registryLogRange - 1, logs: []types.Log{{
+		BlockNumber: registryDeployBlock + 7*registryLogRange,
+		Topics:      []common.Hash{registeredEventSig, common.BigToHash(big.NewInt(42)), common.BytesToHash(wallet.Bytes())},
+	}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var queries atomic.Int32
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		// Cancel while the third chunk is being queried
+		if method == "eth_getLogs" && queries.Add(1) == 3 {
+			cancel()
+		}
+		return chain.handle(method, params)
+	})
+	c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	if c == nil {
+		t.Fatal("client not created")
+	}
+	defer c.Close()
+	// One chunk at a time, so which chunk is in flight is known
+	c.SetLogScanner(NewLogScanner(1, 0))
+
+	start := time.Now()
+	scan, err := c.ScanAgentIdByWallet(ctx, wallet, WalletScan{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second || queries.Load() != 3 {
+		t.Errorf("returned after %s and %d queries, want right after the third", elapsed, queries.Load())
+	}
+	// The third chunk may or may not have made it back before the cancellation
+	if scan.ScannedBlock != registryDeployBlock+2*registryLogRange-1 && scan.ScannedBlock != registryDeployBlock+3*registryLogRange-1 {
+		t.Errorf("ScannedBlock = %d, want the end of the second or third chunk", scan.ScannedBlock)
+	}
+
+	// Resuming picks up after the reported block and finds the agent
+	chain.mu.Lock()
+	resumedFrom := len(chain.ranges)
+	chain.mu.Unlock()
+	scan2, err := c.ScanAgentIdByWallet(context.Background(), wallet, scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan2.AgentID.Int64() != 42 || scan2.ScannedBlock != chain.head {
+		t.Errorf("resumed scan = %+v, want agent 42 scanned to %d", scan2, chain.head)
+	}
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+	if first := chain.ranges[resumedFrom]; first[0] != scan.ScannedBlock+1 {
+		t.Errorf("resumed at block %d, want %d", first[0], scan.ScannedBlock+1)
+	}
+}
+
+func TestScanAgentIdByWalletCallsAtRealisticHead(t *testing.T) {
+	// Base Sepolia is well past 20M blocks beyond the registry's deployment
+	const head = registryDeployBlock + 20_000_000
+	wallet := common.HexToAddress("0xa11ce")
+	for _, tt := range []struct {
+		name     string
+		maxRange uint64 // most blocks the RPC serves in one call; 0 for any
+		maxCalls int32
+	}{
+		{"any range", 0, 41},
+		{"ranges up to 100k blocks", 100_000, 600},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &fakeChain{head: head, logs: []types.Log{{
+				BlockNumber: head - 1000,
+				Topics:      []common.Hash{registeredEventSig, common.BigToHash(big.NewInt(42)), common.BytesToHash(wallet.Bytes())},
+			}}}
+			var calls atomic.Int32
+			url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+				if method != "eth_getLogs" {
+					return chain.handle(method, params)
+				}
+				calls.Add(1)
+				var q struct {
+					FromBlock hexutil.Uint64 `json:"fromBlock"`
+					ToBlock   hexutil.Uint64 `json:"toBlock"`
+				}
+				json.Unmarshal(params[0], &q)
+				if tt.maxRange > 0 && uint64(q.ToBlock-q.FromBlock)+1 > tt.maxRange {
+					return nil, &rpcError{Code: -32000, Message: "block range too large"}
+				}
+				return chain.handle(method, params)
+			})
+			c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+			defer c.Close()
+			// One window at a time, so the count doesn't depend on how the
+			// workers interleave
+			c.SetLogScanner(NewLogScanner(1, 0))
+
+			scan, err := c.ScanAgentIdByWallet(context.Background(), wallet, WalletScan{})
+			if err != nil || scan.AgentID.Int64() != 42 {
+				t.Fatalf("scan = %+v, %v", scan, err)
+			}
+			// DefaultLogRange windows would take 10000 calls
+			if calls.Load() > tt.maxCalls {
+				t.Errorf("%d eth_getLogs calls, want at most %d", calls.Load(), tt.maxCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of reputation view: whose feedback a view counts.
+const (
+	ViewSelf    = "self"    // the node's own wallets: the operator's and its personas'
+	ViewCurated = "curated" // a list of reviewers, such as a curator's
+	ViewGlobal  = "global"  // no client list, whatever the registry counts for an empty one
+)
+
+// DefaultViewsReload is how often a views file is checked for changes.
+const DefaultViewsReload = 10 * time.Second
+
+// ReputationView is a named set of clients whose registry feedback makes up
+// an agent's reputation: reputation "as seen by" them.
+type ReputationView struct {
+	Name    string   `json:"name" yaml:"-"`
+	Kind    string   `json:"kind" yaml:"kind"`
+	Clients []string `json:"clients,omitempty" yaml:"clients"` // of a curated view
+}
+
+// viewsFile is the layout of a views file:
+//
+//	default: curators
+//	views:
+//	  mine: {kind: self}
+//	  curators:
+//	    kind: curated
+//	    clients: ["0x...", "0x..."]
+//	  everyone: {kind: global}
+//	personas:
+//	  "0x...": mine
+//
+// Personas are the node's other wallets, each with the view that decides
+// for it; they count as the node's own in self views.
+type viewsFile struct {
+	Default  string                    `yaml:"default"`
+	Views    map[string]ReputationView `yaml:"views"`
+	Personas map[string]string         `yaml:"personas"`
+}
+
+// ReputationViews holds the views reputation can be read under, from a file
+// reloaded by Watch, and reads it from the registry under the one a query or
+// persona selects. Reads are reused for reputationCacheTTL per view.
+type ReputationViews struct {
+	path  string
+	chain *ERC8004Client
+	self  []common.Address
+	block BlockTag
+	clock Clock
+
+	mu       sync.RWMutex
+	views    map[string]ReputationView
+	clients  map[string][]common.Address // of each view
+	reads    map[string]ReputationFunc   // of each view, with its cache
+	def      string
+	personas map[common.Address]string
+	loaded   []byte
+}
+
+// NewReputationViews loads the views in path. self is the operator's wallet,
+// if the node has one; reputation is read through chain at block at.
+func NewReputationViews(path string, chain *ERC8004Client, self []common.Address, at BlockTag) (*ReputationViews, error) {
+	v := &ReputationViews{path: path, chain: chain, self: self, block: at, clock: SystemClock}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SetClock replaces the clock Watch polls on.
+func (v *ReputationViews) SetClock(clock Clock) {
+	v.clock = clock
+}
+
+// Reload rereads the views file if it changed. On error the views in force
+// are kept.
+func (v *ReputationViews) Reload() error {
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		return fmt.Errorf("reputation views: %w", err)
+	}
+	v.mu.RLock()
+	loaded := v.loaded
+	v.mu.RUnlock()
+	if loaded != nil && bytes.Equal(data, loaded) {
+		return nil
+	}
+
+	var f viewsFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("reputation views %s: %w", v.path, err)
+	}
+	personas := map[common.Address]string{}
+	self := append([]common.Address(nil), v.self...)
+	for wallet, view := range f.Personas {
+		if !common.IsHexAddress(wallet) {
+			return fmt.Errorf("reputation views %s: persona %q is not an address", v.path, wallet)
+		}
+		if _, ok := f.Views[view]; !ok {
+			return fmt.Errorf("reputation views %s: persona %s uses unknown view %q", v.path, wallet, view)
+		}
+		addr := common.HexToAddress(wallet)
+		personas[addr] = view
+		self = append(self, addr)
+	}
+	// Map order is random; keep the calldata of self views stable
+	sort.Slice(self, func(i, j int) bool { return bytes.Compare(self[i][:], self[j][:]) < 0 })
+	if f.Default == "" && len(f.Views) > 0 {
+		return fmt.Errorf("reputation views %s: no default view", v.path)
+	}
+	if _, ok := f.Views[f.Default]; f.Default != "" && !ok {
+		return fmt.Errorf("reputation views %s: default view %q is not defined", v.path, f.Default)
+	}
+
+	views := map[string]ReputationView{}
+	clients := map[string][]common.Address{}
+	reads := map[string]ReputationFunc{}
+	for name, view := range f.Views {
+		view.Name = name
+		var list []common.Address
+		switch view.Kind {
+		case ViewSelf:
+			if len(self) == 0 {
+				return fmt.Errorf("reputation views %s: view %s counts the node's own feedback, but the node has no wallet or persona", v.path, name)
+			}
+			list = self
+		case ViewCurated:
+			if len(view.Clients) == 0 {
+				return fmt.Errorf("reputation views %s: curated view %s lists no clients", v.path, name)
+			}
+			for _, c := range view.Clients {
+				if !common.IsHexAddress(c) {
+					return fmt.Errorf("reputation views %s: view %s: %q is not an address", v.path, name, c)
+				}
+				list = append(list, common.HexToAddress(c))
+			}
+		case ViewGlobal:
+			list = []common.Address{}
+		default:
+			return fmt.Errorf("reputation views %s: view %s: kind must be %s, %s or %s, not %q", v.path, name, ViewSelf, ViewCurated, ViewGlobal, view.Kind)
+		}
+		views[name], clients[name] = view, list
+		if v.chain != nil {
+			reads[name] = RegistryReputation(v.chain, list, v.block)
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if loaded != nil {
+		fmt.Printf("[Reputation] Reloaded %s: %d views\n", v.path, len(views))
+	}
+	v.views, v.clients, v.reads, v.def, v.personas, v.loaded = views, clients, reads, f.Default, personas, data
+	return nil
+}
+
+// Watch reloads the views every interval until ctx is done. Failed reloads
+// are logged and keep the views in force.
+func (v *ReputationViews) Watch(ctx context.Context, interval time.Duration) {
+	if v == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-v.clock.After(interval):
+			}
+			if err := v.Reload(); err != nil {
+				fmt.Printf("[Reputation] Keeping the views in force: %v\n", err)
+			}
+		}
+	}()
+}
+
+// Views returns the views, sorted by name.
+func (v *ReputationViews) Views() []ReputationView {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	views := make([]ReputationView, 0, len(v.views))
+	for _, view := range v.views {
+		views = append(views, view)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// Select names the view for a query: view if it isn't "", else persona's
+// view if the file gives it one, else the default.
+func (v *ReputationViews) Select(view, persona string) (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if view == "" && common.IsHexAddress(persona) {
+		view = v.personas[common.HexToAddress(persona)]
+	}
+	if view == "" {
+		view = v.def
+	}
+	if _, ok := v.views[view]; !ok {
+		return "", fmt.Errorf("no reputation view %q", view)
+	}
+	return view, nil
+}
+
+// Clients returns the clients whose feedback view counts. A global view has
+// none.
+func (v *ReputationViews) Clients(view string) ([]common.Address, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	clients, ok := v.clients[view]
+	if !ok {
+		return nil, fmt.Errorf("no reputation view %q", view)
+	}
+	return clients, nil
+}
+
+// Reputation reads agentId's reputation on tag under view, as
+// RegistryReputation does.
+func (v *ReputationViews) Reputation(ctx context.Context, view string, agentId *big.Int, tag string) (float64, bool, error) {
+	v.mu.RLock()
+	read, ok := v.reads[view]
+	v.mu.RUnlock()
+	if !ok {
+		return 0, false, fmt.Errorf("no reputation view %q, or no chain to read it from", view)
+	}
+	return read(ctx, agentId, tag)
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// summaryCalls serves getSummary, answering every call with one entry, and
+// records the client list packed into each call.
+func summaryCalls(t *testing.T) (*ERC8004Client, func() [][]common.Address) {
+	t.Helper()
+	repABI, _ := abi.JSON(strings.NewReader(reputationABI))
+	method := repABI.Methods["getSummary"]
+	var mu sync.Mutex
+	var calls [][]common.Address
+	url := newFakeRPC(t, func(m string, params []json.RawMessage) (interface{}, *rpcError) {
+		var call struct {
+			Input hexutil.Bytes `json:"input"`
+		}
+		json.Unmarshal(params[0], &call)
+		args, err := method.Inputs.Unpack(call.Input[4:])
+		if err != nil {
+			return nil, &rpcError{Code: 3, Message: err.Error()}
+		}
+		mu.Lock()
+		calls = append(calls, args[1].([]common.Address))
+		mu.Unlock()
+		out, _ := method.Outputs.Pack(uint64(1), big.NewInt(80), uint8(0))
+		return hexutil.Encode(out), nil
+	})
+	client := NewERC8004Client(url, zeroAddressHex, "0x00000000000000000000000000000000000000a5", zeroAddressHex)
+	t.Cleanup(client.Close)
+	return client, func() [][]common.Address {
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { calls = nil }()
+		return calls
+	}
+}
+
+func TestReputationViewsPackTheirClients(t *testing.T) {
+	operator := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	persona := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	curator := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+	path := filepath.Join(t.TempDir(), "views.yaml")
+	write := func(curated string) {
+		os.WriteFile(path, []byte(`default: curators
+views:
+  mine: {kind: self}
+  curators: {kind: curated, clients: [`+curated+`]}
+  everyone: {kind: global}
+personas:
+  "`+persona.Hex()+`": mine
+`), 0o644)
+	}
+	write(curator.Hex())
+	client, calls := summaryCalls(t)
+	views, err := NewReputationViews(path, client, []common.Address{operator}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := NewSelectionPolicy(nil, NewPeerHistory())
+	policy.Views, policy.ExploreRate = views, 0
+	var decided []string
+	policy.Record = func(d SelectionDecision) { decided = append(decided, d.View) }
+	candidates := []AgentRef{{Recipient: Recipient{PeerID: "a"}, AgentID: big.NewInt(7)}}
+
+	for _, c := range []struct {
+		name string
+		task TaskContext
+		view string
+		want []common.Address
+	}{
+		{"default", TaskContext{Capability: "audit"}, "curators", []common.Address{curator}},
+		{"per query", TaskContext{Capability: "audit", View: "everyone"}, "everyone", []common.Address{}},
+		{"per persona", TaskContext{Capability: "audit", Persona: persona.Hex()}, "mine", []common.Address{operator, persona}},
+		{"query over persona", TaskContext{Capability: "audit", View: "curators", Persona: persona.Hex()}, "curators", []common.Address{curator}},
+	} {
+		decided = nil
+		ranked, err := policy.RankCandidates(context.Background(), candidates, c.task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := calls()
+		if len(decided) != 1 || decided[0] != c.view {
+			t.Errorf("%s: ranked under %v, want %s", c.name, decided, c.view)
+		}
+		// Cached reads make no call; every view is read once per agent and tag
+		if c.name == "query over persona" {
+			if len(got) != 0 {
+				t.Errorf("%s: %d calls, want the curators' read reused", c.name, len(got))
+			}
+			continue
+		}
+		if len(got) != 1 || !equalAddresses(got[0], c.want) {
+			t.Errorf("%s: getSummary packed %v, want %v", c.name, got, c.want)
+		}
+		if ranked[0].Inputs.Reputation != 0.8 {
+			t.Errorf("%s: reputation %v, want 0.8", c.name, ranked[0].Inputs.Reputation)
+		}
+	}
+
+	// A new curator list applies on reload; a broken file keeps it
+	second := common.HexToAddress("0x00000000000000000000000000000000000000c2")
+	write(curator.Hex() + ", " + second.Hex())
+	if err := views.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := views.Clients("curators"); !equalAddresses(got, []common.Address{curator, second}) {
+		t.Errorf("curators after reload: %v", got)
+	}
+	policy.RankCandidates(context.Background(), candidates, TaskContext{Capability: "audit"})
+	if got := calls(); len(got) != 1 || !equalAddresses(got[0], []common.Address{curator, second}) {
+		t.Errorf("after reload getSummary packed %v, want both curators", got)
+	}
+	write("not-an-address")
+	if err := views.Reload(); err == nil {
+		t.Error("reloaded a view with a malformed client")
+	}
+	if got, _ := views.Clients("curators"); len(got) != 2 {
+		t.Errorf("curators after a failed reload: %v, want the two in force", got)
+	}
+}
+
+func equalAddresses(a, b []common.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/pbnjay/memory"
+)
+
+// resourceLogInterval is how often the same kind of refusal is logged again.
+const resourceLogInterval = time.Minute
+
+// ResourceLimits bounds the connections, streams, file descriptors and
+// memory the node's libp2p host may use, so peers can't exhaust them. The
+// limits are libp2p's defaults scaled to Memory and FDs, with those of File
+// overriding them. The zero value scales them to the machine.
+type ResourceLimits struct {
+	Memory int64  // bytes the limits scale to; 0 for an eighth of the system's memory
+	FDs    int    // file descriptors the limits scale to; 0 for half the process's limit
+	File   string // JSON limits in libp2p's PartialLimitConfig layout, e.g. {"System": {"Conns": 512}}; empty for none
+}
+
+// limits returns the effective limits.
+func (l ResourceLimits) limits() (rcmgr.ConcreteLimitConfig, error) {
+	scaling := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&scaling)
+	mem, fds := l.Memory, l.FDs
+	if mem == 0 {
+		mem = int64(memory.TotalMemory() / 8)
+	}
+	if fds == 0 {
+		fds = processFDs() / 2
+	}
+	if mem < 0 || fds < 0 {
+		return rcmgr.ConcreteLimitConfig{}, fmt.Errorf("resource limits can't scale to %d bytes and %d file descriptors", mem, fds)
+	}
+	limits := scaling.Scale(mem, fds)
+	if l.File == "" {
+		return limits, nil
+	}
+	data, err := os.ReadFile(l.File)
+	if err != nil {
+		return rcmgr.ConcreteLimitConfig{}, fmt.Errorf("resource limits: %w", err)
+	}
+	var partial rcmgr.PartialLimitConfig
+	if err := json.Unmarshal(data, &partial); err != nil {
+		return rcmgr.ConcreteLimitConfig{}, fmt.Errorf("resource limits %s: %w", l.File, err)
+	}
+	return partial.Build(limits), nil
+}
+
+// Describe sums up the system-wide limits for logs. It fails if the limits
+// can't be built, e.g. from a broken File.
+func (l ResourceLimits) Describe() (string, error) {
+	limits, err := l.limits()
+	if err != nil {
+		return "", err
+	}
+	system := limits.ToPartialLimitConfig().System
+	return fmt.Sprintf("%s conns, %s streams, %s fds, %s MiB of memory", limitString(int64(system.Conns), 0),
+		limitString(int64(system.Streams), 0), limitString(int64(system.FD), 0), limitString(int64(system.Memory), 20)), nil
+}
+
+// limitString formats a limit, shifted right by shift, which is -1 when
+// unlimited and -2 when nothing is allowed.
+func limitString(n int64, shift uint) string {
+	switch {
+	case n == -1:
+		return "unlimited"
+	case n < 0:
+		return "0"
+	}
+	return fmt.Sprint(n >> shift)
+}
+
+// resourceManager builds a resource manager enforcing l that reports to r.
+func (l ResourceLimits) resourceManager(r *resourceReporter) (network.ResourceManager, error) {
+	limits, err := l.limits()
+	if err != nil {
+		return nil, err
+	}
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits), rcmgr.WithTraceReporter(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource manager: %w", err)
+	}
+	return rm, nil
+}
+
+// resourceReporter counts what the resource managers of the node's hosts
+// refused, and logs each kind of refusal at most once per
+// resourceLogInterval so operators can tell which limit to raise.
+type resourceReporter struct {
+	mu      sync.Mutex
+	blocked map[resourceKey]uint64
+	logged  map[resourceKey]time.Time
+}
+
+// resourceKey is a kind of refusal: the class of scope that refused it, e.g.
+// "peer" or "protocol-peer", and the resource, e.g. "streams_inbound".
+type resourceKey struct {
+	scope, resource string
+}
+
+func newResourceReporter() *resourceReporter {
+	return &resourceReporter{blocked: map[resourceKey]uint64{}, logged: map[resourceKey]time.Time{}}
+}
+
+// ConsumeEvent implements rcmgr.TraceReporter.
+func (r *resourceReporter) ConsumeEvent(evt rcmgr.TraceEvt) {
+	var resource string
+	switch evt.Type {
+	case rcmgr.TraceBlockReserveMemoryEvt:
+		resource = "memory"
+	case rcmgr.TraceBlockAddStreamEvt:
+		resource = "streams" + direction(evt.DeltaIn)
+	case rcmgr.TraceBlockAddConnEvt:
+		resource = "conns" + direction(evt.DeltaIn)
+	default:
+		return
+	}
+	key := resourceKey{scopeClass(evt.Name), resource}
+	r.mu.Lock()
+	r.blocked[key]++
+	n := r.blocked[key]
+	now := time.Now()
+	log := now.Sub(r.logged[key]) >= resourceLogInterval
+	if log {
+		r.logged[key] = now
+	}
+	r.mu.Unlock()
+	if log {
+		fmt.Printf("[P2P] Resource limit hit: %s refused by %s (%d times so far)\n", resource, evt.Name, n)
+	}
+}
+
+// Blocked returns how many times each kind of resource was refused, by scope
+// class and resource.
+func (r *resourceReporter) Blocked() map[resourceKey]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[resourceKey]uint64, len(r.blocked))
+	for k, v := range r.blocked {
+		out[k] = v
+	}
+	return out
+}
+
+func direction(deltaIn int) string {
+	if deltaIn > 0 {
+		return "_inbound"
+	}
+	return "_outbound"
+}
+
+// scopeClass drops the peer, connection and stream IDs from a scope's name,
+// keeping services and protocols: "protocol:/agentmesh/task/1.0.0.peer:12D3…"
+// is "protocol-peer".
+func scopeClass(name string) string {
+	switch {
+	case strings.HasPrefix(name, "conn-"):
+		return "conn"
+	case strings.HasPrefix(name, "stream-"):
+		return "stream"
+	case strings.HasPrefix(name, "peer:"):
+		return "peer"
+	case strings.HasPrefix(name, "service:"), strings.HasPrefix(name, "protocol:"):
+		class := name[:strings.Index(name, ":")]
+		if strings.Contains(name, "peer:") {
+			return class + "-peer"
+		}
+		return class
+	}
+	if i := strings.Index(name, ".span:"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResourceLimitsRefuseStreamsPastTheLimitsFile(t *testing.T) {
+	const hold = "/agentmesh/test/hold/1.0.0"
+	path := filepath.Join(t.TempDir(), "limits.json")
+	os.WriteFile(path, []byte(`{"ProtocolPeer": {"`+hold+`": {"StreamsInbound": 1, "Streams": 1}}}`), 0o644)
+
+	server := newTestNode(t)
+	server.Resources = ResourceLimits{Memory: 256 << 20, FDs: 256, File: path}
+	server.Metrics = NewMetrics()
+	if err := server.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	server.CurrentHost().SetStreamHandler(hold, func(s network.Stream) {
+		<-server.ctx.Done()
+		s.Reset()
+	})
+	client := startTestNode(t)
+	info, _ := peer.AddrInfoFromString(dialAddr(server))
+	if err := client.CurrentHost().Connect(context.Background(), *info); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first stream is held open; the second is over the peer's limit
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, err := client.CurrentHost().NewStream(ctx, info.ID, hold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Reset()
+	first.Write([]byte("x"))
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		second, err := client.CurrentHost().NewStream(ctx, info.ID, hold)
+		if err == nil {
+			// Protocol negotiation is lazy: the refusal shows on first use.
+			// A stream accepted before the first was counted is held, so
+			// don't wait on it for long
+			second.SetDeadline(time.Now().Add(500 * time.Millisecond))
+			second.Write([]byte("x"))
+			_, err = second.Read(make([]byte, 1))
+			second.Reset()
+		}
+		if server.resources.Blocked()[resourceKey{"protocol-peer", "streams_inbound"}] > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a second stream wasn't refused (last error %v); refusals: %v", err, server.resources.Blocked())
+		}
+	}
+
+	if got := testutil.ToFloat64(resourceCollector{server.resources}); got < 1 {
+		t.Errorf("agentmesh_p2p_resources_blocked_total is %v, want the refusal counted", got)
+	}
+	if n, err := testutil.GatherAndCount(server.Metrics.registry, "libp2p_rcmgr_streams"); err != nil || n == 0 {
+		t.Errorf("libp2p's resource manager metrics aren't exported: %d series, %v", n, err)
+	}
+
+	// Unreadable limits keep the host from starting
+	if _, err := (ResourceLimits{File: filepath.Join(t.TempDir(), "missing.json")}).Describe(); err == nil {
+		t.Error("built limits from a missing file")
+	}
+	if desc, err := server.Resources.Describe(); err != nil || !strings.Contains(desc, "conns") {
+		t.Errorf("described the limits as %q, %v", desc, err)
+	}
+}
@@ -0,0 +1,469 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// MessageStream is the AgentMessage type announcing a streamed result. Its
+// payload is a StreamHeader, and the result follows on the same stream as
+// length-prefixed frames: data frames of up to streamChunkSize bytes, an
+// empty frame, then a StreamTrailer.
+const MessageStream = "stream"
+
+// streamChunkSize is the most bytes in one frame of a streamed result.
+const streamChunkSize = 64 << 10
+
+// maxBufferedStream caps a streamed result sent whole, in one message, to a
+// requester that didn't ask for a stream; its base64 has to fit
+// maxMessageSize.
+const maxBufferedStream = maxMessageSize / 2
+
+// errStreamClosed is returned by reads of a streamed result once it is
+// closed.
+var errStreamClosed = errors.New("streamed result is closed")
+
+// errResultTooLarge is returned when a streamed result is too large to send
+// in one message.
+var errResultTooLarge = errors.New("result is too large for one message; request it as a stream")
+
+// StreamResult is a task result read as it is produced rather than held in
+// memory, for outputs too large for one message. A handler returns one in
+// place of its payload, and SendTaskStream and FetchMemory hand one back.
+//
+// Whoever ends up with a StreamResult must read or Close it.
+type StreamResult struct {
+	Body        io.Reader
+	Size        int64  // bytes Body holds, or -1 if unknown
+	ContentType string // empty means application/octet-stream
+
+	release func() // run by Close, once Body is done with
+}
+
+// StreamHeader is the payload of a MessageStream message.
+type StreamHeader struct {
+	Size        int64  `json:"size"` // -1 if unknown
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// StreamTrailer ends a streamed result: the bytes sent and their SHA-256, or
+// why the stream was cut short.
+type StreamTrailer struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BufferedStream is a streamed result sent whole, in one message, to a
+// requester that didn't ask for a stream.
+type BufferedStream struct {
+	ContentType string `json:"contentType,omitempty"`
+	Content     []byte `json:"content"` // base64 in JSON
+}
+
+// NewStreamResult returns a result of size bytes, or -1 if unknown, read
+// from body. If body is an io.Closer it is closed with the result.
+func NewStreamResult(body io.Reader, size int64) *StreamResult {
+	return &StreamResult{Body: body, Size: size}
+}
+
+// WriteStream returns a result of size bytes, or -1 if unknown, that write
+// produces as it is read. write runs on its own goroutine and blocks while
+// the reader is behind; it fails once the result is closed unread.
+func WriteStream(size int64, write func(w io.Writer) error) *StreamResult {
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(write(pw)) }()
+	return &StreamResult{Body: pr, Size: size}
+}
+
+// AsStream adapts a handler's result to a StreamResult: a StreamResult is
+// returned as is, and any other result as a stream of its JSON.
+func AsStream(result interface{}) (*StreamResult, error) {
+	if sr, ok := result.(*StreamResult); ok {
+		return sr, nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("result is not JSON: %w", err)
+	}
+	return &StreamResult{Body: bytes.NewReader(data), Size: int64(len(data)), ContentType: "application/json"}, nil
+}
+
+// Read reads from Body.
+func (r *StreamResult) Read(p []byte) (int, error) {
+	return r.Body.Read(p)
+}
+
+// WriteTo writes Body to w. A result read off a peer hands w its frames
+// where they were received, without copying them first, so io.Copy of a
+// result into a file or content store costs one copy less.
+func (r *StreamResult) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, r.Body)
+}
+
+// onClose adds f to what Close releases.
+func (r *StreamResult) onClose(f func()) {
+	prev := r.release
+	r.release = func() {
+		if prev != nil {
+			prev()
+		}
+		f()
+	}
+}
+
+// Close closes Body if it is an io.Closer, and releases what produced it.
+func (r *StreamResult) Close() error {
+	var err error
+	if c, ok := r.Body.(io.Closer); ok {
+		err = c.Close()
+	}
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+	return err
+}
+
+func (r *StreamResult) header() StreamHeader {
+	return StreamHeader{Size: r.Size, ContentType: r.ContentType}
+}
+
+// buffer reads the whole result, for a requester that didn't ask for a
+// stream. A result over maxBufferedStream is errResultTooLarge.
+func (r *StreamResult) buffer() (*BufferedStream, error) {
+	if r.Size > maxBufferedStream {
+		return nil, errResultTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBufferedStream+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBufferedStream {
+		return nil, errResultTooLarge
+	}
+	return &BufferedStream{ContentType: r.ContentType, Content: data}, nil
+}
+
+// writeFrames sends body as the frames of a streamed result, hashing it as
+// it goes, and ends them with the trailer. Writes block while the peer is
+// behind, so a slow reader slows the producer rather than filling memory.
+// It returns the error that cut the stream short, if any.
+func writeFrames(w io.Writer, body io.Reader, size int64) error {
+	bw := getFrameWriter(w)
+	defer putFrameWriter(bw)
+	frame := getFrameBuffer()
+	defer frame.release()
+	buf := frame.data
+	sum := sha256.New()
+	var sent int64
+	var readErr error
+	for readErr == nil {
+		var k int
+		k, readErr = body.Read(buf)
+		if k == 0 {
+			continue
+		}
+		sum.Write(buf[:k])
+		sent += int64(k)
+		if err := writeFrame(bw, buf[:k]); err != nil {
+			return err
+		}
+	}
+
+	trailer := StreamTrailer{Size: sent, SHA256: hex.EncodeToString(sum.Sum(nil))}
+	switch {
+	case readErr != io.EOF:
+		trailer = StreamTrailer{Size: sent, Error: readErr.Error()}
+	case size >= 0 && sent != size:
+		trailer = StreamTrailer{Size: sent, Error: fmt.Sprintf("ended after %d of %d bytes", sent, size)}
+	}
+	if err := writeFrame(bw, nil); err != nil {
+		return err
+	}
+	if err := writeMessage(bw, trailer); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if trailer.Error != "" {
+		return errors.New(trailer.Error)
+	}
+	return nil
+}
+
+// frameReader reads the frames of a streamed result, hashing them as they
+// come, and checks the trailer at the end. Its Read returns io.EOF only once
+// the trailer vouches for everything read.
+//
+// Its buffered reader is pooled: it goes back once the trailer is read or
+// the reader is closed, and mu keeps that from happening while a Read or
+// WriteTo still uses it.
+type frameReader struct {
+	mu     sync.Mutex
+	r      *bufio.Reader // nil once put back
+	closer io.Closer
+	size   int64  // announced in the header, or -1
+	left   uint64 // bytes left in the current frame
+	read   int64
+	sum    hash.Hash
+	err    error
+}
+
+// readFrames returns the result announced by header, read from r and closed
+// with closer.
+func readFrames(r io.Reader, closer io.Closer, header StreamHeader) *StreamResult {
+	f := &frameReader{r: getFrameReader(r), closer: closer, size: header.Size, sum: sha256.New()}
+	return &StreamResult{Body: f, Size: header.Size, ContentType: header.ContentType}
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.nextFrame() {
+		return 0, f.err
+	}
+	if uint64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	k, err := f.r.Read(p)
+	f.consumed(p[:k], err)
+	return k, f.err
+}
+
+// WriteTo writes the frames to w straight from the reader's buffer. w must
+// not keep the slices it is handed, as io.Writer promises; they are
+// overwritten by the frames that follow.
+func (f *frameReader) WriteTo(w io.Writer) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var written int64
+	for f.nextFrame() {
+		frame, err := f.r.Peek(int(min(f.left, uint64(f.r.Size()))))
+		if len(frame) > 0 {
+			k, werr := w.Write(frame)
+			written += int64(k)
+			f.r.Discard(k)
+			if werr == nil && k < len(frame) {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				// What w didn't take can't be hashed or read again
+				f.consumed(frame[:k], werr)
+				return written, werr
+			}
+		}
+		f.consumed(frame, err)
+	}
+	if f.err == io.EOF {
+		return written, nil
+	}
+	return written, f.err
+}
+
+// nextFrame reads frame headers until a frame has bytes left to read,
+// reporting false once the stream ended or failed and f.err says why.
+func (f *frameReader) nextFrame() bool {
+	if f.err != nil {
+		return false
+	}
+	for f.left == 0 {
+		length, err := binary.ReadUvarint(f.r)
+		switch {
+		case err != nil:
+			f.fail(unexpectedEOF(err))
+			return false
+		case length == 0:
+			f.fail(f.finish())
+			return false
+		case length > streamChunkSize:
+			f.fail(fmt.Errorf("%w: frame of %d bytes, limit %d", errMessageTooLarge, length, streamChunkSize))
+			return false
+		}
+		f.left = length
+	}
+	return true
+}
+
+// consumed accounts for the bytes p of the current frame having been read,
+// and for err, if reading them failed.
+func (f *frameReader) consumed(p []byte, err error) {
+	f.left -= uint64(len(p))
+	f.read += int64(len(p))
+	f.sum.Write(p)
+	if err != nil {
+		f.fail(unexpectedEOF(err))
+	}
+	if f.size >= 0 && f.read > f.size {
+		f.fail(fmt.Errorf("stream is longer than the %d bytes announced", f.size))
+	}
+}
+
+// fail ends the stream with err, putting the buffered reader back.
+func (f *frameReader) fail(err error) {
+	f.err = err
+	if f.r != nil {
+		putFrameReader(f.r)
+		f.r = nil
+	}
+}
+
+// finish checks the trailer against what was read.
+func (f *frameReader) finish() error {
+	data, err := readLP(f.r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	var t StreamTrailer
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fmt.Errorf("invalid stream trailer: %w", err)
+	}
+	switch {
+	case t.Error != "":
+		return fmt.Errorf("stream failed after %d bytes: %s", t.Size, t.Error)
+	case t.Size != f.read || t.SHA256 != hex.EncodeToString(f.sum.Sum(nil)):
+		return fmt.Errorf("stream doesn't match its trailer: read %d bytes, trailer says %d", f.read, t.Size)
+	case f.size >= 0 && f.read != f.size:
+		return fmt.Errorf("stream ended after %d of the %d bytes announced", f.read, f.size)
+	}
+	return io.EOF
+}
+
+// Close closes the stream, which ends a Read blocked on it, then puts the
+// buffered reader back once nothing uses it.
+func (f *frameReader) Close() error {
+	err := f.closer.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.fail(errStreamClosed)
+	}
+	return err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// streamMessage announces result, which goes along in the message until it
+// is sent.
+func (n *AgentNode) streamMessage(result *StreamResult) AgentMessage {
+	msg := n.responseMessage(result.header())
+	msg.Type = MessageStream
+	msg.result = result
+	return msg
+}
+
+// sendStream writes resp, a MessageStream message, and its result to w. A
+// requester that didn't ask for a stream gets the result whole, in one
+// response, if it fits.
+func (n *AgentNode) sendStream(w io.Writer, resp AgentMessage, wanted bool) error {
+	result := resp.result
+	defer result.Close()
+	if !wanted {
+		buffered, err := result.buffer()
+		if err != nil {
+			resp = n.errorMessage(ErrorPayload{Code: ErrCodeBadRequest, Message: err.Error()})
+		} else {
+			resp.Type, resp.Payload = "response", buffered
+		}
+		return writeMessage(w, resp)
+	}
+	if err := writeMessage(w, resp); err != nil {
+		return err
+	}
+	return writeFrames(w, result.Body, result.Size)
+}
+
+// decodeStreamHeader reads the StreamHeader of a MessageStream message.
+func decodeStreamHeader(payload interface{}) (StreamHeader, error) {
+	var h StreamHeader
+	if err := UnmarshalPayload(AgentMessage{Type: MessageStream, Payload: payload}, &h); err != nil {
+		return h, fmt.Errorf("invalid stream header: %w", err)
+	}
+	return h, nil
+}
+
+// memoryRequest asks the memory protocol for a workspace file. With Stream
+// the file comes as a streamed result instead of a MemoryChunk, so files of
+// any size can be fetched.
+type memoryRequest struct {
+	Type      string `json:"type"` // "get_memory"
+	TopicHash string `json:"topicHash"`
+	Stream    bool   `json:"stream,omitempty"`
+}
+
+// serveMemoryStream answers a streaming memory request with the file of
+// topic, read from disk as the peer reads it.
+func (n *AgentNode) serveMemoryStream(s network.Stream, topic string) {
+	result, err := n.Memory.OpenMemory(topic)
+	switch {
+	case errors.Is(err, errAccessDenied):
+		n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: err.Error()})
+	case err != nil:
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "failed to read memory", Retryable: true})
+	case result == nil:
+		n.replyError(s, ErrorPayload{Code: ErrCodeNotFound, Message: fmt.Sprintf("no memory for %q", topic)})
+	default:
+		if err := n.sendStream(s, n.streamMessage(result), true); err != nil {
+			n.misbehaved(s, ViolationAbandonedTransfer)
+		}
+	}
+}
+
+// FetchMemory reads the workspace file of topic from the peer at targetAddr
+// over the memory protocol, as a stream. The caller must read or Close it.
+func (n *AgentNode) FetchMemory(ctx context.Context, targetAddr, topic string) (*StreamResult, error) {
+	pid, err := n.addTarget(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := n.CurrentHost().NewStream(ctx, pid, protocol.ID(MemoryProtocol))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	req, _ := json.Marshal(memoryRequest{Type: "get_memory", TopicHash: topic, Stream: true})
+	if err := writeLP(s, req); err != nil {
+		s.Close()
+		return nil, err
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	switch resp.Type {
+	case MessageError:
+		s.Close()
+		return nil, peerError(pid.String(), *resp)
+	case MessageStream:
+		header, err := decodeStreamHeader(resp.Payload)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		return readFrames(s, s, header), nil
+	}
+	s.Close()
+	return nil, fmt.Errorf("peer %s answered a memory request with %q", pid, resp.Type)
+}
@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// patternReader yields size bytes of a repeating pattern, without holding
+// them.
+type patternReader struct {
+	size, off int64
+}
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	if p.off >= p.size {
+		return 0, io.EOF
+	}
+	if left := p.size - p.off; int64(len(b)) > left {
+		b = b[:left]
+	}
+	for i := 0; i < len(b); {
+		i += copy(b[i:], pattern[(p.off+int64(i))%251:])
+	}
+	p.off += int64(len(b))
+	return len(b), nil
+}
+
+// pattern is what patternReader repeats, with room to copy from any offset.
+var pattern = func() []byte {
+	b := make([]byte, 251+64<<10)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}()
+
+func init() {
+	// test.stream streams "bytes" bytes of patternReader, or writes half of
+	// them and fails when "fail" is set
+	RegisterHandler("test.stream", func(ctx context.Context, req TaskRequest) (interface{}, error) {
+		size := int64(req.Payload["bytes"].(float64))
+		if fail, _ := req.Payload["fail"].(bool); fail {
+			return WriteStream(size, func(w io.Writer) error {
+				if _, err := io.Copy(w, &patternReader{size: size / 2}); err != nil {
+					return err
+				}
+				return errors.New("disk full")
+			}), nil
+		}
+		return NewStreamResult(&patternReader{size: size}, size), nil
+	})
+}
+
+const streamManifest = `
+version: 1
+capabilities:
+  - name: stream
+    handler: test.stream
+  - name: summarize
+    handler: echo
+`
+
+// streamingPair starts a node serving streamManifest and a node to ask it.
+func streamingPair(t *testing.T) (requester, server *AgentNode) {
+	t.Helper()
+	server = newTestNode(t)
+	if err := server.LoadCapabilities([]string{writeManifest(t, streamManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	return startTestNode(t), server
+}
+
+// rss returns the process's resident set in bytes, read from /proc.
+func rss(t *testing.T) int64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		t.Skipf("no /proc to measure memory: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "VmRSS:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+			return kb << 10
+		}
+	}
+	t.Skip("no VmRSS in /proc/self/status")
+	return 0
+}
+
+func TestGigabyteResultStreamsInBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 1GB")
+	}
+	const size = 1 << 30
+	const bound = 128 << 20
+	a, b := streamingPair(t)
+
+	runtime.GC()
+	baseline := rss(t)
+	var peak atomic.Int64
+	peak.Store(baseline)
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if r := rss(t); r > peak.Load() {
+				peak.Store(r)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	result, err := a.SendTaskStream(ctx, dialAddr(b), map[string]interface{}{"capability": "stream", "bytes": size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+	if result.Size != size {
+		t.Errorf("announced %d bytes, want %d", result.Size, size)
+	}
+	got := sha256.New()
+	n, err := io.Copy(got, result)
+	close(done)
+	<-sampled
+	if err != nil || n != size {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+
+	want := sha256.New()
+	io.Copy(want, &patternReader{size: size})
+	if string(got.Sum(nil)) != string(want.Sum(nil)) {
+		t.Error("the streamed result doesn't hash like what was sent")
+	}
+	grew := peak.Load() - baseline
+	t.Logf("resident memory grew by %d MiB", grew>>20)
+	if grew > bound {
+		t.Errorf("resident memory grew by %d MiB streaming 1GB, want under %d MiB", grew>>20, bound>>20)
+	}
+}
+
+func TestStreamedResultsAdaptToEitherRequester(t *testing.T) {
+	a, b := streamingPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A requester that didn't ask for a stream gets a small one whole...
+	resp, err := a.SendTask(ctx, dialAddr(b), map[string]interface{}{"capability": "stream", "bytes": 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := resp.(map[string]interface{})["content"].(string); content == "" {
+		t.Errorf("small stream sent whole = %v, want its content", resp)
+	}
+	// ...and is told to stream one too large for a message
+	_, err = a.SendTask(ctx, dialAddr(b), map[string]interface{}{"capability": "stream", "bytes": maxBufferedStream + 1})
+	var pe *PeerError
+	if !errors.As(err, &pe) || !strings.Contains(pe.Message, "request it as a stream") {
+		t.Errorf("large stream to SendTask = %v, want to be told to stream it", err)
+	}
+
+	// A small result reads as a stream of its JSON
+	result, err := a.SendTaskStream(ctx, dialAddr(b), map[string]interface{}{"capability": "summarize", "text": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(result)
+	if err != nil || string(data) != `{"text":"hi"}` || result.ContentType != "application/json" {
+		t.Errorf("small result as a stream = %s (%s), %v", data, result.ContentType, err)
+	}
+
+	// A stream the handler cuts short fails on the requester's side
+	result, err = a.SendTaskStream(ctx, dialAddr(b), map[string]interface{}{"capability": "stream", "bytes": 1 << 20, "fail": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, result)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("read %d bytes of a failed stream with err %v, want its error", n, err)
+	}
+}
+
+func TestFetchMemoryStreamsIntoTheContentStore(t *testing.T) {
+	a, b := streamingPair(t)
+	const size = 5 << 20
+	f, err := os.Create(filepath.Join(b.Memory.workspacePath, "notes.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(f, &patternReader{size: size})
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := a.FetchMemory(ctx, dialAddr(b), "notes.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+	store := DirContentStore{Dir: t.TempDir()}
+	uri, err := PutContent(ctx, store, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.New()
+	io.Copy(want, &patternReader{size: size})
+	if !strings.HasSuffix(uri, "/"+hex.EncodeToString(want.Sum(nil))) {
+		t.Errorf("stored under %s, want its SHA-256", uri)
+	}
+
+	if _, err := a.FetchMemory(ctx, dialAddr(b), "missing.md"); err == nil {
+		t.Error("fetched a topic with no file")
+	}
+}
+
+// BenchmarkStreamTransfer sends 100MB through the framing of a streamed
+// result, as a node relaying a large chunk does, into a hashing sink.
+func BenchmarkStreamTransfer(b *testing.B) {
+	const size = 100 << 20
+	const chunks = size / streamChunkSize
+	b.SetBytes(size)
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < b.N; i++ {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(writeFrames(pw, &patternReader{size: size}, size)) }()
+		result := readFrames(pr, pr, StreamHeader{Size: size})
+		if _, err := io.Copy(sha256.New(), result); err != nil {
+			b.Fatal(err)
+		}
+		result.Close()
+	}
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*chunks), "allocs/chunk")
+}
@@ -0,0 +1,561 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"agentmesh/pkg/agent/canonical"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DefaultRotationGrace is how long a rotated-out peer ID keeps answering with
+// a moved notice before its key is retired.
+const DefaultRotationGrace = 24 * time.Hour
+
+// KeyRotation records a libp2p identity rotation. Until RetireAt the old
+// identity stays online and points callers at the new one.
+type KeyRotation struct {
+	OldPeerID  string `json:"oldPeerId"`
+	NewPeerID  string `json:"newPeerId"`
+	OldKeyPath string `json:"oldKeyPath,omitempty"`
+	RotatedAt  int64  `json:"rotatedAt"`
+	RetireAt   int64  `json:"retireAt"`
+	RetiredAt  int64  `json:"retiredAt,omitempty"`
+}
+
+// MovedNotice is the answer a rotated-out peer ID gives to any request. It is
+// signed by the old key, so a peer holding only the old ID can trust it.
+type MovedNotice struct {
+	OldPeerID string   `json:"oldPeerId"`
+	NewPeerID string   `json:"newPeerId"`
+	NewAddrs  []string `json:"newAddrs,omitempty"`
+	Until     int64    `json:"until"`               // unix seconds the old ID keeps answering
+	Signature string   `json:"signature,omitempty"` // base64, by the old key over signedBytes
+	Verified  bool     `json:"-"`                   // set on receipt: false if taken under VerifyPermissive without a valid signature
+}
+
+func (m MovedNotice) signedBytes() []byte {
+	m.Signature = ""
+	return signedDocument("agentmesh-moved:", m)
+}
+
+// legacySignedBytes is what notices were signed over before canonical JSON.
+func (m MovedNotice) legacySignedBytes() []byte {
+	return []byte(fmt.Sprintf("agentmesh-moved:%s:%s:%s:%d", m.OldPeerID, m.NewPeerID, strings.Join(m.NewAddrs, ","), m.Until))
+}
+
+// Verify checks the notice signature against the old peer ID's public key.
+func (m MovedNotice) Verify() bool {
+	return verifyPeerSignature(m.OldPeerID, m.signedBytes(), m.Signature) ||
+		verifyPeerSignature(m.OldPeerID, m.legacySignedBytes(), m.Signature)
+}
+
+func signMovedNotice(oldKey crypto.PrivKey, m MovedNotice) (MovedNotice, error) {
+	sig, err := oldKey.Sign(m.signedBytes())
+	if err != nil {
+		return m, err
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(sig)
+	return m, nil
+}
+
+// PeerIDBinding is published as the "peerIdBinding" ERC-8004 metadata next to
+// "peerId": the peer key's signature over the agent it belongs to, so nobody
+// can claim a peer ID whose key they don't hold.
+type PeerIDBinding struct {
+	AgentID   string `json:"agentId"`
+	Wallet    string `json:"wallet"`
+	PeerID    string `json:"peerId"`
+	Signature string `json:"signature,omitempty"` // base64, by the peer key over signedBytes
+}
+
+func (b PeerIDBinding) signedBytes() []byte {
+	b.Wallet, b.Signature = strings.ToLower(b.Wallet), ""
+	return signedDocument("agentmesh-peer-binding:", b)
+}
+
+// legacySignedBytes is what bindings were signed over before canonical JSON;
+// bindings published then are still on chain.
+func (b PeerIDBinding) legacySignedBytes() []byte {
+	return []byte(fmt.Sprintf("agentmesh-peer-binding:%s:%s:%s", b.AgentID, strings.ToLower(b.Wallet), b.PeerID))
+}
+
+// Verify checks the binding signature against the bound peer ID.
+func (b PeerIDBinding) Verify() bool {
+	return verifyPeerSignature(b.PeerID, b.signedBytes(), b.Signature) ||
+		verifyPeerSignature(b.PeerID, b.legacySignedBytes(), b.Signature)
+}
+
+// signedDocument is what a peer key signs for a document: its domain, then
+// its canonical JSON. It is nil for a document without a canonical form,
+// such as one a peer sent with an integer beyond 2^53, which never verifies.
+func signedDocument(domain string, doc interface{}) []byte {
+	raw, err := canonical.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+	return append([]byte(domain), raw...)
+}
+
+// verifyPeerSignature checks a base64 signature made by the key behind peerID.
+func verifyPeerSignature(peerID string, data []byte, signature string) bool {
+	if len(data) == 0 {
+		return false
+	}
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return false
+	}
+	pub, err := pid.ExtractPublicKey()
+	if err != nil {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	ok, err := pub.Verify(data, sig)
+	return err == nil && ok
+}
+
+// PublishPeerID points the wallet's agent at the peer ID of priv: it sets the
+// "peerId" metadata and a signed "peerIdBinding". It returns the agentId.
+func (c *ERC8004Client) PublishPeerID(w *Wallet, priv crypto.PrivKey) (*big.Int, error) {
+	agentId, err := c.GetAgentIdByWallet(w.Address)
+	if err != nil {
+		return nil, fmt.Errorf("wallet %s has no registered agent: %w", w.Address.Hex(), err)
+	}
+	if err := c.BindPeerID(w, agentId, priv); err != nil {
+		return nil, err
+	}
+	return agentId, nil
+}
+
+// BindPeerID is PublishPeerID for an agentId already known.
+func (c *ERC8004Client) BindPeerID(w *Wallet, agentId *big.Int, priv crypto.PrivKey) error {
+	pid, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	binding := PeerIDBinding{AgentID: agentId.String(), Wallet: w.Address.Hex(), PeerID: pid.String()}
+	sig, err := priv.Sign(binding.signedBytes())
+	if err != nil {
+		return err
+	}
+	binding.Signature = base64.StdEncoding.EncodeToString(sig)
+	raw, _ := json.Marshal(binding)
+
+	if err := c.SetMetadata(w, agentId, "peerId", []byte(pid.String())); err != nil {
+		return err
+	}
+	return c.SetMetadata(w, agentId, "peerIdBinding", raw)
+}
+
+// ErrUnboundPeerID means an agent's published peerId has no valid
+// "peerIdBinding": anyone could have published it.
+var ErrUnboundPeerID = errors.New("peerId is not bound to the agent")
+
+// SetStrictPeerBinding makes ResolvePeerID reject a peerId whose binding is
+// missing or invalid, instead of only warning about it.
+func (c *ERC8004Client) SetStrictPeerBinding(on bool) {
+	c.strictBinding = on
+}
+
+// SetVerification sets what ResolvePeerID does with a binding whose
+// signature doesn't verify: under VerifyStrict, the default, its peerId is
+// rejected even without strict peer binding; under VerifyPermissive it is
+// used with a warning, like a missing binding; under VerifyOff the
+// signature isn't checked.
+func (c *ERC8004Client) SetVerification(m VerificationMode) {
+	c.verification = m
+}
+
+// ResolvePeerID returns the peerId an agent published, or "" if none. Its
+// binding is checked with VerifyPeerBinding; with strict peer binding a
+// peerId that fails the check is an error wrapping ErrUnboundPeerID, and so
+// is one whose binding signature doesn't verify under VerifyStrict.
+func (c *ERC8004Client) ResolvePeerID(agentId *big.Int) (string, error) {
+	meta, err := c.GetMetadataBatch(agentId, []string{"peerId", "peerIdBinding"})
+	if err != nil {
+		return "", err
+	}
+	return c.checkPeerID(agentId, string(meta["peerId"]), string(meta["peerIdBinding"]))
+}
+
+// checkPeerID is ResolvePeerID for metadata already read.
+func (c *ERC8004Client) checkPeerID(agentId *big.Int, peerID, binding string) (string, error) {
+	if peerID == "" {
+		return "", nil
+	}
+	err := c.verifyBinding(agentId, peerID, binding)
+	switch {
+	case err == nil:
+		return peerID, nil
+	case !errors.Is(err, ErrUnboundPeerID):
+		return "", err
+	case c.strictBinding, errors.Is(err, ErrUnverifiedSignature) && c.verification.strict():
+		return "", fmt.Errorf("agent %s: %w", agentId, err)
+	}
+	fmt.Printf("[Discovery] Warning: agent %s: %v\n", agentId, err)
+	return peerID, nil
+}
+
+// VerifyPeerBinding checks that the agent's "peerIdBinding" metadata was
+// signed by peerID's key for this agent and the wallet that owns it. A
+// missing or invalid binding is an error wrapping ErrUnboundPeerID; other
+// errors are failed registry calls.
+func (c *ERC8004Client) VerifyPeerBinding(agentId *big.Int, peerID string) error {
+	raw, err := c.GetMetadata(agentId, "peerIdBinding")
+	if err != nil {
+		return err
+	}
+	return c.verifyBinding(agentId, peerID, raw)
+}
+
+// verifyBinding is VerifyPeerBinding for a binding already read.
+func (c *ERC8004Client) verifyBinding(agentId *big.Int, peerID, raw string) error {
+	if raw == "" {
+		return fmt.Errorf("%w: no peerIdBinding published", ErrUnboundPeerID)
+	}
+	var b PeerIDBinding
+	if err := json.Unmarshal([]byte(raw), &b); err != nil {
+		return fmt.Errorf("%w: unreadable peerIdBinding", ErrUnboundPeerID)
+	}
+	if b.PeerID != peerID || b.AgentID != agentId.String() {
+		return fmt.Errorf("%w: binding is for peer %s of agent %s", ErrUnboundPeerID, b.PeerID, b.AgentID)
+	}
+	if c.verification != VerifyOff && !b.Verify() {
+		return fmt.Errorf("%w: binding signature is not by %s: %w", ErrUnboundPeerID, peerID, ErrUnverifiedSignature)
+	}
+	owner, err := c.ownerOf(agentId)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(b.Wallet, owner.Hex()) {
+		return fmt.Errorf("%w: binding names wallet %s, agent is owned by %s", ErrUnboundPeerID, b.Wallet, owner.Hex())
+	}
+	return nil
+}
+
+// ownerOf returns the wallet holding an agent's identity NFT.
+func (c *ERC8004Client) ownerOf(agentId *big.Int) (common.Address, error) {
+	data, _ := c.identityABI.Pack("ownerOf", agentId)
+	res, err := c.call(c.identityAddr, data, c.readBlock(nil))
+	if err != nil {
+		return common.Address{}, err
+	}
+	var owner common.Address
+	err = c.identityABI.UnpackIntoInterface(&owner, "ownerOf", res)
+	return owner, err
+}
+
+func (s *sqlStore) SaveKeyRotation(r KeyRotation) error {
+	_, err := s.exec(`
+		INSERT INTO key_rotations (old_peer_id, new_peer_id, old_key_path, rotated_at, retire_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(old_peer_id) DO UPDATE SET new_peer_id = excluded.new_peer_id, old_key_path = excluded.old_key_path,
+			rotated_at = excluded.rotated_at, retire_at = excluded.retire_at`,
+		r.OldPeerID, r.NewPeerID, r.OldKeyPath, r.RotatedAt, r.RetireAt)
+	return err
+}
+
+// PendingKeyRotations returns rotations whose old key has not been retired yet.
+func (s *sqlStore) PendingKeyRotations() ([]KeyRotation, error) {
+	rows, err := s.query("SELECT old_peer_id, new_peer_id, old_key_path, rotated_at, retire_at FROM key_rotations WHERE retired_at IS NULL ORDER BY rotated_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []KeyRotation
+	for rows.Next() {
+		var r KeyRotation
+		var path sql.NullString
+		if err := rows.Scan(&r.OldPeerID, &r.NewPeerID, &path, &r.RotatedAt, &r.RetireAt); err == nil {
+			r.OldKeyPath = path.String
+			results = append(results, r)
+		}
+	}
+	return results, rows.Err()
+}
+
+func (s *sqlStore) MarkKeyRetired(oldPeerID string) error {
+	_, err := s.exec("UPDATE key_rotations SET retired_at = ? WHERE old_peer_id = ?", time.Now().Unix(), oldPeerID)
+	return err
+}
+
+// RotationResult reports a rotation together with the on-chain update of the
+// published peerId.
+type RotationResult struct {
+	KeyRotation
+	AgentID      string `json:"agentId,omitempty"`
+	PublishError string `json:"publishError,omitempty"`
+}
+
+// RotateIdentityFile rotates the key at path while no node is running: the
+// new key replaces the file and the old one is kept next to it, so the next
+// node start serves the old ID with a moved notice until the grace period
+// ends.
+func RotateIdentityFile(store MetadataStore, path string, grace time.Duration) (*KeyRotation, crypto.PrivKey, error) {
+	if grace <= 0 {
+		grace = DefaultRotationGrace
+	}
+	oldKey, err := LoadIdentity(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	newKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	oldID, _ := peer.IDFromPrivateKey(oldKey)
+	newID, _ := peer.IDFromPrivateKey(newKey)
+
+	oldKeyPath := path + "." + oldID.String() + ".old"
+	if err := SaveIdentity(oldKeyPath, oldKey); err != nil {
+		return nil, nil, err
+	}
+	if err := SaveIdentity(path, newKey); err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	r := KeyRotation{
+		OldPeerID:  oldID.String(),
+		NewPeerID:  newID.String(),
+		OldKeyPath: oldKeyPath,
+		RotatedAt:  now.Unix(),
+		RetireAt:   now.Add(grace).Unix(),
+	}
+	if err := store.SaveKeyRotation(r); err != nil {
+		return nil, nil, err
+	}
+	store.AppendAudit(AuditKeyRotated, r.OldPeerID, fmt.Sprintf("new peer ID %s (offline), retiring at %s", r.NewPeerID, time.Unix(r.RetireAt, 0).UTC().Format(time.RFC3339)))
+	return &r, newKey, nil
+}
+
+// RotateIdentity switches the node to newKey while it keeps running. The new
+// identity becomes primary immediately; the old one stays online for grace,
+// answering every request with a signed MovedNotice, and is then retired.
+// With IdentityPath set, the new key replaces the key file and the old key is
+// kept next to it until retirement, so a restart within the grace period
+// resumes serving the old ID.
+func (n *AgentNode) RotateIdentity(newKey crypto.PrivKey, grace time.Duration) (*KeyRotation, error) {
+	if grace <= 0 {
+		grace = DefaultRotationGrace
+	}
+	n.mu.RLock()
+	oldKey, oldHost, oldStack := n.privKey, n.Host, n.stack
+	n.mu.RUnlock()
+	if oldHost == nil {
+		return nil, fmt.Errorf("node is not started")
+	}
+
+	var oldKeyPath string
+	if n.IdentityPath != "" {
+		oldKeyPath = n.IdentityPath + "." + oldHost.ID().String() + ".old"
+		if err := SaveIdentity(oldKeyPath, oldKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := n.startP2P(newKey); err != nil {
+		return nil, fmt.Errorf("failed to start new identity: %w", err)
+	}
+	if n.IdentityPath != "" {
+		if err := SaveIdentity(n.IdentityPath, newKey); err != nil {
+			return nil, err
+		}
+	}
+
+	// The old host leaves pubsub but keeps its listeners for the grace period
+	oldStack.stop()
+	now := time.Now()
+	r := KeyRotation{
+		OldPeerID:  oldHost.ID().String(),
+		NewPeerID:  n.CurrentHost().ID().String(),
+		OldKeyPath: oldKeyPath,
+		RotatedAt:  now.Unix(),
+		RetireAt:   now.Add(grace).Unix(),
+	}
+	if err := n.Store.SaveKeyRotation(r); err != nil {
+		return nil, err
+	}
+	n.Store.AppendAudit(AuditKeyRotated, r.OldPeerID, fmt.Sprintf("new peer ID %s, retiring at %s", r.NewPeerID, time.Unix(r.RetireAt, 0).UTC().Format(time.RFC3339)))
+	fmt.Printf("[Identity] Rotated %s -> %s; old ID answers until %s\n", r.OldPeerID, r.NewPeerID, time.Unix(r.RetireAt, 0).Format(time.RFC3339))
+	n.Events.Add("identity_rotated", r)
+
+	if err := n.serveMoved(oldHost, oldKey, r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// pendingRotations loads the rotations resumeRotations picks up.
+func (n *AgentNode) pendingRotations() []KeyRotation {
+	pending, err := n.Store.PendingKeyRotations()
+	if err != nil {
+		fmt.Printf("[Identity] Failed to load key rotations: %v\n", err)
+	}
+	return pending
+}
+
+// resumeRotations brings rotated-out identities still in their grace period
+// back online after a restart, and retires the expired ones.
+func (n *AgentNode) resumeRotations(pending []KeyRotation) {
+	for _, r := range pending {
+		if time.Now().Unix() >= r.RetireAt || r.OldKeyPath == "" {
+			n.retire(nil, r)
+			continue
+		}
+		// Point at the current identity even if it has rotated again since
+		r.NewPeerID = n.CurrentHost().ID().String()
+		oldKey, err := LoadIdentity(r.OldKeyPath)
+		if err != nil {
+			fmt.Printf("[Identity] Cannot load old key for %s: %v\n", r.OldPeerID, err)
+			n.retire(nil, r)
+			continue
+		}
+		oldHost, err := n.newHost(oldKey, ephemeralAddrs(n.listenAddrs))
+		if err != nil {
+			fmt.Printf("[Identity] Cannot bring %s back online: %v\n", r.OldPeerID, err)
+			continue
+		}
+		n.serveMoved(oldHost, oldKey, r)
+	}
+}
+
+// serveMoved turns h into a forwarding stub for the new identity until the
+// rotation's retire time.
+func (n *AgentNode) serveMoved(h host.Host, oldKey crypto.PrivKey, r KeyRotation) error {
+	notice := MovedNotice{OldPeerID: r.OldPeerID, NewPeerID: r.NewPeerID, Until: r.RetireAt}
+	for _, a := range n.CurrentHost().Addrs() {
+		notice.NewAddrs = append(notice.NewAddrs, a.String())
+	}
+	notice, err := signMovedNotice(oldKey, notice)
+	if err != nil {
+		return err
+	}
+
+	reply := func(s network.Stream) {
+		defer s.Close()
+		readLP(s)
+		// Each stream builds its own message; handlers run concurrently
+		moved := AgentMessage{Type: MessageMoved, Payload: notice, Sender: r.OldPeerID, Timestamp: time.Now().UnixMilli()}
+		data, _ := json.Marshal(moved)
+		writeLP(s, data)
+	}
+	for _, p := range []string{TaskProtocol, MemoryProtocol, NegotiateProtocol, CatalogProtocol, HistoryProtocol} {
+		h.SetStreamHandler(protocol.ID(p), reply)
+	}
+	h.SetStreamHandler(protocol.ID(PingProtocol), func(s network.Stream) {
+		defer s.Close()
+		readLP(s)
+		data, _ := json.Marshal(PingResponse{PeerID: r.OldPeerID, Time: time.Now().UnixMilli(), Moved: &notice})
+		writeLP(s, data)
+	})
+
+	n.mu.Lock()
+	n.retiring = append(n.retiring, h)
+	n.mu.Unlock()
+
+	go func() {
+		timer := time.NewTimer(time.Until(time.Unix(r.RetireAt, 0)))
+		defer timer.Stop()
+		select {
+		case <-n.ctx.Done():
+			// Stop closes the host; the rotation resumes on the next start
+		case <-timer.C:
+			n.retire(h, r)
+		}
+	}()
+	return nil
+}
+
+// retire closes the old identity's host, deletes its key and records it.
+func (n *AgentNode) retire(h host.Host, r KeyRotation) {
+	if h != nil {
+		h.Close()
+		n.mu.Lock()
+		for i, rh := range n.retiring {
+			if rh == h {
+				n.retiring = append(n.retiring[:i], n.retiring[i+1:]...)
+				break
+			}
+		}
+		n.mu.Unlock()
+	}
+	if r.OldKeyPath != "" {
+		if err := os.Remove(r.OldKeyPath); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Identity] Failed to delete old key %s: %v\n", r.OldKeyPath, err)
+		}
+	}
+	if err := n.Store.MarkKeyRetired(r.OldPeerID); err != nil {
+		fmt.Printf("[Identity] Failed to record retirement of %s: %v\n", r.OldPeerID, err)
+		return
+	}
+	n.Store.AppendAudit(AuditKeyRetired, r.OldPeerID, "replaced by "+r.NewPeerID)
+	fmt.Printf("[Identity] Retired old peer ID %s\n", r.OldPeerID)
+	n.Events.Add("identity_retired", map[string]string{"peerId": r.OldPeerID})
+}
+
+// Ping asks a peer who it is. A rotated-out peer answers with a MovedNotice.
+func (n *AgentNode) Ping(ctx context.Context, target string) (*PingResponse, error) {
+	pid, err := n.addTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	s, err := n.CurrentHost().NewStream(ctx, pid, protocol.ID(PingProtocol))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	if err := writeLP(s, []byte("{}")); err != nil {
+		return nil, err
+	}
+	data, err := readLP(s)
+	if err != nil {
+		return nil, err
+	}
+	var msg AgentMessage
+	if json.Unmarshal(data, &msg) == nil && msg.Type == MessageError {
+		return nil, peerError(pid.String(), msg)
+	}
+	var resp PingResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Moved != nil {
+		accept, verified := n.Verification.admit("moved notice", pid.String(), resp.Moved.Verify)
+		if !accept || resp.Moved.OldPeerID != pid.String() {
+			return nil, fmt.Errorf("peer %s sent an invalid moved notice", pid)
+		}
+		resp.Moved.Verified = verified
+	}
+	return &resp, nil
+}
+
+// PingResponse is the answer to the ping protocol.
+type PingResponse struct {
+	PeerID string       `json:"peerId"`
+	Time   int64        `json:"time"`
+	Moved  *MovedNotice `json:"moved,omitempty"`
+}
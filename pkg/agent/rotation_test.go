@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestLiveRotationOldIDDuringAndAfterGrace(t *testing.T) {
+	a := startTestNode(t)
+	b := startTestNode(t)
+	oldAddr := dialAddr(a)
+	oldID := a.CurrentHost().ID().String()
+
+	// Readers run alongside the rotation; -race catches unguarded Host reads
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				a.Status()
+				a.Healthz()
+			}
+		}
+	}()
+
+	newKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rot, err := a.RotateIdentity(newKey, 4*time.Second)
+	close(stop)
+	readers.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rot.OldPeerID != oldID || rot.NewPeerID != a.CurrentHost().ID().String() {
+		t.Fatalf("rotation = %+v, current ID %s", rot, a.CurrentHost().ID())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// During the grace period the old ID answers with a signed notice
+	resp, err := b.Ping(ctx, oldAddr)
+	if err != nil {
+		t.Fatalf("ping old ID during grace: %v", err)
+	}
+	if resp.Moved == nil || resp.Moved.NewPeerID != rot.NewPeerID || !resp.Moved.Verify() {
+		t.Fatalf("ping old ID = %+v, want a verified moved notice to %s", resp, rot.NewPeerID)
+	}
+
+	// Concurrent tasks to the old ID are all followed to the new one
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload, err := b.SendTask(ctx, oldAddr, map[string]interface{}{"hello": "world"})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if m, _ := payload.(map[string]interface{}); m["agent"] != rot.NewPeerID {
+				t.Errorf("task answered by %v, want %s", m["agent"], rot.NewPeerID)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("task to old ID during grace: %v", err)
+	}
+
+	// After the grace period the old ID is gone
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		pending, err := a.Store.PendingKeyRotations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old identity was not retired after the grace period")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	pingCtx, pingCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer pingCancel()
+	if resp, err := b.Ping(pingCtx, oldAddr); err == nil {
+		t.Errorf("old ID still answers after the grace period: %+v", resp)
+	}
+	if resp, err := b.Ping(ctx, dialAddr(a)); err != nil || resp.PeerID != rot.NewPeerID {
+		t.Errorf("ping new ID = %+v, %v", resp, err)
+	}
+}
+
+// bindingRegistry serves getMetadata and ownerOf from maps keyed by agentId.
+func bindingRegistry(t *testing.T, metadata map[int64]map[string]string, owners map[int64]common.Address) *ERC8004Client {
+	t.Helper()
+	parsed, _ := abi.JSON(strings.NewReader(identityABI))
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		if method != "eth_call" {
+			return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+		}
+		var call struct {
+			Input hexutil.Bytes `json:"input"`
+		}
+		json.Unmarshal(params[0], &call)
+		m, err := parsed.MethodById(call.Input)
+		if err != nil {
+			return nil, &rpcError{Code: 3, Message: "execution reverted"}
+		}
+		args, _ := m.Inputs.Unpack(call.Input[4:])
+		agentId := args[0].(*big.Int).Int64()
+		var out []byte
+		switch m.Name {
+		case "getMetadata":
+			out, _ = m.Outputs.Pack([]byte(metadata[agentId][args[1].(string)]))
+		case "ownerOf":
+			out, _ = m.Outputs.Pack(owners[agentId])
+		}
+		return hexutil.Encode(out), nil
+	})
+	c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	t.Cleanup(c.Close)
+	return c
+}
+
+// signBinding returns the peerIdBinding metadata priv signs for an agent.
+func signBinding(t *testing.T, priv crypto.PrivKey, b PeerIDBinding) string {
+	t.Helper()
+	sig, err := priv.Sign(b.signedBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Signature = base64.StdEncoding.EncodeToString(sig)
+	raw, _ := json.Marshal(b)
+	return string(raw)
+}
+
+func TestResolvePeerIDChecksBinding(t *testing.T) {
+	victimKey, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	attackerKey, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	victim, _ := peer.IDFromPrivateKey(victimKey)
+	owner, attacker := common.HexToAddress("0x0a"), common.HexToAddress("0x0b")
+	victimBinding := signBinding(t, victimKey, PeerIDBinding{AgentID: "1", Wallet: owner.Hex(), PeerID: victim.String()})
+
+	client := bindingRegistry(t, map[int64]map[string]string{
+		1: {"peerId": victim.String(), "peerIdBinding": victimBinding},
+		// Someone else's peerId, with its binding copied
+		2: {"peerId": victim.String(), "peerIdBinding": victimBinding},
+		// A binding for agent 3 that the peer key never signed
+		3: {"peerId": victim.String(), "peerIdBinding": signBinding(t, attackerKey, PeerIDBinding{AgentID: "3", Wallet: attacker.Hex(), PeerID: victim.String()})},
+		// Bound before the identity changed hands
+		4: {"peerId": victim.String(), "peerIdBinding": signBinding(t, victimKey, PeerIDBinding{AgentID: "4", Wallet: owner.Hex(), PeerID: victim.String()})},
+		5: {"peerId": victim.String()},
+	}, map[int64]common.Address{1: owner, 2: attacker, 3: attacker, 4: attacker, 5: owner})
+
+	for _, strict := range []bool{false, true} {
+		for _, mode := range []VerificationMode{VerifyStrict, VerifyPermissive} {
+			client.SetStrictPeerBinding(strict)
+			client.SetVerification(mode)
+			for agentId := int64(1); agentId <= 5; agentId++ {
+				got, err := client.ResolvePeerID(big.NewInt(agentId))
+				switch {
+				case agentId == 1:
+					if err != nil || got != victim.String() {
+						t.Errorf("strict=%v agent 1 = %q, %v; want its bound peerId", strict, got, err)
+					}
+				case strict:
+					if !errors.Is(err, ErrUnboundPeerID) || got != "" {
+						t.Errorf("strict agent %d = %q, %v; want ErrUnboundPeerID", agentId, got, err)
+					}
+				case agentId == 3 && mode == VerifyStrict:
+					// A binding signature that doesn't verify is refused
+					// under strict verification all the same
+					if !errors.Is(err, ErrUnverifiedSignature) || got != "" {
+						t.Errorf("lenient agent 3 = %q, %v; want ErrUnverifiedSignature", got, err)
+					}
+				default:
+					if err != nil || got != victim.String() {
+						t.Errorf("lenient %s agent %d = %q, %v; want the peerId with a warning", mode, agentId, got, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSignaturesFromBeforeCanonicalJSONStillVerify(t *testing.T) {
+	key, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	other, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	id, _ := peer.IDFromPrivateKey(key)
+	otherID, _ := peer.IDFromPrivateKey(other)
+	sign := func(k crypto.PrivKey, data []byte) string {
+		sig, err := k.Sign(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+
+	binding := PeerIDBinding{AgentID: "7", Wallet: "0x00000000000000000000000000000000000000Aa", PeerID: id.String()}
+	binding.Signature = sign(key, binding.legacySignedBytes())
+	if !binding.Verify() {
+		t.Error("binding signed in the legacy format didn't verify")
+	}
+
+	offer := Offer{NegotiationID: "n", Round: 1, AssetHash: "0x01", Price: big.NewInt(5), Expiry: 1700000000000, From: id.String()}
+	offer.Signature = sign(key, offer.legacySignedBytes())
+	if !offer.Verify() {
+		t.Error("offer signed in the legacy format didn't verify")
+	}
+	offer.Price = big.NewInt(6)
+	if offer.Verify() {
+		t.Error("offer verified after its price changed")
+	}
+
+	// Both sides must sign the same form
+	agreement := Agreement{NegotiationID: "n", AssetHash: "0x01", Price: big.NewInt(5), Expiry: 1700000000000, Requester: id.String(), Responder: otherID.String(), Rounds: 1}
+	agreement.RequesterSig = sign(key, agreement.legacySignedBytes())
+	agreement.ResponderSig = sign(other, agreement.signedBytes())
+	if agreement.Verify() {
+		t.Error("agreement signed in two different forms verified")
+	}
+	agreement.ResponderSig = sign(other, agreement.legacySignedBytes())
+	if !agreement.Verify() {
+		t.Error("agreement signed in the legacy format didn't verify")
+	}
+
+	// An advertisement encoded by encoding/json, in struct field order
+	data, _ := json.Marshal(struct {
+		Timestamp  int64  `json:"timestamp"`
+		EthAddress string `json:"ethAddress"`
+	}{1700000000000, "0x00000000000000000000000000000000000000aa"})
+	packet := SignedPacket{Data: string(data), PeerID: id.String(), Signature: sign(key, data)}
+	if !packet.Verify() {
+		t.Error("packet signed over its encoding/json data didn't verify")
+	}
+
+	// Signing now covers the canonical JSON, whatever order Data is sent in
+	canonical := `{"ethAddress":"0x00000000000000000000000000000000000000aa","timestamp":1700000000000}`
+	packet.Signature = sign(key, []byte(canonical))
+	if !packet.Verify() {
+		t.Error("packet signed over the canonical form of its data didn't verify")
+	}
+}
@@ -0,0 +1,408 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DefaultRouteTTL is how long a capability announcement keeps its peer in the
+// routing table. Peers re-announce every few seconds, so a missed minute or
+// two means the peer is gone.
+const DefaultRouteTTL = 2 * time.Minute
+
+// DefaultMaxNewPeers is how many announcements from peers the table doesn't
+// know it admits per DefaultRouteTTL. Peer IDs are free to create, so without
+// a cap a flood of them would fill the table and keep the GossipVerifier
+// busy.
+const DefaultMaxNewPeers = 64
+
+// DefaultQuarantineInterval is how often a quarantined peer's announcements
+// are admitted. Verified peers are admitted every time.
+const DefaultQuarantineInterval = 30 * time.Second
+
+// DefaultMaxHops limits how many times a task may be forwarded, so routing
+// tables that point at each other can't bounce a task forever.
+const DefaultMaxHops = 3
+
+// forwardTimeout bounds one forwarding attempt, including the remote work.
+const forwardTimeout = 30 * time.Second
+
+// RoutePeer is a peer able to serve a capability.
+type RoutePeer struct {
+	PeerID      string `json:"peerId"`
+	LastSeen    int64  `json:"lastSeen"`
+	Quarantined bool   `json:"quarantined,omitempty"` // advertised without a verified identity
+}
+
+// Route lists the known peers for one capability, most recently seen first.
+type Route struct {
+	Capability string      `json:"capability"`
+	Peers      []RoutePeer `json:"peers"`
+}
+
+// RoutingTable maps capabilities to the peers that announced them. It is
+// filled from discovery announcements and read when forwarding tasks. Each
+// peer has one entry per capability, refreshed by every announcement and
+// dropped once it hasn't announced for the TTL.
+// Peers whose announcements failed the node's GossipVerifier are kept
+// quarantined: they are routed to only when no verified peer serves the
+// capability, and are never paid.
+type RoutingTable struct {
+	MaxNewPeers        int           // unknown peers admitted per TTL; 0 means DefaultMaxNewPeers
+	QuarantineInterval time.Duration // how often a quarantined peer is admitted; 0 means DefaultQuarantineInterval
+
+	mu       sync.RWMutex
+	ttl      time.Duration
+	clock    Clock
+	routes   map[string]map[peer.ID]routeEntry
+	newPeers []time.Time // admissions of unknown peers within the last TTL
+	pruned   time.Time
+}
+
+type routeEntry struct {
+	seen        time.Time
+	quarantined bool
+}
+
+// NewRoutingTable returns an empty table whose entries expire ttl after the
+// last announcement; non-positive values mean DefaultRouteTTL.
+func NewRoutingTable(ttl time.Duration) *RoutingTable {
+	if ttl <= 0 {
+		ttl = DefaultRouteTTL
+	}
+	return &RoutingTable{ttl: ttl, clock: SystemClock, routes: make(map[string]map[peer.ID]routeEntry)}
+}
+
+// SetClock replaces the clock announcements are timed and expired by.
+func (t *RoutingTable) SetClock(clock Clock) {
+	t.clock = clock
+}
+
+// Admit reports whether an announcement from pid should be processed. Peers
+// with a live verified entry always are; quarantined ones once per
+// QuarantineInterval; peers the table doesn't know while fewer than
+// MaxNewPeers were admitted in the last TTL.
+func (t *RoutingTable) Admit(pid peer.ID) bool {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var last time.Time
+	for _, peers := range t.routes {
+		e, ok := peers[pid]
+		if !ok || now.Sub(e.seen) > t.ttl {
+			continue
+		}
+		if !e.quarantined {
+			return true
+		}
+		if e.seen.After(last) {
+			last = e.seen
+		}
+	}
+	if !last.IsZero() {
+		interval := t.QuarantineInterval
+		if interval <= 0 {
+			interval = DefaultQuarantineInterval
+		}
+		return now.Sub(last) >= interval
+	}
+
+	limit := t.MaxNewPeers
+	if limit <= 0 {
+		limit = DefaultMaxNewPeers
+	}
+	recent := t.newPeers[:0]
+	for _, at := range t.newPeers {
+		if now.Sub(at) < t.ttl {
+			recent = append(recent, at)
+		}
+	}
+	t.newPeers = recent
+	if len(t.newPeers) >= limit {
+		return false
+	}
+	t.newPeers = append(t.newPeers, now)
+	return true
+}
+
+// Add records that pid announced capability just now.
+func (t *RoutingTable) Add(capability string, pid peer.ID) {
+	t.set(capability, pid, false)
+}
+
+// Quarantine records that pid announced capability just now without a
+// verified identity. A verified announcement lifts it again.
+func (t *RoutingTable) Quarantine(capability string, pid peer.ID) {
+	t.set(capability, pid, true)
+}
+
+func (t *RoutingTable) set(capability string, pid peer.ID, quarantined bool) {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.pruned) >= t.ttl {
+		t.prune(now)
+	}
+	peers := t.routes[capability]
+	if peers == nil {
+		peers = make(map[peer.ID]routeEntry)
+		t.routes[capability] = peers
+	}
+	peers[pid] = routeEntry{seen: now, quarantined: quarantined}
+}
+
+// prune drops the entries of peers that stopped announcing. Reads skip them
+// anyway; pruning keeps the table from growing with every peer ever seen.
+func (t *RoutingTable) prune(now time.Time) {
+	for capability, peers := range t.routes {
+		for pid, e := range peers {
+			if now.Sub(e.seen) > t.ttl {
+				delete(peers, pid)
+			}
+		}
+		if len(peers) == 0 {
+			delete(t.routes, capability)
+		}
+	}
+	t.pruned = now
+}
+
+// Len returns how many entries the table holds, stale ones not yet pruned
+// included.
+func (t *RoutingTable) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := 0
+	for _, peers := range t.routes {
+		n += len(peers)
+	}
+	return n
+}
+
+// Remove drops pid from every capability, e.g. once it is blocked.
+func (t *RoutingTable) Remove(pid peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for capability, peers := range t.routes {
+		delete(peers, pid)
+		if len(peers) == 0 {
+			delete(t.routes, capability)
+		}
+	}
+}
+
+// IsQuarantined reports whether peerID's live announcements are all
+// quarantined ones.
+func (t *RoutingTable) IsQuarantined(peerID string) bool {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return false
+	}
+	now := t.clock.Now()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	quarantined := false
+	for _, peers := range t.routes {
+		if e, ok := peers[pid]; ok && now.Sub(e.seen) <= t.ttl {
+			if !e.quarantined {
+				return false
+			}
+			quarantined = true
+		}
+	}
+	return quarantined
+}
+
+// Lookup returns the live peers for capability, most recently seen first.
+// Quarantined peers are returned only when there is no verified one.
+func (t *RoutingTable) Lookup(capability string) []peer.ID {
+	var ids []peer.ID
+	for _, p := range t.route(capability, t.clock.Now()) {
+		if pid, err := peer.Decode(p.PeerID); err == nil {
+			ids = append(ids, pid)
+		}
+	}
+	return ids
+}
+
+// Snapshot returns every capability with live peers, sorted by name,
+// quarantined peers included. It reads the whole table at one instant.
+func (t *RoutingTable) Snapshot() []Route {
+	now := t.clock.Now()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.routes))
+	for capability := range t.routes {
+		names = append(names, capability)
+	}
+	sort.Strings(names)
+
+	routes := []Route{}
+	for _, capability := range names {
+		if peers := t.liveLocked(capability, now); len(peers) > 0 {
+			routes = append(routes, Route{Capability: capability, Peers: peers})
+		}
+	}
+	return routes
+}
+
+// route returns the live verified peers for capability, or the quarantined
+// ones if there are none.
+func (t *RoutingTable) route(capability string, now time.Time) []RoutePeer {
+	var verified, quarantined []RoutePeer
+	for _, p := range t.live(capability, now) {
+		if p.Quarantined {
+			quarantined = append(quarantined, p)
+		} else {
+			verified = append(verified, p)
+		}
+	}
+	if len(verified) == 0 {
+		return quarantined
+	}
+	return verified
+}
+
+// live returns the peers that announced capability within the TTL, newest
+// first. A capability identifier also finds the peers of every identifier
+// it matches.
+func (t *RoutingTable) live(capability string, now time.Time) []RoutePeer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.liveLocked(capability, now)
+}
+
+// liveLocked is live with t.mu held.
+func (t *RoutingTable) liveLocked(capability string, now time.Time) []RoutePeer {
+	keys := []string{capability}
+	if IsCapabilityID(capability) {
+		for key := range t.routes {
+			if key != capability && MatchCapability(capability, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	var peers []RoutePeer
+	seen := map[peer.ID]bool{}
+	for _, key := range keys {
+		for pid, e := range t.routes[key] {
+			if now.Sub(e.seen) <= t.ttl && !seen[pid] {
+				seen[pid] = true
+				peers = append(peers, RoutePeer{PeerID: pid.String(), LastSeen: e.seen.UnixMilli(), Quarantined: e.quarantined})
+			}
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastSeen > peers[j].LastSeen })
+	return peers
+}
+
+// taskCapability returns the capability a task payload asks for, from its
+// "capability" field. Tasks without one are always handled locally.
+func taskCapability(payload interface{}) string {
+	m, ok := payload.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	capability, _ := m["capability"].(string)
+	return capability
+}
+
+// serves reports whether the node advertises capability itself.
+func (n *AgentNode) serves(capability string) bool {
+	_, ok := n.CanHandle(capability)
+	return ok
+}
+
+// forwardTask relays a task the node can't serve to a peer that announced
+// the capability, and returns that peer's response for the original
+// requester. from is the peer that sent the task to us; it and the original
+// sender are never chosen, and the hop count caps longer loops. taskID
+// names the task in lifecycle events.
+func (n *AgentNode) forwardTask(ctx context.Context, taskID string, msg AgentMessage, capability string, from peer.ID) AgentMessage {
+	maxHops := n.MaxHops
+	if maxHops == 0 {
+		maxHops = DefaultMaxHops
+	}
+	if msg.Hops >= maxHops {
+		failure := ErrorPayload{Code: ErrCodeHopLimit, Message: fmt.Sprintf("hop limit %d reached for capability %q", maxHops, capability)}
+		n.taskStage(taskID, StageFailed, capability, errors.New(failure.Message))
+		return n.errorMessage(failure)
+	}
+	n.taskStage(taskID, StageValidated, capability, nil)
+
+	msg.Hops++
+	// Results are relayed whole, so a streamed one reaches us in one message
+	msg.Stream = false
+	self := n.CurrentHost().ID()
+	// With no usable route, answer with the last peer's own error if any
+	failure := ErrorPayload{Code: ErrCodeNoRoute, Message: fmt.Sprintf("no route for capability %q", capability), Retryable: true}
+	for _, pid := range n.forwardCandidates(ctx, taskID, capability) {
+		if pid == from || pid == self || pid.String() == msg.Sender || n.permit(pid, PolicyActionDeliver) != nil {
+			continue
+		}
+		n.EmitLifecycle(LifecycleEvent{TaskID: taskID, Stage: StageDispatched, Capability: capability, Peer: pid.String()})
+		fctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+		start := time.Now()
+		resp, err := n.exchange(fctx, pid, msg)
+		cancel()
+		n.History.Record(pid.String(), time.Since(start), err)
+		n.noteOutcome(pid.String(), InteractionTaskSucceeded, err)
+		n.Metrics.observeForward(capability, err)
+		if err != nil {
+			fmt.Printf("[Routing] Forwarding %q to %s failed: %v\n", capability, pid, err)
+			n.Events.AddError("forward_failed", err, map[string]string{"capability": capability, "peerId": pid.String()})
+			var pe *PeerError
+			if errors.As(err, &pe) {
+				failure = pe.ErrorPayload
+			}
+			continue
+		}
+		if resp.Type == MessageMoved {
+			// Its new ID re-announces soon enough; try the next peer
+			continue
+		}
+		fmt.Printf("[Routing] Forwarded %q task from %s to %s (hop %d)\n", capability, from, pid, msg.Hops)
+		n.Events.Add("task_forwarded", map[string]interface{}{"capability": capability, "from": from.String(), "peerId": pid.String(), "hops": msg.Hops})
+		n.EmitLifecycle(LifecycleEvent{TaskID: taskID, Stage: StageCompleted, Capability: capability, Peer: pid.String()})
+		return *resp
+	}
+	n.taskStage(taskID, StageFailed, capability, errors.New(failure.Message))
+	return n.errorMessage(failure)
+}
+
+// forwardCandidates returns the live peers for capability, ranked by the
+// node's Selection policy when it has one, and fastest first by their probed
+// latency otherwise. Peers are matched to their ERC-8004 identity through
+// the address book. Quarantined peers are candidates only when no verified
+// peer serves capability.
+func (n *AgentNode) forwardCandidates(ctx context.Context, taskID, capability string) []peer.ID {
+	routes := n.Routes.route(capability, n.Routes.clock.Now())
+	if n.Selection == nil || len(routes) < 2 {
+		ids := n.Routes.Lookup(capability)
+		n.Latencies.Sort(ids)
+		return ids
+	}
+	agents := n.agentIDs()
+	candidates := make([]AgentRef, len(routes))
+	for i, r := range routes {
+		candidates[i] = AgentRef{Recipient: Recipient{PeerID: r.PeerID}, AgentID: agents[r.PeerID], LastSeen: r.LastSeen}
+	}
+	ranked, err := n.Selection.RankCandidates(ctx, candidates, TaskContext{TaskID: taskID, Capability: capability})
+	if err != nil {
+		return nil
+	}
+	var ids []peer.ID
+	for _, r := range ranked {
+		if pid, err := peer.Decode(r.PeerID); err == nil {
+			ids = append(ids, pid)
+		}
+	}
+	return ids
+}
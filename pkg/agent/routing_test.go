@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func randomPeer(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+func TestRepeatedAnnouncementsUpdateAndExpire(t *testing.T) {
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	n := newTestNode(t)
+	n.Routes.SetClock(clock)
+
+	// Re-announcing refreshes the peer's one entry
+	pid, packet := advertisement(t, "summarize", nil)
+	for i := 0; i < 3; i++ {
+		n.handleAdvertisement(packet)
+		clock.Advance(10 * time.Second)
+	}
+	routes := n.Routes.Snapshot()
+	if len(routes) != 1 || len(routes[0].Peers) != 1 || routes[0].Peers[0].PeerID != pid.String() {
+		t.Fatalf("routes = %+v, want %s once", routes, pid)
+	}
+	if got, want := routes[0].Peers[0].LastSeen, clock.Now().Add(-10*time.Second).UnixMilli(); got != want {
+		t.Errorf("LastSeen = %d, want the last announcement at %d", got, want)
+	}
+
+	// A peer silent for the TTL is no longer routed to, and is pruned once
+	// the table next changes
+	clock.Advance(DefaultRouteTTL)
+	if got := n.Routes.Lookup("summarize"); len(got) != 0 {
+		t.Errorf("Lookup after the TTL = %v, want none", got)
+	}
+	other, packet := advertisement(t, "translate", nil)
+	n.handleAdvertisement(packet)
+	if got := n.Routes.Len(); got != 1 {
+		t.Errorf("table holds %d entries, want only %s's", got, other)
+	}
+}
+
+func TestUnknownAnnouncersAreRateLimited(t *testing.T) {
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	routes := NewRoutingTable(time.Minute)
+	routes.SetClock(clock)
+	routes.MaxNewPeers = 2
+	routes.QuarantineInterval = 20 * time.Second
+
+	verified, quarantined := randomPeer(t), randomPeer(t)
+	for _, pid := range []peer.ID{verified, quarantined} {
+		if !routes.Admit(pid) {
+			t.Fatalf("first announcement from %s was refused", pid)
+		}
+	}
+	routes.Add("summarize", verified)
+	routes.Quarantine("summarize", quarantined)
+	if routes.Admit(randomPeer(t)) {
+		t.Error("a third unknown peer was admitted within the TTL")
+	}
+
+	// Verified peers are always heard; quarantined ones once per interval
+	clock.Advance(5 * time.Second)
+	if !routes.Admit(verified) {
+		t.Error("verified peer was refused")
+	}
+	if routes.Admit(quarantined) {
+		t.Error("quarantined peer was admitted within its interval")
+	}
+	clock.Advance(15 * time.Second)
+	if !routes.Admit(quarantined) {
+		t.Error("quarantined peer was refused after its interval")
+	}
+
+	// Admissions of unknown peers age out with the TTL
+	clock.Advance(time.Minute)
+	if !routes.Admit(randomPeer(t)) {
+		t.Error("unknown peer was refused a TTL after the last admission")
+	}
+}
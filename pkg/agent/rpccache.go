@@ -0,0 +1,475 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// DefaultRPCCacheTTL is how long an answer to a call on the latest block is
+// reused: one block of Base, the default chain.
+const DefaultRPCCacheTTL = DefaultBlockTime
+
+// maxRPCCacheEntries bounds each in-memory tier; a full tier is emptied
+// rather than tracking which entry to evict.
+const maxRPCCacheEntries = 10000
+
+// DefaultImmutableSelectors are contract methods whose answer never changes,
+// so their calls are cached for good whatever block they ask about: ERC-20
+// decimals(), symbol() and name().
+var DefaultImmutableSelectors = []string{"0x313ce567", "0x95d89b41", "0x06fdde03"}
+
+// RPC cache tiers.
+const (
+	RPCCacheBlock  = "block"  // answers that never change, kept in the metadata store
+	RPCCacheLatest = "latest" // answers about the latest block, kept in memory for the TTL
+)
+
+// RPCCacheEntry is a JSON-RPC result kept for good.
+type RPCCacheEntry struct {
+	Key       string          `json:"key"` // see rpcCacheKey
+	ChainID   uint64          `json:"chainId"`
+	Contract  string          `json:"contract,omitempty"`
+	Method    string          `json:"method"`
+	Result    json.RawMessage `json:"result"`
+	CreatedAt int64           `json:"createdAt"` // unix seconds
+}
+
+// RPCCacheStats counts the requests each tier answered and passed on.
+type RPCCacheStats struct {
+	BlockHits    uint64 `json:"blockHits"`
+	BlockMisses  uint64 `json:"blockMisses"`
+	LatestHits   uint64 `json:"latestHits"`
+	LatestMisses uint64 `json:"latestMisses"`
+}
+
+// RPCCache is a read-through cache of JSON-RPC answers that sits in the
+// HTTP transport of an ERC8004Client, so every read the client makes goes
+// through it. Answers that can't change are kept for good, in the metadata
+// store when there is one: eth_call pinned to a block number or hash, calls
+// of ImmutableSelectors, and eth_getBlockByHash. Calls on the latest block
+// are kept in memory for TTL. Everything else, transactions included, goes
+// straight to the RPC, as do errors. Keys include the chain ID and the
+// contract called.
+//
+// Calls pinned to a block number are taken as final; pin a block that may
+// still be reorganised by its hash instead.
+type RPCCache struct {
+	TTL                time.Duration // for calls on the latest block; DefaultRPCCacheTTL if 0
+	ImmutableSelectors []string      // 4-byte selectors, 0x-prefixed hex; DefaultImmutableSelectors when built
+	Clock              Clock         // nil means the SystemClock
+
+	store MetadataStore // nil keeps the block tier in memory
+
+	mu      sync.Mutex
+	chainID map[string]uint64 // by RPC URL
+	block   map[string]json.RawMessage
+	latest  map[string]rpcCached
+
+	blockHits, blockMisses, latestHits, latestMisses atomic.Uint64
+}
+
+type rpcCached struct {
+	result  json.RawMessage
+	expires time.Time
+}
+
+// NewRPCCache keeps answers that can't change in store, or in memory if
+// store is nil.
+func NewRPCCache(store MetadataStore) *RPCCache {
+	return &RPCCache{
+		ImmutableSelectors: DefaultImmutableSelectors,
+		store:              store,
+		chainID:            make(map[string]uint64),
+		block:              make(map[string]json.RawMessage),
+		latest:             make(map[string]rpcCached),
+	}
+}
+
+// Stats returns how many requests each tier answered and missed. A nil
+// *RPCCache has none.
+func (c *RPCCache) Stats() RPCCacheStats {
+	if c == nil {
+		return RPCCacheStats{}
+	}
+	return RPCCacheStats{
+		BlockHits:    c.blockHits.Load(),
+		BlockMisses:  c.blockMisses.Load(),
+		LatestHits:   c.latestHits.Load(),
+		LatestMisses: c.latestMisses.Load(),
+	}
+}
+
+// Transport returns an http.RoundTripper answering from the cache and
+// sending misses through next, or http.DefaultTransport if next is nil.
+func (c *RPCCache) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &rpcCacheTransport{cache: c, next: next}
+}
+
+func (c *RPCCache) now() time.Time {
+	if c.Clock == nil {
+		return SystemClock.Now()
+	}
+	return c.Clock.Now()
+}
+
+// rpcRequest is a single JSON-RPC request. Batches aren't cached.
+type rpcRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// tier returns which tier caches req's answer, and the contract it calls,
+// or "" if it isn't cached.
+func (c *RPCCache) tier(req rpcRequest) (tier, contract string) {
+	switch req.Method {
+	case "eth_getBlockByHash":
+		return RPCCacheBlock, ""
+	case "eth_call":
+	default:
+		return "", ""
+	}
+	if len(req.Params) == 0 {
+		return "", ""
+	}
+	var call struct {
+		To    string `json:"to"`
+		Data  string `json:"data"`
+		Input string `json:"input"`
+	}
+	if json.Unmarshal(req.Params[0], &call) != nil || call.To == "" {
+		return "", ""
+	}
+	contract = strings.ToLower(call.To)
+	data := call.Input
+	if data == "" {
+		data = call.Data
+	}
+	for _, sel := range c.ImmutableSelectors {
+		if len(data) >= 10 && strings.EqualFold(data[:10], sel) {
+			return RPCCacheBlock, contract
+		}
+	}
+	switch {
+	case len(req.Params) < 2 || isLatestTag(req.Params[1]):
+		return RPCCacheLatest, contract
+	case pinnedBlock(req.Params[1]):
+		return RPCCacheBlock, contract
+	}
+	return "", ""
+}
+
+// pinnedBlock reports whether a block parameter names one block for good:
+// a number, or a hash as EIP-1898 allows.
+func pinnedBlock(raw json.RawMessage) bool {
+	var tag string
+	if json.Unmarshal(raw, &tag) == nil {
+		_, err := hexutil.DecodeUint64(tag)
+		return err == nil
+	}
+	var ref struct {
+		BlockHash   string `json:"blockHash"`
+		BlockNumber string `json:"blockNumber"`
+	}
+	if json.Unmarshal(raw, &ref) != nil {
+		return false
+	}
+	if ref.BlockHash != "" {
+		return true
+	}
+	_, err := hexutil.DecodeUint64(ref.BlockNumber)
+	return err == nil
+}
+
+func isLatestTag(raw json.RawMessage) bool {
+	var tag string
+	return json.Unmarshal(raw, &tag) == nil && tag == "latest"
+}
+
+// rpcCacheKey is the SHA-256 of the chain, contract, method and parameters.
+func rpcCacheKey(chainID uint64, contract string, req rpcRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%s", chainID, contract, req.Method)
+	for _, p := range req.Params {
+		h.Write([]byte{0})
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookup returns the cached answer under key in tier.
+func (c *RPCCache) lookup(tier, key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tier == RPCCacheLatest {
+		e, ok := c.latest[key]
+		if !ok || !c.now().Before(e.expires) {
+			return nil, false
+		}
+		return e.result, true
+	}
+	if result, ok := c.block[key]; ok {
+		return result, true
+	}
+	if c.store == nil {
+		return nil, false
+	}
+	e, err := c.store.GetRPCResult(key)
+	if err != nil {
+		fmt.Printf("[RPC] Failed to read the RPC cache: %v\n", err)
+	}
+	if e == nil {
+		return nil, false
+	}
+	c.keepBlock(key, e.Result)
+	return e.Result, true
+}
+
+// keep caches result under key in tier.
+func (c *RPCCache) keep(tier, key string, chainID uint64, contract, method string, result json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tier == RPCCacheLatest {
+		if len(c.latest) >= maxRPCCacheEntries {
+			c.latest = make(map[string]rpcCached)
+		}
+		ttl := c.TTL
+		if ttl <= 0 {
+			ttl = DefaultRPCCacheTTL
+		}
+		c.latest[key] = rpcCached{result: result, expires: c.now().Add(ttl)}
+		return
+	}
+	c.keepBlock(key, result)
+	if c.store != nil {
+		err := c.store.SaveRPCResult(RPCCacheEntry{Key: key, ChainID: chainID, Contract: contract, Method: method, Result: result, CreatedAt: c.now().Unix()})
+		if err != nil {
+			fmt.Printf("[RPC] Failed to save to the RPC cache: %v\n", err)
+		}
+	}
+}
+
+// keepBlock keeps a block tier answer in memory. c.mu must be held.
+func (c *RPCCache) keepBlock(key string, result json.RawMessage) {
+	if len(c.block) >= maxRPCCacheEntries {
+		c.block = make(map[string]json.RawMessage)
+	}
+	c.block[key] = result
+}
+
+func (c *RPCCache) count(tier string, hit bool) {
+	switch {
+	case tier == RPCCacheBlock && hit:
+		c.blockHits.Add(1)
+	case tier == RPCCacheBlock:
+		c.blockMisses.Add(1)
+	case hit:
+		c.latestHits.Add(1)
+	default:
+		c.latestMisses.Add(1)
+	}
+}
+
+// rpcCacheTransport answers JSON-RPC requests over HTTP from an RPCCache.
+type rpcCacheTransport struct {
+	cache *RPCCache
+	next  http.RoundTripper
+}
+
+func (t *rpcCacheTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return t.next.RoundTrip(r)
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req rpcRequest
+	if json.Unmarshal(body, &req) != nil {
+		return t.next.RoundTrip(r)
+	}
+	tier, contract := t.cache.tier(req)
+	if tier == "" {
+		return t.next.RoundTrip(r)
+	}
+	chainID, err := t.chainID(r)
+	if err != nil {
+		return t.next.RoundTrip(r)
+	}
+	key := rpcCacheKey(chainID, contract, req)
+	if result, ok := t.cache.lookup(tier, key); ok {
+		t.cache.count(tier, true)
+		return rpcResponse(r, req.ID, result)
+	}
+	t.cache.count(tier, false)
+
+	resp, err := t.next.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &answer) == nil && answer.Error == nil && len(answer.Result) > 0 && string(answer.Result) != "null" {
+		t.cache.keep(tier, key, chainID, contract, req.Method, answer.Result)
+	}
+	return resp, nil
+}
+
+// chainID returns the chain the RPC at r's URL serves, asking it once.
+func (t *rpcCacheTransport) chainID(r *http.Request) (uint64, error) {
+	url := r.URL.String()
+	t.cache.mu.Lock()
+	id, ok := t.cache.chainID[url]
+	t.cache.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	ask, err := http.NewRequestWithContext(r.Context(), http.MethodPost, url, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`))
+	if err != nil {
+		return 0, err
+	}
+	ask.Header = r.Header.Clone()
+	ask.Header.Del("Content-Length")
+	resp, err := t.next.RoundTrip(ask)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		Result hexutil.Uint64  `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return 0, err
+	}
+	if answer.Error != nil {
+		return 0, fmt.Errorf("eth_chainId: %s", answer.Error)
+	}
+	t.cache.mu.Lock()
+	t.cache.chainID[url] = uint64(answer.Result)
+	t.cache.mu.Unlock()
+	return uint64(answer.Result), nil
+}
+
+// rpcResponse answers r with result as if the RPC had.
+func rpcResponse(r *http.Request, id, result json.RawMessage) (*http.Response, error) {
+	data, err := json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result"`
+	}{"2.0", id, result})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       r,
+	}, nil
+}
+
+// UseRPCCache sends the client's reads through cache. It redials the RPC,
+// which must be an HTTP endpoint: websocket and IPC connections don't go
+// through an HTTP transport.
+func (c *ERC8004Client) UseRPCCache(cache *RPCCache) error {
+	if keepsConnection(c.rpcURL) {
+		return fmt.Errorf("the RPC cache needs an HTTP endpoint, not %s", c.rpcURL)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rc, err := rpc.DialOptions(ctx, c.rpcURL, rpc.WithHTTPClient(&http.Client{Transport: cache.Transport(nil)}))
+	if err != nil {
+		return err
+	}
+	client := ethclient.NewClient(rc)
+
+	c.connMu.Lock()
+	old := c.client
+	if c.backend == TxBackend(old) {
+		c.backend = client
+	}
+	c.client = client
+	c.connGen++
+	c.rpcCache = cache
+	c.connMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// RPCCache returns the cache the client reads through, or nil.
+func (c *ERC8004Client) RPCCache() *RPCCache {
+	if c == nil {
+		return nil
+	}
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.rpcCache
+}
+
+// SaveRPCResult keeps an RPC answer for good.
+func (s *sqlStore) SaveRPCResult(e RPCCacheEntry) error {
+	_, err := s.exec(`
+		INSERT INTO rpc_cache (cache_key, chain_id, contract, method, result, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(cache_key) DO NOTHING`,
+		e.Key, int64(e.ChainID), e.Contract, e.Method, string(e.Result), e.CreatedAt)
+	return err
+}
+
+// GetRPCResult returns the RPC answer kept under key, or nil if there is
+// none.
+func (s *sqlStore) GetRPCResult(key string) (*RPCCacheEntry, error) {
+	var e RPCCacheEntry
+	var chainID int64
+	var result string
+	err := s.queryRow(`
+		SELECT cache_key, chain_id, contract, method, result, created_at
+		FROM rpc_cache WHERE cache_key = ?`, key).
+		Scan(&e.Key, &chainID, &e.Contract, &e.Method, &result, &e.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.ChainID, e.Result = uint64(chainID), json.RawMessage(result)
+	return &e, nil
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// countingChain answers eth_call with the called contract's address and
+// counts the calls per contract; calls to reverting revert.
+type countingChain struct {
+	mu        sync.Mutex
+	calls     map[string]int
+	reverting common.Address
+}
+
+func (c *countingChain) handle(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch method {
+	case "eth_chainId":
+		return "0x14a34", nil
+	case "eth_call":
+		var call struct {
+			To common.Address `json:"to"`
+		}
+		json.Unmarshal(params[0], &call)
+		c.calls[call.To.Hex()]++
+		if call.To == c.reverting {
+			return nil, &rpcError{Code: 3, Message: "execution reverted"}
+		}
+		return common.BytesToHash(call.To.Bytes()).Hex(), nil
+	}
+	return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+}
+
+func (c *countingChain) count(to common.Address) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[to.Hex()]
+}
+
+func TestImmutableCallsAreServedFromCacheAfterARestart(t *testing.T) {
+	chain := &countingChain{calls: map[string]int{}}
+	url := newFakeRPC(t, chain.handle)
+	store := newTestStore(t)
+	token := common.HexToAddress("0x00000000000000000000000000000000000000d1")
+	registry := common.HexToAddress("0x00000000000000000000000000000000000000d2")
+	decimals := common.FromHex(DefaultImmutableSelectors[0])
+
+	// start connects a client reading through a fresh cache on store, as a
+	// node does when it starts
+	start := func() (*ERC8004Client, *RPCCache) {
+		client := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+		t.Cleanup(client.Close)
+		cache := NewRPCCache(store)
+		if err := client.UseRPCCache(cache); err != nil {
+			t.Fatal(err)
+		}
+		return client, cache
+	}
+	read := func(client *ERC8004Client) {
+		t.Helper()
+		if res, err := client.call(token, decimals, BlockLatest); err != nil || common.BytesToAddress(res) != token {
+			t.Fatalf("decimals() = %x, %v", res, err)
+		}
+		// Any call pinned to a block is as good as immutable
+		err := client.read(context.Background(), func(_ *ethclient.Client, b TxBackend) error {
+			_, err := b.CallContract(context.Background(), ethereum.CallMsg{To: &registry, Data: []byte{1, 2, 3, 4}}, big.NewInt(5))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, _ := start()
+	read(client)
+	read(client)
+	if chain.count(token) != 1 || chain.count(registry) != 1 {
+		t.Fatalf("RPC saw %d and %d calls, want each asked once", chain.count(token), chain.count(registry))
+	}
+
+	client, cache := start()
+	read(client)
+	if chain.count(token) != 1 || chain.count(registry) != 1 {
+		t.Errorf("after a restart the RPC saw %d and %d calls, want the cached answers used", chain.count(token), chain.count(registry))
+	}
+	if s := cache.Stats(); s.BlockHits != 2 || s.BlockMisses != 0 {
+		t.Errorf("stats = %+v, want 2 block hits", s)
+	}
+
+	// The contract is part of the key
+	other := common.HexToAddress("0x00000000000000000000000000000000000000d3")
+	if res, err := client.call(other, decimals, BlockLatest); err != nil || common.BytesToAddress(res) != other {
+		t.Errorf("decimals() of another token = %x, %v", res, err)
+	}
+}
+
+func TestLatestCallsAreCachedBriefly(t *testing.T) {
+	chain := &countingChain{calls: map[string]int{}, reverting: common.HexToAddress("0x00000000000000000000000000000000000000e9")}
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	client := NewERC8004Client(newFakeRPC(t, chain.handle), zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	t.Cleanup(client.Close)
+	cache := NewRPCCache(nil)
+	cache.Clock, cache.TTL = clock, 2*time.Second
+	if err := client.UseRPCCache(cache); err != nil {
+		t.Fatal(err)
+	}
+	registry := common.HexToAddress("0x00000000000000000000000000000000000000d2")
+	wallet := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+
+	client.call(registry, wallet, BlockLatest)
+	client.call(registry, wallet, BlockLatest)
+	if got := chain.count(registry); got != 1 {
+		t.Errorf("RPC saw %d calls within the TTL, want 1", got)
+	}
+	clock.Advance(2 * time.Second)
+	client.call(registry, wallet, BlockLatest)
+	if got := chain.count(registry); got != 2 {
+		t.Errorf("RPC saw %d calls after the TTL, want 2", got)
+	}
+
+	// Errors aren't cached
+	client.call(chain.reverting, wallet, BlockLatest)
+	if _, err := client.call(chain.reverting, wallet, BlockLatest); err == nil || chain.count(chain.reverting) != 2 {
+		t.Errorf("reverting call asked %d times (%v), want every time", chain.count(chain.reverting), err)
+	}
+	if s := cache.Stats(); s.LatestHits != 1 || s.LatestMisses != 4 {
+		t.Errorf("stats = %+v, want 1 hit and 4 misses", s)
+	}
+}
@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RPCReadPool limits used unless configured otherwise.
+const (
+	DefaultRPCReads            = 16
+	DefaultInteractiveReserved = 2
+)
+
+// ReadLane is the priority of an RPC read waiting for an RPCReadPool.
+type ReadLane int
+
+const (
+	// ReadBackground is for reads nobody is waiting on: ranking
+	// counterparties, vetting gossip, backfills. It is the default.
+	ReadBackground ReadLane = iota
+	// ReadInteractive is for reads answering a person or a probe, such as
+	// the status and readiness endpoints.
+	ReadInteractive
+)
+
+func (l ReadLane) String() string {
+	if l == ReadInteractive {
+		return "interactive"
+	}
+	return "background"
+}
+
+type readLaneKey struct{}
+
+// WithReadLane returns a context whose RPC reads wait in lane.
+func WithReadLane(ctx context.Context, lane ReadLane) context.Context {
+	return context.WithValue(ctx, readLaneKey{}, lane)
+}
+
+func readLane(ctx context.Context) ReadLane {
+	lane, _ := ctx.Value(readLaneKey{}).(ReadLane)
+	return lane
+}
+
+// RPCReadPool caps the RPC reads in flight at once across every client
+// sharing it, so a fan-out of contract calls queues instead of tripping the
+// endpoint's rate limit. Waiting interactive reads go before background
+// ones, and background reads never take the last reserved slots, so a burst
+// of background reads can't hold up an interactive one for longer than a
+// single read takes.
+type RPCReadPool struct {
+	limit    int
+	reserved int
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  [2][]*readWaiter // by lane, oldest first
+	onWait   func(lane ReadLane, d time.Duration)
+}
+
+type readWaiter struct {
+	ready   chan struct{} // closed once the read holds a slot
+	granted bool
+}
+
+// NewRPCReadPool allows limit reads in flight at once, the last reserved of
+// them for interactive reads only. A non-positive limit takes
+// DefaultRPCReads; reserved is capped so background reads get at least one.
+func NewRPCReadPool(limit, reserved int) *RPCReadPool {
+	if limit <= 0 {
+		limit = DefaultRPCReads
+	}
+	reserved = min(max(reserved, 0), limit-1)
+	return &RPCReadPool{limit: limit, reserved: reserved}
+}
+
+// Limit returns the most reads the pool lets run at once.
+func (p *RPCReadPool) Limit() int {
+	return p.limit
+}
+
+// InFlight returns the reads running now.
+func (p *RPCReadPool) InFlight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inFlight
+}
+
+// Waiting returns the reads queued in lane.
+func (p *RPCReadPool) Waiting(lane ReadLane) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.waiting[lane])
+}
+
+// fits reports whether a read in lane may start now. Called with p.mu held.
+func (p *RPCReadPool) fits(lane ReadLane) bool {
+	if lane == ReadInteractive {
+		return p.inFlight < p.limit
+	}
+	return p.inFlight < p.limit-p.reserved && len(p.waiting[ReadInteractive]) == 0
+}
+
+// acquire waits for a slot for a read in ctx's lane and returns the func that
+// gives it back. It fails only if ctx ends first.
+func (p *RPCReadPool) acquire(ctx context.Context) (func(), error) {
+	lane := readLane(ctx)
+	start := time.Now()
+	p.mu.Lock()
+	if len(p.waiting[lane]) == 0 && p.fits(lane) {
+		p.inFlight++
+		p.mu.Unlock()
+		p.observe(lane, 0)
+		return p.release, nil
+	}
+	w := &readWaiter{ready: make(chan struct{})}
+	p.waiting[lane] = append(p.waiting[lane], w)
+	p.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		p.observe(lane, time.Since(start))
+		return p.release, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if w.granted {
+			// The slot came as the context ended; pass it on
+			p.inFlight--
+			p.dispatch()
+		} else {
+			p.remove(lane, w)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (p *RPCReadPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight--
+	p.dispatch()
+}
+
+// dispatch starts the waiting reads that fit, interactive ones first. Called
+// with p.mu held.
+func (p *RPCReadPool) dispatch() {
+	for _, lane := range []ReadLane{ReadInteractive, ReadBackground} {
+		for len(p.waiting[lane]) > 0 && p.fits(lane) {
+			w := p.waiting[lane][0]
+			p.waiting[lane] = p.waiting[lane][1:]
+			p.inFlight++
+			w.granted = true
+			close(w.ready)
+		}
+	}
+}
+
+func (p *RPCReadPool) remove(lane ReadLane, w *readWaiter) {
+	for i, q := range p.waiting[lane] {
+		if q == w {
+			p.waiting[lane] = append(p.waiting[lane][:i], p.waiting[lane][i+1:]...)
+			break
+		}
+	}
+	// A background read may have been held back only by this one
+	p.dispatch()
+}
+
+func (p *RPCReadPool) observe(lane ReadLane, d time.Duration) {
+	p.mu.Lock()
+	onWait := p.onWait
+	p.mu.Unlock()
+	if onWait != nil {
+		onWait(lane, d)
+	}
+}
+
+// SetReadPool makes the client's reads, and so those of every contract
+// wrapper built on it, take a slot of p while they run. Clients may share a
+// pool. nil lets reads run unlimited.
+func (c *ERC8004Client) SetReadPool(p *RPCReadPool) {
+	c.readPool = p
+}
+
+// ReadPool returns the pool set with SetReadPool, if any.
+func (c *ERC8004Client) ReadPool() *RPCReadPool {
+	if c == nil {
+		return nil
+	}
+	return c.readPool
+}
+
+// pooled runs fn once it holds a slot of the client's read pool.
+func (c *ERC8004Client) pooled(ctx context.Context, fn func() error) error {
+	if c.readPool == nil {
+		return fn()
+	}
+	release, err := c.readPool.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn()
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// busyChain answers every read after a pause, counting how many it is
+// answering at once, and how many of those aren't readiness probes.
+type busyChain struct {
+	mu                  sync.Mutex
+	now                 map[string]int
+	total, peak, bgPeak int
+}
+
+func (c *busyChain) handle(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	c.mu.Lock()
+	c.now[method]++
+	c.total++
+	c.peak = max(c.peak, c.total)
+	c.bgPeak = max(c.bgPeak, c.total-c.now["eth_blockNumber"])
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.mu.Lock()
+	c.now[method]--
+	c.total--
+	c.mu.Unlock()
+
+	switch method {
+	case "eth_call":
+		return common.Hash{}.Hex(), nil
+	case "eth_getBalance", "eth_blockNumber":
+		return "0x1", nil
+	}
+	return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+}
+
+func TestReadPoolCapsABurstAcrossClients(t *testing.T) {
+	chain := &busyChain{now: map[string]int{}}
+	url := newFakeRPC(t, chain.handle)
+	pool := NewRPCReadPool(8, 2)
+	var clients []*ERC8004Client
+	for i := 0; i < 2; i++ {
+		c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+		t.Cleanup(c.Close)
+		c.SetReadPool(pool)
+		clients = append(clients, c)
+	}
+	var waits [2]atomic.Int32
+	pool.onWait = func(lane ReadLane, d time.Duration) {
+		if d > 0 {
+			waits[lane].Add(1)
+		}
+	}
+
+	// 200 reads at once: contract calls and balances in the background, and
+	// readiness probes
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	interactive := WithReadLane(context.Background(), ReadInteractive)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			switch i % 4 {
+			case 0:
+				_, err = clients[0].call(common.Address{1}, []byte{1, 2, 3, 4}, BlockLatest)
+			case 1:
+				_, err = clients[1].Balance(common.Address{2})
+			default:
+				_, err = clients[i%2].HeadBlock(interactive)
+			}
+			if err != nil {
+				failed.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if failed.Load() != 0 {
+		t.Fatalf("%d reads failed", failed.Load())
+	}
+	if chain.peak > 8 {
+		t.Errorf("the RPC answered %d reads at once, want at most the pool's 8", chain.peak)
+	}
+	if chain.bgPeak > 6 {
+		t.Errorf("%d background reads ran at once, want at most 6 with 2 slots reserved", chain.bgPeak)
+	}
+	if waits[ReadBackground].Load() == 0 || waits[ReadInteractive].Load() == 0 {
+		t.Errorf("reads waited %d times in the background lane and %d in the interactive one, want both to queue", waits[ReadBackground].Load(), waits[ReadInteractive].Load())
+	}
+	if pool.InFlight() != 0 {
+		t.Errorf("%d slots still held", pool.InFlight())
+	}
+}
+
+func TestInteractiveReadsGoFirst(t *testing.T) {
+	pool := NewRPCReadPool(2, 1)
+	background := context.Background()
+	interactive := WithReadLane(background, ReadInteractive)
+
+	release, _ := pool.acquire(background)
+	// The last slot is kept for interactive reads
+	started := make(chan ReadLane, 2)
+	go func() {
+		r, _ := pool.acquire(background)
+		started <- ReadBackground
+		r()
+	}()
+	for pool.Waiting(ReadBackground) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	releaseProbe, err := pool.acquire(interactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With both slots taken, an interactive read queued after the background
+	// one is let in before it
+	go func() {
+		r, _ := pool.acquire(interactive)
+		started <- ReadInteractive
+		r()
+	}()
+	for pool.Waiting(ReadInteractive) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	releaseProbe()
+	if lane := <-started; lane != ReadInteractive {
+		t.Errorf("the %s read went first", lane)
+	}
+	release()
+	if lane := <-started; lane != ReadBackground {
+		t.Errorf("the %s read went second", lane)
+	}
+
+	// A read whose context ends stops waiting
+	hold, _ := pool.acquire(interactive)
+	hold2, _ := pool.acquire(interactive)
+	ctx, cancel := context.WithTimeout(interactive, 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquire on a full pool = %v, want the deadline", err)
+	}
+	hold()
+	hold2()
+	if pool.InFlight() != 0 || pool.Waiting(ReadInteractive) != 0 {
+		t.Errorf("%d in flight and %d waiting, want none", pool.InFlight(), pool.Waiting(ReadInteractive))
+	}
+}
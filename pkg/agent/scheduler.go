@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultScheduleAging is how long a queued task waits before it outranks
+// any task just submitted, however urgent or well paid.
+const DefaultScheduleAging = time.Minute
+
+// urgencyHorizon is the slack at which a task with a deadline is half as
+// urgent as one that must start now.
+const urgencyHorizon = time.Minute
+
+// ErrDeadlinePassed fails a queued task whose deadline passed before it ran.
+var ErrDeadlinePassed = errors.New("deadline passed before the task ran")
+
+// ScheduleWeights weigh the inputs of a queued task's score. Only their
+// ratios matter.
+type ScheduleWeights struct {
+	Deadline float64 `json:"deadline"` // urgency: how little slack is left before the deadline
+	Reward   float64 `json:"reward"`   // the reward, against the best paid task queued
+	Duration float64 `json:"duration"` // shortness: the estimated run, against the shortest queued
+}
+
+// DefaultScheduleWeights put deadlines first.
+var DefaultScheduleWeights = ScheduleWeights{Deadline: 0.6, Reward: 0.25, Duration: 0.15}
+
+// ParseScheduleWeights reads weights written as "deadline=2,reward=1".
+// Weights left out are 0.
+func ParseScheduleWeights(s string) (ScheduleWeights, error) {
+	var w ScheduleWeights
+	fields := map[string]*float64{"deadline": &w.Deadline, "reward": &w.Reward, "duration": &w.Duration}
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		f, known := fields[name]
+		if !ok || !known {
+			return w, fmt.Errorf("invalid weight %q: want name=value with name one of deadline, reward, duration", part)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v < 0 {
+			return w, fmt.Errorf("invalid weight %q: want a non-negative number", part)
+		}
+		*f = v
+	}
+	return w, nil
+}
+
+// TaskScheduler queues the tasks submitted to the node's API and hands its
+// worker the one with the highest priority, rather than the oldest. A task's
+// priority is its weighted score, 0 to 1, plus how long it has waited over
+// Aging, so a task that scores low still runs once it has waited long
+// enough. Ties go to the task queued first.
+//
+// Rewards are in wei of the chain's native token, the only one tasks are
+// paid in. Estimated durations are the average of the capability's recent
+// runs, as the MetadataStore records them; a capability with none has an
+// unknown duration, which scores in the middle.
+type TaskScheduler struct {
+	Weights ScheduleWeights
+	Aging   time.Duration // 0 means DefaultScheduleAging
+	Clock   Clock         // nil means SystemClock
+
+	limit int
+	mu    sync.Mutex
+	queue []localTask   // in submission order
+	ready chan struct{} // signalled when a task is pushed
+}
+
+// NewTaskScheduler queues up to limit tasks; a non-positive limit takes
+// DefaultLocalQueueSize.
+func NewTaskScheduler(limit int) *TaskScheduler {
+	if limit <= 0 {
+		limit = DefaultLocalQueueSize
+	}
+	return &TaskScheduler{
+		Weights: DefaultScheduleWeights,
+		Aging:   DefaultScheduleAging,
+		limit:   limit,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+func (s *TaskScheduler) now() time.Time {
+	if s.Clock == nil {
+		return SystemClock.Now()
+	}
+	return s.Clock.Now()
+}
+
+// push queues a task, stamping when it was queued, or fails with
+// ErrQueueFull.
+func (s *TaskScheduler) push(task localTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) >= s.limit {
+		return ErrQueueFull
+	}
+	task.queued = s.now()
+	s.queue = append(s.queue, task)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop waits for a task and takes the one with the highest priority. It
+// reports false once ctx ends.
+func (s *TaskScheduler) pop(ctx context.Context) (localTask, bool) {
+	for {
+		if task, ok := s.next(); ok {
+			return task, true
+		}
+		select {
+		case <-ctx.Done():
+			return localTask{}, false
+		case <-s.ready:
+		}
+	}
+}
+
+// next takes the task with the highest priority, if any is queued.
+func (s *TaskScheduler) next() (localTask, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return localTask{}, false
+	}
+	priorities := s.priorities(s.now())
+	best := 0
+	for i, p := range priorities {
+		if p > priorities[best] {
+			best = i
+		}
+	}
+	task := s.queue[best]
+	s.queue = append(s.queue[:best], s.queue[best+1:]...)
+	return task, true
+}
+
+// Priorities returns the priority of each queued task, by task ID. A nil
+// *TaskScheduler has none.
+func (s *TaskScheduler) Priorities() map[string]float64 {
+	byID := make(map[string]float64)
+	if s == nil {
+		return byID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.priorities(s.now()) {
+		byID[s.queue[i].record.ID] = p
+	}
+	return byID
+}
+
+// priorities scores the queue at now, in its order. Rewards and durations
+// are scored against the rest of the queue: the best paid task and the
+// shortest score 1, one paid half as much or taking twice as long 0.5.
+func (s *TaskScheduler) priorities(now time.Time) []float64 {
+	var best *big.Int
+	var shortest time.Duration
+	for _, t := range s.queue {
+		if t.reward != nil && (best == nil || t.reward.Cmp(best) > 0) {
+			best = t.reward
+		}
+		if t.estimate > 0 && (shortest == 0 || t.estimate < shortest) {
+			shortest = t.estimate
+		}
+	}
+
+	w := s.Weights
+	total := w.Deadline + w.Reward + w.Duration
+	aging := s.Aging
+	if aging <= 0 {
+		aging = DefaultScheduleAging
+	}
+	priorities := make([]float64, len(s.queue))
+	for i, t := range s.queue {
+		var urgency, reward float64
+		shortness := 0.5
+		if !t.deadline.IsZero() {
+			slack := t.deadline.Sub(now) - t.estimate
+			urgency = float64(urgencyHorizon) / float64(urgencyHorizon+max(slack, 0))
+		}
+		if t.reward != nil && best != nil && best.Sign() > 0 {
+			reward, _ = new(big.Float).Quo(new(big.Float).SetInt(t.reward), new(big.Float).SetInt(best)).Float64()
+		}
+		if t.estimate > 0 {
+			shortness = float64(shortest) / float64(t.estimate)
+		}
+		var score float64
+		if total > 0 {
+			score = (w.Deadline*urgency + w.Reward*reward + w.Duration*shortness) / total
+		}
+		priorities[i] = score + float64(max(now.Sub(t.queued), 0))/float64(aging)
+	}
+	return priorities
+}
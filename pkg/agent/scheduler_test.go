@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+)
+
+// ether is n ether in wei.
+func ether(n int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(n), big.NewInt(1e18))
+}
+
+func queuedTask(id string, estimate time.Duration, reward *big.Int, deadline time.Time) localTask {
+	return localTask{record: TaskRecord{ID: id}, estimate: estimate, reward: reward, deadline: deadline}
+}
+
+func TestSchedulerMeetsADeadlineFIFOMisses(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	start := clock.Now()
+	// Three well paid batch jobs are queued before an urgent one that pays
+	// less; each takes 2s
+	tasks := []localTask{
+		queuedTask("batch-1", 2*time.Second, ether(1), time.Time{}),
+		queuedTask("batch-2", 2*time.Second, ether(1), time.Time{}),
+		queuedTask("batch-3", 2*time.Second, ether(1), time.Time{}),
+		queuedTask("urgent", 2*time.Second, big.NewInt(1e17), start.Add(5*time.Second)),
+	}
+
+	// Run in order, the urgent task finishes at 8s
+	var finished time.Duration
+	for _, task := range tasks {
+		finished += task.estimate
+		if task.record.ID == "urgent" && !start.Add(finished).After(task.deadline) {
+			t.Fatal("FIFO met the deadline; the queue doesn't test anything")
+		}
+	}
+
+	s := NewTaskScheduler(0)
+	s.Clock = clock
+	for _, task := range tasks {
+		if err := s.push(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := s.Priorities(); p["urgent"] <= p["batch-1"] {
+		t.Errorf("priorities %v, want urgent first", p)
+	}
+	var order []string
+	for {
+		task, ok := s.next()
+		if !ok {
+			break
+		}
+		clock.Advance(task.estimate)
+		if !task.deadline.IsZero() && clock.Now().After(task.deadline) {
+			t.Errorf("%s finished at %s, after its deadline", task.record.ID, clock.Now().Sub(start))
+		}
+		order = append(order, task.record.ID)
+	}
+	if got := strings.Join(order, ","); got != "urgent,batch-1,batch-2,batch-3" {
+		t.Errorf("ran %s, want the urgent task first, then the rest in order", got)
+	}
+}
+
+func TestSchedulerRunsLowPriorityTasksEventually(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1700000000, 0))
+	s := NewTaskScheduler(0)
+	s.Clock = clock
+	s.push(queuedTask("unpaid", 10*time.Second, nil, time.Time{}))
+
+	// Better tasks keep arriving, one a second, as fast as they are run
+	for i := 0; i < 120; i++ {
+		s.push(queuedTask("paid", time.Second, ether(1), time.Time{}))
+		task, _ := s.next()
+		if task.record.ID == "unpaid" {
+			if i == 0 {
+				t.Fatal("the unpaid task ran before any paid one")
+			}
+			return
+		}
+		clock.Advance(time.Second)
+	}
+	t.Fatal("the unpaid task starved")
+}
+
+func TestLocalTasksAreEstimatedFromTheirHistory(t *testing.T) {
+	n := newTestNode(t)
+	n.ResultsDir = t.TempDir()
+	if err := n.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := n.Store.EstimateTaskRun("summarize"); ok || err != nil {
+		t.Fatalf("estimate with no runs = %v, %v", ok, err)
+	}
+	n.Store.RecordTaskRun("summarize", 10*time.Millisecond)
+	n.Store.RecordTaskRun("summarize", 30*time.Millisecond)
+	if d, ok, err := n.Store.EstimateTaskRun("summarize"); !ok || err != nil || d != 20*time.Millisecond {
+		t.Errorf("estimate = %s, %v, %v, want the average of 20ms", d, ok, err)
+	}
+
+	// A task whose deadline has passed fails rather than runs
+	record, err := n.SubmitTask(TaskSpec{
+		Capability: "summarize",
+		Payload:    map[string]interface{}{"text": "hello"},
+		Deadline:   time.Now().Add(-time.Second).Unix(),
+		Reward:     "1000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Amount != "1000" {
+		t.Errorf("recorded amount %s, want the reward", record.Amount)
+	}
+	var st *LocalTaskStatus
+	for wait := time.Now().Add(5 * time.Second); time.Now().Before(wait); time.Sleep(10 * time.Millisecond) {
+		if st, err = n.Task(record.ID); err != nil || st.Status != TaskStatusReceived {
+			break
+		}
+	}
+	if err != nil || st.Status != TaskStatusFailed || st.Deadline != record.Deadline {
+		t.Fatalf("task = %+v, %v, want failed with its deadline", st, err)
+	}
+	raw, _ := os.ReadFile(st.Result)
+	if !strings.Contains(string(raw), ErrDeadlinePassed.Error()) {
+		t.Errorf("result = %s, want the deadline error", raw)
+	}
+
+	if _, err := n.SubmitTask(TaskSpec{Capability: "summarize", Payload: map[string]interface{}{"text": "hi"}, Reward: "lots"}); err == nil {
+		t.Error("took a reward that isn't an amount of wei")
+	}
+}
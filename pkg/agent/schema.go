@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// taskSchema is a compiled JSON Schema for task payloads. Only the subset of
+// keywords a payload contract needs is supported; anything else fails to
+// compile, so a typo can't silently disable validation.
+type taskSchema struct {
+	types      []string
+	properties map[string]*taskSchema
+	required   []string
+	additional *bool
+	items      *taskSchema
+	enum       []string // JSON encodings
+	minimum    *float64
+	maximum    *float64
+	minLength  *int
+	maxLength  *int
+	pattern    *regexp.Regexp
+}
+
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// Annotation keywords, accepted and ignored.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "title": true, "description": true,
+	"default": true, "examples": true, "$comment": true,
+}
+
+// schemaError is a compile error at a line of the manifest.
+type schemaError struct {
+	line int
+	msg  string
+}
+
+func (e *schemaError) Error() string { return e.msg }
+
+func schemaErrorf(node *yaml.Node, format string, args ...interface{}) error {
+	return &schemaError{line: node.Line, msg: fmt.Sprintf(format, args...)}
+}
+
+// compileSchema compiles a schema written as YAML.
+func compileSchema(node *yaml.Node) (*taskSchema, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, schemaErrorf(node, "schema must be a mapping")
+	}
+	s := &taskSchema{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+		var err error
+		switch key.Value {
+		case "type":
+			s.types, err = schemaTypeList(val)
+		case "properties":
+			if val.Kind != yaml.MappingNode {
+				return nil, schemaErrorf(val, "properties must be a mapping")
+			}
+			s.properties = map[string]*taskSchema{}
+			for j := 0; j+1 < len(val.Content); j += 2 {
+				prop, err := compileSchema(val.Content[j+1])
+				if err != nil {
+					return nil, err
+				}
+				s.properties[val.Content[j].Value] = prop
+			}
+		case "required":
+			err = val.Decode(&s.required)
+		case "additionalProperties":
+			var b bool
+			if err = val.Decode(&b); err == nil {
+				s.additional = &b
+			}
+		case "items":
+			s.items, err = compileSchema(val)
+		case "enum":
+			var values []interface{}
+			if err = val.Decode(&values); err == nil {
+				for _, v := range values {
+					raw, _ := json.Marshal(v)
+					s.enum = append(s.enum, string(raw))
+				}
+			}
+		case "minimum", "maximum":
+			var f float64
+			if err = val.Decode(&f); err == nil {
+				if key.Value == "minimum" {
+					s.minimum = &f
+				} else {
+					s.maximum = &f
+				}
+			}
+		case "minLength", "maxLength":
+			var n int
+			if err = val.Decode(&n); err == nil {
+				if key.Value == "minLength" {
+					s.minLength = &n
+				} else {
+					s.maxLength = &n
+				}
+			}
+		case "pattern":
+			s.pattern, err = regexp.Compile(val.Value)
+		default:
+			if !schemaAnnotations[key.Value] {
+				return nil, schemaErrorf(key, "unsupported schema keyword %q", key.Value)
+			}
+		}
+		if err != nil {
+			if se, ok := err.(*schemaError); ok {
+				return nil, se
+			}
+			return nil, schemaErrorf(val, "invalid %s: %v", key.Value, err)
+		}
+	}
+	return s, nil
+}
+
+func schemaTypeList(node *yaml.Node) ([]string, error) {
+	var types []string
+	if node.Kind == yaml.SequenceNode {
+		if err := node.Decode(&types); err != nil {
+			return nil, err
+		}
+	} else {
+		types = []string{node.Value}
+	}
+	for _, t := range types {
+		if !schemaTypes[t] {
+			return nil, schemaErrorf(node, "unknown type %q", t)
+		}
+	}
+	return types, nil
+}
+
+// validate checks a value decoded from JSON against the schema; path names
+// the value in errors.
+func (s *taskSchema) validate(v interface{}, path string) error {
+	if len(s.types) > 0 && !s.matchesType(v) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.types, " or "), jsonType(v))
+	}
+	if len(s.enum) > 0 {
+		raw, _ := json.Marshal(v)
+		found := false
+		for _, e := range s.enum {
+			found = found || e == string(raw)
+		}
+		if !found {
+			return fmt.Errorf("%s: %s is not one of %s", path, raw, strings.Join(s.enum, ", "))
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.properties[name]
+			if !ok {
+				if s.additional != nil && !*s.additional {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, path+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.minLength != nil && n < *s.minLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match %s", path, s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return fmt.Errorf("%s: below the minimum %v", path, *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return fmt.Errorf("%s: above the maximum %v", path, *s.maximum)
+		}
+	}
+	return nil
+}
+
+func (s *taskSchema) matchesType(v interface{}) bool {
+	actual := jsonType(v)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType names the JSON type of a value produced by encoding/json.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
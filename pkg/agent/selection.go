@@ -0,0 +1,413 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultExploreRate is the share of rankings that put a random candidate
+// first, so agents without a track record get tried.
+const DefaultExploreRate = 0.1
+
+// latencyReference is the average latency scored 0.5, as good as an
+// unknown counterparty.
+const latencyReference = 5 * time.Second
+
+// reputationCacheTTL is how long a registry reputation is reused.
+const reputationCacheTTL = 5 * time.Minute
+
+// SelectionWeights weigh the inputs of a candidate's score. Only their
+// ratios matter.
+type SelectionWeights struct {
+	Reputation  float64 `json:"reputation"`
+	SuccessRate float64 `json:"successRate"`
+	Latency     float64 `json:"latency"`
+	Price       float64 `json:"price"`
+	Recency     float64 `json:"recency"`
+}
+
+// DefaultSelectionWeights favour the registry's and the node's own
+// experience of a counterparty over its price and how recently it was seen.
+var DefaultSelectionWeights = SelectionWeights{Reputation: 0.35, SuccessRate: 0.3, Latency: 0.1, Price: 0.15, Recency: 0.1}
+
+// ParseSelectionWeights reads weights written as "reputation=2,price=1".
+// Weights left out are 0.
+func ParseSelectionWeights(s string) (SelectionWeights, error) {
+	var w SelectionWeights
+	fields := map[string]*float64{
+		"reputation": &w.Reputation, "successRate": &w.SuccessRate, "latency": &w.Latency,
+		"price": &w.Price, "recency": &w.Recency,
+	}
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		f, known := fields[name]
+		if !ok || !known {
+			return w, fmt.Errorf("invalid weight %q: want name=value with name one of reputation, successRate, latency, price, recency", part)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v < 0 {
+			return w, fmt.Errorf("invalid weight %q: want a non-negative number", part)
+		}
+		*f = v
+	}
+	return w, nil
+}
+
+// AgentRef is a counterparty that could take a task.
+type AgentRef struct {
+	Recipient
+	AgentID  *big.Int `json:"agentId,omitempty"`  // ERC-8004 identity, for its reputation
+	Price    *big.Int `json:"price,omitempty"`    // wei it asks
+	LastSeen int64    `json:"lastSeen,omitempty"` // unix ms of its last announcement
+	ChainID  uint64   `json:"chainId,omitempty"`  // chain its identity is on, and it settles on; 0 if unknown
+}
+
+// TaskContext is what candidates are ranked for.
+type TaskContext struct {
+	TaskID     string `json:"taskId,omitempty"`
+	Capability string `json:"capability,omitempty"` // also the reputation tag candidates are scored on
+	View       string `json:"view,omitempty"`       // reputation view candidates are scored under; "" for Persona's
+	Persona    string `json:"persona,omitempty"`    // wallet the node acts as, whose view applies
+	// What a PricingEngine quotes on: who the task is for, and the size of
+	// its input
+	Counterparty *Counterparty `json:"counterparty,omitempty"`
+	InputBytes   int64         `json:"inputBytes,omitempty"`
+}
+
+// ScoreInputs are a candidate's normalised inputs, each 0 to 1. Inputs the
+// node knows nothing about are 0.5.
+type ScoreInputs struct {
+	Reputation  float64 `json:"reputation"`
+	SuccessRate float64 `json:"successRate"`
+	Latency     float64 `json:"latency"`
+	Price       float64 `json:"price"`
+	Recency     float64 `json:"recency"`
+}
+
+// RankedCandidate is a candidate with its score and what it was made of.
+type RankedCandidate struct {
+	AgentRef
+	Inputs      ScoreInputs `json:"inputs"`
+	Score       float64     `json:"score"`
+	Unreachable bool        `json:"unreachable,omitempty"` // its last probe failed, so it ranks after those that answered
+}
+
+// SelectionDecision records one ranking, for later analysis.
+type SelectionDecision struct {
+	Time     int64             `json:"time"` // unix ms
+	Task     TaskContext       `json:"task"`
+	Weights  SelectionWeights  `json:"weights"`
+	Ranked   []RankedCandidate `json:"ranked"`          // in the order they are tried
+	Explored bool              `json:"explored"`        // the first candidate was picked at random
+	View     string            `json:"view,omitempty"`  // reputation view the candidates were scored under
+	Chain    uint64            `json:"chain,omitempty"` // chain whose candidates were put first
+}
+
+// ReputationFunc returns an agent's reputation on a tag, 0 to 1, and
+// whether it has any feedback.
+type ReputationFunc func(ctx context.Context, agentId *big.Int, tag string) (float64, bool, error)
+
+// RegistryReputation reads reputation from the ERC-8004 registry, counting
+// feedback from clients only: the registry expects the caller to name the
+// reviewers it trusts. Feedback values are scores out of 100. Reputation is
+// read at block at, empty meaning the client's default; ranking on finalized
+// state keeps feedback that a reorg could drop from counting. Results are
+// reused for reputationCacheTTL on the client's clock.
+func RegistryReputation(c *ERC8004Client, clients []common.Address, at BlockTag) ReputationFunc {
+	type entry struct {
+		score float64
+		known bool
+		at    time.Time
+	}
+	var mu sync.Mutex
+	cache := map[string]entry{}
+	return func(ctx context.Context, agentId *big.Int, tag string) (float64, bool, error) {
+		key := agentId.String() + "/" + tag
+		mu.Lock()
+		e, ok := cache[key]
+		mu.Unlock()
+		if ok && c.Clock().Now().Sub(e.at) < reputationCacheTTL {
+			return e.score, e.known, nil
+		}
+		s, err := c.GetReputationSummaryForClients(agentId, clients, tag, "", at)
+		if err != nil {
+			return 0, false, err
+		}
+		e = entry{at: c.Clock().Now(), known: s.Count > 0}
+		if e.known && s.Value != nil {
+			v, _ := new(big.Float).Quo(new(big.Float).SetInt(s.Value), new(big.Float).SetFloat64(math.Pow10(int(s.Decimals)))).Float64()
+			e.score = clamp01(v / 100)
+		}
+		mu.Lock()
+		cache[key] = e
+		mu.Unlock()
+		return e.score, e.known, nil
+	}
+}
+
+// SelectionPolicy ranks the counterparties that could take a task by a
+// weighted score of their reputation, on the registry and in the node's own
+// ledger, the node's history with them, their price and how recently they
+// were seen. Latency is the probed round trip to a peer when it was pinged,
+// and the average exchange otherwise; peers whose last ping failed rank
+// after every peer that answered. With probability ExploreRate a random candidate is moved to the
+// front instead, so new agents build a history. With PreferChain set, the
+// candidates on that chain are ranked ahead of the rest, each group by score,
+// and exploring picks among them.
+type SelectionPolicy struct {
+	Weights     SelectionWeights
+	ExploreRate float64
+	PreferChain uint64            // chain ID whose candidates go first; 0 for none
+	Reputation  ReputationFunc    // nil leaves the registry out of reputation
+	Views       *ReputationViews  // registry reputation under the view a task selects, instead of Reputation
+	Ledger      *ReputationLedger // the node's own scores, averaged with the registry's; nil leaves them out
+	History     *PeerHistory
+	Latencies   *PeerLatencies // probed round trips, scored as latency ahead of History; nil leaves them out
+	// Record, if set, is called with every decision and its inputs.
+	Record func(SelectionDecision)
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func NewSelectionPolicy(reputation ReputationFunc, history *PeerHistory) *SelectionPolicy {
+	return &SelectionPolicy{
+		Weights:     DefaultSelectionWeights,
+		ExploreRate: DefaultExploreRate,
+		Reputation:  reputation,
+		History:     history,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Seed makes exploration repeatable.
+func (p *SelectionPolicy) Seed(seed int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rand = rand.New(rand.NewSource(seed))
+}
+
+// RankCandidates orders candidates best first for task. It fails only when
+// ctx ends; a reputation that can't be read counts as unknown.
+func (p *SelectionPolicy) RankCandidates(ctx context.Context, candidates []AgentRef, task TaskContext) ([]RankedCandidate, error) {
+	var cheapest *big.Int
+	for _, c := range candidates {
+		if c.Price != nil && (cheapest == nil || c.Price.Cmp(cheapest) < 0) {
+			cheapest = c.Price
+		}
+	}
+
+	view := ""
+	if p.Views != nil {
+		var err error
+		if view, err = p.Views.Select(task.View, task.Persona); err != nil {
+			fmt.Printf("[Selection] %v; ranking on Reputation\n", err)
+		}
+	}
+
+	now := time.Now()
+	ranked := make([]RankedCandidate, len(candidates))
+	for i, c := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		in := ScoreInputs{Reputation: p.reputation(ctx, view, c.AgentID, task.Capability), Recency: 0.5, Price: 0.5}
+		in.SuccessRate, in.Latency = p.History.scores(c.key())
+		var unreachable bool
+		if c.PeerID != "" {
+			if score, ok := p.Latencies.score(c.PeerID); ok {
+				in.Latency, unreachable = score, score == 0
+			}
+		}
+		if c.Price != nil && cheapest != nil {
+			// The cheapest scores 1, twice its price 0.5
+			ratio, _ := new(big.Float).Quo(new(big.Float).SetInt(new(big.Int).Add(cheapest, big.NewInt(1))),
+				new(big.Float).SetInt(new(big.Int).Add(c.Price, big.NewInt(1)))).Float64()
+			in.Price = ratio
+		}
+		if c.LastSeen > 0 {
+			age := max(now.Sub(time.UnixMilli(c.LastSeen)), 0)
+			in.Recency = float64(DefaultRouteTTL) / float64(DefaultRouteTTL+age)
+		}
+		ranked[i] = RankedCandidate{AgentRef: c, Inputs: in, Score: p.score(in), Unreachable: unreachable}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if pi, pj := p.prefers(ranked[i].AgentRef), p.prefers(ranked[j].AgentRef); pi != pj {
+			return pi
+		}
+		if ui, uj := ranked[i].Unreachable, ranked[j].Unreachable; ui != uj {
+			return uj
+		}
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].key() < ranked[j].key()
+	})
+
+	d := SelectionDecision{Time: now.UnixMilli(), Task: task, Weights: p.Weights, View: view, Chain: p.PreferChain}
+	// Exploring stays among the preferred chain's candidates, if there are any
+	group := len(ranked)
+	if len(ranked) > 0 && p.prefers(ranked[0].AgentRef) {
+		for group = 1; group < len(ranked) && p.prefers(ranked[group].AgentRef); group++ {
+		}
+	}
+	if group > 1 {
+		p.mu.Lock()
+		if p.rand == nil {
+			p.rand = rand.New(rand.NewSource(now.UnixNano()))
+		}
+		if p.rand.Float64() < p.ExploreRate {
+			i := 1 + p.rand.Intn(group-1)
+			pick := ranked[i]
+			copy(ranked[1:i+1], ranked[:i])
+			ranked[0] = pick
+			d.Explored = true
+		}
+		p.mu.Unlock()
+	}
+	if p.Record != nil {
+		d.Ranked = ranked
+		p.Record(d)
+	}
+	return ranked, nil
+}
+
+// prefers reports whether c is on the chain the policy prefers.
+func (p *SelectionPolicy) prefers(c AgentRef) bool {
+	return p.PreferChain != 0 && c.ChainID == p.PreferChain
+}
+
+// reputation averages what the registry, under view if it isn't "", and the
+// node's ledger know of agentId, and is 0.5 when neither knows it.
+func (p *SelectionPolicy) reputation(ctx context.Context, view string, agentId *big.Int, tag string) float64 {
+	if agentId == nil {
+		return 0.5
+	}
+	var sum float64
+	var known int
+	read := p.Reputation
+	if view != "" {
+		read = func(ctx context.Context, agentId *big.Int, tag string) (float64, bool, error) {
+			return p.Views.Reputation(ctx, view, agentId, tag)
+		}
+	}
+	if read != nil {
+		if score, ok, err := read(ctx, agentId, tag); err != nil {
+			fmt.Printf("[Selection] Reputation of agent %s unavailable: %v\n", agentId, err)
+		} else if ok {
+			sum, known = sum+score, known+1
+		}
+	}
+	if score, ok := p.Ledger.reputation(agentId.String()); ok {
+		sum, known = sum+score, known+1
+	}
+	if known == 0 {
+		return 0.5
+	}
+	return sum / float64(known)
+}
+
+func (p *SelectionPolicy) score(in ScoreInputs) float64 {
+	w := p.Weights
+	total := w.Reputation + w.SuccessRate + w.Latency + w.Price + w.Recency
+	if total == 0 {
+		return 0
+	}
+	return (w.Reputation*in.Reputation + w.SuccessRate*in.SuccessRate + w.Latency*in.Latency +
+		w.Price*in.Price + w.Recency*in.Recency) / total
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// PeerStats is the node's history with one counterparty.
+type PeerStats struct {
+	Attempts  int           `json:"attempts"`
+	Successes int           `json:"successes"`
+	Latency   time.Duration `json:"latency"` // total over successful exchanges
+	LastSeen  int64         `json:"lastSeen"`
+}
+
+// PeerHistory keeps how exchanges with each counterparty went, in memory.
+// A nil *PeerHistory records nothing.
+type PeerHistory struct {
+	mu    sync.Mutex
+	stats map[string]*PeerStats
+}
+
+func NewPeerHistory() *PeerHistory {
+	return &PeerHistory{stats: map[string]*PeerStats{}}
+}
+
+// Record notes an exchange with the counterparty key (its peer ID, or its
+// endpoint) that took latency and ended with err.
+func (h *PeerHistory) Record(key string, latency time.Duration, err error) {
+	if h == nil || key == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stats[key]
+	if s == nil {
+		s = &PeerStats{}
+		h.stats[key] = s
+	}
+	s.Attempts++
+	s.LastSeen = time.Now().UnixMilli()
+	if err == nil {
+		s.Successes++
+		s.Latency += latency
+	}
+}
+
+// Stats returns the history with key, if any.
+func (h *PeerHistory) Stats(key string) (PeerStats, bool) {
+	if h == nil {
+		return PeerStats{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.stats[key]
+	if !ok {
+		return PeerStats{}, false
+	}
+	return *s, true
+}
+
+// Len returns how many counterparties there is a history with.
+func (h *PeerHistory) Len() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.stats)
+}
+
+// scores returns the success rate and latency inputs for key. The success
+// rate starts at 0.5 and moves with each outcome, so one failure doesn't
+// sink a counterparty.
+func (h *PeerHistory) scores(key string) (successRate, latency float64) {
+	s, ok := h.Stats(key)
+	if !ok {
+		return 0.5, 0.5
+	}
+	successRate = float64(s.Successes+1) / float64(s.Attempts+2)
+	latency = 0.5
+	if s.Successes > 0 {
+		avg := s.Latency / time.Duration(s.Successes)
+		latency = float64(latencyReference) / float64(latencyReference+avg)
+	}
+	return successRate, latency
+}
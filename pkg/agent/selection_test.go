@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestRankCandidatesIsDeterministic(t *testing.T) {
+	history := NewPeerHistory()
+	for i := 0; i < 8; i++ {
+		history.Record("reliable", time.Second, nil)
+	}
+	for i := 0; i < 8; i++ {
+		history.Record("flaky", time.Second, errors.New("timeout"))
+	}
+	reputation := func(ctx context.Context, agentId *big.Int, tag string) (float64, bool, error) {
+		if tag != "summarize" {
+			t.Errorf("reputation asked for tag %q", tag)
+		}
+		switch agentId.Int64() {
+		case 1:
+			return 0.9, true, nil
+		case 2:
+			return 0, false, nil
+		}
+		return 0, false, errors.New("rpc unavailable")
+	}
+	p := NewSelectionPolicy(reputation, history)
+	p.Weights = SelectionWeights{Reputation: 1, SuccessRate: 1, Price: 1}
+	p.ExploreRate = 0
+	var recorded []SelectionDecision
+	p.Record = func(d SelectionDecision) { recorded = append(recorded, d) }
+
+	candidates := []AgentRef{
+		{Recipient: Recipient{PeerID: "flaky"}, AgentID: big.NewInt(1), Price: big.NewInt(99)},
+		{Recipient: Recipient{PeerID: "unknown"}, AgentID: big.NewInt(3)},
+		{Recipient: Recipient{PeerID: "reliable"}, AgentID: big.NewInt(2), Price: big.NewInt(199)},
+		{Recipient: Recipient{Endpoint: "https://cheap.example"}, Price: big.NewInt(99)},
+	}
+	task := TaskContext{TaskID: "task:1", Capability: "summarize"}
+	for i := 0; i < 3; i++ {
+		ranked, err := p.RankCandidates(context.Background(), candidates, task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// flaky: (0.9 + 0.1 + 1) / 3, ahead of cheap: (0.5 + 0.5 + 1) / 3 on
+		// the tie by key; reliable: (0.5 + 0.9 + 0.5) / 3; unknown: 0.5 each
+		var order []string
+		for _, r := range ranked {
+			order = append(order, r.key())
+		}
+		want := []string{"flaky", "https://cheap.example", "reliable", "unknown"}
+		for j := range want {
+			if order[j] != want[j] {
+				t.Fatalf("ranking %d: %v, want %v", i, order, want)
+			}
+		}
+		if math.Abs(ranked[2].Score-1.9/3) > 1e-9 || ranked[2].Inputs.SuccessRate != 0.9 || ranked[2].Inputs.Price != 0.5 {
+			t.Errorf("reliable scored %+v", ranked[2])
+		}
+	}
+	if len(recorded) != 3 || recorded[0].Task != task || len(recorded[0].Ranked) != 4 || recorded[0].Explored {
+		t.Errorf("recorded %+v", recorded)
+	}
+}
+
+func TestRankCandidatesExploresAtRate(t *testing.T) {
+	p := NewSelectionPolicy(nil, nil)
+	p.ExploreRate = 0.2
+	p.Seed(7)
+	candidates := []AgentRef{
+		{Recipient: Recipient{PeerID: "best"}, Price: big.NewInt(1)},
+		{Recipient: Recipient{PeerID: "middle"}, Price: big.NewInt(3)},
+		{Recipient: Recipient{PeerID: "worst"}, Price: big.NewInt(9)},
+	}
+
+	const rounds = 10000
+	var explored, worstFirst int
+	for i := 0; i < rounds; i++ {
+		ranked, _ := p.RankCandidates(context.Background(), candidates, TaskContext{})
+		if ranked[0].PeerID != "best" {
+			explored++
+		}
+		if ranked[0].PeerID == "worst" {
+			worstFirst++
+		}
+	}
+	if rate := float64(explored) / rounds; math.Abs(rate-0.2) > 0.02 {
+		t.Errorf("explored %.3f of rankings, want 0.2", rate)
+	}
+	// Exploration picks among the others evenly
+	if rate := float64(worstFirst) / rounds; math.Abs(rate-0.1) > 0.02 {
+		t.Errorf("lowest-ranked candidate first in %.3f of rankings, want 0.1", rate)
+	}
+}
+
+func TestRankCandidatesPrefersAChain(t *testing.T) {
+	p := NewSelectionPolicy(nil, nil)
+	p.PreferChain, p.ExploreRate = 11155420, 1
+	p.Seed(7)
+	candidates := []AgentRef{
+		{Recipient: Recipient{PeerID: "cheap"}, Price: big.NewInt(1), ChainID: 8453},
+		{Recipient: Recipient{PeerID: "dear"}, Price: big.NewInt(9), ChainID: 11155420},
+		{Recipient: Recipient{PeerID: "dearer"}, Price: big.NewInt(20), ChainID: 11155420},
+		{Recipient: Recipient{PeerID: "unknown"}, Price: big.NewInt(2)},
+	}
+	for i := 0; i < 20; i++ {
+		ranked, _ := p.RankCandidates(context.Background(), candidates, TaskContext{})
+		// Always exploring, but only among the preferred chain's candidates
+		if ranked[0].PeerID != "dearer" || ranked[1].PeerID != "dear" || ranked[2].PeerID != "cheap" || ranked[3].PeerID != "unknown" {
+			t.Fatalf("ranked %v, %v, %v, %v", ranked[0].PeerID, ranked[1].PeerID, ranked[2].PeerID, ranked[3].PeerID)
+		}
+	}
+}
+
+func TestParseSelectionWeights(t *testing.T) {
+	w, err := ParseSelectionWeights("reputation=2, price=0.5")
+	if err != nil || w != (SelectionWeights{Reputation: 2, Price: 0.5}) {
+		t.Errorf("weights %+v, %v", w, err)
+	}
+	for _, bad := range []string{"speed=1", "price", "price=-1", "price=cheap"} {
+		if _, err := ParseSelectionWeights(bad); err == nil {
+			t.Errorf("ParseSelectionWeights(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestDelegateTaskTriesTheNextCandidate(t *testing.T) {
+	fastDelivery(t)
+	n := startTestNode(t)
+	n.Selection = NewSelectionPolicy(nil, n.History)
+	n.Selection.Weights, n.Selection.ExploreRate = SelectionWeights{Price: 1}, 0
+
+	busy := &a2aAgent{fail: []int{503, 503, 503}}
+	busySrv := httptest.NewServer(busy)
+	defer busySrv.Close()
+	idle := &a2aAgent{}
+	idleSrv := httptest.NewServer(idle)
+	defer idleSrv.Close()
+
+	// The busy agent is cheaper, so it is tried first
+	candidates := []AgentRef{
+		{Recipient: Recipient{Endpoint: idleSrv.URL}, Price: big.NewInt(200)},
+		{Recipient: Recipient{Endpoint: busySrv.URL}, Price: big.NewInt(100)},
+	}
+	_, receipt, err := n.DelegateTask(context.Background(), candidates, TaskContext{Capability: "summarize"}, "hello")
+	if err != nil || receipt.Transport != "http "+idleSrv.URL {
+		t.Fatalf("receipt %+v, %v; want delivered to the idle agent", receipt, err)
+	}
+	if len(busy.received()) != deliveryAttempts || len(idle.received()) != 1 {
+		t.Errorf("busy agent got %d requests, idle %d", len(busy.received()), len(idle.received()))
+	}
+	if s, _ := n.History.Stats(busySrv.URL); s.Attempts != 1 || s.Successes != 0 {
+		t.Errorf("busy agent history %+v, want one failure", s)
+	}
+
+	// A refusal that won't pass isn't retried elsewhere
+	refusing := &a2aAgent{fail: []int{http.StatusForbidden}}
+	refusingSrv := httptest.NewServer(refusing)
+	defer refusingSrv.Close()
+	candidates[1].Endpoint = refusingSrv.URL
+	if _, _, err := n.DelegateTask(context.Background(), candidates, TaskContext{}, "hello"); err == nil || len(idle.received()) != 1 {
+		t.Errorf("err %v, idle agent got %d requests; want the refusal returned", err, len(idle.received()))
+	}
+}
+
+func TestRegistryReputationExpiresOnTheClientClock(t *testing.T) {
+	reviewer := common.HexToAddress("0x0c")
+	c, batches := newReputationChain(t, map[common.Address]int64{reviewer: 80})
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	c.SetClock(clock)
+	reputation := RegistryReputation(c, []common.Address{reviewer}, "")
+
+	for i := 0; i < 2; i++ {
+		if score, known, err := reputation(context.Background(), big.NewInt(7), "summarize"); err != nil || !known || math.Abs(score-0.8) > 1e-9 {
+			t.Fatalf("reputation = %v, %v, %v; want 0.8", score, known, err)
+		}
+	}
+	if n := len(batches()); n != 1 {
+		t.Fatalf("registry read %d times within the TTL, want 1", n)
+	}
+	clock.Advance(reputationCacheTTL)
+	reputation(context.Background(), big.NewInt(7), "summarize")
+	if n := len(batches()); n != 2 {
+		t.Errorf("registry read %d times after the TTL, want 2", n)
+	}
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ErrAgentUnknown means the node doesn't know its own agentId: it has no
+// wallet or chain, its wallet isn't registered, or discovery hasn't
+// finished yet.
+var ErrAgentUnknown = errors.New("the node's agentId is unknown")
+
+// AgentID returns the agentId the node's wallet holds, as found at startup,
+// and whether it was found.
+func (n *AgentNode) AgentID() (*big.Int, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.agentID == nil {
+		return nil, false
+	}
+	return new(big.Int).Set(n.agentID), true
+}
+
+// ownAgentID is AgentID, looking the agent up by the wallet if startup
+// didn't find it, for a wallet registered since.
+func (n *AgentNode) ownAgentID(ctx context.Context) (*big.Int, error) {
+	if id, ok := n.AgentID(); ok {
+		return id, nil
+	}
+	if n.ERCClient == nil || n.Wallet == nil {
+		return nil, ErrAgentUnknown
+	}
+	id, err := n.ERCClient.GetAgentIdByWalletContext(ctx, n.Wallet.Address)
+	if errors.Is(err, ErrWalletNotRegistered) {
+		return nil, fmt.Errorf("%w: wallet %s isn't registered", ErrAgentUnknown, n.Wallet.Address.Hex())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding the node's agent: %w", err)
+	}
+	n.setAgentID(id)
+	return id, nil
+}
+
+func (n *AgentNode) setAgentID(id *big.Int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.agentID = new(big.Int).Set(id)
+}
+
+// OwnReputation returns the summary of the feedback the node's own agent
+// was given under tag1 and tag2, "" for any, by any client.
+func (n *AgentNode) OwnReputation(tag1, tag2 string) (ReputationSummary, error) {
+	id, ok := n.AgentID()
+	if !ok || n.ERCClient == nil {
+		return ReputationSummary{}, ErrAgentUnknown
+	}
+	return n.ERCClient.GetReputationSummaryForClients(id, nil, tag1, tag2)
+}
+
+// agentStep finds the agentId of the node's wallet once the chain answers,
+// and publishes the node's peer ID to it if PublishPeerID is set and the
+// agent names another. A wallet that isn't registered, or a publication
+// that fails, only gets a warning.
+func (n *AgentNode) agentStep() BootStep {
+	return BootStep{Name: "agent", After: []string{"chain"}, Background: true, Degraded: "agentId unknown", Run: func(ctx context.Context) error {
+		id, err := n.ERCClient.GetAgentIdByWalletContext(ctx, n.Wallet.Address)
+		if errors.Is(err, ErrWalletNotRegistered) {
+			fmt.Printf("[Identity] Warning: wallet %s has no agent; register first with 'agent register'\n", n.Wallet.Address.Hex())
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n.setAgentID(id)
+		fmt.Printf("[Identity] Wallet %s holds agent %s\n", n.Wallet.Address.Hex(), id)
+		if n.PublishPeerID {
+			// A failed publication isn't retried with the step: each try
+			// may cost gas
+			if err := n.publishOwnPeerID(id); err != nil {
+				fmt.Printf("[Identity] %v\n", err)
+				n.Events.AddError("peer_id_publish_failed", err, map[string]string{"agentId": id.String()})
+			}
+		}
+		return nil
+	}}
+}
+
+// publishOwnPeerID points agent id at the node's current peer ID, with a
+// fresh binding, unless it already is.
+func (n *AgentNode) publishOwnPeerID(id *big.Int) error {
+	self := n.CurrentHost().ID().String()
+	published, err := n.ERCClient.GetMetadata(id, "peerId")
+	if err != nil {
+		return err
+	}
+	if published == self && n.ERCClient.VerifyPeerBinding(id, self) == nil {
+		return nil
+	}
+	n.mu.RLock()
+	priv := n.privKey
+	n.mu.RUnlock()
+	if err := n.ERCClient.BindPeerID(n.Wallet, id, priv); err != nil {
+		return fmt.Errorf("publishing peer ID %s to agent %s: %w", self, id, err)
+	}
+	fmt.Printf("[Identity] Published peer ID %s to agent %s\n", self, id)
+	return nil
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestNodeDiscoversItsAgentFromItsWallet(t *testing.T) {
+	registered, unregistered := newTestWallet(t), newTestWallet(t)
+	// chainClient serves a registry with the Registered logs given
+	chainClient := func(logs []types.Log) *ERC8004Client {
+		chain := &fakeChain{head: registryDeployBlock + 10, logs: logs}
+		var client *ERC8004Client
+		url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+			switch method {
+			case "eth_blockNumber":
+				return hexutil.Uint64(chain.head), nil
+			case "eth_call":
+				// The agent has three reviews averaging 80
+				out, _ := client.reputationABI.Methods["getSummary"].Outputs.Pack(uint64(3), big.NewInt(80), uint8(0))
+				return hexutil.Encode(out), nil
+			}
+			return chain.handle(method, params)
+		})
+		client = NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+		t.Cleanup(client.Close)
+		return client
+	}
+	withAgent := chainClient([]types.Log{{
+		BlockNumber: registryDeployBlock + 5,
+		Topics:      []common.Hash{registeredEventSig, common.BigToHash(big.NewInt(42)), common.BytesToHash(registered.Address.Bytes())},
+	}})
+
+	start := func(client *ERC8004Client, w *Wallet) *AgentNode {
+		n := newTestNode(t)
+		n.ERCClient, n.Wallet = client, w
+		if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			if len(n.Status().Degraded) == 0 {
+				return n
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node still degraded: %v", n.Status().Degraded)
+			}
+		}
+	}
+
+	n := start(withAgent, registered)
+	if id, ok := n.AgentID(); !ok || id.Int64() != 42 {
+		t.Errorf("AgentID = %v, %v; want 42", id, ok)
+	}
+	if got := n.Status().AgentID; got != "42" {
+		t.Errorf("status agentId = %q, want 42", got)
+	}
+	if s, err := n.OwnReputation("", ""); err != nil || s.Count != 3 || s.Value.Int64() != 80 {
+		t.Errorf("OwnReputation = %+v, %v; want 3 reviews averaging 80", s, err)
+	}
+
+	// An unregistered wallet leaves the node up, without an agent
+	n = start(chainClient(nil), unregistered)
+	if id, ok := n.AgentID(); ok {
+		t.Errorf("AgentID = %v, want none for an unregistered wallet", id)
+	}
+	if _, err := n.OwnReputation("", ""); !errors.Is(err, ErrAgentUnknown) {
+		t.Errorf("OwnReputation: %v, want ErrAgentUnknown", err)
+	}
+}
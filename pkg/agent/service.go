@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The node methods below are the operations the HTTP and gRPC control APIs
+// share; each API only translates requests and errors.
+
+// defaultTaskLimit is how many tasks a listing returns unless asked otherwise.
+const defaultTaskLimit = 100
+
+// ErrNotFound is returned for a task the node has no record of.
+var ErrNotFound = errors.New("not found")
+
+// ErrTaskRunning is returned when deleting a local task that hasn't finished.
+var ErrTaskRunning = errors.New("task has not finished")
+
+// ErrCapabilityExists is returned when adding a capability the node already
+// serves.
+var ErrCapabilityExists = errors.New("capability already served")
+
+// Tasks returns the most recent tasks, newest first, with the priorities of
+// those queued. A limit of 0 or less means defaultTaskLimit.
+func (n *AgentNode) Tasks(limit int) ([]TaskRecord, error) {
+	if limit <= 0 {
+		limit = defaultTaskLimit
+	}
+	tasks, err := n.Store.ListTasks(limit)
+	if tasks == nil {
+		tasks = []TaskRecord{}
+	}
+	priorities := n.Scheduler.Priorities()
+	for i := range tasks {
+		if p, ok := priorities[tasks[i].ID]; ok {
+			tasks[i].Priority = &p
+		}
+	}
+	return tasks, err
+}
+
+// Task returns a task by ID, with its result file if it is a finished local
+// task.
+func (n *AgentNode) Task(id string) (*LocalTaskStatus, error) {
+	record, err := n.Store.GetTask(id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("task %s: %w", id, ErrNotFound)
+	}
+	st := &LocalTaskStatus{TaskRecord: *record}
+	if p, ok := n.Scheduler.Priorities()[id]; ok {
+		st.Priority = &p
+	}
+	if record.Kind == TaskKindLocal && record.Status != TaskStatusReceived {
+		st.Result = n.resultPath(id)
+	}
+	return st, nil
+}
+
+// DeleteTask forgets a task, and the result file of a local one. A local task
+// can't be deleted while it is queued or running.
+func (n *AgentNode) DeleteTask(id string) error {
+	st, err := n.Task(id)
+	if err != nil {
+		return err
+	}
+	if st.Kind == TaskKindLocal && st.Status == TaskStatusReceived {
+		return fmt.Errorf("task %s: %w", id, ErrTaskRunning)
+	}
+	if err := n.Store.DeleteTask(id); err != nil {
+		return err
+	}
+	if st.Result != "" {
+		if err := os.Remove(st.Result); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	n.Events.Add("task_deleted", map[string]string{"taskId": id})
+	return nil
+}
+
+// Peers returns the peer directory.
+func (n *AgentNode) Peers() ([]PeerRecord, error) {
+	peers, err := n.Store.ListPeers()
+	if peers == nil {
+		peers = []PeerRecord{}
+	}
+	n.namePeers(peers)
+	return peers, err
+}
+
+// namePeers fills in the names of peers the node's NameResolver finds in
+// time.
+func (n *AgentNode) namePeers(peers []PeerRecord) {
+	if n.Names == nil || len(peers) == 0 {
+		return
+	}
+	ids := make([]string, len(peers))
+	for i, p := range peers {
+		ids[i] = p.PeerID
+	}
+	names := n.Names.Names(context.Background(), ids...)
+	for i := range peers {
+		peers[i].Name = names[peers[i].PeerID]
+	}
+}
+
+// Peer returns what the node knows of peerID, with its misbehavior score and
+// bans, or nil if it knows nothing.
+func (n *AgentNode) Peer(peerID string) (*PeerStanding, error) {
+	guard := n.Guard
+	if guard == nil {
+		guard = NewPeerGuard(n.Store, DefaultMisbehaviorConfig())
+	}
+	p, err := guard.Standing(peerID)
+	if p != nil {
+		records := []PeerRecord{p.PeerRecord}
+		n.namePeers(records)
+		p.PeerRecord = records[0]
+	}
+	return p, err
+}
+
+// AddCapabilities loads a capability manifest into the running node and
+// advertises its capabilities, under the wallet address if there is one. None
+// are added if any is already served.
+func (n *AgentNode) AddCapabilities(manifest []byte) ([]CapabilityDef, error) {
+	bindings, err := parseManifest("manifest", manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	for _, b := range bindings {
+		if _, dup := n.bindings[b.def.Name]; dup {
+			n.mu.Unlock()
+			return nil, fmt.Errorf("%w: %s", ErrCapabilityExists, b.def.Name)
+		}
+	}
+	if n.bindings == nil {
+		n.bindings = map[string]capabilityBinding{}
+	}
+	defs := make([]CapabilityDef, len(bindings))
+	for i, b := range bindings {
+		n.bindings[b.def.Name] = b
+		defs[i] = b.def
+	}
+	n.mu.Unlock()
+
+	var ethAddress string
+	if n.Wallet != nil {
+		ethAddress = n.Wallet.Address.Hex()
+	}
+	// Peers hear of the manifest's capabilities together
+	caps := make([]AgentCapability, len(defs))
+	for i, def := range defs {
+		caps[i] = def.Capability()
+	}
+	n.advertise(ethAddress, caps...)
+	n.Events.Add("capabilities_added", defs)
+	return defs, nil
+}
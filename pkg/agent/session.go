@@ -0,0 +1,800 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Message types of the session protocol. Each frame goes on a stream of its
+// own and is answered with a session_ack carrying the answering side's
+// count of messages received, or with a session_close if the session is
+// over there.
+const (
+	MessageSessionOpen    = "session_open"
+	MessageSessionMessage = "session_message"
+	MessageSessionResume  = "session_resume"
+	MessageSessionClose   = "session_close"
+	MessageSessionAck     = "session_ack"
+)
+
+// DefaultSessionTTL is how long a session may sit idle before it is closed.
+const DefaultSessionTTL = time.Hour
+
+// SessionIdle is the reason given for a session closed for sitting idle
+// past its TTL.
+const SessionIdle = "idle"
+
+// sessionTimeout bounds one frame's round trip.
+const sessionTimeout = 30 * time.Second
+
+// ErrSessionClosed is returned for a session closed by either side.
+var ErrSessionClosed = errors.New("session is closed")
+
+// SessionRecord is the state of a conversation kept so it survives a
+// restart of either side: how far each side's messages have got. Messages
+// are numbered from 1 by their sender, and taken by the other side in
+// order, once each.
+type SessionRecord struct {
+	ID         string `json:"id"`
+	PeerID     string `json:"peerId"`
+	Initiator  bool   `json:"initiator"`        // this node opened the session
+	TTL        int64  `json:"ttl"`              // ms the session may sit idle, the shorter of both sides'
+	Sent       uint64 `json:"sent"`             // the latest message this node queued
+	Acked      uint64 `json:"acked"`            // the latest of those the peer acknowledged
+	Received   uint64 `json:"received"`         // the latest of the peer's messages taken, in order
+	Closed     string `json:"closed,omitempty"` // why the session closed; empty while it is open
+	CreatedAt  int64  `json:"createdAt"`        // unix ms
+	LastActive int64  `json:"lastActive"`       // unix ms of the latest message either way
+}
+
+// SessionMessage is one message of a session, in either direction.
+type SessionMessage struct {
+	SessionID string          `json:"sessionId"`
+	Seq       uint64          `json:"seq"`
+	Outgoing  bool            `json:"outgoing"` // sent by this node
+	Body      json.RawMessage `json:"body"`
+	At        int64           `json:"at"` // unix ms it was queued or taken
+}
+
+// SessionHandler gets each message peers send on a session, once and in
+// order. An error withholds the ack, so the peer sends it again.
+type SessionHandler func(sc SessionContext, msg SessionMessage) error
+
+// SessionCloseHandler is told of a session closed by either side or for
+// sitting idle.
+type SessionCloseHandler func(r SessionRecord)
+
+// SessionContext is what a SessionHandler gets with each message: the
+// session it came on, to reply on and read the history of.
+type SessionContext struct {
+	context.Context
+	*Session
+}
+
+// Reply queues body on the session and sends it in the background, so a
+// handler doesn't wait on the peer it is answering. The reply is kept
+// until the peer acknowledges it, across restarts.
+func (sc SessionContext) Reply(body interface{}) error {
+	if _, err := sc.queue(body); err != nil {
+		return err
+	}
+	sc.n.flushLater(sc.s)
+	return nil
+}
+
+// sessionFrame is the payload of every session message type.
+type sessionFrame struct {
+	SessionID string          `json:"sessionId"`
+	Seq       uint64          `json:"seq,omitempty"`      // of a message
+	Received  uint64          `json:"received,omitempty"` // the sender's count of messages taken, on acks and resumes
+	TTL       int64           `json:"ttl,omitempty"`      // ms the session may sit idle, on an open and its ack
+	Body      json.RawMessage `json:"body,omitempty"`
+	Reason    string          `json:"reason,omitempty"` // why the session closes
+}
+
+// Validate requires the session a frame is for.
+func (f sessionFrame) Validate() error {
+	if f.SessionID == "" {
+		return errors.New("frame without a session")
+	}
+	return nil
+}
+
+// session is a loaded session. Deliveries to the node and sends from it
+// each go one at a time; mu guards rec, which is saved on every change.
+type session struct {
+	in, out sync.Mutex
+	mu      sync.Mutex
+	rec     SessionRecord
+}
+
+func (ss *session) snapshot() SessionRecord {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.rec
+}
+
+// sessionTable holds the sessions loaded since the node started, by ID.
+type sessionTable struct {
+	mu      sync.Mutex
+	byID    map[string]*session
+	handler SessionHandler
+}
+
+func (n *AgentNode) sessionTable() *sessionTable {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.sessions == nil {
+		n.sessions = &sessionTable{byID: map[string]*session{}}
+	}
+	return n.sessions
+}
+
+// SetSessionHandler lets peers open sessions with the node, their messages
+// handed to h. Without one, sessions peers open are refused; the messages
+// on sessions the node opened are only recorded.
+func (n *AgentNode) SetSessionHandler(h SessionHandler) {
+	t := n.sessionTable()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = h
+}
+
+func (t *sessionTable) sessionHandler() SessionHandler {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.handler
+}
+
+// session returns the session id, loaded from the store if need be, or nil
+// if there is none.
+func (n *AgentNode) session(id string) (*session, error) {
+	t := n.sessionTable()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ss, ok := t.byID[id]; ok {
+		return ss, nil
+	}
+	rec, err := n.Store.GetSession(id)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	ss := &session{rec: *rec}
+	t.byID[id] = ss
+	return ss, nil
+}
+
+func (n *AgentNode) sessionTTL() time.Duration {
+	if n.SessionTTL > 0 {
+		return n.SessionTTL
+	}
+	return DefaultSessionTTL
+}
+
+// Session is a conversation with one peer over any number of messages,
+// resumed where it stopped when either side restarts.
+type Session struct {
+	n *AgentNode
+	s *session
+}
+
+func (s *Session) ID() string            { return s.s.snapshot().ID }
+func (s *Session) Peer() string          { return s.s.snapshot().PeerID }
+func (s *Session) Record() SessionRecord { return s.s.snapshot() }
+
+// History returns the session's messages both ways, in the order they were
+// queued or taken.
+func (s *Session) History() ([]SessionMessage, error) {
+	return s.n.Store.ListSessionMessages(s.ID())
+}
+
+// Send queues body on the session and sends every message the peer hasn't
+// acknowledged, in order. A message that couldn't be sent stays queued, and
+// goes with the next send or when the session resumes.
+func (s *Session) Send(ctx context.Context, body interface{}) error {
+	if _, err := s.queue(body); err != nil {
+		return err
+	}
+	return s.n.flush(ctx, s.s)
+}
+
+// Close closes the session and tells the peer, giving reason. The session
+// is closed here even if the peer can't be told.
+func (s *Session) Close(ctx context.Context, reason string) error {
+	if reason == "" {
+		reason = "closed"
+	}
+	if !s.n.closeSession(s.s, reason) {
+		return ErrSessionClosed
+	}
+	return s.n.notifyClose(ctx, s.s.snapshot())
+}
+
+// queue numbers body as the session's next message and records it.
+func (s *Session) queue(body interface{}) (SessionMessage, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return SessionMessage{}, err
+	}
+	ss := s.s
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.rec.Closed != "" {
+		return SessionMessage{}, ErrSessionClosed
+	}
+	now := time.Now().UnixMilli()
+	rec := ss.rec
+	rec.Sent++
+	rec.LastActive = now
+	m := SessionMessage{SessionID: rec.ID, Seq: rec.Sent, Outgoing: true, Body: raw, At: now}
+	if err := s.n.Store.SaveSessionMessage(rec, m); err != nil {
+		return SessionMessage{}, fmt.Errorf("recording the message: %w", err)
+	}
+	ss.rec = rec
+	return m, nil
+}
+
+// OpenSession opens a session with the peer at peerID, which must have a
+// session handler. Its ID is proposed by this node and its TTL is the
+// shorter of both sides'.
+func (n *AgentNode) OpenSession(ctx context.Context, peerID string) (*Session, error) {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID %q: %w", peerID, err)
+	}
+	if err := n.permit(pid, PolicyActionDeliver); err != nil {
+		return nil, err
+	}
+	ttl := n.sessionTTL().Milliseconds()
+	id := newMessageID()
+	ack, err := n.sessionCall(ctx, pid, MessageSessionOpen, sessionFrame{SessionID: id, TTL: ttl})
+	if err != nil {
+		return nil, err
+	}
+	if ack.TTL > 0 && ack.TTL < ttl {
+		ttl = ack.TTL
+	}
+	now := time.Now().UnixMilli()
+	rec := SessionRecord{ID: id, PeerID: peerID, Initiator: true, TTL: ttl, CreatedAt: now, LastActive: now}
+	if err := n.Store.SaveSession(rec); err != nil {
+		return nil, fmt.Errorf("recording the session: %w", err)
+	}
+	ss := &session{rec: rec}
+	t := n.sessionTable()
+	t.mu.Lock()
+	t.byID[id] = ss
+	t.mu.Unlock()
+	n.Events.Add("session_opened", map[string]string{"sessionId": id, "peerId": peerID})
+	return &Session{n: n, s: ss}, nil
+}
+
+// Session returns the session id, e.g. one opened before a restart, or nil
+// if the node has none by that ID.
+func (n *AgentNode) Session(id string) (*Session, error) {
+	ss, err := n.session(id)
+	if err != nil || ss == nil {
+		return nil, err
+	}
+	return &Session{n: n, s: ss}, nil
+}
+
+// ResumeSessions tells the peer of every open session how far this node
+// got, and sends what the peer hasn't acknowledged; the peer does the same
+// in turn. It fails only if the sessions can't be listed.
+func (n *AgentNode) ResumeSessions(ctx context.Context) error {
+	records, err := n.Store.ListSessions()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Closed != "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := n.resumeSession(ctx, r.ID); err != nil {
+			fmt.Printf("[Session] Session %s with %s not resumed: %v\n", r.ID, n.Names.Display(r.PeerID), err)
+		}
+	}
+	return nil
+}
+
+func (n *AgentNode) resumeSession(ctx context.Context, id string) error {
+	ss, err := n.session(id)
+	if err != nil || ss == nil {
+		return err
+	}
+	rec := ss.snapshot()
+	pid, err := peer.Decode(rec.PeerID)
+	if err != nil {
+		return err
+	}
+	ack, err := n.sessionCall(ctx, pid, MessageSessionResume, sessionFrame{SessionID: id, Received: rec.Received})
+	if err != nil {
+		n.sessionFailed(ss, err)
+		return err
+	}
+	n.acked(ss, ack.Received)
+	return n.flush(ctx, ss)
+}
+
+// sessionsStep resumes the sessions a restart interrupted once the node is
+// ready, then closes idle ones until it stops.
+func (n *AgentNode) sessionsStep() BootStep {
+	return BootStep{Name: "sessions", After: []string{"store", "host"}, Run: func(context.Context) error {
+		n.localWG.Add(1)
+		go func() {
+			defer n.localWG.Done()
+			if err := n.WaitReady(n.ctx); err != nil {
+				return
+			}
+			n.ResumeSessions(n.ctx)
+			every := n.sessionTTL() / 4
+			if every > time.Minute {
+				every = time.Minute
+			}
+			ticker := time.NewTicker(every)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-n.ctx.Done():
+					return
+				case now := <-ticker.C:
+					n.expireSessions(n.ctx, now)
+				}
+			}
+		}()
+		return nil
+	}}
+}
+
+// expireSessions closes every open session idle for longer than its TTL
+// at now, telling the peer.
+func (n *AgentNode) expireSessions(ctx context.Context, now time.Time) {
+	records, err := n.Store.ListSessions()
+	if err != nil {
+		fmt.Printf("[Session] Failed to list sessions: %v\n", err)
+		return
+	}
+	for _, r := range records {
+		if r.Closed != "" || now.UnixMilli()-r.LastActive <= r.TTL {
+			continue
+		}
+		ss, err := n.session(r.ID)
+		if err != nil || ss == nil {
+			continue
+		}
+		// The session may have moved since it was listed
+		if rec := ss.snapshot(); now.UnixMilli()-rec.LastActive <= rec.TTL || !n.closeSession(ss, SessionIdle) {
+			continue
+		}
+		if err := n.notifyClose(ctx, ss.snapshot()); err != nil {
+			fmt.Printf("[Session] Couldn't tell %s session %s closed: %v\n", n.Names.Display(r.PeerID), r.ID, err)
+		}
+	}
+}
+
+// closeSession closes ss for reason and reports whether it was open.
+func (n *AgentNode) closeSession(ss *session, reason string) bool {
+	ss.mu.Lock()
+	if ss.rec.Closed != "" {
+		ss.mu.Unlock()
+		return false
+	}
+	ss.rec.Closed = reason
+	rec := ss.rec
+	n.saveSession(rec)
+	ss.mu.Unlock()
+
+	t := n.sessionTable()
+	t.mu.Lock()
+	delete(t.byID, rec.ID)
+	t.mu.Unlock()
+	fmt.Printf("[Session] Session %s with %s closed: %s\n", rec.ID, n.Names.Display(rec.PeerID), reason)
+	n.Events.Add("session_closed", map[string]string{"sessionId": rec.ID, "peerId": rec.PeerID, "reason": reason})
+	if n.OnSessionClose != nil {
+		n.OnSessionClose(rec)
+	}
+	return true
+}
+
+func (n *AgentNode) notifyClose(ctx context.Context, rec SessionRecord) error {
+	pid, err := peer.Decode(rec.PeerID)
+	if err != nil {
+		return err
+	}
+	_, err = n.sessionCall(ctx, pid, MessageSessionClose, sessionFrame{SessionID: rec.ID, Reason: rec.Closed})
+	if errors.Is(err, ErrSessionClosed) {
+		return nil
+	}
+	return err
+}
+
+// sessionFailed closes ss if err says the peer has closed it, or has no
+// such session any more.
+func (n *AgentNode) sessionFailed(ss *session, err error) {
+	var closed *sessionClosedError
+	var pe *PeerError
+	switch {
+	case errors.As(err, &closed):
+		n.closeSession(ss, closed.reason)
+	case errors.As(err, &pe) && pe.Code == ErrCodeNotFound:
+		n.closeSession(ss, "unknown to the peer")
+	}
+}
+
+func (n *AgentNode) saveSession(rec SessionRecord) {
+	if err := n.Store.SaveSession(rec); err != nil {
+		fmt.Printf("[DB] Failed to record session %s: %v\n", rec.ID, err)
+	}
+}
+
+// acked notes that the peer has taken this node's messages up to received.
+func (n *AgentNode) acked(ss *session, received uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if received > ss.rec.Sent {
+		received = ss.rec.Sent
+	}
+	if received <= ss.rec.Acked {
+		return
+	}
+	ss.rec.Acked = received
+	n.saveSession(ss.rec)
+}
+
+// flush sends ss's messages the peer hasn't acknowledged, in order, until
+// there are none or one fails.
+func (n *AgentNode) flush(ctx context.Context, ss *session) error {
+	ss.out.Lock()
+	defer ss.out.Unlock()
+	for {
+		rec := ss.snapshot()
+		if rec.Closed != "" {
+			return ErrSessionClosed
+		}
+		if rec.Acked >= rec.Sent {
+			return nil
+		}
+		pid, err := peer.Decode(rec.PeerID)
+		if err != nil {
+			return err
+		}
+		if err := n.permit(pid, PolicyActionDeliver); err != nil {
+			return err
+		}
+		history, err := n.Store.ListSessionMessages(rec.ID)
+		if err != nil {
+			return err
+		}
+		var pending []SessionMessage
+		for _, m := range history {
+			if m.Outgoing && m.Seq > rec.Acked {
+				pending = append(pending, m)
+			}
+		}
+		sort.Slice(pending, func(i, j int) bool { return pending[i].Seq < pending[j].Seq })
+		for _, m := range pending {
+			ack, err := n.sessionCall(ctx, pid, MessageSessionMessage, sessionFrame{SessionID: rec.ID, Seq: m.Seq, Body: m.Body})
+			if err != nil {
+				n.sessionFailed(ss, err)
+				return err
+			}
+			n.acked(ss, ack.Received)
+			if ack.Received < m.Seq {
+				// The peer lost messages it had acknowledged; they can't be told apart from new ones
+				return fmt.Errorf("peer %s has taken %d messages of session %s, fewer than the %d acknowledged", pid, ack.Received, rec.ID, rec.Acked)
+			}
+		}
+	}
+}
+
+// flushLater flushes ss in the background, unless the node stops first.
+func (n *AgentNode) flushLater(ss *session) {
+	if n.ctx.Err() != nil {
+		return
+	}
+	n.localWG.Add(1)
+	go func() {
+		defer n.localWG.Done()
+		if err := n.flush(n.ctx, ss); err != nil && !errors.Is(err, ErrSessionClosed) {
+			rec := ss.snapshot()
+			fmt.Printf("[Session] %d messages of session %s still queued for %s: %v\n", rec.Sent-rec.Acked, rec.ID, n.Names.Display(rec.PeerID), err)
+		}
+	}()
+}
+
+// sessionClosedError is what a peer answers a frame for a session it has
+// closed with.
+type sessionClosedError struct{ reason string }
+
+func (e *sessionClosedError) Error() string { return "peer closed the session: " + e.reason }
+func (e *sessionClosedError) Unwrap() error { return ErrSessionClosed }
+
+// sessionCall sends one frame to pid and returns its ack.
+func (n *AgentNode) sessionCall(ctx context.Context, pid peer.ID, typ string, f sessionFrame) (*sessionFrame, error) {
+	if err := n.reachPeer(ctx, pid); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sessionTimeout)
+	defer cancel()
+	h := n.CurrentHost()
+	s, err := h.NewStream(network.WithAllowLimitedConn(ctx, "session"), pid, protocol.ID(SessionProtocol))
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	s.SetDeadline(deadline)
+
+	if err := writeMessage(s, AgentMessage{ID: newMessageID(), Type: typ, Payload: f, Sender: h.ID().String(), Timestamp: time.Now().UnixMilli()}); err != nil {
+		return nil, err
+	}
+	resp, err := readMessage(s)
+	if err != nil {
+		return nil, err
+	}
+	var ack sessionFrame
+	switch resp.Type {
+	case MessageError:
+		return nil, peerError(pid.String(), *resp)
+	case MessageSessionAck, MessageSessionClose:
+		if err := UnmarshalPayload(*resp, &ack); err != nil || ack.SessionID != f.SessionID {
+			return nil, fmt.Errorf("peer %s sent an ack that doesn't match session %s", pid, f.SessionID)
+		}
+	default:
+		return nil, fmt.Errorf("peer %s answered a session frame with %q", pid, resp.Type)
+	}
+	if resp.Type == MessageSessionClose {
+		return nil, &sessionClosedError{reason: ack.Reason}
+	}
+	return &ack, nil
+}
+
+// handleSession answers a session frame from a peer.
+func (n *AgentNode) handleSession(s network.Stream) {
+	if n.checkBlocked(s) {
+		return
+	}
+	msg, err := readMessage(s)
+	var f sessionFrame
+	if err == nil {
+		err = UnmarshalPayload(*msg, &f)
+	}
+	if err != nil {
+		n.misbehaved(s, ViolationProtocolError)
+		n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "invalid session frame"})
+		return
+	}
+	from := s.Conn().RemotePeer().String()
+	if msg.Type == MessageSessionOpen {
+		n.acceptSession(s, from, f)
+		return
+	}
+
+	ss, err := n.session(f.SessionID)
+	if err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "session log unavailable", Retryable: true})
+		return
+	}
+	if ss == nil || ss.snapshot().PeerID != from {
+		n.replyError(s, ErrorPayload{Code: ErrCodeNotFound, Message: "no such session"})
+		return
+	}
+	if rec := ss.snapshot(); rec.Closed != "" {
+		n.replySession(s, MessageSessionClose, sessionFrame{SessionID: rec.ID, Reason: rec.Closed})
+		return
+	}
+
+	switch msg.Type {
+	case MessageSessionMessage:
+		n.receiveSessionMessage(s, ss, f)
+	case MessageSessionResume:
+		n.acked(ss, f.Received)
+		n.replySession(s, MessageSessionAck, sessionFrame{SessionID: f.SessionID, Received: ss.snapshot().Received})
+		n.flushLater(ss)
+	case MessageSessionClose:
+		reason := f.Reason
+		if reason == "" {
+			reason = "closed by the peer"
+		}
+		n.closeSession(ss, reason)
+		n.replySession(s, MessageSessionAck, sessionFrame{SessionID: f.SessionID})
+	default:
+		n.replyError(s, ErrorPayload{Code: ErrCodeUnsupported, Message: fmt.Sprintf("unexpected message type %q", msg.Type)})
+	}
+}
+
+// acceptSession opens the session a peer proposed, if the node takes
+// sessions. An open sent again is acknowledged again.
+func (n *AgentNode) acceptSession(s network.Stream, from string, f sessionFrame) {
+	if n.sessionTable().sessionHandler() == nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeUnsupported, Message: "node doesn't take sessions"})
+		return
+	}
+	ttl := n.sessionTTL().Milliseconds()
+	if f.TTL > 0 && f.TTL < ttl {
+		ttl = f.TTL
+	}
+	prev, err := n.session(f.SessionID)
+	if err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "session log unavailable", Retryable: true})
+		return
+	}
+	if prev != nil {
+		if rec := prev.snapshot(); rec.PeerID != from || rec.Initiator {
+			n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "session ID already in use"})
+			return
+		}
+		n.replySession(s, MessageSessionAck, sessionFrame{SessionID: f.SessionID, TTL: prev.snapshot().TTL})
+		return
+	}
+	now := time.Now().UnixMilli()
+	rec := SessionRecord{ID: f.SessionID, PeerID: from, TTL: ttl, CreatedAt: now, LastActive: now}
+	if err := n.Store.SaveSession(rec); err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "session log unavailable", Retryable: true})
+		return
+	}
+	t := n.sessionTable()
+	t.mu.Lock()
+	t.byID[rec.ID] = &session{rec: rec}
+	t.mu.Unlock()
+	n.Events.Add("session_opened", map[string]string{"sessionId": rec.ID, "peerId": from})
+	n.replySession(s, MessageSessionAck, sessionFrame{SessionID: rec.ID, TTL: ttl})
+}
+
+// receiveSessionMessage hands the peer's next message to the session
+// handler and records it. A message already taken is acknowledged again
+// without being handled; one that skips ahead is answered with the count
+// taken, so the peer sends the missing ones first.
+func (n *AgentNode) receiveSessionMessage(s network.Stream, ss *session, f sessionFrame) {
+	ss.in.Lock()
+	defer ss.in.Unlock()
+	if f.Seq == ss.snapshot().Received+1 {
+		m := SessionMessage{SessionID: f.SessionID, Seq: f.Seq, Body: f.Body, At: time.Now().UnixMilli()}
+		if h := n.sessionTable().sessionHandler(); h != nil {
+			if err := h(SessionContext{Context: n.ctx, Session: &Session{n: n, s: ss}}, m); err != nil {
+				n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: err.Error(), Retryable: true})
+				return
+			}
+		}
+		ss.mu.Lock()
+		rec := ss.rec
+		rec.Received, rec.LastActive = f.Seq, m.At
+		err := n.Store.SaveSessionMessage(rec, m)
+		if err == nil {
+			ss.rec = rec
+		}
+		ss.mu.Unlock()
+		if err != nil {
+			n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: "session log unavailable", Retryable: true})
+			return
+		}
+	}
+	rec := ss.snapshot()
+	n.replySession(s, MessageSessionAck, sessionFrame{SessionID: rec.ID, Received: rec.Received})
+	if rec.Acked < rec.Sent {
+		// The peer is back: send what it missed
+		n.flushLater(ss)
+	}
+}
+
+func (n *AgentNode) replySession(s network.Stream, typ string, f sessionFrame) {
+	writeMessage(s, AgentMessage{ID: newMessageID(), Type: typ, Payload: f, Sender: n.CurrentHost().ID().String(), Timestamp: time.Now().UnixMilli()})
+}
+
+// SaveSession records a session's state.
+func (s *sqlStore) SaveSession(r SessionRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`
+		INSERT INTO sessions (id, peer_id, closed, session, created_at, last_active)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET closed = excluded.closed, session = excluded.session, last_active = excluded.last_active`,
+		r.ID, r.PeerID, r.Closed, string(data), r.CreatedAt, r.LastActive)
+	return err
+}
+
+// SaveSessionMessage records m together with the session state it moved
+// r to, so neither is kept without the other.
+func (s *sqlStore) SaveSessionMessage(r SessionRecord, m SessionMessage) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	direction := "in"
+	if m.Outgoing {
+		direction = "out"
+	}
+	_, err = tx.exec(`
+		INSERT INTO session_messages (session_id, direction, seq, body, at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(session_id, direction, seq) DO NOTHING`,
+		m.SessionID, direction, int64(m.Seq), string(m.Body), m.At)
+	if err == nil {
+		err = tx.SaveSession(r)
+	}
+	if err != nil {
+		tx.tx.Rollback()
+		return err
+	}
+	return tx.tx.Commit()
+}
+
+// GetSession returns a session's state, or nil if there is none for id.
+func (s *sqlStore) GetSession(id string) (*SessionRecord, error) {
+	var data string
+	err := s.queryRow("SELECT session FROM sessions WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r SessionRecord
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListSessions returns every session, open and closed, oldest first.
+func (s *sqlStore) ListSessions() ([]SessionRecord, error) {
+	rows, err := s.query("SELECT session FROM sessions ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SessionRecord
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var r SessionRecord
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// ListSessionMessages returns a session's messages both ways, in the order
+// they were queued or taken.
+func (s *sqlStore) ListSessionMessages(sessionID string) ([]SessionMessage, error) {
+	rows, err := s.query(`
+		SELECT direction, seq, body, at FROM session_messages
+		WHERE session_id = ? ORDER BY at, direction, seq`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SessionMessage
+	for rows.Next() {
+		var direction, body string
+		var seq int64
+		m := SessionMessage{SessionID: sessionID}
+		if err := rows.Scan(&direction, &seq, &body, &m.At); err != nil {
+			return nil, err
+		}
+		m.Seq, m.Outgoing, m.Body = uint64(seq), direction == "out", json.RawMessage(body)
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
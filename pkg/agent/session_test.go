@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// conversation records the bodies a session handler took, in order.
+type conversation struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (c *conversation) add(m SessionMessage) string {
+	var body string
+	json.Unmarshal(m.Body, &body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodies = append(c.bodies, body)
+	return body
+}
+
+func (c *conversation) get() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.bodies...)
+}
+
+// waitFor waits for c to have taken want.
+func (c *conversation) waitFor(t *testing.T, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !equalStrings(c.get(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("took %q, want %q", c.get(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionResumesAcrossARestart(t *testing.T) {
+	dir := t.TempDir()
+	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The responder answers each message, after checking it has the
+	// conversation so far
+	var taken conversation
+	responder := func() *AgentNode {
+		store, err := OpenMetadataStore(DriverSQLite, filepath.Join(dir, "agent.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := NewAgentNodeWithStore(store, dir)
+		b.SetIdentity(priv)
+		b.SetSessionHandler(func(sc SessionContext, m SessionMessage) error {
+			history, err := sc.History()
+			if err != nil {
+				return err
+			}
+			if want := 2*int(m.Seq) - 2; len(history) != want {
+				return fmt.Errorf("message %d came with %d messages of history, want %d", m.Seq, len(history), want)
+			}
+			body := taken.add(m)
+			return sc.Reply("re: " + body)
+		})
+		if err := b.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	b := responder()
+
+	// The opener refuses the second reply once, so it is still queued when
+	// the responder stops
+	var replies conversation
+	refused := make(chan struct{})
+	var once sync.Once
+	a := startTestNode(t)
+	a.SetSessionHandler(func(sc SessionContext, m SessionMessage) error {
+		if m.Seq == 2 {
+			var first bool
+			once.Do(func() { first = true; close(refused) })
+			if first {
+				return errors.New("not now")
+			}
+		}
+		replies.add(m)
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	bid, err := a.addTarget(dialAddr(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := a.OpenSession(ctx, bid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"m1", "m2"} {
+		if err := sess.Send(ctx, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replies.waitFor(t, "re: m1")
+	<-refused
+	if err := b.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	b = responder()
+	defer b.Stop()
+	a.addTarget(dialAddr(b))
+	b.addTarget(dialAddr(a))
+	if err := b.ResumeSessions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	replies.waitFor(t, "re: m1", "re: m2")
+
+	// As if the opener lost the ack for m2: it is sent again with m3
+	ss, _ := a.session(sess.ID())
+	ss.mu.Lock()
+	ss.rec.Acked = 1
+	ss.mu.Unlock()
+	if err := sess.Send(ctx, "m3"); err != nil {
+		t.Fatal(err)
+	}
+	replies.waitFor(t, "re: m1", "re: m2", "re: m3")
+	if got, want := taken.get(), []string{"m1", "m2", "m3"}; !equalStrings(got, want) {
+		t.Errorf("responder took %q, want %q", got, want)
+	}
+	if r := sess.Record(); r.Sent != 3 || r.Acked != 3 || r.Received != 3 {
+		t.Errorf("opener's session = %+v, want 3 messages each way", r)
+	}
+	resumed, err := b.Session(sess.ID())
+	if err != nil || resumed == nil {
+		t.Fatalf("responder's session: %v", err)
+	}
+	if history, _ := resumed.History(); len(history) != 6 {
+		t.Errorf("responder's history has %d messages, want 6", len(history))
+	}
+}
+
+func TestIdleSessionsClose(t *testing.T) {
+	a, b := startTestNode(t), newTestNode(t)
+	// Set before Start: the sessions step reads them once the node is ready
+	b.SessionTTL = time.Minute
+	b.SetSessionHandler(func(SessionContext, SessionMessage) error { return nil })
+	closed := make(chan SessionRecord, 1)
+	b.OnSessionClose = func(r SessionRecord) { closed <- r }
+	if err := b.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	bid, err := a.addTarget(dialAddr(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := a.OpenSession(ctx, bid.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := sess.Record().TTL; ttl != time.Minute.Milliseconds() {
+		t.Errorf("agreed TTL = %dms, want the responder's minute", ttl)
+	}
+
+	a.expireSessions(ctx, time.Now().Add(30*time.Second))
+	if err := sess.Send(ctx, "still here"); err != nil {
+		t.Fatal(err)
+	}
+	a.expireSessions(ctx, time.Now().Add(2*time.Minute))
+	select {
+	case r := <-closed:
+		if r.ID != sess.ID() || r.Closed != SessionIdle {
+			t.Errorf("responder was told %+v", r)
+		}
+	case <-ctx.Done():
+		t.Fatal("responder wasn't told the session closed")
+	}
+	if err := sess.Send(ctx, "too late"); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("sending on an expired session: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// VerificationMode is how the node treats a signature that doesn't verify
+// on a capability or catalog announcement, a peer ID binding or a moved
+// notice. Signatures money depends on, those of offers, agreements,
+// acknowledgements, receipts and interaction records, are checked in every
+// mode.
+type VerificationMode string
+
+const (
+	VerifyStrict     VerificationMode = "strict"     // reject what doesn't verify; the default
+	VerifyPermissive VerificationMode = "permissive" // accept it, marked unverified
+	VerifyOff        VerificationMode = "off"        // check nothing and take everything as verified; for development only
+)
+
+// ErrUnverifiedSignature means a signature doesn't verify.
+var ErrUnverifiedSignature = errors.New("signature does not verify")
+
+// ParseVerificationMode parses a mode by name; "" is VerifyStrict.
+func ParseVerificationMode(s string) (VerificationMode, error) {
+	switch m := VerificationMode(s); m {
+	case "":
+		return VerifyStrict, nil
+	case VerifyStrict, VerifyPermissive, VerifyOff:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown verification mode %q: want %s, %s or %s", s, VerifyStrict, VerifyPermissive, VerifyOff)
+}
+
+// String names the mode, "strict" for the zero value.
+func (m VerificationMode) String() string {
+	if m == "" {
+		return string(VerifyStrict)
+	}
+	return string(m)
+}
+
+// strict reports whether m is VerifyStrict, which the zero value is too.
+func (m VerificationMode) strict() bool {
+	return m == "" || m == VerifyStrict
+}
+
+// admit decides on a message of kind from sender, whose signature check is
+// verify. It reports whether the message is accepted and whether it is to
+// be taken as verified.
+func (m VerificationMode) admit(kind, sender string, verify func() bool) (accept, verified bool) {
+	if m == VerifyOff {
+		return true, true
+	}
+	if verify() {
+		return true, true
+	}
+	if m == VerifyPermissive {
+		fmt.Printf("[Security] Accepted %s from %s unverified: invalid signature\n", kind, sender)
+		return true, false
+	}
+	fmt.Printf("[Security] Rejected %s from %s: invalid signature\n", kind, sender)
+	return false, false
+}
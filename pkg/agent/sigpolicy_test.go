@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestVerificationModes(t *testing.T) {
+	otherKey, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	for _, mode := range []VerificationMode{"", VerifyStrict, VerifyPermissive, VerifyOff} {
+		n := newTestNode(t)
+		n.Verification = mode
+		var heard []Announcement
+		n.OnAnnouncement(func(a Announcement) { heard = append(heard, a) })
+
+		// An announcement whose signature is another's
+		pid, packet := advertisement(t, "summarize", nil)
+		_, other := advertisement(t, "summarize", nil)
+		packet.Signature = other.Signature
+		accepted := n.handleAdvertisement(packet)
+		routes := n.Routes.Snapshot()
+
+		// A moved notice signed by a key other than the old one
+		newID, _ := peer.IDFromPrivateKey(otherKey)
+		notice, _ := signMovedNotice(otherKey, MovedNotice{OldPeerID: pid.String(), NewPeerID: newID.String(), Until: 1})
+		moved, err := n.decodeMoved(pid, notice)
+
+		switch mode {
+		case "", VerifyStrict:
+			if accepted || len(routes) != 0 || len(heard) != 0 {
+				t.Errorf("%s: accepted = %v, routes = %+v, heard %+v; want the announcement rejected", mode, accepted, routes, heard)
+			}
+			if err == nil {
+				t.Errorf("%s: moved notice accepted", mode)
+			}
+		case VerifyPermissive:
+			if !accepted || len(heard) != 1 || heard[0].Verified || len(routes) != 1 || !routes[0].Peers[0].Quarantined {
+				t.Errorf("permissive: accepted = %v, routes = %+v, heard %+v; want it quarantined and unverified", accepted, routes, heard)
+			}
+			if err != nil || moved.Verified {
+				t.Errorf("permissive: moved = %+v, %v; want it unverified", moved, err)
+			}
+		case VerifyOff:
+			if !accepted || len(heard) != 1 || !heard[0].Verified || len(routes) != 1 || routes[0].Peers[0].Quarantined {
+				t.Errorf("off: accepted = %v, routes = %+v, heard %+v; want it routed", accepted, routes, heard)
+			}
+			if err != nil || !moved.Verified {
+				t.Errorf("off: moved = %+v, %v; want it taken as verified", moved, err)
+			}
+		}
+	}
+
+	if _, err := ParseVerificationMode("lax"); err == nil {
+		t.Error("ParseVerificationMode accepted an unknown mode")
+	}
+}
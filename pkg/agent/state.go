@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// StateSnapshot is what the node knows about the mesh at one instant: where
+// capabilities are served, who the agents it met are, how to reach their
+// peers and how fast they answer, and how far it has read each chain. It is
+// served by GET /state.
+type StateSnapshot struct {
+	GeneratedAt  int64               `json:"generatedAt"` // unix ms
+	Routes       []Route             `json:"routes"`
+	AddressBook  []AddressBookEntry  `json:"addressBook"`
+	Reachability []PeerReachability  `json:"reachability"`
+	Latency      []PeerLatency       `json:"latency"`
+	Checkpoints  []WatcherCheckpoint `json:"checkpoints"`
+}
+
+// PeerReachability is what the node's peerstore holds for one peer: the
+// addresses reachPeer tries first, and whether it is connected now. A peer
+// that dialled in may be connected with no addresses known.
+type PeerReachability struct {
+	PeerID        string   `json:"peerId"`
+	Connectedness string   `json:"connectedness"`
+	Addrs         []string `json:"addrs"`
+}
+
+// WatcherCheckpoint is how far one chain watcher has read.
+type WatcherCheckpoint struct {
+	Name      string `json:"name"`
+	ChainID   uint64 `json:"chainId,omitempty"`
+	LastBlock uint64 `json:"lastBlock"`           // last block processed in memory
+	Persisted uint64 `json:"persisted,omitempty"` // last block stored, if checkpoints are on
+}
+
+// DumpState returns a snapshot of the routing table, address book,
+// peerstore, probed latencies and watcher checkpoints. The table is read under its lock and
+// the database in one read transaction, so neither is seen half-updated.
+func (n *AgentNode) DumpState() (StateSnapshot, error) {
+	snap := StateSnapshot{
+		GeneratedAt:  time.Now().UnixMilli(),
+		Routes:       n.Routes.Snapshot(),
+		AddressBook:  []AddressBookEntry{},
+		Reachability: []PeerReachability{},
+		Latency:      n.Latencies.Snapshot(),
+		Checkpoints:  []WatcherCheckpoint{},
+	}
+	for _, w := range n.watchers() {
+		snap.Checkpoints = append(snap.Checkpoints, WatcherCheckpoint{Name: w.checkpoint, ChainID: w.ChainID(), LastBlock: w.LastBlock()})
+	}
+
+	if h := n.CurrentHost(); h != nil {
+		// Peers with known addresses, and connected ones that dialled in
+		seen := map[peer.ID]bool{h.ID(): true}
+		for _, pid := range append(h.Peerstore().PeersWithAddrs(), h.Network().Peers()...) {
+			if seen[pid] {
+				continue
+			}
+			seen[pid] = true
+			p := PeerReachability{PeerID: pid.String(), Connectedness: h.Network().Connectedness(pid).String(), Addrs: []string{}}
+			for _, a := range h.Peerstore().Addrs(pid) {
+				p.Addrs = append(p.Addrs, a.String())
+			}
+			snap.Reachability = append(snap.Reachability, p)
+		}
+		sort.Slice(snap.Reachability, func(i, j int) bool { return snap.Reachability[i].PeerID < snap.Reachability[j].PeerID })
+	}
+
+	if n.Store == nil {
+		return snap, nil
+	}
+	err := readConsistent(n.Store, func(s MetadataStore) error {
+		entries, err := s.ListAddresses()
+		if err != nil {
+			return err
+		}
+		if entries != nil {
+			snap.AddressBook = entries
+		}
+		for i := range snap.Checkpoints {
+			c := &snap.Checkpoints[i]
+			if c.Name == "" {
+				continue
+			}
+			if c.Persisted, _, err = s.GetCheckpoint(c.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return snap, err
+}
+
+// readConsistent runs fn against a read transaction of store's database,
+// or against store itself if it isn't a SQL store.
+func readConsistent(store MetadataStore, fn func(MetadataStore) error) error {
+	s, _ := store.(*sqlStore)
+	if b, ok := store.(*WriteBatcher); ok {
+		s = b.store
+	}
+	if s == nil {
+		return fn(store)
+	}
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.tx.Rollback()
+	return fn(tx)
+}
@@ -0,0 +1,410 @@
+package agent
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Supported metadata database drivers.
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// MetadataStore is the node's persistent state: the remote knowledge index,
+// tasks, peers, the wallet address book, watcher checkpoints and dead letters,
+// the local reputation ledger, validations, and processed event markers. SQLite is the
+// default backend; Postgres lets several node processes share state.
+type MetadataStore interface {
+	// Remote knowledge index
+	IndexRemoteKnowledge(offer KnowledgeOffer, tags []string) error
+	SearchRemoteIndex(tag string) ([]KnowledgeOffer, error)
+
+	// Tasks
+	SaveTask(t TaskRecord) error
+	UpdateTaskStatus(id, status string) error
+	SetTaskVerdict(id string, v Verdict) error
+	SetTaskVerification(id string, v ResultVerification) error
+	ListTasks(limit int) ([]TaskRecord, error)
+	GetTask(id string) (*TaskRecord, error)
+	DeleteTask(id string) error
+	RecordTaskRun(capability string, d time.Duration) error
+	EstimateTaskRun(capability string) (time.Duration, bool, error)
+
+	// Peers
+	TouchPeer(peerID, ethAddress, capability string) error
+	ListPeers() ([]PeerRecord, error)
+	SetPeerBlocked(peerID string, blocked bool) error
+	IsPeerBlocked(peerID string) bool
+	GetPeer(peerID string) (*PeerRecord, error)
+	SetPeerMisbehavior(peerID string, score float64, at, bannedUntil int64) error
+	AddPeerBan(b PeerBan) error
+	ListPeerBans(peerID string) ([]PeerBan, error)
+
+	// Agents and the wallet address book
+	SaveAddress(e AddressBookEntry) error
+	LookupAddress(wallet string) (*AddressBookEntry, error)
+	LookupPeerAddress(peerID string) (*AddressBookEntry, error)
+	ListAddresses() ([]AddressBookEntry, error)
+	RewindAddressScans(block uint64) (int64, error)
+
+	// Watcher checkpoints, keyed by watcher name
+	GetCheckpoint(name string) (uint64, bool, error)
+	SetCheckpoint(name string, block uint64) error
+
+	// Watcher events whose callbacks failed, keyed by event ID
+	SaveDeadLetter(d DeadLetter) error
+	GetDeadLetter(id string) (*DeadLetter, error)
+	ListDeadLetters() ([]DeadLetter, error)
+	DeleteDeadLetter(id string) error
+
+	// Local reputation ledger, keyed by agentId
+	SaveLedgerEntry(e LedgerEntry) error
+	GetLedgerEntry(agentId string) (*LedgerEntry, error)
+	ListLedgerEntries() ([]LedgerEntry, error)
+
+	// Validations this node was asked for, keyed by request hash
+	SaveValidation(r ValidationRecord) error
+	GetValidation(requestHash string) (*ValidationRecord, error)
+	ListValidations() ([]ValidationRecord, error)
+
+	// Agreements reached by negotiation, keyed by negotiation ID
+	SaveAgreement(a Agreement) error
+	GetAgreement(negotiationID string) (*Agreement, error)
+	ListAgreements() ([]Agreement, error)
+
+	// Listings of the node's knowledge catalog, keyed by listing ID; an
+	// artifact hash is listed once
+	SaveListing(l CatalogListing) error
+	GetListing(id string) (*CatalogListing, error)
+	GetListingByAsset(assetHash string) (*CatalogListing, error)
+	ListListings() ([]CatalogListing, error)
+	DeleteListing(id string) error
+
+	// Answers to knowledge requests on their way to the requester, and
+	// answers received, keyed by correlation ID
+	SaveDelivery(d KnowledgeDelivery) error
+	GetDelivery(id string) (*KnowledgeDelivery, error)
+	ListDeliveries() ([]KnowledgeDelivery, error)
+
+	// Records of completed exchanges signed by both parties, keyed by
+	// record hash
+	SaveInteraction(r InteractionRecord) error
+	GetInteraction(id string) (*InteractionRecord, error)
+	ListInteractions() ([]InteractionRecord, error)
+
+	// Sessions and the messages sent on them both ways, keyed by session
+	// ID; a message is saved with the session state it moves to
+	SaveSession(r SessionRecord) error
+	SaveSessionMessage(r SessionRecord, m SessionMessage) error
+	GetSession(id string) (*SessionRecord, error)
+	ListSessions() ([]SessionRecord, error)
+	ListSessionMessages(sessionID string) ([]SessionMessage, error)
+
+	// Budget held for bids by a CapitalTracker, keyed by task ID
+	SaveReservation(r CapitalReservation) error
+	DeleteReservation(taskID string) error
+	ListReservations() ([]CapitalReservation, error)
+
+	// Runs of capability handlers, kept by CapabilityAnalytics, and their
+	// sums by day, keyed by day and capability
+	RecordInvocation(inv CapabilityInvocation) error
+	ListInvocations(capability string, from, to int64) ([]CapabilityInvocation, error)
+	SettleInvocations(taskID, revenue string) error
+	DeleteInvocationsBefore(before int64) error
+	SaveCapabilityDay(d CapabilityDay) error
+	ListCapabilityDays(from, to string) ([]CapabilityDay, error)
+
+	// Capability answers kept by an AnswerCache, keyed by capability and
+	// query hash
+	SaveCachedAnswer(a CachedAnswer) error
+	GetCachedAnswer(capability, queryHash string) (*CachedAnswer, error)
+	ListCachedAnswers() ([]CachedAnswer, error)
+	DeleteCachedAnswer(capability, queryHash string) error
+
+	// RPC answers that can't change, kept by an RPCCache
+	SaveRPCResult(e RPCCacheEntry) error
+	GetRPCResult(key string) (*RPCCacheEntry, error)
+
+	// MarkProcessed records an event ID and reports whether it was new, so an
+	// event delivered twice (restart, overlapping poll) is handled once.
+	MarkProcessed(id string) (bool, error)
+
+	// Leases back leader election: AcquireLease takes or renews the named
+	// lease for holder and reports whether holder owns it afterwards.
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(name, holder string) error
+	LeaseHolder(name string) (string, error)
+
+	// Identity key rotations still inside their grace period
+	SaveKeyRotation(r KeyRotation) error
+	PendingKeyRotations() ([]KeyRotation, error)
+	MarkKeyRetired(oldPeerID string) error
+
+	// AppendAudit records a security-relevant action.
+	AppendAudit(kind, subject, detail string) error
+
+	SchemaVersion() (int, error)
+	Close() error
+}
+
+// OpenMetadataStore opens and migrates a metadata database. For sqlite the dsn
+// is a file path; for postgres it is a connection string or URL.
+func OpenMetadataStore(driver, dsn string) (MetadataStore, error) {
+	if driver == "" {
+		driver = DriverSQLite
+	}
+	if driver != DriverSQLite && driver != DriverPostgres {
+		return nil, fmt.Errorf("unsupported database driver %q (want %s or %s)", driver, DriverSQLite, DriverPostgres)
+	}
+
+	if driver == DriverSQLite {
+		// Wait for a concurrent writer, such as the watcher or another
+		// process, rather than failing at once with SQLITE_BUSY
+		dsn = sqliteURI(dsn, "_pragma=busy_timeout(5000)")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	s := &sqlStore{db: db, driver: driver}
+
+	// Bring the schema up to date before anything touches it
+	if err := migrate(s); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+	return s, nil
+}
+
+// ErrSchemaMismatch is returned by OpenMetadataStoreReadOnly when the database
+// is not at this binary's schema version.
+var ErrSchemaMismatch = errors.New("metadata database schema version does not match this binary")
+
+// OpenMetadataStoreReadOnly opens an existing metadata database for reading
+// without migrating it, for tools that must not change the schema or print
+// migration output. A SQLite file is opened read-only and never created. The
+// database must be at LatestSchemaVersion; otherwise the error wraps
+// ErrSchemaMismatch.
+func OpenMetadataStoreReadOnly(driver, dsn string) (MetadataStore, error) {
+	if driver == "" {
+		driver = DriverSQLite
+	}
+	switch driver {
+	case DriverSQLite:
+		dsn = sqliteURI(dsn, "mode=ro")
+	case DriverPostgres:
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q (want %s or %s)", driver, DriverSQLite, DriverPostgres)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version != LatestSchemaVersion() {
+		db.Close()
+		return nil, fmt.Errorf("%w: database is at version %d, binary expects %d", ErrSchemaMismatch, version, LatestSchemaVersion())
+	}
+	return &sqlStore{db: db, driver: driver}, nil
+}
+
+// sqliteURI turns a database path into a SQLite URI with query parameters.
+func sqliteURI(path, query string) string {
+	// SQLite URIs need '%', '?' and '#' escaped in the path
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path) + "?" + query
+}
+
+// sqlStore implements MetadataStore over database/sql. Queries are written
+// with '?' placeholders and SQL that both SQLite and Postgres accept;
+// rebind translates placeholders for Postgres.
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+	tx     *sql.Tx // set on a store bound to a transaction, which runs every statement in it
+}
+
+func (s *sqlStore) rebind(query string) string {
+	if s.driver != DriverPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	if s.tx != nil {
+		return s.tx.Exec(s.rebind(query), args...)
+	}
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if s.tx != nil {
+		return s.tx.Query(s.rebind(query), args...)
+	}
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	if s.tx != nil {
+		return s.tx.QueryRow(s.rebind(query), args...)
+	}
+	return s.db.QueryRow(s.rebind(query), args...)
+}
+
+// begin opens a transaction and returns a store bound to it.
+func (s *sqlStore) begin() (*sqlStore, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: s.db, driver: s.driver, tx: tx}, nil
+}
+
+func (s *sqlStore) SchemaVersion() (int, error) {
+	return SchemaVersion(s.db)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) IndexRemoteKnowledge(offer KnowledgeOffer, tags []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.rebind(`
+		INSERT INTO remote_knowledge (topic_hash, topic, summary, author, provider_id, price, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(topic_hash) DO UPDATE SET topic = excluded.topic, summary = excluded.summary, author = excluded.author,
+			provider_id = excluded.provider_id, price = excluded.price, timestamp = excluded.timestamp`),
+		offer.TopicHash, offer.Topic, offer.Summary, offer.Author, offer.Provider, offer.Price, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, tag := range tags {
+		tx.Exec(s.rebind("INSERT INTO remote_tags (tag, topic_hash) VALUES (?, ?)"), tag, offer.TopicHash)
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) SearchRemoteIndex(tag string) ([]KnowledgeOffer, error) {
+	rows, err := s.query(`
+		SELECT k.topic_hash, k.topic, k.summary, k.provider_id, k.price
+		FROM remote_knowledge k
+		JOIN remote_tags t ON k.topic_hash = t.topic_hash
+		WHERE t.tag = ?`, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []KnowledgeOffer
+	for rows.Next() {
+		var offer KnowledgeOffer
+		if err := rows.Scan(&offer.TopicHash, &offer.Topic, &offer.Summary, &offer.Provider, &offer.Price); err == nil {
+			results = append(results, offer)
+		}
+	}
+	return results, nil
+}
+
+func (s *sqlStore) GetCheckpoint(name string) (uint64, bool, error) {
+	var block int64
+	err := s.queryRow("SELECT block FROM checkpoints WHERE name = ?", name).Scan(&block)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint64(block), true, nil
+}
+
+func (s *sqlStore) SetCheckpoint(name string, block uint64) error {
+	_, err := s.exec(`
+		INSERT INTO checkpoints (name, block, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET block = excluded.block, updated_at = excluded.updated_at`,
+		name, int64(block), time.Now().Unix())
+	return err
+}
+
+func (s *sqlStore) MarkProcessed(id string) (bool, error) {
+	res, err := s.exec(`
+		INSERT INTO processed_events (id, processed_at) VALUES (?, ?)
+		ON CONFLICT(id) DO NOTHING`, id, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *sqlStore) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UnixMilli()
+	// The conditional upsert is atomic in both SQLite and Postgres: it only
+	// overwrites a lease that we already hold or that has expired.
+	res, err := s.exec(`
+		INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at < ?`,
+		name, holder, now+ttl.Milliseconds(), now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *sqlStore) ReleaseLease(name, holder string) error {
+	_, err := s.exec("DELETE FROM leases WHERE name = ? AND holder = ?", name, holder)
+	return err
+}
+
+// LeaseHolder returns the current unexpired holder of a lease, or "".
+func (s *sqlStore) LeaseHolder(name string) (string, error) {
+	var holder string
+	err := s.queryRow("SELECT holder FROM leases WHERE name = ? AND expires_at >= ?", name, time.Now().UnixMilli()).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return holder, err
+}
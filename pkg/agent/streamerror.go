@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// MessageError is the AgentMessage type of a failed request; its payload is
+// an ErrorPayload.
+const MessageError = "error"
+
+// streamReadTimeout bounds how long a handler waits for the request. It is a
+// variable so tests can shorten it.
+var streamReadTimeout = 30 * time.Second
+
+// Error codes carried in ErrorPayload.Code.
+const (
+	ErrCodeBadRequest     = "bad_request" // unreadable or malformed message
+	ErrCodeUnsupported    = "unsupported" // message type the protocol doesn't handle
+	ErrCodeForbidden      = "forbidden"   // blocked peer or denied resource
+	ErrCodeNotFound       = "not_found"
+	ErrCodeTimeout        = "timeout"
+	ErrCodeNoRoute        = "no_route"         // forwarding found no capable peer
+	ErrCodeHopLimit       = "hop_limit"        // forwarding gave up to avoid a loop
+	ErrCodeBusy           = "busy"             // every worker is taken and the task queue is full
+	ErrCodeTooManyStreams = "too_many_streams" // the peer has as many task streams open as it may
+	ErrCodeInternal       = "internal"
+)
+
+// ErrorPayload is the payload of an error message: a machine-readable Code,
+// a human-readable Message and whether the same request may succeed later.
+type ErrorPayload struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+// Validate requires a code, which is what the error is matched by.
+func (p ErrorPayload) Validate() error {
+	if p.Code == "" {
+		return errors.New("error without a code")
+	}
+	return nil
+}
+
+// PeerError is returned by SendTask and Ping when the peer answered with an
+// error message. Use errors.As to inspect the code.
+type PeerError struct {
+	PeerID string
+	ErrorPayload
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %s: %s", e.PeerID, e.Code, e.Message)
+}
+
+// peerError decodes the ErrorPayload of an error message from a peer ID or,
+// for agents reached over HTTP, an endpoint.
+func peerError(from string, msg AgentMessage) *PeerError {
+	e := &PeerError{PeerID: from}
+	if err := UnmarshalPayload(msg, &e.ErrorPayload); err != nil {
+		e.ErrorPayload = ErrorPayload{Code: ErrCodeInternal, Message: "malformed error message"}
+	}
+	return e
+}
+
+// errorMessage wraps p in an error message from this node.
+func (n *AgentNode) errorMessage(p ErrorPayload) AgentMessage {
+	return AgentMessage{
+		Type:      MessageError,
+		Payload:   p,
+		Sender:    n.CurrentHost().ID().String(),
+		Timestamp: time.Now().UnixMilli(),
+	}
+}
+
+// replyError answers the request on s with an error message.
+func (n *AgentNode) replyError(s network.Stream, p ErrorPayload) {
+	writeMessage(s, n.errorMessage(p))
+}
+
+// handleStream wraps a protocol handler: the stream is always closed, and a
+// panicking handler answers with an internal error instead of killing the node.
+func (n *AgentNode) handleStream(name string, fn func(s network.Stream)) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("[P2P] %s handler failed for %s: %v\n", name, s.Conn().RemotePeer(), r)
+				n.replyError(s, ErrorPayload{Code: ErrCodeInternal, Message: name + " handler failed"})
+			}
+		}()
+		fn(s)
+	}
+}
+
+// readRequest reads one request within streamReadTimeout. On failure the
+// peer has already been answered and ok is false.
+func (n *AgentNode) readRequest(s network.Stream) (data []byte, ok bool) {
+	s.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	data, err := readLP(s)
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			n.replyError(s, ErrorPayload{Code: ErrCodeTimeout, Message: "timed out waiting for the request", Retryable: true})
+		} else if errors.Is(err, errMessageTooLarge) {
+			n.misbehaved(s, ViolationOversized)
+			n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "unreadable request: " + err.Error()})
+		} else {
+			n.misbehaved(s, ViolationProtocolError)
+			n.replyError(s, ErrorPayload{Code: ErrCodeBadRequest, Message: "unreadable request: " + err.Error()})
+		}
+		return nil, false
+	}
+	s.SetReadDeadline(time.Time{})
+	return data, true
+}
+
+// checkBlocked answers a blocked peer, or one the identity policy denies,
+// with a forbidden error and reports whether it was refused.
+func (n *AgentNode) checkBlocked(s network.Stream) bool {
+	if n.Store.IsPeerBlocked(s.Conn().RemotePeer().String()) {
+		n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: "peer is blocked"})
+		return true
+	}
+	if err := n.permit(s.Conn().RemotePeer(), PolicyActionServe); err != nil {
+		n.replyError(s, ErrorPayload{Code: ErrCodeForbidden, Message: err.Error()})
+		return true
+	}
+	return false
+}
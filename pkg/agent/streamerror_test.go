@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// request opens a stream from client to server on proto, writes raw and
+// returns the error payload server answered with.
+func request(t *testing.T, client, server *AgentNode, proto string, raw []byte) ErrorPayload {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := peer.AddrInfoFromString(dialAddr(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CurrentHost().Connect(ctx, *info); err != nil {
+		t.Fatal(err)
+	}
+	s, err := client.CurrentHost().NewStream(ctx, info.ID, protocol.ID(proto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readLP(s)
+	if err != nil {
+		t.Fatalf("reading the answer: %v", err)
+	}
+	var msg AgentMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("answer %q: %v", data, err)
+	}
+	if msg.Type != MessageError {
+		t.Fatalf("answer type %q, want %q", msg.Type, MessageError)
+	}
+	return peerError(info.ID.String(), msg).ErrorPayload
+}
+
+// lp frames data as one length-prefixed message.
+func lp(data []byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+}
+
+func TestStreamErrors(t *testing.T) {
+	server := startTestNode(t)
+	client := startTestNode(t)
+
+	tests := []struct {
+		name      string
+		raw       []byte
+		code      string
+		message   string
+		retryable bool
+	}{
+		{"bad JSON", lp([]byte("{not json")), ErrCodeBadRequest, "invalid JSON", false},
+		{"unsupported type", lp([]byte(`{"type":"gossip","payload":{}}`)), ErrCodeUnsupported, `unsupported message type "gossip"`, false},
+		{"oversized message", binary.AppendUvarint(nil, maxMessageSize+1), ErrCodeBadRequest, "unreadable request", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := request(t, client, server, TaskProtocol, tt.raw)
+			if got.Code != tt.code || !strings.Contains(got.Message, tt.message) || got.Retryable != tt.retryable {
+				t.Errorf("answer = %+v, want code %s, retryable %t, message containing %q", got, tt.code, tt.retryable, tt.message)
+			}
+		})
+	}
+}
+
+func TestStreamErrorBlockedPeer(t *testing.T) {
+	server := startTestNode(t)
+	client := startTestNode(t)
+	if err := server.Store.SetPeerBlocked(client.CurrentHost().ID().String(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	got := request(t, client, server, TaskProtocol, lp([]byte(`{"type":"task","payload":{}}`)))
+	if got.Code != ErrCodeForbidden || got.Retryable {
+		t.Errorf("answer = %+v, want a final %s error", got, ErrCodeForbidden)
+	}
+}
+
+func TestStreamErrorTimeout(t *testing.T) {
+	// Restored after the nodes stop, so no handler reads it concurrently
+	saved := streamReadTimeout
+	t.Cleanup(func() { streamReadTimeout = saved })
+	streamReadTimeout = 200 * time.Millisecond
+
+	server := startTestNode(t)
+	client := startTestNode(t)
+
+	// Announce ten bytes and never send them
+	got := request(t, client, server, TaskProtocol, binary.AppendUvarint(nil, 10))
+	if got.Code != ErrCodeTimeout || !got.Retryable {
+		t.Errorf("answer = %+v, want a retryable %s error", got, ErrCodeTimeout)
+	}
+}
+
+func TestStreamErrorHandlerPanic(t *testing.T) {
+	server := startTestNode(t)
+	client := startTestNode(t)
+	const proto = "/agentmesh/test-panic/1.0.0"
+	server.CurrentHost().SetStreamHandler(protocol.ID(proto), server.handleStream("panic", func(s network.Stream) {
+		readLP(s)
+		panic("boom")
+	}))
+
+	got := request(t, client, server, proto, lp([]byte(`{}`)))
+	if got.Code != ErrCodeInternal || got.Message != "panic handler failed" {
+		t.Errorf("answer = %+v, want %s \"panic handler failed\"", got, ErrCodeInternal)
+	}
+
+	// The node keeps serving after the panic
+	if _, err := client.Ping(context.Background(), dialAddr(server)); err != nil {
+		t.Errorf("ping after handler panic: %v", err)
+	}
+}
+
+func TestSendTaskReturnsPeerError(t *testing.T) {
+	server := startTestNode(t)
+	client := startTestNode(t)
+	if err := server.Store.SetPeerBlocked(client.CurrentHost().ID().String(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.SendTask(ctx, dialAddr(server), map[string]interface{}{"hello": "world"})
+	var pe *PeerError
+	if !errors.As(err, &pe) {
+		t.Fatalf("SendTask error = %v (%T), want a *PeerError", err, err)
+	}
+	if pe.Code != ErrCodeForbidden || pe.PeerID != server.CurrentHost().ID().String() {
+		t.Errorf("PeerError = %+v, want %s from %s", pe, ErrCodeForbidden, server.CurrentHost().ID())
+	}
+}
+
+func TestPeerErrorMalformedPayload(t *testing.T) {
+	pid, err := peer.Decode("QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := peerError(pid.String(), AgentMessage{Type: MessageError, Payload: "not an error payload"})
+	if e.Code != ErrCodeInternal || e.Message != "malformed error message" {
+		t.Errorf("peerError = %+v, want %s \"malformed error message\"", e, ErrCodeInternal)
+	}
+}
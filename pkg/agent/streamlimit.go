@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// DefaultStreamsPerPeer is how many task streams one peer may have open at
+// once unless configured otherwise.
+const DefaultStreamsPerPeer = 8
+
+// StreamLimiter bounds how many task streams each peer has open at once.
+// Where the task pool bounds the work of all peers together, it keeps one
+// peer from multiplexing enough streams over its connection to take every
+// worker. A nil *StreamLimiter admits every stream.
+type StreamLimiter struct {
+	limit int
+
+	mu      sync.Mutex
+	streams map[string]int // open streams, by peer ID
+}
+
+// NewStreamLimiter admits up to limit concurrent streams per peer; a
+// non-positive limit takes DefaultStreamsPerPeer.
+func NewStreamLimiter(limit int) *StreamLimiter {
+	if limit <= 0 {
+		limit = DefaultStreamsPerPeer
+	}
+	return &StreamLimiter{limit: limit, streams: make(map[string]int)}
+}
+
+// Acquire admits a stream from peer and returns how many it has open,
+// including this one. It reports false, admitting nothing, when peer is at
+// the limit. Every admitted stream must be released.
+func (l *StreamLimiter) Acquire(peer string) (int, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.streams[peer] >= l.limit {
+		return l.streams[peer], false
+	}
+	l.streams[peer]++
+	return l.streams[peer], true
+}
+
+// Release ends a stream Acquire admitted.
+func (l *StreamLimiter) Release(peer string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.streams[peer]--; l.streams[peer] <= 0 {
+		delete(l.streams, peer)
+	}
+}
+
+// Open returns how many streams peer has open.
+func (l *StreamLimiter) Open(peer string) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.streams[peer]
+}
+
+// Counts returns how many streams each peer with any has open.
+func (l *StreamLimiter) Counts() map[string]int {
+	counts := make(map[string]int)
+	if l == nil {
+		return counts
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for peer, open := range l.streams {
+		counts[peer] = open
+	}
+	return counts
+}
+
+// Limit returns the most streams a peer may have open.
+func (l *StreamLimiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	return l.limit
+}
+
+// admitStream admits the task stream s under the node's StreamLimiter, and
+// returns the function that releases it. A peer at its limit is told to
+// retry once one of its streams closes, and ok is false.
+func (n *AgentNode) admitStream(s network.Stream) (release func(), ok bool) {
+	peer := s.Conn().RemotePeer().String()
+	open, ok := n.StreamLimit.Acquire(peer)
+	if !ok {
+		n.replyError(s, ErrorPayload{
+			Code:      ErrCodeTooManyStreams,
+			Message:   fmt.Sprintf("%d task streams already open from this peer; retry once one closes", open),
+			Retryable: true,
+		})
+		return nil, false
+	}
+	return func() { n.StreamLimit.Release(peer) }, true
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// holdRelease unblocks the test.hold handler's tasks when closed.
+var holdRelease atomic.Pointer[chan struct{}]
+
+func init() {
+	RegisterHandler("test.hold", func(ctx context.Context, req TaskRequest) (interface{}, error) {
+		select {
+		case <-*holdRelease.Load():
+		case <-ctx.Done():
+		}
+		return map[string]interface{}{"held": true}, nil
+	})
+}
+
+const holdManifest = `
+version: 1
+capabilities:
+  - name: hold
+    handler: test.hold
+  - name: quick
+    handler: test.lookup
+    noCache: true
+`
+
+func TestPeerStreamsBeyondTheLimitAreRefused(t *testing.T) {
+	b := newTestNode(t)
+	b.Metrics = NewMetrics()
+	b.StreamLimit = NewStreamLimiter(2)
+	if err := b.LoadCapabilities([]string{writeManifest(t, holdManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	a := startTestNode(t)
+	peer := a.CurrentHost().ID().String()
+	release := make(chan struct{})
+	holdRelease.Store(&release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	held := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := a.SendTask(ctx, dialAddr(b), map[string]interface{}{"capability": "hold"})
+			held <- err
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); b.StreamLimit.Open(peer) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams open, want 2", b.StreamLimit.Open(peer))
+		}
+	}
+	want := fmt.Sprintf(`
+# HELP agentmesh_peer_task_streams Task streams each peer has open.
+# TYPE agentmesh_peer_task_streams gauge
+agentmesh_peer_task_streams{peer=%q} 2
+`, peer)
+	if err := testutil.GatherAndCompare(b.Metrics.registry, strings.NewReader(want), "agentmesh_peer_task_streams"); err != nil {
+		t.Error(err)
+	}
+
+	quick := map[string]interface{}{"capability": "quick", "topic": "streams"}
+	_, err := a.SendTask(ctx, dialAddr(b), quick)
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Code != ErrCodeTooManyStreams || !pe.Retryable {
+		t.Fatalf("a third stream = %v, want a retryable %s error", err, ErrCodeTooManyStreams)
+	}
+
+	// Once the held streams close, the peer may open more
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-held; err != nil {
+			t.Fatalf("held task: %v", err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); b.StreamLimit.Open(peer) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams still counted after they closed", b.StreamLimit.Open(peer))
+		}
+	}
+	if _, err := a.SendTask(ctx, dialAddr(b), quick); err != nil {
+		t.Fatalf("SendTask after the streams closed: %v", err)
+	}
+	if n, _ := testutil.GatherAndCount(b.Metrics.registry, "agentmesh_peer_task_streams"); n != 0 {
+		t.Errorf("%d peer stream series left, want none for a peer with no streams", n)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultGossipVerifyTTL is how long a verdict on an advertiser is reused.
+// Peers re-announce every few seconds and the wallet lookup scans registry
+// logs, so verdicts are cached well beyond one announcement.
+const DefaultGossipVerifyTTL = 10 * time.Minute
+
+// gossipLookupTimeout bounds the chain reads behind one verdict.
+const gossipLookupTimeout = 30 * time.Second
+
+// GossipVerdict is what a GossipVerifier decided about an advertiser.
+type GossipVerdict struct {
+	Verified bool
+	AgentID  *big.Int // the ERC-8004 identity its wallet maps to, if any
+	Reason   string   // why it is unverified
+}
+
+// GossipVerifier decides whether a capability advertisement comes from a
+// registered ERC-8004 agent before its peer is routed to. Creating peers is
+// free, so an advertisement is only trusted when it is signed by both the
+// peer key and a wallet, that wallet registered an agent, and, with
+// MinFeedback set, the agent has that much feedback. Peers failing any of
+// these are quarantined by the discovery loop rather than dropped.
+type GossipVerifier struct {
+	MinFeedback uint64        // feedback entries from the reviewers an agent needs; 0 requires none
+	TTL         time.Duration // how long verdicts are reused; non-positive means DefaultGossipVerifyTTL
+	Block       BlockTag      // the block feedback is counted at; empty means the client's default
+
+	client    *ERC8004Client
+	store     MetadataStore
+	reviewers []common.Address
+
+	mu    sync.Mutex
+	cache map[string]gossipEntry
+}
+
+type gossipEntry struct {
+	verdict GossipVerdict
+	at      time.Time
+}
+
+// NewGossipVerifier checks advertisers against the identity registry of
+// client, trying the address book in store first. Feedback for MinFeedback
+// is counted from reviewers only, as with RegistryReputation. Verdicts
+// expire on the client's clock.
+func NewGossipVerifier(client *ERC8004Client, store MetadataStore, reviewers []common.Address) *GossipVerifier {
+	return &GossipVerifier{
+		client:    client,
+		store:     store,
+		reviewers: reviewers,
+		cache:     make(map[string]gossipEntry),
+	}
+}
+
+// Len returns how many verdicts are cached, expired ones not yet pruned
+// included.
+func (v *GossipVerifier) Len() int {
+	if v == nil {
+		return 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.cache)
+}
+
+func (v *GossipVerifier) ttl() time.Duration {
+	if v.TTL <= 0 {
+		return DefaultGossipVerifyTTL
+	}
+	return v.TTL
+}
+
+// Verify returns the verdict on the advertiser peerID claiming ethAddress;
+// dualSigned reports whether the advertisement carried a valid wallet
+// signature. A nil verifier trusts every advertiser. Lookup failures count
+// as unverified and are cached like any verdict, so an unreachable RPC
+// isn't asked again on every announcement.
+func (v *GossipVerifier) Verify(ctx context.Context, peerID, ethAddress string, dualSigned bool) GossipVerdict {
+	if v == nil {
+		return GossipVerdict{Verified: true}
+	}
+	key := peerID + "/" + ethAddress
+	if !dualSigned {
+		key += "/unsigned"
+	}
+	now := v.client.Clock().Now()
+	ttl := v.ttl()
+	v.mu.Lock()
+	e, ok := v.cache[key]
+	v.mu.Unlock()
+	if ok && now.Sub(e.at) < ttl {
+		return e.verdict
+	}
+
+	verdict := v.verify(ctx, ethAddress, dualSigned)
+	if !verdict.Verified {
+		fmt.Printf("[Sybil] Quarantined %s (Eth: %s): %s\n", peerID, ethAddress, verdict.Reason)
+	}
+	v.mu.Lock()
+	v.cache[key] = gossipEntry{verdict: verdict, at: now}
+	for k, old := range v.cache {
+		if now.Sub(old.at) >= ttl {
+			delete(v.cache, k)
+		}
+	}
+	v.mu.Unlock()
+	return verdict
+}
+
+func (v *GossipVerifier) verify(ctx context.Context, ethAddress string, dualSigned bool) GossipVerdict {
+	if !dualSigned || !common.IsHexAddress(ethAddress) {
+		return GossipVerdict{Reason: "advertisement is not signed by a wallet"}
+	}
+	wallet := common.HexToAddress(ethAddress)
+	agentID, err := v.agentID(ctx, wallet)
+	if err != nil {
+		return GossipVerdict{Reason: fmt.Sprintf("could not look up the wallet's agent: %v", err)}
+	}
+	if agentID == nil {
+		return GossipVerdict{Reason: "wallet has no registered agent"}
+	}
+	if v.MinFeedback > 0 {
+		s, err := v.client.GetReputationSummaryForClients(agentID, v.reviewers, "", "", v.Block)
+		if err != nil {
+			return GossipVerdict{AgentID: agentID, Reason: fmt.Sprintf("could not read agent %s's reputation: %v", agentID, err)}
+		}
+		if s.Count < v.MinFeedback {
+			return GossipVerdict{AgentID: agentID, Reason: fmt.Sprintf("agent %s has %d feedback entries, fewer than %d", agentID, s.Count, v.MinFeedback)}
+		}
+	}
+	return GossipVerdict{Verified: true, AgentID: agentID}
+}
+
+// agentID maps wallet to its agent through the address book, falling back to
+// a registry scan. It returns nil for a wallet that registered none.
+func (v *GossipVerifier) agentID(ctx context.Context, wallet common.Address) (*big.Int, error) {
+	if v.store != nil {
+		if e, err := v.store.LookupAddress(wallet.Hex()); err == nil && e != nil && e.AgentID != "" {
+			if id, ok := new(big.Int).SetString(e.AgentID, 10); ok {
+				return id, nil
+			}
+		}
+	}
+	if v.client == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, gossipLookupTimeout)
+	defer cancel()
+	return v.client.GetAgentIdByWalletContext(ctx, wallet)
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// advertisement is a capability announcement signed by a fresh peer key and,
+// when w is set, by w as well.
+func advertisement(t *testing.T, capability string, w *Wallet) (peer.ID, SignedPacket) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := peer.IDFromPrivateKey(priv)
+	data := map[string]interface{}{"capability": AgentCapability{Name: capability}}
+	if w != nil {
+		data["ethAddress"] = w.Address.Hex()
+	}
+	raw, _ := json.Marshal(data)
+	sig, err := signData(priv, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := SignedPacket{Data: string(raw), PeerID: pid.String(), Signature: sig}
+	if w != nil {
+		walletSig, _ := w.SignMessage(raw)
+		packet.WalletSig = hexutil.Encode(walletSig)
+	}
+	return pid, packet
+}
+
+func TestUnverifiedAdvertisersAreQuarantined(t *testing.T) {
+	chain := &fakeChain{head: registryDeployBlock + 10}
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		if method == "eth_getCode" {
+			return "0x", nil
+		}
+		return chain.handle(method, params)
+	})
+	n := newTestNode(t)
+	n.ERCClient = NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	defer n.ERCClient.Close()
+	n.Gossip = NewGossipVerifier(n.ERCClient, n.Store, nil)
+
+	// Both signatures are valid, but the wallet never registered an agent
+	sybil, packet := advertisement(t, "summarize", newTestWallet(t))
+	n.handleAdvertisement(packet)
+	if !n.Routes.IsQuarantined(sybil.String()) {
+		t.Fatal("advertiser with an unregistered wallet was not quarantined")
+	}
+	if got := n.Routes.Lookup("summarize"); len(got) != 1 || got[0] != sybil {
+		t.Errorf("Lookup = %v, want the quarantined peer while nothing else serves it", got)
+	}
+	_, _, err := n.DelegateTask(context.Background(), []AgentRef{{Recipient: Recipient{PeerID: sybil.String()}, Price: big.NewInt(1)}},
+		TaskContext{Capability: "summarize"}, map[string]interface{}{"capability": "summarize"})
+	if err == nil || !strings.Contains(err.Error(), "no candidates") {
+		t.Errorf("paid delegation to a quarantined peer = %v, want no candidates", err)
+	}
+
+	// The verdict is cached: re-announcing doesn't scan the registry again
+	scans := len(chain.ranges)
+	n.handleAdvertisement(packet)
+	if len(chain.ranges) != scans {
+		t.Errorf("re-announcement scanned the registry %d more times", len(chain.ranges)-scans)
+	}
+
+	// Without a wallet signature there is no identity to check
+	unsigned, packet := advertisement(t, "summarize", nil)
+	n.handleAdvertisement(packet)
+	if !n.Routes.IsQuarantined(unsigned.String()) {
+		t.Error("advertiser without a wallet signature was not quarantined")
+	}
+
+	// A registered agent is routed to, and quarantined peers drop out
+	w := newTestWallet(t)
+	n.Store.SaveAddress(AddressBookEntry{Wallet: w.Address.Hex(), AgentID: "7"})
+	registered, packet := advertisement(t, "summarize", w)
+	n.handleAdvertisement(packet)
+	if n.Routes.IsQuarantined(registered.String()) {
+		t.Error("registered agent was quarantined")
+	}
+	if got := n.Routes.Lookup("summarize"); len(got) != 1 || got[0] != registered {
+		t.Errorf("Lookup = %v, want only the verified peer", got)
+	}
+
+	// With a feedback minimum, registration alone no longer suffices
+	n.Gossip = NewGossipVerifier(n.ERCClient, n.Store, nil)
+	n.Gossip.MinFeedback = 1
+	if v := n.Gossip.Verify(context.Background(), registered.String(), w.Address.Hex(), true); v.Verified || v.AgentID == nil || v.AgentID.Int64() != 7 {
+		t.Errorf("verdict = %+v, want agent 7 unverified for lack of feedback", v)
+	}
+}
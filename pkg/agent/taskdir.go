@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultTaskDirRetention is how long the scratch directory of a task a
+// crash left behind is kept before the startup sweep clears it.
+const DefaultTaskDirRetention = 24 * time.Hour
+
+// Workspace subdirectories holding the tasks' scratch directories, and those
+// a quarantining sweep moved aside. Peers can't read either over the memory
+// protocol.
+const (
+	taskDirsName   = ".tasks"
+	quarantineName = ".tasks-quarantine"
+)
+
+// TaskDirRetention is what the startup sweep does with scratch directories
+// left behind by tasks that never finished, e.g. because the node crashed.
+// A directory is an orphan unless the database has its task in progress.
+type TaskDirRetention struct {
+	MaxAge     time.Duration // orphans last modified longer ago are swept; 0 for DefaultTaskDirRetention
+	Quarantine bool          // move swept orphans to the workspace's .tasks-quarantine instead of removing them
+}
+
+func (r TaskDirRetention) maxAge() time.Duration {
+	if r.MaxAge > 0 {
+		return r.MaxAge
+	}
+	return DefaultTaskDirRetention
+}
+
+// taskDirsPath is the directory tasks get scratch directories in, or "" if
+// the node has no workspace.
+func (n *AgentNode) taskDirsPath() string {
+	if n.Memory == nil || n.Memory.workspacePath == "" {
+		return ""
+	}
+	return filepath.Join(n.Memory.workspacePath, taskDirsName)
+}
+
+// taskDir creates a scratch directory for a run of taskID, or returns "" if
+// the node has no workspace. Runs of the same task get directories of their
+// own.
+func (n *AgentNode) taskDir(taskID string) (string, error) {
+	dirs := n.taskDirsPath()
+	if dirs == "" {
+		return "", nil
+	}
+	if err := os.MkdirAll(dirs, 0700); err != nil {
+		return "", err
+	}
+	// The escaped ID has no colons, which Windows doesn't allow in file
+	// names, and MkdirTemp's suffix has no dash, so the ID can be read back
+	return os.MkdirTemp(dirs, url.QueryEscape(taskID)+"-*")
+}
+
+// removeTaskDir removes a scratch directory made by taskDir.
+func removeTaskDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		fmt.Printf("[Workspace] Failed to remove task directory %s: %v\n", dir, err)
+	}
+}
+
+// taskDirID returns the ID of the task whose scratch directory is name.
+func taskDirID(name string) (string, bool) {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return "", false
+	}
+	id, err := url.QueryUnescape(name[:i])
+	return id, err == nil
+}
+
+// SweepTaskDirs clears the scratch directories of tasks that aren't in
+// progress and weren't modified within the retention's MaxAge of now, and
+// returns how many it cleared. Start runs it before the node takes tasks.
+func (n *AgentNode) SweepTaskDirs(now time.Time) (int, error) {
+	dirs := n.taskDirsPath()
+	if dirs == "" {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(dirs)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	policy := n.TaskDirRetention
+	swept := 0
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.IsDir() || now.Sub(info.ModTime()) < policy.maxAge() {
+			continue
+		}
+		if id, ok := taskDirID(e.Name()); ok {
+			if task, err := n.Store.GetTask(id); err != nil {
+				return swept, err
+			} else if task != nil && task.Status == TaskStatusReceived {
+				continue
+			}
+		}
+		path := filepath.Join(dirs, e.Name())
+		if policy.Quarantine {
+			quarantine := filepath.Join(n.Memory.workspacePath, quarantineName)
+			if err := os.MkdirAll(quarantine, 0700); err != nil {
+				return swept, err
+			}
+			err = os.Rename(path, filepath.Join(quarantine, e.Name()))
+		} else {
+			err = os.RemoveAll(path)
+		}
+		if err != nil {
+			return swept, err
+		}
+		swept++
+	}
+	return swept, nil
+}
+
+// taskDirsStep sweeps orphaned task directories once the store is up. The
+// host waits for it, so no task is running yet whose directory it could
+// take.
+func (n *AgentNode) taskDirsStep() BootStep {
+	return BootStep{Name: "workspace", After: []string{"store"}, Run: func(context.Context) error {
+		swept, err := n.SweepTaskDirs(time.Now())
+		if swept > 0 {
+			verb := "Removed"
+			if n.TaskDirRetention.Quarantine {
+				verb = "Quarantined"
+			}
+			fmt.Printf("[Workspace] %s %d orphaned task directories\n", verb, swept)
+		}
+		// Leftovers only cost disk, so they don't keep the node from starting
+		if err != nil {
+			fmt.Printf("[Workspace] Failed to sweep task directories: %v\n", err)
+		}
+		return nil
+	}}
+}
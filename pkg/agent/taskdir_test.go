@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	// test.scratch writes the payload's text to a file in its task
+	// directory and answers with the file's path, or streams the file back
+	RegisterHandler("test.scratch", func(ctx context.Context, req TaskRequest) (interface{}, error) {
+		path := filepath.Join(req.Dir, "note.txt")
+		if err := os.WriteFile(path, []byte(req.Payload["text"].(string)), 0600); err != nil {
+			return nil, err
+		}
+		if req.Payload["stream"] == true {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			return NewStreamResult(f, -1), nil
+		}
+		return map[string]interface{}{"path": path}, nil
+	})
+}
+
+const scratchManifest = `
+version: 1
+capabilities:
+  - name: scratch
+    handler: test.scratch
+`
+
+func TestTaskDirsLastAsLongAsTheirRun(t *testing.T) {
+	n := newTestNode(t)
+	if err := n.LoadCapabilities([]string{writeManifest(t, scratchManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := n.binding("scratch")
+	run := func(payload map[string]interface{}) interface{} {
+		t.Helper()
+		result, err := n.runHandler(context.Background(), "task:7", b, TaskRequest{Capability: "scratch", Payload: payload, Node: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	dir := filepath.Dir(run(map[string]interface{}{"text": "hi"}).(map[string]interface{})["path"].(string))
+	if filepath.Dir(dir) != n.taskDirsPath() {
+		t.Fatalf("task directory %s isn't in %s", dir, n.taskDirsPath())
+	}
+	if id, ok := taskDirID(filepath.Base(dir)); !ok || id != "task:7" {
+		t.Errorf("task directory %s reads back as %q, %v", dir, id, ok)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("task directory left after the run: %v", err)
+	}
+
+	// A streamed result is read from the directory after the handler returns
+	stream := run(map[string]interface{}{"text": "streamed", "stream": true}).(*StreamResult)
+	body, err := io.ReadAll(stream.Body)
+	if err != nil || string(body) != "streamed" {
+		t.Fatalf("streamed %q, %v", body, err)
+	}
+	stream.Close()
+	if entries, _ := os.ReadDir(n.taskDirsPath()); len(entries) != 0 {
+		t.Errorf("%d task directories left once the stream closed", len(entries))
+	}
+}
+
+func TestStartupSweepsOrphanedTaskDirs(t *testing.T) {
+	n := newTestNode(t)
+	n.TaskDirRetention = TaskDirRetention{MaxAge: time.Hour}
+	now := time.Now()
+	for _, task := range []TaskRecord{
+		{ID: "local:running", Kind: TaskKindLocal, Status: TaskStatusReceived},
+		{ID: "local:done", Kind: TaskKindLocal, Status: TaskStatusResolved},
+	} {
+		if err := n.Store.SaveTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir := func(taskID string, age time.Duration) string {
+		t.Helper()
+		dir, err := n.taskDir(taskID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	running := mkdir("local:running", 2*time.Hour)
+	done := mkdir("local:done", 2*time.Hour)
+	crashed := mkdir("peer:crashed", 2*time.Hour)
+	recent := mkdir("peer:recent", time.Minute)
+
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	for dir, kept := range map[string]bool{running: true, done: false, crashed: false, recent: true} {
+		if _, err := os.Stat(dir); (err == nil) != kept {
+			t.Errorf("%s: kept %v, want %v", filepath.Base(dir), err == nil, kept)
+		}
+	}
+
+	// Quarantined directories are moved aside, out of peers' reach
+	n.TaskDirRetention.Quarantine = true
+	if swept, err := n.SweepTaskDirs(now.Add(time.Hour)); err != nil || swept != 1 {
+		t.Fatalf("swept %d, %v, want the recent directory", swept, err)
+	}
+	moved := filepath.Join(n.Memory.workspacePath, quarantineName, filepath.Base(recent))
+	if _, err := os.Stat(moved); err != nil {
+		t.Errorf("quarantined directory: %v", err)
+	}
+	if _, err := n.Memory.GetMemory(filepath.Join(quarantineName, filepath.Base(recent))); !errors.Is(err, errAccessDenied) {
+		t.Errorf("reading the quarantine over the memory protocol: %v, want access denied", err)
+	}
+	if _, err := os.Stat(running); err != nil {
+		t.Errorf("directory of the running task swept: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Task kinds recorded from on-chain events.
+const (
+	TaskKindEscrow    = "task"
+	TaskKindKnowledge = "knowledge"
+)
+
+// Task statuses.
+const (
+	TaskStatusReceived = "received"
+	TaskStatusResolved = "resolved"
+	TaskStatusSkipped  = "skipped"
+	TaskStatusFailed   = "failed"
+	TaskStatusDisputed = "disputed" // a delegated result failed verification
+)
+
+// TaskRecord is the node's local view of an on-chain task or knowledge request.
+type TaskRecord struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Client    string `json:"client"`
+	Topic     string `json:"topic,omitempty"`
+	SpecHash  string `json:"specHash,omitempty"`
+	Amount    string `json:"amount"` // wei
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt"`
+	Deadline  int64  `json:"deadline,omitempty"` // unix seconds it must be done by; 0 for none
+	ChainID   uint64 `json:"chainId,omitempty"`  // chain the task or request is on; 0 if unknown
+	// Priority is the scheduler's, while a local task is queued
+	Priority *float64 `json:"priority,omitempty"`
+	// Verdict is the Evaluator's, with the raw model output, for auditing
+	Verdict *Verdict `json:"verdict,omitempty"`
+	// Verification is how the result of a task the node delegated was
+	// checked before it was paid for
+	Verification *ResultVerification `json:"verification,omitempty"`
+}
+
+// TaskRecordFromEvent builds a record for a TaskEscrow TaskCreated event.
+func TaskRecordFromEvent(e TaskCreatedEvent) TaskRecord {
+	now := time.Now().Unix()
+	return TaskRecord{
+		ID:        eventID(TaskKindEscrow, e.ChainID, e.chainQualified, e.Contract, e.qualified, e.TaskId),
+		Kind:      TaskKindEscrow,
+		Client:    e.Client.Hex(),
+		SpecHash:  common.Hash(e.SpecHash).Hex(),
+		Amount:    e.Payment.String(),
+		Status:    TaskStatusReceived,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ChainID:   e.ChainID,
+	}
+}
+
+// TaskRecordFromQuery builds a record for a KnowledgeMarket KnowledgeRequested event.
+func TaskRecordFromQuery(e KnowledgeRequestedEvent) TaskRecord {
+	now := time.Now().Unix()
+	return TaskRecord{
+		ID:        eventID(TaskKindKnowledge, e.ChainID, e.chainQualified, e.Contract, e.qualified, e.RequestId),
+		Kind:      TaskKindKnowledge,
+		Client:    e.Requester.Hex(),
+		Topic:     e.Topic,
+		SpecHash:  common.Hash(e.TopicHash).Hex(),
+		Amount:    e.Bounty.String(),
+		Status:    TaskStatusReceived,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ChainID:   e.ChainID,
+	}
+}
+
+// SaveTask inserts or replaces a task record.
+func (s *sqlStore) SaveTask(t TaskRecord) error {
+	_, err := s.exec(`
+		INSERT INTO tasks (id, kind, client, topic, spec_hash, amount, status, created_at, updated_at, deadline, chain_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET kind = excluded.kind, client = excluded.client, topic = excluded.topic,
+			spec_hash = excluded.spec_hash, amount = excluded.amount, status = excluded.status, updated_at = excluded.updated_at,
+			deadline = excluded.deadline, chain_id = excluded.chain_id`,
+		t.ID, t.Kind, t.Client, t.Topic, t.SpecHash, t.Amount, t.Status, t.CreatedAt, t.UpdatedAt, t.Deadline, int64(t.ChainID))
+	return err
+}
+
+// UpdateTaskStatus moves a task to a new status.
+func (s *sqlStore) UpdateTaskStatus(id, status string) error {
+	_, err := s.exec("UPDATE tasks SET status = ?, updated_at = ? WHERE id = ?", status, time.Now().Unix(), id)
+	return err
+}
+
+// SetTaskVerdict stores an Evaluator's verdict on a task.
+func (s *sqlStore) SetTaskVerdict(id string, v Verdict) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("UPDATE tasks SET verdict = ?, updated_at = ? WHERE id = ?", string(data), time.Now().Unix(), id)
+	return err
+}
+
+// SetTaskVerification stores how a delegated task's result was verified.
+func (s *sqlStore) SetTaskVerification(id string, v ResultVerification) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("UPDATE tasks SET verification = ?, updated_at = ? WHERE id = ?", string(data), time.Now().Unix(), id)
+	return err
+}
+
+// scanVerdict decodes a stored verdict and verification into t.
+func scanVerdict(t *TaskRecord, verdict, verification sql.NullString) {
+	if verdict.Valid && verdict.String != "" {
+		var v Verdict
+		if json.Unmarshal([]byte(verdict.String), &v) == nil {
+			t.Verdict = &v
+		}
+	}
+	if verification.Valid && verification.String != "" {
+		var v ResultVerification
+		if json.Unmarshal([]byte(verification.String), &v) == nil {
+			t.Verification = &v
+		}
+	}
+}
+
+// ListTasks returns the most recent tasks, newest first.
+func (s *sqlStore) ListTasks(limit int) ([]TaskRecord, error) {
+	rows, err := s.query(`
+		SELECT id, kind, client, topic, spec_hash, amount, status, created_at, updated_at, deadline, chain_id, verdict, verification
+		FROM tasks ORDER BY created_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []TaskRecord
+	for rows.Next() {
+		var t TaskRecord
+		var chainID int64
+		var verdict, verification sql.NullString
+		if err := rows.Scan(&t.ID, &t.Kind, &t.Client, &t.Topic, &t.SpecHash, &t.Amount, &t.Status, &t.CreatedAt, &t.UpdatedAt, &t.Deadline, &chainID, &verdict, &verification); err == nil {
+			t.ChainID = uint64(chainID)
+			scanVerdict(&t, verdict, verification)
+			results = append(results, t)
+		}
+	}
+	return results, rows.Err()
+}
+
+// GetTask returns a single task, or nil if it is unknown.
+func (s *sqlStore) GetTask(id string) (*TaskRecord, error) {
+	var t TaskRecord
+	var chainID int64
+	var verdict, verification sql.NullString
+	err := s.queryRow(`
+		SELECT id, kind, client, topic, spec_hash, amount, status, created_at, updated_at, deadline, chain_id, verdict, verification
+		FROM tasks WHERE id = ?`, id).
+		Scan(&t.ID, &t.Kind, &t.Client, &t.Topic, &t.SpecHash, &t.Amount, &t.Status, &t.CreatedAt, &t.UpdatedAt, &t.Deadline, &chainID, &verdict, &verification)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.ChainID = uint64(chainID)
+	scanVerdict(&t, verdict, verification)
+	return &t, nil
+}
+
+// DeleteTask removes a task record. Deleting an unknown task is not an error.
+func (s *sqlStore) DeleteTask(id string) error {
+	_, err := s.exec("DELETE FROM tasks WHERE id = ?", id)
+	return err
+}
+
+// taskRunSample is how many of a capability's latest runs its estimate
+// averages.
+const taskRunSample = 20
+
+// RecordTaskRun notes that a run of capability took d.
+func (s *sqlStore) RecordTaskRun(capability string, d time.Duration) error {
+	_, err := s.exec("INSERT INTO task_runs (capability, duration_ms, finished_at) VALUES (?, ?, ?)",
+		capability, d.Milliseconds(), time.Now().UnixMilli())
+	return err
+}
+
+// EstimateTaskRun averages the latest recorded runs of capability, and
+// reports false if there are none.
+func (s *sqlStore) EstimateTaskRun(capability string) (time.Duration, bool, error) {
+	var avg sql.NullFloat64
+	err := s.queryRow(`
+		SELECT AVG(duration_ms) FROM (
+			SELECT duration_ms FROM task_runs WHERE capability = ? ORDER BY finished_at DESC LIMIT ?
+		) AS latest`, capability, taskRunSample).Scan(&avg)
+	if err != nil || !avg.Valid {
+		return 0, false, err
+	}
+	return time.Duration(avg.Float64 * float64(time.Millisecond)), true, nil
+}
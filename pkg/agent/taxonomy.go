@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Capability identifiers name a capability the same way across
+// implementations, where Name is whatever its author chose. An identifier is
+// two or more lowercase, slash-separated segments and an optional version:
+//
+//	skill/text-summarization@1
+//	skill/translation/en-de@2.1.0
+//	tool/web-search
+//
+// A requested identifier may also use wildcards and version ranges; see
+// MatchCapability.
+
+// CapabilityID is a parsed capability identifier.
+type CapabilityID struct {
+	Path    []string // the segments, e.g. ["skill", "text-summarization"]
+	Version string   // e.g. "1", "2.1.0", or a range when requested; empty for none
+}
+
+// ParseCapabilityID parses an identifier as offered: no wildcards, and a
+// concrete version of up to three numbers if any.
+func ParseCapabilityID(s string) (CapabilityID, error) {
+	id, err := parseCapabilityID(s, false)
+	if err != nil {
+		return id, err
+	}
+	if id.Version != "" {
+		if _, err := parseVersion(id.Version); err != nil {
+			return id, fmt.Errorf("capability id %q: %w", s, err)
+		}
+	}
+	return id, nil
+}
+
+// IsCapabilityID reports whether s has the form of an identifier rather
+// than a free-form capability name: it has a slash.
+func IsCapabilityID(s string) bool {
+	return strings.Contains(s, "/")
+}
+
+func parseCapabilityID(s string, wildcards bool) (CapabilityID, error) {
+	var id CapabilityID
+	path, version, hasVersion := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "@")
+	if hasVersion {
+		if version == "" {
+			return id, fmt.Errorf("capability id %q: empty version", s)
+		}
+		id.Version = version
+	}
+	id.Path = strings.Split(path, "/")
+	if len(id.Path) < 2 {
+		return id, fmt.Errorf("capability id %q: want namespace/name", s)
+	}
+	for _, seg := range id.Path {
+		if wildcards && seg == "*" {
+			continue
+		}
+		if !validSegment(seg) {
+			return id, fmt.Errorf("capability id %q: invalid segment %q", s, seg)
+		}
+	}
+	return id, nil
+}
+
+// validSegment allows a lowercase letter or digit, then letters, digits,
+// '.', '_' and '-'.
+func validSegment(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	for i, c := range seg {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case i > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the identifier in its canonical form.
+func (id CapabilityID) String() string {
+	s := strings.Join(id.Path, "/")
+	if id.Version != "" {
+		s += "@" + id.Version
+	}
+	return s
+}
+
+// MatchCapability reports whether a capability offered as offered serves a
+// request for requested. Free-form names match only themselves. Identifiers
+// match case-insensitively, segment by segment, where a requested "*"
+// matches any one segment. The requested version then narrows the offered
+// one:
+//
+//	(none) or *    any version, or none
+//	1, 1.2, 1.2.3  versions with that prefix: 1 matches 1.4.0, 1.2 matches 1.2.7
+//	^1.2           1.2.0 and up within major version 1
+//	>=1.2,<2       every comparison (<, <=, >, >=, =) holds
+//
+// An offered capability with no version only serves requests for any.
+// Offered identifiers with wildcards or ranges, and malformed ones, match
+// nothing.
+func MatchCapability(requested, offered string) bool {
+	if !IsCapabilityID(requested) || !IsCapabilityID(offered) {
+		return requested == offered
+	}
+	want, err := parseCapabilityID(requested, true)
+	if err != nil {
+		return false
+	}
+	have, err := ParseCapabilityID(offered)
+	if err != nil || len(want.Path) != len(have.Path) {
+		return false
+	}
+	for i, seg := range want.Path {
+		if seg != "*" && seg != have.Path[i] {
+			return false
+		}
+	}
+	if want.Version == "" || want.Version == "*" {
+		return true
+	}
+	if have.Version == "" {
+		return false
+	}
+	v, _ := parseVersion(have.Version)
+	ok, err := versionInRange(v, want.Version)
+	return err == nil && ok
+}
+
+// version is a parsed major.minor.patch, missing parts zero.
+type version [3]int
+
+// parseVersionParts parses up to three dot-separated numbers, and returns
+// how many there were.
+func parseVersionParts(s string) (version, int, error) {
+	var v version
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("version %q has more than three parts", s)
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || p == "" || (len(p) > 1 && p[0] == '0') {
+			return v, 0, fmt.Errorf("invalid version %q", s)
+		}
+		v[i] = n
+	}
+	return v, len(parts), nil
+}
+
+func parseVersion(s string) (version, error) {
+	v, _, err := parseVersionParts(s)
+	return v, err
+}
+
+func (v version) compare(o version) int {
+	for i := range v {
+		if v[i] != o[i] {
+			if v[i] < o[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionInRange reports whether v satisfies a requested version; see
+// MatchCapability.
+func versionInRange(v version, requested string) (bool, error) {
+	if rest, ok := strings.CutPrefix(requested, "^"); ok {
+		min, err := parseVersion(rest)
+		if err != nil {
+			return false, err
+		}
+		return v.compare(min) >= 0 && v[0] == min[0], nil
+	}
+	if !strings.ContainsAny(requested, "<>=") {
+		prefix, n, err := parseVersionParts(requested)
+		if err != nil {
+			return false, err
+		}
+		return equalPrefix(v, prefix, n), nil
+	}
+	for _, cond := range strings.Split(requested, ",") {
+		op := strings.TrimRight(cond, "0123456789.")
+		bound, err := parseVersion(strings.TrimPrefix(cond, op))
+		if err != nil {
+			return false, err
+		}
+		c := v.compare(bound)
+		var holds bool
+		switch op {
+		case "<":
+			holds = c < 0
+		case "<=":
+			holds = c <= 0
+		case ">":
+			holds = c > 0
+		case ">=":
+			holds = c >= 0
+		case "=":
+			holds = c == 0
+		default:
+			return false, fmt.Errorf("invalid version comparison %q", cond)
+		}
+		if !holds {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// equalPrefix reports whether v and prefix agree in their first n parts.
+func equalPrefix(v, prefix version, n int) bool {
+	for i := 0; i < n; i++ {
+		if v[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Handles reports whether c serves a request for requested: it is c's name,
+// or an identifier c's ID matches.
+func (c AgentCapability) Handles(requested string) bool {
+	return requested == c.Name || (c.ID != "" && IsCapabilityID(requested) && MatchCapability(requested, c.ID))
+}
+
+// CanHandle returns the name of the capability the node offers for
+// requested, manifest or advertised; see bestCapability. Every node picks
+// the same capability for the same request.
+func (n *AgentNode) CanHandle(requested string) (string, bool) {
+	n.mu.RLock()
+	offered := make([]AgentCapability, 0, len(n.bindings))
+	for _, b := range n.bindings {
+		offered = append(offered, b.def.Capability())
+	}
+	advertised := n.capabilities
+	n.mu.RUnlock()
+	return bestCapability(requested, append(offered, advertised.Snapshot()...))
+}
+
+// bestCapability returns the name of the capability in offered that serves
+// requested: the one of that name, or else, of those whose ID matches, the
+// one with the highest version, then the first by name.
+func bestCapability(requested string, offered []AgentCapability) (string, bool) {
+	var best *AgentCapability
+	var bestVersion version
+	for i, c := range offered {
+		if c.Name == requested {
+			return c.Name, true
+		}
+		if !c.Handles(requested) {
+			continue
+		}
+		id, _ := ParseCapabilityID(c.ID)
+		v, _ := parseVersion(id.Version)
+		if best == nil || v.compare(bestVersion) > 0 || (v == bestVersion && c.Name < best.Name) {
+			best, bestVersion = &offered[i], v
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.Name, true
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchCapability(t *testing.T) {
+	cases := []struct {
+		requested, offered string
+		want               bool
+	}{
+		// Free-form names match only themselves
+		{"summarize", "summarize", true},
+		{"summarize", "Summarize", false},
+		{"summarize", "skill/summarize@1", false},
+
+		// Identifiers match segment by segment, ignoring case
+		{"skill/text-summarization", "skill/text-summarization@1", true},
+		{"Skill/Text-Summarization@1", "skill/text-summarization@1.3", true},
+		{"skill/text-summarization", "skill/translation@1", false},
+		{"skill/*", "skill/text-summarization@1", true},
+		{"*/text-summarization", "tool/text-summarization", true},
+		{"skill/*", "skill/translation/en-de@1", false},
+		{"skill/translation/*@2", "skill/translation/en-de@2.1.0", true},
+
+		// Versions
+		{"skill/sum@*", "skill/sum", true},
+		{"skill/sum@1", "skill/sum", false},
+		{"skill/sum@1", "skill/sum@1.9.2", true},
+		{"skill/sum@1", "skill/sum@10", false},
+		{"skill/sum@1.2", "skill/sum@1.2.7", true},
+		{"skill/sum@1.2", "skill/sum@1.3", false},
+		{"skill/sum@1.2.3", "skill/sum@1.2.3", true},
+		{"skill/sum@^1.2", "skill/sum@1.10", true},
+		{"skill/sum@^1.2", "skill/sum@1.1.9", false},
+		{"skill/sum@^1.2", "skill/sum@2", false},
+		{"skill/sum@>=1.2,<2", "skill/sum@1.5", true},
+		{"skill/sum@>=1.2,<2", "skill/sum@2.0.0", false},
+		{"skill/sum@>1", "skill/sum@1.0.1", true},
+		{"skill/sum@=2", "skill/sum@2.0", true},
+
+		// Malformed identifiers match nothing
+		{"skill/sum@~1", "skill/sum@1", false},
+		{"skill/sum", "skill/*@1", false},
+		{"skill/sum", "skill/sum@1.x", false},
+		{"skill//sum", "skill//sum", false},
+	}
+	for _, c := range cases {
+		if got := MatchCapability(c.requested, c.offered); got != c.want {
+			t.Errorf("MatchCapability(%q, %q) = %v, want %v", c.requested, c.offered, got, c.want)
+		}
+	}
+}
+
+func TestCanHandlePicksTheSameCapabilityEveryTime(t *testing.T) {
+	n := newTestNode(t)
+	n.capabilities = NewCapabilitySet()
+	n.capabilities.Add("",
+		AgentCapability{Name: "summarize", ID: "skill/text-summarization@1.2"},
+		AgentCapability{Name: "summarize-v2", ID: "skill/text-summarization@2"},
+		AgentCapability{Name: "digest", ID: "skill/text-summarization@2"},
+		AgentCapability{Name: "translate"},
+	)
+	cases := []struct {
+		requested, want string
+	}{
+		{"summarize", "summarize"},
+		{"skill/text-summarization", "digest"},
+		{"skill/text-summarization@1", "summarize"},
+		{"skill/*@^1.1", "summarize"},
+		{"translate", "translate"},
+		{"skill/translation", ""},
+		{"Translate", ""},
+	}
+	for _, c := range cases {
+		for i := 0; i < 10; i++ {
+			if got, _ := n.CanHandle(c.requested); got != c.want {
+				t.Fatalf("CanHandle(%q) = %q, want %q", c.requested, got, c.want)
+			}
+		}
+	}
+}
+
+func TestRoutesFindPeersByCapabilityID(t *testing.T) {
+	routes := NewRoutingTable(DefaultRouteTTL)
+	v1, v2 := randomPeer(t), randomPeer(t)
+	routes.Add("summarize", v1)
+	routes.Add("skill/text-summarization@1.4", v1)
+	routes.Add("skill/text-summarization@2.0", v2)
+
+	if got := routes.Lookup("skill/text-summarization@1"); len(got) != 1 || got[0] != v1 {
+		t.Errorf("@1 routes to %v, want only %s", got, v1)
+	}
+	if got := routes.Lookup("skill/text-summarization"); len(got) != 2 {
+		t.Errorf("any version routes to %v, want both peers", got)
+	}
+}
+
+func TestManifestRejectsInvalidCapabilityID(t *testing.T) {
+	err := NewAgentNodeWithStore(nil, "").LoadCapabilities([]string{writeManifest(t, `
+version: 1
+capabilities:
+  - name: summarize
+    id: skill/summarize@latest
+    handler: echo
+`)})
+	if err == nil || !strings.Contains(err.Error(), "invalid version") {
+		t.Errorf("LoadCapabilities = %v, want an invalid version error", err)
+	}
+}
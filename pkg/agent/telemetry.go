@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of the node's spans.
+const tracerName = "agentmesh"
+
+// DefaultTraceSampleRate is the share of new traces recorded unless
+// configured otherwise. Traces started by a peer follow the peer's decision.
+const DefaultTraceSampleRate = 1.0
+
+// traceContext carries the W3C trace context across P2P messages.
+var traceContext = propagation.TraceContext{}
+
+// NewOTLPTracerProvider exports spans over OTLP/HTTP to endpoint, e.g.
+// http://localhost:4318. sampleRate is the share of traces started here that
+// are recorded. Shut the provider down to flush buffered spans.
+func NewOTLPTracerProvider(ctx context.Context, endpoint string, sampleRate float64, serviceName string) (*sdktrace.TracerProvider, error) {
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("trace sample rate must be between 0 and 1, got %v", sampleRate)
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	), nil
+}
+
+// tracer returns the node's tracer; a no-op one without a TracerProvider.
+func (n *AgentNode) tracer() trace.Tracer {
+	return tracerFrom(n.TracerProvider)
+}
+
+// SetTracerProvider traces the client's contract calls and transactions.
+func (c *ERC8004Client) SetTracerProvider(tp trace.TracerProvider) {
+	c.tracing = tp
+}
+
+func (c *ERC8004Client) tracer() trace.Tracer {
+	return tracerFrom(c.tracing)
+}
+
+func tracerFrom(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// injectTrace records the span in ctx in msg, so the receiving peer's spans
+// join the trace. Nothing is added when ctx holds no sampled span.
+func injectTrace(ctx context.Context, msg *AgentMessage) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	msg.Trace = carrier
+}
+
+// extractTrace returns ctx continuing the trace msg was sent under, if any.
+func extractTrace(ctx context.Context, msg AgentMessage) context.Context {
+	if len(msg.Trace) == 0 {
+		return ctx
+	}
+	return traceContext.Extract(ctx, propagation.MapCarrier(msg.Trace))
+}
+
+// endSpan ends span, marking it failed when err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// capabilityAttr labels a span with the task's capability.
+func capabilityAttr(capability string) attribute.KeyValue {
+	return attribute.String("agentmesh.capability", capability)
+}
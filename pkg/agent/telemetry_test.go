@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestDelegatedTaskIsOneTrace(t *testing.T) {
+	// Each node has its own provider, as separate processes would, exporting
+	// to one in-memory collector
+	exporter := tracetest.NewInMemoryExporter()
+	newProvider := func() *sdktrace.TracerProvider {
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		t.Cleanup(func() { tp.Shutdown(context.Background()) })
+		return tp
+	}
+
+	b := newTestNode(t)
+	b.TracerProvider = newProvider()
+	b.Metrics = NewMetrics()
+	if err := b.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	a := startTestNode(t)
+	a.TracerProvider = newProvider()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := a.SendTask(ctx, dialAddr(b), map[string]interface{}{"capability": "summarize", "text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// B ends its stream span after replying, so it may land just after A's
+	var spans tracetest.SpanStubs
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if spans = exporter.GetSpans(); len(spans) >= 3 {
+			break
+		}
+	}
+	byName := map[string]tracetest.SpanStub{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	send, handle, execute := byName["p2p.task"], byName["p2p.handle_task"], byName["task.execute"]
+	if len(spans) != 3 || !send.SpanContext.IsValid() || !handle.SpanContext.IsValid() || !execute.SpanContext.IsValid() {
+		t.Fatalf("spans = %v, want p2p.task, p2p.handle_task and task.execute", spanNames(spans))
+	}
+
+	traceID := send.SpanContext.TraceID()
+	for _, s := range spans {
+		if s.SpanContext.TraceID() != traceID {
+			t.Errorf("span %s is in trace %s, want %s", s.Name, s.SpanContext.TraceID(), traceID)
+		}
+	}
+	if send.Parent.IsValid() {
+		t.Errorf("p2p.task has parent %s, want it to start the trace", send.Parent.SpanID())
+	}
+	if !handle.Parent.IsRemote() || handle.Parent.SpanID() != send.SpanContext.SpanID() {
+		t.Errorf("p2p.handle_task parent = %s, want A's p2p.task span %s", handle.Parent.SpanID(), send.SpanContext.SpanID())
+	}
+	if execute.Parent.SpanID() != handle.SpanContext.SpanID() {
+		t.Errorf("task.execute parent = %s, want p2p.handle_task %s", execute.Parent.SpanID(), handle.SpanContext.SpanID())
+	}
+
+	if got := testutil.ToFloat64(b.Metrics.tasks.WithLabelValues("summarize", "ok")); got != 1 {
+		t.Errorf("agentmesh_tasks_total{summarize,ok} = %v, want 1", got)
+	}
+}
+
+func TestUntracedMessageHasNoTraceContext(t *testing.T) {
+	n := newTestNode(t)
+	ctx, span := n.tracer().Start(context.Background(), "p2p.task")
+	defer span.End()
+
+	var msg AgentMessage
+	injectTrace(ctx, &msg)
+	if msg.Trace != nil {
+		t.Errorf("Trace = %v without a TracerProvider, want none", msg.Trace)
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	return names
+}
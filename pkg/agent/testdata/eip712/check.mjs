@@ -0,0 +1,27 @@
+// Checks vectors.json against ethers.js, an independent EIP-712
+// implementation: npm install ethers@6 && node check.mjs
+import { readFileSync } from "node:fs";
+import { TypedDataEncoder, Wallet, id } from "ethers";
+
+const { privateKey, vectors } = JSON.parse(readFileSync(new URL("./vectors.json", import.meta.url)));
+const wallet = new Wallet(privateKey);
+let failed = 0;
+for (const v of vectors) {
+  const encoder = TypedDataEncoder.from(v.types);
+  const got = {
+    encodeType: encoder.encodeType(v.primaryType),
+    typeHash: id(encoder.encodeType(v.primaryType)),
+    domainSeparator: TypedDataEncoder.hashDomain(v.domain),
+    structHash: encoder.hashStruct(v.primaryType, v.message),
+    digest: TypedDataEncoder.hash(v.domain, v.types, v.message),
+    signature: await wallet.signTypedData(v.domain, v.types, v.message),
+  };
+  for (const [field, value] of Object.entries(got)) {
+    if (value.toLowerCase() !== v[field].toLowerCase()) {
+      console.log(`${v.name}: ${field} is ${value}, the vector has ${v[field]}`);
+      failed++;
+    }
+  }
+}
+console.log(failed ? `${failed} mismatches` : `${vectors.length} vectors match`);
+process.exit(failed ? 1 : 0);
@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Delivery retries: each transport gets deliveryAttempts tries, the first
+// retry after deliveryBackoff and each later one after twice the previous
+// wait. They are variables so tests can shorten them.
+var (
+	deliveryAttempts = 3
+	deliveryBackoff  = 500 * time.Millisecond
+)
+
+// Recipient is how a counterparty is reached: the libp2p peer ID it
+// published, the HTTP endpoint of an agent that doesn't run libp2p, or both.
+// Addrs are where the peer said it listens, if it did.
+type Recipient struct {
+	PeerID   string                `json:"peerId,omitempty"`
+	Endpoint string                `json:"endpoint,omitempty"`
+	Addrs    []multiaddr.Multiaddr `json:"addrs,omitempty"`
+}
+
+// key names the recipient in the PeerHistory: its peer ID, or its endpoint.
+func (r Recipient) key() string {
+	if r.PeerID != "" {
+		return r.PeerID
+	}
+	return r.Endpoint
+}
+
+// Transport carries a message to one counterparty and returns its answer.
+// An error message from the counterparty is returned as a *PeerError.
+type Transport interface {
+	Exchange(ctx context.Context, msg AgentMessage) (*AgentMessage, error)
+	String() string
+}
+
+// DeliveryReceipt records how a message was delivered.
+type DeliveryReceipt struct {
+	ID        string `json:"id"`        // correlation ID of the message
+	Transport string `json:"transport"` // the last transport tried
+	Attempts  int    `json:"attempts"`  // over all transports
+	Delivered bool   `json:"delivered"` // the counterparty answered, if only with an error
+}
+
+// p2pTransport reaches a peer on the task protocol.
+type p2pTransport struct {
+	n   *AgentNode
+	pid peer.ID
+}
+
+func (t p2pTransport) Exchange(ctx context.Context, msg AgentMessage) (*AgentMessage, error) {
+	return t.n.exchangeFollowingMoves(ctx, t.pid, msg)
+}
+
+func (t p2pTransport) String() string {
+	return "p2p " + t.pid.String()
+}
+
+func newMessageID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// LearnAddrs adds the addresses a recipient published to the peerstore, so
+// dialling its peer ID needs no discovery.
+func (n *AgentNode) LearnAddrs(to Recipient) {
+	pid, err := peer.Decode(to.PeerID)
+	if err != nil || len(to.Addrs) == 0 {
+		return
+	}
+	if h := n.CurrentHost(); h != nil {
+		h.Peerstore().AddAddrs(pid, to.Addrs, time.Hour)
+	}
+}
+
+// transports lists the ways to reach a recipient, libp2p first.
+func (n *AgentNode) transports(to Recipient) []Transport {
+	var ts []Transport
+	if pid, err := peer.Decode(to.PeerID); err == nil {
+		ts = append(ts, p2pTransport{n: n, pid: pid})
+	}
+	if isHTTPURL(to.Endpoint) {
+		ts = append(ts, httpTransport{n: n, endpoint: to.Endpoint, client: &http.Client{Timeout: a2aRequestTimeout}})
+	}
+	return ts
+}
+
+// Deliver sends msg to a recipient and returns the answer. The recipient's
+// peer ID is tried first; when the peer can't be reached, delivery falls
+// back to its HTTP endpoint. An answer from the counterparty, even an error
+// message, ends delivery. Recipients the identity policy denies are refused.
+func (n *AgentNode) Deliver(ctx context.Context, to Recipient, msg AgentMessage) (*AgentMessage, DeliveryReceipt, error) {
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+	if msg.Sender == "" {
+		msg.Sender = n.CurrentHost().ID().String()
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixMilli()
+	}
+	receipt := DeliveryReceipt{ID: msg.ID}
+	if err := n.Policy.Check(Counterparty{PeerID: to.PeerID}, PolicyActionDeliver); err != nil {
+		return nil, receipt, err
+	}
+	n.LearnAddrs(to)
+	ts := n.transports(to)
+	if len(ts) == 0 {
+		return nil, receipt, fmt.Errorf("recipient has neither a peer ID nor an HTTP endpoint")
+	}
+
+	var err error
+	for _, t := range ts {
+		receipt.Transport = t.String()
+		var resp *AgentMessage
+		start := time.Now()
+		resp, err = n.attempt(ctx, t, msg, &receipt)
+		n.History.Record(to.key(), time.Since(start), err)
+		n.noteOutcome(to.key(), InteractionDeliveryAccepted, err)
+		var pe *PeerError
+		if err == nil || errors.As(err, &pe) {
+			receipt.Delivered = true
+			return resp, receipt, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Printf("[Delivery] %s unreachable over %s: %v\n", msg.ID, t, err)
+	}
+	return nil, receipt, err
+}
+
+// attempt exchanges msg over t, retrying failures that may pass: transport
+// errors and retryable error messages. Retries resend the same ID, so the
+// counterparty can tell them from new messages.
+func (n *AgentNode) attempt(ctx context.Context, t Transport, msg AgentMessage, receipt *DeliveryReceipt) (*AgentMessage, error) {
+	backoff := deliveryBackoff
+	for i := 1; ; i++ {
+		receipt.Attempts++
+		resp, err := t.Exchange(ctx, msg)
+		if err == nil {
+			// Peers predating correlation IDs answer without one
+			if resp.ID != "" && resp.ID != msg.ID {
+				return nil, fmt.Errorf("%s answered message %s, not %s", t, resp.ID, msg.ID)
+			}
+			return resp, nil
+		}
+		var pe *PeerError
+		if (errors.As(err, &pe) && !pe.Retryable) || i >= deliveryAttempts {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Delegate sends a task to a recipient over whichever transport reaches it
+// and returns the response payload, like SendTask.
+func (n *AgentNode) Delegate(ctx context.Context, to Recipient, payload interface{}) (interface{}, DeliveryReceipt, error) {
+	resp, receipt, err := n.Deliver(ctx, to, n.taskMessage(payload))
+	if err != nil {
+		return nil, receipt, err
+	}
+	return resp.Payload, receipt, nil
+}
+
+// DelegateTask sends a task to the best of candidates: they are ranked by
+// the node's Selection policy, or tried in the order given without one. The
+// next candidate is tried while a task goes undelivered or is refused with a
+// retryable error. Candidates asking a price are left out while their
+// announcements are quarantined.
+func (n *AgentNode) DelegateTask(ctx context.Context, candidates []AgentRef, task TaskContext, payload interface{}) (interface{}, DeliveryReceipt, error) {
+	var eligible []AgentRef
+	for _, c := range candidates {
+		if c.Price != nil && c.Price.Sign() > 0 && n.Routes.IsQuarantined(c.PeerID) {
+			continue
+		}
+		eligible = append(eligible, c)
+	}
+	order := eligible
+	if n.Selection != nil {
+		ranked, err := n.Selection.RankCandidates(ctx, eligible, task)
+		if err != nil {
+			return nil, DeliveryReceipt{}, err
+		}
+		order = make([]AgentRef, len(ranked))
+		for i, r := range ranked {
+			order[i] = r.AgentRef
+		}
+	}
+
+	var receipt DeliveryReceipt
+	err := fmt.Errorf("no candidates for %q", task.Capability)
+	for _, c := range order {
+		var resp interface{}
+		resp, receipt, err = n.Delegate(ctx, c.Recipient, payload)
+		if err == nil {
+			return resp, receipt, nil
+		}
+		var pe *PeerError
+		if (receipt.Delivered && !(errors.As(err, &pe) && pe.Retryable)) || ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, receipt, err
+}
@@ -0,0 +1,333 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// txMineTimeout bounds how long sendTx waits for a receipt.
+const txMineTimeout = 2 * time.Minute
+
+// txSimulateTimeout bounds the RPC calls of one dry-run simulation.
+const txSimulateTimeout = 30 * time.Second
+
+// ErrDryRun is returned by write paths that need a mined receipt, such as
+// Register, when the client only simulates transactions.
+var ErrDryRun = errors.New("dry run: transaction was simulated, not sent")
+
+// ErrWrongChain is returned when an RPC serves another chain than the one a
+// client or watcher is bound to.
+var ErrWrongChain = errors.New("wrong chain")
+
+// TxBackend is the chain access the write paths need: calls, gas and fee
+// estimation, sending and receipts. *ethclient.Client implements it.
+type TxBackend interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	ChainID(ctx context.Context) (*big.Int, error)
+}
+
+// TxSimulation is what a transaction would have done, as found by eth_call
+// and eth_estimateGas with the exact calldata. Amounts are in wei.
+type TxSimulation struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Method       string `json:"method"`
+	Gas          uint64 `json:"gas,omitempty"`
+	GasFeeCap    string `json:"gasFeeCap,omitempty"`
+	Cost         string `json:"cost,omitempty"` // upper bound: gas * gasFeeCap + value
+	Reverted     bool   `json:"reverted"`
+	RevertReason string `json:"revertReason,omitempty"`
+}
+
+// SetDryRun switches the client between sending transactions and only
+// simulating them.
+func (c *ERC8004Client) SetDryRun(on bool) {
+	c.dryRun = on
+}
+
+// DryRun reports whether transactions are simulated instead of sent.
+func (c *ERC8004Client) DryRun() bool {
+	return c.dryRun
+}
+
+// SetTxBackend replaces the backend transactions and contract calls go
+// through, e.g. to count or script them in tests.
+func (c *ERC8004Client) SetTxBackend(b TxBackend) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.backend = b
+}
+
+// BindChain makes the client send transactions, and simulate them, only
+// while its RPC serves chainID, failing with ErrWrongChain otherwise. 0
+// unbinds it.
+func (c *ERC8004Client) BindChain(chainID uint64) {
+	c.chainID = chainID
+}
+
+// ChainID returns the chain the client is bound to, or 0.
+func (c *ERC8004Client) ChainID() uint64 {
+	return c.chainID
+}
+
+// RPCURL returns the endpoint the client was dialed with.
+func (c *ERC8004Client) RPCURL() string {
+	return c.rpcURL
+}
+
+// checkChain fails with ErrWrongChain if the client is bound to a chain
+// backend doesn't serve.
+func (c *ERC8004Client) checkChain(backend TxBackend) error {
+	if c.chainID == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), txSimulateTimeout)
+	defer cancel()
+	id, err := backend.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain id: %w", err)
+	}
+	if id.Uint64() != c.chainID {
+		return fmt.Errorf("%w: RPC serves chain %s, the client is bound to chain %d", ErrWrongChain, id, c.chainID)
+	}
+	return nil
+}
+
+// SetGovernor caps what sent transactions may cost. Simulated transactions
+// are free and are never charged to it.
+func (c *ERC8004Client) SetGovernor(g *TxGovernor) {
+	c.governor = g
+}
+
+// SetJournal records every sent or simulated transaction in the store's audit log.
+func (c *ERC8004Client) SetJournal(store MetadataStore) {
+	c.journal = store
+}
+
+// Simulations returns the transactions simulated so far, in order.
+func (c *ERC8004Client) Simulations() []TxSimulation {
+	c.simMu.Lock()
+	defer c.simMu.Unlock()
+	return append([]TxSimulation(nil), c.sims...)
+}
+
+// transact sends a transaction with sendTx, or in dry-run mode simulates it
+// and returns a nil receipt. A simulated revert is returned as an error
+// carrying the revert reason.
+func (c *ERC8004Client) transact(w *Wallet, to common.Address, data []byte, value *big.Int) (_ *types.Receipt, err error) {
+	method := c.methodName(data)
+	_, span := c.tracer().Start(context.Background(), "eth.transact", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("eth.method", method), attribute.String("eth.to", to.Hex()), attribute.Bool("eth.dry_run", c.dryRun)))
+	defer func() { endSpan(span, err) }()
+	_, backend, gen := c.conn()
+	if err := c.checkChain(backend); err != nil {
+		c.noteConnError(gen, err)
+		return nil, err
+	}
+	if !c.dryRun {
+		receipt, err := sendTx(backend, c.governor, w, to, data, value)
+		c.noteConnError(gen, err)
+		if receipt != nil {
+			c.record(AuditTxSent, to, map[string]interface{}{"method": method, "hash": receipt.TxHash.Hex(), "gasUsed": receipt.GasUsed})
+		}
+		return receipt, err
+	}
+
+	sim, err := simulateTx(backend, w, to, data, value)
+	c.noteConnError(gen, err)
+	if err != nil {
+		return nil, err
+	}
+	sim.Method = method
+	c.simMu.Lock()
+	c.sims = append(c.sims, sim)
+	c.simMu.Unlock()
+	c.record(AuditTxSimulated, to, sim)
+
+	if sim.Reverted {
+		fmt.Printf("[Tx] Dry run: %s would revert: %s\n", method, sim.RevertReason)
+		return nil, fmt.Errorf("transaction would revert: %s", sim.RevertReason)
+	}
+	fmt.Printf("[Tx] Dry run: %s would use %d gas, costing up to %s wei\n", method, sim.Gas, sim.Cost)
+	return nil, nil
+}
+
+// record appends a transaction to the journal, if one is set. Journal
+// failures are logged but never fail the transaction.
+func (c *ERC8004Client) record(kind string, to common.Address, detail interface{}) {
+	if c.journal == nil {
+		return
+	}
+	raw, _ := json.Marshal(detail)
+	if err := c.journal.AppendAudit(kind, to.Hex(), string(raw)); err != nil {
+		fmt.Printf("[Tx] Failed to journal %s: %v\n", kind, err)
+	}
+}
+
+// methodName names the registry function data calls, for journals and reports.
+func (c *ERC8004Client) methodName(data []byte) string {
+	if len(data) < 4 {
+		return "transfer"
+	}
+	for _, parsed := range []abi.ABI{c.identityABI, c.reputationABI, c.validationABI, c.escrowABI, c.marketABI} {
+		if m, err := parsed.MethodById(data[:4]); err == nil {
+			return m.Name
+		}
+	}
+	return hexutil.Encode(data[:4])
+}
+
+// simulateTx runs data through eth_call and eth_estimateGas as w would send
+// it, without signing or broadcasting anything. A revert is reported in the
+// result; only RPC failures are returned as errors.
+func simulateTx(client TxBackend, w *Wallet, to common.Address, data []byte, value *big.Int) (TxSimulation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), txSimulateTimeout)
+	defer cancel()
+
+	if value == nil {
+		value = big.NewInt(0)
+	}
+	sim := TxSimulation{From: w.Address.Hex(), To: to.Hex()}
+	msg := ethereum.CallMsg{From: w.Address, To: &to, Data: data, Value: value}
+
+	if _, err := client.CallContract(ctx, msg, nil); err != nil {
+		reason, ok := revertReason(err)
+		if !ok {
+			return sim, fmt.Errorf("simulation failed: %w", err)
+		}
+		sim.Reverted, sim.RevertReason = true, reason
+		return sim, nil
+	}
+	gas, err := client.EstimateGas(ctx, msg)
+	if err != nil {
+		reason, ok := revertReason(err)
+		if !ok {
+			return sim, fmt.Errorf("gas estimation failed: %w", err)
+		}
+		sim.Reverted, sim.RevertReason = true, reason
+		return sim, nil
+	}
+
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return sim, fmt.Errorf("failed to suggest gas tip: %w", err)
+	}
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return sim, fmt.Errorf("failed to get head: %w", err)
+	}
+	// Same fee cap sendTx would use, so Cost bounds what the real send may spend
+	feeCap := new(big.Int).Add(tip, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+	cost := new(big.Int).Mul(feeCap, new(big.Int).SetUint64(gas))
+
+	sim.Gas = gas
+	sim.GasFeeCap = feeCap.String()
+	sim.Cost = cost.Add(cost, value).String()
+	return sim, nil
+}
+
+// revertReason extracts the reason from an execution-reverted RPC error,
+// decoding Error(string) revert data when the node returns it. It reports
+// false for errors that are not reverts.
+func revertReason(err error) (string, bool) {
+	var de rpc.DataError
+	if errors.As(err, &de) {
+		if s, ok := de.ErrorData().(string); ok {
+			if data, derr := hexutil.Decode(s); derr == nil {
+				if reason, uerr := abi.UnpackRevert(data); uerr == nil {
+					return reason, true
+				}
+				return "execution reverted with data " + s, true
+			}
+		}
+		return de.Error(), true
+	}
+	if strings.Contains(err.Error(), "execution reverted") {
+		return err.Error(), true
+	}
+	return "", false
+}
+
+// sendTx signs a contract call with the wallet, broadcasts it as an EIP-1559
+// transaction and waits for it to be mined. Its worst-case cost is charged to
+// gov, if set, before signing. A reverted transaction is returned as an error
+// together with its receipt.
+func sendTx(client TxBackend, gov *TxGovernor, w *Wallet, to common.Address, data []byte, value *big.Int) (*types.Receipt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), txMineTimeout)
+	defer cancel()
+
+	if value == nil {
+		value = big.NewInt(0)
+	}
+
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain id: %w", err)
+	}
+	nonce, err := client.PendingNonceAt(ctx, w.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to suggest gas tip: %w", err)
+	}
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get head: %w", err)
+	}
+	feeCap := new(big.Int).Add(tip, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+
+	gas, err := client.EstimateGas(ctx, ethereum.CallMsg{From: w.Address, To: &to, Data: data, Value: value})
+	if err != nil {
+		return nil, fmt.Errorf("gas estimation failed: %w", err)
+	}
+	cost := new(big.Int).Mul(feeCap, new(big.Int).SetUint64(gas))
+	if err := gov.Reserve(cost.Add(cost, value)); err != nil {
+		return nil, err
+	}
+
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       gas,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	})
+	signed, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), w.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	if err := client.SendTransaction(ctx, signed); err != nil {
+		return nil, fmt.Errorf("failed to send transaction: %w", err)
+	}
+	fmt.Printf("[Tx] Sent %s, waiting to be mined...\n", signed.Hash().Hex())
+
+	receipt, err := bind.WaitMined(ctx, client, signed)
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for %s: %w", signed.Hash().Hex(), err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return receipt, fmt.Errorf("transaction %s reverted", signed.Hash().Hex())
+	}
+	return receipt, nil
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// countingBackend counts the transactions that reach the chain.
+type countingBackend struct {
+	*ethclient.Client
+	sent atomic.Int32
+}
+
+func (b *countingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sent.Add(1)
+	return b.Client.SendTransaction(ctx, tx)
+}
+
+const escrowAddrHex = "0x00000000000000000000000000000000000000e5"
+
+// revertData encodes Error(reason), as a require() failure returns it.
+func revertData(reason string) string {
+	str, _ := abi.NewType("string", "", nil)
+	packed, _ := abi.Arguments{{Type: str}}.Pack(reason)
+	return hexutil.Encode(append([]byte{0x08, 0xc3, 0x79, 0xa0}, packed...))
+}
+
+// newEscrowChain serves a TaskEscrow holding one task paying 1000 wei, and
+// 600 wei in all, with a 1 gwei base fee and tip. acceptTask reverts with revert, if set.
+func newEscrowChain(t *testing.T, revert string) (*ERC8004Client, *countingBackend) {
+	t.Helper()
+	escrowABI, _ := abi.JSON(strings.NewReader(taskEscrowABI))
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		switch method {
+		case "eth_call", "eth_estimateGas":
+			var call struct {
+				Input hexutil.Bytes `json:"input"`
+				Data  hexutil.Bytes `json:"data"`
+			}
+			json.Unmarshal(params[0], &call)
+			input := call.Input
+			if len(input) == 0 {
+				input = call.Data
+			}
+			switch {
+			case bytes.HasPrefix(input, escrowABI.Methods["getTask"].ID):
+				out, err := escrowABI.Methods["getTask"].Outputs.Pack(EscrowTask{
+					Client: common.HexToAddress("0xc11e47"), Payment: big.NewInt(1000), WorkerStake: big.NewInt(0),
+					CreatedAt: big.NewInt(1700000000), SubmittedAt: big.NewInt(0),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return hexutil.Encode(out), nil
+			case revert != "":
+				return nil, &rpcError{Code: 3, Message: "execution reverted: " + revert, Data: revertData(revert)}
+			case method == "eth_estimateGas":
+				return hexutil.Uint64(50000), nil
+			}
+			return "0x", nil
+		case "eth_getBalance":
+			return "0x258", nil
+		case "eth_maxPriorityFeePerGas":
+			return "0x3b9aca00", nil
+		case "eth_getBlockByNumber":
+			return &types.Header{Number: big.NewInt(100), Difficulty: big.NewInt(0), BaseFee: big.NewInt(1e9)}, nil
+		case "eth_chainId":
+			return hexutil.Uint64(84532), nil
+		case "eth_getTransactionCount":
+			return hexutil.Uint64(0), nil
+		case "eth_sendRawTransaction":
+			return nil, &rpcError{Code: -32000, Message: "test chain does not mine"}
+		}
+		return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+	})
+
+	c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	if c == nil {
+		t.Fatal("client not created")
+	}
+	t.Cleanup(c.Close)
+	eth, err := ethclient.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(eth.Close)
+	backend := &countingBackend{Client: eth}
+	c.SetTxBackend(backend)
+	return c, backend
+}
+
+func TestEscrowBalanceCappedByContract(t *testing.T) {
+	c, _ := newEscrowChain(t, "")
+	held, err := NewTaskEscrow(c, escrowAddrHex).EscrowBalance(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The task pays 1000 wei, but the contract only has 600
+	if held.Cmp(big.NewInt(600)) != 0 {
+		t.Errorf("EscrowBalance = %s, want 600", held)
+	}
+}
+
+func TestDryRunSendsNothing(t *testing.T) {
+	c, backend := newEscrowChain(t, "")
+	c.SetDryRun(true)
+	gov := NewTxGovernor(big.NewInt(1), DefaultSpendWindow)
+	c.SetGovernor(gov)
+	escrow := NewTaskEscrow(c, escrowAddrHex)
+	w := newTestWallet(t)
+
+	stake, err := escrow.Bid(w, big.NewInt(1))
+	if err != nil {
+		t.Fatalf("simulated bid: %v", err)
+	}
+	if err := escrow.Submit(w, big.NewInt(1), common.Hash{1}); err != nil {
+		t.Fatalf("simulated submit: %v", err)
+	}
+	if err := c.SetMetadata(w, big.NewInt(1), "peerId", []byte("12D3KooW")); err != nil {
+		t.Fatalf("simulated setMetadata: %v", err)
+	}
+
+	if n := backend.sent.Load(); n != 0 {
+		t.Errorf("%d transactions reached the backend in dry-run", n)
+	}
+	if stake.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("stake = %s, want 10%% of 1000", stake)
+	}
+	sims := c.Simulations()
+	if len(sims) != 3 || sims[0].Method != "acceptTask" || sims[1].Method != "submitResult" || sims[2].Method != "setMetadata" {
+		t.Fatalf("simulations = %+v", sims)
+	}
+	// 50000 gas at a 3 gwei fee cap (tip + 2 * base fee), plus the stake
+	if want := "150000000000100"; sims[0].Cost != want || sims[0].Reverted {
+		t.Errorf("acceptTask simulation = %+v, want cost %s", sims[0], want)
+	}
+	// Simulations are free to the governor, even above its limit
+	if spent := gov.Spent(); spent.Sign() != 0 {
+		t.Errorf("governor charged %s wei for simulations", spent)
+	}
+}
+
+func TestDryRunSurfacesRevertReason(t *testing.T) {
+	c, backend := newEscrowChain(t, "Task not available")
+	c.SetDryRun(true)
+	escrow := NewTaskEscrow(c, escrowAddrHex)
+
+	_, err := escrow.Bid(newTestWallet(t), big.NewInt(1))
+	if err == nil || !strings.Contains(err.Error(), "would revert: Task not available") {
+		t.Errorf("err = %v, want the revert reason", err)
+	}
+	sims := c.Simulations()
+	if len(sims) != 1 || !sims[0].Reverted || sims[0].RevertReason != "Task not available" {
+		t.Errorf("simulations = %+v, want a revert with its reason", sims)
+	}
+	if n := backend.sent.Load(); n != 0 {
+		t.Errorf("%d transactions reached the backend", n)
+	}
+}
+
+func TestGovernorBlocksSendOverLimit(t *testing.T) {
+	c, backend := newEscrowChain(t, "")
+	gov := NewTxGovernor(big.NewInt(1e12), DefaultSpendWindow)
+	c.SetGovernor(gov)
+
+	_, err := NewTaskEscrow(c, escrowAddrHex).Bid(newTestWallet(t), big.NewInt(1))
+	if !errors.Is(err, ErrSpendLimit) {
+		t.Errorf("err = %v, want ErrSpendLimit", err)
+	}
+	if n := backend.sent.Load(); n != 0 {
+		t.Errorf("%d transactions sent over the limit", n)
+	}
+	if spent := gov.Spent(); spent.Sign() != 0 {
+		t.Errorf("refused transaction charged %s wei", spent)
+	}
+}
+
+func TestSendReachesBackend(t *testing.T) {
+	c, backend := newEscrowChain(t, "")
+	err := c.SetMetadata(newTestWallet(t), big.NewInt(1), "peerId", []byte("12D3KooW"))
+	if err == nil || !strings.Contains(err.Error(), "test chain does not mine") {
+		t.Errorf("err = %v, want the send error", err)
+	}
+	if n := backend.sent.Load(); n != 1 {
+		t.Errorf("%d transactions sent, want 1", n)
+	}
+}
@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// The EIP-712 domain agentmesh signs under, with the chain and contract
+// where they apply.
+const (
+	TypedDomainName    = "AgentMesh"
+	TypedDomainVersion = "1"
+)
+
+// typedStructs are the EIP-712 types agentmesh signs. They are part of the
+// protocol: contracts and other implementations hash the same definitions,
+// so a field is never changed, only a new type added.
+var typedStructs = apitypes.Types{
+	// The terms of a negotiation's Agreement
+	"Agreement": {
+		{Name: "negotiationId", Type: "string"},
+		{Name: "assetHash", Type: "bytes32"},
+		{Name: "price", Type: "uint256"},
+		{Name: "token", Type: "address"}, // zero for ETH
+		{Name: "expiry", Type: "uint64"}, // unix ms
+		{Name: "requester", Type: "string"},
+		{Name: "responder", Type: "string"},
+		{Name: "rounds", Type: "uint32"},
+	},
+	// A requester's receipt for an answer to its knowledge request
+	"KnowledgeReceipt": {
+		{Name: "requestId", Type: "uint256"},
+		{Name: "answerHash", Type: "bytes32"},
+		{Name: "provider", Type: "address"},
+		{Name: "requester", Type: "address"},
+	},
+	// An agent owner's pre-authorization of a client's feedback, per ERC-8004
+	"FeedbackAuth": {
+		{Name: "agentId", Type: "uint256"},
+		{Name: "clientAddress", Type: "address"},
+		{Name: "indexLimit", Type: "uint64"},
+		{Name: "expiry", Type: "uint256"},
+		{Name: "chainId", Type: "uint256"},
+		{Name: "identityRegistry", Type: "address"},
+		{Name: "signerAddress", Type: "address"},
+	},
+}
+
+// TypedDomain is the EIP-712 domain of agentmesh on chainID at contract,
+// the contract that verifies the signature. A zero chainID or contract is
+// left out of the domain.
+func TypedDomain(chainID uint64, contract common.Address) apitypes.TypedDataDomain {
+	d := apitypes.TypedDataDomain{Name: TypedDomainName, Version: TypedDomainVersion}
+	if chainID != 0 {
+		d.ChainId = math.NewHexOrDecimal256(int64(chainID))
+	}
+	if contract != (common.Address{}) {
+		d.VerifyingContract = contract.Hex()
+	}
+	return d
+}
+
+// newTypedData is message as the typedStructs type primary, under domain.
+func newTypedData(primary string, domain apitypes.TypedDataDomain, message apitypes.TypedDataMessage) apitypes.TypedData {
+	// EIP712Domain lists the fields the domain has, in the order EIP-712 gives
+	var fields []apitypes.Type
+	present := domain.Map()
+	for _, f := range []apitypes.Type{{Name: "name", Type: "string"}, {Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"}, {Name: "verifyingContract", Type: "address"}, {Name: "salt", Type: "bytes32"}} {
+		if _, ok := present[f.Name]; ok {
+			fields = append(fields, f)
+		}
+	}
+	return apitypes.TypedData{
+		Types:       apitypes.Types{"EIP712Domain": fields, primary: typedStructs[primary]},
+		PrimaryType: primary,
+		Domain:      domain,
+		Message:     message,
+	}
+}
+
+// TypedDigest is the hash an EIP-712 signature of data signs:
+// keccak256("\x19\x01" || domainSeparator || hashStruct(message)).
+func TypedDigest(data apitypes.TypedData) (common.Hash, error) {
+	digest, _, err := apitypes.TypedDataAndHash(data)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("EIP-712 %s: %w", data.PrimaryType, err)
+	}
+	return common.BytesToHash(digest), nil
+}
+
+// Signer signs EIP-712 typed data for an Ethereum account. *Wallet is one;
+// a remote signer or hardware wallet can be another.
+type Signer interface {
+	Account() common.Address
+	// SignTypedData returns the 65-byte [R || S || V] signature of data's
+	// TypedDigest, with V in {27, 28}.
+	SignTypedData(data apitypes.TypedData) ([]byte, error)
+}
+
+// Account is the wallet's address.
+func (w *Wallet) Account() common.Address {
+	return w.Address
+}
+
+// SignTypedData signs data per EIP-712 with the wallet key.
+func (w *Wallet) SignTypedData(data apitypes.TypedData) ([]byte, error) {
+	digest, err := TypedDigest(data)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := ethcrypto.Sign(digest.Bytes(), w.key)
+	if err != nil {
+		return nil, err
+	}
+	sig[ethcrypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
+
+// signer returns what signs for the node's wallet: Signer, or Wallet, or
+// nil if it has neither.
+func (n *AgentNode) signer() Signer {
+	if n.Signer != nil {
+		return n.Signer
+	}
+	if n.Wallet != nil {
+		return n.Wallet
+	}
+	return nil
+}
+
+// RecoverTypedSigner returns the account whose key made sig, an EIP-712
+// signature of data.
+func RecoverTypedSigner(data apitypes.TypedData, sig []byte) (common.Address, error) {
+	digest, err := TypedDigest(data)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return recoverSigner(digest, sig)
+}
+
+// VerifyTypedSignature checks that account's key made sig, an EIP-712
+// signature of data. Like VerifyEOASignature, it can't verify smart-contract
+// wallets; use ERC8004Client.VerifyTypedWalletSignature for those.
+func VerifyTypedSignature(account common.Address, data apitypes.TypedData, sig []byte) bool {
+	signer, err := RecoverTypedSigner(data, sig)
+	return err == nil && signer == account
+}
+
+// VerifyTypedWalletSignature checks that wallet signed data per EIP-712,
+// through EIP-1271 isValidSignature if it is a contract.
+func (c *ERC8004Client) VerifyTypedWalletSignature(wallet common.Address, data apitypes.TypedData, sig []byte) (bool, error) {
+	digest, err := TypedDigest(data)
+	if err != nil {
+		return false, err
+	}
+	return c.verifyWalletHash(wallet, digest, sig)
+}
+
+// TypedData is the agreement's terms as EIP-712 typed data. Agreements
+// aren't bound to a chain, so the domain has neither chain nor contract.
+func (a Agreement) TypedData() apitypes.TypedData {
+	token := common.Address{}
+	if a.Token != "" {
+		token = common.HexToAddress(a.Token)
+	}
+	return newTypedData("Agreement", TypedDomain(0, common.Address{}), apitypes.TypedDataMessage{
+		"negotiationId": a.NegotiationID,
+		"assetHash":     a.AssetHash,
+		"price":         bigString(a.Price),
+		"token":         token.Hex(),
+		"expiry":        fmt.Sprint(a.Expiry),
+		"requester":     a.Requester,
+		"responder":     a.Responder,
+		"rounds":        fmt.Sprint(a.Rounds),
+	})
+}
+
+// verifyWalletSig checks one side's EIP-712 signature: none at all passes,
+// since wallet signatures are optional, but a wallet without a valid
+// signature by it doesn't.
+func (a Agreement) verifyWalletSig(wallet, sig string) bool {
+	if wallet == "" && sig == "" {
+		return true
+	}
+	raw, err := hexutil.Decode(sig)
+	return err == nil && common.IsHexAddress(wallet) && VerifyTypedSignature(common.HexToAddress(wallet), a.TypedData(), raw)
+}
+
+// KnowledgeReceipt is a requester's EIP-712 receipt for an answer to its
+// knowledge request, signed with the wallet that posted the request, for
+// the market on ChainID at Market to release the bounty to Provider.
+type KnowledgeReceipt struct {
+	ChainID    uint64 `json:"chainId,omitempty"`
+	Market     string `json:"market"`
+	RequestID  string `json:"requestId"` // decimal
+	AnswerHash string `json:"answerHash"`
+	Provider   string `json:"provider"`  // wallet of the node that answered
+	Requester  string `json:"requester"` // wallet that signed the receipt
+	Signature  string `json:"signature"` // hex, EIP-712
+}
+
+// TypedData is the receipt as EIP-712 typed data, in the domain of its
+// market.
+func (r KnowledgeReceipt) TypedData() apitypes.TypedData {
+	return newTypedData("KnowledgeReceipt", TypedDomain(r.ChainID, common.HexToAddress(r.Market)), apitypes.TypedDataMessage{
+		"requestId":  r.RequestID,
+		"answerHash": r.AnswerHash,
+		"provider":   r.Provider,
+		"requester":  r.Requester,
+	})
+}
+
+// Verify checks that Requester signed the receipt.
+func (r KnowledgeReceipt) Verify() bool {
+	sig, err := hexutil.Decode(r.Signature)
+	if err != nil || !common.IsHexAddress(r.Requester) || !common.IsHexAddress(r.Provider) || !common.IsHexAddress(r.Market) {
+		return false
+	}
+	if _, ok := new(big.Int).SetString(r.RequestID, 10); !ok {
+		return false
+	}
+	return VerifyTypedSignature(common.HexToAddress(r.Requester), r.TypedData(), sig)
+}
+
+// FeedbackAuth is an agent owner's pre-authorization for ClientAddress to
+// leave up to IndexLimit feedback entries on AgentID until Expiry, in the
+// ERC-8004 ReputationRegistry, signed by SignerAddress.
+type FeedbackAuth struct {
+	AgentID          *big.Int       `json:"agentId"`
+	ClientAddress    common.Address `json:"clientAddress"`
+	IndexLimit       uint64         `json:"indexLimit"`
+	Expiry           uint64         `json:"expiry"` // unix seconds
+	ChainID          uint64         `json:"chainId"`
+	IdentityRegistry common.Address `json:"identityRegistry"`
+	SignerAddress    common.Address `json:"signerAddress"`
+}
+
+// TypedData is the authorization as EIP-712 typed data, in the domain of
+// the reputation registry at registry.
+func (f FeedbackAuth) TypedData(registry common.Address) apitypes.TypedData {
+	return newTypedData("FeedbackAuth", TypedDomain(f.ChainID, registry), apitypes.TypedDataMessage{
+		"agentId":          bigString(f.AgentID),
+		"clientAddress":    f.ClientAddress.Hex(),
+		"indexLimit":       fmt.Sprint(f.IndexLimit),
+		"expiry":           fmt.Sprint(f.Expiry),
+		"chainId":          fmt.Sprint(f.ChainID),
+		"identityRegistry": f.IdentityRegistry.Hex(),
+		"signerAddress":    f.SignerAddress.Hex(),
+	})
+}
+
+// SignFeedbackAuth signs f for the reputation registry at registry, as
+// f.SignerAddress, which must be s's account.
+func SignFeedbackAuth(s Signer, f FeedbackAuth, registry common.Address) ([]byte, error) {
+	if s.Account() != f.SignerAddress {
+		return nil, fmt.Errorf("feedback authorization names signer %s, not %s", f.SignerAddress.Hex(), s.Account().Hex())
+	}
+	return s.SignTypedData(f.TypedData(registry))
+}
+
+// VerifyFeedbackAuth checks that f.SignerAddress signed f for the
+// reputation registry at registry. Whether the signer may authorize
+// feedback on the agent, and whether f expired, is the caller's to check.
+func VerifyFeedbackAuth(f FeedbackAuth, registry common.Address, sig []byte) bool {
+	return VerifyTypedSignature(f.SignerAddress, f.TypedData(registry), sig)
+}
+
+// bigString is n in decimal, with nil as 0.
+func bigString(n *big.Int) string {
+	if n == nil {
+		return "0"
+	}
+	return n.String()
+}
@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// typedVector is an EIP-712 test vector from testdata/eip712/vectors.json.
+// The mail vector is the example of EIP-712 itself; check.mjs checks them
+// all against ethers.js.
+type typedVector struct {
+	Name            string                    `json:"name"`
+	Domain          apitypes.TypedDataDomain  `json:"domain"`
+	Types           apitypes.Types            `json:"types"`
+	PrimaryType     string                    `json:"primaryType"`
+	Message         apitypes.TypedDataMessage `json:"message"`
+	EncodeType      string                    `json:"encodeType"`
+	TypeHash        string                    `json:"typeHash"`
+	DomainSeparator string                    `json:"domainSeparator"`
+	StructHash      string                    `json:"structHash"`
+	Digest          string                    `json:"digest"`
+	Signature       string                    `json:"signature"`
+}
+
+func TestTypedDataMatchesReferenceVectors(t *testing.T) {
+	raw, err := os.ReadFile("testdata/eip712/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		PrivateKey string        `json:"privateKey"`
+		Vectors    []typedVector `json:"vectors"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ethcrypto.HexToECDSA(file.PrivateKey[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Wallet{key: key, Address: ethcrypto.PubkeyToAddress(key.PublicKey)}
+	other := common.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+
+	// The same messages, built from agentmesh's own types
+	ours := map[string]apitypes.TypedData{
+		"agreement": Agreement{NegotiationID: "neg-1", AssetHash: HashAsset([]byte("summarize the ERC-8004 spec")), Price: big.NewInt(1500000000000000),
+			Expiry: 1767225600000, Requester: "12D3KooWRequester", Responder: "12D3KooWResponder", Rounds: 3}.TypedData(),
+		"knowledgeReceipt": KnowledgeReceipt{ChainID: 8453, Market: "0x5FbDB2315678afecb367f032d93F642f64180aa3", RequestID: "42",
+			AnswerHash: ethcrypto.Keccak256Hash([]byte("answer")).Hex(), Provider: other.Hex(), Requester: w.Address.Hex()}.TypedData(),
+		"feedbackAuth": FeedbackAuth{AgentID: big.NewInt(12), ClientAddress: other, IndexLimit: 5, Expiry: 1767225600, ChainID: 84532,
+			IdentityRegistry: common.HexToAddress("0x8004a6090Cd10A7288092483047B097295Fb8847"), SignerAddress: w.Address,
+		}.TypedData(common.HexToAddress("0x8004B8FD1A363aa02fDC07635C0c5F94f6Af5B7E")),
+	}
+
+	for _, v := range file.Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			data, ok := ours[v.Name]
+			if !ok {
+				data = newTypedData(v.PrimaryType, v.Domain, v.Message)
+				for name, fields := range v.Types {
+					data.Types[name] = fields
+				}
+			}
+			if got := string(data.EncodeType(v.PrimaryType)); got != v.EncodeType {
+				t.Errorf("encodeType %s, want %s", got, v.EncodeType)
+			}
+			if got := hexutil.Encode(data.TypeHash(v.PrimaryType)); got != v.TypeHash {
+				t.Errorf("typeHash %s, want %s", got, v.TypeHash)
+			}
+			domain, err := data.HashStruct("EIP712Domain", data.Domain.Map())
+			if err != nil || domain.String() != v.DomainSeparator {
+				t.Errorf("domain separator %s (%v), want %s", domain, err, v.DomainSeparator)
+			}
+			hash, err := data.HashStruct(v.PrimaryType, data.Message)
+			if err != nil || hash.String() != v.StructHash {
+				t.Errorf("struct hash %s (%v), want %s", hash, err, v.StructHash)
+			}
+			digest, err := TypedDigest(data)
+			if err != nil || digest.Hex() != v.Digest {
+				t.Errorf("digest %s (%v), want %s", digest.Hex(), err, v.Digest)
+			}
+			sig, err := w.SignTypedData(data)
+			if err != nil || hexutil.Encode(sig) != v.Signature {
+				t.Errorf("signature %x (%v), want %s", sig, err, v.Signature)
+			}
+			if signer, err := RecoverTypedSigner(data, sig); err != nil || signer != w.Address {
+				t.Errorf("recovered %s (%v), want %s", signer.Hex(), err, w.Address.Hex())
+			}
+		})
+	}
+
+	// A signature only verifies for the message and domain it was made over
+	auth := FeedbackAuth{AgentID: big.NewInt(12), ClientAddress: other, IndexLimit: 5, Expiry: 1767225600, ChainID: 84532, SignerAddress: w.Address}
+	registry := common.HexToAddress("0x8004B8FD1A363aa02fDC07635C0c5F94f6Af5B7E")
+	sig, err := SignFeedbackAuth(w, auth, registry)
+	if err != nil || !VerifyFeedbackAuth(auth, registry, sig) {
+		t.Fatalf("feedback authorization didn't verify: %v", err)
+	}
+	raised := auth
+	raised.IndexLimit = 50
+	if VerifyFeedbackAuth(raised, registry, sig) || VerifyFeedbackAuth(auth, other, sig) {
+		t.Error("a feedback authorization verified for other terms or another registry")
+	}
+	auth.SignerAddress = other
+	if _, err := SignFeedbackAuth(w, auth, registry); err == nil {
+		t.Error("signed a feedback authorization naming another signer")
+	}
+}
+
+func TestWalletsSignAgreementsAndReceipts(t *testing.T) {
+	a, b := startTestNode(t), startTestNode(t)
+	a.Wallet, b.Wallet = newTestWallet(t), newTestWallet(t)
+	b.SetNegotiationHandler(func(peerID string, offer Offer) NegotiationStrategy { return TakeItOrLeaveIt{Price: big.NewInt(80)} })
+	if _, err := a.addTarget(dialAddr(b)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opening := Offer{AssetHash: HashAsset([]byte(`{"capability":"summarize"}`)), Price: big.NewInt(80)}
+	agreement, err := a.Negotiate(ctx, b.CurrentHost().ID().String(), opening, TakeItOrLeaveIt{Price: big.NewInt(80)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agreement.RequesterWallet != a.Wallet.Address.Hex() || agreement.ResponderWallet != b.Wallet.Address.Hex() || !agreement.Verify() {
+		t.Fatalf("agreement %+v, want both wallets' EIP-712 signatures", agreement)
+	}
+	forged := *agreement
+	forged.ResponderWallet = a.Wallet.Address.Hex()
+	if forged.Verify() {
+		t.Error("an agreement verified with a wallet that didn't sign it")
+	}
+
+	// The requester's ack carries its wallet's receipt for the answer
+	answer := KnowledgeAnswer{RequestID: "9", ChainID: 8453, Topic: "go", Content: "goroutines",
+		Market: "0x5fbdb2315678afecb367f032d93f642f64180aa3", Provider: b.Wallet.Address.Hex()}
+	if _, err := b.addTarget(dialAddr(a)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := b.DeliverKnowledge(ctx, "query:9", a.CurrentHost().ID().String(), answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := d.Ack.Receipt
+	if r == nil || r.Requester != a.Wallet.Address.Hex() || r.Provider != b.Wallet.Address.Hex() || r.ChainID != 8453 || !r.Verify() {
+		t.Fatalf("receipt %+v, want one by the requester's wallet crediting the provider", r)
+	}
+	hash, _ := answer.Hash()
+	if r.AnswerHash != hash.Hex() {
+		t.Errorf("receipt names answer %s, want %s", r.AnswerHash, hash.Hex())
+	}
+	other := *r
+	other.Market = "0x0000000000000000000000000000000000000001"
+	if other.Verify() {
+		t.Error("a receipt verified for another market")
+	}
+}
@@ -1,21 +1,44 @@
 package agent
 
 type AgentCapability struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	Name        string                 `json:"name"`
+	ID          string                 `json:"id,omitempty"` // namespaced identifier, e.g. skill/text-summarization@1; see MatchCapability
+	Description string                 `json:"description"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`  // payload contract, from a manifest
+	Pricing     *CapabilityPricing     `json:"pricing,omitempty"` // pricing hint, from a manifest
 }
 
 type AgentMessage struct {
-	Type      string      `json:"type"` // "task", "response", "error"
-	Payload   interface{} `json:"payload"`
-	Sender    string      `json:"sender"`
-	Timestamp int64       `json:"timestamp"`
+	ID        string            `json:"id,omitempty"` // correlation ID, echoed by the response
+	Type      string            `json:"type"`         // "task", "response", "error"
+	Payload   interface{}       `json:"payload"`
+	Sender    string            `json:"sender"`
+	Timestamp int64             `json:"timestamp"`
+	Hops      int               `json:"hops,omitempty"`   // times the task was forwarded
+	Trace     map[string]string `json:"trace,omitempty"`  // W3C trace context of the sender's span
+	Commit    bool              `json:"commit,omitempty"` // the sender wants a commitment to the response first
+	Stream    bool              `json:"stream,omitempty"` // the sender reads a StreamResult as frames; see MessageStream
+	Fresh     bool              `json:"fresh,omitempty"`  // the sender wants an answer worked out anew, not a cached one
+
+	// Encoding is how Payload was compressed, if it was: it then holds the
+	// payload's JSON compressed and base64-encoded, until the receiver
+	// decompresses it. AcceptEncoding lists the encodings the sender reads,
+	// for its peer to compress what it sends back.
+	Encoding       string   `json:"encoding,omitempty"`
+	AcceptEncoding []string `json:"acceptEncoding,omitempty"`
+
+	result *StreamResult // the result a MessageStream message announces, until it is sent
 }
 
 // SignedPacket contains a signed message for secure discovery.
-// Data is stored as a JSON string to ensure deterministic signing.
+// Data is the canonical JSON that was signed, kept as a string so it is
+// verified as sent.
 type SignedPacket struct {
 	Data      string `json:"data"`      // JSON-encoded payload (signed as-is)
 	Signature string `json:"signature"` // Base64-encoded Ed25519 signature
 	PeerID    string `json:"peerId"`
+	// WalletSig optionally proves control of the ethAddress in Data: an
+	// EIP-191 signature over Data by that wallet, hex-encoded. Smart-contract
+	// wallets are verified through EIP-1271.
+	WalletSig string `json:"walletSig,omitempty"`
 }
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// validationReorgDepth is how far behind the head a block must be for
+	// its validation decisions to be cached. Newer blocks may still be
+	// reorganized, so they are fetched again on every call.
+	validationReorgDepth = 64
+	// maxCachedValidationAgents bounds the agents whose decisions a client
+	// caches; past it, the cache starts over.
+	maxCachedValidationAgents = 1000
+)
+
+// ValidationDecision is a validator's response to a validation request for
+// an agent: a ValidationResponse event of the ValidationRegistry.
+type ValidationDecision struct {
+	Validator    common.Address `json:"validator"`
+	AgentID      *big.Int       `json:"agentId"`
+	RequestHash  common.Hash    `json:"requestHash"`
+	Response     uint8          `json:"response"` // 0 (failed) to 100 (passed)
+	ResponseURI  string         `json:"responseUri,omitempty"`
+	ResponseHash common.Hash    `json:"responseHash"`
+	Tag          string         `json:"tag,omitempty"`
+	Block        uint64         `json:"block"`
+	Time         uint64         `json:"time"` // the block's unix timestamp
+	TxHash       common.Hash    `json:"txHash"`
+	LogIndex     uint           `json:"logIndex"`
+}
+
+// ValidationHistory is a page of an agent's validation decisions, oldest
+// first.
+type ValidationHistory struct {
+	Decisions []ValidationDecision `json:"decisions"`
+	Next      uint64               `json:"next,omitempty"` // fromBlock of the next page; 0 after the last
+}
+
+// validationCache holds the decisions GetValidationHistory fetched, by agent.
+type validationCache struct {
+	mu     sync.Mutex
+	agents map[string]*agentValidations
+}
+
+// agentValidations are all of an agent's decisions in blocks from..to. An
+// entry is replaced, never changed, so it can be read without the lock.
+type agentValidations struct {
+	from, to  uint64
+	decisions []ValidationDecision
+}
+
+// GetValidationHistory returns the validation decisions for agentId from
+// fromBlock to the head, oldest first, from the ValidationRegistry's
+// ValidationResponse events. fromBlock 0 starts at the registries'
+// deployment block; see SetRegistryDeployBlock. Only decisions by one of
+// validators, if any are given, and under tag, if not empty, are returned.
+// Unlike the registry's average, they show when an agent started to fail.
+//
+// A positive limit pages the history: a page holds at most limit decisions,
+// or more if the last block has more, since blocks aren't split across
+// pages. Pass Next as fromBlock for the next page. Decisions
+// validationReorgDepth blocks behind the head are cached, so later pages and
+// calls only fetch the blocks since.
+func (c *ERC8004Client) GetValidationHistory(ctx context.Context, agentId *big.Int, validators []common.Address, tag string, fromBlock uint64, limit int) (ValidationHistory, error) {
+	var head uint64
+	err := c.read(ctx, func(_ *ethclient.Client, b TxBackend) error {
+		h, err := b.HeaderByNumber(ctx, nil)
+		if err == nil {
+			head = h.Number.Uint64()
+		}
+		return err
+	})
+	if err != nil {
+		return ValidationHistory{}, fmt.Errorf("failed to read the head block: %w", err)
+	}
+	if fromBlock == 0 {
+		fromBlock = registryDeployBlock
+		if c.registryBlock > 0 {
+			fromBlock = c.registryBlock
+		}
+	}
+	decisions, err := c.validationDecisions(ctx, agentId, fromBlock, head)
+	if err != nil {
+		return ValidationHistory{}, err
+	}
+
+	wanted := map[common.Address]bool{}
+	for _, v := range validators {
+		wanted[v] = true
+	}
+	history := ValidationHistory{Decisions: []ValidationDecision{}}
+	for _, d := range decisions {
+		if len(wanted) > 0 && !wanted[d.Validator] || tag != "" && d.Tag != tag {
+			continue
+		}
+		if n := len(history.Decisions); limit > 0 && n >= limit && d.Block != history.Decisions[n-1].Block {
+			history.Next = d.Block
+			break
+		}
+		history.Decisions = append(history.Decisions, d)
+	}
+	return history, nil
+}
+
+// validationDecisions returns all of agentId's decisions in blocks
+// from..head, from the cache where it has them.
+func (c *ERC8004Client) validationDecisions(ctx context.Context, agentId *big.Int, from, head uint64) ([]ValidationDecision, error) {
+	if from > head {
+		return nil, nil
+	}
+	key := agentId.String()
+	c.validations.mu.Lock()
+	cached := c.validations.agents[key]
+	c.validations.mu.Unlock()
+
+	var out []ValidationDecision
+	scanFrom := from
+	useCache := cached != nil && cached.from <= from && from <= cached.to
+	if useCache {
+		for _, d := range cached.decisions {
+			if d.Block >= from {
+				out = append(out, d)
+			}
+		}
+		scanFrom = cached.to + 1
+	}
+	fetched, err := c.scanValidationDecisions(ctx, agentId, scanFrom, head)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, fetched...)
+
+	var stable uint64
+	if head > validationReorgDepth {
+		stable = head - validationReorgDepth
+	}
+	var settled []ValidationDecision
+	for _, d := range fetched {
+		if d.Block <= stable {
+			settled = append(settled, d)
+		}
+	}
+	var entry *agentValidations
+	switch {
+	case useCache && stable > cached.to:
+		decisions := append(append([]ValidationDecision(nil), cached.decisions...), settled...)
+		entry = &agentValidations{from: cached.from, to: stable, decisions: decisions}
+	case !useCache && stable >= from && (cached == nil || from < cached.from):
+		entry = &agentValidations{from: from, to: stable, decisions: settled}
+	}
+	if entry != nil {
+		c.validations.mu.Lock()
+		if c.validations.agents == nil || len(c.validations.agents) >= maxCachedValidationAgents {
+			c.validations.agents = map[string]*agentValidations{}
+		}
+		c.validations.agents[key] = entry
+		c.validations.mu.Unlock()
+	}
+	return out, nil
+}
+
+// scanValidationDecisions fetches agentId's decisions in blocks from..to
+// through the client's LogScanner.
+func (c *ERC8004Client) scanValidationDecisions(ctx context.Context, agentId *big.Int, from, to uint64) ([]ValidationDecision, error) {
+	event := c.validationABI.Events["ValidationResponse"]
+	fetch := func(ctx context.Context, from, to uint64) ([]types.Log, error) {
+		// ValidationResponse(address indexed validatorAddress, uint256 indexed agentId, bytes32 indexed requestHash, ...)
+		query := ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{c.validAddr},
+			Topics: [][]common.Hash{
+				{event.ID},
+				nil,
+				{common.BigToHash(agentId)},
+			},
+		}
+		var logs []types.Log
+		err := c.read(ctx, func(_ *ethclient.Client, b TxBackend) (err error) {
+			logs, err = b.FilterLogs(ctx, query)
+			return err
+		})
+		return logs, err
+	}
+
+	var out []ValidationDecision
+	times := map[uint64]uint64{} // block timestamps the RPC left out of logs
+	err := c.scanner.Scan(ctx, from, to, registryLogRange, fetch, func(_, _ uint64, logs []types.Log) error {
+		for _, l := range logs {
+			d, err := c.decodeValidationResponse(l)
+			if err != nil {
+				return err
+			}
+			if d.Time == 0 {
+				if _, ok := times[d.Block]; !ok {
+					t, err := c.blockTime(ctx, d.Block)
+					if err != nil {
+						return fmt.Errorf("failed to read block %d: %w", d.Block, err)
+					}
+					times[d.Block] = t
+				}
+				d.Time = times[d.Block]
+			}
+			out = append(out, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan validation responses: %w", err)
+	}
+	return out, nil
+}
+
+// decodeValidationResponse decodes a ValidationResponse log.
+func (c *ERC8004Client) decodeValidationResponse(l types.Log) (ValidationDecision, error) {
+	// Fields named as unpackLog expects them
+	var raw struct {
+		ValidatorAddress common.Address
+		AgentId          *big.Int
+		RequestHash      [32]byte
+		Response         uint8
+		ResponseURI      string
+		ResponseHash     [32]byte
+		Tag              string
+	}
+	if err := unpackLog(c.validationABI, "ValidationResponse", &raw, l); err != nil {
+		return ValidationDecision{}, err
+	}
+	return ValidationDecision{
+		Validator:    raw.ValidatorAddress,
+		AgentID:      raw.AgentId,
+		RequestHash:  raw.RequestHash,
+		Response:     raw.Response,
+		ResponseURI:  raw.ResponseURI,
+		ResponseHash: raw.ResponseHash,
+		Tag:          raw.Tag,
+		Block:        l.BlockNumber,
+		Time:         l.BlockTimestamp,
+		TxHash:       l.TxHash,
+		LogIndex:     l.Index,
+	}, nil
+}
+
+// blockTime returns the timestamp of block n.
+func (c *ERC8004Client) blockTime(ctx context.Context, n uint64) (uint64, error) {
+	var t uint64
+	err := c.read(ctx, func(_ *ethclient.Client, b TxBackend) error {
+		h, err := b.HeaderByNumber(ctx, new(big.Int).SetUint64(n))
+		if err == nil {
+			t = h.Time
+		}
+		return err
+	})
+	return t, err
+}
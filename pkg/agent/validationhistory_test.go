@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// validationResponseLog is a ValidationResponse log for agent 7 at block,
+// encoded with the client's ABI. A zero at leaves the timestamp out, as some
+// RPCs do.
+func validationResponseLog(t *testing.T, c *ERC8004Client, block, at uint64, validator common.Address, response uint8, tag string) types.Log {
+	t.Helper()
+	event := c.validationABI.Events["ValidationResponse"]
+	data, err := event.Inputs.NonIndexed().Pack(response, "ipfs://evidence", [32]byte{0xee}, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.Log{
+		Address:        c.validAddr,
+		Topics:         []common.Hash{event.ID, common.BytesToHash(validator.Bytes()), common.BigToHash(big.NewInt(7)), {0x0e, byte(block)}},
+		Data:           data,
+		BlockNumber:    block,
+		BlockTimestamp: at,
+		TxHash:         common.Hash{byte(block)},
+		Index:          uint(response),
+	}
+}
+
+func TestValidationHistoryIsDecodedFilteredPagedAndCached(t *testing.T) {
+	alice := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	bob := common.HexToAddress("0x00000000000000000000000000000000000000b0")
+	chain := &fakeChain{head: 200, headTime: 5000}
+	client := NewERC8004Client(newFakeRPC(t, chain.handle), zeroAddressHex, zeroAddressHex, "0x00000000000000000000000000000000000000a7")
+	t.Cleanup(client.Close)
+
+	want := crypto.Keccak256Hash([]byte("ValidationResponse(address,uint256,bytes32,uint8,string,bytes32,string)"))
+	if id := client.validationABI.Events["ValidationResponse"].ID; id != want {
+		t.Fatalf("ValidationResponse topic %s, want %s", id.Hex(), want.Hex())
+	}
+	chain.logs = []types.Log{
+		validationResponseLog(t, client, 20, 1000, alice, 100, "code"),
+		validationResponseLog(t, client, 20, 1000, bob, 90, "code"),
+		validationResponseLog(t, client, 50, 1300, alice, 80, "text"),
+		validationResponseLog(t, client, 120, 0, alice, 30, "code"),
+		validationResponseLog(t, client, 180, 4800, alice, 0, "code"),
+	}
+
+	ctx := context.Background()
+	all, err := client.GetValidationHistory(ctx, big.NewInt(7), nil, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Decisions) != 5 || all.Next != 0 {
+		t.Fatalf("history %+v, want all 5 decisions", all)
+	}
+	d := all.Decisions[0]
+	if d.Validator != alice || d.AgentID.Int64() != 7 || d.RequestHash != (common.Hash{0x0e, 20}) || d.Response != 100 ||
+		d.ResponseURI != "ipfs://evidence" || d.ResponseHash != (common.Hash{0xee}) || d.Tag != "code" || d.Block != 20 || d.Time != 1000 {
+		t.Errorf("decoded %+v", d)
+	}
+	if got := all.Decisions[3].Time; got != 5000 {
+		t.Errorf("a log without a timestamp got %d, want the block's", got)
+	}
+
+	// The trend of one validator's code reviews
+	code, _ := client.GetValidationHistory(ctx, big.NewInt(7), []common.Address{alice}, "code", 10, 0)
+	var responses []uint8
+	for _, d := range code.Decisions {
+		responses = append(responses, d.Response)
+	}
+	if len(responses) != 3 || responses[0] != 100 || responses[1] != 30 || responses[2] != 0 {
+		t.Errorf("alice's code responses %v, want 100, 30, 0", responses)
+	}
+
+	// Pages don't split a block
+	chain.ranges = nil
+	first, _ := client.GetValidationHistory(ctx, big.NewInt(7), nil, "", 10, 1)
+	if len(first.Decisions) != 2 || first.Next != 50 {
+		t.Errorf("first page %+v, want block 20's two decisions and block 50 next", first)
+	}
+	second, _ := client.GetValidationHistory(ctx, big.NewInt(7), nil, "", first.Next, 1)
+	if len(second.Decisions) != 1 || second.Decisions[0].Block != 50 || second.Next != 120 {
+		t.Errorf("second page %+v, want block 50 and block 120 next", second)
+	}
+
+	// Settled blocks come from the cache; only the recent ones are fetched
+	// again, and once the head moves, the blocks since
+	chain.head = 300
+	chain.logs = append(chain.logs, validationResponseLog(t, client, 290, 6000, bob, 10, "code"))
+	latest, err := client.GetValidationHistory(ctx, big.NewInt(7), nil, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest.Decisions) != 6 {
+		t.Errorf("got %d decisions after the head moved, want 6", len(latest.Decisions))
+	}
+	for _, r := range chain.ranges {
+		if r[0] <= 200-validationReorgDepth {
+			t.Errorf("fetched blocks %v again, though they were cached", r)
+		}
+	}
+
+	// A log that doesn't fit the ABI fails the query rather than vanish
+	broken := validationResponseLog(t, client, 295, 6000, bob, 5, "code")
+	broken.Topics = broken.Topics[:3]
+	chain.logs = append(chain.logs, broken)
+	if _, err := client.GetValidationHistory(ctx, big.NewInt(7), nil, "", 10, 0); err == nil {
+		t.Error("a malformed log was skipped silently")
+	}
+}
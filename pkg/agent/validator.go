@@ -0,0 +1,509 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationRegistry ABI (event only)
+const validationEventABI = `[{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"validatorAddress","type":"address"},{"indexed":true,"internalType":"uint256","name":"agentId","type":"uint256"},{"indexed":false,"internalType":"string","name":"requestURI","type":"string"},{"indexed":true,"internalType":"bytes32","name":"requestHash","type":"bytes32"}],"name":"ValidationRequest","type":"event"}]`
+
+// ValidationRequestedEvent is a ValidationRegistry request for a validator
+// to judge an agent's work, described by the document at RequestURI whose
+// keccak256 is RequestHash.
+type ValidationRequestedEvent struct {
+	Validator   common.Address
+	AgentID     *big.Int
+	RequestURI  string
+	RequestHash [32]byte
+	Block       uint64
+}
+
+// ValidationRequestedHandler processes a ValidationRequest event, failing
+// like a TaskCreatedHandler.
+type ValidationRequestedHandler func(event ValidationRequestedEvent) error
+
+// Validator defaults.
+const (
+	DefaultValidationMaxSize  = 1 << 20
+	DefaultValidationTimeout  = 2 * time.Minute
+	DefaultValidationDeadline = 24 * time.Hour
+)
+
+// Validation statuses. A pending validation is answered, or given up on, the
+// next time its request is delivered; the others are final.
+const (
+	ValidationPending   = "pending"
+	ValidationSubmitted = "submitted"
+	ValidationSkipped   = "skipped"
+	ValidationFailed    = "failed"
+	ValidationExpired   = "expired"
+)
+
+// ValidationRecord is a validation request addressed to this node and what
+// became of it.
+type ValidationRecord struct {
+	RequestHash string `json:"requestHash"`
+	AgentID     string `json:"agentId"`
+	RequestURI  string `json:"requestUri"`
+	Tag         string `json:"tag,omitempty"`
+	Status      string `json:"status"`
+	Response    uint8  `json:"response"` // 0 to 100, once submitted
+	Reason      string `json:"reason,omitempty"`
+	Block       uint64 `json:"block"`
+	Deadline    int64  `json:"deadline"` // unix ms; the request expires after it
+	CreatedAt   int64  `json:"createdAt"`
+	UpdatedAt   int64  `json:"updatedAt"`
+}
+
+// ValidationRequest is the work a ValidationHandler judges: the request
+// document, its tag, and the agent that did the work.
+type ValidationRequest struct {
+	RequestHash common.Hash
+	AgentID     *big.Int
+	RequestURI  string
+	Tag         string
+	Data        []byte // the request document, hashing to RequestHash
+}
+
+// ValidationResult is a handler's verdict. Response runs from 0 (failed) to
+// 100 (passed); ResponseURI and ResponseHash optionally point at evidence.
+type ValidationResult struct {
+	Response     uint8
+	ResponseURI  string
+	ResponseHash common.Hash
+}
+
+// ValidationHandler judges a validation request. ctx ends at the node's
+// validation timeout or the request's deadline, whichever is first.
+type ValidationHandler func(ctx context.Context, req ValidationRequest) (ValidationResult, error)
+
+var (
+	validationHandlersMu sync.RWMutex
+	validationHandlers   = map[string]ValidationHandler{}
+)
+
+// RegisterValidationHandler makes a handler available to validators under
+// name, like RegisterHandler does for capabilities. Registering a name twice
+// panics.
+func RegisterValidationHandler(name string, h ValidationHandler) {
+	validationHandlersMu.Lock()
+	defer validationHandlersMu.Unlock()
+	if _, dup := validationHandlers[name]; dup {
+		panic("agent: validation handler " + name + " registered twice")
+	}
+	validationHandlers[name] = h
+}
+
+// ValidationHandlerNames lists the registered validation handler names, sorted.
+func ValidationHandlerNames() []string {
+	validationHandlersMu.RLock()
+	defer validationHandlersMu.RUnlock()
+	names := make([]string, 0, len(validationHandlers))
+	for name := range validationHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupValidationHandler(name string) (ValidationHandler, bool) {
+	validationHandlersMu.RLock()
+	defer validationHandlersMu.RUnlock()
+	h, ok := validationHandlers[name]
+	return h, ok
+}
+
+func init() {
+	// schema passes a document whose "output" satisfies its "schema", written
+	// in the subset of JSON Schema capability manifests use
+	RegisterValidationHandler("schema", func(ctx context.Context, req ValidationRequest) (ValidationResult, error) {
+		var doc struct {
+			Schema json.RawMessage `json:"schema"`
+			Output interface{}     `json:"output"`
+		}
+		if err := json.Unmarshal(req.Data, &doc); err != nil || len(doc.Schema) == 0 {
+			return ValidationResult{}, fmt.Errorf("request has no schema")
+		}
+		// JSON is YAML, which is what the schema compiler reads
+		var node yaml.Node
+		if err := yaml.Unmarshal(doc.Schema, &node); err != nil || len(node.Content) == 0 {
+			return ValidationResult{}, fmt.Errorf("request has an unreadable schema")
+		}
+		schema, err := compileSchema(node.Content[0])
+		if err != nil {
+			return ValidationResult{}, fmt.Errorf("request schema: %w", err)
+		}
+		if schema.validate(doc.Output, "output") != nil {
+			return ValidationResult{Response: 0}, nil
+		}
+		return ValidationResult{Response: 100}, nil
+	})
+}
+
+// ParseValidationTopics parses tag=handler pairs, naming the validation tags
+// a node judges and the registered handler that judges each.
+func ParseValidationTopics(pairs []string) (map[string]string, error) {
+	topics := map[string]string{}
+	for _, pair := range pairs {
+		tag, handler, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || tag == "" || handler == "" {
+			return nil, fmt.Errorf("%q is not tag=handler", pair)
+		}
+		if _, ok := lookupValidationHandler(handler); !ok {
+			return nil, fmt.Errorf("unknown validation handler %q (have %s)", handler, strings.Join(ValidationHandlerNames(), ", "))
+		}
+		topics[tag] = handler
+	}
+	return topics, nil
+}
+
+// errTooLarge is returned by a fetch whose document is over the size limit.
+var errTooLarge = errors.New("request document is too large")
+
+// Validator earns by validating other agents' work: it answers the
+// ValidationRegistry requests addressed to its wallet whose tag it has a
+// handler for, submitting each handler's verdict on-chain. Feed it events
+// with WithValidationRequests.
+type Validator struct {
+	MaxDataSize int64         // largest request document fetched; bigger ones are skipped
+	Timeout     time.Duration // how long a handler may run
+	Deadline    time.Duration // how long after it is first seen a request may be answered
+	Content     ContentStore  // fetches ipfs:// documents; nil means a local IPFSContentStore
+
+	client   *ERC8004Client
+	wallet   *Wallet
+	store    MetadataStore
+	topics   map[string]string // tag -> handler name
+	onRecord func(ValidationRecord)
+	now      func() time.Time
+}
+
+// NewValidator creates a validator answering from wallet through client, for
+// the tags in topics (see ParseValidationTopics).
+func NewValidator(client *ERC8004Client, wallet *Wallet, store MetadataStore, topics map[string]string) (*Validator, error) {
+	if client == nil || wallet == nil {
+		return nil, fmt.Errorf("a validator needs a chain client and a wallet")
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("a validator needs at least one tag to judge")
+	}
+	for tag, name := range topics {
+		if _, ok := lookupValidationHandler(name); !ok {
+			return nil, fmt.Errorf("tag %s: unknown validation handler %q", tag, name)
+		}
+	}
+	return &Validator{
+		MaxDataSize: DefaultValidationMaxSize,
+		Timeout:     DefaultValidationTimeout,
+		Deadline:    DefaultValidationDeadline,
+		client:      client,
+		wallet:      wallet,
+		store:       store,
+		topics:      topics,
+		now:         time.Now,
+	}, nil
+}
+
+// OnRecord registers a callback invoked whenever a validation's status
+// changes.
+func (v *Validator) OnRecord(cb func(ValidationRecord)) {
+	v.onRecord = cb
+}
+
+// OnRequest handles a ValidationRequest event. It is a
+// ValidationRequestedHandler: requests for other validators are ignored, and
+// it fails, to be delivered again, when the document couldn't be fetched or
+// the response couldn't be sent.
+func (v *Validator) OnRequest(e ValidationRequestedEvent) error {
+	if e.Validator != v.wallet.Address {
+		return nil
+	}
+	hash := common.Hash(e.RequestHash)
+	r, err := v.store.GetValidation(hash.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to load validation %s: %w", hash.Hex(), err)
+	}
+	if r != nil && r.Status != ValidationPending {
+		return nil
+	}
+	now := v.now()
+	if r == nil {
+		r = &ValidationRecord{
+			RequestHash: hash.Hex(),
+			AgentID:     e.AgentID.String(),
+			RequestURI:  e.RequestURI,
+			Status:      ValidationPending,
+			Block:       e.Block,
+			Deadline:    now.Add(v.Deadline).UnixMilli(),
+			CreatedAt:   now.UnixMilli(),
+		}
+		if err := v.save(r); err != nil {
+			return err
+		}
+	}
+	deadline := time.UnixMilli(r.Deadline)
+	if !now.Before(deadline) {
+		return v.finish(r, ValidationExpired, "deadline passed before the request was answered")
+	}
+	if v.requesterBlocked(e.AgentID) {
+		return v.finish(r, ValidationSkipped, "requester is blocked")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline.Sub(now))
+	defer cancel()
+	data, err := v.fetch(ctx, e.RequestURI)
+	if errors.Is(err, errTooLarge) {
+		return v.finish(r, ValidationSkipped, fmt.Sprintf("request document is over %d bytes", v.MaxDataSize))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", e.RequestURI, err)
+	}
+	if crypto.Keccak256Hash(data) != hash {
+		return v.finish(r, ValidationSkipped, "request document does not match its hash")
+	}
+	var doc struct {
+		Tag string `json:"tag"`
+	}
+	json.Unmarshal(data, &doc)
+	r.Tag = doc.Tag
+	name, ok := v.topics[doc.Tag]
+	if !ok {
+		return v.finish(r, ValidationSkipped, fmt.Sprintf("no handler for tag %q", doc.Tag))
+	}
+	handler, _ := lookupValidationHandler(name)
+
+	hctx, hcancel := context.WithTimeout(ctx, v.Timeout)
+	defer hcancel()
+	result, err := v.judge(hctx, handler, ValidationRequest{RequestHash: hash, AgentID: e.AgentID, RequestURI: e.RequestURI, Tag: doc.Tag, Data: data})
+	if err != nil {
+		if hctx.Err() != nil {
+			return v.finish(r, ValidationFailed, fmt.Sprintf("%s timed out", name))
+		}
+		return v.finish(r, ValidationFailed, fmt.Sprintf("%s: %v", name, err))
+	}
+	if result.Response > 100 {
+		return v.finish(r, ValidationFailed, fmt.Sprintf("%s answered %d, over 100", name, result.Response))
+	}
+
+	if err := v.client.SubmitValidationResponse(v.wallet, hash, result.Response, result.ResponseURI, result.ResponseHash, doc.Tag); err != nil {
+		return fmt.Errorf("failed to answer validation %s: %w", hash.Hex(), err)
+	}
+	r.Response = result.Response
+	return v.finish(r, ValidationSubmitted, "")
+}
+
+// judge runs a handler, turning a panic into an error and returning once ctx
+// ends even if the handler ignores it.
+func (v *Validator) judge(ctx context.Context, h ValidationHandler, req ValidationRequest) (ValidationResult, error) {
+	type answer struct {
+		result ValidationResult
+		err    error
+	}
+	done := make(chan answer, 1)
+	go func() {
+		var a answer
+		a.err = callSafely(func() (err error) {
+			a.result, err = h(ctx, req)
+			return err
+		})
+		done <- a
+	}()
+	select {
+	case a := <-done:
+		return a.result, a.err
+	case <-ctx.Done():
+		return ValidationResult{}, ctx.Err()
+	}
+}
+
+// fetch reads a request document over HTTP(S) or IPFS, failing with
+// errTooLarge past MaxDataSize.
+func (v *Validator) fetch(ctx context.Context, uri string) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	switch u.Scheme {
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", uri, res.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(res.Body, v.MaxDataSize+1)); err != nil {
+			return nil, err
+		}
+	case "ipfs":
+		content := v.Content
+		if content == nil {
+			content = IPFSContentStore{}
+		}
+		if data, err = content.Get(ctx, uri); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported request URI %s", uri)
+	}
+	if int64(len(data)) > v.MaxDataSize {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
+
+// requesterBlocked reports whether the operator blocked a peer of the agent
+// asking for validation, by its peerId or wallet.
+func (v *Validator) requesterBlocked(agentId *big.Int) bool {
+	entries, err := v.store.ListAddresses()
+	if err != nil {
+		return false
+	}
+	wallets := map[string]bool{}
+	for _, e := range entries {
+		if e.AgentID != agentId.String() {
+			continue
+		}
+		if e.PeerID != "" && v.store.IsPeerBlocked(e.PeerID) {
+			return true
+		}
+		wallets[strings.ToLower(e.Wallet)] = true
+	}
+	if len(wallets) == 0 {
+		return false
+	}
+	peers, _ := v.store.ListPeers()
+	for _, p := range peers {
+		if p.Blocked && wallets[strings.ToLower(p.EthAddress)] {
+			return true
+		}
+	}
+	return false
+}
+
+// finish settles a validation, or records a failure to, and reports it.
+func (v *Validator) finish(r *ValidationRecord, status, reason string) error {
+	r.Status, r.Reason = status, reason
+	if err := v.save(r); err != nil {
+		return err
+	}
+	if reason != "" {
+		fmt.Printf("[Validator] %s: %s (%s)\n", r.RequestHash, status, reason)
+	} else {
+		fmt.Printf("[Validator] %s: %s, response %d\n", r.RequestHash, status, r.Response)
+	}
+	return nil
+}
+
+func (v *Validator) save(r *ValidationRecord) error {
+	r.UpdatedAt = v.now().UnixMilli()
+	if err := v.store.SaveValidation(*r); err != nil {
+		return fmt.Errorf("failed to record validation %s: %w", r.RequestHash, err)
+	}
+	if v.onRecord != nil {
+		v.onRecord(*r)
+	}
+	return nil
+}
+
+// List returns the validations this node was asked for, newest first.
+func (v *Validator) List() ([]ValidationRecord, error) {
+	return v.store.ListValidations()
+}
+
+// decodeValidationRequest decodes a ValidationRequest log.
+func decodeValidationRequest(parsed abi.ABI, vLog types.Log) (ValidationRequestedEvent, error) {
+	// Fields named as unpackLog expects them
+	var raw struct {
+		ValidatorAddress common.Address
+		AgentId          *big.Int
+		RequestURI       string
+		RequestHash      [32]byte
+	}
+	if err := unpackLog(parsed, "ValidationRequest", &raw, vLog); err != nil {
+		return ValidationRequestedEvent{}, err
+	}
+	return ValidationRequestedEvent{
+		Validator:   raw.ValidatorAddress,
+		AgentID:     raw.AgentId,
+		RequestURI:  raw.RequestURI,
+		RequestHash: raw.RequestHash,
+		Block:       vLog.BlockNumber,
+	}, nil
+}
+
+func (s *sqlStore) SaveValidation(r ValidationRecord) error {
+	_, err := s.exec(`
+		INSERT INTO validations (request_hash, agent_id, request_uri, tag, status, response, reason, block, deadline, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(request_hash) DO UPDATE SET tag = excluded.tag, status = excluded.status, response = excluded.response,
+			reason = excluded.reason, updated_at = excluded.updated_at`,
+		r.RequestHash, r.AgentID, r.RequestURI, r.Tag, r.Status, int(r.Response), r.Reason, int64(r.Block), r.Deadline, r.CreatedAt, r.UpdatedAt)
+	return err
+}
+
+const validationColumns = "request_hash, agent_id, request_uri, tag, status, response, reason, block, deadline, created_at, updated_at"
+
+func scanValidation(row interface{ Scan(...interface{}) error }) (ValidationRecord, error) {
+	var r ValidationRecord
+	var response int
+	var block int64
+	err := row.Scan(&r.RequestHash, &r.AgentID, &r.RequestURI, &r.Tag, &r.Status, &response, &r.Reason, &block, &r.Deadline, &r.CreatedAt, &r.UpdatedAt)
+	r.Response, r.Block = uint8(response), uint64(block)
+	return r, err
+}
+
+// GetValidation returns the validation of a request, or nil if there is none.
+func (s *sqlStore) GetValidation(requestHash string) (*ValidationRecord, error) {
+	r, err := scanValidation(s.queryRow("SELECT "+validationColumns+" FROM validations WHERE request_hash = ?", requestHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListValidations returns every validation, newest first.
+func (s *sqlStore) ListValidations() ([]ValidationRecord, error) {
+	rows, err := s.query("SELECT " + validationColumns + " FROM validations ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ValidationRecord
+	for rows.Next() {
+		r, err := scanValidation(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
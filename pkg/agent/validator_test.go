@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const validationRegistryHex = "0x00000000000000000000000000000000000000a1"
+
+func init() {
+	// test.stall never answers, for handler timeouts
+	RegisterValidationHandler("test.stall", func(ctx context.Context, req ValidationRequest) (ValidationResult, error) {
+		<-ctx.Done()
+		return ValidationResult{}, ctx.Err()
+	})
+}
+
+// minedBackend mines every transaction it is sent, successfully.
+type minedBackend struct {
+	*ethclient.Client
+	mu   sync.Mutex
+	sent []*types.Transaction
+}
+
+func (b *minedBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = append(b.sent, tx)
+	return nil
+}
+
+func (b *minedBackend) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	return &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: hash, BlockNumber: big.NewInt(1)}, nil
+}
+
+func (b *minedBackend) transactions() []*types.Transaction {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*types.Transaction(nil), b.sent...)
+}
+
+// validationChain serves a ValidationRegistry whose logs the test sets, and
+// the request documents they point at over HTTP.
+type validationChain struct {
+	t       *testing.T
+	rpcURL  string
+	docsURL string
+	client  *ERC8004Client
+	backend *minedBackend
+	event   abi.Event
+
+	mu   sync.Mutex
+	head uint64
+	logs []types.Log
+	docs map[string][]byte
+}
+
+func newValidationChain(t *testing.T) *validationChain {
+	t.Helper()
+	parsed, _ := abi.JSON(strings.NewReader(validationEventABI))
+	c := &validationChain{t: t, head: 10, docs: map[string][]byte{}, event: parsed.Events["ValidationRequest"]}
+	c.rpcURL = newFakeRPC(t, c.handle)
+	docs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		doc, ok := c.docs[r.URL.Path]
+		c.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(doc)
+	}))
+	t.Cleanup(docs.Close)
+	c.docsURL = docs.URL
+
+	c.client = NewERC8004Client(c.rpcURL, zeroAddressHex, zeroAddressHex, validationRegistryHex)
+	if c.client == nil {
+		t.Fatal("client not created")
+	}
+	t.Cleanup(c.client.Close)
+	eth, err := ethclient.Dial(c.rpcURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(eth.Close)
+	c.backend = &minedBackend{Client: eth}
+	c.client.SetTxBackend(c.backend)
+	return c
+}
+
+func (c *validationChain) handle(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch method {
+	case "eth_getBlockByNumber":
+		return &types.Header{Number: new(big.Int).SetUint64(c.head), Difficulty: big.NewInt(0), BaseFee: big.NewInt(1e9)}, nil
+	case "eth_getLogs":
+		return c.logs, nil
+	case "eth_call":
+		return "0x", nil
+	case "eth_estimateGas":
+		return hexutil.Uint64(50000), nil
+	case "eth_maxPriorityFeePerGas":
+		return "0x3b9aca00", nil
+	case "eth_chainId":
+		return hexutil.Uint64(84532), nil
+	case "eth_getTransactionCount":
+		return hexutil.Uint64(0), nil
+	}
+	return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+}
+
+// request publishes doc and returns the event of a request for validator to
+// judge it, as the next block's log.
+func (c *validationChain) request(validator common.Address, agentId int64, doc []byte) ValidationRequestedEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := "/" + crypto.Keccak256Hash(doc).Hex()
+	c.docs[path] = doc
+	e := ValidationRequestedEvent{
+		Validator:   validator,
+		AgentID:     big.NewInt(agentId),
+		RequestURI:  c.docsURL + path,
+		RequestHash: crypto.Keccak256Hash(doc),
+		Block:       c.head + 1,
+	}
+	data, err := c.event.Inputs.NonIndexed().Pack(e.RequestURI)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.head++
+	c.logs = append(c.logs, types.Log{
+		Address:     common.HexToAddress(validationRegistryHex),
+		Topics:      []common.Hash{c.event.ID, common.BytesToHash(validator.Bytes()), common.BigToHash(e.AgentID), e.RequestHash},
+		Data:        data,
+		BlockNumber: e.Block,
+		TxHash:      common.Hash{byte(len(c.logs) + 1)},
+	})
+	return e
+}
+
+// responses decodes the validationResponse calls sent to the registry.
+func (c *validationChain) responses() []map[string]interface{} {
+	method := c.client.validationABI.Methods["validationResponse"]
+	var out []map[string]interface{}
+	for _, tx := range c.backend.transactions() {
+		if *tx.To() != common.HexToAddress(validationRegistryHex) || !strings.HasPrefix(string(tx.Data()), string(method.ID)) {
+			c.t.Fatalf("sent %x to %s, want validationResponse to the registry", tx.Data(), tx.To())
+		}
+		args := map[string]interface{}{}
+		if err := method.Inputs.UnpackIntoMap(args, tx.Data()[4:]); err != nil {
+			c.t.Fatal(err)
+		}
+		out = append(out, args)
+	}
+	return out
+}
+
+func newTestValidator(t *testing.T, chain *validationChain, topics map[string]string) (*Validator, MetadataStore) {
+	t.Helper()
+	store := newTestStore(t)
+	v, err := NewValidator(chain.client, newTestWallet(t), store, topics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, store
+}
+
+func TestValidatorAnswersRequestsOnChain(t *testing.T) {
+	chain := newValidationChain(t)
+	v, store := newTestValidator(t, chain, map[string]string{"format": "schema"})
+	w, err := NewEventWatcherWithHandlers(chain.rpcURL, []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil,
+		WithValidationRequests(validationRegistryHex, v.OnRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := []byte(`{"tag":"format","schema":{"type":"object","required":["title"]},"output":{"title":"Q3 report"}}`)
+	mine := chain.request(v.wallet.Address, 7, doc)
+	chain.request(common.HexToAddress("0x0b"), 8, []byte(`{"tag":"format"}`)) // someone else's
+	w.pollLogs(context.Background())
+
+	responses := chain.responses()
+	if len(responses) != 1 {
+		t.Fatalf("sent %d responses, want 1", len(responses))
+	}
+	got := responses[0]
+	if got["requestHash"] != mine.RequestHash || got["response"] != uint8(100) || got["tag"] != "format" {
+		t.Errorf("response = %v, want 100 for %x under format", got, mine.RequestHash)
+	}
+	r, err := store.GetValidation(common.Hash(mine.RequestHash).Hex())
+	if err != nil || r == nil {
+		t.Fatalf("GetValidation = %v, %v", r, err)
+	}
+	if r.Status != ValidationSubmitted || r.Response != 100 || r.AgentID != "7" || r.Tag != "format" {
+		t.Errorf("record = %+v", r)
+	}
+	if all, _ := store.ListValidations(); len(all) != 1 {
+		t.Errorf("recorded %d validations, want only the one addressed to us", len(all))
+	}
+
+	// Delivered again, a settled request isn't answered twice
+	if err := v.OnRequest(mine); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(chain.backend.transactions()); n != 1 {
+		t.Errorf("%d responses after redelivery, want 1", n)
+	}
+}
+
+func TestValidatorHandlerTimeoutSubmitsNothing(t *testing.T) {
+	chain := newValidationChain(t)
+	v, store := newTestValidator(t, chain, map[string]string{"slow": "test.stall"})
+	v.Timeout = 50 * time.Millisecond
+
+	e := chain.request(v.wallet.Address, 7, []byte(`{"tag":"slow"}`))
+	if err := v.OnRequest(e); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(chain.backend.transactions()); n != 0 {
+		t.Errorf("%d responses sent for a timed-out handler", n)
+	}
+	r, _ := store.GetValidation(common.Hash(e.RequestHash).Hex())
+	if r == nil || r.Status != ValidationFailed || !strings.Contains(r.Reason, "timed out") {
+		t.Errorf("record = %+v, want failed with a timeout", r)
+	}
+}
+
+func TestValidatorSkipsRequests(t *testing.T) {
+	chain := newValidationChain(t)
+	v, store := newTestValidator(t, chain, map[string]string{"format": "schema"})
+	v.MaxDataSize = 256
+	now := time.UnixMilli(1700000000000)
+	v.now = func() time.Time { return now }
+
+	// Agent 9's peer is blocked
+	store.SaveAddress(AddressBookEntry{Wallet: "0x09", AgentID: "9", PeerID: "12D3KooWblocked"})
+	store.SetPeerBlocked("12D3KooWblocked", true)
+
+	valid := `{"tag":"format","schema":{"type":"string"},"output":"ok"}`
+	tampered := chain.request(v.wallet.Address, 7, []byte(valid))
+	chain.mu.Lock()
+	chain.docs["/"+common.Hash(tampered.RequestHash).Hex()] = []byte(`{"tag":"format","schema":{"type":"string"},"output":"no"}`)
+	chain.mu.Unlock()
+	late := chain.request(v.wallet.Address, 7, []byte(valid+" "))
+
+	cases := []struct {
+		name   string
+		event  ValidationRequestedEvent
+		status string
+		reason string
+	}{
+		{"too large", chain.request(v.wallet.Address, 7, []byte(`{"tag":"format","output":"`+strings.Repeat("x", 300)+`"}`)), ValidationSkipped, "over 256 bytes"},
+		{"blocked", chain.request(v.wallet.Address, 9, []byte(valid+"\n")), ValidationSkipped, "blocked"},
+		{"unknown tag", chain.request(v.wallet.Address, 7, []byte(`{"tag":"style"}`)), ValidationSkipped, `no handler for tag "style"`},
+		{"tampered", tampered, ValidationSkipped, "does not match"},
+	}
+	for _, c := range cases {
+		if err := v.OnRequest(c.event); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		r, _ := store.GetValidation(common.Hash(c.event.RequestHash).Hex())
+		if r == nil || r.Status != c.status || !strings.Contains(r.Reason, c.reason) {
+			t.Errorf("%s: record = %+v, want %s with %q", c.name, r, c.status, c.reason)
+		}
+	}
+
+	// A request left pending past its deadline expires rather than being answered
+	store.SaveValidation(ValidationRecord{RequestHash: common.Hash(late.RequestHash).Hex(), AgentID: "7", RequestURI: late.RequestURI,
+		Status: ValidationPending, Deadline: now.Add(-time.Minute).UnixMilli()})
+	if err := v.OnRequest(late); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := store.GetValidation(common.Hash(late.RequestHash).Hex()); r == nil || r.Status != ValidationExpired {
+		t.Errorf("overdue record = %+v, want expired", r)
+	}
+
+	if n := len(chain.backend.transactions()); n != 0 {
+		t.Errorf("%d responses sent for skipped requests", n)
+	}
+}
@@ -0,0 +1,370 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+)
+
+// Message types of the commitment exchange. A task sent with Commit set is
+// answered first with a commitment, whose payload is the keccak256 hash of
+// the response message about to follow; the sender acknowledges it by
+// echoing the hash in a commit_ack before the response is sent.
+const (
+	MessageCommitment = "commitment"
+	MessageCommitAck  = "commit_ack"
+)
+
+// Outcomes of a result verification.
+const (
+	VerificationApproved   = "approved"   // the result checked out and was paid for
+	VerificationDisputed   = "disputed"   // the result failed and its payment was disputed
+	VerificationUnverified = "unverified" // the verifier couldn't run; nothing was settled
+)
+
+// ErrCommitmentMismatch is returned when a delivered result doesn't hash to
+// the commitment the worker sent for it.
+var ErrCommitmentMismatch = errors.New("result doesn't match its commitment")
+
+// ErrResultRejected is returned by DelegateVerified for a result that failed
+// verification and was disputed.
+var ErrResultRejected = errors.New("result rejected")
+
+// verifierOutputLimit caps the verifier output kept on a task record.
+const verifierOutputLimit = 16 << 10
+
+// VerifierReport is what a VerifierFunc found.
+type VerifierReport struct {
+	Passed bool   `json:"passed"`
+	Output string `json:"output,omitempty"` // what the verifier printed or answered, for the task record
+
+	Reexecution *Reexecution `json:"reexecution,omitempty"` // from ReexecutionVerifier
+}
+
+// VerifierFunc checks the result of a delegated task, given the payload it
+// was sent. It returns an error only when it couldn't check; a result it
+// rejects is a report that didn't pass.
+type VerifierFunc func(ctx context.Context, payload, result interface{}) (VerifierReport, error)
+
+// ResultVerification records how a delegated result was checked before it
+// was paid for. It is kept on the task record.
+type ResultVerification struct {
+	Worker     string          `json:"worker"`               // peer ID
+	Commitment string          `json:"commitment"`           // hash the worker committed to
+	ResultHash string          `json:"resultHash,omitempty"` // hash of the result delivered
+	Verifier   *VerifierReport `json:"verifier,omitempty"`
+	Outcome    string          `json:"outcome"`
+	Reason     string          `json:"reason,omitempty"` // why it was disputed or left unverified
+	VerifiedAt int64           `json:"verifiedAt"`       // unix ms
+}
+
+// SchemaVerifier passes results that satisfy schema, written in YAML or JSON
+// with the keywords capability manifests accept.
+func SchemaVerifier(schema []byte) (VerifierFunc, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(schema, &doc); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("empty schema")
+	}
+	compiled, err := compileSchema(doc.Content[0])
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, payload, result interface{}) (VerifierReport, error) {
+		// Validate the result as it arrived over JSON
+		raw, err := json.Marshal(result)
+		if err != nil {
+			return VerifierReport{}, err
+		}
+		var v interface{}
+		json.Unmarshal(raw, &v)
+		if err := compiled.validate(v, "result"); err != nil {
+			return VerifierReport{Output: err.Error()}, nil
+		}
+		return VerifierReport{Passed: true}, nil
+	}, nil
+}
+
+// CommandVerifier runs name with args in dir, such as a test suite in the
+// workspace, with the result as JSON on stdin. The result passes when the
+// command exits 0.
+func CommandVerifier(dir, name string, args ...string) VerifierFunc {
+	return func(ctx context.Context, payload, result interface{}) (VerifierReport, error) {
+		input, err := json.Marshal(result)
+		if err != nil {
+			return VerifierReport{}, err
+		}
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Dir, cmd.Stdin, cmd.Stdout, cmd.Stderr = dir, bytes.NewReader(input), &out, &out
+		err = cmd.Run()
+		var exit *exec.ExitError
+		if err != nil && !errors.As(err, &exit) {
+			return VerifierReport{}, fmt.Errorf("failed to run %s: %w", name, err)
+		}
+		return VerifierReport{Passed: err == nil, Output: truncate(out.String(), verifierOutputLimit)}, nil
+	}
+}
+
+const judgeSystemPrompt = `You check the result an autonomous agent delivered for a paid task before
+it is paid. You are given the task and the result. Answer with a single JSON
+object and nothing else:
+{"pass": true|false, "reason": "<one sentence>"}`
+
+// JudgeVerifier asks the model behind e whether a result does what its task
+// asked. Its calls count against e's hourly cap.
+func JudgeVerifier(e *LLMEvaluator) VerifierFunc {
+	return func(ctx context.Context, payload, result interface{}) (VerifierReport, error) {
+		if !e.reserve() {
+			return VerifierReport{}, ErrEvalBudget
+		}
+		prompt, _ := json.MarshalIndent(struct {
+			Task   interface{} `json:"task"`
+			Result interface{} `json:"result"`
+		}{payload, result}, "", "  ")
+		raw, err := e.complete(ctx, judgeSystemPrompt, string(prompt))
+		if err != nil {
+			return VerifierReport{}, err
+		}
+		start, end := strings.Index(raw, "{"), strings.LastIndex(raw, "}")
+		var out struct {
+			Pass *bool `json:"pass"`
+		}
+		if start < 0 || end < start || json.Unmarshal([]byte(raw[start:end+1]), &out) != nil || out.Pass == nil {
+			return VerifierReport{}, fmt.Errorf("model answered without a judgement: %q", raw)
+		}
+		return VerifierReport{Passed: *out.Pass, Output: truncate(raw, verifierOutputLimit)}, nil
+	}
+}
+
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit] + "\n[truncated]"
+}
+
+// DelegateVerified delegates the escrow task taskId, which the node created,
+// to the worker pid and pays for the result only once it checks out. The
+// worker commits to the hash of its result before delivering it; a result
+// that doesn't match the commitment, or that verify rejects, is disputed
+// through settle instead of paid. The verification is kept on the task's
+// record. A result that is disputed is returned with ErrResultRejected. With
+// a nil verify only the commitment is checked; with a nil settle nothing is
+// paid or disputed.
+func (n *AgentNode) DelegateVerified(ctx context.Context, pid peer.ID, taskId *big.Int, payload interface{}, verify VerifierFunc, settle Settlement) (interface{}, *ResultVerification, error) {
+	if err := n.permit(pid, PolicyActionDeliver); err != nil {
+		return nil, nil, err
+	}
+	started := time.Now()
+	msg := n.taskMessage(payload)
+	msg.Commit = true
+	resp, v, err := n.exchangeCommitted(ctx, pid, msg)
+	if err != nil && !errors.Is(err, ErrCommitmentMismatch) {
+		// Nothing was delivered, so there is nothing to settle
+		return nil, nil, err
+	}
+
+	var result interface{}
+	if err != nil {
+		v.Outcome, v.Reason = VerificationDisputed, err.Error()
+	} else {
+		result = resp.Payload
+		v.Outcome = VerificationApproved
+		if verify != nil {
+			report, err := verify(ctx, payload, result)
+			switch {
+			case err != nil:
+				v.Outcome, v.Reason = VerificationUnverified, err.Error()
+			case !report.Passed:
+				v.Verifier, v.Outcome, v.Reason = &report, VerificationDisputed, "verifier rejected the result"
+			default:
+				v.Verifier = &report
+			}
+		}
+	}
+
+	recordID := fmt.Sprintf("%s:%s", TaskKindEscrow, taskId)
+	var settleErr error
+	switch v.Outcome {
+	case VerificationApproved:
+		if settle != nil {
+			if settleErr = settle.ApprovePayment(taskId); settleErr == nil {
+				n.EmitLifecycle(LifecycleEvent{TaskID: recordID, Stage: StagePaid, Peer: pid.String()})
+			}
+		}
+	case VerificationDisputed:
+		fmt.Printf("[Escrow] Disputing task %s delegated to %s: %s\n", taskId, pid, v.Reason)
+		n.noteInteraction(pid.String(), InteractionDispute, 1)
+		if settle != nil {
+			settleErr = settle.Dispute(taskId)
+		}
+	}
+	v.VerifiedAt = time.Now().UnixMilli()
+	n.saveVerification(recordID, *v)
+	if v.Outcome == VerificationApproved && settleErr == nil {
+		n.recordTask(pid.String(), recordID, v.ResultHash, started)
+	}
+	n.Events.Add("result_verified", map[string]interface{}{"taskId": recordID, "verification": v})
+
+	switch {
+	case settleErr != nil:
+		return result, v, settleErr
+	case v.Outcome == VerificationUnverified:
+		return result, v, fmt.Errorf("could not verify the result of task %s: %s", taskId, v.Reason)
+	case v.Outcome == VerificationDisputed:
+		return result, v, fmt.Errorf("%w: %s", ErrResultRejected, v.Reason)
+	}
+	return result, v, nil
+}
+
+// saveVerification attaches v to the task record id, creating the record for
+// a task the node hasn't seen on-chain.
+func (n *AgentNode) saveVerification(id string, v ResultVerification) {
+	status := TaskStatusResolved
+	if v.Outcome == VerificationDisputed {
+		status = TaskStatusDisputed
+	}
+	record, err := n.Store.GetTask(id)
+	if err == nil && record == nil {
+		now := time.Now().Unix()
+		record = &TaskRecord{ID: id, Kind: TaskKindEscrow, Amount: "0", CreatedAt: now}
+		if n.Wallet != nil {
+			record.Client = n.Wallet.Address.Hex()
+		}
+	}
+	if err == nil && v.Outcome != VerificationUnverified {
+		record.Status, record.UpdatedAt = status, time.Now().Unix()
+		err = n.Store.SaveTask(*record)
+	} else if err == nil && record.Status == "" {
+		record.Status, record.UpdatedAt = TaskStatusReceived, time.Now().Unix()
+		err = n.Store.SaveTask(*record)
+	}
+	if err == nil {
+		err = n.Store.SetTaskVerification(id, v)
+	}
+	if err != nil {
+		fmt.Printf("[DB] Failed to record the verification of %s: %v\n", id, err)
+		n.Events.AddError("verification_record_failed", err, map[string]string{"taskId": id})
+	}
+}
+
+// exchangeCommitted sends msg on the task protocol like exchange, taking the
+// worker's commitment before its response. The returned verification holds
+// the commitment and the hash of what was delivered; when they differ the
+// error is ErrCommitmentMismatch.
+func (n *AgentNode) exchangeCommitted(ctx context.Context, pid peer.ID, msg AgentMessage) (resp *AgentMessage, v *ResultVerification, err error) {
+	ctx, span := n.tracer().Start(ctx, "p2p.task", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("agentmesh.peer", pid.String()), capabilityAttr(taskCapability(msg.Payload))))
+	defer func() { endSpan(span, err) }()
+	injectTrace(ctx, &msg)
+	n.compressFor(pid, &msg)
+
+	s, err := n.CurrentHost().NewStream(ctx, pid, protocol.ID(TaskProtocol))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	data, _ := json.Marshal(msg)
+	if err := writeLP(s, data); err != nil {
+		return nil, nil, err
+	}
+	first, err := readMessage(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first.Type {
+	case MessageError:
+		return nil, nil, peerError(pid.String(), *first)
+	case MessageCommitment:
+	default:
+		return nil, nil, fmt.Errorf("peer %s answered with %q instead of a commitment", pid, first.Type)
+	}
+	var commitment string
+	UnmarshalPayload(*first, &commitment)
+	if len(common.FromHex(commitment)) != common.HashLength {
+		return nil, nil, fmt.Errorf("peer %s sent an invalid commitment %q", pid, commitment)
+	}
+
+	ack, _ := json.Marshal(AgentMessage{ID: msg.ID, Type: MessageCommitAck, Payload: commitment, Sender: msg.Sender, Timestamp: time.Now().UnixMilli()})
+	if err := writeLP(s, ack); err != nil {
+		return nil, nil, err
+	}
+	raw, err := readLP(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	v = &ResultVerification{Worker: pid.String(), Commitment: commitment, ResultHash: ethcrypto.Keccak256Hash(raw).Hex()}
+	if !strings.EqualFold(v.ResultHash, commitment) {
+		return nil, v, fmt.Errorf("%w: delivered %s, committed to %s", ErrCommitmentMismatch, v.ResultHash, commitment)
+	}
+	resp = new(AgentMessage)
+	if err := json.Unmarshal(raw, resp); err != nil {
+		return nil, nil, err
+	}
+	n.noteEncodings(pid, resp)
+	if err := n.decodePayload(resp); err != nil {
+		return nil, nil, fmt.Errorf("peer %s: %w", pid, err)
+	}
+	if resp.Type == MessageError {
+		return nil, nil, peerError(pid.String(), *resp)
+	}
+	return resp, v, nil
+}
+
+func readMessage(s network.Stream) (*AgentMessage, error) {
+	data, err := readLP(s)
+	if err != nil {
+		return nil, err
+	}
+	m := new(AgentMessage)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if err := checkPayload(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// commitResult answers a task sent with Commit: the hash of response goes
+// first, and response itself only once the sender has acknowledged that
+// hash.
+func (n *AgentNode) commitResult(s network.Stream, id string, response []byte) {
+	hash := ethcrypto.Keccak256Hash(response).Hex()
+	commit, _ := json.Marshal(AgentMessage{ID: id, Type: MessageCommitment, Payload: hash, Sender: s.Conn().LocalPeer().String(), Timestamp: time.Now().UnixMilli()})
+	if err := writeLP(s, commit); err != nil {
+		return
+	}
+	s.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	ack, err := readMessage(s)
+	if err != nil || ack.Type != MessageCommitAck || ack.Payload != hash {
+		fmt.Printf("[P2P] %s didn't acknowledge the commitment to task %s; result withheld\n", s.Conn().RemotePeer(), id)
+		return
+	}
+	s.SetReadDeadline(time.Time{})
+	if writeLP(s, response) == nil {
+		n.commitments().add(hash, s.Conn().RemotePeer().String())
+	}
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// fakeSettlement records the tasks it was asked to pay for or dispute.
+type fakeSettlement struct {
+	approved, disputed []string
+}
+
+func (f *fakeSettlement) ApprovePayment(taskId *big.Int) error {
+	f.approved = append(f.approved, taskId.String())
+	return nil
+}
+
+func (f *fakeSettlement) Dispute(taskId *big.Int) error {
+	f.disputed = append(f.disputed, taskId.String())
+	return nil
+}
+
+// connectedPair starts a delegator and a worker connected to it.
+func connectedPair(t *testing.T) (delegator, worker *AgentNode) {
+	t.Helper()
+	delegator, worker = startTestNode(t), startTestNode(t)
+	info, err := peer.AddrInfoFromString(dialAddr(worker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delegator.CurrentHost().Connect(context.Background(), *info); err != nil {
+		t.Fatal(err)
+	}
+	return delegator, worker
+}
+
+func TestVerifiedResultFailingTheVerifierIsDisputed(t *testing.T) {
+	delegator, worker := connectedPair(t)
+	if err := worker.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	payload := map[string]interface{}{"capability": "summarize", "text": "a long document"}
+	pid := worker.CurrentHost().ID()
+
+	// echo hands back the payload, which has no summary
+	verify, err := SchemaVerifier([]byte("{type: object, required: [summary]}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settle := &fakeSettlement{}
+	_, v, err := delegator.DelegateVerified(ctx, pid, big.NewInt(7), payload, verify, settle)
+	if !errors.Is(err, ErrResultRejected) {
+		t.Fatalf("err = %v, want ErrResultRejected", err)
+	}
+	if len(settle.approved) != 0 || len(settle.disputed) != 1 || settle.disputed[0] != "7" {
+		t.Errorf("settlement = %+v, want task 7 disputed only", settle)
+	}
+	if v.Commitment == "" || v.ResultHash != v.Commitment || v.Verifier == nil || v.Verifier.Passed {
+		t.Errorf("verification = %+v, want a matching commitment and a failed verifier", v)
+	}
+	record, err := delegator.Store.GetTask("task:7")
+	if err != nil || record == nil {
+		t.Fatalf("task record = %v, %v", record, err)
+	}
+	if record.Status != TaskStatusDisputed || record.Verification == nil || record.Verification.Outcome != VerificationDisputed {
+		t.Errorf("record = %+v, want disputed with its verification", record)
+	}
+	if rv := record.Verification; rv != nil && (rv.Verifier == nil || rv.Verifier.Output == "") {
+		t.Errorf("record verification %+v lost the verifier output", rv)
+	}
+
+	// A result the verifier accepts is paid for
+	verify, _ = SchemaVerifier([]byte("{type: object, required: [text]}"))
+	result, v, err := delegator.DelegateVerified(ctx, pid, big.NewInt(8), payload, verify, settle)
+	if err != nil {
+		t.Fatalf("DelegateVerified: %v", err)
+	}
+	if got, _ := result.(map[string]interface{})["text"]; got != "a long document" || v.Outcome != VerificationApproved {
+		t.Errorf("result = %v, outcome %s", result, v.Outcome)
+	}
+	if len(settle.approved) != 1 || settle.approved[0] != "8" {
+		t.Errorf("approved = %v, want task 8", settle.approved)
+	}
+	if record, _ := delegator.Store.GetTask("task:8"); record == nil || record.Status != TaskStatusResolved {
+		t.Errorf("record = %+v, want resolved", record)
+	}
+}
+
+func TestResultNotMatchingItsCommitmentIsDisputed(t *testing.T) {
+	delegator, worker := connectedPair(t)
+
+	// The worker commits to one result and delivers another
+	committed, _ := json.Marshal(AgentMessage{Type: "response", Payload: "the real work"})
+	delivered, _ := json.Marshal(AgentMessage{Type: "response", Payload: "something cheaper"})
+	worker.CurrentHost().SetStreamHandler(protocol.ID(TaskProtocol), func(s network.Stream) {
+		defer s.Close()
+		if _, err := readLP(s); err != nil {
+			return
+		}
+		commit, _ := json.Marshal(AgentMessage{Type: MessageCommitment, Payload: ethcrypto.Keccak256Hash(committed).Hex()})
+		writeLP(s, commit)
+		if _, err := readLP(s); err != nil {
+			return
+		}
+		writeLP(s, delivered)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	verified := false
+	verify := func(context.Context, interface{}, interface{}) (VerifierReport, error) {
+		verified = true
+		return VerifierReport{Passed: true}, nil
+	}
+	settle := &fakeSettlement{}
+	_, v, err := delegator.DelegateVerified(ctx, worker.CurrentHost().ID(), big.NewInt(9), map[string]interface{}{"capability": "summarize"}, verify, settle)
+	if !errors.Is(err, ErrResultRejected) {
+		t.Fatalf("err = %v, want ErrResultRejected", err)
+	}
+	if verified {
+		t.Error("the verifier ran on a result that didn't match its commitment")
+	}
+	if len(settle.approved) != 0 || len(settle.disputed) != 1 {
+		t.Errorf("settlement = %+v, want one dispute", settle)
+	}
+	if v.Commitment != ethcrypto.Keccak256Hash(committed).Hex() || v.ResultHash != ethcrypto.Keccak256Hash(delivered).Hex() {
+		t.Errorf("verification = %+v, want both hashes recorded", v)
+	}
+	record, _ := delegator.Store.GetTask("task:9")
+	if record == nil || record.Status != TaskStatusDisputed || record.Verification == nil || record.Verification.ResultHash != v.ResultHash {
+		t.Errorf("record = %+v, want disputed with both hashes", record)
+	}
+}
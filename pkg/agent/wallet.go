@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// Wallet is the operator's Ethereum key used to sign on-chain transactions.
+type Wallet struct {
+	key     *ecdsa.PrivateKey
+	Address common.Address
+}
+
+// LoadWallet reads a hex-encoded secp256k1 private key from path.
+func LoadWallet(path string) (*Wallet, error) {
+	key, err := ethcrypto.LoadECDSA(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load wallet key %s: %w", path, err)
+	}
+	return &Wallet{key: key, Address: ethcrypto.PubkeyToAddress(key.PublicKey)}, nil
+}
+
+// LoadOrCreateWallet loads the wallet key at path, generating a fresh one if
+// the file does not exist. A generated wallet must be funded before it can send
+// transactions.
+func LoadOrCreateWallet(path string) (*Wallet, error) {
+	if _, err := os.Stat(path); err == nil {
+		return LoadWallet(path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate wallet key: %w", err)
+	}
+	if err := ethcrypto.SaveECDSA(path, key); err != nil {
+		return nil, fmt.Errorf("failed to write wallet key: %w", err)
+	}
+	return &Wallet{key: key, Address: ethcrypto.PubkeyToAddress(key.PublicKey)}, nil
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// EIP-1271 isValidSignature(bytes32,bytes), implemented by smart-contract
+// wallets such as Safe and ERC-4337 accounts.
+const eip1271ABI = `[{"inputs":[{"internalType":"bytes32","name":"hash","type":"bytes32"},{"internalType":"bytes","name":"signature","type":"bytes"}],"name":"isValidSignature","outputs":[{"internalType":"bytes4","name":"magicValue","type":"bytes4"}],"stateMutability":"view","type":"function"}]`
+
+// eip1271MagicValue is returned by isValidSignature for a valid signature.
+var eip1271MagicValue = []byte{0x16, 0x26, 0xba, 0x7e}
+
+var eip1271 = func() abi.ABI {
+	parsed, _ := abi.JSON(strings.NewReader(eip1271ABI))
+	return parsed
+}()
+
+// SignMessage signs msg with the wallet key as an EIP-191 personal message
+// and returns the 65-byte [R || S || V] signature with V in {27, 28}.
+func (w *Wallet) SignMessage(msg []byte) ([]byte, error) {
+	sig, err := ethcrypto.Sign(accounts.TextHash(msg), w.key)
+	if err != nil {
+		return nil, err
+	}
+	sig[ethcrypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
+
+// VerifyEOASignature checks an EIP-191 personal message signature by ECDSA
+// recovery. It cannot verify smart-contract wallets; use
+// ERC8004Client.VerifyWalletSignature for those.
+func VerifyEOASignature(wallet common.Address, msg, sig []byte) bool {
+	return recoversTo(wallet, common.BytesToHash(accounts.TextHash(msg)), sig)
+}
+
+// recoversTo reports whether sig is wallet's ECDSA signature of hash.
+func recoversTo(wallet common.Address, hash common.Hash, sig []byte) bool {
+	signer, err := recoverSigner(hash, sig)
+	return err == nil && signer == wallet
+}
+
+// recoverSigner returns the address whose key made sig over hash.
+func recoverSigner(hash common.Hash, sig []byte) (common.Address, error) {
+	if len(sig) != ethcrypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("signature is %d bytes, want %d", len(sig), ethcrypto.SignatureLength)
+	}
+	// Accept both the {27, 28} and {0, 1} recovery id conventions
+	normalized := make([]byte, len(sig))
+	copy(normalized, sig)
+	if v := normalized[ethcrypto.RecoveryIDOffset]; v >= 27 {
+		normalized[ethcrypto.RecoveryIDOffset] = v - 27
+	}
+	pub, err := ethcrypto.SigToPub(hash.Bytes(), normalized)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return ethcrypto.PubkeyToAddress(*pub), nil
+}
+
+// VerifyWalletSignature checks that wallet signed msg as an EIP-191 personal
+// message. Addresses with contract code are verified through EIP-1271
+// isValidSignature, so Safe and account-abstraction wallets work; plain
+// addresses fall back to ecrecover.
+func (c *ERC8004Client) VerifyWalletSignature(wallet common.Address, msg, sig []byte) (bool, error) {
+	return c.verifyWalletHash(wallet, common.BytesToHash(accounts.TextHash(msg)), sig)
+}
+
+// verifyWalletHash checks that wallet signed hash, through EIP-1271 if it is
+// a contract.
+func (c *ERC8004Client) verifyWalletHash(wallet common.Address, hash common.Hash, sig []byte) (bool, error) {
+	block := c.readBlock(nil)
+	var code []byte
+	err := c.read(context.Background(), func(_ *ethclient.Client, b TxBackend) (err error) {
+		code, err = b.CodeAt(context.Background(), wallet, block.number())
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch code for %s: %w", wallet.Hex(), err)
+	}
+	if len(code) == 0 {
+		return recoversTo(wallet, hash, sig), nil
+	}
+
+	data, err := eip1271.Pack("isValidSignature", hash, sig)
+	if err != nil {
+		return false, err
+	}
+	var res []byte
+	err = c.read(context.Background(), func(_ *ethclient.Client, b TxBackend) (err error) {
+		res, err = b.CallContract(context.Background(), ethereum.CallMsg{To: &wallet, Data: data}, block.number())
+		return err
+	})
+	if err != nil {
+		// Contracts signal an invalid signature by reverting as often as by
+		// returning a different value
+		var dataErr interface{ ErrorData() interface{} }
+		if errors.As(err, &dataErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("isValidSignature call on %s failed: %w", wallet.Hex(), err)
+	}
+	// bytes4 is returned left-aligned in a 32-byte word
+	return len(res) >= 4 && bytes.Equal(res[:4], eip1271MagicValue), nil
+}
+
+// verifyWalletSig checks the WalletSig of a discovery packet against the
+// ethAddress it advertises. Without a chain client only EOA signatures can be
+// checked; an RPC failure rejects the packet, since an unproven address must
+// not reach the reputation check.
+func (n *AgentNode) verifyWalletSig(ethAddress string, packet SignedPacket) bool {
+	if !common.IsHexAddress(ethAddress) {
+		return false
+	}
+	sig, err := hexutil.Decode(packet.WalletSig)
+	if err != nil {
+		return false
+	}
+	wallet := common.HexToAddress(ethAddress)
+	if n.ERCClient == nil {
+		return VerifyEOASignature(wallet, []byte(packet.Data), sig)
+	}
+	ok, err := n.ERCClient.VerifyWalletSignature(wallet, []byte(packet.Data), sig)
+	if err != nil {
+		fmt.Printf("[Security] Could not verify wallet signature for %s: %v\n", ethAddress, err)
+		return false
+	}
+	return ok
+}
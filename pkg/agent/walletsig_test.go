@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// rpcError is a JSON-RPC error returned by a fake RPC handler.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data,omitempty"`
+}
+
+// newFakeRPC serves JSON-RPC requests with handle, for pointing clients at a
+// scripted chain.
+func newFakeRPC(t *testing.T, handle func(method string, params []json.RawMessage) (interface{}, *rpcError)) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, rpcErr := handle(req.Method, req.Params)
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if rpcErr != nil {
+			resp["error"] = rpcErr
+		} else {
+			resp["result"] = result
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func newTestWallet(t *testing.T) *Wallet {
+	t.Helper()
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Wallet{key: key, Address: ethcrypto.PubkeyToAddress(key.PublicKey)}
+}
+
+func TestVerifyEOASignature(t *testing.T) {
+	w := newTestWallet(t)
+	msg := []byte(`{"capability":{"name":"summarize"}}`)
+	sig, err := w.SignMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !VerifyEOASignature(w.Address, msg, sig) {
+		t.Error("valid signature rejected")
+	}
+
+	// The {0, 1} recovery id convention is accepted too
+	legacy := append([]byte(nil), sig...)
+	legacy[ethcrypto.RecoveryIDOffset] -= 27
+	if !VerifyEOASignature(w.Address, msg, legacy) {
+		t.Error("signature with a {0, 1} recovery id rejected")
+	}
+
+	if VerifyEOASignature(w.Address, []byte("tampered"), sig) {
+		t.Error("signature accepted for a different message")
+	}
+	if VerifyEOASignature(newTestWallet(t).Address, msg, sig) {
+		t.Error("signature accepted for a different wallet")
+	}
+	if VerifyEOASignature(w.Address, msg, sig[:64]) {
+		t.Error("truncated signature accepted")
+	}
+}
+
+func TestVerifyWalletSignatureEIP1271(t *testing.T) {
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+	signer := newTestWallet(t)
+	msg := []byte("hello")
+	good, err := signer.SignMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		switch method {
+		case "eth_getCode":
+			return "0x6080", nil
+		case "eth_call":
+			calls++
+			var call struct {
+				To    common.Address `json:"to"`
+				Input hexutil.Bytes  `json:"input"`
+				Data  hexutil.Bytes  `json:"data"`
+			}
+			json.Unmarshal(params[0], &call)
+			input := call.Input
+			if len(input) == 0 {
+				input = call.Data
+			}
+			if call.To != contract {
+				t.Errorf("isValidSignature called on %s, want %s", call.To.Hex(), contract.Hex())
+			}
+			args, err := eip1271.Methods["isValidSignature"].Inputs.Unpack(input[4:])
+			if err != nil {
+				t.Fatalf("bad isValidSignature call: %v", err)
+			}
+			// The wallet accepts signatures by its owner key, as a Safe would
+			if sig := args[1].([]byte); !bytes.Equal(sig, good) {
+				return nil, &rpcError{Code: 3, Message: "execution reverted", Data: "0x"}
+			}
+			word := make([]byte, 32)
+			copy(word, eip1271MagicValue)
+			return hexutil.Encode(word), nil
+		}
+		return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+	})
+
+	c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	if c == nil {
+		t.Fatal("client not created")
+	}
+	defer c.Close()
+
+	ok, err := c.VerifyWalletSignature(contract, msg, good)
+	if err != nil || !ok {
+		t.Errorf("valid EIP-1271 signature: ok=%v err=%v", ok, err)
+	}
+
+	bad := append([]byte(nil), good...)
+	bad[0] ^= 0xff
+	ok, err = c.VerifyWalletSignature(contract, msg, bad)
+	if err != nil || ok {
+		t.Errorf("reverting isValidSignature: ok=%v err=%v, want false without error", ok, err)
+	}
+	if calls != 2 {
+		t.Errorf("isValidSignature called %d times, want 2", calls)
+	}
+}
+
+func TestVerifyWalletSignatureFallsBackToEOA(t *testing.T) {
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		if method == "eth_getCode" {
+			return "0x", nil
+		}
+		t.Errorf("unexpected %s for an EOA", method)
+		return nil, &rpcError{Code: -32601, Message: "unexpected"}
+	})
+	c := NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	defer c.Close()
+
+	w := newTestWallet(t)
+	sig, _ := w.SignMessage([]byte("hello"))
+	if ok, err := c.VerifyWalletSignature(w.Address, []byte("hello"), sig); err != nil || !ok {
+		t.Errorf("EOA signature: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestNodeVerifyWalletSig(t *testing.T) {
+	w := newTestWallet(t)
+	data := `{"capability":{"name":"summarize"},"ethAddress":"` + w.Address.Hex() + `"}`
+	sig, _ := w.SignMessage([]byte(data))
+	packet := SignedPacket{Data: data, WalletSig: hexutil.Encode(sig)}
+
+	// Without a chain client only EOA signatures are checked
+	n := &AgentNode{}
+	if !n.verifyWalletSig(w.Address.Hex(), packet) {
+		t.Error("valid wallet signature rejected")
+	}
+	if n.verifyWalletSig(newTestWallet(t).Address.Hex(), packet) {
+		t.Error("signature accepted for another address")
+	}
+	if n.verifyWalletSig("not-an-address", packet) {
+		t.Error("signature accepted for a malformed address")
+	}
+	packet.WalletSig = "zz"
+	if n.verifyWalletSig(w.Address.Hex(), packet) {
+		t.Error("undecodable signature accepted")
+	}
+
+	// An RPC failure rejects rather than trusting the address
+	url := newFakeRPC(t, func(method string, params []json.RawMessage) (interface{}, *rpcError) {
+		return nil, &rpcError{Code: -32000, Message: "unavailable"}
+	})
+	n.ERCClient = NewERC8004Client(url, zeroAddressHex, zeroAddressHex, zeroAddressHex)
+	defer n.ERCClient.Close()
+	packet.WalletSig = hexutil.Encode(sig)
+	if n.verifyWalletSig(w.Address.Hex(), packet) {
+		t.Error("signature accepted although the chain could not be queried")
+	}
+}
+
+const zeroAddressHex = "0x0000000000000000000000000000000000000000"
@@ -2,8 +2,13 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"strings"
@@ -11,42 +16,342 @@ import (
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// TaskEscrow ABI (event only)
-const taskEscrowEventABI = `[{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"taskId","type":"uint256"},{"indexed":true,"internalType":"address","name":"client","type":"address"},{"indexed":false,"internalType":"bytes32","name":"specHash","type":"bytes32"},{"indexed":false,"internalType":"uint256","name":"payment","type":"uint256"}],"name":"TaskCreated","type":"event"}]`
+// TaskEscrow ABI (events only). The watcher acts on TaskCreated; the others
+// are known so they aren't taken for ABI drift:
+// TaskCreated(uint256 indexed taskId, address indexed client, bytes32 specHash, uint256 payment)
+// TaskAccepted(uint256 indexed taskId, address indexed worker)
+// TaskSubmitted(uint256 indexed taskId, bytes32 resultHash)
+// TaskCompleted(uint256 indexed taskId, address indexed worker, uint256 payment)
+// TaskRefunded(uint256 indexed taskId, address indexed client, uint256 amount)
+// TaskDisputed(uint256 indexed taskId)
+const taskEscrowEventABI = `[{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"taskId","type":"uint256"},{"indexed":true,"internalType":"address","name":"client","type":"address"},{"indexed":false,"internalType":"bytes32","name":"specHash","type":"bytes32"},{"indexed":false,"internalType":"uint256","name":"payment","type":"uint256"}],"name":"TaskCreated","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"taskId","type":"uint256"},{"indexed":true,"internalType":"address","name":"worker","type":"address"}],"name":"TaskAccepted","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"taskId","type":"uint256"},{"indexed":false,"internalType":"bytes32","name":"resultHash","type":"bytes32"}],"name":"TaskSubmitted","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"taskId","type":"uint256"},{"indexed":true,"internalType":"address","name":"worker","type":"address"},{"indexed":false,"internalType":"uint256","name":"payment","type":"uint256"}],"name":"TaskCompleted","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"taskId","type":"uint256"},{"indexed":true,"internalType":"address","name":"client","type":"address"},{"indexed":false,"internalType":"uint256","name":"amount","type":"uint256"}],"name":"TaskRefunded","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"taskId","type":"uint256"}],"name":"TaskDisputed","type":"event"}]`
 
-// KnowledgeMarket ABI (event only)
-const knowledgeMarketEventABI = `[{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"requestId","type":"uint256"},{"indexed":true,"internalType":"address","name":"requester","type":"address"},{"indexed":false,"internalType":"string","name":"topic","type":"string"},{"indexed":true,"internalType":"bytes32","name":"topicHash","type":"bytes32"},{"indexed":false,"internalType":"uint256","name":"bounty","type":"uint256"}],"name":"KnowledgeRequested","type":"event"}]`
+// KnowledgeMarket ABI (events only), acted on for KnowledgeRequested:
+// KnowledgeRequested(uint256 indexed requestId, address indexed requester, string topic, bytes32 indexed topicHash, uint256 bounty)
+// KnowledgeProvided(uint256 indexed requestId, address indexed provider, string responsePath)
+const knowledgeMarketEventABI = `[{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"requestId","type":"uint256"},{"indexed":true,"internalType":"address","name":"requester","type":"address"},{"indexed":false,"internalType":"string","name":"topic","type":"string"},{"indexed":true,"internalType":"bytes32","name":"topicHash","type":"bytes32"},{"indexed":false,"internalType":"uint256","name":"bounty","type":"uint256"}],"name":"KnowledgeRequested","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"uint256","name":"requestId","type":"uint256"},{"indexed":true,"internalType":"address","name":"provider","type":"address"},{"indexed":false,"internalType":"string","name":"responsePath","type":"string"}],"name":"KnowledgeProvided","type":"event"}]`
 
 type TaskCreatedEvent struct {
 	TaskId   *big.Int
 	Client   common.Address
 	SpecHash [32]byte
 	Payment  *big.Int
+	Block    uint64
+	Contract common.Address // the escrow that emitted it
+	ChainID  uint64         // the chain it was emitted on; 0 if the watcher isn't bound to one
+	// qualified is set for events of an escrow other than the first watched,
+	// whose task IDs name the contract so they don't collide
+	qualified bool
+	// chainQualified is set for events of a chain other than the node's
+	// primary one, whose task IDs name the chain
+	chainQualified bool
+	raw            *types.Log // the log it was decoded from, for an EventArchive
 }
 
 type KnowledgeRequestedEvent struct {
-	RequestId *big.Int
-	Requester common.Address
-	Topic     string
-	TopicHash [32]byte
-	Bounty    *big.Int
+	RequestId      *big.Int
+	Requester      common.Address
+	Topic          string
+	TopicHash      [32]byte
+	Bounty         *big.Int
+	Block          uint64
+	Contract       common.Address // the market that emitted it
+	ChainID        uint64         // as for TaskCreatedEvent
+	qualified      bool           // as for TaskCreatedEvent
+	chainQualified bool           // as for TaskCreatedEvent
+	raw            *types.Log     // as for TaskCreatedEvent
 }
 
+// eventID is how records and dead letters key an event of kind with id:
+// "task:<id>", "task:<contract>:<id>" when qualified, and either with the
+// chain ID after the kind when chainQualified, e.g. "task:84532:7".
+func eventID(kind string, chainID uint64, chainQualified bool, contract common.Address, qualified bool, id *big.Int) string {
+	if chainQualified {
+		kind = fmt.Sprintf("%s:%d", kind, chainID)
+	}
+	if qualified {
+		return fmt.Sprintf("%s:%s:%s", kind, contract.Hex(), id)
+	}
+	return fmt.Sprintf("%s:%s", kind, id)
+}
+
+// TaskCreatedHandler processes a TaskCreated event. An error means the event
+// wasn't processed: it is kept as a dead letter and delivered again.
+type TaskCreatedHandler func(event TaskCreatedEvent) error
+
+// KnowledgeRequestedHandler processes a KnowledgeRequested event, failing
+// like a TaskCreatedHandler.
+type KnowledgeRequestedHandler func(event KnowledgeRequestedEvent) error
+
+// DefaultPollInterval matches the 2s block time of Base, the default chain,
+// so each poll usually sees one new block and the watcher stays well within
+// DefaultMaxBlockLag of the head.
+const DefaultPollInterval = 2 * time.Second
+
+// DefaultBlockTime is the block time of Base, the default chain, from which
+// the watcher works out which block the chain should be at by now.
+const DefaultBlockTime = 2 * time.Second
+
+// DefaultMaxHeadLag is how many blocks the RPC's head may trail the block
+// the chain should be at before the watcher warns and readiness fails: a
+// minute at DefaultBlockTime.
+const DefaultMaxHeadLag = 30
+
+// reorgWindow is how many of the blocks it processed last the watcher
+// remembers the hashes of, to find where a reorg forked from.
+const reorgWindow = 64
+
+// ReorgHandler is told that a reorg replaced the blocks after ancestor, the
+// newest block the watcher processed that is still on the chain. The
+// watcher delivers the events of the blocks after it again.
+type ReorgHandler func(ancestor uint64) error
+
+// blockRef is a block the watcher processed, by number and hash.
+type blockRef struct {
+	number uint64
+	hash   common.Hash
+}
+
+// DefaultLogRange is the most blocks queried by one eth_getLogs call. Public
+// RPC endpoints reject wider ranges, so catching up after downtime walks the
+// gap in chunks of this size.
+const DefaultLogRange = 2000
+
 type EventWatcher struct {
-	client     *ethclient.Client
-	escrowAddr common.Address
-	marketAddr common.Address
-	escrowABI  abi.ABI
-	marketABI  abi.ABI
-	lastBlock  uint64
-	onTask     func(event TaskCreatedEvent)
-	onQuery    func(event KnowledgeRequestedEvent)
+	client        *ethclient.Client
+	escrowAddrs   []common.Address
+	marketAddrs   []common.Address
+	validAddr     common.Address
+	escrowABI     abi.ABI
+	marketABI     abi.ABI
+	validABI      abi.ABI
+	lastBlock     uint64
+	anchored      atomic.Bool // lastBlock came from the head or a checkpoint
+	deferHead     bool
+	store         MetadataStore
+	checkpoint    string
+	pollInterval  time.Duration
+	jitter        float64
+	confirmations uint64
+	blockTime     time.Duration
+	maxHeadLag    uint64
+	headLag       atomic.Uint64 // blocks the RPC's head trailed the clock at the last look
+	headLagging   atomic.Bool   // whether headLag was over maxHeadLag, to warn once
+	logRange      uint64
+	scanner       *LogScanner
+	onTask        TaskCreatedHandler
+	onQuery       KnowledgeRequestedHandler
+	onValidation  ValidationRequestedHandler
+	onReorg       ReorgHandler
+	recent        []blockRef // the last blocks processed, oldest first, when onReorg is set
+	onError       func(err error)
+	prefilter     *EventPrefilter
+	maxAttempts   int
+	retryBackoff  time.Duration
+	tracing       trace.TracerProvider
+	clock         Clock
+	chainID       uint64      // the chain the RPC must serve; 0 for any
+	otherChain    bool        // chainID isn't the node's primary chain; see WithChain
+	chainChecked  atomic.Bool // the RPC was found to serve chainID
+	startBlock    uint64      // where to start without a checkpoint; 0 for the head
+	abis          ContractABIs
+	driftMu       sync.Mutex
+	undecoded     map[common.Address]*UndecodedLogs
+	progress      catchUp
+}
+
+// WatcherOption configures an EventWatcher.
+type WatcherOption func(*EventWatcher)
+
+// WithPollInterval sets how often the watcher queries the RPC for new blocks.
+// Non-positive values keep DefaultPollInterval.
+func WithPollInterval(d time.Duration) WatcherOption {
+	return func(w *EventWatcher) {
+		if d > 0 {
+			w.pollInterval = d
+		}
+	}
+}
+
+// WithJitter randomises each poll delay by up to ±frac of the interval (0.1
+// means 1.8s–2.2s at the default), so nodes sharing a public endpoint don't
+// poll in lockstep. frac is clamped to [0, 1).
+func WithJitter(frac float64) WatcherOption {
+	return func(w *EventWatcher) {
+		switch {
+		case frac < 0:
+			frac = 0
+		case frac >= 1:
+			frac = 0.99
+		}
+		w.jitter = frac
+	}
+}
+
+// WithConfirmations makes the watcher only process blocks at least n blocks
+// behind the head, so events from reorged blocks are not acted on.
+//
+// Confirmation depth and poll interval add up: an event is seen between
+// n*blockTime and n*blockTime + interval (+ jitter) after its block. Polling
+// faster than the block time does not reduce that latency, it only costs RPC
+// calls.
+func WithConfirmations(n uint64) WatcherOption {
+	return func(w *EventWatcher) {
+		w.confirmations = n
+	}
+}
+
+// WithBlockTime sets the chain's block time, from which HeadLag works out
+// where the chain should be. Non-positive values keep DefaultBlockTime.
+func WithBlockTime(d time.Duration) WatcherOption {
+	return func(w *EventWatcher) {
+		if d > 0 {
+			w.blockTime = d
+		}
+	}
+}
+
+// WithMaxHeadLag sets how many blocks the RPC's head may trail the block the
+// chain should be at before the watcher warns and readiness fails. Zero
+// keeps DefaultMaxHeadLag.
+func WithMaxHeadLag(blocks uint64) WatcherOption {
+	return func(w *EventWatcher) {
+		if blocks > 0 {
+			w.maxHeadLag = blocks
+		}
+	}
+}
+
+// WithLogRange caps the blocks queried per eth_getLogs call. Non-positive
+// values keep DefaultLogRange.
+func WithLogRange(blocks uint64) WatcherOption {
+	return func(w *EventWatcher) {
+		if blocks > 0 {
+			w.logRange = blocks
+		}
+	}
+}
+
+// WithLogScanner sets the scanner that fetches the blocks behind the head
+// after downtime, to share its rate limit or change its workers. Without it
+// the watcher scans with DefaultScanWorkers and no rate limit.
+func WithLogScanner(s *LogScanner) WatcherOption {
+	return func(w *EventWatcher) {
+		w.scanner = s
+	}
+}
+
+// WithValidationRequests also watches the ValidationRegistry at
+// registryAddr, calling onRequest for its ValidationRequest events, such as
+// Validator.OnRequest.
+func WithValidationRequests(registryAddr string, onRequest ValidationRequestedHandler) WatcherOption {
+	return func(w *EventWatcher) {
+		w.validAddr = common.HexToAddress(registryAddr)
+		w.onValidation = onRequest
+	}
+}
+
+// WithReorgHandler makes the watcher check, before each poll, that the last
+// block it processed is still on the chain. When a reorg replaced it, the
+// watcher rewinds to the newest block it processed that wasn't replaced,
+// within the last 64, and calls fn with it. Checking costs a header request
+// per poll.
+func WithReorgHandler(fn ReorgHandler) WatcherOption {
+	return func(w *EventWatcher) {
+		w.onReorg = fn
+	}
+}
+
+// WithErrorHandler calls fn for every failed poll, checkpoint write or event
+// delivery.
+func WithErrorHandler(fn func(err error)) WatcherOption {
+	return func(w *EventWatcher) {
+		w.onError = fn
+	}
+}
+
+// WithTracerProvider traces the handling of each chain event. Without it the
+// watcher records no spans.
+func WithTracerProvider(tp trace.TracerProvider) WatcherOption {
+	return func(w *EventWatcher) {
+		w.tracing = tp
+	}
+}
+
+// WithDeferredHead makes the constructor leave the RPC alone: the watcher
+// reads the head it starts from on its first poll that reaches the RPC, so
+// a node can come up while its RPC is slow or down.
+func WithDeferredHead() WatcherOption {
+	return func(w *EventWatcher) {
+		w.deferHead = true
+	}
+}
+
+// WithChain binds the watcher to the chain chainID: its events carry the ID,
+// and it processes nothing until the RPC is found to serve that chain. The
+// IDs of the events and dead letters of a watcher that isn't the primary
+// one's, the first chain a node works on, name the chain, e.g.
+// "task:84532:7", so the same task on two chains makes two records.
+func WithChain(chainID uint64, primary bool) WatcherOption {
+	return func(w *EventWatcher) {
+		w.chainID, w.otherChain = chainID, !primary
+	}
+}
+
+// WithStartBlock makes a watcher with no checkpoint start at block, such as
+// the one its contracts were deployed in, rather than at the head.
+func WithStartBlock(block uint64) WatcherOption {
+	return func(w *EventWatcher) {
+		w.startBlock = block
+	}
+}
+
+// WithClock sets the clock polls are scheduled by and dead letters are
+// retried by. Without it the watcher uses the SystemClock.
+func WithClock(clock Clock) WatcherOption {
+	return func(w *EventWatcher) {
+		w.clock = clock
+	}
 }
 
-func NewEventWatcher(rpcURL string, escrowAddr, marketAddr string, onTask func(event TaskCreatedEvent), onQuery func(event KnowledgeRequestedEvent)) (*EventWatcher, error) {
+// NewEventWatcher watches the escrow and market contracts, calling onTask and
+// onQuery for their events, each tagged with the contract it came from. The
+// callbacks can't fail; only a panic makes an event a dead letter. Use
+// NewEventWatcherWithHandlers for callbacks that report errors.
+//
+// Task and request IDs are only unique within a contract, so events of any
+// escrow or market but the first listed are recorded under IDs that name
+// their contract, e.g. "task:0xAbC...:7" rather than "task:7".
+func NewEventWatcher(rpcURL string, escrowAddrs, marketAddrs []string, onTask func(event TaskCreatedEvent), onQuery func(event KnowledgeRequestedEvent), opts ...WatcherOption) (*EventWatcher, error) {
+	var taskHandler TaskCreatedHandler
+	if onTask != nil {
+		taskHandler = func(e TaskCreatedEvent) error { onTask(e); return nil }
+	}
+	var queryHandler KnowledgeRequestedHandler
+	if onQuery != nil {
+		queryHandler = func(q KnowledgeRequestedEvent) error { onQuery(q); return nil }
+	}
+	return NewEventWatcherWithHandlers(rpcURL, escrowAddrs, marketAddrs, taskHandler, queryHandler, opts...)
+}
+
+// NewEventWatcherWithHandlers is NewEventWatcher with callbacks that return
+// an error when they fail to process an event. The watcher checkpoints a
+// block only once each of its events was processed or kept as a dead letter,
+// so every event is processed at least once.
+func NewEventWatcherWithHandlers(rpcURL string, escrowAddrs, marketAddrs []string, onTask TaskCreatedHandler, onQuery KnowledgeRequestedHandler, opts ...WatcherOption) (*EventWatcher, error) {
+	escrows, err := parseContracts("escrow", escrowAddrs)
+	if err != nil {
+		return nil, err
+	}
+	markets, err := parseContracts("market", marketAddrs)
+	if err != nil {
+		return nil, err
+	}
 	client, err := ethclient.Dial(rpcURL)
 	if err != nil {
 		return nil, err
@@ -54,97 +359,509 @@ func NewEventWatcher(rpcURL string, escrowAddr, marketAddr string, onTask func(e
 
 	eABI, _ := abi.JSON(strings.NewReader(taskEscrowEventABI))
 	mABI, _ := abi.JSON(strings.NewReader(knowledgeMarketEventABI))
+	vABI, _ := abi.JSON(strings.NewReader(validationEventABI))
 
-	header, err := client.HeaderByNumber(context.Background(), nil)
-	lastBlock := uint64(0)
-	if err == nil {
-		lastBlock = header.Number.Uint64()
+	w := &EventWatcher{
+		client:       client,
+		escrowAddrs:  escrows,
+		marketAddrs:  markets,
+		escrowABI:    eABI,
+		marketABI:    mABI,
+		validABI:     vABI,
+		pollInterval: DefaultPollInterval,
+		blockTime:    DefaultBlockTime,
+		maxHeadLag:   DefaultMaxHeadLag,
+		logRange:     DefaultLogRange,
+		maxAttempts:  DefaultMaxAttempts,
+		retryBackoff: DefaultRetryBackoff,
+		onTask:       onTask,
+		onQuery:      onQuery,
+		clock:        SystemClock,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if len(escrows) == 0 && len(markets) == 0 && w.onValidation == nil {
+		return nil, errors.New("no contract to watch")
 	}
+	if w.startBlock > 0 {
+		// The blocks from startBlock on are caught up on the first poll
+		w.lastBlock = w.startBlock - 1
+		w.anchored.Store(true)
+	} else if !w.deferHead {
+		if header, err := client.HeaderByNumber(context.Background(), nil); err == nil {
+			w.noteHead(header)
+			w.anchor(header.Number.Uint64())
+		}
+	}
+	return w, nil
+}
 
-	return &EventWatcher{
-		client:     client,
-		escrowAddr: common.HexToAddress(escrowAddr),
-		marketAddr: common.HexToAddress(marketAddr),
-		escrowABI:  eABI,
-		marketABI:  mABI,
-		lastBlock:  lastBlock,
-		onTask:     onTask,
-		onQuery:    onQuery,
-	}, nil
+// parseContracts parses the addresses of the contracts of kind to watch,
+// dropping repeats.
+func parseContracts(kind string, addrs []string) ([]common.Address, error) {
+	var parsed []common.Address
+	for _, a := range addrs {
+		if !common.IsHexAddress(a) {
+			return nil, fmt.Errorf("%s contract %q is not an address", kind, a)
+		}
+		if addr := common.HexToAddress(a); contractIndex(parsed, addr) < 0 {
+			parsed = append(parsed, addr)
+		}
+	}
+	return parsed, nil
 }
 
-// Start begins polling for TaskCreated and KnowledgeRequested events.
+// contractIndex returns where addr is in addrs, or -1.
+func contractIndex(addrs []common.Address, addr common.Address) int {
+	for i, a := range addrs {
+		if a == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// UseCheckpoints persists the watcher's progress under name and, if a
+// checkpoint already exists, resumes from it instead of the current head.
+func (w *EventWatcher) UseCheckpoints(store MetadataStore, name string) error {
+	block, ok, err := store.GetCheckpoint(name)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint %s: %w", name, err)
+	}
+	if ok {
+		w.lastBlock = block
+		w.anchored.Store(true)
+	}
+	w.store = store
+	w.checkpoint = name
+	return nil
+}
+
+// Start begins polling for TaskCreated and KnowledgeRequested events. With
+// checkpoints enabled it resumes from the stored block, so a watcher restarted
+// after a leadership change picks up where the previous leader stopped.
 func (w *EventWatcher) Start(ctx context.Context) {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+	if w.store != nil {
+		if block, ok, err := w.store.GetCheckpoint(w.checkpoint); err == nil && ok {
+			atomic.StoreUint64(&w.lastBlock, block)
+			w.anchored.Store(true)
+		}
+	}
 
-	fmt.Printf("[Watcher] Started monitoring Escrow (%s) and Market (%s) from block %d\n", w.escrowAddr.Hex(), w.marketAddr.Hex(), w.lastBlock)
+	fmt.Printf("[Watcher] Started monitoring Escrow %v and Market %v%s from block %d (every %s, %d confirmations)\n",
+		w.escrowAddrs, w.marketAddrs, w.chainLabel(), w.LastBlock(), w.pollInterval, w.confirmations)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-w.clock.After(w.nextDelay()):
 			w.pollLogs(ctx)
+			w.retryDeadLetters(w.clock.Now())
 		}
 	}
 }
 
+// nextDelay returns the poll interval with jitter applied.
+func (w *EventWatcher) nextDelay() time.Duration {
+	if w.jitter == 0 {
+		return w.pollInterval
+	}
+	f := 1 + w.jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(w.pollInterval) * f)
+}
+
 func (w *EventWatcher) pollLogs(ctx context.Context) {
+	if err := w.checkChain(ctx); err != nil {
+		w.reportError(err)
+		return
+	}
 	header, err := w.client.HeaderByNumber(ctx, nil)
 	if err != nil {
+		w.reportError(fmt.Errorf("failed to get head: %w", err))
 		return
 	}
+	w.noteHead(header)
 	currentBlock := header.Number.Uint64()
+	if !w.anchored.Load() {
+		// Nothing to catch up on: the watcher starts here
+		w.anchor(currentBlock)
+		fmt.Printf("[Watcher] Reached the RPC; watching from block %d\n", w.LastBlock())
+		return
+	}
+	if currentBlock <= w.confirmations {
+		return
+	}
+	currentBlock -= w.confirmations
+	w.noteTarget(currentBlock)
+	if w.onReorg != nil {
+		if err := w.checkReorg(ctx); err != nil {
+			w.reportError(err)
+			return
+		}
+	}
 
-	if currentBlock <= w.lastBlock {
+	// Fetch the gap in bounded chunks, several at once, and process and
+	// checkpoint them in block order, so a long outage is caught up across
+	// polls even if one chunk fails
+	if err := w.scanner.Scan(ctx, w.LastBlock()+1, currentBlock, w.logRange, w.fetchLogs, w.processLogs); err != nil {
+		w.reportError(err)
+	}
+	if w.onReorg != nil {
+		w.remember(ctx, header)
+	}
+}
+
+// remember records the hash of the last block processed, for checkReorg.
+// head is the chain head just read, which saves a request when the watcher
+// waits for no confirmations.
+func (w *EventWatcher) remember(ctx context.Context, head *types.Header) {
+	last := w.LastBlock()
+	if n := len(w.recent); n > 0 && w.recent[n-1].number >= last {
 		return
 	}
+	hash := head.Hash()
+	if head.Number.Uint64() != last {
+		h, err := w.client.HeaderByNumber(ctx, new(big.Int).SetUint64(last))
+		if err != nil {
+			// The next block processed is remembered instead
+			return
+		}
+		hash = h.Hash()
+	}
+	w.recent = append(w.recent, blockRef{number: last, hash: hash})
+	if len(w.recent) > reorgWindow {
+		w.recent = w.recent[len(w.recent)-reorgWindow:]
+	}
+}
+
+// checkReorg compares the blocks processed last with the chain, newest
+// first. When the newest was replaced, the watcher rewinds to the newest
+// that wasn't, or past all it remembers, and tells onReorg.
+func (w *EventWatcher) checkReorg(ctx context.Context) error {
+	for i := len(w.recent) - 1; i >= 0; i-- {
+		ref := w.recent[i]
+		h, err := w.client.HeaderByNumber(ctx, new(big.Int).SetUint64(ref.number))
+		if err != nil {
+			return fmt.Errorf("failed to check block %d for a reorg: %w", ref.number, err)
+		}
+		if h.Hash() == ref.hash {
+			if i == len(w.recent)-1 {
+				return nil
+			}
+			return w.rewind(ref.number, i+1)
+		}
+	}
+	if len(w.recent) == 0 {
+		return nil
+	}
+	ancestor := w.recent[0].number
+	if ancestor > 0 {
+		ancestor--
+	}
+	return w.rewind(ancestor, 0)
+}
+
+// rewind makes ancestor the last block processed, forgetting the recent
+// blocks from keep on, which a reorg replaced. onReorg is told first: if it
+// fails, nothing is rewound and the next poll finds the reorg again.
+func (w *EventWatcher) rewind(ancestor uint64, keep int) error {
+	fmt.Printf("[Watcher] Reorg%s: blocks after %d were replaced; processing them again\n", w.chainLabel(), ancestor)
+	if err := w.onReorg(ancestor); err != nil {
+		return fmt.Errorf("handling the reorg after block %d: %w", ancestor, err)
+	}
+	if err := w.advance(ancestor); err != nil {
+		return err
+	}
+	w.recent = w.recent[:keep]
+	return nil
+}
 
+// checkChain makes sure the RPC serves the chain the watcher is bound to,
+// asking it until it answers once. Logs of another chain would be recorded
+// as the bound chain's.
+func (w *EventWatcher) checkChain(ctx context.Context) error {
+	if w.chainID == 0 || w.chainChecked.Load() {
+		return nil
+	}
+	id, err := w.client.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain id: %w", err)
+	}
+	if id.Uint64() != w.chainID {
+		return fmt.Errorf("%w: RPC serves chain %s, the watcher chain %d", ErrWrongChain, id, w.chainID)
+	}
+	w.chainChecked.Store(true)
+	return nil
+}
+
+// chainLabel names the watcher's chain for its log lines.
+func (w *EventWatcher) chainLabel() string {
+	if w.chainID == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" on chain %d", w.chainID)
+}
+
+// ChainID returns the chain the watcher is bound to, or 0.
+func (w *EventWatcher) ChainID() uint64 {
+	return w.chainID
+}
+
+// fetchLogs returns the watched contracts' logs of blocks from..to.
+func (w *EventWatcher) fetchLogs(ctx context.Context, from, to uint64) ([]types.Log, error) {
 	query := ethereum.FilterQuery{
-		FromBlock: big.NewInt(int64(w.lastBlock + 1)),
-		ToBlock:   big.NewInt(int64(currentBlock)),
-		Addresses: []common.Address{w.escrowAddr, w.marketAddr},
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: append(append([]common.Address{}, w.escrowAddrs...), w.marketAddrs...),
+	}
+	if w.onValidation != nil {
+		query.Addresses = append(query.Addresses, w.validAddr)
 	}
 
 	logs, err := w.client.FilterLogs(ctx, query)
 	if err != nil {
-		fmt.Printf("[Watcher] FilterLogs error: %v\n", err)
-		return
+		fmt.Printf("[Watcher] FilterLogs error for blocks %d-%d: %v\n", from, to, err)
+		return nil, fmt.Errorf("FilterLogs %d-%d: %w", from, to, err)
 	}
+	return logs, nil
+}
 
+// processLogs delivers the events of blocks from..to and records to as done.
+func (w *EventWatcher) processLogs(from, to uint64, logs []types.Log) error {
 	for _, vLog := range logs {
-		// TaskEscrow Events
-		if vLog.Address == w.escrowAddr && vLog.Topics[0] == w.escrowABI.Events["TaskCreated"].ID {
-			var event TaskCreatedEvent
-			err := w.escrowABI.UnpackIntoInterface(&event, "TaskCreated", vLog.Data)
-			if err != nil {
-				continue
-			}
-			event.TaskId = new(big.Int).SetBytes(vLog.Topics[1].Bytes())
-			event.Client = common.BytesToAddress(vLog.Topics[2].Bytes())
-			if w.onTask != nil {
-				w.onTask(event)
+		if err := w.handleLog(vLog); err != nil {
+			// Keep the blocks before this one; the next poll resumes here,
+			// delivering this block's earlier events again
+			if done := vLog.BlockNumber - 1; done >= from {
+				if cerr := w.advance(done); cerr != nil {
+					return cerr
+				}
 			}
+			return fmt.Errorf("block %d not processed: %w", vLog.BlockNumber, err)
 		}
+	}
+	return w.advance(to)
+}
 
-		// KnowledgeMarket Events
-		if vLog.Address == w.marketAddr && vLog.Topics[0] == w.marketABI.Events["KnowledgeRequested"].ID {
-			var event KnowledgeRequestedEvent
-			err := w.marketABI.UnpackIntoInterface(&event, "KnowledgeRequested", vLog.Data)
-			if err != nil {
-				fmt.Printf("[Watcher] Unpack Query Error: %v\n", err)
-				continue
-			}
-			event.RequestId = new(big.Int).SetBytes(vLog.Topics[1].Bytes())
-			event.Requester = common.BytesToAddress(vLog.Topics[2].Bytes())
-			event.TopicHash = vLog.Topics[3]
+// advance records every block up to block as processed. A checkpoint that
+// isn't saved, as when it is batched with the writes of events that were
+// lost, leaves the blocks to be delivered again.
+func (w *EventWatcher) advance(block uint64) error {
+	if w.store != nil {
+		if err := w.store.SetCheckpoint(w.checkpoint, block); err != nil {
+			fmt.Printf("[Watcher] Failed to save checkpoint: %v\n", err)
+			return fmt.Errorf("failed to save checkpoint: %w", err)
+		}
+	}
+	atomic.StoreUint64(&w.lastBlock, block)
+	w.noteProgress()
+	return nil
+}
 
-			if w.onQuery != nil {
-				w.onQuery(event)
-			}
+// handleLog delivers a TaskCreated, KnowledgeRequested or ValidationRequest
+// log to its callback, unless the prefilter skips it, keeping it as a dead
+// letter if the callback fails. Escrow and market logs that are no event of
+// their contract's ABI are counted as possible drift. The
+// error is set only when the event was neither processed nor kept.
+func (w *EventWatcher) handleLog(vLog types.Log) error {
+	if !w.recognized(vLog) {
+		w.noteUndecoded(vLog, "matches no event of its ABI")
+		return nil
+	}
+	if len(vLog.Topics) < 2 {
+		return nil
+	}
+	escrow, market := contractIndex(w.escrowAddrs, vLog.Address), contractIndex(w.marketAddrs, vLog.Address)
+	switch {
+	case escrow >= 0 && vLog.Topics[0] == w.escrowABIAt(vLog).Events["TaskCreated"].ID:
+		if w.prefilter != nil && !w.prefilter.admitTask(vLog) {
+			return nil
+		}
+		return w.deliver(eventID(TaskKindEscrow, w.chainID, w.otherChain, vLog.Address, escrow > 0, vLog.Topics[1].Big()), vLog)
+	case market >= 0 && vLog.Topics[0] == w.marketABIAt(vLog).Events["KnowledgeRequested"].ID:
+		if w.prefilter != nil && !w.prefilter.admitQuery(vLog) {
+			return nil
+		}
+		return w.deliver(eventID(TaskKindKnowledge, w.chainID, w.otherChain, vLog.Address, market > 0, vLog.Topics[1].Big()), vLog)
+	case w.onValidation != nil && vLog.Address == w.validAddr && vLog.Topics[0] == w.validABI.Events["ValidationRequest"].ID && len(vLog.Topics) > 3:
+		kind := "validation"
+		if w.otherChain {
+			kind = fmt.Sprintf("validation:%d", w.chainID)
 		}
+		return w.deliver(kind+":"+vLog.Topics[3].Hex(), vLog)
 	}
+	return nil
+}
+
+// dispatch decodes a log and hands it to the callbacks, returning their
+// error. A log that doesn't decode is dropped, and counted as possible drift:
+// delivering it again wouldn't help.
+func (w *EventWatcher) dispatch(vLog types.Log) error {
+	// TaskEscrow Events
+	escrowABI, marketABI := w.escrowABIAt(vLog), w.marketABIAt(vLog)
+	if i := contractIndex(w.escrowAddrs, vLog.Address); i >= 0 && vLog.Topics[0] == escrowABI.Events["TaskCreated"].ID {
+		var event TaskCreatedEvent
+		if err := unpackLog(escrowABI, "TaskCreated", &event, vLog); err != nil {
+			fmt.Printf("[Watcher] Unpack Task Error: %v\n", err)
+			w.noteUndecoded(vLog, "doesn't unpack: "+err.Error())
+			return nil
+		}
+		event.Block, event.Contract, event.qualified = vLog.BlockNumber, vLog.Address, i > 0
+		event.ChainID, event.chainQualified, event.raw = w.chainID, w.otherChain, &vLog
+		if w.onTask != nil {
+			return w.onTask(event)
+		}
+	}
+
+	// KnowledgeMarket Events
+	if i := contractIndex(w.marketAddrs, vLog.Address); i >= 0 && vLog.Topics[0] == marketABI.Events["KnowledgeRequested"].ID {
+		var event KnowledgeRequestedEvent
+		if err := unpackLog(marketABI, "KnowledgeRequested", &event, vLog); err != nil {
+			fmt.Printf("[Watcher] Unpack Query Error: %v\n", err)
+			w.noteUndecoded(vLog, "doesn't unpack: "+err.Error())
+			return nil
+		}
+		event.Block, event.Contract, event.qualified = vLog.BlockNumber, vLog.Address, i > 0
+		event.ChainID, event.chainQualified, event.raw = w.chainID, w.otherChain, &vLog
+		if w.onQuery != nil {
+			return w.onQuery(event)
+		}
+	}
+
+	// ValidationRegistry Events
+	if w.onValidation != nil && vLog.Address == w.validAddr && vLog.Topics[0] == w.validABI.Events["ValidationRequest"].ID {
+		event, err := decodeValidationRequest(w.validABI, vLog)
+		if err != nil {
+			fmt.Printf("[Watcher] Unpack Validation Error: %v\n", err)
+			return nil
+		}
+		return w.onValidation(event)
+	}
+	return nil
+}
+
+// unpackLog decodes a log of the named event into out, a pointer to a struct
+// with a field for each event input named after it in CamelCase: non-indexed
+// inputs come from the data, indexed ones from the topics. Inputs out has no
+// field for are skipped and fields with no input are left alone, so one
+// struct serves every version of an event.
+func unpackLog(parsed abi.ABI, name string, out interface{}, vLog types.Log) error {
+	event, ok := parsed.Events[name]
+	if !ok {
+		return fmt.Errorf("no %s event in the ABI", name)
+	}
+	if len(vLog.Topics) == 0 || vLog.Topics[0] != event.ID {
+		return fmt.Errorf("log in tx %s is not a %s event", vLog.TxHash.Hex(), name)
+	}
+	var indexed abi.Arguments
+	for _, arg := range event.Inputs {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+	if len(vLog.Topics) != len(indexed)+1 {
+		return fmt.Errorf("%s log has %d topics, want %d", name, len(vLog.Topics), len(indexed)+1)
+	}
+	values := map[string]interface{}{}
+	if err := event.Inputs.UnpackIntoMap(values, vLog.Data); err != nil {
+		return fmt.Errorf("%s data: %w", name, err)
+	}
+	if err := abi.ParseTopicsIntoMap(values, indexed, vLog.Topics[1:]); err != nil {
+		return fmt.Errorf("%s topics: %w", name, err)
+	}
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%s decoded into %T, not a pointer to a struct", name, out)
+	}
+	for input, value := range values {
+		field := rv.Elem().FieldByName(abi.ToCamelCase(input))
+		if !field.IsValid() || !field.CanSet() {
+			continue
+		}
+		v := reflect.ValueOf(value)
+		switch {
+		case v.Type().AssignableTo(field.Type()):
+			field.Set(v)
+		case v.Kind() == field.Kind() && v.Type().ConvertibleTo(field.Type()):
+			// bytes32 into a common.Hash, say
+			field.Set(v.Convert(field.Type()))
+		default:
+			return fmt.Errorf("%s input %s is a %s, not a %s", name, input, v.Type(), field.Type())
+		}
+	}
+	return nil
+}
+
+func (w *EventWatcher) reportError(err error) {
+	if w.onError != nil && !errors.Is(err, context.Canceled) {
+		w.onError(err)
+	}
+}
+
+// LastBlock returns the last block the watcher has fully processed.
+func (w *EventWatcher) LastBlock() uint64 {
+	return atomic.LoadUint64(&w.lastBlock)
+}
+
+// Lag returns how many confirmed blocks the watcher is behind the chain head.
+// It also refreshes HeadLag.
+func (w *EventWatcher) Lag(ctx context.Context) (uint64, error) {
+	header, err := w.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	w.noteHead(header)
+	if !w.anchored.Load() {
+		return 0, errors.New("waiting for its first poll to pick a start block")
+	}
+	head := header.Number.Uint64()
+	if head <= w.confirmations+w.LastBlock() {
+		return 0, nil
+	}
+	return head - w.confirmations - w.LastBlock(), nil
+}
 
-	w.lastBlock = currentBlock
+// HeadLag returns how many blocks the RPC's head trailed the block the chain
+// should be at, going by the head's timestamp and the block time, when the
+// watcher last read it. Lag says how far the watcher is behind the RPC; this
+// says how far the RPC is behind the chain, which no amount of polling fixes.
+func (w *EventWatcher) HeadLag() uint64 {
+	return w.headLag.Load()
+}
+
+// MaxHeadLag returns the HeadLag over which the RPC counts as behind.
+func (w *EventWatcher) MaxHeadLag() uint64 {
+	return w.maxHeadLag
+}
+
+// anchor starts the watcher at head's confirmed block, not the raw head.
+func (w *EventWatcher) anchor(head uint64) {
+	if head > w.confirmations {
+		atomic.StoreUint64(&w.lastBlock, head-w.confirmations)
+	}
+	w.progress.head.Store(w.LastBlock())
+	w.anchored.Store(true)
+}
+
+// noteHead records the head lag of header, warning when the RPC falls more
+// than maxHeadLag blocks behind and again when it recovers.
+func (w *EventWatcher) noteHead(header *types.Header) {
+	var lag uint64
+	if age := w.clock.Now().Sub(time.Unix(int64(header.Time), 0)); age > 0 {
+		lag = uint64(age / w.blockTime)
+	}
+	w.headLag.Store(lag)
+
+	lagging := lag > w.maxHeadLag
+	if w.headLagging.Swap(lagging) == lagging {
+		return
+	}
+	if lagging {
+		fmt.Printf("[Watcher] RPC head %d is %d blocks behind the chain (max %d); the RPC node is syncing or stuck, not the watcher\n",
+			header.Number.Uint64(), lag, w.maxHeadLag)
+	} else {
+		fmt.Printf("[Watcher] RPC head %d has caught up with the chain\n", header.Number.Uint64())
+	}
 }
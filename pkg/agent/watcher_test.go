@@ -0,0 +1,378 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/testutil"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func newTestStore(t *testing.T) MetadataStore {
+	t.Helper()
+	store, err := OpenMetadataStore(DriverSQLite, filepath.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// fakeChain serves a head block, made at headTime, and records the eth_getLogs ranges asked for,
+// failing any range that reaches failFrom or beyond. Blocks after forkAfter are
+// those of fork, so changing fork reorganizes them.
+type fakeChain struct {
+	mu        sync.Mutex
+	chainID   uint64
+	head      uint64
+	headTime  uint64 // unix seconds
+	failFrom  uint64
+	forkAfter uint64
+	fork      byte
+	ranges    [][2]uint64
+	logs      []types.Log
+}
+
+func (c *fakeChain) handle(method string, params []json.RawMessage) (interface{}, *rpcError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch method {
+	case "eth_chainId":
+		return hexutil.Uint64(c.chainID), nil
+	case "eth_blockNumber":
+		return hexutil.Uint64(c.head), nil
+	case "eth_getBlockByNumber":
+		number := c.head
+		var tag string
+		if json.Unmarshal(params[0], &tag) == nil && tag != "latest" {
+			number, _ = hexutil.DecodeUint64(tag)
+		}
+		h := &types.Header{Number: new(big.Int).SetUint64(number), Time: c.headTime, Difficulty: big.NewInt(0)}
+		if c.fork != 0 && number > c.forkAfter {
+			h.Extra = []byte{c.fork}
+		}
+		return h, nil
+	case "eth_getLogs":
+		var q struct {
+			FromBlock hexutil.Uint64 `json:"fromBlock"`
+			ToBlock   hexutil.Uint64 `json:"toBlock"`
+		}
+		json.Unmarshal(params[0], &q)
+		c.ranges = append(c.ranges, [2]uint64{uint64(q.FromBlock), uint64(q.ToBlock)})
+		if c.failFrom != 0 && uint64(q.ToBlock) >= c.failFrom {
+			return nil, &rpcError{Code: -32000, Message: "upstream unavailable"}
+		}
+		logs := []types.Log{}
+		for _, l := range c.logs {
+			if l.BlockNumber >= uint64(q.FromBlock) && l.BlockNumber <= uint64(q.ToBlock) {
+				logs = append(logs, l)
+			}
+		}
+		return logs, nil
+	}
+	return nil, &rpcError{Code: -32601, Message: "method not found: " + method}
+}
+
+func sortRanges(ranges [][2]uint64) {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+}
+
+func TestWatcherCatchesUpInChunks(t *testing.T) {
+	chain := &fakeChain{head: 3500}
+	url := newFakeRPC(t, chain.handle)
+	w, err := NewEventWatcher(url, []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil, WithLogRange(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+	store.SetCheckpoint("watcher", 100)
+	if err := w.UseCheckpoints(store, "watcher"); err != nil {
+		t.Fatal(err)
+	}
+
+	w.pollLogs(context.Background())
+
+	// Chunks are fetched concurrently, so in no particular order
+	sortRanges(chain.ranges)
+	want := [][2]uint64{{101, 1100}, {1101, 2100}, {2101, 3100}, {3101, 3500}}
+	if len(chain.ranges) != len(want) {
+		t.Fatalf("queried %v, want %v", chain.ranges, want)
+	}
+	for i := range want {
+		if chain.ranges[i] != want[i] {
+			t.Errorf("chunk %d = %v, want %v", i, chain.ranges[i], want[i])
+		}
+	}
+	if block, _, _ := store.GetCheckpoint("watcher"); block != 3500 || w.LastBlock() != 3500 {
+		t.Errorf("checkpoint %d, last block %d, want 3500", block, w.LastBlock())
+	}
+}
+
+func TestWatcherKeepsProgressWhenAChunkFails(t *testing.T) {
+	chain := &fakeChain{head: 3500, failFrom: 2500}
+	url := newFakeRPC(t, chain.handle)
+	var errs []error
+	w, err := NewEventWatcher(url, []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil,
+		WithLogRange(1000), WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+	store.SetCheckpoint("watcher", 100)
+	w.UseCheckpoints(store, "watcher")
+
+	w.pollLogs(context.Background())
+	if len(errs) != 1 {
+		t.Fatalf("reported %d errors, want 1", len(errs))
+	}
+	if block, _, _ := store.GetCheckpoint("watcher"); block != 2100 {
+		t.Errorf("checkpoint %d after a failed chunk, want 2100", block)
+	}
+
+	// The next poll resumes at the failed chunk rather than the old checkpoint
+	chain.mu.Lock()
+	chain.failFrom, chain.ranges = 0, nil
+	chain.mu.Unlock()
+	w.pollLogs(context.Background())
+	sortRanges(chain.ranges)
+	if len(chain.ranges) == 0 || chain.ranges[0] != [2]uint64{2101, 3100} {
+		t.Errorf("resumed with %v, want 2101-3100 first", chain.ranges)
+	}
+	if block, _, _ := store.GetCheckpoint("watcher"); block != 3500 {
+		t.Errorf("checkpoint %d, want 3500", block)
+	}
+}
+
+func TestWatcherPollsOnItsClock(t *testing.T) {
+	chain := &fakeChain{head: 100}
+	url := newFakeRPC(t, chain.handle)
+	clock := testutil.NewFakeClock(time.UnixMilli(1700000000000))
+	w, err := NewEventWatcher(url, []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Start(ctx)
+
+	clock.BlockUntil(1)
+	chain.mu.Lock()
+	chain.head = 105
+	chain.mu.Unlock()
+	clock.Advance(DefaultPollInterval - time.Millisecond)
+	if w.LastBlock() != 100 {
+		t.Fatalf("polled before the interval passed: last block %d", w.LastBlock())
+	}
+
+	// The poll is done once the loop waits on the clock again
+	clock.Advance(time.Millisecond)
+	clock.BlockUntil(1)
+	if w.LastBlock() != 105 {
+		t.Errorf("last block %d after the interval, want 105", w.LastBlock())
+	}
+}
+
+func TestReadyzFailsWhileTheRPCHeadLags(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	// The RPC's head is two minutes old: 60 blocks behind at 2s blocks
+	chain := &fakeChain{head: 100, headTime: uint64(now.Add(-2 * time.Minute).Unix())}
+	w, err := NewEventWatcher(newFakeRPC(t, chain.handle), []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil,
+		WithClock(testutil.NewFakeClock(now)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.HeadLag() != 60 {
+		t.Errorf("HeadLag = %d, want 60", w.HeadLag())
+	}
+	n := newTestNode(t)
+	n.Watcher = w
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() Check {
+		for _, c := range n.Readyz().Checks {
+			if c.Name == "rpc_head" {
+				return c
+			}
+		}
+		t.Fatal("no rpc_head check")
+		return Check{}
+	}
+	if c := check(); c.OK {
+		t.Errorf("rpc_head = %+v with the RPC two minutes behind, want failing", c)
+	}
+
+	// The RPC syncs; the watcher was caught up with it all along
+	chain.mu.Lock()
+	chain.headTime = uint64(now.Add(-time.Second).Unix())
+	chain.mu.Unlock()
+	if c := check(); !c.OK || w.HeadLag() != 0 {
+		t.Errorf("rpc_head = %+v, HeadLag %d after the RPC synced, want passing", c, w.HeadLag())
+	}
+}
+
+// word is a 32-byte ABI word holding hex right-aligned.
+func word(hex string) string {
+	return strings.Repeat("0", 64-len(hex)) + hex
+}
+
+func TestUnpackLogDecodesIndexedAndDataFields(t *testing.T) {
+	w, err := NewEventWatcher(newFakeRPC(t, (&fakeChain{head: 1}).handle), []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+
+	// TaskCreated(7, 0xc1, 0xabab..., 1000) as the escrow logs it
+	taskLog := types.Log{
+		Topics: []common.Hash{
+			crypto.Keccak256Hash([]byte("TaskCreated(uint256,address,bytes32,uint256)")),
+			common.HexToHash(word("7")),
+			common.HexToHash(word("c1")),
+		},
+		Data:        common.FromHex(strings.Repeat("ab", 32) + word("3e8")),
+		BlockNumber: 9,
+	}
+	var task TaskCreatedEvent
+	if err := unpackLog(w.escrowABI, "TaskCreated", &task, taskLog); err != nil {
+		t.Fatal(err)
+	}
+	if task.TaskId.Int64() != 7 || task.Client != client || task.SpecHash != [32]byte(common.FromHex(strings.Repeat("ab", 32))) || task.Payment.Int64() != 1000 {
+		t.Errorf("TaskCreated = %+v", task)
+	}
+
+	// KnowledgeRequested(3, 0xc1, "rust async", keccak("rust async"), 1e16):
+	// the string sits after the head, at the offset its word gives
+	topicHash := crypto.Keccak256Hash([]byte("rust async"))
+	queryLog := types.Log{
+		Topics: []common.Hash{
+			crypto.Keccak256Hash([]byte("KnowledgeRequested(uint256,address,string,bytes32,uint256)")),
+			common.HexToHash(word("3")),
+			common.HexToHash(word("c1")),
+			topicHash,
+		},
+		Data: common.FromHex(word("40") + word("2386f26fc10000") + word("a") + "7275737420617379" + "6e63" + strings.Repeat("0", 44)),
+	}
+	var query KnowledgeRequestedEvent
+	if err := unpackLog(w.marketABI, "KnowledgeRequested", &query, queryLog); err != nil {
+		t.Fatal(err)
+	}
+	if query.RequestId.Int64() != 3 || query.Requester != client || query.Topic != "rust async" || query.TopicHash != topicHash || query.Bounty.String() != "10000000000000000" {
+		t.Errorf("KnowledgeRequested = %+v", query)
+	}
+
+	// A log missing an indexed field is refused rather than misread
+	queryLog.Topics = queryLog.Topics[:3]
+	if err := unpackLog(w.marketABI, "KnowledgeRequested", &query, queryLog); err == nil {
+		t.Error("decoded a KnowledgeRequested log without its topicHash topic")
+	}
+	if err := unpackLog(w.marketABI, "KnowledgeRequested", &query, taskLog); err == nil {
+		t.Error("decoded a TaskCreated log as KnowledgeRequested")
+	}
+}
+
+func TestWatcherTagsEventsWithTheirContract(t *testing.T) {
+	const otherEscrowHex = "0x00000000000000000000000000000000000000e6"
+	var delivered []TaskCreatedEvent
+	onTask := func(e TaskCreatedEvent) { delivered = append(delivered, e) }
+	w, err := NewEventWatcher(newFakeRPC(t, (&fakeChain{head: 1}).handle), []string{testEscrowHex, otherEscrowHex}, nil, onTask, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both escrows create a task 7; a third, unwatched contract emits the
+	// same event
+	first, other, unwatched := taskCreatedLog(t, w, 7), taskCreatedLog(t, w, 7), taskCreatedLog(t, w, 7)
+	other.Address = common.HexToAddress(otherEscrowHex)
+	unwatched.Address = common.HexToAddress("0x00000000000000000000000000000000000000e7")
+	if err := w.processLogs(42, 42, []types.Log{first, other, unwatched}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(delivered) != 2 {
+		t.Fatalf("delivered %d events, want one from each watched escrow", len(delivered))
+	}
+	if delivered[0].Contract != common.HexToAddress(testEscrowHex) || delivered[1].Contract != common.HexToAddress(otherEscrowHex) {
+		t.Errorf("events came from %s and %s, want each escrow", delivered[0].Contract, delivered[1].Contract)
+	}
+	// The first escrow's tasks keep their IDs; the other's name it
+	if id := TaskRecordFromEvent(delivered[0]).ID; id != "task:7" {
+		t.Errorf("first escrow's task recorded as %s, want task:7", id)
+	}
+	if id := TaskRecordFromEvent(delivered[1]).ID; id != "task:"+common.HexToAddress(otherEscrowHex).Hex()+":7" {
+		t.Errorf("other escrow's task recorded as %s, want it to name the escrow", id)
+	}
+	// and so does its recording, once replayed
+	replayed, err := RecordTask(delivered[1]).TaskEvent()
+	if err != nil || TaskRecordFromEvent(replayed).ID != TaskRecordFromEvent(delivered[1]).ID {
+		t.Errorf("replayed task recorded as %s (%v)", TaskRecordFromEvent(replayed).ID, err)
+	}
+
+	if _, err := NewEventWatcher(newFakeRPC(t, (&fakeChain{head: 1}).handle), []string{"escrow"}, nil, nil, nil); err == nil {
+		t.Error("watched an escrow that isn't an address")
+	}
+}
+
+func TestWatcherRewindsTheAddressBookOnAReorg(t *testing.T) {
+	chain := &fakeChain{head: 100}
+	n := newTestNode(t)
+	var reorgs []uint64
+	w, err := NewEventWatcher(newFakeRPC(t, chain.handle), []string{zeroAddressHex}, []string{zeroAddressHex}, nil, nil,
+		WithReorgHandler(func(ancestor uint64) error {
+			reorgs = append(reorgs, ancestor)
+			return n.RewindAddressBook(ancestor)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll := func(head uint64) {
+		chain.mu.Lock()
+		chain.head, chain.ranges = head, nil
+		chain.mu.Unlock()
+		w.pollLogs(context.Background())
+	}
+	poll(105)
+	poll(110)
+
+	// Wallets scanned up to various blocks: not found yet, or found
+	for wallet, scanned := range map[string]uint64{"0xa": 90, "0xb": 105, "0xc": 108, "0xd": 110} {
+		if err := n.Store.SaveAddress(AddressBookEntry{Wallet: wallet, ScannedBlock: scanned}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Blocks 106 on are mined again
+	chain.mu.Lock()
+	chain.forkAfter, chain.fork = 105, 1
+	chain.mu.Unlock()
+	poll(112)
+	if len(reorgs) != 1 || reorgs[0] != 105 {
+		t.Fatalf("reorgs = %v, want one after block 105", reorgs)
+	}
+	if len(chain.ranges) != 1 || chain.ranges[0] != [2]uint64{106, 112} {
+		t.Errorf("queried %v after the reorg, want 106-112 again", chain.ranges)
+	}
+	for wallet, want := range map[string]uint64{"0xa": 90, "0xb": 105, "0xc": 105, "0xd": 105} {
+		if e, err := n.Store.LookupAddress(wallet); err != nil || e == nil || e.ScannedBlock != want {
+			t.Errorf("%s scanned up to %+v (%v), want %d", wallet, e, err, want)
+		}
+	}
+
+	// The new blocks stand: no more reorgs
+	poll(113)
+	if len(reorgs) != 1 {
+		t.Errorf("reorgs = %v after a quiet poll", reorgs)
+	}
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Task pool defaults: how many peer tasks run at once, and how many more may
+// wait for a worker before peers are told the node is busy.
+const (
+	DefaultTaskWorkers = 16
+	DefaultTaskQueue   = 64
+)
+
+// DefaultBusyRetryAfter is how long requesters are asked to wait while the
+// pool has no room; see RetryAfter.
+const DefaultBusyRetryAfter = time.Minute
+
+// ErrBusy is returned by TaskPool.Do when every worker is taken and the queue
+// is full.
+var ErrBusy = errors.New("task queue is full")
+
+// TaskPool runs the tasks peers send on a fixed number of workers. Streams
+// are still accepted on their own goroutines, but only the pool's workers run
+// handlers; a task that finds the queue full is refused at once instead of
+// piling up.
+type TaskPool struct {
+	workers int
+	jobs    chan func()
+	active  atomic.Int64
+
+	start sync.Once
+	stop  sync.Once
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewTaskPool creates a pool of workers with room for queue waiting tasks.
+// Non-positive sizes take the defaults. Workers start with the first task.
+func NewTaskPool(workers, queue int) *TaskPool {
+	if workers <= 0 {
+		workers = DefaultTaskWorkers
+	}
+	if queue < 0 {
+		queue = DefaultTaskQueue
+	}
+	return &TaskPool{workers: workers, jobs: make(chan func(), queue), quit: make(chan struct{})}
+}
+
+// Do runs job on a worker and waits for it to finish. It returns ErrBusy
+// without running job when the queue is full, and ctx's error if ctx ends
+// first; a job still queued then is skipped.
+func (p *TaskPool) Do(ctx context.Context, job func()) error {
+	p.start.Do(func() {
+		p.wg.Add(p.workers)
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+	})
+
+	done := make(chan struct{})
+	var claimed atomic.Bool
+	run := func() {
+		defer close(done)
+		// Whoever claims the job first either runs it or gives it up
+		if claimed.CompareAndSwap(false, true) {
+			job()
+		}
+	}
+	select {
+	case <-p.quit:
+		return context.Canceled
+	default:
+	}
+	select {
+	case p.jobs <- run:
+	default:
+		return ErrBusy
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if claimed.CompareAndSwap(false, true) {
+			return ctx.Err()
+		}
+		// Already running: wait for it rather than leave it writing to a
+		// stream its caller has moved on from
+		<-done
+		return nil
+	}
+}
+
+func (p *TaskPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case job := <-p.jobs:
+			p.active.Add(1)
+			job()
+			p.active.Add(-1)
+		}
+	}
+}
+
+// Queued returns how many tasks wait for a worker.
+func (p *TaskPool) Queued() int {
+	return len(p.jobs)
+}
+
+// Active returns how many workers are running a task.
+func (p *TaskPool) Active() int {
+	return int(p.active.Load())
+}
+
+// RetryAfter returns 0 while the pool has room for another task, and
+// DefaultBusyRetryAfter while every worker is taken and the queue is full.
+// It is a CapacityFunc.
+func (p *TaskPool) RetryAfter() time.Duration {
+	if p.Active() < p.workers || len(p.jobs) < cap(p.jobs) {
+		return 0
+	}
+	return DefaultBusyRetryAfter
+}
+
+// Load returns how full the pool is, 0 when idle to 1 when every worker is
+// taken and the queue is full.
+func (p *TaskPool) Load() float64 {
+	used := float64(p.Active() + len(p.jobs))
+	return math.Min(1, used/float64(p.workers+cap(p.jobs)))
+}
+
+// Workers returns the pool's size.
+func (p *TaskPool) Workers() int {
+	return p.workers
+}
+
+// Close stops the workers once their current tasks finish. Tasks still
+// queued are dropped, and their callers get ctx's error when it ends.
+func (p *TaskPool) Close() {
+	p.stop.Do(func() { close(p.quit) })
+	p.wg.Wait()
+}
+
+// runTask runs job, which answers the peer with reply, on the node's worker
+// pool. When the pool is full the peer is told to retry later.
+func (n *AgentNode) runTask(ctx context.Context, taskID, capability string, reply func(AgentMessage), job func()) {
+	if n.Workers == nil {
+		job()
+		return
+	}
+	if err := n.Workers.Do(ctx, job); errors.Is(err, ErrBusy) {
+		n.Metrics.observeRejected()
+		n.taskStage(taskID, StageFailed, capability, err)
+		reply(n.errorMessage(ErrorPayload{Code: ErrCodeBusy, Message: "node is busy; retry later", Retryable: true}))
+	}
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fillPool occupies every worker and queue slot of p with jobs that block
+// until the returned function is called, which waits for them to drain.
+func fillPool(t *testing.T, p *TaskPool, workers, queue int) func() {
+	t.Helper()
+	release := make(chan struct{})
+	for i := 0; i < workers+queue; i++ {
+		go p.Do(context.Background(), func() { <-release })
+		// Wait for each job to land so the next one can't take its place
+		for deadline := time.Now().Add(5 * time.Second); p.Active()+p.Queued() <= i; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("job %d never reached the pool", i)
+			}
+		}
+	}
+	return func() {
+		close(release)
+		for deadline := time.Now().Add(5 * time.Second); p.Active()+p.Queued() > 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("the pool never drained")
+			}
+		}
+	}
+}
+
+func TestTaskPoolRefusesWhenFull(t *testing.T) {
+	p := NewTaskPool(2, 3)
+	defer p.Close()
+	release := fillPool(t, p, 2, 3)
+
+	if p.Active() != 2 || p.Queued() != 3 {
+		t.Fatalf("active %d, queued %d; want 2 and 3", p.Active(), p.Queued())
+	}
+	ran := false
+	if err := p.Do(context.Background(), func() { ran = true }); !errors.Is(err, ErrBusy) || ran {
+		t.Fatalf("Do on a full pool = %v (ran %v), want ErrBusy", err, ran)
+	}
+
+	// Once the workers free up, tasks run again
+	release()
+	if err := p.Do(context.Background(), func() { ran = true }); err != nil || !ran {
+		t.Fatalf("Do after draining = %v (ran %v)", err, ran)
+	}
+}
+
+func TestTaskPoolSkipsJobsWhoseCallerLeft(t *testing.T) {
+	p := NewTaskPool(1, 1)
+	defer p.Close()
+	release := fillPool(t, p, 1, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	ran := make(chan struct{}, 1)
+	if err := p.Do(ctx, func() { ran <- struct{}{} }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Do = %v, want the deadline", err)
+	}
+	release()
+	if err := p.Do(context.Background(), func() {}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+		t.Error("a job whose caller left was run")
+	default:
+	}
+}
+
+func TestSaturatedNodeAnswersBusy(t *testing.T) {
+	b := newTestNode(t)
+	b.Metrics = NewMetrics()
+	b.Workers = NewTaskPool(1, 1)
+	if err := b.LoadCapabilities([]string{writeManifest(t, summarizeManifest)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	a := startTestNode(t)
+	release := fillPool(t, b.Workers, 1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	task := map[string]interface{}{"capability": "summarize", "text": "hello"}
+	_, err := a.SendTask(ctx, dialAddr(b), task)
+	var pe *PeerError
+	if !errors.As(err, &pe) || pe.Code != ErrCodeBusy || !pe.Retryable {
+		t.Fatalf("SendTask to a saturated node = %v, want a retryable %s error", err, ErrCodeBusy)
+	}
+	if got := testutil.ToFloat64(b.Metrics.rejected); got != 1 {
+		t.Errorf("agentmesh_tasks_rejected_total = %v, want 1", got)
+	}
+
+	// Once the backlog drains the same task goes through
+	release()
+	if _, err := a.SendTask(ctx, dialAddr(b), task); err != nil {
+		t.Fatalf("SendTask after draining: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Write batching defaults: how long a batch stays open, and how many writes
+// commit it early.
+const (
+	DefaultWriteBatchInterval = 50 * time.Millisecond
+	DefaultWriteBatchSize     = 500
+)
+
+// WriteBatcher coalesces the writes the event pipeline makes for every event,
+// its dedup mark, task record, status and verdict, and the local task
+// runner's bookkeeping, into one transaction. At high event rates a
+// transaction per write spends most of its time syncing the database to disk.
+//
+// The first write opens a batch and each later one joins it; the batch
+// commits after Interval or once it holds Size writes, whichever is first,
+// and on Flush. A write runs when it is made, so MarkProcessed still reports
+// whether the event is new and a failing write returns its error, but other
+// readers of the database only see it once its batch commits.
+//
+// A batch that fails to commit, or in which a write fails, is rolled back
+// whole, and the next Flush returns why. SetCheckpoint commits the checkpoint
+// in the batch with the events before it, so after a crash the watcher never
+// resumes past an event whose writes were lost: it delivers the event again,
+// and the dedup mark, rolled back with the rest, lets it through.
+//
+// Writes other than those above, and every read, go straight to the
+// underlying store. A WriteBatcher over a store that can't open
+// transactions, or with a non-positive Interval, writes each at once.
+type WriteBatcher struct {
+	MetadataStore
+	Interval time.Duration
+	Size     int // 0 means DefaultWriteBatchSize
+
+	store   *sqlStore
+	mu      sync.Mutex
+	tx      *sqlStore // the open batch, if any
+	writes  int
+	timer   *time.Timer
+	err     error // why the last batch was lost, until Flush reports it
+	onFlush func(writes int, took time.Duration, err error)
+}
+
+// NewWriteBatcher batches writes to store with the default interval and size.
+func NewWriteBatcher(store MetadataStore) *WriteBatcher {
+	s, _ := store.(*sqlStore)
+	return &WriteBatcher{
+		MetadataStore: store,
+		Interval:      DefaultWriteBatchInterval,
+		Size:          DefaultWriteBatchSize,
+		store:         s,
+	}
+}
+
+// write runs fn in the open batch, opening one if needed, or against the
+// store itself when batching is off.
+func (b *WriteBatcher) write(fn func(MetadataStore) error) error {
+	if !b.batching() {
+		return fn(b.MetadataStore)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writeLocked(fn)
+}
+
+func (b *WriteBatcher) batching() bool {
+	return b.store != nil && b.Interval > 0
+}
+
+// writeLocked is write with b.mu held.
+func (b *WriteBatcher) writeLocked(fn func(MetadataStore) error) error {
+	if b.tx == nil {
+		tx, err := b.store.begin()
+		if err != nil {
+			return err
+		}
+		b.tx, b.writes = tx, 0
+		b.timer = time.AfterFunc(b.Interval, b.flushDue)
+	}
+	if err := fn(b.tx); err != nil {
+		b.rollback(err)
+		return err
+	}
+	b.writes++
+	size := b.Size
+	if size <= 0 {
+		size = DefaultWriteBatchSize
+	}
+	if b.writes >= size {
+		return b.commit()
+	}
+	return nil
+}
+
+// flushDue commits a batch whose interval is up. Nobody waits on it, so a
+// failure is kept for the next Flush.
+func (b *WriteBatcher) flushDue() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tx != nil {
+		if err := b.commit(); err != nil {
+			fmt.Printf("[DB] Failed to commit a batch of writes: %v\n", err)
+		}
+	}
+}
+
+// commit ends the open batch. Called with b.mu held.
+func (b *WriteBatcher) commit() error {
+	b.timer.Stop()
+	start := time.Now()
+	err := b.tx.tx.Commit()
+	if b.onFlush != nil {
+		b.onFlush(b.writes, time.Since(start), err)
+	}
+	if err != nil {
+		b.err = fmt.Errorf("batch of %d writes lost: %w", b.writes, err)
+	}
+	b.tx = nil
+	return err
+}
+
+// rollback abandons the open batch because a write in it failed. Called
+// with b.mu held.
+func (b *WriteBatcher) rollback(cause error) {
+	b.timer.Stop()
+	b.tx.tx.Rollback()
+	if b.onFlush != nil {
+		b.onFlush(b.writes, 0, cause)
+	}
+	b.err = fmt.Errorf("batch of %d writes rolled back: %w", b.writes, cause)
+	b.tx = nil
+}
+
+// Flush commits the open batch. It fails if the batch didn't commit, or if
+// an earlier batch was lost since the last Flush.
+func (b *WriteBatcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tx != nil {
+		b.commit()
+	}
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// MarkProcessed records an event ID in the batch and reports whether it was
+// new, counting the IDs marked earlier in the batch.
+func (b *WriteBatcher) MarkProcessed(id string) (bool, error) {
+	var isNew bool
+	err := b.write(func(s MetadataStore) (err error) {
+		isNew, err = s.MarkProcessed(id)
+		return err
+	})
+	return isNew, err
+}
+
+func (b *WriteBatcher) SaveTask(t TaskRecord) error {
+	return b.write(func(s MetadataStore) error { return s.SaveTask(t) })
+}
+
+func (b *WriteBatcher) UpdateTaskStatus(id, status string) error {
+	return b.write(func(s MetadataStore) error { return s.UpdateTaskStatus(id, status) })
+}
+
+func (b *WriteBatcher) SetTaskVerdict(id string, v Verdict) error {
+	return b.write(func(s MetadataStore) error { return s.SetTaskVerdict(id, v) })
+}
+
+func (b *WriteBatcher) RecordTaskRun(capability string, d time.Duration) error {
+	return b.write(func(s MetadataStore) error { return s.RecordTaskRun(capability, d) })
+}
+
+// SetCheckpoint adds the checkpoint to the batch and commits it, so the
+// checkpoint is saved only with the writes of the events it covers. If a
+// batch was lost since the last Flush, the checkpoint isn't saved at all and
+// SetCheckpoint returns why.
+func (b *WriteBatcher) SetCheckpoint(name string, block uint64) error {
+	if !b.batching() {
+		return b.MetadataStore.SetCheckpoint(name, block)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	if b.err == nil {
+		err = b.writeLocked(func(s MetadataStore) error { return s.SetCheckpoint(name, block) })
+		if err == nil && b.tx != nil {
+			err = b.commit()
+		}
+	}
+	if b.err != nil {
+		err = b.err
+	}
+	b.err = nil
+	return err
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// intakeRate runs n task events through an intake writing to store and
+// returns the events handled per second, counting the final commit.
+func intakeRate(t *testing.T, store MetadataStore, n int, flush func() error) float64 {
+	t.Helper()
+	intake := NewTaskIntake(store, nil, nil)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		d := intake.HandleTask(TaskCreatedEvent{TaskId: big.NewInt(int64(i)), Client: common.HexToAddress("0xc1"), Block: uint64(i)})
+		if d.Action != ActionSkip || d.Reason != "task carries no payment" {
+			t.Fatalf("event %d: %+v", i, d)
+		}
+	}
+	if err := flush(); err != nil {
+		t.Fatal(err)
+	}
+	return float64(n) / time.Since(start).Seconds()
+}
+
+func TestBatchedWritesOutrunPerEventTransactions(t *testing.T) {
+	const events = 300
+	direct := intakeRate(t, newTestStore(t), events, func() error { return nil })
+
+	store := newTestStore(t)
+	b := NewWriteBatcher(store)
+	b.Interval = time.Minute
+	var commits int
+	b.onFlush = func(int, time.Duration, error) { commits++ }
+	batched := intakeRate(t, b, events, b.Flush)
+	t.Logf("%.0f events/s a transaction per write, %.0f batched", direct, batched)
+
+	// The race detector slows the batched, CPU-bound path far more than the
+	// fsyncs a transaction per write waits on
+	if batched < 2*direct && !raceEnabled {
+		t.Errorf("batched writes ran %.0f events/s, want at least twice the %.0f of a transaction per write", batched, direct)
+	}
+	// Each event marks, saves and settles its task
+	if want := events * 3 / DefaultWriteBatchSize; commits != want+1 {
+		t.Errorf("%d commits, want %d full batches and the flush", commits, want)
+	}
+	if task, err := store.GetTask(fmt.Sprintf("%s:%d", TaskKindEscrow, events-1)); err != nil || task.Status != TaskStatusSkipped {
+		t.Errorf("last task = %+v, %v, want it settled once flushed", task, err)
+	}
+}
+
+func TestBatchCommitsWhenItsIntervalIsUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta.db")
+	store, err := OpenMetadataStore(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	b := NewWriteBatcher(store)
+	b.Interval = 20 * time.Millisecond
+
+	if isNew, err := b.MarkProcessed("e1"); !isNew || err != nil {
+		t.Fatalf("MarkProcessed = %v, %v", isNew, err)
+	}
+	if isNew, _ := b.MarkProcessed("e1"); isNew {
+		t.Error("an event marked earlier in the batch was new")
+	}
+	// Another process sees nothing until the batch commits
+	other, err := OpenMetadataStoreReadOnly(DriverSQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	processed := func() (n int) {
+		other.(*sqlStore).queryRow("SELECT COUNT(*) FROM processed_events").Scan(&n)
+		return n
+	}
+	if n := processed(); n != 0 {
+		t.Fatalf("%d events visible before the batch committed", n)
+	}
+	for wait := time.Now().Add(5 * time.Second); time.Now().Before(wait); time.Sleep(5 * time.Millisecond) {
+		if processed() == 1 {
+			return
+		}
+	}
+	t.Error("the batch didn't commit after its interval")
+}
+
+func TestLostBatchHoldsBackTheCheckpoint(t *testing.T) {
+	store := newTestStore(t)
+	b := NewWriteBatcher(store)
+	b.Interval = time.Minute
+	// A write in the batch will fail
+	if _, err := store.(*sqlStore).exec("DROP TABLE task_runs"); err != nil {
+		t.Fatal(err)
+	}
+
+	b.MarkProcessed("e1")
+	if err := b.RecordTaskRun("summarize", time.Second); err == nil {
+		t.Fatal("recorded a run with no table to record it in")
+	}
+	if err := b.SetCheckpoint("watcher", 10); err == nil {
+		t.Error("checkpointed past an event whose writes were rolled back")
+	}
+	if _, ok, _ := store.GetCheckpoint("watcher"); ok {
+		t.Error("the checkpoint was saved")
+	}
+
+	// Delivered again, the event is new, and the next checkpoint commits
+	if isNew, err := b.MarkProcessed("e1"); !isNew || err != nil {
+		t.Errorf("redelivered event: MarkProcessed = %v, %v, want new", isNew, err)
+	}
+	if err := b.SetCheckpoint("watcher", 10); err != nil {
+		t.Fatal(err)
+	}
+	if block, ok, _ := store.GetCheckpoint("watcher"); !ok || block != 10 {
+		t.Errorf("checkpoint = %d, %v, want 10", block, ok)
+	}
+	if isNew, _ := store.MarkProcessed("e1"); isNew {
+		t.Error("the event's mark wasn't committed with the checkpoint")
+	}
+}
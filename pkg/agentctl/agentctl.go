@@ -0,0 +1,180 @@
+// Package agentctl manages remote agentmesh nodes through their NodeControl
+// gRPC API ('agent run -grpc'). It depends only on the generated controlpb
+// package, not on the node or libp2p.
+package agentctl
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+
+	"agentmesh/pkg/controlpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ErrStopWatching, returned by a WatchEvents callback, ends the watch without
+// an error.
+var ErrStopWatching = errors.New("stop watching")
+
+// Client is a connection to one node.
+type Client struct {
+	conn *grpc.ClientConn
+	rpc  controlpb.NodeControlClient
+}
+
+type options struct {
+	token string
+	tls   *tls.Config
+}
+
+// Option configures Dial.
+type Option func(*options)
+
+// WithToken authenticates with the node's API token.
+func WithToken(token string) Option {
+	return func(o *options) { o.token = token }
+}
+
+// WithTLS connects over TLS; set Certificates for nodes that require client
+// certificates.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) { o.tls = config }
+}
+
+// Dial connects to the node serving gRPC on addr. The connection is made
+// lazily, so errors surface on the first call.
+func Dial(addr string, opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	creds := insecure.NewCredentials()
+	if o.tls != nil {
+		creds = credentials.NewTLS(o.tls)
+	}
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if o.token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(bearerToken(o.token)))
+	}
+	conn, err := grpc.NewClient(addr, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, rpc: controlpb.NewNodeControlClient(conn)}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// bearerToken sends the API token with every call. Like the HTTP API, it is
+// allowed without TLS for nodes reached over loopback.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// Status returns a snapshot of the node.
+func (c *Client) Status(ctx context.Context) (*controlpb.NodeStatus, error) {
+	return c.rpc.GetStatus(ctx, &controlpb.GetStatusRequest{})
+}
+
+// Tasks returns the most recent tasks, newest first; limit 0 means 100.
+func (c *Client) Tasks(ctx context.Context, limit int) ([]*controlpb.Task, error) {
+	res, err := c.rpc.ListTasks(ctx, &controlpb.ListTasksRequest{Limit: int32(limit)})
+	return res.GetTasks(), err
+}
+
+// Task returns a task by ID.
+func (c *Client) Task(ctx context.Context, id string) (*controlpb.Task, error) {
+	return c.rpc.GetTask(ctx, &controlpb.GetTaskRequest{Id: id})
+}
+
+// SubmitTask queues a task for one of the node's manifest capabilities. The
+// payload must convert to a protobuf Struct: JSON-like maps, slices, strings,
+// numbers and bools.
+func (c *Client) SubmitTask(ctx context.Context, capability string, payload map[string]interface{}) (*controlpb.Task, error) {
+	p, err := structpb.NewStruct(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.rpc.SubmitTask(ctx, &controlpb.SubmitTaskRequest{Capability: capability, Payload: p})
+}
+
+// DeleteTask forgets a finished task.
+func (c *Client) DeleteTask(ctx context.Context, id string) error {
+	_, err := c.rpc.DeleteTask(ctx, &controlpb.DeleteTaskRequest{Id: id})
+	return err
+}
+
+// Peers returns the node's peer directory.
+func (c *Client) Peers(ctx context.Context) ([]*controlpb.Peer, error) {
+	res, err := c.rpc.ListPeers(ctx, &controlpb.ListPeersRequest{})
+	return res.GetPeers(), err
+}
+
+// BlockPeer blocks a peer and drops its connections.
+func (c *Client) BlockPeer(ctx context.Context, peerID string) (*controlpb.Peer, error) {
+	return c.rpc.BlockPeer(ctx, &controlpb.BlockPeerRequest{PeerId: peerID})
+}
+
+// Routes returns the capabilities the node knows live peers for.
+func (c *Client) Routes(ctx context.Context) ([]*controlpb.Route, error) {
+	res, err := c.rpc.ListRoutes(ctx, &controlpb.ListRoutesRequest{})
+	return res.GetRoutes(), err
+}
+
+// Capabilities returns the manifest capabilities the node serves.
+func (c *Client) Capabilities(ctx context.Context) ([]*controlpb.Capability, error) {
+	res, err := c.rpc.ListCapabilities(ctx, &controlpb.ListCapabilitiesRequest{})
+	return res.GetCapabilities(), err
+}
+
+// AddCapabilities loads a capability manifest (YAML) into the node and
+// returns the capabilities it added.
+func (c *Client) AddCapabilities(ctx context.Context, manifest []byte) ([]*controlpb.Capability, error) {
+	res, err := c.rpc.AddCapabilities(ctx, &controlpb.AddCapabilitiesRequest{Manifest: manifest})
+	return res.GetCapabilities(), err
+}
+
+// WatchEvents calls fn with each node event after sequence number after,
+// first the buffered ones, then new ones as they happen. It returns when ctx
+// ends, the stream fails, or fn returns an error; ErrStopWatching ends it
+// with nil.
+func (c *Client) WatchEvents(ctx context.Context, after uint64, fn func(*controlpb.Event) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.rpc.Events(ctx, &controlpb.EventsRequest{AfterSeq: after})
+	if err != nil {
+		return err
+	}
+	for {
+		e, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := fn(e); err != nil {
+			if errors.Is(err, ErrStopWatching) {
+				return nil
+			}
+			return err
+		}
+	}
+}
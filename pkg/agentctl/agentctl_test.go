@@ -0,0 +1,231 @@
+package agentctl_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"agentmesh/pkg/agent"
+	"agentmesh/pkg/agentctl"
+	"agentmesh/pkg/controlpb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testToken = "s3cret"
+
+const summarizeManifest = `
+version: 1
+capabilities:
+  - name: summarize
+    description: Summarize a document
+    handler: echo
+    schema:
+      type: object
+      required: [text]
+      properties:
+        text: {type: string, minLength: 1}
+    pricing: {amount: "1000", unit: task}
+`
+
+// startNode starts a node on loopback serving gRPC with tlsConfig, if given.
+func startNode(t *testing.T, token string, tlsConfig *tls.Config) *agent.AgentNode {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := agent.OpenMetadataStore(agent.DriverSQLite, filepath.Join(dir, "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := agent.NewAgentNodeWithStore(store, dir)
+	t.Cleanup(func() { n.Stop() })
+	n.APIToken = token
+	n.ResultsDir = filepath.Join(dir, "results")
+	if err := n.Start("/ip4/127.0.0.1/tcp/0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.ServeGRPC("127.0.0.1:0", tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func dial(t *testing.T, addr string, opts ...agentctl.Option) *agentctl.Client {
+	t.Helper()
+	c, err := agentctl.Dial(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSubmitTaskAndWatchCompletion(t *testing.T) {
+	n := startNode(t, testToken, nil)
+	c := dial(t, n.GRPCAddr(), agentctl.WithToken(testToken))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	st, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.GetPeerId() != n.CurrentHost().ID().String() {
+		t.Errorf("status peer = %s, want %s", st.GetPeerId(), n.CurrentHost().ID())
+	}
+
+	added, err := c.AddCapabilities(ctx, []byte(summarizeManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].GetName() != "summarize" || added[0].GetPricing().GetAmount() != "1000" {
+		t.Fatalf("added %v, want summarize", added)
+	}
+	if _, err := c.AddCapabilities(ctx, []byte(summarizeManifest)); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("adding summarize twice: %v, want AlreadyExists", err)
+	}
+
+	if _, err := c.SubmitTask(ctx, "summarize", map[string]interface{}{"text": ""}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("invalid payload: %v, want InvalidArgument", err)
+	}
+	task, err := c.SubmitTask(ctx, "summarize", map[string]interface{}{"text": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.GetKind() != agent.TaskKindLocal || task.GetStatus() != agent.TaskStatusReceived {
+		t.Fatalf("submitted task = %v", task)
+	}
+
+	// The stream replays the buffered events, so the completion can't be missed
+	var resolved *controlpb.Event
+	err = c.WatchEvents(ctx, 0, func(e *controlpb.Event) error {
+		if e.GetKind() == "local_task_resolved" && e.GetData().GetStructValue().GetFields()["taskId"].GetStringValue() == task.GetId() {
+			resolved = e
+			return agentctl.ErrStopWatching
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("watching events: %v", err)
+	}
+	result := resolved.GetData().GetStructValue().GetFields()["result"].GetStringValue()
+
+	done, err := c.Task(ctx, task.GetId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.GetStatus() != agent.TaskStatusResolved || done.GetResult() != result {
+		t.Errorf("task = %v, want resolved with result %s", done, result)
+	}
+	if _, err := os.Stat(result); err != nil {
+		t.Errorf("result file: %v", err)
+	}
+
+	if err := c.DeleteTask(ctx, task.GetId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Task(ctx, task.GetId()); status.Code(err) != codes.NotFound {
+		t.Errorf("deleted task: %v, want NotFound", err)
+	}
+}
+
+func TestRejectsWrongToken(t *testing.T) {
+	n := startNode(t, testToken, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, opts := range [][]agentctl.Option{nil, {agentctl.WithToken("guess")}} {
+		c := dial(t, n.GRPCAddr(), opts...)
+		if _, err := c.Status(ctx); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("status: %v, want Unauthenticated", err)
+		}
+		err := c.WatchEvents(ctx, 0, func(*controlpb.Event) error { return nil })
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("events: %v, want Unauthenticated", err)
+		}
+	}
+}
+
+func TestServeGRPCNeedsAuth(t *testing.T) {
+	n := startNode(t, testToken, nil)
+	n.APIToken = ""
+	if err := n.ServeGRPC("127.0.0.1:0", nil); err == nil {
+		t.Error("served gRPC with neither a token nor client certificates")
+	}
+}
+
+// testCerts issues a CA, a server certificate for 127.0.0.1 and a client
+// certificate.
+func testCerts(t *testing.T) (pool *x509.CertPool, server, client tls.Certificate) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pool = x509.NewCertPool()
+	pool.AddCert(ca)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "agentmesh"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pool, issue(2, x509.ExtKeyUsageServerAuth), issue(3, x509.ExtKeyUsageClientAuth)
+}
+
+func TestMutualTLS(t *testing.T) {
+	pool, server, client := testCerts(t)
+	n := startNode(t, "", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := dial(t, n.GRPCAddr(), agentctl.WithTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{client}}))
+	if _, err := c.Status(ctx); err != nil {
+		t.Fatalf("with a client certificate: %v", err)
+	}
+
+	anon := dial(t, n.GRPCAddr(), agentctl.WithTLS(&tls.Config{RootCAs: pool}))
+	if _, err := anon.Status(ctx); err == nil {
+		t.Error("served a client without a certificate")
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("without a certificate: %v, want a handshake failure", err)
+	}
+}
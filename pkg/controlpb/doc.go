@@ -0,0 +1,6 @@
+// Package controlpb holds the protobuf definitions of the NodeControl gRPC
+// service. The Go code is generated from control.proto; regenerate it with
+// go generate after editing the .proto.
+package controlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
@@ -0,0 +1,216 @@
+// Package mcp serves tools over the Model Context Protocol, so local LLM
+// agents can call them. It speaks JSON-RPC 2.0 over stdio, one message per
+// line, or over HTTP with server-sent events, as in the 2024-11-05 revision
+// of the spec. It knows nothing about the mesh; 'agent mcp serve' supplies
+// the tools.
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ProtocolVersion is the MCP revision the server implements.
+const ProtocolVersion = "2024-11-05"
+
+// maxMessageSize bounds one stdio message.
+const maxMessageSize = 4 << 20
+
+// JSON-RPC error codes.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// Tool is a function an MCP client may call. InputSchema is the JSON Schema
+// of its arguments.
+type Tool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+
+	// Call runs the tool. Its result is sent to the client as JSON text; an
+	// error is reported as a failed tool call, which the model gets to see.
+	Call func(ctx context.Context, args map[string]interface{}) (interface{}, error) `json:"-"`
+}
+
+// ToolSource lists the tools on offer. It is asked on every tools/list and
+// tools/call, so tools may come and go while the server runs.
+type ToolSource func(ctx context.Context) ([]Tool, error)
+
+// Server answers MCP requests with the tools from its ToolSource.
+type Server struct {
+	name    string
+	version string
+	tools   ToolSource
+
+	mu       sync.Mutex
+	sessions map[string]chan []byte // SSE sessions, by ID
+}
+
+// NewServer creates a server introducing itself as name and version.
+func NewServer(name, version string, tools ToolSource) *Server {
+	return &Server{name: name, version: version, tools: tools, sessions: map[string]chan []byte{}}
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a JSON-RPC error.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// Content is one item of a tool result. The server only sends text.
+type Content struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// CallResult is the result of tools/call.
+type CallResult struct {
+	Content []Content `json:"content"`
+	IsError bool      `json:"isError,omitempty"`
+}
+
+// Handle answers one JSON-RPC message. It returns nil for notifications,
+// which get no response.
+func (s *Server) Handle(ctx context.Context, msg []byte) []byte {
+	var req request
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return encode(response{ID: json.RawMessage("null"), Error: &Error{CodeParseError, "parse error: " + err.Error()}})
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		if req.ID == nil {
+			return nil
+		}
+		return encode(response{ID: req.ID, Error: &Error{CodeInvalidRequest, "not a JSON-RPC 2.0 request"}})
+	}
+
+	result, err := s.dispatch(ctx, req)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{CodeInternalError, err.Error()}
+		}
+		return encode(response{ID: req.ID, Error: rpcErr})
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+	return encode(response{ID: req.ID, Result: result})
+}
+
+func (s *Server) dispatch(ctx context.Context, req request) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"protocolVersion": ProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": s.name, "version": s.version},
+		}, nil
+	case "notifications/initialized", "notifications/cancelled":
+		return nil, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		tools, err := s.tools(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if tools == nil {
+			tools = []Tool{}
+		}
+		return map[string]interface{}{"tools": tools}, nil
+	case "tools/call":
+		return s.call(ctx, req.Params)
+	}
+	return nil, &Error{CodeMethodNotFound, fmt.Sprintf("method %q not found", req.Method)}
+}
+
+func (s *Server) call(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var params struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil || params.Name == "" {
+		return nil, &Error{CodeInvalidParams, "tools/call needs a tool name"}
+	}
+	tools, err := s.tools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tools {
+		if t.Name != params.Name {
+			continue
+		}
+		if params.Arguments == nil {
+			params.Arguments = map[string]interface{}{}
+		}
+		out, err := t.Call(ctx, params.Arguments)
+		if err != nil {
+			return CallResult{Content: []Content{{Type: "text", Text: err.Error()}}, IsError: true}, nil
+		}
+		text, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return CallResult{Content: []Content{{Type: "text", Text: string(text)}}}, nil
+	}
+	return nil, &Error{CodeInvalidParams, fmt.Sprintf("unknown tool %q", params.Name)}
+}
+
+func encode(resp response) []byte {
+	resp.JSONRPC = "2.0"
+	raw, _ := json.Marshal(resp)
+	return raw
+}
+
+// ServeStdio answers the newline-delimited messages read from in on out,
+// until in ends or ctx is done.
+func (s *Server) ServeStdio(ctx context.Context, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if resp := s.Handle(ctx, line); resp != nil {
+			if _, err := out.Write(append(resp, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,193 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer() *Server {
+	return NewServer("test", "1.0", func(ctx context.Context) ([]Tool, error) {
+		return []Tool{{
+			Name:        "echo",
+			Description: "Echo the text back",
+			InputSchema: map[string]interface{}{"type": "object", "required": []string{"text"}},
+			Call: func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+				text, _ := args["text"].(string)
+				if text == "" {
+					return nil, errors.New("text is required")
+				}
+				return map[string]string{"echo": text}, nil
+			},
+		}}, nil
+	})
+}
+
+// rpcResponse is a response as a client decodes it.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *Error          `json:"error"`
+}
+
+func TestStdioScriptedSession(t *testing.T) {
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- testServer().ServeStdio(context.Background(), serverIn, serverOut) }()
+	responses := bufio.NewScanner(clientIn)
+
+	// Each step sends one line and, unless it is a notification, reads one
+	// response line
+	script := []struct {
+		send string
+		want func(t *testing.T, r rpcResponse)
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2024-11-05","capabilities":{},"clientInfo":{"name":"script","version":"0"}}}`,
+			func(t *testing.T, r rpcResponse) {
+				var res struct {
+					ProtocolVersion string                 `json:"protocolVersion"`
+					ServerInfo      map[string]string      `json:"serverInfo"`
+					Capabilities    map[string]interface{} `json:"capabilities"`
+				}
+				json.Unmarshal(r.Result, &res)
+				if res.ProtocolVersion != ProtocolVersion || res.ServerInfo["name"] != "test" || res.Capabilities["tools"] == nil {
+					t.Errorf("initialize = %s", r.Result)
+				}
+			}},
+		{`{"jsonrpc":"2.0","method":"notifications/initialized"}`, nil},
+		{`{"jsonrpc":"2.0","id":"list","method":"tools/list"}`,
+			func(t *testing.T, r rpcResponse) {
+				var res struct {
+					Tools []Tool `json:"tools"`
+				}
+				json.Unmarshal(r.Result, &res)
+				if string(r.ID) != `"list"` || len(res.Tools) != 1 || res.Tools[0].Name != "echo" || res.Tools[0].InputSchema["type"] != "object" {
+					t.Errorf("tools/list = %s (id %s)", r.Result, r.ID)
+				}
+			}},
+		{`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"echo","arguments":{"text":"hi"}}}`,
+			func(t *testing.T, r rpcResponse) {
+				var res CallResult
+				json.Unmarshal(r.Result, &res)
+				if res.IsError || len(res.Content) != 1 || res.Content[0].Type != "text" || !strings.Contains(res.Content[0].Text, `"echo": "hi"`) {
+					t.Errorf("tools/call = %s", r.Result)
+				}
+			}},
+		{`{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"echo","arguments":{}}}`,
+			func(t *testing.T, r rpcResponse) {
+				var res CallResult
+				json.Unmarshal(r.Result, &res)
+				if !res.IsError || res.Content[0].Text != "text is required" {
+					t.Errorf("failed tools/call = %s, want an error result", r.Result)
+				}
+			}},
+		{`{"jsonrpc":"2.0","id":5,"method":"tools/call","params":{"name":"nope"}}`,
+			func(t *testing.T, r rpcResponse) {
+				if r.Error == nil || r.Error.Code != CodeInvalidParams {
+					t.Errorf("unknown tool: error = %+v, want %d", r.Error, CodeInvalidParams)
+				}
+			}},
+		{`{"jsonrpc":"2.0","id":6,"method":"resources/list"}`,
+			func(t *testing.T, r rpcResponse) {
+				if r.Error == nil || r.Error.Code != CodeMethodNotFound {
+					t.Errorf("unknown method: error = %+v, want %d", r.Error, CodeMethodNotFound)
+				}
+			}},
+		{`{not json`,
+			func(t *testing.T, r rpcResponse) {
+				if r.Error == nil || r.Error.Code != CodeParseError || string(r.ID) != "null" {
+					t.Errorf("bad JSON: %+v (id %s), want a parse error for id null", r.Error, r.ID)
+				}
+			}},
+	}
+	for _, step := range script {
+		if _, err := io.WriteString(clientOut, step.send+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		if step.want == nil {
+			continue
+		}
+		if !responses.Scan() {
+			t.Fatalf("no response to %s: %v", step.send, responses.Err())
+		}
+		var r rpcResponse
+		if err := json.Unmarshal(responses.Bytes(), &r); err != nil || r.JSONRPC != "2.0" {
+			t.Fatalf("response to %s is not JSON-RPC: %s", step.send, responses.Bytes())
+		}
+		step.want(t, r)
+	}
+
+	clientOut.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeStdio = %v after the client hung up, want nil", err)
+	}
+}
+
+func TestSSETransport(t *testing.T) {
+	srv := httptest.NewServer(testServer().SSEHandler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/sse", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewScanner(resp.Body)
+	next := func() (event, data string) {
+		for events.Scan() {
+			line := events.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event != "":
+				return event, data
+			}
+		}
+		t.Fatalf("stream ended: %v", events.Err())
+		return "", ""
+	}
+
+	event, endpoint := next()
+	if event != "endpoint" || !strings.HasPrefix(endpoint, "/message?sessionId=") {
+		t.Fatalf("first event = %s %q, want the message endpoint", event, endpoint)
+	}
+	post, err := http.Post(srv.URL+endpoint, "application/json",
+		strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"echo","arguments":{"text":"over sse"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusAccepted {
+		t.Errorf("POST = %d, want 202", post.StatusCode)
+	}
+
+	event, data := next()
+	var r rpcResponse
+	json.Unmarshal([]byte(data), &r)
+	if event != "message" || string(r.ID) != "1" || !strings.Contains(string(r.Result), "over sse") {
+		t.Errorf("response event = %s %s", event, data)
+	}
+
+	post, err = http.Post(srv.URL+"/message?sessionId=nope", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusNotFound {
+		t.Errorf("POST to an unknown session = %d, want 404", post.StatusCode)
+	}
+}
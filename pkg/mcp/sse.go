@@ -0,0 +1,91 @@
+package mcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sseKeepAlive is how often an idle event stream sends a comment, so proxies
+// don't time it out.
+const sseKeepAlive = 15 * time.Second
+
+// SSEHandler serves the HTTP transport. A client opens GET /sse, whose first
+// event names the endpoint to POST its messages to; the responses arrive as
+// "message" events on the stream.
+func (s *Server) SSEHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sse", s.serveStream)
+	mux.HandleFunc("POST /message", s.serveMessage)
+	return mux
+}
+
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	session := hex.EncodeToString(id)
+	out := make(chan []byte, 16)
+	s.mu.Lock()
+	s.sessions[session] = out
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, session)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "event: endpoint\ndata: /message?sessionId=%s\n\n", session)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-out:
+			if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", msg); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Server) serveMessage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	out, ok := s.sessions[r.URL.Query().Get("sessionId")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	msg, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	if resp := s.Handle(r.Context(), msg); resp != nil {
+		select {
+		case out <- resp:
+		case <-r.Context().Done():
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockFiresOnlyWhenAdvanced(t *testing.T) {
+	start := time.UnixMilli(1700000000000)
+	c := NewFakeClock(start)
+	ch := c.After(time.Minute)
+
+	c.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("fired before its time")
+	default:
+	}
+	c.Advance(time.Second)
+	select {
+	case got := <-ch:
+		if !got.Equal(start.Add(time.Minute)) {
+			t.Errorf("fired with %v, want %v", got, start.Add(time.Minute))
+		}
+	default:
+		t.Fatal("did not fire once due")
+	}
+	if c.Waiters() != 0 {
+		t.Errorf("%d waiters left", c.Waiters())
+	}
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("After(0) did not fire at once")
+	}
+}